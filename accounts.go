@@ -0,0 +1,469 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	accountEntryLen    = secp256k1.PublicKeyLen + 8
+	submissionEntryLen = 8 + dataLen
+
+	defaultAccountPageSize = 25
+	maxAccountPageSize     = 100
+)
+
+var (
+	errAccountsDisabled    = errors.New("chain doesn't have accounts")
+	errTooManySubmissions  = errors.New("block has too many signed submissions")
+	errBadSubmissionNonce  = errors.New("signed submission has the wrong nonce")
+	errNoSuchAccount       = errors.New("address has no accepted submissions")
+	errUsedSubmissionNonce = errors.New("signed submission's nonce is already used")
+	errBadAccountEntry     = fmt.Errorf("account entry must be %d bytes", accountEntryLen)
+	errBadSubmissionEntry  = fmt.Errorf("submission entry must be %d bytes", submissionEntryLen)
+)
+
+// SignedSubmission is a piece of data signed by its submitter. Each
+// address's submissions are accepted in the order of their nonces, starting
+// at 0, so a submission can't be replayed. The submitter's account, its
+// public key and next nonce, is created by its first accepted submission.
+type SignedSubmission struct {
+	Nonce uint64        `serialize:"true"`
+	Data  [dataLen]byte `serialize:"true"`
+	// Namespace of [Data] on chains whose data has namespaces. Zero
+	// otherwise.
+	Namespace [NamespaceLen]byte `namespace:"true"`
+	// Submitter's signature of the submission's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	submitterKey *secp256k1.PublicKey // public key of this submission's submitter, if recovered
+}
+
+// Hash returns the hash of [s] on the chain [chainID], which is what the
+// submitter signs
+func (s *SignedSubmission) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+8+dataLen+NamespaceLen)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, submissionTag)
+	msg = binary.BigEndian.AppendUint64(msg, s.Nonce)
+	msg = append(msg, s.Data[:]...)
+	msg = append(msg, s.Namespace[:]...)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [s]'s signature to [key]'s signature of [s] on the chain
+// [chainID]. [key]'s address is the submitter.
+func (s *SignedSubmission) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(s.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(s.Sig[:], sig)
+	s.submitterKey = nil
+	return nil
+}
+
+// submitter returns the public key that signed [s] on the chain [chainID]
+func (s *SignedSubmission) submitter(chainID ids.ID) (*secp256k1.PublicKey, error) {
+	if s.submitterKey != nil {
+		return s.submitterKey, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(s.Hash(chainID), s.Sig[:])
+	if err != nil {
+		return nil, err
+	}
+	s.submitterKey = key
+	return key, nil
+}
+
+// submitterAccount is the public key and next submission nonce of an
+// address
+type submitterAccount struct {
+	publicKey [secp256k1.PublicKeyLen]byte
+	nonce     uint64
+}
+
+func parseSubmitterAccount(b []byte) (submitterAccount, error) {
+	if len(b) != accountEntryLen {
+		return submitterAccount{}, errBadAccountEntry
+	}
+	return submitterAccount{
+		publicKey: [secp256k1.PublicKeyLen]byte(b),
+		nonce:     binary.BigEndian.Uint64(b[secp256k1.PublicKeyLen:]),
+	}, nil
+}
+
+func (a submitterAccount) bytes() []byte {
+	return binary.BigEndian.AppendUint64(a.publicKey[:], a.nonce)
+}
+
+// submissionEntry is an accepted submission: its nonce, the height of its
+// block and its data
+type submissionEntry struct {
+	nonce  uint64
+	height uint64
+	data   [dataLen]byte
+}
+
+func parseSubmissionEntry(nonce uint64, b []byte) (submissionEntry, error) {
+	if len(b) != submissionEntryLen {
+		return submissionEntry{}, errBadSubmissionEntry
+	}
+	return submissionEntry{
+		nonce:  nonce,
+		height: binary.BigEndian.Uint64(b),
+		data:   [dataLen]byte(b[8:]),
+	}, nil
+}
+
+func (e submissionEntry) bytes() []byte {
+	b := make([]byte, 8, submissionEntryLen)
+	binary.BigEndian.PutUint64(b, e.height)
+	return append(b, e.data[:]...)
+}
+
+// submissionNonceAfter returns the nonce of [addr]'s next submission after
+// [blk] is accepted
+func (vm *VM) submissionNonceAfter(blk *Block, addr ids.ShortID) (uint64, error) {
+	// Processing ancestors' submissions aren't persisted yet
+	ancestors, err := vm.processingAncestors(blk)
+	if err != nil {
+		return 0, err
+	}
+	var processing uint64
+	for _, ancestor := range ancestors {
+		for i := range ancestor.Submissions {
+			key, err := ancestor.Submissions[i].submitter(vm.ctx.ChainID)
+			if err != nil {
+				return 0, err
+			}
+			if key.Address() == addr {
+				processing++
+			}
+		}
+	}
+	a, err := vm.state.getSubmitterAccount(addr)
+	switch err {
+	case nil:
+		return a.nonce + processing, nil
+	case database.ErrNotFound:
+		return processing, nil
+	default:
+		return 0, err
+	}
+}
+
+// verifySubmissions returns nil iff each of [b]'s submissions has its
+// submitter's next nonce after [parent] is accepted and the submissions
+// before it in [b]
+func (b *Block) verifySubmissions(parent *Block) error {
+	switch {
+	case len(b.Submissions) == 0:
+		return nil
+	case !b.vm.genesis.Params.Accounts:
+		return errAccountsDisabled
+	case len(b.Submissions) > maxBatchSize:
+		return errTooManySubmissions
+	}
+	nonces := make(map[ids.ShortID]uint64)
+	for i := range b.Submissions {
+		s := &b.Submissions[i]
+		key, err := s.submitter(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		addr := key.Address()
+		nonce, ok := nonces[addr]
+		if !ok {
+			if nonce, err = b.vm.submissionNonceAfter(parent, addr); err != nil {
+				return err
+			}
+		}
+		if s.Nonce != nonce {
+			return errBadSubmissionNonce
+		}
+		nonces[addr] = nonce + 1
+	}
+	return nil
+}
+
+// applySubmissions increments the nonce of the account of each of [b]'s
+// submitters, creating the account if it's the submitter's first
+// submission, and records the submissions in the account's history
+func (b *Block) applySubmissions() error {
+	for i := range b.Submissions {
+		s := &b.Submissions[i]
+		key, err := s.submitter(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		addr := key.Address()
+		a := submitterAccount{
+			publicKey: [secp256k1.PublicKeyLen]byte(key.Bytes()),
+			nonce:     s.Nonce + 1,
+		}
+		if err := b.vm.state.putSubmitterAccount(addr, a); err != nil {
+			return err
+		}
+		e := submissionEntry{nonce: s.Nonce, height: b.Height(), data: s.Data}
+		if err := b.vm.state.putSubmission(addr, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingSubmissions holds signed submissions submitted over the API until
+// they are accepted
+type pendingSubmissions struct {
+	lock        sync.Mutex
+	submissions []SignedSubmission
+}
+
+// add adds [s] to the pending submissions
+func (p *pendingSubmissions) add(s SignedSubmission) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.submissions = append(p.submissions, s)
+}
+
+// next returns up to [limit] pending submissions that can be accepted in a
+// child of [parent] with parameters [params], timestamp [timestamp] and the
+// data [data]. Submissions whose nonces aren't their submitter's next nonce
+// stay pending until the submissions before them are accepted.
+func (p *pendingSubmissions) next(vm *VM, parent *Block, params *ChainParams, timestamp time.Time, data [][dataLen]byte, namespaces [][NamespaceLen]byte, limit int) []SignedSubmission {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	limit = min(limit, maxBatchSize)
+	nonces := make(map[ids.ShortID]uint64)
+	var next []SignedSubmission
+	included := set.NewSet[int](len(p.submissions))
+	for found := true; found && len(next) < limit; {
+		found = false
+		for i := range p.submissions {
+			s := &p.submissions[i]
+			if included.Contains(i) {
+				continue
+			}
+			key, err := s.submitter(vm.ctx.ChainID)
+			if err != nil {
+				continue
+			}
+			addr := key.Address()
+			nonce, ok := nonces[addr]
+			if !ok {
+				if nonce, err = vm.submissionNonceAfter(parent, addr); err != nil {
+					continue
+				}
+			}
+			nonces[addr] = nonce
+			if s.Nonce != nonce {
+				continue
+			}
+			if vm.verifySignedData(parent, params, timestamp, addr, s.Data, s.Namespace) != nil || !vm.fitsBlock(data, namespaces, s.Data, s.Namespace) {
+				continue
+			}
+			nonces[addr]++
+			included.Add(i)
+			next = append(next, *s)
+			data = append(data, s.Data)
+			namespaces = append(namespaces, s.Namespace)
+			found = true
+			if len(next) == limit {
+				break
+			}
+		}
+	}
+	return next
+}
+
+// prune drops the pending submissions whose nonces were used
+func (p *pendingSubmissions) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.submissions, err = pruneOps(vm.opJournal, submissionKind, p.submissions, func(s *SignedSubmission) bool {
+		key, err := s.submitter(vm.ctx.ChainID)
+		if err != nil {
+			return false
+		}
+		a, err := vm.state.getSubmitterAccount(key.Address())
+		return err == database.ErrNotFound || (err == nil && s.Nonce >= a.nonce)
+	})
+	return err
+}
+
+// len returns the number of pending submissions
+func (p *pendingSubmissions) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.submissions)
+}
+
+// SubmitSignedArgs are the arguments to SubmitSigned
+type SubmitSignedArgs struct {
+	// Position of the submission among the submitter's submissions
+	Nonce json.Uint64 `json:"nonce"`
+	// Base 58 repr. of the data
+	Data string `json:"data"`
+	// Namespace of the data on chains whose data has namespaces
+	Namespace string `json:"namespace"`
+	// Base 58 repr. of the submitter's signature of the submission
+	Signature string `json:"signature"`
+
+	data      [dataLen]byte
+	namespace [NamespaceLen]byte
+	sig       [secp256k1.SignatureLen]byte
+}
+
+func (a *SubmitSignedArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+	a.namespace = v.namespace("namespace", a.Namespace)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// SubmitSignedReply is the reply from SubmitSigned
+type SubmitSignedReply struct {
+	// Address that signed the submission
+	Submitter ids.ShortID `json:"submitter"`
+}
+
+// SubmitSigned is an API method to propose a piece of data signed by its
+// submitter. The submission is included in a block built by this node once
+// its nonce is the submitter's next nonce.
+func (s *Service) SubmitSigned(_ *http.Request, args *SubmitSignedArgs, reply *SubmitSignedReply) error {
+	if !s.backend.chainParams().Accounts {
+		return errAccountsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	submission := SignedSubmission{
+		Nonce:     uint64(args.Nonce),
+		Data:      args.data,
+		Namespace: args.namespace,
+		Sig:       args.sig,
+	}
+	key, err := submission.submitter(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	reply.Submitter = key.Address()
+	return s.backend.addSubmission(submission)
+}
+
+// GetAccountArgs are the arguments to GetAccount
+type GetAccountArgs struct {
+	Address ids.ShortID `json:"address"`
+}
+
+// GetAccountReply is the reply from GetAccount
+type GetAccountReply struct {
+	// Base 58 repr. of the account's compressed secp256k1 public key
+	PublicKey string `json:"publicKey"`
+	// Nonce of the account's next submission
+	Nonce json.Uint64 `json:"nonce"`
+}
+
+// GetAccount returns the account of [args.Address] after the last accepted
+// block. An address has an account once one of its submissions is accepted.
+func (s *Service) GetAccount(_ *http.Request, args *GetAccountArgs, reply *GetAccountReply) error {
+	if !s.backend.chainParams().Accounts {
+		return errAccountsDisabled
+	}
+	a, err := s.backend.submitterAccount(args.Address)
+	if err == database.ErrNotFound {
+		return errNoSuchAccount
+	}
+	if err != nil {
+		return err
+	}
+	reply.PublicKey = encoding.EncodeCB58(a.publicKey[:])
+	reply.Nonce = json.Uint64(a.nonce)
+	return nil
+}
+
+// GetAccountHistoryArgs are the arguments to GetAccountHistory
+type GetAccountHistoryArgs struct {
+	Address ids.ShortID `json:"address"`
+	// Nonce of the first submission that is returned
+	StartNonce json.Uint64 `json:"startNonce"`
+	// Max number of submissions to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the submissions start where the previous page's nextCursor
+	// says, instead of at [StartNonce]
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *GetAccountHistoryArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultAccountPageSize, maxAccountPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: accountHistoryCursor, direction: forward, position: uint64(a.StartNonce)})
+}
+
+// APISubmission is an accepted signed submission
+type APISubmission struct {
+	Nonce json.Uint64 `json:"nonce"`
+	// Base 58 repr. of the data
+	Data string `json:"data"`
+	// Height of the accepted block that contains the submission
+	Height json.Uint64 `json:"height"`
+}
+
+// GetAccountHistoryReply is the reply from GetAccountHistory
+type GetAccountHistoryReply struct {
+	Submissions []APISubmission `json:"submissions"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetAccountHistory returns [args.Address]'s accepted submissions in nonce
+// order, starting at [args.StartNonce]
+func (s *Service) GetAccountHistory(r *http.Request, args *GetAccountHistoryArgs, reply *GetAccountHistoryReply) error {
+	ctx := requestContext(r)
+	if !s.backend.chainParams().Accounts {
+		return errAccountsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	entries, err := s.backend.accountHistory(ctx, args.Address, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(entries) > args.limit {
+		reply.NextCursor = args.start.at(entries[args.limit].nonce).String()
+		entries = entries[:args.limit]
+	}
+	reply.Submissions = make([]APISubmission, len(entries))
+	for i, e := range entries {
+		reply.Submissions[i] = APISubmission{
+			Nonce:  json.Uint64(e.nonce),
+			Data:   encoding.EncodeCB58(e.data[:]),
+			Height: json.Uint64(e.height),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,553 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+// NamespaceLen is the length of the namespace of a piece of data
+const NamespaceLen = 4
+
+var (
+	errBadNamespace          = fmt.Errorf("namespace must be 1 to %d bytes without zero bytes", NamespaceLen)
+	errDuplicateNamespace    = errors.New("duplicate namespace")
+	errNamespaceWithoutAdmin = errors.New("namespace ACL must have an admin")
+	errACLsDisabled          = errors.New("chain doesn't have namespace ACLs")
+	errNoSuchACL             = errors.New("namespace has no ACL")
+	errTooManyACLOps         = errors.New("block has too many ACL operations")
+	errBadACLOpNonce         = errors.New("ACL operation has the wrong nonce")
+	errNotNamespaceAdmin     = errors.New("ACL operation isn't signed by an admin of the namespace")
+	errAlreadyWriter         = errors.New("address may already write to the namespace")
+	errUnknownWriter         = errors.New("address may not write to the namespace")
+	errNoWritePermission     = errors.New("block's signer may not write to the namespace of its data")
+)
+
+// NamespaceACL restricts who may write data to a namespace. Data in a
+// namespace without an ACL, or without a namespace, may be written by any
+// block signer.
+type NamespaceACL struct {
+	// Namespace, which is zero-padded to [NamespaceLen] bytes
+	Namespace string `json:"namespace"`
+	// Addresses that may grant and revoke write permission
+	Admins []ids.ShortID `json:"admins"`
+	// Block signers that may initially write data to the namespace
+	Writers []ids.ShortID `json:"writers"`
+}
+
+// parseNamespace returns the zero-padded form of [namespace]
+func parseNamespace(namespace string) ([NamespaceLen]byte, error) {
+	var padded [NamespaceLen]byte
+	if len(namespace) == 0 || len(namespace) > NamespaceLen || bytes.IndexByte([]byte(namespace), 0) != -1 {
+		return padded, errBadNamespace
+	}
+	copy(padded[:], namespace)
+	return padded, nil
+}
+
+// verifyACLs returns nil iff [acls] name distinct namespaces that each have
+// an admin
+func verifyACLs(acls []NamespaceACL) error {
+	namespaces := set.NewSet[[NamespaceLen]byte](len(acls))
+	for _, acl := range acls {
+		namespace, err := parseNamespace(acl.Namespace)
+		if err != nil {
+			return err
+		}
+		switch {
+		case namespaces.Contains(namespace):
+			return fmt.Errorf("%w: %s", errDuplicateNamespace, acl.Namespace)
+		case len(acl.Admins) == 0:
+			return fmt.Errorf("%w: %s", errNamespaceWithoutAdmin, acl.Namespace)
+		}
+		namespaces.Add(namespace)
+		if err := verifyAddresses(acl.Admins); err != nil {
+			return fmt.Errorf("%s admins: %w", acl.Namespace, err)
+		}
+		if err := verifyAddresses(acl.Writers); err != nil {
+			return fmt.Errorf("%s writers: %w", acl.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// hasACLs returns true iff some namespaces restrict who may write to them
+func (p *ChainParams) hasACLs() bool {
+	return len(p.ACLs) > 0
+}
+
+// namespaceACL returns the ACL of [namespace], or nil if it has none
+func (p *ChainParams) namespaceACL(namespace [NamespaceLen]byte) *NamespaceACL {
+	for i := range p.ACLs {
+		// The namespaces are checked when the genesis is parsed
+		if padded, _ := parseNamespace(p.ACLs[i].Namespace); padded == namespace {
+			return &p.ACLs[i]
+		}
+	}
+	return nil
+}
+
+// ACLOp grants an address permission to write to a namespace, or revokes
+// it. It must be signed by one of the namespace's admins. Each namespace's
+// operations are applied in the order of their nonces, starting at 0, so an
+// operation can't be replayed.
+type ACLOp struct {
+	Nonce     uint64             `serialize:"true"`
+	Namespace [NamespaceLen]byte `serialize:"true"`
+	Grant     bool               `serialize:"true"` // If false, [Writer]'s permission is revoked
+	Writer    ids.ShortID        `serialize:"true"`
+	// Admin's signature of the operation's hash on this chain
+	AdminSig [secp256k1.SignatureLen]byte `serialize:"true"`
+}
+
+// Hash returns the hash of [op] on the chain [chainID], which is what an
+// admin of the namespace signs
+func (op *ACLOp) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+NamespaceLen+8+1+ids.ShortIDLen)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, aclOpTag)
+	msg = append(msg, op.Namespace[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, op.Nonce)
+	if op.Grant {
+		msg = append(msg, 1)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, op.Writer[:]...)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [op]'s admin signature to [key]'s signature of [op] on the chain
+// [chainID]
+func (op *ACLOp) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(op.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(op.AdminSig[:], sig)
+	return nil
+}
+
+// admin returns the address that signed [op] on the chain [chainID]
+func (op *ACLOp) admin(chainID ids.ID) (ids.ShortID, error) {
+	key, err := secp256k1.RecoverPublicKeyFromHash(op.Hash(chainID), op.AdminSig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	return key.Address(), nil
+}
+
+// writerSet is the set of addresses that may write to a namespace after
+// some number of the namespace's ACL operations
+type writerSet struct {
+	writers set.Set[ids.ShortID]
+	// Nonce of the namespace's next ACL operation
+	nonce uint64
+}
+
+// apply applies [op] to [w] without checking it
+func (w *writerSet) apply(op ACLOp) {
+	if op.Grant {
+		w.writers.Add(op.Writer)
+	} else {
+		w.writers.Remove(op.Writer)
+	}
+	w.nonce++
+}
+
+// verify returns nil iff [op] can be applied to [w], the writers of [op]'s
+// namespace, on the chain [vm] runs
+func (w *writerSet) verify(vm *VM, op ACLOp) error {
+	acl := vm.genesis.Params.namespaceACL(op.Namespace)
+	if acl == nil {
+		return errNoSuchACL
+	}
+	if op.Nonce != w.nonce {
+		return errBadACLOpNonce
+	}
+	admin, err := op.admin(vm.ctx.ChainID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(acl.Admins, admin) {
+		return errNotNamespaceAdmin
+	}
+	switch {
+	case op.Grant && w.writers.Contains(op.Writer):
+		return errAlreadyWriter
+	case !op.Grant && !w.writers.Contains(op.Writer):
+		return errUnknownWriter
+	default:
+		return nil
+	}
+}
+
+// writersAfter returns the writers of [namespace] after [blk] is accepted
+func (vm *VM) writersAfter(blk *Block, namespace [NamespaceLen]byte) (*writerSet, error) {
+	// Processing ancestors' operations aren't persisted yet
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := vm.state.getWriters(namespace)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(processing) - 1; i >= 0; i-- {
+		for _, op := range processing[i].ACLOps {
+			if op.Namespace == namespace {
+				w.apply(op)
+			}
+		}
+	}
+	return w, nil
+}
+
+// verifyACL returns nil iff [b]'s signer and submitters may write to the
+// namespaces of the data they put in [b] after [parent] is accepted and
+// [b]'s ACL operations are valid.
+// [b]'s operations only apply to its descendants.
+func (b *Block) verifyACL(parent *Block) error {
+	params := &b.vm.genesis.Params
+	switch {
+	case !params.hasACLs() && len(b.ACLOps) > 0:
+		return errACLsDisabled
+	case !params.hasACLs():
+		return nil
+	case len(b.ACLOps) > maxBatchSize:
+		return errTooManyACLOps
+	}
+
+	writers := make(map[[NamespaceLen]byte]*writerSet)
+	getWriters := func(namespace [NamespaceLen]byte) (*writerSet, error) {
+		if w, ok := writers[namespace]; ok {
+			return w, nil
+		}
+		w, err := b.vm.writersAfter(parent, namespace)
+		if err != nil {
+			return nil, err
+		}
+		writers[namespace] = w
+		return w, nil
+	}
+
+	verifyWriter := func(writer ids.ShortID, namespace [NamespaceLen]byte) error {
+		if params.namespaceACL(namespace) == nil {
+			return nil
+		}
+		w, err := getWriters(namespace)
+		if err != nil {
+			return err
+		}
+		if !w.writers.Contains(writer) {
+			return errNoWritePermission
+		}
+		return nil
+	}
+
+	// [b]'s signer writes its data and the data of its multisig proposals
+	if len(b.Dt) > 0 || len(b.Multisigs) > 0 {
+		signer, err := b.signer()
+		if err != nil {
+			return err
+		}
+		for _, namespace := range b.Ns {
+			if err := verifyWriter(signer, namespace); err != nil {
+				return err
+			}
+		}
+		for i := range b.Multisigs {
+			if err := verifyWriter(signer, b.Multisigs[i].Namespace); err != nil {
+				return err
+			}
+		}
+	}
+	// A signed submission is written by its submitter
+	for i := range b.Submissions {
+		key, err := b.Submissions[i].submitter(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		if err := verifyWriter(key.Address(), b.Submissions[i].Namespace); err != nil {
+			return err
+		}
+	}
+	for _, op := range b.ACLOps {
+		w, err := getWriters(op.Namespace)
+		if err != nil {
+			return err
+		}
+		if err := w.verify(b.vm, op); err != nil {
+			return err
+		}
+		w.apply(op)
+	}
+	return nil
+}
+
+// writableData splits [entries] into the data this node's signer may write
+// in a child of [parent] and the data it may not
+func (vm *VM) writableData(parent *Block, entries []MempoolEntry) ([]MempoolEntry, []MempoolEntry, error) {
+	params := &vm.genesis.Params
+	if !params.hasACLs() {
+		return entries, nil, nil
+	}
+	var writable, unwritable []MempoolEntry
+	for _, entry := range entries {
+		ok, err := vm.canWrite(parent, vm.signer.Address(), entry.namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			writable = append(writable, entry)
+		} else {
+			unwritable = append(unwritable, entry)
+		}
+	}
+	return writable, unwritable, nil
+}
+
+// canWrite returns true iff [writer] may write data in [namespace] in a child
+// of [parent]
+func (vm *VM) canWrite(parent *Block, writer ids.ShortID, namespace [NamespaceLen]byte) (bool, error) {
+	params := &vm.genesis.Params
+	if !params.hasACLs() {
+		return true, nil
+	}
+	if params.namespaceACL(namespace) == nil {
+		return true, nil
+	}
+	w, err := vm.writersAfter(parent, namespace)
+	if err != nil {
+		return false, err
+	}
+	return w.writers.Contains(writer), nil
+}
+
+// verifyCanWrite returns nil iff this node's signer may write data in
+// [namespace] in a child of [parent]
+func (vm *VM) verifyCanWrite(parent *Block, namespace [NamespaceLen]byte) error {
+	params := &vm.genesis.Params
+	if !params.hasACLs() {
+		return nil
+	}
+	if params.namespaceACL(namespace) == nil {
+		return nil
+	}
+	if vm.signer == nil {
+		return errNoSigningKey
+	}
+	w, err := vm.writersAfter(parent, namespace)
+	if err != nil {
+		return err
+	}
+	if !w.writers.Contains(vm.signer.Address()) {
+		return errNoWritePermission
+	}
+	return nil
+}
+
+// pendingACLOps holds ACL operations submitted over the API until they are
+// accepted
+type pendingACLOps struct {
+	lock sync.Mutex
+	ops  []ACLOp
+}
+
+// add adds [op] to the pending operations
+func (p *pendingACLOps) add(op ACLOp) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ops = append(p.ops, op)
+}
+
+// next returns the pending operations that can be applied in a child of
+// [parent], in nonce order for each namespace
+func (p *pendingACLOps) next(vm *VM, parent *Block) []ACLOp {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.ops) == 0 {
+		return nil
+	}
+	writers := make(map[[NamespaceLen]byte]*writerSet)
+	var next []ACLOp
+	included := make([]bool, len(p.ops))
+	for found := true; found && len(next) < maxBatchSize; {
+		found = false
+		for i, op := range p.ops {
+			if included[i] {
+				continue
+			}
+			w, ok := writers[op.Namespace]
+			if !ok {
+				var err error
+				if w, err = vm.writersAfter(parent, op.Namespace); err != nil {
+					continue
+				}
+				writers[op.Namespace] = w
+			}
+			if w.verify(vm, op) != nil {
+				continue
+			}
+			w.apply(op)
+			included[i] = true
+			next = append(next, op)
+			found = true
+			if len(next) == maxBatchSize {
+				break
+			}
+		}
+	}
+	return next
+}
+
+// prune drops the pending operations that can no longer be accepted because
+// their nonces were used
+func (p *pendingACLOps) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.ops, err = pruneOps(vm.opJournal, aclOpKind, p.ops, func(op *ACLOp) bool {
+		nonce, err := vm.state.getACLNonce(op.Namespace)
+		return err == nil && op.Nonce >= nonce
+	})
+	return err
+}
+
+// len returns the number of pending operations
+func (p *pendingACLOps) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.ops)
+}
+
+// ProposeACLOpArgs are the arguments to ProposeACLOp
+type ProposeACLOpArgs struct {
+	// Position of the operation among the namespace's ACL operations
+	Nonce     json.Uint64 `json:"nonce"`
+	Namespace string      `json:"namespace"`
+	// If true, [Writer] may write to the namespace. Otherwise its permission
+	// is revoked.
+	Grant  bool        `json:"grant"`
+	Writer ids.ShortID `json:"writer"`
+	// Base 58 repr. of an admin's signature of the operation
+	Signature string `json:"signature"`
+
+	namespace [NamespaceLen]byte
+	sig       [secp256k1.SignatureLen]byte
+}
+
+func (a *ProposeACLOpArgs) validate(v *argValidator) {
+	var err error
+	a.namespace, err = parseNamespace(a.Namespace)
+	v.add("namespace", err)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// ProposeACLOpReply is the reply from ProposeACLOp
+type ProposeACLOpReply struct{ Success bool }
+
+// ProposeACLOp is an API method to propose a change to who may write to a
+// namespace. The operation is included in a block built by this node once
+// it is the namespace's next operation and is valid.
+func (s *Service) ProposeACLOp(_ *http.Request, args *ProposeACLOpArgs, reply *ProposeACLOpReply) error {
+	params := s.backend.chainParams()
+	if !params.hasACLs() {
+		return errACLsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	acl := params.namespaceACL(args.namespace)
+	if acl == nil {
+		return errNoSuchACL
+	}
+	op := ACLOp{
+		Nonce:     uint64(args.Nonce),
+		Namespace: args.namespace,
+		Grant:     args.Grant,
+		Writer:    args.Writer,
+		AdminSig:  args.sig,
+	}
+
+	admin, err := op.admin(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(acl.Admins, admin) {
+		return errNotNamespaceAdmin
+	}
+	if err := s.backend.addACLOp(op); err != nil {
+		return err
+	}
+	reply.Success = true
+	return nil
+}
+
+// GetPermissionsArgs are the arguments to GetPermissions
+type GetPermissionsArgs struct {
+	Namespace string `json:"namespace"`
+
+	namespace [NamespaceLen]byte
+}
+
+func (a *GetPermissionsArgs) validate(v *argValidator) {
+	var err error
+	a.namespace, err = parseNamespace(a.Namespace)
+	v.add("namespace", err)
+}
+
+// GetPermissionsReply is the reply from GetPermissions
+type GetPermissionsReply struct {
+	// Addresses that may grant and revoke write permission
+	Admins []ids.ShortID `json:"admins"`
+	// Block signers that may write data to the namespace
+	Writers []ids.ShortID `json:"writers"`
+	// Nonce of the namespace's next ACL operation
+	Nonce json.Uint64 `json:"nonce"`
+}
+
+// GetPermissions returns who may write to [args.Namespace] after the last
+// accepted block
+func (s *Service) GetPermissions(_ *http.Request, args *GetPermissionsArgs, reply *GetPermissionsReply) error {
+	params := s.backend.chainParams()
+	if !params.hasACLs() {
+		return errACLsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	acl := params.namespaceACL(args.namespace)
+	if acl == nil {
+		return errNoSuchACL
+	}
+	w, err := s.backend.writers(args.namespace)
+	if err != nil {
+		return err
+	}
+	reply.Admins = acl.Admins
+	reply.Writers = w.writers.List()
+	slices.SortFunc(reply.Writers, func(a, b ids.ShortID) int {
+		return a.Compare(b)
+	})
+	reply.Nonce = json.Uint64(w.nonce)
+	return nil
+}
@@ -0,0 +1,229 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/gorilla/rpc/v2"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	avajson "github.com/ava-labs/avalanchego/utils/json"
+)
+
+const (
+	// AdminName is the name of the admin API's service
+	AdminName = "admin"
+
+	// adminEndpoint is the path extension of the chain's admin API
+	adminEndpoint = "/admin"
+)
+
+var (
+	errNotReloadable = errors.New("config field can't be changed without restarting the chain")
+	errNoConfigFile  = errors.New("no config file to reload the config from")
+	errNotRunning    = errors.New("vm isn't running")
+
+	// reloadableFields are the JSON names of the config fields that
+	// ReloadConfig changes on a running chain
+	reloadableFields = set.Of(
+		"mempoolSize",
+		"blockCacheSize",
+		"buildBatchWindow",
+		"buildBackoff",
+		"blockLogLevel",
+	)
+)
+
+// changedFields returns the JSON names of the fields of [a] and [b] that are
+// different
+func changedFields(a, b Config) []string {
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// ReloadConfig changes the config of the running chain to [configBytes],
+// which is parsed like the config it was initialized with. Only the mempool
+// size, block cache size, build batch window, build backoff and block log
+// level may be different; the other fields must be unchanged. Changing the
+// block cache size empties the caches.
+// Returns the JSON names of the fields that changed.
+func (vm *VM) ReloadConfig(configBytes []byte) ([]string, error) {
+	config, err := ParseConfig(configBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !vm.running.Load() {
+		return nil, errNotRunning
+	}
+
+	// The lock orders reloads and keeps the caches and the builder in step
+	// with the config. Readers that don't take it see the old config or the
+	// new one, never a mix.
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	current := vm.config.Load()
+	changed := changedFields(*current, config)
+	for _, name := range changed {
+		if !reloadableFields.Contains(name) {
+			return nil, fmt.Errorf("%w: %s", errNotReloadable, name)
+		}
+	}
+	if config.BlockCacheSize != current.BlockCacheSize {
+		vm.state.resizeCaches(config.BlockCacheSize)
+	}
+	vm.builder.setLimits(config.MempoolSize, config.BuildBatchWindow.Duration)
+	vm.config.Store(&config)
+	if len(changed) > 0 {
+		vm.ctx.Log.Info("reloaded config", zap.Strings("fields", changed))
+	}
+	return changed, nil
+}
+
+// ReloadConfigFile reloads the config from the config file set in the
+// config, as ReloadConfig does
+func (vm *VM) ReloadConfigFile() ([]string, error) {
+	if !vm.running.Load() {
+		return nil, errNotRunning
+	}
+	path := vm.config.Load().ConfigFile
+	if path == "" {
+		return nil, errNoConfigFile
+	}
+
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file: %w", err)
+	}
+	return vm.ReloadConfig(configBytes)
+}
+
+// adminHandler serves the admin API to requests that carry the configured
+// bearer token
+type adminHandler struct {
+	token  string
+	server *rpc.Server
+}
+
+// newAdminHandler returns the handler of the admin API of [vm], which is
+// only served to requests that carry [token]
+func newAdminHandler(vm *VM, token string) (*adminHandler, error) {
+	server := rpc.NewServer()
+	server.RegisterCodec(avajson.NewCodec(), "application/json")
+	server.RegisterCodec(avajson.NewCodec(), "application/json;charset=UTF-8")
+	return &adminHandler{token: token, server: server}, server.RegisterService(&AdminService{vm: vm}, AdminName)
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, h.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.server.ServeHTTP(w, r)
+}
+
+// AdminService is the admin API of a node running this VM, which changes how
+// the node runs the chain
+type AdminService struct {
+	vm *VM
+}
+
+// ReloadConfigArgs are the arguments to ReloadConfig
+type ReloadConfigArgs struct {
+	// The new config. If empty or null, the config is read from the config
+	// file.
+	Config json.RawMessage `json:"config"`
+}
+
+// ReloadConfigReply is the reply from ReloadConfig
+type ReloadConfigReply struct {
+	// JSON names of the config fields that changed
+	Changed []string `json:"changed"`
+}
+
+// ReloadConfig changes this node's config of the chain without restarting
+// the chain. Only the mempool size, block cache size, build batch window,
+// build backoff and block log level may be changed.
+func (s *AdminService) ReloadConfig(_ *http.Request, args *ReloadConfigArgs, reply *ReloadConfigReply) error {
+	var (
+		changed []string
+		err     error
+	)
+	if config := bytes.TrimSpace(args.Config); len(config) == 0 || bytes.Equal(config, []byte("null")) {
+		changed, err = s.vm.ReloadConfigFile()
+	} else {
+		changed, err = s.vm.ReloadConfig(args.Config)
+	}
+	reply.Changed = changed
+	return err
+}
+
+// SetLogLevelArgs are the arguments to SetLogLevel
+type SetLogLevelArgs struct {
+	// One of "api", "builder" or "mempool". If empty, the level of the
+	// chain's logs is set.
+	Subsystem string `json:"subsystem"`
+	// Level such as "debug". If empty, the subsystem logs at the chain's
+	// level again.
+	Level string `json:"level"`
+}
+
+// SetLogLevel changes the level at which this node logs the chain, or one of
+// its subsystems, without restarting the chain. Subsystems without a level
+// of their own log at the chain's level.
+func (s *AdminService) SetLogLevel(_ *http.Request, args *SetLogLevelArgs, _ *struct{}) error {
+	var level *logging.Level
+	if args.Level != "" {
+		parsed, err := logging.ToLevel(args.Level)
+		if err != nil {
+			return err
+		}
+		level = &parsed
+	}
+	if err := s.vm.logs.setLevel(args.Subsystem, level); err != nil {
+		return err
+	}
+	s.vm.ctx.Log.Info("set log level",
+		zap.String("subsystem", args.Subsystem),
+		zap.String("level", args.Level),
+	)
+	return nil
+}
+
+// GetLogLevelsReply is the reply from GetLogLevels
+type GetLogLevelsReply struct {
+	// Level of the chain's logs
+	Chain string `json:"chain"`
+	// Subsystem --> Its level, for each subsystem with a level of its own
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+// GetLogLevels returns the levels at which this node logs the chain and its
+// subsystems
+func (s *AdminService) GetLogLevels(_ *http.Request, _ *struct{}, reply *GetLogLevelsReply) error {
+	reply.Chain = s.vm.logs.chainLevel().LowerString()
+	reply.Subsystems = make(map[string]string)
+	for subsystem, level := range s.vm.logs.subsystemLevels() {
+		reply.Subsystems[subsystem] = level.LowerString()
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+const (
+	defaultAggregationInterval = time.Second
+	defaultMaxPendingHashes    = 1 << 16
+
+	aggregatedStepLen = 1 + dataLen
+)
+
+var (
+	aggregatedPrefix        = []byte("aggregated")
+	pendingAggregatedPrefix = []byte("pendingAggregated")
+
+	errAggregationDisabled    = errors.New("hash aggregation isn't enabled on this node")
+	errBadAggregationConfig   = errors.New("aggregation interval and max pending hashes must not be negative")
+	errAggregatorFull         = errors.New("too many hashes are waiting to be aggregated")
+	errHashPending            = errors.New("hash is waiting to be aggregated")
+	errNotAggregated          = errors.New("hash wasn't aggregated by this node")
+	errBadAggregatedPath      = errors.New("aggregated path in the index is malformed")
+	errBadAggregatedHashBytes = errors.New("hash must be base 58 repr. of 32 bytes")
+	errBadPendingHash         = errors.New("aggregation journal has a hash of the wrong length")
+)
+
+// AggregationConfig configures the aggregation of hashes submitted to this
+// node into Merkle trees, of which only the roots are proposed
+type AggregationConfig struct {
+	// How often the pending hashes are aggregated and their root is
+	// proposed. Defaults to 1s.
+	Interval Duration `json:"interval"`
+	// Max number of hashes waiting to be aggregated. Defaults to 65536.
+	MaxPending int `json:"maxPending"`
+}
+
+// Verify returns nil iff [c] is a valid aggregation config
+func (c *AggregationConfig) Verify() error {
+	if c.Interval.Duration < 0 || c.MaxPending < 0 {
+		return errBadAggregationConfig
+	}
+	return nil
+}
+
+// aggregator collects submitted hashes and, every interval, proposes the
+// root of a Merkle tree of them. The path of each hash to its root is
+// recorded in an index on this node, which isn't part of the chain's state,
+// so it's written to the database immediately. Pending hashes are written to
+// a journal before they're acknowledged and are aggregated after a restart.
+type aggregator struct {
+	db       database.Database // hash -> root | path
+	journal  database.Database // hash -> nil for each pending hash
+	verify   func(proposal []byte) error
+	propose  func(data [dataLen]byte) error
+	log      logging.Logger
+	interval time.Duration
+	max      int
+
+	lock      sync.Mutex
+	pending   [][dataLen]byte
+	isPending set.Set[[dataLen]byte]
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newAggregator starts aggregating hashes every interval of [config],
+// starting with the pending hashes in [journal]. Roots are checked with
+// [verify] and proposed with [propose].
+func newAggregator(
+	config AggregationConfig,
+	db database.Database,
+	journal database.Database,
+	verify func([]byte) error,
+	propose func([dataLen]byte) error,
+	log logging.Logger,
+) (*aggregator, error) {
+	if config.Interval.Duration == 0 {
+		config.Interval.Duration = defaultAggregationInterval
+	}
+	if config.MaxPending == 0 {
+		config.MaxPending = defaultMaxPendingHashes
+	}
+	a := &aggregator{
+		db:        db,
+		journal:   journal,
+		verify:    verify,
+		propose:   propose,
+		log:       log,
+		interval:  config.Interval.Duration,
+		max:       config.MaxPending,
+		isPending: set.Set[[dataLen]byte]{},
+		shutdown:  make(chan struct{}),
+	}
+	if err := a.restore(); err != nil {
+		return nil, err
+	}
+	a.wg.Add(1)
+	go a.run()
+	return a, nil
+}
+
+// restore makes the hashes in the journal pending. Hashes that were
+// aggregated before the node stopped are removed from the journal.
+func (a *aggregator) restore() error {
+	it := a.journal.NewIterator()
+	defer it.Release()
+
+	var aggregated [][dataLen]byte
+	for it.Next() {
+		if len(it.Key()) != dataLen {
+			return errBadPendingHash
+		}
+		hash := [dataLen]byte(it.Key())
+		isAggregated, err := a.db.Has(hash[:])
+		if err != nil {
+			return err
+		}
+		if isAggregated {
+			aggregated = append(aggregated, hash)
+			continue
+		}
+		a.pending = append(a.pending, hash)
+		a.isPending.Add(hash)
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	for _, hash := range aggregated {
+		if err := a.journal.Delete(hash[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submit adds [hash] to the hashes that are aggregated at the end of the
+// interval. Submitting a hash that is pending or aggregated has no effect.
+func (a *aggregator) submit(hash [dataLen]byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.isPending.Contains(hash) {
+		return nil
+	}
+	aggregated, err := a.db.Has(hash[:])
+	if err != nil {
+		return err
+	}
+	if aggregated {
+		return nil
+	}
+	if len(a.pending) >= a.max {
+		return errAggregatorFull
+	}
+	if err := a.journal.Put(hash[:], nil); err != nil {
+		return err
+	}
+	a.pending = append(a.pending, hash)
+	a.isPending.Add(hash)
+	return nil
+}
+
+// path returns the root that [hash] was aggregated into and its path to the
+// root
+func (a *aggregator) path(hash [dataLen]byte) ([dataLen]byte, *proof.MerklePath, error) {
+	a.lock.Lock()
+	pending := a.isPending.Contains(hash)
+	a.lock.Unlock()
+	if pending {
+		return [dataLen]byte{}, nil, errHashPending
+	}
+
+	b, err := a.db.Get(hash[:])
+	if err == database.ErrNotFound {
+		return [dataLen]byte{}, nil, errNotAggregated
+	}
+	if err != nil {
+		return [dataLen]byte{}, nil, err
+	}
+	if len(b) < dataLen || (len(b)-dataLen)%aggregatedStepLen != 0 {
+		return [dataLen]byte{}, nil, errBadAggregatedPath
+	}
+	root := [dataLen]byte(b)
+	path := &proof.MerklePath{Steps: []proof.MerkleStep{}}
+	for rest := b[dataLen:]; len(rest) > 0; rest = rest[aggregatedStepLen:] {
+		path.Steps = append(path.Steps, proof.MerkleStep{
+			Left: rest[0] == 1,
+			Hash: rest[1:aggregatedStepLen],
+		})
+	}
+	return root, path, nil
+}
+
+// flush proposes the root of a Merkle tree of the pending hashes and records
+// each hash's path to it. If the root can't be proposed, the hashes stay
+// pending.
+func (a *aggregator) flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if len(a.pending) == 0 {
+		return nil
+	}
+	root, paths := proof.MerkleTree(a.pending)
+	if err := a.verify(root[:]); err != nil {
+		return err
+	}
+	if err := a.propose(root); err != nil {
+		return err
+	}
+	for i, hash := range a.pending {
+		b := make([]byte, 0, dataLen+len(paths[i].Steps)*aggregatedStepLen)
+		b = append(b, root[:]...)
+		for _, step := range paths[i].Steps {
+			left := byte(0)
+			if step.Left {
+				left = 1
+			}
+			b = append(b, left)
+			b = append(b, step.Hash...)
+		}
+		if err := a.db.Put(hash[:], b); err != nil {
+			return err
+		}
+		if err := a.journal.Delete(hash[:]); err != nil {
+			return err
+		}
+	}
+	a.log.Debug("proposed aggregated hashes",
+		zap.String("root", encoding.EncodeCB58(root[:])),
+		zap.Int("numHashes", len(a.pending)),
+	)
+	a.pending = nil
+	a.isPending.Clear()
+	return nil
+}
+
+// stop stops aggregating. Pending hashes stay in the journal.
+func (a *aggregator) stop() {
+	close(a.shutdown)
+	a.wg.Wait()
+}
+
+func (a *aggregator) run() {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.flush(); err != nil {
+				a.log.Warn("couldn't propose aggregated hashes", zap.Error(err))
+			}
+		case <-a.shutdown:
+			return
+		}
+	}
+}
+
+// verifyRoot returns nil iff the Merkle root [root] may be proposed. Roots
+// have no namespace.
+func (vm *VM) verifyRoot(root []byte) error {
+	return vm.verifyProposal(root, [NamespaceLen]byte{})
+}
+
+func (vm *VM) aggregationEnabled() bool {
+	return vm.aggregator != nil
+}
+
+func (vm *VM) submitHash(hash [dataLen]byte) error {
+	return vm.aggregator.submit(hash)
+}
+
+func (vm *VM) aggregatedPath(hash [dataLen]byte) ([dataLen]byte, *proof.MerklePath, error) {
+	return vm.aggregator.path(hash)
+}
+
+// SubmitHashArgs are the arguments to SubmitHash
+type SubmitHashArgs struct {
+	// Base 58 repr. of a 32 byte hash
+	Hash string `json:"hash"`
+
+	hash [dataLen]byte
+}
+
+func (a *SubmitHashArgs) validate(v *argValidator) {
+	a.hash = v.hash("hash", a.Hash, errBadAggregatedHashBytes)
+}
+
+// SubmitHashReply is the reply from SubmitHash
+type SubmitHashReply struct {
+	Success bool `json:"success"`
+}
+
+// SubmitHash submits a hash to be aggregated with others into a Merkle tree,
+// whose root is proposed at the end of this node's aggregation interval.
+// The hash's proof can be fetched with GetInclusionProof once the root is
+// accepted.
+func (s *Service) SubmitHash(_ *http.Request, args *SubmitHashArgs, reply *SubmitHashReply) error {
+	if !s.backend.aggregationEnabled() {
+		return errAggregationDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	if err := s.backend.submitHash(args.hash); err != nil {
+		return err
+	}
+	reply.Success = true
+	return nil
+}
+
+// GetInclusionProofArgs are the arguments to GetInclusionProof
+type GetInclusionProofArgs struct {
+	// Base 58 repr. of the submitted hash
+	Hash string `json:"hash"`
+
+	hash [dataLen]byte
+}
+
+func (a *GetInclusionProofArgs) validate(v *argValidator) {
+	a.hash = v.hash("hash", a.Hash, errBadAggregatedHashBytes)
+}
+
+// GetInclusionProofReply is the reply from GetInclusionProof
+type GetInclusionProofReply struct {
+	// Base 58 repr. of the root the hash was aggregated into
+	Root string `json:"root"`
+	proof.Proof
+}
+
+// GetInclusionProof returns a proof that [args.Hash], which was submitted to
+// this node with SubmitHash, is a leaf of a Merkle tree whose root is in an
+// accepted block. It can be checked offline with [proof.Proof.Verify].
+func (s *Service) GetInclusionProof(r *http.Request, args *GetInclusionProofArgs, reply *GetInclusionProofReply) error {
+	ctx := requestContext(r)
+	if !s.backend.aggregationEnabled() {
+		return errAggregationDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	root, path, err := s.backend.aggregatedPath(args.hash)
+	if err != nil {
+		return err
+	}
+	if reply.Proof, err = s.dataProof(ctx, root); err != nil {
+		return err
+	}
+	reply.Root = encoding.EncodeCB58(root[:])
+	reply.Merkle = path
+	return nil
+}
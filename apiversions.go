@@ -0,0 +1,33 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+// apiVersion is a version of the JSON-RPC API, served at its own path
+// extension. A version's methods never change in ways that break its
+// clients: a breaking change, such as a new encoding, ships in a new version
+// whose service embeds the previous one and replaces the changed methods,
+// while the previous version keeps being served.
+type apiVersion struct {
+	// Path extension the version is served at, such as "/v1"
+	endpoint string
+	// newService returns the receiver of the version's methods, which are
+	// served from [b]
+	newService func(b backend) any
+}
+
+var (
+	// apiVersions are the versions of the API the chain serves, oldest first
+	apiVersions = []apiVersion{
+		{
+			endpoint:   "/v1",
+			newService: func(b backend) any { return &Service{b} },
+		},
+	}
+
+	// unversionedAPI is the version served at the chain's base path, where
+	// the API was served before it had versions. It's always the first
+	// version, so that integrations written against the base path keep
+	// working.
+	unversionedAPI = apiVersions[0]
+)
@@ -0,0 +1,340 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/snow/engine/common"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp/payload"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+// An attestation gossiped to the chain's validators is the ID of the attested
+// block followed by the attestor's BLS signature
+const attestationGossipLen = ids.IDLen + bls.SignatureLen
+
+var (
+	attestationPrefix = []byte("attestation")
+
+	errAttestationsDisabled = errors.New("block attestations aren't enabled on this node")
+	errNoBlockAttestation   = errors.New("node has no attestations of the block")
+	errBadAttestationGossip = errors.New("attestation gossip must be a block ID and a BLS signature")
+	errNotAttestor          = errors.New("attestor isn't a validator of the chain")
+	errBadBlockAttestation  = errors.New("attestation isn't signed by its attestor")
+	errBadAttestationRecord = errors.New("attestation record in the index is malformed")
+	errAttestedNotAccepted  = errors.New("attested block isn't accepted")
+)
+
+// attestor signs the blocks this node accepts with its BLS key and aggregates
+// the signatures of the chain's validators into Warp messages whose payload
+// is the hash of the block's ID. The aggregates aren't part of the chain's
+// state, so they are written to the database immediately.
+// Each block's signatures are checked against the validator set at the
+// P-Chain height when its first signature was received, so two nodes may
+// aggregate a block's signatures over different validator sets.
+type attestor struct {
+	ctx    *snow.Context
+	sender common.AppSender
+
+	lock sync.Mutex
+	db   database.Database // block ID -> blockAttestation
+}
+
+func newAttestor(ctx *snow.Context, sender common.AppSender, db database.Database) *attestor {
+	return &attestor{
+		ctx:    ctx,
+		sender: sender,
+		db:     db,
+	}
+}
+
+// blockAttestation is the aggregate signature of the validators at
+// [pChainHeight] that attested a block
+type blockAttestation struct {
+	pChainHeight uint64
+	// Indices of the attestors in the canonical order of the validator set
+	signers   set.Bits
+	signature *bls.Signature
+}
+
+// bytes returns the encoding of [a] in the attestation index:
+// P-Chain height | aggregate signature | signers
+func (a *blockAttestation) bytes() []byte {
+	b := make([]byte, 0, 8+bls.SignatureLen)
+	b = binary.BigEndian.AppendUint64(b, a.pChainHeight)
+	b = append(b, bls.SignatureToBytes(a.signature)...)
+	return append(b, a.signers.Bytes()...)
+}
+
+func parseBlockAttestation(b []byte) (*blockAttestation, error) {
+	if len(b) < 8+bls.SignatureLen {
+		return nil, errBadAttestationRecord
+	}
+	sig, err := bls.SignatureFromBytes(b[8 : 8+bls.SignatureLen])
+	if err != nil {
+		return nil, errBadAttestationRecord
+	}
+	return &blockAttestation{
+		pChainHeight: binary.BigEndian.Uint64(b),
+		signers:      set.BitsFromBytes(b[8+bls.SignatureLen:]),
+		signature:    sig,
+	}, nil
+}
+
+// unsignedMessage returns the Warp message that attestors of the block
+// [blkID] sign
+func (a *attestor) unsignedMessage(blkID ids.ID) (*warp.UnsignedMessage, error) {
+	hash, err := payload.NewHash(blkID)
+	if err != nil {
+		return nil, err
+	}
+	return warp.NewUnsignedMessage(a.ctx.NetworkID, a.ctx.ChainID, hash.Bytes())
+}
+
+// attest signs the accepted block [blkID], adds the signature to the block's
+// aggregate and gossips it to the other validators. Attestations aren't part
+// of consensus, so failures are only logged.
+func (a *attestor) attest(ctx context.Context, blkID ids.ID) {
+	if err := a.signAndGossip(ctx, blkID); err != nil {
+		a.ctx.Log.Debug("couldn't attest block",
+			zap.Stringer("blkID", blkID),
+			zap.Error(err),
+		)
+	}
+}
+
+func (a *attestor) signAndGossip(ctx context.Context, blkID ids.ID) error {
+	unsigned, err := a.unsignedMessage(blkID)
+	if err != nil {
+		return err
+	}
+	sig, err := a.ctx.WarpSigner.Sign(unsigned)
+	if err != nil {
+		return err
+	}
+	vdrs, err := a.add(ctx, blkID, a.ctx.NodeID, sig)
+	if err != nil {
+		return err
+	}
+	peers := set.Set[ids.NodeID]{}
+	for _, vdr := range vdrs.Validators {
+		peers.Add(vdr.NodeIDs...)
+	}
+	peers.Remove(a.ctx.NodeID)
+	if peers.Len() == 0 {
+		return nil
+	}
+	msg := make([]byte, 0, attestationGossipLen)
+	msg = append(msg, blkID[:]...)
+	msg = append(msg, sig...)
+	return a.sender.SendAppGossip(ctx, common.SendConfig{NodeIDs: peers}, msg)
+}
+
+// add adds [nodeID]'s signature [sig] of the block [blkID] to the block's
+// aggregate. Adding a signature that is already aggregated has no effect.
+// Returns the validator set the aggregate is over.
+func (a *attestor) add(ctx context.Context, blkID ids.ID, nodeID ids.NodeID, sig []byte) (validators.WarpSet, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	attestation, err := a.get(blkID)
+	if err == database.ErrNotFound {
+		height, err := a.ctx.ValidatorState.GetCurrentHeight(ctx)
+		if err != nil {
+			return validators.WarpSet{}, err
+		}
+		attestation = &blockAttestation{
+			pChainHeight: height,
+			signers:      set.NewBits(),
+		}
+	} else if err != nil {
+		return validators.WarpSet{}, err
+	}
+	vdrs, err := a.ctx.ValidatorState.GetWarpValidatorSet(ctx, attestation.pChainHeight, a.ctx.SubnetID)
+	if err != nil {
+		return validators.WarpSet{}, err
+	}
+	index := slices.IndexFunc(vdrs.Validators, func(vdr *validators.Warp) bool {
+		return slices.Contains(vdr.NodeIDs, nodeID)
+	})
+	if index < 0 {
+		return validators.WarpSet{}, errNotAttestor
+	}
+	if attestation.signers.Contains(index) {
+		return vdrs, nil
+	}
+
+	signature, err := bls.SignatureFromBytes(sig)
+	if err != nil {
+		return validators.WarpSet{}, errBadBlockAttestation
+	}
+	unsigned, err := a.unsignedMessage(blkID)
+	if err != nil {
+		return validators.WarpSet{}, err
+	}
+	if !bls.Verify(vdrs.Validators[index].PublicKey, signature, unsigned.Bytes()) {
+		return validators.WarpSet{}, errBadBlockAttestation
+	}
+	if attestation.signature != nil {
+		if signature, err = bls.AggregateSignatures([]*bls.Signature{attestation.signature, signature}); err != nil {
+			return validators.WarpSet{}, err
+		}
+	}
+	attestation.signature = signature
+	attestation.signers.Add(index)
+	return vdrs, a.db.Put(blkID[:], attestation.bytes())
+}
+
+func (a *attestor) get(blkID ids.ID) (*blockAttestation, error) {
+	b, err := a.db.Get(blkID[:])
+	if err != nil {
+		return nil, err
+	}
+	return parseBlockAttestation(b)
+}
+
+// aggregateAttestation is a block's attestation as a Warp message, with the
+// weight of the stake that signed it
+type aggregateAttestation struct {
+	msg          *warp.Message
+	pChainHeight uint64
+	signedWeight uint64
+	totalWeight  uint64
+}
+
+// aggregate returns the Warp message signed by the attestors of the block
+// [blkID] whose signatures this node has received
+func (a *attestor) aggregate(ctx context.Context, blkID ids.ID) (*aggregateAttestation, error) {
+	a.lock.Lock()
+	attestation, err := a.get(blkID)
+	a.lock.Unlock()
+	if err == database.ErrNotFound {
+		return nil, errNoBlockAttestation
+	}
+	if err != nil {
+		return nil, err
+	}
+	vdrs, err := a.ctx.ValidatorState.GetWarpValidatorSet(ctx, attestation.pChainHeight, a.ctx.SubnetID)
+	if err != nil {
+		return nil, err
+	}
+	var signedWeight uint64
+	for i, vdr := range vdrs.Validators {
+		if attestation.signers.Contains(i) {
+			signedWeight += vdr.Weight
+		}
+	}
+	unsigned, err := a.unsignedMessage(blkID)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := warp.NewMessage(unsigned, &warp.BitSetSignature{
+		Signers:   attestation.signers.Bytes(),
+		Signature: [bls.SignatureLen]byte(bls.SignatureToBytes(attestation.signature)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &aggregateAttestation{
+		msg:          msg,
+		pChainHeight: attestation.pChainHeight,
+		signedWeight: signedWeight,
+		totalWeight:  vdrs.TotalWeight,
+	}, nil
+}
+
+// AppGossip adds the attestation gossiped by [nodeID] to its block's
+// aggregate. Invalid attestations are dropped.
+func (vm *VM) AppGossip(ctx context.Context, nodeID ids.NodeID, msg []byte) error {
+	if vm.attestor == nil {
+		return nil
+	}
+	if len(msg) != attestationGossipLen {
+		vm.ctx.Log.Debug("dropping malformed attestation",
+			zap.Stringer("nodeID", nodeID),
+			zap.Error(errBadAttestationGossip),
+		)
+		return nil
+	}
+	blkID := ids.ID(msg[:ids.IDLen])
+	if _, err := vm.attestor.add(ctx, blkID, nodeID, msg[ids.IDLen:]); err != nil {
+		vm.ctx.Log.Debug("dropping attestation",
+			zap.Stringer("nodeID", nodeID),
+			zap.Stringer("blkID", blkID),
+			zap.Error(err),
+		)
+	}
+	return nil
+}
+
+func (vm *VM) attestationsEnabled() bool {
+	return vm.attestor != nil
+}
+
+func (vm *VM) blockAttestation(ctx context.Context, blkID ids.ID) (*aggregateAttestation, error) {
+	return vm.attestor.aggregate(ctx, blkID)
+}
+
+// GetBlockAttestationArgs are the arguments to GetBlockAttestation
+type GetBlockAttestationArgs struct {
+	BlockID ids.ID `json:"blockID"`
+}
+
+// GetBlockAttestationReply is the reply from GetBlockAttestation
+type GetBlockAttestationReply struct {
+	// Base 58 repr. of a Warp message from this chain whose payload is the
+	// hash of the block's ID. It can be checked with
+	// [proof.VerifyAttestation].
+	Message string `json:"message"`
+	// P-Chain height of the validator set that signed the message
+	PChainHeight json.Uint64 `json:"pChainHeight"`
+	// Weight of the validators that signed the message
+	SignedWeight json.Uint64 `json:"signedWeight"`
+	// Weight of the validator set
+	TotalWeight json.Uint64 `json:"totalWeight"`
+}
+
+// GetBlockAttestation returns the aggregate signature of the validators that
+// attested that the accepted block [args.BlockID] is accepted, as far as
+// this node has received their attestations
+func (s *Service) GetBlockAttestation(r *http.Request, args *GetBlockAttestationArgs, reply *GetBlockAttestationReply) error {
+	ctx := requestContext(r)
+	if !s.backend.attestationsEnabled() {
+		return errAttestationsDisabled
+	}
+	blk, err := s.backend.lookupBlock(ctx, args.BlockID)
+	if err != nil {
+		return ErrBlockNotFound
+	}
+	if blk.Status() != choices.Accepted {
+		return errAttestedNotAccepted
+	}
+	attestation, err := s.backend.blockAttestation(ctx, args.BlockID)
+	if err != nil {
+		return err
+	}
+	reply.Message = encoding.EncodeCB58(attestation.msg.Bytes())
+	reply.PChainHeight = json.Uint64(attestation.pChainHeight)
+	reply.SignedWeight = json.Uint64(attestation.signedWeight)
+	reply.TotalWeight = json.Uint64(attestation.totalWeight)
+	return nil
+}
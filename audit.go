@@ -0,0 +1,301 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/database/prefixdb"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	avajson "github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	defaultAuditPageSize = 25
+	maxAuditPageSize     = 100
+)
+
+var (
+	auditPrefix       = []byte("audit")
+	auditRecordPrefix = []byte("record")
+	auditNextKey      = []byte("next")
+
+	errAuditDisabled  = errors.New("audit log isn't enabled on this node")
+	errBadAuditRecord = errors.New("audit record is malformed")
+
+	// auditedMethods are the API methods that change what this node proposes
+	// or holds pending, which are recorded in the audit log
+	auditedMethods = set.Of(
+		"AnchorCID",
+		"CancelProposal",
+		"ProposeACLOp",
+		"ProposeBlock",
+		"ProposeEncrypted",
+		"ProposeReference",
+		"ProposeSignerOp",
+		"RegisterKey",
+		"Reveal",
+		"SubmitFeedUpdate",
+		"SubmitGovernanceVote",
+		"SubmitHash",
+		"SubmitMultisigSignature",
+		"SubmitSigned",
+		"SubmitWarpMessage",
+		"Transfer",
+		"TransferClaim",
+	)
+)
+
+// AuditConfig configures the audit log of the API calls that write to this
+// node
+type AuditConfig struct {
+	// Header that holds the caller's identity, set by an authenticating
+	// proxy in front of the node. If empty, or missing from a request, the
+	// caller is the request's remote address.
+	CallerHeader string `json:"callerHeader"`
+}
+
+// AuditRecord is a write API call recorded in the audit log
+type AuditRecord struct {
+	// Position of the record in the audit log
+	Index avajson.Uint64 `json:"index"`
+	// Name of the API method, such as "proposeBlock"
+	Method string `json:"method"`
+	Caller string `json:"caller"`
+	// Base 58 repr. of the SHA-256 hash of the call's params, as sent
+	PayloadHash string `json:"payloadHash"`
+	// Error returned by the call. Empty if it succeeded.
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// auditLog is an append-only log of the write API calls to this node. It
+// isn't part of the chain's state, so records are written to the database
+// immediately.
+type auditLog struct {
+	config AuditConfig
+
+	lock    sync.Mutex
+	db      database.Database
+	records database.Database // index -> AuditRecord
+	next    uint64
+}
+
+// newAuditLog returns the audit log in [db]
+func newAuditLog(config AuditConfig, db database.Database) (*auditLog, error) {
+	next, err := database.WithDefault(database.GetUInt64, db, auditNextKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{
+		config:  config,
+		db:      db,
+		records: prefixdb.New(auditRecordPrefix, db),
+		next:    next,
+	}, nil
+}
+
+// append adds [record] to the end of the log
+func (l *auditLog) append(record AuditRecord) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	record.Index = avajson.Uint64(l.next)
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := l.records.Put(database.PackUInt64(l.next), b); err != nil {
+		return err
+	}
+	if err := database.PutUInt64(l.db, auditNextKey, l.next+1); err != nil {
+		return err
+	}
+	l.next++
+	return nil
+}
+
+// query returns up to [limit] records from [start] on, oldest first, that
+// match [method] and [caller]. Empty filters match every record.
+func (l *auditLog) query(start uint64, limit int, method, caller string) ([]AuditRecord, error) {
+	it := l.records.NewIteratorWithStart(database.PackUInt64(start))
+	defer it.Release()
+
+	var records []AuditRecord
+	for len(records) < limit && it.Next() {
+		var record AuditRecord
+		if err := json.Unmarshal(it.Value(), &record); err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadAuditRecord, err)
+		}
+		if (method == "" || strings.EqualFold(record.Method, method)) && (caller == "" || record.Caller == caller) {
+			records = append(records, record)
+		}
+	}
+	return records, it.Error()
+}
+
+// caller returns the identity of the caller of [r]
+func (l *auditLog) caller(r *http.Request) string {
+	if l.config.CallerHeader != "" {
+		if caller := r.Header.Get(l.config.CallerHeader); caller != "" {
+			return caller
+		}
+	}
+	return r.RemoteAddr
+}
+
+// auditHandler records each call to a write API method in [log] once [next]
+// has answered it. The answer is held until the call is recorded. Calls of
+// batch requests are recorded one by one, since [batchHandler] passes each
+// call on as its own request.
+type auditHandler struct {
+	next http.Handler
+	log  *auditLog
+}
+
+func (h *auditHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var call struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if json.Unmarshal(body, &call) != nil || !auditedMethods.Contains(serviceMethod(call.Method)) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	resp := &bufferedResponse{header: make(http.Header)}
+	h.next.ServeHTTP(resp, r)
+
+	hash := sha256.Sum256(call.Params)
+	record := AuditRecord{
+		Method:      call.Method[strings.IndexByte(call.Method, '.')+1:],
+		Caller:      h.log.caller(r),
+		PayloadHash: encoding.EncodeCB58(hash[:]),
+		Error:       responseError(resp),
+		Time:        time.Now().UTC(),
+	}
+	// A call that can't be recorded isn't answered, so that every answered
+	// write is in the log
+	if err := h.log.append(record); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't record call in the audit log: %s", err), http.StatusInternalServerError)
+		return
+	}
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	if resp.status != 0 {
+		w.WriteHeader(resp.status)
+	}
+	_, _ = w.Write(resp.body.Bytes())
+}
+
+// serviceMethod returns the name of the Service method that the JSON-RPC
+// method [method], such as "timestamp.proposeBlock", is served by
+func serviceMethod(method string) string {
+	name := method[strings.IndexByte(method, '.')+1:]
+	if name == "" {
+		return ""
+	}
+	runes := []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// responseError returns the error message of the JSON-RPC response [resp],
+// or its body if it isn't a JSON-RPC response. Empty if the call succeeded.
+func responseError(resp *bufferedResponse) string {
+	var reply struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(resp.body.Bytes(), &reply); err != nil {
+		return strings.TrimSpace(resp.body.String())
+	}
+	if reply.Error == nil {
+		return ""
+	}
+	return reply.Error.Message
+}
+
+func (vm *VM) auditLog() *auditLog {
+	return vm.audit
+}
+
+// GetAuditLogArgs are the arguments to GetAuditLog
+type GetAuditLogArgs struct {
+	// Index of the first record that may be returned
+	StartIndex avajson.Uint64 `json:"startIndex"`
+	// Max number of records to return. Zero means 25. At most 100.
+	Limit avajson.Uint32 `json:"limit"`
+	// If set, only calls of this method are returned
+	Method string `json:"method"`
+	// If set, only calls by this caller are returned
+	Caller string `json:"caller"`
+	// If set, the records start where the previous page's nextCursor says,
+	// instead of at [StartIndex]. The page must have the same filters.
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *GetAuditLogArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultAuditPageSize, maxAuditPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: auditLogCursor, direction: forward, position: uint64(a.StartIndex)})
+}
+
+// GetAuditLogReply is the reply from GetAuditLog
+type GetAuditLogReply struct {
+	Records []AuditRecord `json:"records"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetAuditLog returns the write API calls recorded in this node's audit
+// log, oldest first, starting at [args.StartIndex]
+func (s *Service) GetAuditLog(_ *http.Request, args *GetAuditLogArgs, reply *GetAuditLogReply) error {
+	log := s.backend.auditLog()
+	if log == nil {
+		return errAuditDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	records, err := log.query(args.start.position, args.limit+1, args.Method, args.Caller)
+	if err != nil {
+		return err
+	}
+	if len(records) > args.limit {
+		reply.NextCursor = args.start.at(uint64(records[args.limit].Index)).String()
+		records = records[:args.limit]
+	}
+	reply.Records = records
+	return nil
+}
@@ -0,0 +1,878 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"slices"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+
+	"github.com/hitrich/AVM-TEST/light"
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+var _ backend = &VM{}
+
+// backend is the chain the API service reads from and proposes to. The VM is
+// the backend of a running chain. Tests of the API and of its clients can
+// use an in-memory fake instead, which needs no snow context or database.
+// Implementations are called from API goroutines, so they must lock whatever
+// they share with the consensus engine.
+type backend interface {
+	blockStore
+	mempool
+	signerOpPool
+	transferPool
+	claimRegistry
+	aclRegistry
+	revealRegistry
+	keyRegistry
+	feedRegistry
+	namespaceIndex
+	prover
+	anchorIndex
+	referenceIndex
+	hashAggregator
+	explorerIndex
+	kvStore
+	documentIndex
+	headerChain
+	warpRelay
+	governanceRegistry
+	multisigRegistry
+	accountRegistry
+	blockAttestor
+	retentionIndex
+	auditTrail
+	hookIndex
+	indexerFeed
+	chainConfig
+}
+
+// blockStore looks up blocks and balances
+type blockStore interface {
+	// lastAcceptedID returns the ID of the last accepted block
+	lastAcceptedID(ctx context.Context) (ids.ID, error)
+	// lookupBlock returns the block with ID [blkID], which may be processing
+	lookupBlock(ctx context.Context, blkID ids.ID) (*Block, error)
+	// lookupHeader returns the header of the block with ID [blkID], which may
+	// be processing
+	lookupHeader(ctx context.Context, blkID ids.ID) (blockHeader, error)
+	// acceptedAtHeight returns the ID of the accepted block at [height]
+	acceptedAtHeight(ctx context.Context, height uint64) (ids.ID, error)
+	// chainHead returns the headers of the last accepted block and of the
+	// preferred block, at the same moment
+	chainHead(ctx context.Context) (lastAccepted blockHeader, preferred blockHeader, err error)
+	// dataBlock returns the ID of the accepted block that contains [data].
+	// Returns database.ErrNotFound if no accepted block contains [data].
+	dataBlock(ctx context.Context, data [dataLen]byte) (ids.ID, error)
+	// balance returns the balance of [addr] after the last accepted block
+	balance(ctx context.Context, addr ids.ShortID) (uint64, error)
+	// burned returns the total fees burned by accepted blocks
+	burned(ctx context.Context) (uint64, error)
+	// currentFee returns the parameters of the next block after the last
+	// accepted block and the fee for each piece of data in it if it's built
+	// now
+	currentFee() (*ChainParams, uint64, error)
+}
+
+// chainConfig describes how the chain, and this node's view of it, are
+// configured
+type chainConfig interface {
+	// chainGenesis returns the chain's genesis
+	chainGenesis() *Genesis
+	// upgradeConfig returns the chain's upgrade config
+	upgradeConfig() UpgradeConfig
+	// nodeConfig returns this node's current config of the chain
+	nodeConfig() Config
+}
+
+// mempool holds proposed data until it's built into a block
+type mempool interface {
+	// maxPayloadSize returns the max number of bytes of proposed data
+	maxPayloadSize() int
+	// verifyProposal returns nil iff [proposal] may be proposed in
+	// [namespace]
+	verifyProposal(proposal []byte, namespace [NamespaceLen]byte) error
+	// proposeBlock adds [data] to the mempool
+	proposeBlock(data [dataLen]byte) error
+	// submitProposal adds [data] to the mempool once the Unix time
+	// [notBefore] has passed, and returns the proposal's ID and the random
+	// token that cancels it
+	submitProposal(data [dataLen]byte, namespace [NamespaceLen]byte, notBefore int64) (uint64, [cancelTokenLen]byte, error)
+	// cancelProposal removes the pending proposal [id] if [cancelToken] is
+	// its cancel token or the caller is an [admin]
+	cancelProposal(id uint64, cancelToken [cancelTokenLen]byte, admin bool) error
+	// mempoolLen returns the number of pieces of data in the mempool
+	mempoolLen() int
+	// scheduledLen returns the number of pieces of data that aren't due yet
+	scheduledLen() int
+}
+
+// signerOpPool holds signer operations until they are built into a block
+type signerOpPool interface {
+	// chainID returns the ID of the chain, which signer operations are signed
+	// for
+	chainID() ids.ID
+	// chainParams returns the chain's parameters
+	chainParams() *ChainParams
+	// addSignerOp adds [op] to the pending operations
+	addSignerOp(op SignerOp) error
+}
+
+// transferPool holds transfers until they are built into a block
+type transferPool interface {
+	// addTransfer adds [t] to the pending transfers
+	addTransfer(t Transfer) error
+	// nonce returns the nonce of [addr]'s next transfer after the last
+	// accepted block
+	nonce(addr ids.ShortID) (uint64, error)
+}
+
+// claimRegistry tracks the claims on data of chains with claims
+type claimRegistry interface {
+	// addClaimTransfer adds [t] to the pending claim transfers
+	addClaimTransfer(t ClaimTransfer) error
+	// claim returns the claim on [data] after the last accepted block.
+	// Returns database.ErrNotFound if [data] has no claim.
+	claim(data [dataLen]byte) (claim, error)
+	// ownedClaims returns the data claimed by [owner] after the last
+	// accepted block, in the order of the data's bytes
+	ownedClaims(ctx context.Context, owner ids.ShortID) ([][dataLen]byte, error)
+}
+
+// revealRegistry tracks the reveals of commitments of chains with reveals
+type revealRegistry interface {
+	// addReveal adds [r] to the pending reveals
+	addReveal(r Reveal) error
+	// reveal returns the data an accepted block revealed for [commitment].
+	// Returns database.ErrNotFound if it isn't revealed.
+	reveal(commitment [dataLen]byte) (revealed, error)
+}
+
+// keyRegistry tracks the keys and encrypted payloads of chains with
+// encrypted payloads
+type keyRegistry interface {
+	// addKeyRegistration adds [r] to the pending key registrations
+	addKeyRegistration(r KeyRegistration) error
+	// addEncrypted adds [p] to the pending encrypted payloads
+	addEncrypted(p EncryptedPayload) error
+	// encryptionKey returns version [version] of [addr]'s key after the last
+	// accepted block, or its latest key and version if [version] is zero.
+	// Returns database.ErrNotFound if there is no such key.
+	encryptionKey(addr ids.ShortID, version uint64) ([EncryptionKeyLen]byte, uint64, error)
+	// encrypted returns the accepted encrypted payload [id].
+	// Returns database.ErrNotFound if it isn't accepted.
+	encrypted(id [dataLen]byte) (encryptedEntry, error)
+}
+
+// feedRegistry tracks the oracles and updates of chains with oracle feeds
+type feedRegistry interface {
+	// addFeedUpdate adds [u] to the pending feed updates
+	addFeedUpdate(u FeedUpdate) error
+	// isOracle returns true iff [addr] may sign updates of [feed]
+	isOracle(feed [FeedIDLen]byte, addr ids.ShortID) (bool, error)
+	// feedValue returns [feed]'s latest update after the last accepted
+	// block. Returns database.ErrNotFound if [feed] has no accepted updates.
+	feedValue(feed [FeedIDLen]byte) (feedEntry, error)
+	// feedHistory returns up to [limit] of [feed]'s accepted updates, oldest
+	// first, starting at the timestamp [start]
+	feedHistory(ctx context.Context, feed [FeedIDLen]byte, start uint64, limit int) ([]feedEntry, error)
+}
+
+// aclRegistry tracks who may write to the namespaces of chains with ACLs
+type aclRegistry interface {
+	// addACLOp adds [op] to the pending ACL operations
+	addACLOp(op ACLOp) error
+	// writers returns the addresses that may write to [namespace] after the
+	// last accepted block
+	writers(namespace [NamespaceLen]byte) (*writerSet, error)
+}
+
+// namespaceIndex indexes the accepted data of chains with namespaces
+type namespaceIndex interface {
+	// namespaceData returns up to [limit] pieces of [namespace]'s accepted
+	// data, oldest first, starting at the piece at [index] in the block at
+	// [start]
+	namespaceData(ctx context.Context, namespace [NamespaceLen]byte, start uint64, index int, limit int) ([]namespaceEntry, error)
+	// namespaces returns up to [limit] namespaces with accepted data, in the
+	// order of the namespaces' bytes, skipping the first [start]
+	namespaces(ctx context.Context, start uint64, limit int) ([]namespaceSummary, error)
+}
+
+// prover signs the checkpoints of notarization proofs
+type prover interface {
+	// checkpointSigner returns this node's signer, or nil if it has none
+	checkpointSigner() Signer
+}
+
+// anchorIndex records the IPFS content anchored through this node's API
+type anchorIndex interface {
+	// anchoringEnabled returns true iff IPFS content may be anchored through
+	// this node's API
+	anchoringEnabled() bool
+	// putAnchor records that [a] was anchored
+	putAnchor(a anchor) error
+	// anchors returns up to [limit] pieces of anchored content in the order of
+	// the CIDs' bytes, skipping the first [start]
+	anchors(ctx context.Context, start uint64, limit int) ([]anchor, error)
+}
+
+// referenceIndex records the references to off-chain content proposed
+// through this node's API
+type referenceIndex interface {
+	// referencesEnabled returns true iff references may be proposed through
+	// this node's API
+	referencesEnabled() bool
+	// putReference records that [r] was proposed
+	putReference(r dataReference) error
+	// reference returns the reference whose data is [data].
+	// Returns database.ErrNotFound if this node didn't record it.
+	reference(data [dataLen]byte) (dataReference, error)
+}
+
+// hashAggregator aggregates hashes submitted through this node's API into
+// Merkle trees
+type hashAggregator interface {
+	// aggregationEnabled returns true iff hashes may be submitted through
+	// this node's API
+	aggregationEnabled() bool
+	// submitHash adds [hash] to the hashes that are aggregated next
+	submitHash(hash [dataLen]byte) error
+	// aggregatedPath returns the root that [hash] was aggregated into and its
+	// path to the root
+	aggregatedPath(hash [dataLen]byte) ([dataLen]byte, *proof.MerklePath, error)
+}
+
+// explorerIndex summarizes the chain for block explorers
+type explorerIndex interface {
+	// submitters returns the stats of up to [limit] addresses that signed an
+	// accepted block, in the order of the addresses, skipping the first
+	// [start]
+	submitters(ctx context.Context, start uint64, limit int) ([]submitterSummary, error)
+}
+
+// kvStore is the key-value state of chains with the key-value payload rule
+type kvStore interface {
+	// kvValue returns the value of [key] after the last accepted block.
+	// Returns database.ErrNotFound if [key] has no value.
+	kvValue(key [KVKeyLen]byte) (kvEntry, error)
+	// kvHistory returns up to [limit] accepted operations on [key], oldest
+	// first, starting at the piece at [index] in the block at [start]
+	kvHistory(ctx context.Context, key [KVKeyLen]byte, start uint64, index int, limit int) ([]kvHistoryEntry, error)
+}
+
+// documentIndex is the document histories of chains with the document
+// payload rule
+type documentIndex interface {
+	// documentHistory returns up to [limit] accepted versions of [docID],
+	// oldest first, skipping the first [start]
+	documentHistory(ctx context.Context, docID [DocIDLen]byte, start uint64, limit int) ([]docHistoryEntry, error)
+}
+
+// headerChain is the light headers of the accepted blocks
+type headerChain interface {
+	// lightHeaders returns up to [limit] consecutive light headers, starting
+	// at [start]
+	lightHeaders(ctx context.Context, start uint64, limit int) ([]light.Header, error)
+}
+
+// governanceRegistry tracks the votes and parameter changes of chains with
+// governance
+type governanceRegistry interface {
+	// addVote adds [v] to the pending votes if it can be accepted after the
+	// last accepted block
+	addVote(v GovernanceVote) error
+	// governance returns the parameters of the next block after the last
+	// accepted block and the accepted changes that activate after it
+	governance() (*ChainParams, []ParamChange, error)
+	// proposalVotes returns the addresses whose votes for [c] were accepted
+	// and whether [c] passed
+	proposalVotes(c ParamChange) ([]ids.ShortID, bool, error)
+}
+
+// warpRelay accepts hashes attested by Warp messages from approved chains
+type warpRelay interface {
+	// addWarpMessage adds the Warp message [msg], which relays [a], to the
+	// pending Warp messages if its signature is valid at the current
+	// P-Chain height
+	addWarpMessage(ctx context.Context, msg []byte, a warpAttestation) error
+	// warpAttestation returns the height of the accepted block in which
+	// [sourceChainID] attested [hash]
+	warpAttestation(sourceChainID, hash ids.ID) (uint64, error)
+}
+
+// multisigRegistry collects the signatures of multisig proposals on chains
+// with multisig sets
+type multisigRegistry interface {
+	// addMultisigSignature adds [sig] to the pending proposal of [data] in
+	// [namespace] with [set] and returns the proposal and [set]'s threshold.
+	// It fails if [data] can't be put in the next block.
+	addMultisigSignature(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte, sig [secp256k1.SignatureLen]byte) (MultisigProposal, int, error)
+	// multisig returns the signers of the proposal of [data] in [namespace]
+	// with [set] and true if it's accepted, or its pending signers and false
+	// if it isn't
+	multisig(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte) (multisigEntry, bool, error)
+}
+
+// accountRegistry tracks the signed submissions and accounts of chains with
+// accounts
+type accountRegistry interface {
+	// addSubmission adds [s] to the pending submissions if its nonce isn't
+	// used after the last accepted block and its data can be put in the
+	// next block
+	addSubmission(s SignedSubmission) error
+	// submitterAccount returns the account of [addr] after the last accepted
+	// block. Returns database.ErrNotFound if [addr] has no account.
+	submitterAccount(addr ids.ShortID) (submitterAccount, error)
+	// accountHistory returns up to [limit] of [addr]'s accepted submissions
+	// from the nonce [start] on
+	accountHistory(ctx context.Context, addr ids.ShortID, start uint64, limit int) ([]submissionEntry, error)
+}
+
+// blockAttestor aggregates the validators' attestations of accepted blocks
+type blockAttestor interface {
+	// attestationsEnabled returns true iff this node aggregates attestations
+	attestationsEnabled() bool
+	// blockAttestation returns the aggregate of the attestations of the
+	// block [blkID] that this node has received
+	blockAttestation(ctx context.Context, blkID ids.ID) (*aggregateAttestation, error)
+}
+
+// retentionIndex reports how this node retains the data of accepted blocks
+type retentionIndex interface {
+	// retentionEnabled returns true iff this node has retention policies
+	retentionEnabled() bool
+	// blockRetention returns the retention status of each piece of the
+	// accepted block [blk]'s data
+	blockRetention(blk *Block) ([]dataRetention, error)
+}
+
+// auditTrail records the write API calls to the node
+type auditTrail interface {
+	// auditLog returns the node's audit log, or nil if it has none
+	auditLog() *auditLog
+}
+
+// hookIndex holds the outcome of the node's WASM hook on accepted data
+type hookIndex interface {
+	// wasmHooks returns the node's hook runner, or nil if it has none
+	wasmHooks() *hookRunner
+}
+
+// indexerFeed is the log of the changes to the accepted chain
+type indexerFeed interface {
+	// indexerEvents returns up to [limit] events of the indexer feed from
+	// the sequence [start] on
+	indexerEvents(ctx context.Context, start uint64, limit int) ([]indexerEvent, error)
+}
+
+func (vm *VM) lastAcceptedID(ctx context.Context) (ids.ID, error) {
+	if err := ctx.Err(); err != nil {
+		return ids.Empty, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getLastAccepted()
+}
+
+func (vm *VM) lookupBlock(ctx context.Context, blkID ids.ID) (*Block, error) {
+	// A request whose client is gone doesn't wait for the lock
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.getBlock(blkID)
+}
+
+func (vm *VM) lookupHeader(ctx context.Context, blkID ids.ID) (blockHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return blockHeader{}, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	header, _, err := vm.getHeader(blkID)
+	return header, err
+}
+
+func (vm *VM) chainHead(ctx context.Context) (blockHeader, blockHeader, error) {
+	if err := ctx.Err(); err != nil {
+		return blockHeader{}, blockHeader{}, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return blockHeader{}, blockHeader{}, err
+	}
+	lastAccepted, _, err := vm.getHeader(lastAcceptedID)
+	if err != nil {
+		return blockHeader{}, blockHeader{}, err
+	}
+	preferred, _, err := vm.getHeader(vm.preferred)
+	return lastAccepted, preferred, err
+}
+
+func (vm *VM) acceptedAtHeight(ctx context.Context, height uint64) (ids.ID, error) {
+	if err := ctx.Err(); err != nil {
+		return ids.Empty, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getBlockIDAtHeight(height)
+}
+
+func (vm *VM) dataBlock(ctx context.Context, data [dataLen]byte) (ids.ID, error) {
+	if err := ctx.Err(); err != nil {
+		return ids.Empty, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getDataBlock(data)
+}
+
+func (vm *VM) balance(ctx context.Context, addr ids.ShortID) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getBalance(addr)
+}
+
+func (vm *VM) burned(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getBurned()
+}
+
+func (vm *VM) currentFee() (*ChainParams, uint64, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return nil, 0, err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return nil, 0, err
+	}
+	params, err := vm.paramsAt(lastAccepted, lastAccepted.Height()+1)
+	if err != nil {
+		return nil, 0, err
+	}
+	timestamp, err := vm.buildTimestamp(lastAccepted, params, vm.clock.Time())
+	if err != nil {
+		return nil, 0, err
+	}
+	fee, err := vm.baseFeeAfter(lastAccepted, params, timestamp.Unix())
+	if err != nil {
+		return nil, 0, err
+	}
+	return params, fee, nil
+}
+
+func (vm *VM) mempoolLen() int {
+	return vm.builder.len()
+}
+
+func (vm *VM) cancelProposal(id uint64, cancelToken [cancelTokenLen]byte, admin bool) error {
+	return vm.builder.cancelProposal(id, cancelToken, admin)
+}
+
+func (vm *VM) scheduledLen() int {
+	return vm.builder.scheduledLen()
+}
+
+func (vm *VM) chainID() ids.ID {
+	return vm.ctx.ChainID
+}
+
+func (vm *VM) chainParams() *ChainParams {
+	return &vm.genesis.Params
+}
+
+func (vm *VM) chainGenesis() *Genesis {
+	return vm.genesis
+}
+
+func (vm *VM) upgradeConfig() UpgradeConfig {
+	return vm.upgrades
+}
+
+func (vm *VM) nodeConfig() Config {
+	return *vm.config.Load()
+}
+
+func (vm *VM) addSignerOp(op SignerOp) error {
+	if err := vm.opJournal.put(signerOpKind, &op); err != nil {
+		return err
+	}
+	vm.pendingOps.add(op)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) addTransfer(t Transfer) error {
+	if err := vm.opJournal.put(transferKind, &t); err != nil {
+		return err
+	}
+	vm.pendingTransfers.add(t)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) nonce(addr ids.ShortID) (uint64, error) {
+	return vm.state.getNonce(addr)
+}
+
+func (vm *VM) addClaimTransfer(t ClaimTransfer) error {
+	if err := vm.opJournal.put(claimTransferKind, &t); err != nil {
+		return err
+	}
+	vm.pendingClaims.add(t)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) claim(data [dataLen]byte) (claim, error) {
+	return vm.state.getClaim(data)
+}
+
+func (vm *VM) ownedClaims(ctx context.Context, owner ids.ShortID) ([][dataLen]byte, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getOwnedClaims(ctx, owner)
+}
+
+func (vm *VM) addReveal(r Reveal) error {
+	if err := vm.opJournal.put(revealKind, &r); err != nil {
+		return err
+	}
+	vm.pendingReveals.add(r)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) reveal(commitment [dataLen]byte) (revealed, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getReveal(commitment)
+}
+
+func (vm *VM) addKeyRegistration(r KeyRegistration) error {
+	if err := vm.opJournal.put(keyRegistrationKind, &r); err != nil {
+		return err
+	}
+	vm.pendingEncryption.addKeyRegistration(r)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) addEncrypted(p EncryptedPayload) error {
+	if err := vm.opJournal.put(encryptedKind, &p); err != nil {
+		return err
+	}
+	vm.pendingEncryption.addEncrypted(p)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) encryptionKey(addr ids.ShortID, version uint64) ([EncryptionKeyLen]byte, uint64, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	if version == 0 {
+		latest, err := vm.state.getKeyVersion(addr)
+		if err != nil {
+			return [EncryptionKeyLen]byte{}, 0, err
+		}
+		version = latest
+	}
+	key, err := vm.state.getKey(addr, version)
+	return key, version, err
+}
+
+func (vm *VM) encrypted(id [dataLen]byte) (encryptedEntry, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getEncrypted(id)
+}
+
+func (vm *VM) addFeedUpdate(u FeedUpdate) error {
+	if err := vm.opJournal.put(feedUpdateKind, &u); err != nil {
+		return err
+	}
+	vm.pendingFeeds.add(u)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) addWarpMessage(ctx context.Context, msg []byte, a warpAttestation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	height, err := vm.ctx.ValidatorState.GetCurrentHeight(ctx)
+	if err != nil {
+		return err
+	}
+	if err := vm.verifyWarpAttestation(ctx, a, height); err != nil {
+		return err
+	}
+	if err := vm.opJournal.put(warpMessageKind, &msg); err != nil {
+		return err
+	}
+	vm.pendingWarp.add(msg)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) warpAttestation(sourceChainID, hash ids.ID) (uint64, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	height, err := vm.state.getWarpAttestation(warpAttestationKey(sourceChainID, hash))
+	if err == database.ErrNotFound {
+		return 0, errNoSuchAttestation
+	}
+	return height, err
+}
+
+func (vm *VM) isOracle(feed [FeedIDLen]byte, addr ids.ShortID) (bool, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.isOracle(feed, addr)
+}
+
+func (vm *VM) feedValue(feed [FeedIDLen]byte) (feedEntry, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getLatestFeedEntry(feed)
+}
+
+func (vm *VM) feedHistory(ctx context.Context, feed [FeedIDLen]byte, start uint64, limit int) ([]feedEntry, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getFeedEntries(ctx, feed, start, limit)
+}
+
+func (vm *VM) addACLOp(op ACLOp) error {
+	if err := vm.opJournal.put(aclOpKind, &op); err != nil {
+		return err
+	}
+	vm.pendingACLOps.add(op)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) writers(namespace [NamespaceLen]byte) (*writerSet, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getWriters(namespace)
+}
+
+func (vm *VM) submitters(ctx context.Context, start uint64, limit int) ([]submitterSummary, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getSubmitters(ctx, start, limit)
+}
+
+func (vm *VM) addVote(v GovernanceVote) error {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	g, err := vm.governanceAfter(lastAccepted)
+	if err != nil {
+		return err
+	}
+	if err := g.verify(&v, lastAccepted.Height()+1); err != nil {
+		return err
+	}
+	if err := vm.opJournal.put(voteKind, &v); err != nil {
+		return err
+	}
+	vm.pendingVotes.add(v)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) governance() (*ChainParams, []ParamChange, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return nil, nil, err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return nil, nil, err
+	}
+	next := lastAccepted.Height() + 1
+	params, err := vm.paramsAt(lastAccepted, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := vm.state.getParamChanges()
+	if err != nil {
+		return nil, nil, err
+	}
+	var scheduled []ParamChange
+	for _, c := range changes {
+		if c.ActivationHeight > next {
+			scheduled = append(scheduled, c)
+		}
+	}
+	return params, scheduled, nil
+}
+
+func (vm *VM) proposalVotes(c ParamChange) ([]ids.ShortID, bool, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	voters, err := vm.state.getVoters(c)
+	if err != nil {
+		return nil, false, err
+	}
+	passed, err := vm.state.isPassed(c)
+	if err != nil {
+		return nil, false, err
+	}
+	sorted := voters.List()
+	slices.SortFunc(sorted, ids.ShortID.Compare)
+	return sorted, passed, nil
+}
+
+func (vm *VM) addMultisigSignature(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte, sig [secp256k1.SignatureLen]byte) (MultisigProposal, int, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	config := vm.genesis.Params.multisigConfig(set)
+	if config == nil {
+		return MultisigProposal{}, 0, errUnknownMultisig
+	}
+	key := (&MultisigProposal{Set: set, Data: data, Namespace: namespace}).key()
+	accepted, err := vm.state.hasMultisig(key)
+	if err != nil {
+		return MultisigProposal{}, 0, err
+	}
+	if accepted {
+		return MultisigProposal{}, 0, errMultisigAccepted
+	}
+	// This node's signer writes the proposal's data into a block
+	if vm.signer == nil {
+		return MultisigProposal{}, 0, errNoSigningKey
+	}
+	if err := vm.verifyNextSignedData(vm.signer.Address(), data, namespace); err != nil {
+		return MultisigProposal{}, 0, err
+	}
+	proposal, err := vm.pendingMultisigs.addSignature(vm.ctx.ChainID, config, set, data, namespace, sig)
+	if err != nil {
+		return MultisigProposal{}, 0, err
+	}
+	if err := vm.opJournal.put(multisigSignatureKind, proposal.withSignature(sig)); err != nil {
+		return MultisigProposal{}, 0, err
+	}
+	if len(proposal.Sigs) >= config.Threshold {
+		vm.builder.markReady()
+	}
+	return proposal, config.Threshold, nil
+}
+
+func (vm *VM) multisig(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte) (multisigEntry, bool, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	key := (&MultisigProposal{Set: set, Data: data, Namespace: namespace}).key()
+	e, err := vm.state.getMultisig(key)
+	if err == nil {
+		return e, true, nil
+	}
+	if err != database.ErrNotFound {
+		return multisigEntry{}, false, err
+	}
+	signers, ok, err := vm.pendingMultisigs.signers(vm.ctx.ChainID, key)
+	if err != nil {
+		return multisigEntry{}, false, err
+	}
+	if !ok {
+		return multisigEntry{}, false, errNoSuchMultisig
+	}
+	return multisigEntry{signers: signers}, false, nil
+}
+
+func (vm *VM) addSubmission(s SignedSubmission) error {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	key, err := s.submitter(vm.ctx.ChainID)
+	if err != nil {
+		return err
+	}
+	a, err := vm.state.getSubmitterAccount(key.Address())
+	switch {
+	case err == nil && s.Nonce < a.nonce:
+		return errUsedSubmissionNonce
+	case err != nil && err != database.ErrNotFound:
+		return err
+	}
+	if err := vm.verifyNextSignedData(key.Address(), s.Data, s.Namespace); err != nil {
+		return err
+	}
+	if err := vm.opJournal.put(submissionKind, &s); err != nil {
+		return err
+	}
+	vm.pendingSubmissions.add(s)
+	vm.builder.markReady()
+	return nil
+}
+
+func (vm *VM) submitterAccount(addr ids.ShortID) (submitterAccount, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getSubmitterAccount(addr)
+}
+
+func (vm *VM) accountHistory(ctx context.Context, addr ids.ShortID, start uint64, limit int) ([]submissionEntry, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getSubmissions(ctx, addr, start, limit)
+}
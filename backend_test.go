@@ -0,0 +1,692 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/codec"
+	"github.com/ava-labs/avalanchego/codec/linearcodec"
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/trace"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/light"
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+var _ backend = &fakeBackend{}
+
+// fakeBackend is an in-memory chain for testing the API and its clients
+// without a snow context or a database. Each proposal is accepted in its own
+// block as soon as it's proposed.
+type fakeBackend struct {
+	t      testing.TB
+	codec  codec.Manager
+	params ChainParams
+
+	lock           sync.Mutex
+	blocks         map[ids.ID]*Block
+	heights        []ids.ID // height -> ID of the accepted block at that height
+	data           map[[dataLen]byte]ids.ID
+	balances       map[ids.ShortID]uint64
+	burnedFee      uint64
+	ops            []SignerOp
+	transfers      []Transfer
+	claimTransfers []ClaimTransfer
+	aclOps         []ACLOp
+	reveals        []Reveal
+	keyRegs        []KeyRegistration
+	payloads       []EncryptedPayload
+	feedUpdates    []FeedUpdate
+	votes          []GovernanceVote
+	multisigs      map[[multisigKeyLen]byte]*MultisigProposal
+	submissions    []SignedSubmission
+	anchorIdx      map[string]anchor // CID bytes -> anchor
+	referenceIdx   map[[dataLen]byte]dataReference
+}
+
+// newFakeBackend returns a fake chain with chain parameters [params] and a
+// genesis block with no data
+func newFakeBackend(t testing.TB, params ChainParams) *fakeBackend {
+	manager := codec.NewDefaultManager()
+	if err := manager.RegisterCodec(codecVersion, linearcodec.NewDefault()); err != nil {
+		t.Fatal(err)
+	}
+	if params.MaxPayloadSize == 0 {
+		params.MaxPayloadSize = dataLen
+	}
+	f := &fakeBackend{
+		t:            t,
+		codec:        manager,
+		params:       params,
+		blocks:       make(map[ids.ID]*Block),
+		data:         make(map[[dataLen]byte]ids.ID),
+		balances:     make(map[ids.ShortID]uint64),
+		anchorIdx:    make(map[string]anchor),
+		referenceIdx: make(map[[dataLen]byte]dataReference),
+	}
+	f.accept(ids.Empty, nil, nil)
+	return f
+}
+
+// accept adds an accepted child of [parentID] with [data] in [namespaces] to
+// the chain. The namespaces aren't marshaled.
+// Assumes [f.lock] is held.
+func (f *fakeBackend) accept(parentID ids.ID, data [][dataLen]byte, namespaces [][NamespaceLen]byte) *Block {
+	blk := &Block{
+		PrntID: parentID,
+		Hght:   uint64(len(f.heights)),
+		Tmstmp: time.Now().Unix(),
+		Dt:     data,
+		Ns:     namespaces,
+	}
+	blockBytes, err := f.codec.Marshal(codecVersion, blk)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	blk.Initialize(blockBytes, choices.Accepted, nil)
+	f.blocks[blk.ID()] = blk
+	f.heights = append(f.heights, blk.ID())
+	for _, d := range data {
+		f.data[d] = blk.ID()
+	}
+	return blk
+}
+
+func (f *fakeBackend) lastAcceptedID(context.Context) (ids.ID, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.heights[len(f.heights)-1], nil
+}
+
+// chainHead returns the last accepted block as the preferred block too, since
+// the fake has no processing blocks
+func (f *fakeBackend) chainHead(ctx context.Context) (blockHeader, blockHeader, error) {
+	blkID, err := f.lastAcceptedID(ctx)
+	if err != nil {
+		return blockHeader{}, blockHeader{}, err
+	}
+	header, err := f.lookupHeader(ctx, blkID)
+	return header, header, err
+}
+
+func (f *fakeBackend) lookupBlock(_ context.Context, blkID ids.ID) (*Block, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	blk, ok := f.blocks[blkID]
+	if !ok {
+		return nil, database.ErrNotFound
+	}
+	return blk, nil
+}
+
+func (f *fakeBackend) lookupHeader(_ context.Context, blkID ids.ID) (blockHeader, error) {
+	blk, err := f.lookupBlock(context.Background(), blkID)
+	if err != nil {
+		return blockHeader{}, err
+	}
+	return blk.header(), nil
+}
+
+func (f *fakeBackend) acceptedAtHeight(_ context.Context, height uint64) (ids.ID, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if height >= uint64(len(f.heights)) {
+		return ids.Empty, database.ErrNotFound
+	}
+	return f.heights[height], nil
+}
+
+func (f *fakeBackend) dataBlock(_ context.Context, data [dataLen]byte) (ids.ID, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	blkID, ok := f.data[data]
+	if !ok {
+		return ids.Empty, database.ErrNotFound
+	}
+	return blkID, nil
+}
+
+func (f *fakeBackend) balance(_ context.Context, addr ids.ShortID) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.balances[addr], nil
+}
+
+func (f *fakeBackend) burned(context.Context) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.burnedFee, nil
+}
+
+func (f *fakeBackend) currentFee() (*ChainParams, uint64, error) {
+	return &f.params, f.params.Fee, nil
+}
+
+func (f *fakeBackend) chainGenesis() *Genesis {
+	return &Genesis{Params: f.params}
+}
+
+func (*fakeBackend) upgradeConfig() UpgradeConfig {
+	return UpgradeConfig{}
+}
+
+func (*fakeBackend) nodeConfig() Config {
+	return DefaultConfig()
+}
+
+func (f *fakeBackend) maxPayloadSize() int {
+	return f.params.MaxPayloadSize
+}
+
+func (*fakeBackend) verifyProposal([]byte, [NamespaceLen]byte) error {
+	return nil
+}
+
+func (f *fakeBackend) proposeBlock(data [dataLen]byte) error {
+	_, _, err := f.submitProposal(data, [NamespaceLen]byte{}, 0)
+	return err
+}
+
+// submitProposal ignores [notBefore] and accepts [data] immediately, so
+// every proposal's ID and cancel token are zero
+func (f *fakeBackend) submitProposal(data [dataLen]byte, namespace [NamespaceLen]byte, _ int64) (uint64, [cancelTokenLen]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var namespaces [][NamespaceLen]byte
+	if f.params.namespaced() {
+		namespaces = [][NamespaceLen]byte{namespace}
+	}
+	f.accept(f.heights[len(f.heights)-1], [][dataLen]byte{data}, namespaces)
+	return 0, [cancelTokenLen]byte{}, nil
+}
+
+// cancelProposal always fails because proposals are accepted immediately
+func (*fakeBackend) cancelProposal(uint64, [cancelTokenLen]byte, bool) error {
+	return errUnknownProposal
+}
+
+// scheduledLen is always 0 because proposals are accepted immediately
+func (*fakeBackend) scheduledLen() int {
+	return 0
+}
+
+// mempoolLen is always 0 because proposals are accepted immediately
+func (*fakeBackend) mempoolLen() int {
+	return 0
+}
+
+func (*fakeBackend) chainID() ids.ID {
+	return blockchainID
+}
+
+func (f *fakeBackend) chainParams() *ChainParams {
+	return &f.params
+}
+
+func (f *fakeBackend) addSignerOp(op SignerOp) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.ops = append(f.ops, op)
+	return nil
+}
+
+func (f *fakeBackend) addTransfer(t Transfer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.transfers = append(f.transfers, t)
+	return nil
+}
+
+// nonce is always 0 because transfers are never accepted
+func (*fakeBackend) nonce(ids.ShortID) (uint64, error) {
+	return 0, nil
+}
+
+func (f *fakeBackend) addClaimTransfer(t ClaimTransfer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.claimTransfers = append(f.claimTransfers, t)
+	return nil
+}
+
+// claim always returns database.ErrNotFound because the fake mints no claims
+func (*fakeBackend) claim([dataLen]byte) (claim, error) {
+	return claim{}, database.ErrNotFound
+}
+
+func (*fakeBackend) ownedClaims(context.Context, ids.ShortID) ([][dataLen]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeBackend) addReveal(r Reveal) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.reveals = append(f.reveals, r)
+	return nil
+}
+
+// reveal always returns database.ErrNotFound because reveals are never
+// accepted
+func (*fakeBackend) reveal([dataLen]byte) (revealed, error) {
+	return revealed{}, database.ErrNotFound
+}
+
+func (f *fakeBackend) addKeyRegistration(r KeyRegistration) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.keyRegs = append(f.keyRegs, r)
+	return nil
+}
+
+func (f *fakeBackend) addEncrypted(p EncryptedPayload) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.payloads = append(f.payloads, p)
+	return nil
+}
+
+// encryptionKey always returns database.ErrNotFound because key
+// registrations are never accepted
+func (*fakeBackend) encryptionKey(ids.ShortID, uint64) ([EncryptionKeyLen]byte, uint64, error) {
+	return [EncryptionKeyLen]byte{}, 0, database.ErrNotFound
+}
+
+// encrypted always returns database.ErrNotFound because encrypted payloads
+// are never accepted
+func (*fakeBackend) encrypted([dataLen]byte) (encryptedEntry, error) {
+	return encryptedEntry{}, database.ErrNotFound
+}
+
+func (f *fakeBackend) addFeedUpdate(u FeedUpdate) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.feedUpdates = append(f.feedUpdates, u)
+	return nil
+}
+
+// isOracle returns true iff [addr] is one of [feed]'s oracles in the chain
+// parameters
+func (f *fakeBackend) isOracle(feed [FeedIDLen]byte, addr ids.ShortID) (bool, error) {
+	config := f.params.feedConfig(feed)
+	return config != nil && slices.Contains(config.Oracles, addr), nil
+}
+
+// feedValue always returns database.ErrNotFound because feed updates are
+// never accepted
+func (*fakeBackend) feedValue([FeedIDLen]byte) (feedEntry, error) {
+	return feedEntry{}, database.ErrNotFound
+}
+
+func (*fakeBackend) feedHistory(context.Context, [FeedIDLen]byte, uint64, int) ([]feedEntry, error) {
+	return nil, nil
+}
+
+func (f *fakeBackend) addACLOp(op ACLOp) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.aclOps = append(f.aclOps, op)
+	return nil
+}
+
+// writers returns the writers in the chain parameters because ACL
+// operations are never accepted
+func (f *fakeBackend) writers(namespace [NamespaceLen]byte) (*writerSet, error) {
+	w := &writerSet{writers: set.Set[ids.ShortID]{}}
+	if acl := f.params.namespaceACL(namespace); acl != nil {
+		w.writers.Add(acl.Writers...)
+	}
+	return w, nil
+}
+
+func (f *fakeBackend) namespaceData(_ context.Context, namespace [NamespaceLen]byte, start uint64, index int, limit int) ([]namespaceEntry, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var entries []namespaceEntry
+	for height := start; height < uint64(len(f.heights)); height++ {
+		blk := f.blocks[f.heights[height]]
+		for i, ns := range blk.Ns {
+			if ns == namespace && len(entries) < limit && (height > start || i >= index) {
+				entries = append(entries, namespaceEntry{data: blk.Dt[i], height: height, index: i})
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (f *fakeBackend) namespaces(_ context.Context, start uint64, limit int) ([]namespaceSummary, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	counts := make(map[[NamespaceLen]byte]uint64)
+	for _, blkID := range f.heights {
+		for _, namespace := range f.blocks[blkID].Ns {
+			counts[namespace]++
+		}
+	}
+	summaries := make([]namespaceSummary, 0, len(counts))
+	for namespace, count := range counts {
+		summaries = append(summaries, namespaceSummary{namespace: namespace, count: count})
+	}
+	slices.SortFunc(summaries, func(a, b namespaceSummary) int {
+		return bytes.Compare(a.namespace[:], b.namespace[:])
+	})
+	return page(summaries, start, limit), nil
+}
+
+// checkpointSigner is nil, so the fake's proofs have no checkpoint
+func (*fakeBackend) checkpointSigner() Signer {
+	return nil
+}
+
+func (*fakeBackend) anchoringEnabled() bool {
+	return true
+}
+
+func (f *fakeBackend) putAnchor(a anchor) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.anchorIdx[a.cid.KeyString()] = a
+	return nil
+}
+
+func (f *fakeBackend) anchors(_ context.Context, start uint64, limit int) ([]anchor, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys := maps.Keys(f.anchorIdx)
+	anchors := make([]anchor, 0, len(f.anchorIdx))
+	for _, key := range slices.Sorted(keys) {
+		anchors = append(anchors, f.anchorIdx[key])
+	}
+	return page(anchors, start, limit), nil
+}
+
+// page returns up to [limit] of [s]'s elements, skipping the first [start]
+func page[T any](s []T, start uint64, limit int) []T {
+	s = s[min(start, uint64(len(s))):]
+	return s[:min(limit, len(s))]
+}
+
+func (*fakeBackend) referencesEnabled() bool {
+	return true
+}
+
+func (f *fakeBackend) putReference(r dataReference) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.referenceIdx[r.data()] = r
+	return nil
+}
+
+func (f *fakeBackend) reference(data [dataLen]byte) (dataReference, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	r, ok := f.referenceIdx[data]
+	if !ok {
+		return dataReference{}, database.ErrNotFound
+	}
+	return r, nil
+}
+
+// Assert that the API and the client work against the fake chain
+func TestFakeBackend(t *testing.T) {
+	fake := newFakeBackend(t, ChainParams{})
+	handler, err := newServiceHandler(fake, unversionedAPI, trace.Noop, logging.NoLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	if err := client.ProposeBlock(ctx, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := client.GetLastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blk.Height != 1 || len(blk.Data) != 1 || blk.Status != choices.Accepted.String() {
+		t.Fatalf("unexpected last accepted block %+v", blk)
+	}
+	genesis, err := client.GetBlockByHeight(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.ID != blk.ParentID {
+		t.Fatalf("expected parent %s but got %s", genesis.ID, blk.ParentID)
+	}
+
+	const cid = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	if _, err := client.AnchorCID(ctx, cid, "text/html"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AnchorCID(ctx, "not a cid", ""); err == nil {
+		t.Fatal("expected a bad CID to be refused")
+	}
+	anchors, _, err := client.ListAnchoredCIDs(ctx, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anchors) != 1 || anchors[0].CID != cid || anchors[0].ContentType != "text/html" || anchors[0].BlockID == "" {
+		t.Fatalf("unexpected anchors %+v", anchors)
+	}
+}
+
+func (*fakeBackend) aggregationEnabled() bool {
+	return false
+}
+
+func (*fakeBackend) submitHash([dataLen]byte) error {
+	return errAggregationDisabled
+}
+
+func (*fakeBackend) aggregatedPath([dataLen]byte) ([dataLen]byte, *proof.MerklePath, error) {
+	return [dataLen]byte{}, nil, errAggregationDisabled
+}
+
+// submitters is always empty because the fake's blocks aren't signed
+func (*fakeBackend) submitters(context.Context, uint64, int) ([]submitterSummary, error) {
+	return nil, nil
+}
+
+func (*fakeBackend) kvValue([KVKeyLen]byte) (kvEntry, error) {
+	return kvEntry{}, errKVDisabled
+}
+
+func (*fakeBackend) kvHistory(context.Context, [KVKeyLen]byte, uint64, int, int) ([]kvHistoryEntry, error) {
+	return nil, errKVDisabled
+}
+
+func (*fakeBackend) documentHistory(context.Context, [DocIDLen]byte, uint64, int) ([]docHistoryEntry, error) {
+	return nil, errDocsDisabled
+}
+
+// lightHeaders builds the header chain of the fake's blocks on every call
+func (f *fakeBackend) lightHeaders(_ context.Context, start uint64, limit int) ([]light.Header, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var (
+		headers  []light.Header
+		parentID ids.ID
+	)
+	for height, blkID := range f.heights {
+		h := f.blocks[blkID].lightHeader(parentID)
+		if uint64(height) >= start && len(headers) < limit {
+			headers = append(headers, h)
+		}
+		parentID = h.ID()
+	}
+	return headers, nil
+}
+
+func (*fakeBackend) addWarpMessage(context.Context, []byte, warpAttestation) error {
+	return errWarpDisabled
+}
+
+func (*fakeBackend) warpAttestation(ids.ID, ids.ID) (uint64, error) {
+	return 0, errWarpDisabled
+}
+
+func (*fakeBackend) attestationsEnabled() bool {
+	return false
+}
+
+func (*fakeBackend) blockAttestation(context.Context, ids.ID) (*aggregateAttestation, error) {
+	return nil, errAttestationsDisabled
+}
+
+func (*fakeBackend) auditLog() *auditLog {
+	return nil
+}
+
+func (*fakeBackend) wasmHooks() *hookRunner {
+	return nil
+}
+
+func (*fakeBackend) retentionEnabled() bool {
+	return false
+}
+
+// indexerEvents returns an accepted event for each accepted block, whose
+// sequence is its height
+func (f *fakeBackend) indexerEvents(_ context.Context, start uint64, limit int) ([]indexerEvent, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var events []indexerEvent
+	for height := start; height < uint64(len(f.heights)) && len(events) < limit; height++ {
+		events = append(events, indexerEvent{sequence: height, height: height})
+	}
+	return events, nil
+}
+
+func (*fakeBackend) blockRetention(*Block) ([]dataRetention, error) {
+	return nil, errRetentionDisabled
+}
+
+func (f *fakeBackend) addVote(v GovernanceVote) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.votes = append(f.votes, v)
+	return nil
+}
+
+// addMultisigSignature adds [sig] to the proposal of [data] in [namespace]
+// with [set]. Proposals are never accepted.
+func (f *fakeBackend) addMultisigSignature(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte, sig [secp256k1.SignatureLen]byte) (MultisigProposal, int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	config := f.params.multisigConfig(set)
+	if config == nil {
+		return MultisigProposal{}, 0, errUnknownMultisig
+	}
+	if f.multisigs == nil {
+		f.multisigs = make(map[[multisigKeyLen]byte]*MultisigProposal)
+	}
+	proposal := MultisigProposal{Set: set, Data: data, Namespace: namespace}
+	key := [multisigKeyLen]byte(proposal.key())
+	if pending, ok := f.multisigs[key]; ok {
+		proposal.Sigs = slices.Clone(pending.Sigs)
+	}
+	proposal.Sigs = append(proposal.Sigs, sig)
+	if err := proposal.verifySigners(blockchainID, config, false); err != nil {
+		return MultisigProposal{}, 0, err
+	}
+	f.multisigs[key] = &proposal
+	return proposal, config.Threshold, nil
+}
+
+// multisig returns the signers of the proposal of [data] in [namespace] with
+// [set] that were added. Proposals are never accepted.
+func (f *fakeBackend) multisig(set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte) (multisigEntry, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	proposal, ok := f.multisigs[[multisigKeyLen]byte((&MultisigProposal{Set: set, Data: data, Namespace: namespace}).key())]
+	if !ok {
+		return multisigEntry{}, false, errNoSuchMultisig
+	}
+	signers, err := proposal.signers(blockchainID)
+	return multisigEntry{signers: signers}, false, err
+}
+
+func (f *fakeBackend) addSubmission(s SignedSubmission) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.submissions = append(f.submissions, s)
+	return nil
+}
+
+// submitterAccount always returns database.ErrNotFound because submissions
+// are never accepted
+func (*fakeBackend) submitterAccount(ids.ShortID) (submitterAccount, error) {
+	return submitterAccount{}, database.ErrNotFound
+}
+
+func (*fakeBackend) accountHistory(context.Context, ids.ShortID, uint64, int) ([]submissionEntry, error) {
+	return nil, nil
+}
+
+// governance returns the genesis parameters because votes are never
+// accepted
+func (f *fakeBackend) governance() (*ChainParams, []ParamChange, error) {
+	return &f.params, nil, nil
+}
+
+// proposalVotes returns the voters of the votes for [c] that were added.
+// Votes are never counted, so no change passes.
+func (f *fakeBackend) proposalVotes(c ParamChange) ([]ids.ShortID, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var voters []ids.ShortID
+	for i := range f.votes {
+		if v := &f.votes[i]; v.change() == c {
+			voter, err := v.voter(blockchainID)
+			if err != nil {
+				return nil, false, err
+			}
+			voters = append(voters, voter)
+		}
+	}
+	return voters, false, nil
+}
@@ -0,0 +1,156 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	// maxBatchCalls is the max number of calls in a JSON-RPC batch request
+	maxBatchCalls = 128
+
+	// JSON-RPC 2.0 error codes
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+)
+
+// batchHandler serves JSON-RPC 2.0 batch requests, which are arrays of calls,
+// by passing each call to [next] as its own request. Other requests are
+// passed to [next] unchanged. Request bodies larger than [maxBytes] are
+// refused.
+type batchHandler struct {
+	next     http.Handler
+	maxBytes int64
+}
+
+// jsonRPCError is the response to a call that [next] couldn't respond to
+type jsonRPCError struct {
+	Version string          `json:"jsonrpc"`
+	Error   jsonRPCErrorObj `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCErrorObj struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newJSONRPCError(code int, msg string, id json.RawMessage) []byte {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	resp, _ := json.Marshal(jsonRPCError{
+		Version: "2.0",
+		Error:   jsonRPCErrorObj{Code: code, Message: msg},
+		ID:      id,
+	})
+	return resp
+}
+
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBytes))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	var calls []json.RawMessage
+	switch err := json.Unmarshal(trimmed, &calls); {
+	case err != nil:
+		writeJSON(w, newJSONRPCError(jsonRPCParseError, "couldn't parse the batch", nil))
+		return
+	case len(calls) == 0:
+		writeJSON(w, newJSONRPCError(jsonRPCInvalidRequest, "batch is empty", nil))
+		return
+	case len(calls) > maxBatchCalls:
+		writeJSON(w, newJSONRPCError(jsonRPCInvalidRequest, fmt.Sprintf("batch has more than %d calls", maxBatchCalls), nil))
+		return
+	}
+
+	responses := make([][]byte, 0, len(calls))
+	for _, call := range calls {
+		if resp := h.serveCall(r, call); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	// Notifications aren't responded to, so a batch of only notifications
+	// has an empty response
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, append(append([]byte{'['}, bytes.Join(responses, []byte{','})...), ']'))
+}
+
+// serveCall returns the response to [call], one of the calls in the batch
+// request [r], or nil if [call] is a notification
+func (h *batchHandler) serveCall(r *http.Request, call json.RawMessage) []byte {
+	var envelope struct {
+		ID *json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(call, &envelope); err != nil {
+		return newJSONRPCError(jsonRPCInvalidRequest, "call must be an object", nil)
+	}
+
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(call))
+	req.ContentLength = int64(len(call))
+	resp := &bufferedResponse{header: make(http.Header)}
+	h.next.ServeHTTP(resp, req)
+
+	if envelope.ID == nil {
+		return nil
+	}
+	body := bytes.TrimSpace(resp.body.Bytes())
+	if !json.Valid(body) {
+		// [next] responded with a plain-text HTTP error
+		return newJSONRPCError(jsonRPCInvalidRequest, string(body), *envelope.ID)
+	}
+	return body
+}
+
+func writeJSON(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(body)
+}
+
+// bufferedResponse holds the response to one call until it's inspected
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
@@ -0,0 +1,97 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/consensus/snowman"
+	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
+	"github.com/ava-labs/avalanchego/utils/wrappers"
+)
+
+var _ block.BatchedChainVM = &VM{}
+
+// GetAncestors returns the bytes of the block [blkID] followed by its
+// ancestors, newest first, so that a peer can fetch many blocks in one round
+// trip while bootstrapping.
+// At most [maxBlocksNum] blocks are returned, and the blocks, each with the
+// length prefix it's sent with, hold at most [maxBlocksSize] bytes. The
+// config's ancestors limits lower these further. The block [blkID] is
+// returned even if it's over the byte limit, so that the peer makes
+// progress. No more blocks are fetched once [maxBlocksRetrievalTime] has
+// passed.
+// If [blkID] isn't known, no blocks are returned so the peer asks another
+// node.
+func (vm *VM) GetAncestors(
+	_ context.Context,
+	blkID ids.ID,
+	maxBlocksNum int,
+	maxBlocksSize int,
+	maxBlocksRetrievalTime time.Duration,
+) ([][]byte, error) {
+	if limit := vm.config.Load().MaxAncestorsBlocks; limit > 0 {
+		maxBlocksNum = min(maxBlocksNum, limit)
+	}
+	if limit := vm.config.Load().MaxAncestorsBytes; limit > 0 {
+		maxBlocksSize = min(maxBlocksSize, limit)
+	}
+	if maxBlocksNum <= 0 {
+		return nil, nil
+	}
+
+	// Only the headers of the blocks are decoded
+	start := time.Now()
+	header, blockBytes, err := vm.getHeader(blkID)
+	if err == database.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ancestors := make([][]byte, 1, maxBlocksNum)
+	ancestors[0] = blockBytes
+	size := len(blockBytes) + wrappers.IntLen
+	for len(ancestors) < maxBlocksNum && header.Height > 0 && time.Since(start) < maxBlocksRetrievalTime {
+		parentID := header.ParentID
+		header, blockBytes, err = vm.getHeader(parentID)
+		if err == database.ErrNotFound {
+			// Blocks before a checkpoint are never fetched
+			break
+		}
+		if err != nil {
+			vm.ctx.Log.Error("couldn't get ancestor",
+				zap.Stringer("blkID", parentID),
+				zap.Error(err),
+			)
+			break
+		}
+		newSize := size + len(blockBytes) + wrappers.IntLen
+		if newSize > maxBlocksSize {
+			break
+		}
+		ancestors = append(ancestors, blockBytes)
+		size = newSize
+	}
+	return ancestors, nil
+}
+
+// BatchedParseBlock parses each of [blks]
+func (vm *VM) BatchedParseBlock(ctx context.Context, blks [][]byte) ([]snowman.Block, error) {
+	parsed := make([]snowman.Block, len(blks))
+	for i, blkBytes := range blks {
+		blk, err := vm.ParseBlock(ctx, blkBytes)
+		if err != nil {
+			return nil, err
+		}
+		parsed[i] = blk
+	}
+	return parsed, nil
+}
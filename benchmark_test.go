@@ -0,0 +1,184 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+)
+
+// benchmarkBatchSizes are the numbers of pieces of data per block that the
+// benchmarks are run with
+var benchmarkBatchSizes = []int{1, 16, maxBatchSize}
+
+// newBenchmarkVM returns a vm whose proposals are built into blocks
+// immediately. Allocations are reported.
+func newBenchmarkVM(b *testing.B) *VM {
+	b.ReportAllocs()
+	return newTestVMWithGenesis(b, &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}, []byte(`{"buildBatchWindow": "0s", "mempoolSize": 100000}`))
+}
+
+// benchmarkData returns [n] distinct pieces of data, starting at [start]
+func benchmarkData(start, n int) [][dataLen]byte {
+	data := make([][dataLen]byte, n)
+	for i := range data {
+		binary.BigEndian.PutUint64(data[i][:], uint64(start+i))
+	}
+	return data
+}
+
+// acceptBenchmarkChain accepts [length] blocks of [batchSize] pieces of data
+// on top of the last accepted block and returns their IDs
+func acceptBenchmarkChain(b *testing.B, vm *VM, length, batchSize int) []ids.ID {
+	blkIDs := make([]ids.ID, length)
+	for i := range blkIDs {
+		parent, err := vm.getBlock(vm.preferred)
+		if err != nil {
+			b.Fatal(err)
+		}
+		blk, err := vm.NewBlock(parent.ID(), parent.Height()+1, benchmarkData(i*batchSize, batchSize), time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		vm.preferred = blk.ID()
+		blkIDs[i] = blk.ID()
+	}
+	return blkIDs
+}
+
+func BenchmarkBuildBlock(b *testing.B) {
+	for _, batchSize := range benchmarkBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			vm := newBenchmarkVM(b)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for _, d := range benchmarkData(i*batchSize, batchSize) {
+					if err := vm.proposeBlock(d); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+
+				if _, err := vm.BuildBlock(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseBlock(b *testing.B) {
+	for _, batchSize := range benchmarkBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			vm := newBenchmarkVM(b)
+			blk, err := vm.NewBlock(vm.preferred, 1, benchmarkData(0, batchSize), time.Now())
+			if err != nil {
+				b.Fatal(err)
+			}
+			blockBytes := blk.Bytes()
+			b.SetBytes(int64(len(blockBytes)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := vm.ParseBlock(context.Background(), blockBytes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	for _, batchSize := range benchmarkBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			vm := newBenchmarkVM(b)
+			blk, err := vm.NewBlock(vm.preferred, 1, benchmarkData(0, batchSize), time.Now())
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := blk.Verify(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAccept(b *testing.B) {
+	for _, batchSize := range benchmarkBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			vm := newBenchmarkVM(b)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				parent, err := vm.getBlock(vm.preferred)
+				if err != nil {
+					b.Fatal(err)
+				}
+				blk, err := vm.NewBlock(parent.ID(), parent.Height()+1, benchmarkData(i*batchSize, batchSize), time.Now())
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := blk.Verify(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				if err := blk.Accept(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				vm.preferred = blk.ID()
+			}
+		})
+	}
+}
+
+func BenchmarkGetBlock(b *testing.B) {
+	for _, length := range []int{10, 1000} {
+		for _, batchSize := range []int{1, maxBatchSize} {
+			b.Run(fmt.Sprintf("length=%d/batch=%d", length, batchSize), func(b *testing.B) {
+				vm := newBenchmarkVM(b)
+				blkIDs := acceptBenchmarkChain(b, vm, length, batchSize)
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := vm.GetBlock(context.Background(), blkIDs[i%length]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkServiceGetBlock(b *testing.B) {
+	for _, batchSize := range []int{1, maxBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			vm := newBenchmarkVM(b)
+			blkIDs := acceptBenchmarkChain(b, vm, 10, batchSize)
+			service := &Service{vm}
+			args := &GetBlockArgs{ID: blkIDs[len(blkIDs)-1].String()}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := service.GetBlock(nil, args, &GetBlockReply{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
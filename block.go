@@ -4,54 +4,664 @@
 package timestampvm
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"slices"
 	"time"
 
-	"github.com/ava-labs/avalanchego/vms/components/core"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/snow/consensus/snowman"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/set"
 )
 
 var (
-	errTimestampTooEarly = errors.New("block's timestamp is earlier than its parent's timestamp")
+	// ErrInvalidTimestamp is wrapped by the errors of blocks whose timestamp
+	// breaks the chain's timestamp rules
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+
+	errTimestampTooEarly = fmt.Errorf("%w: block's timestamp is earlier than its parent's timestamp", ErrInvalidTimestamp)
+	errTimestampNotAfter = fmt.Errorf("%w: block's timestamp isn't after its parent's timestamp", ErrInvalidTimestamp)
+	errBlockTooSoon      = fmt.Errorf("%w: block's timestamp is less than the min block interval after its parent's timestamp", ErrInvalidTimestamp)
 	errDatabaseGet       = errors.New("error while retrieving data from database")
-	errDatabaseSave      = errors.New("error while saving block to the database")
-	errTimestampTooLate  = errors.New("block's timestamp is more than 1 hour ahead of local time")
+	errTimestampTooLate  = fmt.Errorf("%w: block's timestamp is further ahead of local time than the max clock skew", ErrInvalidTimestamp)
+	errDuplicateData     = errors.New("block's data is already in an ancestor block")
+	errNoData            = errors.New("block has no data")
+	errWrongHeight       = errors.New("block's height isn't one more than its parent's height")
+	errTooMuchData       = fmt.Errorf("block has more than %d pieces of data", maxBatchSize)
+
+	_ snowman.Block = &Block{}
 )
 
 // Block is a block on the chain.
 // Each block contains:
-// 1) A piece of data (a string)
+// 1) A batch of pieces of data (each a 32 byte array)
 // 2) A timestamp
 type Block struct {
-	*core.Block `serialize:"true"`
-	Data        [dataLen]byte `serialize:"true"`
-	Timestamp   int64         `serialize:"true"`
+	PrntID ids.ID          `serialize:"true"` // This block's parent's ID
+	Hght   uint64          `serialize:"true"` // This block's height. The genesis block is at height 0.
+	Tmstmp int64           `serialize:"true"` // Time this block was proposed at
+	Dt     [][dataLen]byte `serialize:"true"` // Data proposed in this block
+
+	// Only serialized in blocks of chains with namespaces or namespace ACLs.
+	// The namespace of each piece of [Dt], in the same order.
+	Ns [][NamespaceLen]byte `namespace:"true"`
+
+	// Only serialized in signed blocks, which are used by chains with an
+	// allowed signer set or fees
+	Ops []SignerOp `signed:"true"` // Changes to the allowed signers
+	// Only serialized in blocks of chains with transfers, claims, namespace
+	// ACLs, reveals, encrypted payloads, oracle feeds, Warp messages,
+	// governance, multisig sets or accounts
+	Transfers      []Transfer                   `transfer:"true"`
+	ClaimTransfers []ClaimTransfer              `transfer:"true"`
+	ACLOps         []ACLOp                      `transfer:"true"`
+	Reveals        []Reveal                     `transfer:"true"`
+	KeyRegs        []KeyRegistration            `transfer:"true"`
+	Encrypted      []EncryptedPayload           `transfer:"true"`
+	FeedUpdates    []FeedUpdate                 `transfer:"true"`
+	WarpMessages   [][]byte                     `transfer:"true"`
+	Votes          []GovernanceVote             `transfer:"true"`
+	Multisigs      []MultisigProposal           `transfer:"true"`
+	Submissions    []SignedSubmission           `transfer:"true"`
+	Sig            [secp256k1.SignatureLen]byte `signed:"true"` // Signature of the block's signer
+
+	version uint16 // codec version of this block's bytes
+	// Parameters that apply to this block, if computed
+	params *ChainParams
+	// P-Chain height this block was verified at, if [hasPChainHeight]
+	pChainHeight    uint64
+	hasPChainHeight bool
+	dataFee         uint64 // fee for each piece of data in this block, if [baseFeeKnown]
+	baseFeeKnown    bool
+	signerAddr      ids.ShortID // address of this block's signer, if [signerKnown]
+	signerKnown     bool
+	payerCounts     map[ids.ShortID]int // number of items each address pays the fee for, if computed
+	id              ids.ID              // hold this block's ID
+	bytes           []byte              // this block's encoded bytes
+	status          choices.Status      // block's status
+	vm              *VM                 // the underlying VM reference, mostly used for state
+}
+
+// Initialize sets [b.bytes] to [bytes], [b.id] to hash([b.bytes]),
+// [b.status] to [status] and [b.vm] to [vm]
+func (b *Block) Initialize(bytes []byte, status choices.Status, vm *VM) {
+	b.bytes = bytes
+	b.id = hashing.ComputeHash256Array(b.bytes)
+	b.status = status
+	b.vm = vm
 }
 
 // Verify returns nil iff this block is valid.
 // To be valid, it must be that:
-// b.parent.Timestamp < b.Timestamp <= [local time] + 1 hour
-func (b *Block) Verify() error {
-	if accepted, err := b.Block.Verify(); err != nil || accepted {
+// b.parent.Timestamp <= b.Timestamp <= [local time] + [max clock skew]
+// where the first comparison is strict if the chain requires strictly
+// increasing timestamps, and [b] is at least the chain's min block interval
+// after its parent. On chains with a median time past window, [b] must
+// also be after the median time past of its parent,
+// and [b] holds between 1 and [maxBatchSize] pieces of data, none of which
+// is larger than the chain's max payload size, breaks an active payload
+// rule or is refused by a payload validator or an fx that implements
+// PayloadVerifier. On chains with namespaces, each piece of data must have a
+// namespace and no namespace may have more data than its quota.
+// Once duplicate rejection is active, [b]'s data must also not be repeated
+// within [b] or be in any of its ancestors.
+// On chains with an allowed signer set, [b] must be signed by an allowed
+// signer and its signer operations must be valid; a block may then hold
+// signer operations instead of data.
+// On chains with fees, [b] must be signed and its signer must be able to pay
+// the fee for each piece of data in [b].
+// On chains with transfers, each of [b]'s transfers must be its sender's
+// next transfer and be covered by the sender's balance, and on chains with
+// claims, each of [b]'s claim transfers must be the claim's next transfer
+// and be signed by its owner; a block may then hold transfers or claim
+// transfers instead of data.
+// On chains with namespace ACLs, [b]'s signer must be allowed to write to
+// the namespace of each piece of [b]'s data and [b]'s ACL operations must be
+// valid; a block may then hold ACL operations instead of data.
+// On chains that accept Warp messages, each of [b]'s Warp messages must be
+// signed by the quorum of its source chain's validators at the P-Chain
+// height [b] is verified at with VerifyWithContext.
+// On chains with governance, each of [b]'s votes must be by an allowed
+// signer for a valid parameter change that activates after [b], and the
+// parameters that apply to [b] include the changes that activated by its
+// height.
+// On chains with multisig sets, each of [b]'s multisig proposals must have
+// the signatures of at least its set's threshold of distinct signers of the
+// set, and must not be accepted with that set already.
+// On chains with accounts, each of [b]'s signed submissions must have its
+// submitter's next nonce.
+// Finally, every fx that implements BlockVerifier must accept [b].
+func (b *Block) Verify(ctx context.Context) error {
+	if b.Status() == choices.Accepted {
+		return nil
+	}
+	defer observeSince(b.vm.metrics.verifyDuration, time.Now())
+	ctx, span := b.vm.startBlockSpan(ctx, "timestampvm.Verify", b)
+	err := b.verify(ctx)
+	endSpan(span, err)
+	if err != nil {
+		b.vm.logBlock("block failed verification", b, zap.Error(err))
+	} else {
+		b.vm.logBlock("verified block", b)
+	}
+	return err
+}
+
+func (b *Block) verify(ctx context.Context) error {
+	switch {
+	case b.empty():
+		return errNoData
+	case len(b.Dt) > maxBatchSize:
+		return errTooMuchData
+	}
+	if err := b.verifyNamespaces(); err != nil {
 		return err
 	}
+	data := b.data()
+	rules := b.vm.payloadRules(b.Height(), b.Timestamp())
+	validators := b.vm.payloadValidators(b.Height(), b.Timestamp())
+	for _, d := range data {
+		if err := b.vm.verifyData(rules, validators, d); err != nil {
+			return err
+		}
+	}
 
 	// Get [b]'s parent
-	parent, ok := b.Parent().(*Block)
-	if !ok {
+	parent, err := b.vm.getBlock(b.Parent())
+	if err != nil {
 		return errDatabaseGet
 	}
+	if b.Hght != parent.Height()+1 {
+		return errWrongHeight
+	}
 
-	if b.Timestamp < time.Unix(parent.Timestamp, 0).Unix() {
-		return errTimestampTooEarly
+	params, err := b.activeParams()
+	if err != nil {
+		return err
+	}
+	for _, d := range data {
+		if err := params.verifyPayloadSize(d); err != nil {
+			return err
+		}
 	}
 
-	if b.Timestamp >= time.Now().Add(time.Hour).Unix() {
-		return errTimestampTooLate
+	if err := b.vm.verifyBlockTimestamp(parent, params, b.Tmstmp); err != nil {
+		return err
 	}
 
-	// Persist the block
-	if err := b.VM.SaveBlock(b.VM.DB, b); err != nil {
-		return errDatabaseSave
+	if b.vm.upgrades.IsActive(DuplicateRejectionFeature, b.Height(), b.Timestamp()) {
+		if err := b.verifyUniqueData(parent); err != nil {
+			return err
+		}
+	}
+
+	if err := b.verifySignature(parent); err != nil {
+		return err
 	}
-	return b.VM.DB.Commit()
+	if err := b.verifyFee(parent); err != nil {
+		return err
+	}
+	if err := b.verifyTransfers(parent); err != nil {
+		return err
+	}
+	if err := b.verifyClaims(parent); err != nil {
+		return err
+	}
+	if err := b.verifyACL(parent); err != nil {
+		return err
+	}
+	if err := b.verifyReveals(parent); err != nil {
+		return err
+	}
+	if err := b.verifyKeyRegs(parent); err != nil {
+		return err
+	}
+	if err := b.verifyEncrypted(parent); err != nil {
+		return err
+	}
+	if err := b.verifyFeedUpdates(parent); err != nil {
+		return err
+	}
+	if err := b.verifyWarpMessages(ctx, parent); err != nil {
+		return err
+	}
+	if err := b.verifyVotes(parent); err != nil {
+		return err
+	}
+	if err := b.verifyMultisigs(parent); err != nil {
+		return err
+	}
+	if err := b.verifySubmissions(parent); err != nil {
+		return err
+	}
+
+	if err := b.vm.verifyFxs(b); err != nil {
+		return err
+	}
+
+	// Keep the block in memory until it's decided
+	b.vm.processing.add(b)
+	return nil
+}
+
+// empty returns true iff [b] holds no data and no signed operations
+func (b *Block) empty() bool {
+	return len(b.Dt) == 0 &&
+		len(b.Ops) == 0 &&
+		len(b.Transfers) == 0 &&
+		len(b.ClaimTransfers) == 0 &&
+		len(b.ACLOps) == 0 &&
+		len(b.Reveals) == 0 &&
+		len(b.KeyRegs) == 0 &&
+		len(b.Encrypted) == 0 &&
+		len(b.FeedUpdates) == 0 &&
+		len(b.WarpMessages) == 0 &&
+		len(b.Votes) == 0 &&
+		len(b.Multisigs) == 0 &&
+		len(b.Submissions) == 0
+}
+
+// data returns all of [b]'s data: the data it holds directly, then the data
+// of its signed submissions and of its multisig proposals
+func (b *Block) data() [][dataLen]byte {
+	if len(b.Submissions) == 0 && len(b.Multisigs) == 0 {
+		return b.Dt
+	}
+	data := make([][dataLen]byte, 0, len(b.Dt)+len(b.Submissions)+len(b.Multisigs))
+	data = append(data, b.Dt...)
+	for i := range b.Submissions {
+		data = append(data, b.Submissions[i].Data)
+	}
+	for i := range b.Multisigs {
+		data = append(data, b.Multisigs[i].Data)
+	}
+	return data
+}
+
+// verifyUniqueData returns errDuplicateData if a piece of [b]'s data is
+// repeated within [b] or is in [parent] or any of its ancestors
+func (b *Block) verifyUniqueData(parent *Block) error {
+	all := b.data()
+	data := set.NewSet[[dataLen]byte](len(all))
+	for _, d := range all {
+		if data.Contains(d) {
+			return errDuplicateData
+		}
+		data.Add(d)
+	}
+
+	// Processing ancestors aren't indexed yet
+	processing, err := b.vm.processingAncestors(parent)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range processing {
+		for _, d := range ancestor.data() {
+			if data.Contains(d) {
+				return errDuplicateData
+			}
+		}
+	}
+
+	for d := range data {
+		duplicate, err := b.vm.state.hasAnyData(d)
+		if err != nil {
+			return errDatabaseGet
+		}
+		if duplicate {
+			return errDuplicateData
+		}
+	}
+	return nil
 }
+
+// hasDataAfter returns true iff [d] is in [blk] or any of its ancestors
+func (vm *VM) hasDataAfter(blk *Block, d [dataLen]byte) (bool, error) {
+	// Processing ancestors aren't indexed yet
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return false, err
+	}
+	for _, ancestor := range processing {
+		if slices.Contains(ancestor.data(), d) {
+			return true, nil
+		}
+	}
+	has, err := vm.state.hasAnyData(d)
+	if err != nil {
+		return false, errDatabaseGet
+	}
+	return has, nil
+}
+
+// processingAncestors returns [blk] and its ancestors that aren't accepted,
+// newest first
+func (vm *VM) processingAncestors(blk *Block) ([]*Block, error) {
+	var processing []*Block
+	for blk.Status() != choices.Accepted {
+		processing = append(processing, blk)
+		var err error
+		blk, err = vm.getBlock(blk.Parent())
+		if err != nil {
+			return nil, errDatabaseGet
+		}
+	}
+	return processing, nil
+}
+
+// Accept sets this block's status to Accepted and sets lastAccepted to this
+// block's ID. The block, its indexes and the last accepted pointer are
+// committed in one batch, so a crash can't leave the last accepted block
+// without its indexes.
+// Processing blocks that conflict with [b] are dropped from memory; the
+// engine rejects them later.
+func (b *Block) Accept(ctx context.Context) error {
+	_, span := b.vm.startBlockSpan(ctx, "timestampvm.Accept", b)
+	err := b.accept()
+	endSpan(span, err)
+	if err == nil {
+		b.vm.logBlock("accepted block", b)
+	}
+	return err
+}
+
+func (b *Block) accept() error {
+	b.SetStatus(choices.Accepted)
+	if err := b.writeAccepted(); err != nil {
+		// Drop the partial writes so that a later commit doesn't flush them
+		b.vm.abort()
+		b.SetStatus(choices.Processing)
+		return err
+	}
+	abandoned := b.vm.processing.accept(b)
+	if len(abandoned) > 0 {
+		b.vm.ctx.Log.Debug("dropping blocks that conflict with accepted block",
+			zap.Stringer("blkID", b.ID()),
+			zap.Int("numAbandoned", len(abandoned)),
+		)
+		for _, blkID := range abandoned {
+			if blkID == b.vm.preferred {
+				b.vm.preferred = b.ID()
+			}
+		}
+	}
+	delete(b.vm.inFlight, b.ID())
+	b.vm.metrics.blocksAccepted.Inc()
+	if b.vm.bootstrapped {
+		b.vm.emitAccepted(b)
+		if b.vm.attestor != nil {
+			b.vm.attestor.attest(context.TODO(), b.ID())
+		}
+	}
+	if b.vm.hooks != nil {
+		b.vm.hooks.notify()
+	}
+	// Accepted operations, and those they conflict with, are dropped from
+	// their pools and the journal
+	if len(b.Ops) > 0 {
+		if err := b.vm.pendingOps.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.Transfers) > 0 {
+		if err := b.vm.pendingTransfers.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.ClaimTransfers) > 0 {
+		if err := b.vm.pendingClaims.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.ACLOps) > 0 {
+		if err := b.vm.pendingACLOps.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.Reveals) > 0 {
+		if err := b.vm.pendingReveals.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.KeyRegs) > 0 || len(b.Encrypted) > 0 {
+		if err := b.vm.pendingEncryption.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.FeedUpdates) > 0 {
+		if err := b.vm.pendingFeeds.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.WarpMessages) > 0 {
+		if err := b.vm.pendingWarp.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.Votes) > 0 || b.vm.pendingVotes.len() > 0 {
+		// Votes can also expire when their activation height is reached
+		if err := b.vm.pendingVotes.prune(b.vm, b); err != nil {
+			return err
+		}
+	}
+	if len(b.Multisigs) > 0 {
+		if err := b.vm.pendingMultisigs.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	if len(b.Submissions) > 0 {
+		if err := b.vm.pendingSubmissions.prune(b.vm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAccepted writes [b], the indexes of its data and height, its light
+// header, its governance votes, signer and ACL operations, fee, transfers,
+// claims, reveals, keys, encrypted payloads, feed updates, Warp
+// attestations, multisig proposals, signed submissions, submitter stats, key-value operations, document and
+// namespace indexes, the removal of its data from the journal and the new
+// last accepted block to b.vm.db and commits them. b.vm.db flushes
+// everything it buffered in a single batch. While bootstrapping, the writes
+// of many blocks are committed together.
+func (b *Block) writeAccepted() error {
+	if err := b.vm.state.putBlock(b); err != nil {
+		return err
+	}
+	for _, d := range b.Dt {
+		if err := b.vm.state.putData(d, b.ID()); err != nil {
+			return err
+		}
+	}
+	for i := range b.Submissions {
+		if err := b.vm.state.putSignedData(b.Submissions[i].Data, b.ID()); err != nil {
+			return err
+		}
+	}
+	for i := range b.Multisigs {
+		if err := b.vm.state.putSignedData(b.Multisigs[i].Data, b.ID()); err != nil {
+			return err
+		}
+	}
+	if err := b.vm.state.putBlockIDAtHeight(b.Height(), b.ID()); err != nil {
+		return err
+	}
+	if err := b.putLightHeader(); err != nil {
+		return err
+	}
+	if err := b.applyVotes(); err != nil {
+		return err
+	}
+	for _, op := range b.Ops {
+		if err := b.vm.state.applySignerOp(op); err != nil {
+			return err
+		}
+	}
+	for _, op := range b.ACLOps {
+		if err := b.vm.state.applyACLOp(op); err != nil {
+			return err
+		}
+	}
+	if err := b.chargeFee(); err != nil {
+		return err
+	}
+	if err := b.applyTransfers(); err != nil {
+		return err
+	}
+	if err := b.applyClaims(); err != nil {
+		return err
+	}
+	if err := b.applyReveals(); err != nil {
+		return err
+	}
+	if err := b.applyEncryption(); err != nil {
+		return err
+	}
+	if err := b.applyFeedUpdates(); err != nil {
+		return err
+	}
+	if err := b.applyWarpMessages(); err != nil {
+		return err
+	}
+	if err := b.applyMultisigs(); err != nil {
+		return err
+	}
+	if err := b.applySubmissions(); err != nil {
+		return err
+	}
+	if err := b.recordSubmitter(); err != nil {
+		return err
+	}
+	if err := b.applyKVOps(); err != nil {
+		return err
+	}
+	if err := b.indexDocuments(); err != nil {
+		return err
+	}
+	if err := b.indexNamespaces(); err != nil {
+		return err
+	}
+	if err := b.removeFromJournal(); err != nil {
+		return err
+	}
+	if err := b.vm.state.appendIndexerEvent(indexerEvent{height: b.Height()}); err != nil {
+		return err
+	}
+	if err := b.vm.state.setLastAccepted(b.ID()); err != nil {
+		return err
+	}
+	return b.vm.commitAccepted()
+}
+
+// Reject sets this block's status to Rejected and saves the status in state.
+// If the VM prunes rejected blocks, the block is discarded instead.
+// If this node built [b], the data in [b] that hasn't been accepted in
+// another block is put back into the mempool.
+func (b *Block) Reject(ctx context.Context) error {
+	_, span := b.vm.startBlockSpan(ctx, "timestampvm.Reject", b)
+	err := b.reject()
+	endSpan(span, err)
+	if err == nil {
+		b.vm.logBlock("rejected block", b)
+	}
+	return err
+}
+
+func (b *Block) reject() error {
+	b.SetStatus(choices.Rejected)
+	requeue, err := b.writeRejected()
+	if err != nil {
+		// Drop the partial writes so that a later commit doesn't flush them
+		b.vm.abort()
+		b.SetStatus(choices.Processing)
+		return err
+	}
+	b.vm.processing.remove(b.ID())
+	delete(b.vm.inFlight, b.ID())
+	b.vm.metrics.blocksRejected.Inc()
+	if len(requeue) > 0 {
+		b.vm.logs.mempool.Debug("re-queueing data of rejected block",
+			zap.Stringer("blkID", b.ID()),
+			zap.Int("numData", len(requeue)),
+		)
+		b.vm.builder.requeue(requeue)
+	}
+	if b.vm.hasPendingOps() {
+		// The signed operations in [b] are still pending
+		b.vm.builder.markReady()
+	}
+	return nil
+}
+
+// writeRejected writes [b]'s rejection to b.vm.db and commits it.
+// Returns the journal entries of [b]'s data that should be put back into the
+// mempool. They stay in the journal; the journal entries of data that was
+// accepted in another block are deleted.
+func (b *Block) writeRejected() ([]MempoolEntry, error) {
+	var requeue, accepted []MempoolEntry
+	for _, entry := range b.vm.inFlight[b.ID()] {
+		has, err := b.vm.state.hasData(entry.data)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			accepted = append(accepted, entry)
+		} else {
+			requeue = append(requeue, entry)
+		}
+	}
+	if err := deleteJournalEntries(b.vm.state.journalDB, accepted); err != nil {
+		return nil, err
+	}
+
+	if b.vm.config.Load().PruningMode == RejectedPruningMode {
+		// Older versions persisted blocks when they were verified
+		if err := b.vm.state.deleteBlock(b.ID()); err != nil {
+			return nil, err
+		}
+	} else if err := b.vm.state.putBlock(b); err != nil {
+		return nil, err
+	}
+	return requeue, b.vm.commit()
+}
+
+// removeFromJournal deletes the journal entries of [b]'s data if [b] was
+// built by this node. The deletion is committed along with [b]'s acceptance.
+func (b *Block) removeFromJournal() error {
+	entries, ok := b.vm.inFlight[b.ID()]
+	if !ok {
+		return nil
+	}
+	return deleteJournalEntries(b.vm.state.journalDB, entries)
+}
+
+// ID returns the ID of this block
+func (b *Block) ID() ids.ID { return b.id }
+
+// Parent returns [b]'s parent's ID
+func (b *Block) Parent() ids.ID { return b.PrntID }
+
+// Height returns this block's height. The genesis block has height 0.
+func (b *Block) Height() uint64 { return b.Hght }
+
+// Timestamp returns this block's time. The genesis block has time 0.
+func (b *Block) Timestamp() time.Time { return time.Unix(b.Tmstmp, 0) }
+
+// Bytes returns the byte repr. of this block
+func (b *Block) Bytes() []byte { return b.bytes }
+
+// Data returns the data of this block
+func (b *Block) Data() [][dataLen]byte { return b.Dt }
+
+// Status returns the status of this block
+func (b *Block) Status() choices.Status { return b.status }
+
+// SetStatus sets the status of this block
+func (b *Block) SetStatus(status choices.Status) { b.status = status }
@@ -0,0 +1,59 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"crypto/sha256"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+// logBlock logs the lifecycle event [msg] of [b], along with [fields], at the
+// configured block log level
+func (vm *VM) logBlock(msg string, b *Block, fields ...zap.Field) {
+	level := vm.config.Load().BlockLogLevel
+	if level >= logging.Off || !vm.ctx.Log.Enabled(level) {
+		return
+	}
+	fields = append(fields,
+		zap.Stringer("blkID", b.ID()),
+		zap.Stringer("parentID", b.Parent()),
+		zap.Uint64("height", b.Height()),
+		zap.Int64("timestamp", b.Tmstmp),
+		zap.Int("numData", len(b.Dt)),
+		zap.Stringer("payloadHash", payloadHash(b.Dt)),
+	)
+	logFunc(vm.ctx.Log, level)(msg, fields...)
+}
+
+// payloadHash returns the hash of [data] concatenated, which identifies a
+// block's data in logs without printing all of it
+func payloadHash(data [][dataLen]byte) ids.ID {
+	hasher := sha256.New()
+	for _, d := range data {
+		_, _ = hasher.Write(d[:])
+	}
+	return ids.ID(hasher.Sum(nil))
+}
+
+// logFunc returns the function that logs to [log] at [level]
+func logFunc(log logging.Logger, level logging.Level) logging.Func {
+	switch {
+	case level <= logging.Verbo:
+		return log.Verbo
+	case level <= logging.Debug:
+		return log.Debug
+	case level <= logging.Trace:
+		return log.Trace
+	case level <= logging.Info:
+		return log.Info
+	case level <= logging.Warn:
+		return log.Warn
+	default:
+		return log.Error
+	}
+}
@@ -0,0 +1,91 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+// blockTree is the tree of blocks that passed verification and haven't been
+// decided. These blocks are only persisted once they are decided.
+// The root of the tree is the last accepted block, which isn't in the tree.
+type blockTree struct {
+	// Block ID --> Block
+	blocks map[ids.ID]*Block
+	// Block ID --> IDs of the processing children of that block
+	children map[ids.ID]set.Set[ids.ID]
+}
+
+func newBlockTree() *blockTree {
+	return &blockTree{
+		blocks:   make(map[ids.ID]*Block),
+		children: make(map[ids.ID]set.Set[ids.ID]),
+	}
+}
+
+// get returns the processing block with ID [blkID]
+func (t *blockTree) get(blkID ids.ID) (*Block, bool) {
+	blk, ok := t.blocks[blkID]
+	return blk, ok
+}
+
+// add adds [blk] to the tree as a child of its parent
+func (t *blockTree) add(blk *Block) {
+	blkID := blk.ID()
+	t.blocks[blkID] = blk
+	children, ok := t.children[blk.Parent()]
+	if !ok {
+		children = set.Set[ids.ID]{}
+		t.children[blk.Parent()] = children
+	}
+	children.Add(blkID)
+}
+
+// remove removes the block with ID [blkID] from the tree, if it's there.
+// Its children are left in the tree.
+func (t *blockTree) remove(blkID ids.ID) {
+	blk, ok := t.blocks[blkID]
+	if !ok {
+		return
+	}
+	delete(t.blocks, blkID)
+	if children, ok := t.children[blk.Parent()]; ok {
+		children.Remove(blkID)
+		if children.Len() == 0 {
+			delete(t.children, blk.Parent())
+		}
+	}
+}
+
+// accept removes [blk], which must be a child of the root, from the tree and
+// makes it the root. The other children of the root conflict with [blk], so
+// they and their descendants are removed as well, and their IDs are returned.
+func (t *blockTree) accept(blk *Block) []ids.ID {
+	blkID := blk.ID()
+	t.remove(blkID)
+
+	var abandoned []ids.ID
+	for sibling := range t.children[blk.Parent()] {
+		abandoned = t.removeSubtree(sibling, abandoned)
+	}
+	delete(t.children, blk.Parent())
+	return abandoned
+}
+
+// removeSubtree removes the block with ID [blkID] and its descendants from the
+// tree and returns [removed] with their IDs appended
+func (t *blockTree) removeSubtree(blkID ids.ID, removed []ids.ID) []ids.ID {
+	for child := range t.children[blkID] {
+		removed = t.removeSubtree(child, removed)
+	}
+	delete(t.children, blkID)
+	delete(t.blocks, blkID)
+	return append(removed, blkID)
+}
+
+// len returns the number of processing blocks
+func (t *blockTree) len() int {
+	return len(t.blocks)
+}
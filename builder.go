@@ -0,0 +1,449 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ava-labs/avalanchego/snow/engine/common"
+)
+
+var (
+	errShuttingDown    = errors.New("block builder is shutting down")
+	errUnknownProposal = errors.New("no pending proposal has this ID")
+	errBadCancelToken  = errors.New("cancel token doesn't match the proposal's")
+	errNotCancellable  = errors.New("mempool doesn't support cancelling proposals that are due")
+)
+
+// proposal is a piece of data sent to the builder by the API layer.
+// The builder replies on [result] with the proposal's ID once the data is in
+// the mempool, or with the reason it was dropped.
+type proposal struct {
+	data        [dataLen]byte
+	namespace   [NamespaceLen]byte
+	notBefore   int64
+	cancelToken [cancelTokenLen]byte
+	result      chan proposalResult
+}
+
+type proposalResult struct {
+	id  uint64
+	err error
+}
+
+// cancellation is a request to remove the pending proposal [id] from the
+// mempool or the schedule. Unless [admin], it must carry the proposal's
+// [cancelToken]. The builder replies on [result].
+type cancellation struct {
+	id          uint64
+	cancelToken [cancelTokenLen]byte
+	admin       bool
+	result      chan error
+}
+
+// builder owns the mempool of proposed data that hasn't been put into a block.
+// Data with an earliest inclusion time is held in a schedule until then, and
+// only moves to the mempool, where blocks are built from, once it's due.
+// The mempool is only ever accessed by the builder's goroutine; the API layer
+// and the engine interact with it over channels.
+// Every piece of data is written to [journal] before it's acknowledged.
+type builder struct {
+	// The maximum number of pieces of data in [mempool] and [scheduled],
+	// which may be changed from any goroutine
+	mempoolSize atomic.Int64
+	// How long to wait after data arrives at an empty mempool before telling
+	// the engine to build a block, which may be changed from any goroutine
+	batchWindow atomic.Int64
+	journal     *journal
+
+	proposals chan proposal
+	cancels   chan cancellation
+	// Data of rejected blocks built by this node to put back into the mempool
+	requeues chan []MempoolEntry
+	// Times at which the engine should be told to try building a block again
+	retries chan time.Time
+	// Each request receives the next batch of data to put into a block
+	batchRequests chan chan []MempoolEntry
+	// Holds a value iff the engine should build a block
+	ready chan struct{}
+	// Holds a value iff the engine should be told that state sync finished
+	stateSyncDone chan struct{}
+	shutdown      chan struct{}
+	wg            sync.WaitGroup
+
+	// Everything below is owned by the builder's goroutine
+
+	// Proposed pieces of data that are due and haven't been put into a block
+	// and proposed yet
+	mempool Mempool
+	// Length of [mempool], which may be read from any goroutine
+	mempoolLen atomic.Int64
+	// Proposed pieces of data that aren't due yet, soonest first
+	scheduled []MempoolEntry
+	// Length of [scheduled], which may be read from any goroutine
+	numScheduled atomic.Int64
+	// True iff the build batch window of the data in [mempool] has elapsed
+	batchElapsed bool
+}
+
+// newBuilder returns a builder whose mempool is [mempool] and initially holds
+// [pending], the entries of [journal] that weren't decided before the last
+// shutdown. Entries that aren't due yet are scheduled instead.
+func newBuilder(mempoolSize int, batchWindow time.Duration, journal *journal, mempool Mempool, pending []MempoolEntry) *builder {
+	now := time.Now().Unix()
+	var scheduled []MempoolEntry
+	for _, entry := range pending {
+		if entry.notBefore > now {
+			scheduled = append(scheduled, entry)
+		} else {
+			mempool.Push(entry)
+		}
+	}
+	slices.SortStableFunc(scheduled, compareNotBefore)
+	b := &builder{
+		journal:       journal,
+		proposals:     make(chan proposal),
+		cancels:       make(chan cancellation),
+		requeues:      make(chan []MempoolEntry),
+		retries:       make(chan time.Time),
+		batchRequests: make(chan chan []MempoolEntry),
+		ready:         make(chan struct{}, 1),
+		stateSyncDone: make(chan struct{}, 1),
+		shutdown:      make(chan struct{}),
+		mempool:       mempool,
+		scheduled:     scheduled,
+		// Pending data has already waited for its batch window
+		batchElapsed: true,
+	}
+	b.setLimits(mempoolSize, batchWindow)
+	b.mempoolLen.Store(int64(mempool.Len()))
+	b.numScheduled.Store(int64(len(scheduled)))
+	return b
+}
+
+// compareNotBefore orders journal entries by their earliest inclusion time
+func compareNotBefore(a, b MempoolEntry) int {
+	return cmp.Compare(a.notBefore, b.notBefore)
+}
+
+// start runs the builder's goroutine until stop is called
+func (b *builder) start() {
+	b.wg.Add(1)
+	go b.run()
+}
+
+// stop shuts down the builder's goroutine and waits for it to exit.
+// Data still in the mempool remains in the journal.
+func (b *builder) stop() {
+	close(b.shutdown)
+	b.wg.Wait()
+}
+
+func (b *builder) run() {
+	defer b.wg.Done()
+
+	batchTimer := time.NewTimer(0)
+	if !batchTimer.Stop() {
+		<-batchTimer.C
+	}
+	defer batchTimer.Stop()
+
+	retryTimer := time.NewTimer(0)
+	if !retryTimer.Stop() {
+		<-retryTimer.C
+	}
+	defer retryTimer.Stop()
+
+	scheduleTimer := time.NewTimer(0)
+	if !scheduleTimer.Stop() {
+		<-scheduleTimer.C
+	}
+	defer scheduleTimer.Stop()
+	// resetScheduleTimer fires [scheduleTimer] when the soonest scheduled data
+	// is due
+	resetScheduleTimer := func() {
+		if !scheduleTimer.Stop() {
+			select {
+			case <-scheduleTimer.C:
+			default:
+			}
+		}
+		if len(b.scheduled) > 0 {
+			scheduleTimer.Reset(time.Until(time.Unix(b.scheduled[0].notBefore, 0)))
+		}
+	}
+	resetScheduleTimer()
+
+	if b.mempool.Len() > 0 {
+		b.markReady()
+	}
+
+	for {
+		b.mempoolLen.Store(int64(b.mempool.Len()))
+		b.numScheduled.Store(int64(len(b.scheduled)))
+		select {
+		case p := <-b.proposals:
+			if b.mempool.Len()+len(b.scheduled) >= int(b.mempoolSize.Load()) {
+				p.result <- proposalResult{err: ErrMempoolFull}
+				continue
+			}
+			entry, err := b.journal.append(p.data, p.namespace, p.notBefore)
+			if err != nil {
+				p.result <- proposalResult{err: err}
+				continue
+			}
+			entry.cancelToken = p.cancelToken
+			if entry.notBefore > time.Now().Unix() {
+				// Data scheduled for the same time keeps its order
+				i := slices.IndexFunc(b.scheduled, func(e MempoolEntry) bool {
+					return e.notBefore > entry.notBefore
+				})
+				if i == -1 {
+					i = len(b.scheduled)
+				}
+				b.scheduled = slices.Insert(b.scheduled, i, entry)
+				b.numScheduled.Store(int64(len(b.scheduled)))
+				p.result <- proposalResult{id: entry.seq}
+				if i == 0 {
+					resetScheduleTimer()
+				}
+				continue
+			}
+			if b.mempool.Len() == 0 {
+				b.batchElapsed = false
+				batchTimer.Reset(time.Duration(b.batchWindow.Load()))
+			}
+			b.mempool.Push(entry)
+			// Stored before replying so the proposer sees its own proposal
+			b.mempoolLen.Store(int64(b.mempool.Len()))
+			p.result <- proposalResult{id: entry.seq}
+
+			if b.batchElapsed || b.mempool.Len() >= maxBatchSize {
+				b.markReady()
+			}
+		case c := <-b.cancels:
+			c.result <- b.cancel(c)
+			resetScheduleTimer()
+			if b.mempool.Len() == 0 {
+				b.clearReady()
+			}
+		case entries := <-b.requeues:
+			// Re-queued data was proposed before the data in the mempool and
+			// has already waited for its batch window. It was admitted to the
+			// mempool before, so it doesn't count against the mempool size.
+			b.mempool.Requeue(entries)
+			if b.mempool.Len() > 0 {
+				b.markReady()
+			}
+		case retryTime := <-b.retries:
+			if !retryTimer.Stop() {
+				select {
+				case <-retryTimer.C:
+				default:
+				}
+			}
+			retryTimer.Reset(time.Until(retryTime))
+		case <-retryTimer.C:
+			if b.batchElapsed && b.mempool.Len() > 0 {
+				b.markReady()
+			}
+		case <-scheduleTimer.C:
+			now := time.Now().Unix()
+			i := 0
+			for i < len(b.scheduled) && b.scheduled[i].notBefore <= now {
+				i++
+			}
+			// Due data has waited long enough, so it doesn't wait for a batch
+			// window
+			for _, entry := range b.scheduled[:i] {
+				b.mempool.Push(entry)
+			}
+			b.scheduled = slices.Delete(b.scheduled, 0, i)
+			resetScheduleTimer()
+			if i > 0 {
+				b.markReady()
+			}
+		case <-batchTimer.C:
+			b.batchElapsed = true
+			if b.mempool.Len() > 0 {
+				b.markReady()
+			}
+		case request := <-b.batchRequests:
+			request <- b.mempool.Pop(maxBatchSize)
+
+			if b.mempool.Len() > 0 {
+				// The remaining data has already waited for its batch window
+				b.markReady()
+			} else {
+				b.clearReady()
+			}
+		case <-b.shutdown:
+			return
+		}
+	}
+}
+
+// cancel removes the proposal [c] asks for from the schedule or the mempool
+// and the journal. Proposals that have been put into a block can't be
+// cancelled.
+func (b *builder) cancel(c cancellation) error {
+	i := slices.IndexFunc(b.scheduled, func(e MempoolEntry) bool {
+		return e.seq == c.id
+	})
+	cancellable, _ := b.mempool.(CancellableMempool)
+	var entry MempoolEntry
+	switch {
+	case i != -1:
+		entry = b.scheduled[i]
+	case cancellable == nil:
+		return errNotCancellable
+	default:
+		var ok bool
+		if entry, ok = cancellable.Get(c.id); !ok {
+			return errUnknownProposal
+		}
+	}
+	var zero [cancelTokenLen]byte
+	if !c.admin && (entry.cancelToken == zero || subtle.ConstantTimeCompare(c.cancelToken[:], entry.cancelToken[:]) != 1) {
+		return errBadCancelToken
+	}
+	if err := b.journal.delete(entry); err != nil {
+		return err
+	}
+	if i != -1 {
+		b.scheduled = slices.Delete(b.scheduled, i, i+1)
+	} else {
+		cancellable.Remove(c.id)
+	}
+	return nil
+}
+
+// setLimits sets the mempool size and build batch window. Data already in
+// the mempool stays there if it's over the new size, and data waiting for
+// its batch window keeps waiting for the old one.
+func (b *builder) setLimits(mempoolSize int, batchWindow time.Duration) {
+	b.mempoolSize.Store(int64(mempoolSize))
+	b.batchWindow.Store(int64(batchWindow))
+}
+
+// markReady notifies the engine that a block should be built
+func (b *builder) markReady() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// clearReady withdraws a notification the engine hasn't seen yet
+func (b *builder) clearReady() {
+	select {
+	case <-b.ready:
+	default:
+	}
+}
+
+// schedule sends [data] in [namespace], which isn't put into a block before
+// the Unix time [notBefore], to the builder and returns the proposal's ID once it's in the
+// mempool or scheduled. [cancelToken], unless it's zero, or an admin may
+// cancel it.
+func (b *builder) schedule(data [dataLen]byte, namespace [NamespaceLen]byte, notBefore int64, cancelToken [cancelTokenLen]byte) (uint64, error) {
+	result := make(chan proposalResult, 1)
+	select {
+	case b.proposals <- proposal{data: data, namespace: namespace, notBefore: notBefore, cancelToken: cancelToken, result: result}:
+		r := <-result
+		return r.id, r.err
+	case <-b.shutdown:
+		return 0, errShuttingDown
+	}
+}
+
+// cancelProposal removes the pending proposal [id] if [cancelToken] is its
+// cancel token or the caller is an [admin]
+func (b *builder) cancelProposal(id uint64, cancelToken [cancelTokenLen]byte, admin bool) error {
+	result := make(chan error, 1)
+	select {
+	case b.cancels <- cancellation{id: id, cancelToken: cancelToken, admin: admin, result: result}:
+		return <-result
+	case <-b.shutdown:
+		return errShuttingDown
+	}
+}
+
+// len returns the number of pieces of data in the mempool
+func (b *builder) len() int {
+	return int(b.mempoolLen.Load())
+}
+
+// scheduledLen returns the number of pieces of data that aren't due yet
+func (b *builder) scheduledLen() int {
+	return int(b.numScheduled.Load())
+}
+
+// markStateSyncDone notifies the engine that the VM finished state syncing
+func (b *builder) markStateSyncDone() {
+	select {
+	case b.stateSyncDone <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts [entries] back at the front of the mempool.
+// If the builder is shutting down, [entries] stay in the journal and are
+// restored on restart.
+func (b *builder) requeue(entries []MempoolEntry) {
+	select {
+	case b.requeues <- entries:
+	case <-b.shutdown:
+	}
+}
+
+// retryAt tells the engine to try building a block again at [retryTime]
+// if there is data in the mempool then
+func (b *builder) retryAt(retryTime time.Time) {
+	select {
+	case b.retries <- retryTime:
+	case <-b.shutdown:
+	}
+}
+
+// waitForEvent blocks until there is a message for the engine or [ctx] is
+// done. Finishing state sync takes priority over building a block.
+func (b *builder) waitForEvent(ctx context.Context) (common.Message, error) {
+	select {
+	case <-b.stateSyncDone:
+		return common.StateSyncDone, nil
+	default:
+	}
+
+	select {
+	case <-b.stateSyncDone:
+		return common.StateSyncDone, nil
+	case <-b.ready:
+		return common.PendingTxs, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-b.shutdown:
+		return 0, errShuttingDown
+	}
+}
+
+// nextBatch removes and returns the next batch of data to put into a block.
+// The batch is empty if the mempool is.
+// The data stays in the journal until the block containing it is decided.
+func (b *builder) nextBatch() ([]MempoolEntry, error) {
+	request := make(chan []MempoolEntry, 1)
+	select {
+	case b.batchRequests <- request:
+		return <-request, nil
+	case <-b.shutdown:
+		return nil, errShuttingDown
+	}
+}
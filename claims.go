@@ -0,0 +1,443 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const claimLen = ids.ShortIDLen + 8 + 8
+
+var (
+	errClaimsDisabled        = errors.New("chain doesn't have claims")
+	errTooManyClaimTransfers = errors.New("block has too many claim transfers")
+	errNoSuchClaim           = errors.New("data has no claim")
+	errNotClaimOwner         = errors.New("claim transfer isn't signed by the claim's owner")
+	errBadClaimNonce         = errors.New("claim transfer has the wrong nonce")
+	errBadClaim              = errors.New("claim must be 36 bytes")
+)
+
+// claim is the ownership of a piece of data. The signer of the first
+// accepted block that contains the data mints its claim.
+type claim struct {
+	owner ids.ShortID
+	// Nonce of the claim's next transfer
+	nonce uint64
+	// Height of the block that minted the claim
+	height uint64
+
+	minted bool // false if no block has minted the claim yet
+}
+
+func parseClaim(b []byte) (claim, error) {
+	if len(b) != claimLen {
+		return claim{}, errBadClaim
+	}
+	c := claim{
+		nonce:  binary.BigEndian.Uint64(b[ids.ShortIDLen:]),
+		height: binary.BigEndian.Uint64(b[ids.ShortIDLen+8:]),
+		minted: true,
+	}
+	copy(c.owner[:], b)
+	return c, nil
+}
+
+func (c claim) bytes() []byte {
+	b := make([]byte, claimLen)
+	copy(b, c.owner[:])
+	binary.BigEndian.PutUint64(b[ids.ShortIDLen:], c.nonce)
+	binary.BigEndian.PutUint64(b[ids.ShortIDLen+8:], c.height)
+	return b
+}
+
+// ClaimTransfer gives the claim on [Data] to [To]. Each claim's transfers
+// are applied in the order of their nonces, starting at 0, so a claim
+// transfer can't be replayed.
+type ClaimTransfer struct {
+	Data  [dataLen]byte `serialize:"true"`
+	Nonce uint64        `serialize:"true"`
+	To    ids.ShortID   `serialize:"true"`
+	// Owner's signature of the claim transfer's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	senderAddr  ids.ShortID // address of this claim transfer's sender, if [senderKnown]
+	senderKnown bool
+}
+
+// Hash returns the hash of [t] on the chain [chainID], which is what the
+// claim's owner signs
+func (t *ClaimTransfer) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+dataLen+8+ids.ShortIDLen)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, claimTransferTag)
+	msg = append(msg, t.Data[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, t.Nonce)
+	msg = append(msg, t.To[:]...)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [t]'s signature to [key]'s signature of [t] on the chain
+// [chainID]
+func (t *ClaimTransfer) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(t.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(t.Sig[:], sig)
+	t.senderKnown = false
+	return nil
+}
+
+// sender returns the address that signed [t] on the chain [chainID]
+func (t *ClaimTransfer) sender(chainID ids.ID) (ids.ShortID, error) {
+	if t.senderKnown {
+		return t.senderAddr, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(t.Hash(chainID), t.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	t.senderAddr = key.Address()
+	t.senderKnown = true
+	return t.senderAddr, nil
+}
+
+// apply applies [blk]'s mint and transfers of [c], the claim on [data].
+// The claim is minted before it's transferred.
+func (c *claim) apply(vm *VM, blk *Block, data [dataLen]byte) error {
+	if !c.minted && blk.Height() > 0 && slices.Contains(blk.Dt, data) {
+		signer, err := blk.signer()
+		if err != nil {
+			return err
+		}
+		*c = claim{owner: signer, height: blk.Height(), minted: true}
+	}
+	for i := range blk.ClaimTransfers {
+		t := &blk.ClaimTransfers[i]
+		if t.Data != data {
+			continue
+		}
+		sender, err := t.sender(vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !c.minted:
+			return errNoSuchClaim
+		case sender != c.owner:
+			return errNotClaimOwner
+		case t.Nonce != c.nonce:
+			return errBadClaimNonce
+		}
+		c.owner = t.To
+		c.nonce++
+	}
+	return nil
+}
+
+// claimAfter returns the claim on [data] after [blk] is accepted
+func (vm *VM) claimAfter(blk *Block, data [dataLen]byte) (claim, error) {
+	// Processing ancestors' mints and claim transfers aren't persisted yet
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return claim{}, err
+	}
+
+	c, err := vm.state.getClaim(data)
+	if err != nil && err != database.ErrNotFound {
+		return claim{}, err
+	}
+	for i := len(processing) - 1; i >= 0; i-- {
+		if err := c.apply(vm, processing[i], data); err != nil {
+			return claim{}, err
+		}
+	}
+	return c, nil
+}
+
+// verifyClaims returns nil iff [b]'s claim transfers can be applied after
+// [parent] is accepted and [b]'s claims are minted
+func (b *Block) verifyClaims(parent *Block) error {
+	switch {
+	case len(b.ClaimTransfers) == 0:
+		return nil
+	case !b.vm.genesis.Params.Claims:
+		return errClaimsDisabled
+	case len(b.ClaimTransfers) > maxBatchSize:
+		return errTooManyClaimTransfers
+	}
+	data := set.NewSet[[dataLen]byte](len(b.ClaimTransfers))
+	for _, t := range b.ClaimTransfers {
+		data.Add(t.Data)
+	}
+	// A claim only depends on the blocks that mint or transfer it, so each
+	// claim is checked on its own
+	for d := range data {
+		c, err := b.vm.claimAfter(parent, d)
+		if err != nil {
+			return err
+		}
+		if err := c.apply(b.vm, b, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyClaims mints the claims on [b]'s data that no accepted block has
+// minted, then applies [b]'s claim transfers
+func (b *Block) applyClaims() error {
+	if !b.vm.genesis.Params.Claims || b.Height() == 0 {
+		return nil
+	}
+	signer, err := b.signer()
+	if err != nil {
+		return err
+	}
+	for _, d := range b.Dt {
+		minted, err := b.vm.state.hasClaim(d)
+		if err != nil {
+			return err
+		}
+		if minted {
+			continue
+		}
+		if err := b.vm.state.putClaim(d, claim{owner: signer, height: b.Height()}); err != nil {
+			return err
+		}
+	}
+	for i := range b.ClaimTransfers {
+		t := &b.ClaimTransfers[i]
+		c, err := b.vm.state.getClaim(t.Data)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.deleteOwnedClaim(c.owner, t.Data); err != nil {
+			return err
+		}
+		c.owner = t.To
+		c.nonce++
+		if err := b.vm.state.putClaim(t.Data, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingClaimTransfers holds claim transfers submitted over the API until
+// they are accepted
+type pendingClaimTransfers struct {
+	lock      sync.Mutex
+	transfers []ClaimTransfer
+}
+
+// add adds [t] to the pending claim transfers
+func (p *pendingClaimTransfers) add(t ClaimTransfer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.transfers = append(p.transfers, t)
+}
+
+// next returns the pending claim transfers that can be applied in a child
+// of [parent]
+func (p *pendingClaimTransfers) next(vm *VM, parent *Block) []ClaimTransfer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.transfers) == 0 {
+		return nil
+	}
+	claims := make(map[[dataLen]byte]*claim)
+	var next []ClaimTransfer
+	included := make([]bool, len(p.transfers))
+	for found := true; found && len(next) < maxBatchSize; {
+		found = false
+		for i := range p.transfers {
+			t := &p.transfers[i]
+			if included[i] {
+				continue
+			}
+			c, ok := claims[t.Data]
+			if !ok {
+				after, err := vm.claimAfter(parent, t.Data)
+				if err != nil {
+					continue
+				}
+				c = &after
+				claims[t.Data] = c
+			}
+			sender, err := t.sender(vm.ctx.ChainID)
+			if err != nil || !c.minted || sender != c.owner || t.Nonce != c.nonce {
+				continue
+			}
+			c.owner = t.To
+			c.nonce++
+			included[i] = true
+			next = append(next, *t)
+			found = true
+			if len(next) == maxBatchSize {
+				break
+			}
+		}
+	}
+	return next
+}
+
+// prune drops the pending claim transfers that can no longer be accepted
+// because their nonces were used
+func (p *pendingClaimTransfers) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.transfers, err = pruneOps(vm.opJournal, claimTransferKind, p.transfers, func(t *ClaimTransfer) bool {
+		c, err := vm.state.getClaim(t.Data)
+		return err == database.ErrNotFound || (err == nil && t.Nonce >= c.nonce)
+	})
+	return err
+}
+
+// len returns the number of pending claim transfers
+func (p *pendingClaimTransfers) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.transfers)
+}
+
+// TransferClaimArgs are the arguments to TransferClaim
+type TransferClaimArgs struct {
+	// Base 58 repr. of the claimed data
+	Data string `json:"data"`
+	// Position of the transfer among the claim's transfers
+	Nonce json.Uint64 `json:"nonce"`
+	To    ids.ShortID `json:"to"`
+	// Base 58 repr. of the owner's signature of the claim transfer
+	Signature string `json:"signature"`
+
+	data [dataLen]byte
+	sig  [secp256k1.SignatureLen]byte
+}
+
+func (a *TransferClaimArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// TransferClaimReply is the reply from TransferClaim
+type TransferClaimReply struct {
+	// Address that signed the claim transfer
+	Sender ids.ShortID `json:"sender"`
+}
+
+// TransferClaim is an API method to propose a signed claim transfer. The
+// claim transfer is included in a block built by this node once it is the
+// claim's next transfer and it's signed by the claim's owner.
+func (s *Service) TransferClaim(_ *http.Request, args *TransferClaimArgs, reply *TransferClaimReply) error {
+	if !s.backend.chainParams().Claims {
+		return errClaimsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	t := ClaimTransfer{
+		Data:  args.data,
+		Nonce: uint64(args.Nonce),
+		To:    args.To,
+		Sig:   args.sig,
+	}
+	var err error
+	if reply.Sender, err = t.sender(s.backend.chainID()); err != nil {
+		return err
+	}
+	if err := s.backend.addClaimTransfer(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetClaimArgs are the arguments to GetClaim
+type GetClaimArgs struct {
+	// Base 58 repr. of the claimed data
+	Data string `json:"data"`
+
+	data [dataLen]byte
+}
+
+func (a *GetClaimArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+}
+
+// GetClaimReply is the reply from GetClaim
+type GetClaimReply struct {
+	Owner ids.ShortID `json:"owner"`
+	// Nonce of the claim's next transfer
+	Nonce json.Uint64 `json:"nonce"`
+	// Height of the accepted block that minted the claim
+	Height json.Uint64 `json:"height"`
+}
+
+// GetClaim returns the claim on [args.Data] after the last accepted block
+func (s *Service) GetClaim(_ *http.Request, args *GetClaimArgs, reply *GetClaimReply) error {
+	if !s.backend.chainParams().Claims {
+		return errClaimsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	c, err := s.backend.claim(args.data)
+	if err == database.ErrNotFound {
+		return errNoSuchClaim
+	}
+	if err != nil {
+		return err
+	}
+	reply.Owner = c.owner
+	reply.Nonce = json.Uint64(c.nonce)
+	reply.Height = json.Uint64(c.height)
+	return nil
+}
+
+// GetClaimsArgs are the arguments to GetClaims
+type GetClaimsArgs struct {
+	Owner ids.ShortID `json:"owner"`
+}
+
+// GetClaimsReply is the reply from GetClaims
+type GetClaimsReply struct {
+	// Base 58 repr. of each piece of data claimed by the owner
+	Data []string `json:"data"`
+}
+
+// GetClaims returns the data claimed by [args.Owner] after the last
+// accepted block, in the order of the data's bytes
+func (s *Service) GetClaims(r *http.Request, args *GetClaimsArgs, reply *GetClaimsReply) error {
+	ctx := requestContext(r)
+	if !s.backend.chainParams().Claims {
+		return errClaimsDisabled
+	}
+	owned, err := s.backend.ownedClaims(ctx, args.Owner)
+	if err != nil {
+		return err
+	}
+	reply.Data = make([]string, len(owned))
+	for i, d := range owned {
+		reply.Data[i] = encoding.EncodeCB58(d[:])
+	}
+	return nil
+}
@@ -0,0 +1,770 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/rpc"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+	"github.com/hitrich/AVM-TEST/light"
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+var errNotProposed = errors.New("data wasn't proposed")
+
+// Client is a client of the API of a chain running this VM
+type Client struct {
+	requester rpc.EndpointRequester
+}
+
+// NewClient returns a client of the chain [chain], which is the chain's ID
+// or alias, on the node at [uri]
+func NewClient(uri, chain string) *Client {
+	return &Client{
+		requester: rpc.NewEndpointRequester(uri + "/ext/bc/" + chain),
+	}
+}
+
+// ProposeBlock proposes [data] to be put in a block
+func (c *Client) ProposeBlock(ctx context.Context, data []byte, options ...rpc.Option) error {
+	_, _, err := c.SubmitProposal(ctx, data, time.Time{}, options...)
+	return err
+}
+
+// ScheduleBlock proposes [data] to be put in a block once [notBefore] has
+// passed
+func (c *Client) ScheduleBlock(ctx context.Context, data []byte, notBefore time.Time, options ...rpc.Option) error {
+	_, _, err := c.SubmitProposal(ctx, data, notBefore, options...)
+	return err
+}
+
+// SubmitProposal proposes [data] to be put in a block once [notBefore] has
+// passed, or right away if it's zero, and returns the ID and cancel token
+// that [Client.CancelProposal] takes
+func (c *Client) SubmitProposal(ctx context.Context, data []byte, notBefore time.Time, options ...rpc.Option) (uint64, string, error) {
+	return c.SubmitNamespacedProposal(ctx, "", data, notBefore, options...)
+}
+
+// SubmitNamespacedProposal is [Client.SubmitProposal] for [data] in
+// [namespace], which chains with namespaces require
+func (c *Client) SubmitNamespacedProposal(ctx context.Context, namespace string, data []byte, notBefore time.Time, options ...rpc.Option) (uint64, string, error) {
+	args := &ProposeBlockArgs{Data: encoding.EncodeCB58(data), Namespace: namespace}
+	if !notBefore.IsZero() {
+		args.NotBefore = json.Uint64(notBefore.Unix())
+	}
+	reply := &ProposeBlockReply{}
+	if err := c.requester.SendRequest(ctx, Name+".proposeBlock", args, reply, options...); err != nil {
+		return 0, "", err
+	}
+	if !reply.Success {
+		return 0, "", errNotProposed
+	}
+	return uint64(reply.ID), reply.CancelToken, nil
+}
+
+// CancelProposal removes the pending proposal [id] with its [cancelToken],
+// which may be empty if [options] set the admin token as a bearer token
+func (c *Client) CancelProposal(ctx context.Context, id uint64, cancelToken string, options ...rpc.Option) error {
+	args := &CancelProposalArgs{ID: json.Uint64(id), CancelToken: cancelToken}
+	return c.requester.SendRequest(ctx, Name+".cancelProposal", args, &struct{}{}, options...)
+}
+
+// GetBlock returns the block with ID [blkID]
+func (c *Client) GetBlock(ctx context.Context, blkID ids.ID, options ...rpc.Option) (*APIBlock, error) {
+	return c.getBlock(ctx, &GetBlockArgs{ID: blkID.String()}, options...)
+}
+
+// GetLastAccepted returns the last accepted block
+func (c *Client) GetLastAccepted(ctx context.Context, options ...rpc.Option) (*APIBlock, error) {
+	return c.getBlock(ctx, &GetBlockArgs{}, options...)
+}
+
+func (c *Client) getBlock(ctx context.Context, args *GetBlockArgs, options ...rpc.Option) (*APIBlock, error) {
+	reply := &GetBlockReply{}
+	err := c.requester.SendRequest(ctx, Name+".getBlock", args, reply, options...)
+	return &reply.APIBlock, err
+}
+
+// GetBlockByHeight returns the accepted block at [height]
+func (c *Client) GetBlockByHeight(ctx context.Context, height uint64, options ...rpc.Option) (*APIBlock, error) {
+	reply := &GetBlockReply{}
+	err := c.requester.SendRequest(ctx, Name+".getBlockByHeight", &GetBlockByHeightArgs{Height: json.Uint64(height)}, reply, options...)
+	return &reply.APIBlock, err
+}
+
+// GetMempoolSize returns the number of pieces of data in the node's mempool
+func (c *Client) GetMempoolSize(ctx context.Context, options ...rpc.Option) (uint64, error) {
+	reply := &GetMempoolSizeReply{}
+	err := c.requester.SendRequest(ctx, Name+".getMempoolSize", struct{}{}, reply, options...)
+	return uint64(reply.Size), err
+}
+
+// AnchorCID proposes the digest of the IPFS content with CID [cid] and records
+// the CID, with [contentType], in the node's anchor index. It returns the
+// cb58 encoding of the proposed data.
+func (c *Client) AnchorCID(ctx context.Context, cid, contentType string, options ...rpc.Option) (string, error) {
+	reply := &AnchorCIDReply{}
+	err := c.requester.SendRequest(ctx, Name+".anchorCID", &AnchorCIDArgs{
+		CID:         cid,
+		ContentType: contentType,
+	}, reply, options...)
+	return reply.Data, err
+}
+
+// ListAnchoredCIDs returns up to [limit] pieces of the IPFS content anchored
+// through the node's API from [cursor] on, and the cursor of the next page.
+// An empty [cursor] starts at the first piece, and an empty next cursor means
+// the page is the last.
+func (c *Client) ListAnchoredCIDs(ctx context.Context, cursor string, limit uint32, options ...rpc.Option) ([]APIAnchor, string, error) {
+	reply := &ListAnchoredCIDsReply{}
+	err := c.requester.SendRequest(ctx, Name+".listAnchoredCIDs", &ListAnchoredCIDsArgs{
+		Limit:  json.Uint32(limit),
+		Cursor: cursor,
+	}, reply, options...)
+	return reply.Anchors, reply.NextCursor, err
+}
+
+// ProposeReference proposes the hash of a reference to the content of [size]
+// bytes at [locator] whose content hash is [contentHash], such as
+// "sha256:<hex>", and records the reference in the node's reference index.
+// It returns the cb58 encoding of the proposed data.
+func (c *Client) ProposeReference(ctx context.Context, locator, contentHash string, size uint64, options ...rpc.Option) (string, error) {
+	reply := &ProposeReferenceReply{}
+	err := c.requester.SendRequest(ctx, Name+".proposeReference", &ProposeReferenceArgs{
+		Locator:     locator,
+		ContentHash: contentHash,
+		Size:        json.Uint64(size),
+	}, reply, options...)
+	return reply.Data, err
+}
+
+// GetReference returns the reference whose cb58 encoded data is [data]. If
+// [verify], the node fetches the referenced content and checks it.
+func (c *Client) GetReference(ctx context.Context, data string, verify bool, options ...rpc.Option) (*GetReferenceReply, error) {
+	reply := &GetReferenceReply{}
+	err := c.requester.SendRequest(ctx, Name+".getReference", &GetReferenceArgs{
+		Data:   data,
+		Verify: verify,
+	}, reply, options...)
+	return reply, err
+}
+
+// ProposeSignerOp proposes [op], which must already be signed by an admin
+// with [SignerOp.Sign], so the admin's key never leaves the client
+func (c *Client) ProposeSignerOp(ctx context.Context, op SignerOp, options ...rpc.Option) error {
+	encoded := encoding.EncodeCB58(op.AdminSig[:])
+	reply := &ProposeSignerOpReply{}
+	if err := c.requester.SendRequest(ctx, Name+".proposeSignerOp", &ProposeSignerOpArgs{
+		Nonce:     json.Uint64(op.Nonce),
+		Add:       op.Add,
+		Signer:    op.Signer,
+		Signature: encoded,
+	}, reply, options...); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return errNotProposed
+	}
+	return nil
+}
+
+// Transfer proposes the signed transfer [t] and returns its sender
+func (c *Client) Transfer(ctx context.Context, t Transfer, options ...rpc.Option) (ids.ShortID, error) {
+	encoded := encoding.EncodeCB58(t.Sig[:])
+	reply := &TransferReply{}
+	err := c.requester.SendRequest(ctx, Name+".transfer", &TransferArgs{
+		Nonce:     json.Uint64(t.Nonce),
+		To:        t.To,
+		Amount:    json.Uint64(t.Amount),
+		Signature: encoded,
+	}, reply, options...)
+	return reply.Sender, err
+}
+
+// GetNonce returns the nonce of [addr]'s next transfer
+func (c *Client) GetNonce(ctx context.Context, addr ids.ShortID, options ...rpc.Option) (uint64, error) {
+	reply := &GetNonceReply{}
+	err := c.requester.SendRequest(ctx, Name+".getNonce", &GetNonceArgs{Address: addr}, reply, options...)
+	return uint64(reply.Nonce), err
+}
+
+// TransferClaim proposes the signed claim transfer [t] and returns its sender
+func (c *Client) TransferClaim(ctx context.Context, t ClaimTransfer, options ...rpc.Option) (ids.ShortID, error) {
+	data := encoding.EncodeCB58(t.Data[:])
+	sig := encoding.EncodeCB58(t.Sig[:])
+	reply := &TransferClaimReply{}
+	err := c.requester.SendRequest(ctx, Name+".transferClaim", &TransferClaimArgs{
+		Data:      data,
+		Nonce:     json.Uint64(t.Nonce),
+		To:        t.To,
+		Signature: sig,
+	}, reply, options...)
+	return reply.Sender, err
+}
+
+// GetClaim returns the claim on [data]
+func (c *Client) GetClaim(ctx context.Context, data [dataLen]byte, options ...rpc.Option) (*GetClaimReply, error) {
+	encoded := encoding.EncodeCB58(data[:])
+	reply := &GetClaimReply{}
+	err := c.requester.SendRequest(ctx, Name+".getClaim", &GetClaimArgs{Data: encoded}, reply, options...)
+	return reply, err
+}
+
+// GetClaims returns the data claimed by [owner]
+func (c *Client) GetClaims(ctx context.Context, owner ids.ShortID, options ...rpc.Option) ([][dataLen]byte, error) {
+	reply := &GetClaimsReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getClaims", &GetClaimsArgs{Owner: owner}, reply, options...); err != nil {
+		return nil, err
+	}
+	owned := make([][dataLen]byte, len(reply.Data))
+	for i, encoded := range reply.Data {
+		decoded, err := encoding.DecodeCB58(encoded)
+		if err != nil {
+			return nil, err
+		}
+		copy(owned[i][:], decoded)
+	}
+	return owned, nil
+}
+
+// ProposeACLOp proposes the signed ACL operation [op]
+func (c *Client) ProposeACLOp(ctx context.Context, op ACLOp, options ...rpc.Option) error {
+	encoded := encoding.EncodeCB58(op.AdminSig[:])
+	reply := &ProposeACLOpReply{}
+	if err := c.requester.SendRequest(ctx, Name+".proposeACLOp", &ProposeACLOpArgs{
+		Nonce:     json.Uint64(op.Nonce),
+		Namespace: namespaceString(op.Namespace),
+		Grant:     op.Grant,
+		Writer:    op.Writer,
+		Signature: encoded,
+	}, reply, options...); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return errNotProposed
+	}
+	return nil
+}
+
+// GetPermissions returns who may write to [namespace]
+func (c *Client) GetPermissions(ctx context.Context, namespace string, options ...rpc.Option) (*GetPermissionsReply, error) {
+	reply := &GetPermissionsReply{}
+	err := c.requester.SendRequest(ctx, Name+".getPermissions", &GetPermissionsArgs{Namespace: namespace}, reply, options...)
+	return reply, err
+}
+
+// GetNamespaceData returns up to [limit] pieces of [namespace]'s accepted
+// data, oldest first, starting at the block at [startHeight]
+func (c *Client) GetNamespaceData(ctx context.Context, namespace string, startHeight uint64, limit uint32, options ...rpc.Option) ([]APINamespaceData, error) {
+	reply := &GetNamespaceDataReply{}
+	err := c.requester.SendRequest(ctx, Name+".getNamespaceData", &GetNamespaceDataArgs{
+		Namespace:   namespace,
+		StartHeight: json.Uint64(startHeight),
+		Limit:       json.Uint32(limit),
+	}, reply, options...)
+	return reply.Data, err
+}
+
+// ListNamespaces returns up to [limit] namespaces with accepted data and how
+// much data they have from [cursor] on, and the cursor of the next page. An
+// empty [cursor] starts at the first namespace, and an empty next cursor
+// means the page is the last.
+func (c *Client) ListNamespaces(ctx context.Context, cursor string, limit uint32, options ...rpc.Option) ([]NamespaceSummary, string, error) {
+	reply := &ListNamespacesReply{}
+	err := c.requester.SendRequest(ctx, Name+".listNamespaces", &ListNamespacesArgs{
+		Limit:  json.Uint32(limit),
+		Cursor: cursor,
+	}, reply, options...)
+	return reply.Namespaces, reply.NextCursor, err
+}
+
+// GetProof returns a proof that [data] is in an accepted block
+func (c *Client) GetProof(ctx context.Context, data []byte, options ...rpc.Option) (*proof.Proof, error) {
+	encoded := encoding.EncodeCB58(data)
+	reply := &GetProofReply{}
+	err := c.requester.SendRequest(ctx, Name+".getProof", &GetProofArgs{Data: encoded}, reply, options...)
+	return &reply.Proof, err
+}
+
+// SubmitHash submits [hash] to be aggregated with others into a Merkle tree
+// whose root is proposed
+func (c *Client) SubmitHash(ctx context.Context, hash [dataLen]byte, options ...rpc.Option) error {
+	encoded := encoding.EncodeCB58(hash[:])
+	return c.requester.SendRequest(ctx, Name+".submitHash", &SubmitHashArgs{Hash: encoded}, &SubmitHashReply{}, options...)
+}
+
+// GetInclusionProof returns a proof that the submitted [hash] is a leaf of a
+// Merkle tree whose root is in an accepted block
+func (c *Client) GetInclusionProof(ctx context.Context, hash [dataLen]byte, options ...rpc.Option) (*proof.Proof, error) {
+	encoded := encoding.EncodeCB58(hash[:])
+	reply := &GetInclusionProofReply{}
+	err := c.requester.SendRequest(ctx, Name+".getInclusionProof", &GetInclusionProofArgs{Hash: encoded}, reply, options...)
+	return &reply.Proof, err
+}
+
+// Reveal proposes the reveal of the commitment of [data] with [salt], which
+// must have been proposed as data, and returns the commitment
+func (c *Client) Reveal(ctx context.Context, data []byte, salt [SaltLen]byte, options ...rpc.Option) ([dataLen]byte, error) {
+	encodedData := encoding.EncodeCB58(data)
+	encodedSalt := encoding.EncodeCB58(salt[:])
+	reply := &RevealReply{}
+	if err := c.requester.SendRequest(ctx, Name+".reveal", &RevealArgs{
+		Data: encodedData,
+		Salt: encodedSalt,
+	}, reply, options...); err != nil {
+		return [dataLen]byte{}, err
+	}
+	return parseData(reply.Commitment)
+}
+
+// GetReveal returns the data revealed for [commitment] and the height of
+// the block that revealed it
+func (c *Client) GetReveal(ctx context.Context, commitment [dataLen]byte, options ...rpc.Option) ([]byte, uint64, error) {
+	encoded := encoding.EncodeCB58(commitment[:])
+	reply := &GetRevealReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getReveal", &GetRevealArgs{Commitment: encoded}, reply, options...); err != nil {
+		return nil, 0, err
+	}
+	data, err := encoding.DecodeCB58(reply.Data)
+	return data, uint64(reply.Height), err
+}
+
+// RegisterKey proposes the signed key registration [r] and returns the
+// address that owns the key
+func (c *Client) RegisterKey(ctx context.Context, r KeyRegistration, options ...rpc.Option) (ids.ShortID, error) {
+	key := encoding.EncodeCB58(r.Key[:])
+	sig := encoding.EncodeCB58(r.Sig[:])
+	reply := &RegisterKeyReply{}
+	err := c.requester.SendRequest(ctx, Name+".registerKey", &RegisterKeyArgs{
+		Key:       key,
+		Version:   json.Uint64(r.Version),
+		Signature: sig,
+	}, reply, options...)
+	return reply.Owner, err
+}
+
+// GetKey returns version [version] of [addr]'s key, or its latest key if
+// [version] is zero, and the key's version
+func (c *Client) GetKey(ctx context.Context, addr ids.ShortID, version uint64, options ...rpc.Option) ([EncryptionKeyLen]byte, uint64, error) {
+	var key [EncryptionKeyLen]byte
+	reply := &GetKeyReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getKey", &GetKeyArgs{
+		Address: addr,
+		Version: json.Uint64(version),
+	}, reply, options...); err != nil {
+		return key, 0, err
+	}
+	decoded, err := encoding.DecodeCB58(reply.Key)
+	if err != nil {
+		return key, 0, err
+	}
+	copy(key[:], decoded)
+	return key, uint64(reply.Version), nil
+}
+
+// ProposeEncrypted proposes [ciphertext], which was encrypted to version
+// [keyVersion] of [recipient]'s key, or to its latest key if [keyVersion]
+// is zero. Returns the payload's ID and the key's version.
+func (c *Client) ProposeEncrypted(ctx context.Context, recipient ids.ShortID, keyVersion uint64, ciphertext []byte, options ...rpc.Option) ([dataLen]byte, uint64, error) {
+	encoded := encoding.EncodeCB58(ciphertext)
+	reply := &ProposeEncryptedReply{}
+	if err := c.requester.SendRequest(ctx, Name+".proposeEncrypted", &ProposeEncryptedArgs{
+		Recipient:  recipient,
+		KeyVersion: json.Uint64(keyVersion),
+		Ciphertext: encoded,
+	}, reply, options...); err != nil {
+		return [dataLen]byte{}, 0, err
+	}
+	id, err := parseData(reply.ID)
+	return id, uint64(reply.KeyVersion), err
+}
+
+// GetEncrypted returns the accepted encrypted payload [id]
+func (c *Client) GetEncrypted(ctx context.Context, id [dataLen]byte, options ...rpc.Option) (*GetEncryptedReply, error) {
+	encoded := encoding.EncodeCB58(id[:])
+	reply := &GetEncryptedReply{}
+	err := c.requester.SendRequest(ctx, Name+".getEncrypted", &GetEncryptedArgs{ID: encoded}, reply, options...)
+	return reply, err
+}
+
+// SubmitFeedUpdate proposes the signed feed update [u] and returns the
+// address of its oracle
+func (c *Client) SubmitFeedUpdate(ctx context.Context, u FeedUpdate, options ...rpc.Option) (ids.ShortID, error) {
+	sig := encoding.EncodeCB58(u.Sig[:])
+	reply := &SubmitFeedUpdateReply{}
+	err := c.requester.SendRequest(ctx, Name+".submitFeedUpdate", &SubmitFeedUpdateArgs{
+		Feed:      feedString(u.Feed),
+		Value:     u.Value,
+		Timestamp: json.Uint64(u.Timestamp),
+		Signature: sig,
+	}, reply, options...)
+	return reply.Oracle, err
+}
+
+// SubmitGovernanceVote proposes the signed vote [v] and returns the
+// address that signed it
+func (c *Client) SubmitGovernanceVote(ctx context.Context, v GovernanceVote, options ...rpc.Option) (ids.ShortID, error) {
+	sig := encoding.EncodeCB58(v.Sig[:])
+	reply := &SubmitGovernanceVoteReply{}
+	err := c.requester.SendRequest(ctx, Name+".submitGovernanceVote", &SubmitGovernanceVoteArgs{
+		APIParamChange: newAPIParamChange(v.change()),
+		Signature:      sig,
+	}, reply, options...)
+	return reply.Voter, err
+}
+
+// GetGovernance returns the governed parameters that apply to the next
+// block and the accepted changes that are scheduled after it
+func (c *Client) GetGovernance(ctx context.Context, options ...rpc.Option) (*GetGovernanceReply, error) {
+	reply := &GetGovernanceReply{}
+	err := c.requester.SendRequest(ctx, Name+".getGovernance", struct{}{}, reply, options...)
+	return reply, err
+}
+
+// GetProposalVotes returns the accepted votes for [change] and whether it
+// passed
+func (c *Client) GetProposalVotes(ctx context.Context, change ParamChange, options ...rpc.Option) (*GetProposalVotesReply, error) {
+	args := newAPIParamChange(change)
+	reply := &GetProposalVotesReply{}
+	err := c.requester.SendRequest(ctx, Name+".getProposalVotes", &args, reply, options...)
+	return reply, err
+}
+
+// GetFeedValue returns [feed]'s latest accepted update
+func (c *Client) GetFeedValue(ctx context.Context, feed string, options ...rpc.Option) (*APIFeedUpdate, error) {
+	reply := &APIFeedUpdate{}
+	err := c.requester.SendRequest(ctx, Name+".getFeedValue", &GetFeedValueArgs{Feed: feed}, reply, options...)
+	return reply, err
+}
+
+// GetFeedHistory returns up to [limit] of [feed]'s accepted updates, oldest
+// first, starting at the Unix time [startTime]
+func (c *Client) GetFeedHistory(ctx context.Context, feed string, startTime uint64, limit uint32, options ...rpc.Option) ([]APIFeedUpdate, error) {
+	reply := &GetFeedHistoryReply{}
+	err := c.requester.SendRequest(ctx, Name+".getFeedHistory", &GetFeedHistoryArgs{
+		Feed:      feed,
+		StartTime: json.Uint64(startTime),
+		Limit:     json.Uint32(limit),
+	}, reply, options...)
+	return reply.Updates, err
+}
+
+// ListBlocks returns the page [page] of accepted blocks, newest first, with
+// [pageSize] blocks in each page, and the number of accepted blocks
+func (c *Client) ListBlocks(ctx context.Context, page, pageSize uint64, options ...rpc.Option) ([]APIBlock, uint64, error) {
+	reply := &ListBlocksReply{}
+	err := c.requester.SendRequest(ctx, Name+".listBlocks", &ListBlocksArgs{
+		Page:     json.Uint64(page),
+		PageSize: json.Uint64(pageSize),
+	}, reply, options...)
+	return reply.Blocks, uint64(reply.Total), err
+}
+
+// Search returns the block with the ID or height [query], or the accepted
+// block containing the data [query]
+func (c *Client) Search(ctx context.Context, query string, options ...rpc.Option) (*SearchReply, error) {
+	reply := &SearchReply{}
+	err := c.requester.SendRequest(ctx, Name+".search", &SearchArgs{Query: query}, reply, options...)
+	return reply, err
+}
+
+// GetDailyBlockCounts returns the number of accepted blocks in each of [days]
+// days in UTC, starting at the day of [start]
+func (c *Client) GetDailyBlockCounts(ctx context.Context, start time.Time, days int, options ...rpc.Option) ([]DailyBlockCount, error) {
+	reply := &GetDailyBlockCountsReply{}
+	err := c.requester.SendRequest(ctx, Name+".getDailyBlockCounts", &GetDailyBlockCountsArgs{
+		Start: start.UTC().Format(dayFormat),
+		Days:  days,
+	}, reply, options...)
+	return reply.Counts, err
+}
+
+// ListSubmitters returns the totals of the accepted blocks signed by up to
+// [limit] addresses from [cursor] on, and the cursor of the next page. An
+// empty [cursor] starts at the first address, and an empty next cursor means
+// the page is the last.
+func (c *Client) ListSubmitters(ctx context.Context, cursor string, limit uint32, options ...rpc.Option) ([]SubmitterSummary, string, error) {
+	reply := &ListSubmittersReply{}
+	err := c.requester.SendRequest(ctx, Name+".listSubmitters", &ListSubmittersArgs{
+		Limit:  json.Uint32(limit),
+		Cursor: cursor,
+	}, reply, options...)
+	return reply.Submitters, reply.NextCursor, err
+}
+
+// PutValue proposes setting [key] to [value] on a chain with the key-value
+// payload rule
+func (c *Client) PutValue(ctx context.Context, key string, value []byte, options ...rpc.Option) error {
+	data, err := EncodePut(key, value)
+	if err != nil {
+		return err
+	}
+	return c.ProposeBlock(ctx, data[:], options...)
+}
+
+// DeleteValue proposes deleting [key] on a chain with the key-value payload
+// rule
+func (c *Client) DeleteValue(ctx context.Context, key string, options ...rpc.Option) error {
+	data, err := EncodeDelete(key)
+	if err != nil {
+		return err
+	}
+	return c.ProposeBlock(ctx, data[:], options...)
+}
+
+// GetValue returns the zero-padded value of [key] and the height of the
+// block that set it
+func (c *Client) GetValue(ctx context.Context, key string, options ...rpc.Option) ([]byte, uint64, error) {
+	reply := &GetValueReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getValue", &GetValueArgs{Key: key}, reply, options...); err != nil {
+		return nil, 0, err
+	}
+	value, err := encoding.DecodeCB58(reply.Value)
+	return value, uint64(reply.Height), err
+}
+
+// GetHistory returns up to [limit] accepted operations on [key], oldest
+// first, from [cursor] on, and the cursor of the next page. An empty
+// [cursor] starts at the first operation, and an empty next cursor means the
+// page is the last.
+func (c *Client) GetHistory(ctx context.Context, key, cursor string, limit uint32, options ...rpc.Option) ([]APIKVOp, string, error) {
+	reply := &GetHistoryReply{}
+	err := c.requester.SendRequest(ctx, Name+".getHistory", &GetHistoryArgs{
+		Key:    key,
+		Limit:  json.Uint32(limit),
+		Cursor: cursor,
+	}, reply, options...)
+	return reply.History, reply.NextCursor, err
+}
+
+// GetDocumentHistory returns up to [limit] accepted versions of [docID],
+// oldest first, from [cursor] on, and the cursor of the next page. An empty
+// [cursor] starts at the first version, and an empty next cursor means the
+// page is the last.
+func (c *Client) GetDocumentHistory(ctx context.Context, docID, cursor string, limit uint32, options ...rpc.Option) ([]APIDocumentVersion, string, error) {
+	reply := &GetDocumentHistoryReply{}
+	err := c.requester.SendRequest(ctx, Name+".getDocumentHistory", &GetDocumentHistoryArgs{
+		DocID:  docID,
+		Limit:  json.Uint32(limit),
+		Cursor: cursor,
+	}, reply, options...)
+	return reply.Versions, reply.NextCursor, err
+}
+
+// GetHeaders returns up to [limit] light headers of accepted blocks, starting
+// at [startHeight], and this node's checkpoint signature of the last one, if
+// it has a signer
+func (c *Client) GetHeaders(ctx context.Context, startHeight uint64, limit uint32, options ...rpc.Option) ([]light.Header, *proof.Checkpoint, error) {
+	reply := &GetHeadersReply{}
+	err := c.requester.SendRequest(ctx, Name+".getHeaders", &GetHeadersArgs{
+		StartHeight: json.Uint64(startHeight),
+		Limit:       json.Uint32(limit),
+	}, reply, options...)
+	return reply.Headers, reply.Checkpoint, err
+}
+
+// GetPayloadPath returns the light header of the accepted block that contains
+// [data] and the data's path to its payload root
+func (c *Client) GetPayloadPath(ctx context.Context, data []byte, options ...rpc.Option) (light.Header, *proof.MerklePath, error) {
+	encoded := encoding.EncodeCB58(data)
+	reply := &GetPayloadPathReply{}
+	err := c.requester.SendRequest(ctx, Name+".getPayloadPath", &GetPayloadPathArgs{Data: encoded}, reply, options...)
+	return reply.Header, &reply.Path, err
+}
+
+// SubmitWarpMessage relays the signed Warp message [msg], whose payload is a
+// hash, to be included in a block. Returns the message's source chain and
+// the hash it attests.
+func (c *Client) SubmitWarpMessage(ctx context.Context, msg []byte, options ...rpc.Option) (ids.ID, []byte, error) {
+	encoded := encoding.EncodeCB58(msg)
+	reply := &SubmitWarpMessageReply{}
+	if err := c.requester.SendRequest(ctx, Name+".submitWarpMessage", &SubmitWarpMessageArgs{Message: encoded}, reply, options...); err != nil {
+		return ids.Empty, nil, err
+	}
+	hash, err := encoding.DecodeCB58(reply.Hash)
+	return reply.SourceChainID, hash, err
+}
+
+// GetWarpAttestation returns the height of the accepted block in which
+// [sourceChainID] attested [hash]
+func (c *Client) GetWarpAttestation(ctx context.Context, sourceChainID ids.ID, hash []byte, options ...rpc.Option) (uint64, error) {
+	encoded := encoding.EncodeCB58(hash)
+	reply := &GetWarpAttestationReply{}
+	err := c.requester.SendRequest(ctx, Name+".getWarpAttestation", &GetWarpAttestationArgs{
+		SourceChainID: sourceChainID,
+		Hash:          encoded,
+	}, reply, options...)
+	return uint64(reply.Height), err
+}
+
+// GetBlockAttestation returns the Warp message signed by the validators that
+// attested the accepted block [blkID], as aggregated by the node
+func (c *Client) GetBlockAttestation(ctx context.Context, blkID ids.ID, options ...rpc.Option) (*GetBlockAttestationReply, error) {
+	reply := &GetBlockAttestationReply{}
+	err := c.requester.SendRequest(ctx, Name+".getBlockAttestation", &GetBlockAttestationArgs{
+		BlockID: blkID,
+	}, reply, options...)
+	return reply, err
+}
+
+// GetBlockRetention returns the retention status of each piece of the
+// accepted block [blkID]'s data on the node
+func (c *Client) GetBlockRetention(ctx context.Context, blkID ids.ID, options ...rpc.Option) ([]APIDataRetention, error) {
+	reply := &GetBlockRetentionReply{}
+	err := c.requester.SendRequest(ctx, Name+".getBlockRetention", &GetBlockRetentionArgs{
+		BlockID: blkID,
+	}, reply, options...)
+	return reply.Data, err
+}
+
+// GetAuditLog returns up to [limit] of the write API calls recorded in the
+// node's audit log from [startIndex] on, of [method] by [caller]. Empty
+// filters match every call.
+func (c *Client) GetAuditLog(ctx context.Context, startIndex uint64, limit uint32, method, caller string, options ...rpc.Option) ([]AuditRecord, error) {
+	reply := &GetAuditLogReply{}
+	err := c.requester.SendRequest(ctx, Name+".getAuditLog", &GetAuditLogArgs{
+		StartIndex: json.Uint64(startIndex),
+		Limit:      json.Uint32(limit),
+		Method:     method,
+		Caller:     caller,
+	}, reply, options...)
+	return reply.Records, err
+}
+
+// GetIndexerFeed returns up to [limit] changes to the accepted chain after
+// [cursor], and the cursor of the changes after them. An empty [cursor]
+// starts at the beginning of the feed.
+func (c *Client) GetIndexerFeed(ctx context.Context, cursor string, limit uint32, options ...rpc.Option) ([]IndexerEvent, string, error) {
+	reply := &GetIndexerFeedReply{}
+	err := c.requester.SendRequest(ctx, Name+".getIndexerFeed", &GetIndexerFeedArgs{
+		Cursor: cursor,
+		Limit:  json.Uint32(limit),
+	}, reply, options...)
+	return reply.Events, reply.NextCursor, err
+}
+
+// GetHookResults returns the outcome of the node's WASM hook on each piece of
+// the accepted block [blkID]'s data
+func (c *Client) GetHookResults(ctx context.Context, blkID ids.ID, options ...rpc.Option) ([]APIHookResult, error) {
+	reply := &GetHookResultsReply{}
+	err := c.requester.SendRequest(ctx, Name+".getHookResults", &GetHookResultsArgs{BlockID: blkID}, reply, options...)
+	return reply.Results, err
+}
+
+// GetHookIndex returns the value that the node's WASM hook last set for [key]
+// in its derived index
+func (c *Client) GetHookIndex(ctx context.Context, key []byte, options ...rpc.Option) ([]byte, error) {
+	encoded := encoding.EncodeCB58(key)
+	reply := &GetHookIndexReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getHookIndex", &GetHookIndexArgs{Key: encoded}, reply, options...); err != nil {
+		return nil, err
+	}
+	return encoding.DecodeCB58(reply.Value)
+}
+
+// SubmitMultisigSignature adds [sig], a signer's signature of the multisig
+// proposal of [data] in [namespace] with the set [set], to the proposal on
+// the node. [namespace] is empty on chains whose data has no namespaces. It
+// returns the number of signatures the node collected and the number the
+// proposal needs.
+func (c *Client) SubmitMultisigSignature(ctx context.Context, set string, data [dataLen]byte, namespace string, sig [secp256k1.SignatureLen]byte, options ...rpc.Option) (uint32, uint32, error) {
+	encodedData := encoding.EncodeCB58(data[:])
+	encodedSig := encoding.EncodeCB58(sig[:])
+	reply := &SubmitMultisigSignatureReply{}
+	err := c.requester.SendRequest(ctx, Name+".submitMultisigSignature", &SubmitMultisigSignatureArgs{
+		Set:       set,
+		Data:      encodedData,
+		Namespace: namespace,
+		Signature: encodedSig,
+	}, reply, options...)
+	return uint32(reply.Signatures), uint32(reply.Threshold), err
+}
+
+// GetMultisig returns the signers of the multisig proposal of [data] in
+// [namespace] with the set [set], and whether it's accepted
+func (c *Client) GetMultisig(ctx context.Context, set string, data [dataLen]byte, namespace string, options ...rpc.Option) (*GetMultisigReply, error) {
+	encoded := encoding.EncodeCB58(data[:])
+	reply := &GetMultisigReply{}
+	err := c.requester.SendRequest(ctx, Name+".getMultisig", &GetMultisigArgs{Set: set, Data: encoded, Namespace: namespace}, reply, options...)
+	return reply, err
+}
+
+// SubmitSigned proposes the signed submission [s] and returns the address
+// that signed it
+func (c *Client) SubmitSigned(ctx context.Context, s SignedSubmission, options ...rpc.Option) (ids.ShortID, error) {
+	data := encoding.EncodeCB58(s.Data[:])
+	sig := encoding.EncodeCB58(s.Sig[:])
+	reply := &SubmitSignedReply{}
+	err := c.requester.SendRequest(ctx, Name+".submitSigned", &SubmitSignedArgs{
+		Nonce:     json.Uint64(s.Nonce),
+		Data:      data,
+		Namespace: namespaceString(s.Namespace),
+		Signature: sig,
+	}, reply, options...)
+	return reply.Submitter, err
+}
+
+// GetAccount returns the public key of [addr]'s account and the nonce of its
+// next submission
+func (c *Client) GetAccount(ctx context.Context, addr ids.ShortID, options ...rpc.Option) (*secp256k1.PublicKey, uint64, error) {
+	reply := &GetAccountReply{}
+	if err := c.requester.SendRequest(ctx, Name+".getAccount", &GetAccountArgs{Address: addr}, reply, options...); err != nil {
+		return nil, 0, err
+	}
+	keyBytes, err := encoding.DecodeCB58(reply.PublicKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, err := secp256k1.ToPublicKey(keyBytes)
+	return key, uint64(reply.Nonce), err
+}
+
+// GetAccountHistory returns up to [limit] of [addr]'s accepted submissions
+// from the nonce [startNonce] on
+func (c *Client) GetAccountHistory(ctx context.Context, addr ids.ShortID, startNonce uint64, limit uint32, options ...rpc.Option) ([]APISubmission, error) {
+	reply := &GetAccountHistoryReply{}
+	err := c.requester.SendRequest(ctx, Name+".getAccountHistory", &GetAccountHistoryArgs{
+		Address:    addr,
+		StartNonce: json.Uint64(startNonce),
+		Limit:      json.Uint32(limit),
+	}, reply, options...)
+	return reply.Submissions, err
+}
+
+// GetCurrentFee returns the fee for each piece of data in the next block
+func (c *Client) GetCurrentFee(ctx context.Context, options ...rpc.Option) (*GetCurrentFeeReply, error) {
+	reply := &GetCurrentFeeReply{}
+	err := c.requester.SendRequest(ctx, Name+".getCurrentFee", struct{}{}, reply, options...)
+	return reply, err
+}
+
+// GetGenesis returns the chain's genesis and upgrades
+func (c *Client) GetGenesis(ctx context.Context, options ...rpc.Option) (*GetGenesisReply, error) {
+	reply := &GetGenesisReply{}
+	err := c.requester.SendRequest(ctx, Name+".getGenesis", struct{}{}, reply, options...)
+	return reply, err
+}
+
+// GetChainHead returns the node's last accepted block and its preferred
+// block
+func (c *Client) GetChainHead(ctx context.Context, options ...rpc.Option) (*GetChainHeadReply, error) {
+	reply := &GetChainHeadReply{}
+	err := c.requester.SendRequest(ctx, Name+".getChainHead", struct{}{}, reply, options...)
+	return reply, err
+}
+
+// GetConfig returns the node's current config of the chain, without its
+// secrets
+func (c *Client) GetConfig(ctx context.Context, options ...rpc.Option) (Config, error) {
+	reply := &GetConfigReply{}
+	err := c.requester.SendRequest(ctx, Name+".getConfig", struct{}{}, reply, options...)
+	return reply.Config, err
+}
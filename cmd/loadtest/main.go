@@ -0,0 +1,290 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// loadtest proposes data to a running chain that uses the timestamp VM at a
+// fixed rate and reports how long proposals take to be accepted and how large
+// the node's mempool grows. It's meant for capacity planning.
+//
+// Usage:
+//
+//	loadtest [-uri uri] -chain chain [-rate n] [-duration d] [-concurrency n] [-drain d]
+//
+// Every proposal is a unique piece of data. A proposal's acceptance latency is
+// the time from sending it to first seeing it in an accepted block, so it
+// includes up to one -poll interval of polling delay.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+var errUsage = errors.New("usage: loadtest [-uri uri] -chain chain [-rate n] [-duration d] [-concurrency n] [-drain d] [-poll d]")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	uri := flags.String("uri", "http://127.0.0.1:9650", "URI of the node")
+	chain := flags.String("chain", "", "ID or alias of the chain")
+	rate := flags.Float64("rate", 10, "proposals per second")
+	duration := flags.Duration("duration", time.Minute, "how long to propose for")
+	concurrency := flags.Int("concurrency", 16, "maximum number of outstanding proposals")
+	drain := flags.Duration("drain", 30*time.Second, "how long to wait for outstanding proposals to be accepted")
+	poll := flags.Duration("poll", 100*time.Millisecond, "how often to poll for accepted blocks")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *chain == "" || flags.NArg() != 0 || *rate <= 0 || *concurrency <= 0 || *poll <= 0 {
+		return errUsage
+	}
+
+	client := timestampvm.NewClient(*uri, *chain)
+	lastAccepted, err := client.GetLastAccepted(ctx)
+	if err != nil {
+		return err
+	}
+	t := &test{
+		client: client,
+		height: uint64(lastAccepted.Height),
+		sent:   make(map[string]time.Time),
+	}
+	if _, err := rand.Read(t.runID[:]); err != nil {
+		return err
+	}
+
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	watchDone := make(chan error, 1)
+	go func() {
+		watchDone <- t.watch(watchCtx, *poll)
+	}()
+
+	fmt.Fprintf(os.Stderr, "proposing %g/s for %s\n", *rate, *duration)
+	t.propose(ctx, *rate, *duration, *concurrency)
+	t.waitForDrain(ctx, *drain)
+	stopWatching()
+	if err := <-watchDone; err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	t.report()
+	return nil
+}
+
+// test is the state of a load test
+type test struct {
+	client *timestampvm.Client
+	// Prefix of every piece of data proposed by this run, so that data from
+	// other runs isn't counted
+	runID [8]byte
+
+	lock sync.Mutex
+	// Height of the last accepted block that was checked for proposed data
+	height uint64
+	// Proposed data --> When it was sent. Data is removed once it's accepted.
+	sent      map[string]time.Time
+	proposed  int
+	failed    int
+	latencies []time.Duration
+	// Mempool sizes sampled once per second
+	mempoolSizes []uint64
+}
+
+// newData returns the cb58 encoding of the [seq]th piece of data proposed by
+// this run, and the data itself
+func (t *test) newData(seq uint64) (string, []byte) {
+	data := make([]byte, 32)
+	copy(data, t.runID[:])
+	binary.BigEndian.PutUint64(data[len(t.runID):], seq)
+	return encoding.EncodeCB58(data), data
+}
+
+// propose sends proposals at [rate] per second for [duration], with at most
+// [concurrency] outstanding at a time. If a proposal would exceed
+// [concurrency], it's dropped and counted as failed.
+func (t *test) propose(ctx context.Context, rate float64, duration time.Duration, concurrency int) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+
+	var (
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, concurrency)
+		seq   uint64
+	)
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-progress.C:
+			t.sample(ctx)
+		case <-ticker.C:
+			select {
+			case slots <- struct{}{}:
+			default:
+				t.lock.Lock()
+				t.failed++
+				t.lock.Unlock()
+				continue
+			}
+			encoded, data := t.newData(seq)
+			seq++
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				t.lock.Lock()
+				t.sent[encoded] = time.Now()
+				t.proposed++
+				t.lock.Unlock()
+
+				if err := t.client.ProposeBlock(context.WithoutCancel(ctx), data); err != nil {
+					t.lock.Lock()
+					delete(t.sent, encoded)
+					t.failed++
+					t.lock.Unlock()
+				}
+			}()
+		}
+	}
+}
+
+// sample records the node's mempool size and prints the progress so far
+func (t *test) sample(ctx context.Context) {
+	size, err := t.client.GetMempoolSize(ctx)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err == nil {
+		t.mempoolSizes = append(t.mempoolSizes, size)
+	}
+	fmt.Fprintf(os.Stderr, "proposed=%d accepted=%d failed=%d outstanding=%d mempool=%d\n",
+		t.proposed, len(t.latencies), t.failed, len(t.sent), size)
+}
+
+// waitForDrain waits up to [timeout] for every outstanding proposal to be
+// accepted
+func (t *test) waitForDrain(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		t.lock.Lock()
+		outstanding := len(t.sent)
+		t.lock.Unlock()
+		if outstanding == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sample(ctx)
+		}
+	}
+}
+
+// watch polls for newly accepted blocks every [interval] and records the
+// acceptance latency of the proposed data in them
+func (t *test) watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		lastAccepted, err := t.client.GetLastAccepted(ctx)
+		if err != nil {
+			return err
+		}
+		for height := t.height + 1; height <= uint64(lastAccepted.Height); height++ {
+			blk, err := t.client.GetBlockByHeight(ctx, height)
+			if err != nil {
+				return err
+			}
+			t.accepted(blk)
+		}
+	}
+}
+
+// accepted records the acceptance latency of the proposed data in the
+// accepted block [blk]
+func (t *test) accepted(blk *timestampvm.APIBlock) {
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, data := range blk.Data {
+		if sentAt, ok := t.sent[data]; ok {
+			t.latencies = append(t.latencies, now.Sub(sentAt))
+			delete(t.sent, data)
+		}
+	}
+	t.height = uint64(blk.Height)
+}
+
+// report prints the results of the test
+func (t *test) report() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	fmt.Printf("proposed:    %d\n", t.proposed)
+	fmt.Printf("accepted:    %d\n", len(t.latencies))
+	fmt.Printf("failed:      %d\n", t.failed)
+	fmt.Printf("unaccepted:  %d\n", len(t.sent))
+	if len(t.latencies) > 0 {
+		slices.Sort(t.latencies)
+		fmt.Printf("latency p50: %s\n", percentile(t.latencies, 0.50))
+		fmt.Printf("latency p90: %s\n", percentile(t.latencies, 0.90))
+		fmt.Printf("latency p99: %s\n", percentile(t.latencies, 0.99))
+		fmt.Printf("latency max: %s\n", t.latencies[len(t.latencies)-1])
+	}
+	if len(t.mempoolSizes) > 0 {
+		var sum uint64
+		for _, size := range t.mempoolSizes {
+			sum += size
+		}
+		fmt.Printf("mempool avg: %d\n", sum/uint64(len(t.mempoolSizes)))
+		fmt.Printf("mempool max: %d\n", slices.Max(t.mempoolSizes))
+	}
+}
+
+// percentile returns the [q]th quantile of [sorted], which must be sorted and
+// non-empty
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
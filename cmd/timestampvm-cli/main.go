@@ -0,0 +1,337 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// timestampvm-cli proposes data to, and reads blocks from, a running chain
+// that uses the timestamp VM.
+//
+// Usage:
+//
+//	timestampvm-cli [-uri uri] -chain chain <command> [arguments]
+//
+// The commands are:
+//
+//	propose [-encoding enc] [-hex] [-not-before t] data
+//	                         propose data, given in cb58, hex or base64.
+//	                         -hex is short for -encoding hex. With
+//	                         -not-before, it isn't included in a block
+//	                         until the Unix time t, in seconds.
+//	get [blockID]            print a block, or the last accepted block
+//	range from to            print the accepted blocks at heights [from, to]
+//	watch [-interval d]      print blocks as they are accepted
+//	key-generate file        write a new key to file and print its address
+//	key-address file         print the address of the key in file
+//	signer-op -key file [-chain-id id] [-remove] nonce address
+//	                         sign a signer operation with the admin key in
+//	                         file and propose it. The chain ID is signed
+//	                         over, so -chain-id is needed if -chain is an
+//	                         alias.
+//	genesis-encode [-config file] [-encoding enc] [data...]
+//	                         print the genesis bytes of the genesis in the
+//	                         config file with the given data appended. All of
+//	                         the data is in one encoding: cb58, hex or utf8.
+//
+// Blocks are printed as JSON, one per line. Keys never leave this tool.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+	"github.com/hitrich/AVM-TEST/encoding"
+	"github.com/hitrich/AVM-TEST/genesis"
+)
+
+var errUsage = errors.New("usage: timestampvm-cli [-uri uri] -chain chain <propose|get|range|watch|key-generate|key-address|signer-op|genesis-encode> [arguments]")
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("timestampvm-cli", flag.ContinueOnError)
+	uri := flags.String("uri", "http://127.0.0.1:9650", "URI of the node")
+	chain := flags.String("chain", "", "ID or alias of the chain")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "genesis-encode":
+		return genesisEncode(args)
+	case "key-generate":
+		return keyGenerate(args)
+	case "key-address":
+		return keyAddress(args)
+	}
+	if *chain == "" {
+		return errUsage
+	}
+	client := timestampvm.NewClient(*uri, *chain)
+	switch command {
+	case "propose":
+		return propose(ctx, client, args)
+	case "get":
+		return get(ctx, client, args)
+	case "range":
+		return getRange(ctx, client, args)
+	case "watch":
+		return watch(ctx, client, args)
+	case "signer-op":
+		return signerOp(ctx, client, *chain, args)
+	default:
+		return errUsage
+	}
+}
+
+func propose(ctx context.Context, client *timestampvm.Client, args []string) error {
+	flags := flag.NewFlagSet("propose", flag.ContinueOnError)
+	format := flags.String("encoding", string(encoding.CB58), "encoding of the data: cb58, hex or base64")
+	isHex := flags.Bool("hex", false, "data is hex instead of cb58")
+	notBefore := flags.Int64("not-before", 0, "earliest Unix time, in seconds, of the block that includes the data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: propose [-encoding enc] [-hex] [-not-before t] data")
+	}
+	if *isHex {
+		*format = string(encoding.Hex)
+	}
+	data, err := encoding.Format(*format).Decode(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *notBefore != 0 {
+		return client.ScheduleBlock(ctx, data, time.Unix(*notBefore, 0))
+	}
+	return client.ProposeBlock(ctx, data)
+}
+
+func get(ctx context.Context, client *timestampvm.Client, args []string) error {
+	var (
+		blk *timestampvm.APIBlock
+		err error
+	)
+	switch len(args) {
+	case 0:
+		blk, err = client.GetLastAccepted(ctx)
+	case 1:
+		blkID, parseErr := ids.FromString(args[0])
+		if parseErr != nil {
+			return parseErr
+		}
+		blk, err = client.GetBlock(ctx, blkID)
+	default:
+		return errors.New("usage: get [blockID]")
+	}
+	if err != nil {
+		return err
+	}
+	return printBlock(blk)
+}
+
+func getRange(ctx context.Context, client *timestampvm.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: range from to")
+	}
+	from, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	to, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	for height := from; height <= to; height++ {
+		blk, err := client.GetBlockByHeight(ctx, height)
+		if err != nil {
+			return fmt.Errorf("couldn't get block at height %d: %w", height, err)
+		}
+		if err := printBlock(blk); err != nil {
+			return err
+		}
+		if height == to {
+			// [to] may be the max height
+			return nil
+		}
+	}
+	return nil
+}
+
+// watch prints the last accepted block and then every block accepted after it
+// until [ctx] is cancelled
+func watch(ctx context.Context, client *timestampvm.Client, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Second, "how often the node is polled")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	last, err := client.GetLastAccepted(ctx)
+	if err != nil {
+		return err
+	}
+	if err := printBlock(last); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		tip, err := client.GetLastAccepted(ctx)
+		if err != nil {
+			return err
+		}
+		// Blocks accepted between polls are fetched by height
+		for height := uint64(last.Height) + 1; height < uint64(tip.Height); height++ {
+			blk, err := client.GetBlockByHeight(ctx, height)
+			if err != nil {
+				return err
+			}
+			if err := printBlock(blk); err != nil {
+				return err
+			}
+		}
+		if tip.Height > last.Height {
+			if err := printBlock(tip); err != nil {
+				return err
+			}
+			last = tip
+		}
+	}
+}
+
+func keyGenerate(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: key-generate file")
+	}
+	key, err := timestampvm.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := timestampvm.SaveKey(args[0], key); err != nil {
+		return err
+	}
+	_, err = fmt.Println(key.Address())
+	return err
+}
+
+func keyAddress(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: key-address file")
+	}
+	key, err := timestampvm.LoadKey(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(key.Address())
+	return err
+}
+
+func signerOp(ctx context.Context, client *timestampvm.Client, chain string, args []string) error {
+	flags := flag.NewFlagSet("signer-op", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "file of the admin key that signs the operation")
+	chainIDFlag := flags.String("chain-id", chain, "ID of the chain")
+	remove := flags.Bool("remove", false, "remove the address from the allowed signers instead of adding it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || flags.NArg() != 2 {
+		return errors.New("usage: signer-op -key file [-chain-id id] [-remove] nonce address")
+	}
+	chainID, err := ids.FromString(*chainIDFlag)
+	if err != nil {
+		return fmt.Errorf("couldn't parse chain ID %q: %w", *chainIDFlag, err)
+	}
+	nonce, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		return err
+	}
+	addr, err := ids.ShortFromString(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	key, err := timestampvm.LoadKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	op := timestampvm.SignerOp{
+		Nonce:  nonce,
+		Add:    !*remove,
+		Signer: addr,
+	}
+	if err := op.Sign(chainID, key); err != nil {
+		return err
+	}
+	return client.ProposeSignerOp(ctx, op)
+}
+
+func genesisEncode(args []string) error {
+	flags := flag.NewFlagSet("genesis-encode", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON file of the chain parameters, data and allocations")
+	encoding := flags.String("encoding", string(genesis.CB58), "encoding of the data, overriding the config file's: cb58, hex or utf8")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := genesis.Config{}
+	if *configFile != "" {
+		configBytes, err := os.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(configBytes, &config); err != nil {
+			return fmt.Errorf("couldn't parse %s: %w", *configFile, err)
+		}
+	}
+	// The flag overrides the config file's encoding
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "encoding" {
+			config.Encoding = genesis.Encoding(*encoding)
+		}
+	})
+	config.Data = append(config.Data, flags.Args()...)
+
+	genesisBytes, err := config.Build()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(genesisBytes))
+	return err
+}
+
+func printBlock(blk *timestampvm.APIBlock) error {
+	blockJSON, err := json.Marshal(blk)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(blockJSON))
+	return err
+}
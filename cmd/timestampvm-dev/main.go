@@ -0,0 +1,219 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// timestampvm-dev runs a chain using the timestamp VM without an avalanchego
+// node, for developing against the VM's API. The chain's state is kept in
+// memory and is lost when the process exits.
+//
+// This node is the chain's only validator, so every block it builds is
+// accepted immediately. The chain's API is served at /ext/bc/<chain>, where
+// the chain is "timestamp" unless set with -chain, so the CLI can be pointed
+// at it. The chain's metrics are served at /ext/metrics.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/api/metrics"
+	"github.com/ava-labs/avalanchego/database/memdb"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow"
+	"github.com/ava-labs/avalanchego/snow/consensus/snowman"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/utils/constants"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/logging"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+)
+
+// chainID is the ID of the dev chain. It's fixed so that signatures made for
+// one run of the dev chain are valid on the next.
+var chainID = ids.ID(hashing.ComputeHash256Array([]byte("timestampvm-dev")))
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("timestampvm-dev", flag.ContinueOnError)
+	addr := flags.String("http-addr", "127.0.0.1:9650", "address the API is served on")
+	chain := flags.String("chain", "timestamp", "alias of the chain in the API's path")
+	genesisFile := flags.String("genesis", "", "genesis file. Defaults to a chain with no genesis data.")
+	configFile := flags.String("config", "", "VM config file")
+	logLevel := flags.String("log-level", "info", "log level")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	genesisBytes := []byte("{}")
+	if *genesisFile != "" {
+		var err error
+		if genesisBytes, err = os.ReadFile(*genesisFile); err != nil {
+			return err
+		}
+	}
+	var configBytes []byte
+	if *configFile != "" {
+		var err error
+		if configBytes, err = os.ReadFile(*configFile); err != nil {
+			return err
+		}
+	}
+	level, err := logging.ToLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	log := logging.NewLogger("", logging.NewWrappedCore(level, os.Stdout, logging.Plain.ConsoleEncoder()))
+
+	nodeID := ids.EmptyNodeID
+	gatherer := metrics.NewPrefixGatherer()
+	snowCtx := &snow.Context{
+		NetworkID:      constants.LocalID,
+		SubnetID:       constants.PrimaryNetworkID,
+		ChainID:        chainID,
+		NodeID:         nodeID,
+		Log:            log,
+		ValidatorState: soleValidator{nodeID: nodeID},
+		Metrics:        gatherer,
+	}
+	vm := &timestampvm.VM{}
+	if err := vm.Initialize(ctx, snowCtx, memdb.New(), genesisBytes, nil, configBytes, nil, nil); err != nil {
+		return fmt.Errorf("couldn't initialize vm: %w", err)
+	}
+	defer func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			log.Error("couldn't shut down vm", zap.Error(err))
+		}
+	}()
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		return err
+	}
+
+	handlers, err := vm.CreateHandlers(ctx)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	for path, handler := range handlers {
+		mux.Handle("/ext/bc/"+*chain+path, handler)
+	}
+	mux.Handle("/ext/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	log.Info("serving dev chain",
+		zap.String("uri", "http://"+*addr+"/ext/bc/"+*chain),
+		zap.Stringer("chainID", chainID),
+	)
+
+	buildCtx, cancelBuild := context.WithCancel(ctx)
+	built := make(chan struct{})
+	go func() {
+		defer close(built)
+		buildBlocks(buildCtx, snowCtx, vm)
+	}()
+
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-serveErr:
+	}
+	cancelBuild()
+	<-built
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return errors.Join(err, server.Shutdown(shutdownCtx))
+}
+
+// buildBlocks builds and accepts a block each time the vm has data to build
+// one with, until [ctx] is cancelled. It stands in for the consensus engine.
+func buildBlocks(ctx context.Context, snowCtx *snow.Context, vm *timestampvm.VM) {
+	for {
+		if _, err := vm.WaitForEvent(ctx); err != nil {
+			return
+		}
+
+		snowCtx.Lock.Lock()
+		blk, err := buildBlock(ctx, vm)
+		snowCtx.Lock.Unlock()
+		if err != nil {
+			snowCtx.Log.Debug("couldn't build block", zap.Error(err))
+			continue
+		}
+		snowCtx.Log.Info("accepted block",
+			zap.Stringer("blkID", blk.ID()),
+			zap.Uint64("height", blk.Height()),
+		)
+	}
+}
+
+// buildBlock builds a block and accepts it
+// Assumes the context lock is held.
+func buildBlock(ctx context.Context, vm *timestampvm.VM) (snowman.Block, error) {
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := blk.Verify(ctx); err != nil {
+		return nil, err
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		return nil, err
+	}
+	return blk, blk.Accept(ctx)
+}
+
+// soleValidator is a validator set with only [nodeID] in it
+type soleValidator struct {
+	nodeID ids.NodeID
+}
+
+func (soleValidator) GetMinimumHeight(context.Context) (uint64, error) { return 0, nil }
+
+func (soleValidator) GetCurrentHeight(context.Context) (uint64, error) { return 0, nil }
+
+func (soleValidator) GetSubnetID(context.Context, ids.ID) (ids.ID, error) {
+	return constants.PrimaryNetworkID, nil
+}
+
+func (soleValidator) GetWarpValidatorSets(context.Context, uint64) (map[ids.ID]validators.WarpSet, error) {
+	return nil, nil
+}
+
+func (soleValidator) GetWarpValidatorSet(context.Context, uint64, ids.ID) (validators.WarpSet, error) {
+	return validators.WarpSet{}, nil
+}
+
+func (v soleValidator) GetValidatorSet(context.Context, uint64, ids.ID) (map[ids.NodeID]*validators.GetValidatorOutput, error) {
+	return map[ids.NodeID]*validators.GetValidatorOutput{
+		v.nodeID: {NodeID: v.nodeID, Weight: 1},
+	}, nil
+}
+
+func (soleValidator) GetCurrentValidatorSet(context.Context, ids.ID) (map[ids.ID]*validators.GetCurrentValidatorOutput, uint64, error) {
+	return nil, 0, nil
+}
@@ -0,0 +1,51 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// timestampvm is the plugin binary that avalanchego runs to serve chains
+// using the timestamp VM.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ava-labs/avalanchego/vms/rpcchainvm"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+)
+
+func main() {
+	// Proposed data is journaled and block decisions are committed
+	// atomically, so on SIGINT/SIGTERM it's enough to stop serving and shut
+	// the VM down, even if the node never asked us to.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	vm := &timestampvm.VM{}
+
+	// SIGHUP reloads the config from the chain's config file
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for range hangups {
+			if _, err := vm.ReloadConfigFile(); err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't reload config: %s\n", err)
+			}
+		}
+	}()
+
+	serveErr := rpcchainvm.Serve(ctx, vm)
+
+	// Shutdown is a no-op if the node already shut the VM down
+	if err := vm.Shutdown(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "couldn't shut down vm: %s\n", err)
+	}
+	if serveErr != nil {
+		fmt.Fprintf(os.Stderr, "rpcchainvm.Serve failed: %s\n", serveErr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,112 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/codec"
+	"github.com/ava-labs/avalanchego/codec/linearcodec"
+	"github.com/ava-labs/avalanchego/codec/reflectcodec"
+	"github.com/ava-labs/avalanchego/utils/units"
+	"github.com/ava-labs/avalanchego/utils/wrappers"
+)
+
+const (
+	// maxCodecSize is the maximum size of a marshaled value, which matches
+	// the limit of the codec manager that unmarshals it. Payloads are at most
+	// [dataLen] bytes, so a block always fits in memory and is decoded from
+	// its bytes rather than streamed.
+	maxCodecSize = 256 * units.KiB
+	// initialBufferSize is the capacity of a new pooled buffer, which fits a
+	// block with a full batch of data
+	initialBufferSize = 16 * units.KiB
+)
+
+var (
+	errUnknownCodecVersion = errors.New("unknown codec version")
+
+	// bufferPool holds buffers that values are marshaled into, so that
+	// marshaling a block doesn't grow a new buffer every time
+	bufferPool = sync.Pool{
+		New: func() any {
+			buf := make([]byte, 0, initialBufferSize)
+			return &buf
+		},
+	}
+)
+
+// withMarshaled marshals [value] with the codec of [version] into a pooled
+// buffer and calls [f] with the bytes. The bytes are only valid until [f]
+// returns.
+func (vm *VM) withMarshaled(version uint16, value any, f func([]byte) error) error {
+	c, ok := vm.codecs[version]
+	if !ok {
+		return errUnknownCodecVersion
+	}
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+
+	p := wrappers.Packer{
+		MaxSize: maxCodecSize,
+		Bytes:   (*buf)[:0],
+	}
+	p.PackShort(version)
+	err := c.MarshalInto(value, &p)
+	// Keep the buffer's capacity if it grew
+	*buf = p.Bytes[:0]
+	if err != nil {
+		return err
+	}
+	return f(p.Bytes)
+}
+
+// marshal returns the bytes of [value] marshaled with the codec of [version].
+// The bytes are marshaled into a pooled buffer and copied out, so only the
+// returned bytes are allocated.
+func (vm *VM) marshal(version uint16, value any) ([]byte, error) {
+	var marshaled []byte
+	err := vm.withMarshaled(version, value, func(b []byte) error {
+		marshaled = slices.Clone(b)
+		return nil
+	})
+	return marshaled, err
+}
+
+// initializeCodecs registers the codecs of each codec version, which are
+// replaced by the codecs set by [WithCodec]
+func (vm *VM) initializeCodecs() error {
+	codecs := map[uint16]codec.Codec{
+		codecVersion:         linearcodec.NewDefault(),
+		signedCodecVersion:   linearcodec.New([]string{reflectcodec.DefaultTagName, signedTagName}),
+		transferCodecVersion: linearcodec.New([]string{reflectcodec.DefaultTagName, signedTagName, transferTagName}),
+
+		namespacedCodecVersion:         linearcodec.New([]string{reflectcodec.DefaultTagName, namespaceTagName}),
+		namespacedSignedCodecVersion:   linearcodec.New([]string{reflectcodec.DefaultTagName, namespaceTagName, signedTagName}),
+		namespacedTransferCodecVersion: linearcodec.New([]string{reflectcodec.DefaultTagName, namespaceTagName, signedTagName, transferTagName}),
+	}
+	maps.Copy(codecs, vm.codecOverrides)
+
+	vm.codecs = make(map[uint16]codec.Codec)
+	manager := codec.NewDefaultManager()
+	for _, version := range slices.Sorted(maps.Keys(codecs)) {
+		if err := vm.registerCodec(manager, version, codecs[version]); err != nil {
+			return err
+		}
+	}
+	vm.codec = manager
+	return nil
+}
+
+// registerCodec registers [c] as the codec of [version]
+func (vm *VM) registerCodec(manager codec.Manager, version uint16, c codec.Codec) error {
+	if err := manager.RegisterCodec(version, c); err != nil {
+		return err
+	}
+	vm.codecs[version] = c
+	return nil
+}
@@ -0,0 +1,371 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/trace"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// ArchivePruningMode keeps every block the VM has seen, including rejected ones
+	ArchivePruningMode = "archive"
+	// RejectedPruningMode deletes blocks from the database once they are rejected
+	RejectedPruningMode = "rejected"
+
+	defaultMempoolSize      = 1024
+	defaultBlockCacheSize   = 1024
+	defaultBuildBatchWindow = 500 * time.Millisecond
+	defaultBuildTimeout     = 10 * time.Second
+	defaultMaxBatchBytes    = 1 << 20
+)
+
+var (
+	errBadMempoolSize    = errors.New("mempool size must be positive")
+	errBadMaxPayloadSize = fmt.Errorf("max payload size must be in [1, %d]", dataLen)
+	errBadPruningMode    = errors.New("unknown pruning mode")
+	errBadBatchWindow    = errors.New("build batch window must not be negative")
+	errBadCheckpoint     = errors.New("checkpoint must have a non-zero height and block ID")
+	errBadBuildBackoff   = errors.New("build backoff must not be negative")
+	errBadBuildTimeout   = errors.New("build timeout must not be negative")
+	errBadBlockCacheSize = errors.New("block cache size must not be negative")
+	errBadAncestorsLimit = errors.New("ancestors limits must not be negative")
+	errBadMaxBatchBytes  = errors.New("max batch bytes must be positive")
+	errDuplicateProposer = errors.New("duplicate allowed proposer")
+)
+
+// Duration is a time.Duration that is encoded in JSON as a string such as
+// "500ms" or "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Checkpoint is a trusted accepted block. A new node that is given a
+// checkpoint starts from that block instead of fetching every block since
+// genesis.
+type Checkpoint struct {
+	Height  uint64 `json:"height"`
+	BlockID ids.ID `json:"blockID"`
+}
+
+// Verify returns nil iff [c] is a valid checkpoint
+func (c *Checkpoint) Verify() error {
+	if c.Height == 0 || c.BlockID == ids.Empty {
+		return errBadCheckpoint
+	}
+	return nil
+}
+
+// Config is the per-chain configuration of the VM.
+// It is passed to Initialize as JSON in the configBytes.
+type Config struct {
+	// Maximum number of proposals waiting to be put into a block
+	MempoolSize int `json:"mempoolSize"`
+	// Maximum number of bytes a proposal's data may decode to
+	MaxPayloadSize int `json:"maxPayloadSize"`
+	// One of [ArchivePruningMode] or [RejectedPruningMode]
+	PruningMode string `json:"pruningMode"`
+	// Number of decided blocks, and of heights of accepted blocks, kept in
+	// memory. The most recently accepted blocks are loaded when the VM starts.
+	// Zero disables the caches.
+	BlockCacheSize int `json:"blockCacheSize"`
+	// If false, the VM doesn't serve its JSON-RPC API
+	APIEnabled bool `json:"apiEnabled"`
+	// Max number of bytes in the body of a request to the JSON-RPC API,
+	// including batch requests. Larger requests are refused unread.
+	MaxBatchBytes int `json:"maxBatchBytes"`
+	// If true, the chain serves a page at the "/ui" API path that lists
+	// recent blocks and decodes their data, using the JSON-RPC API
+	ExplorerUI bool `json:"explorerUI"`
+	// How long the VM waits after a proposal arrives at an empty mempool
+	// before asking the engine to build a block, so that proposals arriving
+	// close together are put into one block
+	BuildBatchWindow Duration `json:"buildBatchWindow"`
+	// If true, when wrapped by the ProposerVM the VM only builds blocks during
+	// this node's proposer slot
+	ProposerWindowBuilding bool `json:"proposerWindowBuilding"`
+	// If non-empty, this node only builds blocks if its node ID is one of
+	// these, so that operators can share one config among their nodes. It's
+	// a local policy: blocks built by any node are valid.
+	AllowedProposers []ids.NodeID `json:"allowedProposers"`
+	// If positive, this node waits a random delay before building a block on
+	// a new preferred block, so that block production is spread across the
+	// validators in proportion to their stake. The first validator to build
+	// waits this long on average. Zero disables the backoff.
+	BuildBackoff Duration `json:"buildBackoff"`
+	// If positive, the VM gives up on building a block that takes longer
+	// than this, such as when the remote signer doesn't answer, and puts its
+	// data back into the mempool for the next block. Zero disables the
+	// deadline.
+	BuildTimeout Duration `json:"buildTimeout"`
+	// If set and this node hasn't accepted a block at the checkpoint's height,
+	// the node state syncs to the checkpoint block and only fetches the
+	// blocks after it. Blocks before the checkpoint are never fetched, so
+	// chains whose rules or state depend on them can't have a checkpoint:
+	// chains with signed blocks, a median time past window, duplicate
+	// rejection, namespaces or key-value or document payloads.
+	Checkpoint *Checkpoint `json:"checkpoint"`
+	// If positive, at most this many blocks are sent in one response to a
+	// bootstrapping peer, even if the peer's request allows more. Zero
+	// leaves the limit to the engine.
+	MaxAncestorsBlocks int `json:"maxAncestorsBlocks"`
+	// If positive, the blocks sent in one response to a bootstrapping peer
+	// hold at most this many bytes, so that chains with large blocks stay
+	// under the network's message size. The requested block is always sent.
+	// Zero leaves the limit to the engine.
+	MaxAncestorsBytes int `json:"maxAncestorsBytes"`
+	// Key this node signs the blocks it builds with, on chains whose blocks
+	// must be signed by an allowed signer or that charge fees. On chains with
+	// fees, the key's address pays the fees of the blocks this node builds.
+	SigningKey *secp256k1.PrivateKey `json:"signingKey"`
+	// If set, this node's blocks are signed by a signer that holds its key
+	// outside the node instead of with [SigningKey]
+	RemoteSigner *RemoteSignerConfig `json:"remoteSigner"`
+	// If set, the chain serves profiles of the node's process at the "/pprof"
+	// API path to requests with the header "Authorization: Bearer <token>".
+	// Profiles expose the whole process, so the token should be kept secret.
+	ProfilerToken string `json:"profilerToken"`
+	// If set, the chain serves its admin API at the "/admin" API path to
+	// requests with the header "Authorization: Bearer <token>". The admin
+	// API changes how this node runs, so the token should be kept secret.
+	AdminToken string `json:"adminToken"`
+	// If set, the config is read from this file again when it's reloaded
+	// without a new config, such as when the plugin binary receives SIGHUP.
+	// It's usually the chain's config file.
+	ConfigFile string `json:"configFile"`
+	// If set, spans of block building, verification, acceptance and
+	// rejection, and of API requests, are exported over OTLP
+	Tracing *trace.Config `json:"tracing"`
+	// Level that blocks being built, verified, accepted and rejected are
+	// logged at, such as "info". "off" disables these logs.
+	BlockLogLevel logging.Level `json:"blockLogLevel"`
+	// If set, the VM POSTs a signed payload to each webhook URL for every
+	// block accepted after the node has bootstrapped
+	Webhooks *WebhookConfig `json:"webhooks"`
+	// If set, the VM publishes an event to Kafka or NATS for every block
+	// accepted after the node has bootstrapped
+	Publisher *PublisherConfig `json:"publisher"`
+	// If true, the API anchors IPFS content: the digest of a CID is proposed
+	// and the CID is recorded, with its content type, in an index on this
+	// node
+	IPFSAnchoring bool `json:"ipfsAnchoring"`
+	// If true, the API timestamps references to content stored off the
+	// chain: the hash of the reference is proposed and the reference's
+	// locator, content hash and size are recorded in an index on this node
+	DataReferences bool `json:"dataReferences"`
+	// If set, the chain serves an RFC 3161 time-stamp authority at the
+	// "/tsa" API path, which signs time-stamp tokens of accepted data with
+	// an operator certificate
+	TSA *TSAConfig `json:"tsa"`
+	// If set, the API aggregates submitted hashes into Merkle trees and
+	// proposes only the root of each interval's tree. The path of each hash
+	// to its root is recorded in an index on this node.
+	Aggregation *AggregationConfig `json:"aggregation"`
+	// If true, this node signs each block it accepts with its BLS key,
+	// gossips the signature to the chain's validators and aggregates the
+	// signatures it receives into a Warp message, which is served by
+	// GetBlockAttestation. The aggregates are recorded in an index on this
+	// node.
+	Attestations bool `json:"attestations"`
+	// If set, this node compacts the data in its namespace index according
+	// to each namespace's retention policy. Blocks keep their data. Requires
+	// a chain with namespaces.
+	Retention *RetentionConfig `json:"retention"`
+	// If set, each call to a write API method is recorded in an audit log on
+	// this node, which is served by GetAuditLog
+	Audit *AuditConfig `json:"audit"`
+	// If set, this node runs a sandboxed WASM module on each piece of
+	// accepted data. The module's results, events and derived index are
+	// recorded on this node and served by GetHookResults and GetHookIndex.
+	Hooks *HookConfig `json:"hooks"`
+	// If set, every proposal to this node's API must pass these validators.
+	// They're a local admission policy: blocks are only checked against the
+	// chain's payload validators, in its genesis and upgrades.
+	PayloadValidation *PayloadValidationConfig `json:"payloadValidation"`
+}
+
+// DefaultConfig returns the config used when no configBytes are given
+func DefaultConfig() Config {
+	return Config{
+		MempoolSize:    defaultMempoolSize,
+		MaxPayloadSize: dataLen,
+		PruningMode:    ArchivePruningMode,
+		BlockCacheSize: defaultBlockCacheSize,
+		APIEnabled:     true,
+		MaxBatchBytes:  defaultMaxBatchBytes,
+		BlockLogLevel:  logging.Debug,
+		BuildBatchWindow: Duration{
+			Duration: defaultBuildBatchWindow,
+		},
+		BuildTimeout: Duration{
+			Duration: defaultBuildTimeout,
+		},
+	}
+}
+
+// ParseConfig parses [configBytes] on top of the default config.
+// Unknown fields are an error so that typos don't silently fall back to
+// the defaults.
+func ParseConfig(configBytes []byte) (Config, error) {
+	config := DefaultConfig()
+	if len(bytes.TrimSpace(configBytes)) == 0 {
+		return config, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(configBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("couldn't parse config: %w", err)
+	}
+	return config, config.Verify()
+}
+
+// withoutSecrets returns [c] without its keys, tokens and secrets, which are
+// left empty
+func (c Config) withoutSecrets() Config {
+	c.SigningKey = nil
+	c.ProfilerToken = ""
+	c.AdminToken = ""
+	if c.RemoteSigner != nil {
+		remoteSigner := *c.RemoteSigner
+		remoteSigner.Token = ""
+		c.RemoteSigner = &remoteSigner
+	}
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		tracing.Headers = nil
+		c.Tracing = &tracing
+	}
+	if c.Webhooks != nil {
+		webhooks := *c.Webhooks
+		webhooks.Secret = ""
+		c.Webhooks = &webhooks
+	}
+	return c
+}
+
+// isAllowedProposer returns true iff [c] lets the node [nodeID] build blocks
+func (c *Config) isAllowedProposer(nodeID ids.NodeID) bool {
+	if len(c.AllowedProposers) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowedProposers {
+		if allowed == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify returns nil iff [c] is a valid config
+func (c *Config) Verify() error {
+	switch {
+	case c.MempoolSize <= 0:
+		return errBadMempoolSize
+	case c.MaxPayloadSize <= 0 || c.MaxPayloadSize > dataLen:
+		return errBadMaxPayloadSize
+	case c.BuildBatchWindow.Duration < 0:
+		return errBadBatchWindow
+	case c.BuildBackoff.Duration < 0:
+		return errBadBuildBackoff
+	case c.BuildTimeout.Duration < 0:
+		return errBadBuildTimeout
+	case c.BlockCacheSize < 0:
+		return errBadBlockCacheSize
+	case c.MaxAncestorsBlocks < 0 || c.MaxAncestorsBytes < 0:
+		return errBadAncestorsLimit
+	case c.MaxBatchBytes <= 0:
+		return errBadMaxBatchBytes
+	}
+	proposers := set.NewSet[ids.NodeID](len(c.AllowedProposers))
+	for _, nodeID := range c.AllowedProposers {
+		if proposers.Contains(nodeID) {
+			return fmt.Errorf("%w: %s", errDuplicateProposer, nodeID)
+		}
+		proposers.Add(nodeID)
+	}
+	if c.Checkpoint != nil {
+		if err := c.Checkpoint.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.RemoteSigner != nil {
+		if c.SigningKey != nil {
+			return errMultipleSigners
+		}
+		if err := c.RemoteSigner.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.Webhooks != nil {
+		if err := c.Webhooks.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.Publisher != nil {
+		if err := c.Publisher.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.TSA != nil {
+		if err := c.TSA.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.Aggregation != nil {
+		if err := c.Aggregation.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.Retention != nil {
+		if err := c.Retention.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.Hooks != nil {
+		if err := c.Hooks.Verify(); err != nil {
+			return err
+		}
+	}
+	if c.PayloadValidation != nil {
+		if err := c.PayloadValidation.Verify(); err != nil {
+			return err
+		}
+	}
+
+	switch c.PruningMode {
+	case ArchivePruningMode, RejectedPruningMode:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", errBadPruningMode, c.PruningMode)
+	}
+}
@@ -0,0 +1,152 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		configBytes string
+		expected    Config
+		expectedErr error
+	}{
+		{
+			name:     "empty",
+			expected: DefaultConfig(),
+		},
+		{
+			name:        "overrides",
+			configBytes: `{"mempoolSize": 10, "maxPayloadSize": 8, "pruningMode": "rejected", "blockCacheSize": 0, "apiEnabled": false, "buildBatchWindow": "1s", "buildTimeout": "2s", "maxBatchBytes": 100, "blockLogLevel": "info"}`,
+			expected: Config{
+				MempoolSize:      10,
+				MaxPayloadSize:   8,
+				PruningMode:      RejectedPruningMode,
+				BlockCacheSize:   0,
+				APIEnabled:       false,
+				MaxBatchBytes:    100,
+				BuildBatchWindow: Duration{Duration: time.Second},
+				BuildTimeout:     Duration{Duration: 2 * time.Second},
+				BlockLogLevel:    logging.Info,
+			},
+		},
+		{
+			name:        "bad mempool size",
+			configBytes: `{"mempoolSize": 0}`,
+			expectedErr: errBadMempoolSize,
+		},
+		{
+			name:        "payload too large",
+			configBytes: `{"maxPayloadSize": 33}`,
+			expectedErr: errBadMaxPayloadSize,
+		},
+		{
+			name:        "negative batch window",
+			configBytes: `{"buildBatchWindow": "-1s"}`,
+			expectedErr: errBadBatchWindow,
+		},
+		{
+			name:        "negative build backoff",
+			configBytes: `{"buildBackoff": "-1s"}`,
+			expectedErr: errBadBuildBackoff,
+		},
+		{
+			name:        "negative build timeout",
+			configBytes: `{"buildTimeout": "-1s"}`,
+			expectedErr: errBadBuildTimeout,
+		},
+		{
+			name:        "negative block cache size",
+			configBytes: `{"blockCacheSize": -1}`,
+			expectedErr: errBadBlockCacheSize,
+		},
+		{
+			name:        "negative ancestors limit",
+			configBytes: `{"maxAncestorsBytes": -1}`,
+			expectedErr: errBadAncestorsLimit,
+		},
+		{
+			name:        "zero max batch bytes",
+			configBytes: `{"maxBatchBytes": 0}`,
+			expectedErr: errBadMaxBatchBytes,
+		},
+		{
+			name:        "duplicate allowed proposer",
+			configBytes: `{"allowedProposers": ["NodeID-111111111111111111116DBWJs", "NodeID-111111111111111111116DBWJs"]}`,
+			expectedErr: errDuplicateProposer,
+		},
+		{
+			name:        "empty checkpoint",
+			configBytes: `{"checkpoint": {"height": 0}}`,
+			expectedErr: errBadCheckpoint,
+		},
+		{
+			name:        "bad block log level",
+			configBytes: `{"blockLogLevel": "loud"}`,
+			expectedErr: logging.ErrUnknownLevel,
+		},
+		{
+			name:        "webhooks without a secret",
+			configBytes: `{"webhooks": {"urls": ["http://127.0.0.1:8080"]}}`,
+			expectedErr: errNoWebhookSecret,
+		},
+		{
+			name:        "bad webhook URL",
+			configBytes: `{"webhooks": {"urls": ["127.0.0.1:8080"], "secret": "secret"}}`,
+			expectedErr: errBadWebhookURL,
+		},
+		{
+			name:        "hook gas limit too large",
+			configBytes: `{"hooks": {"module": "hook.wasm", "gasLimit": 9223372036854775808}}`,
+			expectedErr: errBadHookGas,
+		},
+		{
+			name:        "remote signer without an address",
+			configBytes: `{"remoteSigner": {"url": "https://kms.example.com/sign"}}`,
+			expectedErr: errBadRemoteSigner,
+		},
+		{
+			name:        "bad publisher type",
+			configBytes: `{"publisher": {"type": "mqtt", "addrs": ["127.0.0.1:1883"], "topic": "blocks"}}`,
+			expectedErr: errBadPublisherType,
+		},
+		{
+			name:        "hash-only retention without days",
+			configBytes: `{"retention": {"namespaces": [{"namespace": "a", "mode": "hashOnly"}]}}`,
+			expectedErr: errBadRetentionDays,
+		},
+		{
+			name:        "unknown payload validator",
+			configBytes: `{"payloadValidation": {"validators": [{"type": "checksum"}]}}`,
+			expectedErr: errUnknownValidator,
+		},
+		{
+			name:        "bad pruning mode",
+			configBytes: `{"pruningMode": "everything"}`,
+			expectedErr: errBadPruningMode,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ParseConfig([]byte(test.configBytes))
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v but got %v", test.expectedErr, err)
+			}
+			if test.expectedErr == nil && !reflect.DeepEqual(config, test.expected) {
+				t.Fatalf("expected config %+v but got %+v", test.expected, config)
+			}
+		})
+	}
+
+	if _, err := ParseConfig([]byte(`{"mempoolSise": 10}`)); err == nil {
+		t.Fatal("expected unknown field to be rejected")
+	}
+}
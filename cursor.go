@@ -0,0 +1,96 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+// cursorVersion is the version of the encoding of cursors. Cursors of other
+// versions are rejected.
+const cursorVersion = 0
+
+// cursorLen is the length of an encoded cursor: its version, list, direction,
+// position and index
+const cursorLen = 1 + 1 + 1 + 8 + 2
+
+var errBadCursor = errors.New("must be a cursor returned by the same method")
+
+// cursorList is the list API method a cursor pages through
+type cursorList byte
+
+const (
+	blocksCursor cursorList = iota + 1
+	headersCursor
+	namespaceDataCursor
+	feedHistoryCursor
+	accountHistoryCursor
+	auditLogCursor
+	indexerFeedCursor
+	kvHistoryCursor
+	documentHistoryCursor
+	submittersCursor
+	namespacesCursor
+	anchorsCursor
+)
+
+// cursorDirection is the order in which a list is paged through
+type cursorDirection byte
+
+const (
+	// forward pages through a list oldest first
+	forward cursorDirection = iota + 1
+	// backward pages through a list newest first
+	backward
+)
+
+// pageCursor is where a page of a list API method's results starts. Clients
+// get it as the opaque nextCursor of the previous page. It only holds the
+// position in the list, so it stays valid when the node restarts.
+type pageCursor struct {
+	list      cursorList
+	direction cursorDirection
+	// Height of the first block of the page, or for lists that aren't
+	// ordered by height, the key they are ordered by: the update's time, the
+	// submission's nonce or the record's index. For lists whose keys don't
+	// fit, and for document histories, whose versions are numbered, it's the
+	// number of results before the page.
+	position uint64
+	// Index of the first result among those at [position]
+	index uint16
+}
+
+// at returns the cursor of the same list and direction at [position]
+func (c pageCursor) at(position uint64) pageCursor {
+	c.position = position
+	c.index = 0
+	return c
+}
+
+// String returns the URL safe base 64 repr. of the cursor
+func (c pageCursor) String() string {
+	b := make([]byte, cursorLen)
+	b[0] = cursorVersion
+	b[1] = byte(c.list)
+	b[2] = byte(c.direction)
+	binary.BigEndian.PutUint64(b[3:], c.position)
+	binary.BigEndian.PutUint16(b[11:], c.index)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor returns the cursor whose repr. is [s]
+func parseCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != cursorLen || b[0] != cursorVersion {
+		return pageCursor{}, errBadCursor
+	}
+	return pageCursor{
+		list:      cursorList(b[1]),
+		direction: cursorDirection(b[2]),
+		position:  binary.BigEndian.Uint64(b[3:]),
+		index:     binary.BigEndian.Uint16(b[11:]),
+	}, nil
+}
@@ -0,0 +1,295 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	contentHashPrefix = "sha256:"
+	maxLocatorLen     = 2048
+
+	// Referenced content is only fetched if it's at most this large
+	maxFetchSize          = 64 << 20
+	referenceFetchTimeout = 30 * time.Second
+)
+
+var (
+	referencePrefix = []byte("reference")
+
+	errReferencesDisabled = errors.New("data references aren't enabled on this node")
+	errBadLocator         = fmt.Errorf("locator must be a URL of at most %d bytes", maxLocatorLen)
+	errBadContentHash     = errors.New(`content hash must be "sha256:" followed by 64 lowercase hex digits`)
+	errNoSuchReference    = errors.New("data isn't a reference recorded by this node")
+	errBadReference       = errors.New("reference in the index is malformed")
+	errUnfetchableLocator = errors.New("only http and https locators can be fetched")
+	errReferenceTooLarge  = fmt.Errorf("referenced content is larger than the %d bytes that are fetched", maxFetchSize)
+	errFetchFailed        = errors.New("couldn't fetch referenced content")
+	errReferenceMismatch  = errors.New("fetched content doesn't match the reference")
+	errReferenceSize      = errors.New("fetched content isn't the referenced size")
+)
+
+// dataReference points to content stored off the chain. Only the reference's
+// digest is put on the chain; the reference itself is only known to this
+// node.
+type dataReference struct {
+	// URL or other storage locator of the content
+	locator string
+	// SHA-256 hash of the content
+	hash [sha256.Size]byte
+	// Size of the content in bytes
+	size uint64
+}
+
+// parseReference returns the reference to the content of [size] bytes at
+// [locator] with the content hash [contentHash]
+func parseReference(locator, contentHash string, size uint64) (dataReference, error) {
+	if len(locator) == 0 || len(locator) > maxLocatorLen {
+		return dataReference{}, errBadLocator
+	}
+	if u, err := url.Parse(locator); err != nil || u.Scheme == "" {
+		return dataReference{}, errBadLocator
+	}
+	r := dataReference{
+		locator: locator,
+		size:    size,
+	}
+	encoded, ok := strings.CutPrefix(contentHash, contentHashPrefix)
+	if !ok || len(encoded) != hex.EncodedLen(sha256.Size) || strings.ToLower(encoded) != encoded {
+		return dataReference{}, errBadContentHash
+	}
+	if _, err := hex.Decode(r.hash[:], []byte(encoded)); err != nil {
+		return dataReference{}, errBadContentHash
+	}
+	return r, nil
+}
+
+func parseReferenceBytes(b []byte) (dataReference, error) {
+	if len(b) < sha256.Size+8 {
+		return dataReference{}, errBadReference
+	}
+	r := dataReference{
+		size:    binary.BigEndian.Uint64(b[sha256.Size:]),
+		locator: string(b[sha256.Size+8:]),
+	}
+	copy(r.hash[:], b)
+	return r, nil
+}
+
+func (r dataReference) bytes() []byte {
+	b := make([]byte, 0, sha256.Size+8+len(r.locator))
+	b = append(b, r.hash[:]...)
+	b = binary.BigEndian.AppendUint64(b, r.size)
+	return append(b, r.locator...)
+}
+
+// data returns the piece of data that timestamps [r] on the chain, which is
+// the hash of the whole reference
+func (r dataReference) data() [dataLen]byte {
+	return sha256.Sum256(r.bytes())
+}
+
+func (r dataReference) contentHash() string {
+	return contentHashPrefix + hex.EncodeToString(r.hash[:])
+}
+
+// verifyContent fetches the content [r] refers to and returns nil iff it has
+// the referenced size and hash
+func (r dataReference) verifyContent(ctx context.Context) error {
+	u, err := url.Parse(r.locator)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errUnfetchableLocator
+	}
+	if r.size > maxFetchSize {
+		return errReferenceTooLarge
+	}
+	ctx, cancel := context.WithTimeout(ctx, referenceFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.locator, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errFetchFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", errFetchFailed, resp.Status)
+	}
+
+	// Read one byte more than the size so that longer content is caught
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, io.LimitReader(resp.Body, int64(r.size)+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errFetchFailed, err)
+	}
+	if uint64(n) != r.size {
+		return errReferenceSize
+	}
+	if !bytes.Equal(hasher.Sum(nil), r.hash[:]) {
+		return errReferenceMismatch
+	}
+	return nil
+}
+
+func (vm *VM) referencesEnabled() bool {
+	return vm.config.Load().DataReferences
+}
+
+// putReference records [r] in this node's reference index. The index isn't
+// part of the chain's state, so it's written to the database immediately.
+func (vm *VM) putReference(r dataReference) error {
+	data := r.data()
+	return vm.referenceDB.Put(data[:], r.bytes())
+}
+
+func (vm *VM) reference(data [dataLen]byte) (dataReference, error) {
+	b, err := vm.referenceDB.Get(data[:])
+	if err != nil {
+		return dataReference{}, err
+	}
+	return parseReferenceBytes(b)
+}
+
+// ProposeReferenceArgs are the arguments to ProposeReference
+type ProposeReferenceArgs struct {
+	// URL or other storage locator of the content
+	Locator string `json:"locator"`
+	// "sha256:" followed by the hex encoded SHA-256 hash of the content
+	ContentHash string `json:"contentHash"`
+	// Size of the content in bytes
+	Size json.Uint64 `json:"size"`
+
+	ref dataReference
+}
+
+func (a *ProposeReferenceArgs) validate(v *argValidator) {
+	var err error
+	a.ref, err = parseReference(a.Locator, a.ContentHash, uint64(a.Size))
+	if err == errBadLocator {
+		v.add("locator", err)
+	} else {
+		v.add("contentHash", err)
+	}
+}
+
+// ProposeReferenceReply is the reply from ProposeReference
+type ProposeReferenceReply struct {
+	// Base 58 repr. of the data that was proposed, which is the hash of the
+	// reference
+	Data string `json:"data"`
+}
+
+// ProposeReference proposes the hash of a reference to content stored off
+// the chain and records the reference in this node's reference index. Only
+// the hash is put on the chain.
+func (s *Service) ProposeReference(_ *http.Request, args *ProposeReferenceArgs, reply *ProposeReferenceReply) error {
+	if !s.backend.referencesEnabled() {
+		return errReferencesDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	r := args.ref
+	data := r.data()
+	if err := s.backend.verifyProposal(data[:], [NamespaceLen]byte{}); err != nil {
+		return err
+	}
+	if err := s.backend.proposeBlock(data); err != nil {
+		return err
+	}
+	if err := s.backend.putReference(r); err != nil {
+		return err
+	}
+	reply.Data = encoding.EncodeCB58(data[:])
+	return nil
+}
+
+// GetReferenceArgs are the arguments to GetReference
+type GetReferenceArgs struct {
+	// Base 58 repr. of the reference's data
+	Data string `json:"data"`
+	// If true, the referenced content is fetched and checked against the
+	// reference. Only http and https locators can be fetched.
+	Verify bool `json:"verify"`
+
+	data [dataLen]byte
+}
+
+func (a *GetReferenceArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+}
+
+// GetReferenceReply is the reply from GetReference
+type GetReferenceReply struct {
+	Locator     string      `json:"locator"`
+	ContentHash string      `json:"contentHash"`
+	Size        json.Uint64 `json:"size"`
+	// ID of the accepted block that contains the reference's data. Empty if
+	// the data isn't accepted yet.
+	BlockID string `json:"blockID"`
+	// True iff the content was fetched and matches the reference
+	Verified bool `json:"verified"`
+}
+
+// GetReference returns the reference recorded by this node whose hash is
+// [args.Data]. If [args.Verify], it's an error if the referenced content
+// can't be fetched or doesn't match the reference.
+func (s *Service) GetReference(req *http.Request, args *GetReferenceArgs, reply *GetReferenceReply) error {
+	if !s.backend.referencesEnabled() {
+		return errReferencesDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	data := args.data
+	r, err := s.backend.reference(data)
+	if err == database.ErrNotFound {
+		return errNoSuchReference
+	}
+	if err != nil {
+		return err
+	}
+	reply.Locator = r.locator
+	reply.ContentHash = r.contentHash()
+	reply.Size = json.Uint64(r.size)
+	blkID, err := s.backend.dataBlock(requestContext(req), data)
+	switch err {
+	case nil:
+		reply.BlockID = blkID.String()
+	case database.ErrNotFound:
+	default:
+		return err
+	}
+	if !args.Verify {
+		return nil
+	}
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	if err := r.verifyContent(ctx); err != nil {
+		return err
+	}
+	reply.Verified = true
+	return nil
+}
@@ -0,0 +1,216 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// DocIDLen is the max number of bytes in a document's ID
+	DocIDLen = 12
+	// DocDigestLen is the number of bytes of a document version's digest
+	DocDigestLen = dataLen - DocIDLen
+
+	docHistoryKeyLen = DocIDLen + 8 + 2
+
+	defaultDocumentPageSize = 25
+	maxDocumentPageSize     = 100
+)
+
+var (
+	errBadDocID        = fmt.Errorf("document ID must be 1 to %d bytes without zero bytes", DocIDLen)
+	errBadDocVersion   = errors.New("data must be a version of a document")
+	errDocsDisabled    = fmt.Errorf("chain doesn't have the %s payload rule", DocumentPayloadRule)
+	errNoSuchDocument  = errors.New("document has no accepted versions")
+	errDocumentPayload = fmt.Errorf("%s rule requires a max payload size of %d", DocumentPayloadRule, dataLen)
+)
+
+// docVersion is a version of a document, encoded in one piece of data as
+//
+//	document ID (12 bytes) | digest (20 bytes)
+//
+// where the document ID is zero-padded. Successive versions with the same
+// document ID form the document's history.
+type docVersion struct {
+	docID  [DocIDLen]byte
+	digest [DocDigestLen]byte
+}
+
+// parseDocVersion returns the document version that [data] encodes
+func parseDocVersion(data [dataLen]byte) (docVersion, error) {
+	var v docVersion
+	copy(v.docID[:], data[:DocIDLen])
+	copy(v.digest[:], data[DocIDLen:])
+	if !isZeroPadded(v.docID[:]) {
+		return docVersion{}, errBadDocVersion
+	}
+	return v, nil
+}
+
+// data returns the piece of data that encodes [v]
+func (v docVersion) data() [dataLen]byte {
+	var data [dataLen]byte
+	copy(data[:], v.docID[:])
+	copy(data[DocIDLen:], v.digest[:])
+	return data
+}
+
+// parseDocID returns the zero-padded form of [docID]
+func parseDocID(docID string) ([DocIDLen]byte, error) {
+	var padded [DocIDLen]byte
+	if len(docID) == 0 || len(docID) > DocIDLen || bytes.IndexByte([]byte(docID), 0) != -1 {
+		return padded, errBadDocID
+	}
+	copy(padded[:], docID)
+	return padded, nil
+}
+
+// EncodeDocumentVersion returns the piece of data that records [content] as
+// the next version of the document [docID]. The version's digest is the
+// first [DocDigestLen] bytes of the SHA-256 hash of [content].
+func EncodeDocumentVersion(docID string, content []byte) ([dataLen]byte, error) {
+	padded, err := parseDocID(docID)
+	if err != nil {
+		return [dataLen]byte{}, err
+	}
+	hash := sha256.Sum256(content)
+	v := docVersion{docID: padded}
+	copy(v.digest[:], hash[:])
+	return v.data(), nil
+}
+
+// docHistoryEntry is a version of a document and the height of its block
+type docHistoryEntry struct {
+	version docVersion
+	height  uint64
+}
+
+// docHistoryKey is the key of the [index]th piece of data of the block at
+// [height], which is a version of [docID], in the document index. Keys sort
+// by document, then in the order the versions were accepted.
+func docHistoryKey(docID [DocIDLen]byte, height uint64, index int) []byte {
+	b := make([]byte, docHistoryKeyLen)
+	copy(b, docID[:])
+	binary.BigEndian.PutUint64(b[DocIDLen:], height)
+	binary.BigEndian.PutUint16(b[DocIDLen+8:], uint16(index))
+	return b
+}
+
+// indexDocuments adds [b]'s data to the document index if [b] follows the
+// document payload rule
+func (b *Block) indexDocuments() error {
+	if !hasPayloadRule(b.vm.payloadRules(b.Height(), b.Timestamp()), DocumentPayloadRule) {
+		return nil
+	}
+	for i, d := range b.Dt {
+		v, err := parseDocVersion(d)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.putDocVersion(v, b.Height(), i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) docsEnabled() bool {
+	return hasPayloadRule(vm.genesis.Params.PayloadRules, DocumentPayloadRule) ||
+		(vm.upgrades.PayloadPolicy != nil && hasPayloadRule(vm.upgrades.PayloadPolicy.Rules, DocumentPayloadRule))
+}
+
+func (vm *VM) documentHistory(ctx context.Context, docID [DocIDLen]byte, start uint64, limit int) ([]docHistoryEntry, error) {
+	if !vm.docsEnabled() {
+		return nil, errDocsDisabled
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getDocHistory(ctx, docID, start, limit)
+}
+
+// GetDocumentHistoryArgs are the arguments to GetDocumentHistory
+type GetDocumentHistoryArgs struct {
+	DocID string `json:"docID"`
+	// Max number of versions to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the versions start where the previous page's nextCursor says,
+	// instead of at the first one
+	Cursor string `json:"cursor"`
+
+	docID [DocIDLen]byte
+	limit int
+	start pageCursor
+}
+
+func (a *GetDocumentHistoryArgs) validate(v *argValidator) {
+	var err error
+	a.docID, err = parseDocID(a.DocID)
+	v.add("docID", err)
+	a.limit = v.limit("limit", uint64(a.Limit), defaultDocumentPageSize, maxDocumentPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: documentHistoryCursor, direction: forward})
+}
+
+// APIDocumentVersion is an accepted version of a document
+type APIDocumentVersion struct {
+	// Number of the version. The first version is 1.
+	Version json.Uint64 `json:"version"`
+	// Base 58 repr. of the version's data, which includes the document ID
+	Data string `json:"data"`
+	// Base 58 repr. of the version's digest
+	Digest string `json:"digest"`
+	// Height of the accepted block that contains the version
+	Height json.Uint64 `json:"height"`
+}
+
+// GetDocumentHistoryReply is the reply from GetDocumentHistory
+type GetDocumentHistoryReply struct {
+	Versions []APIDocumentVersion `json:"versions"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetDocumentHistory returns the accepted versions of [args.DocID], oldest
+// first
+func (s *Service) GetDocumentHistory(r *http.Request, args *GetDocumentHistoryArgs, reply *GetDocumentHistoryReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	history, err := s.backend.documentHistory(ctx, args.docID, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 && args.start.position == 0 {
+		return errNoSuchDocument
+	}
+	if len(history) > args.limit {
+		reply.NextCursor = args.start.at(args.start.position + uint64(args.limit)).String()
+		history = history[:args.limit]
+	}
+	reply.Versions = make([]APIDocumentVersion, len(history))
+	for i, entry := range history {
+		data := entry.version.data()
+		encodedData := encoding.EncodeCB58(data[:])
+		digest := encoding.EncodeCB58(entry.version.digest[:])
+		reply.Versions[i] = APIDocumentVersion{
+			Version: json.Uint64(args.start.position + uint64(i) + 1),
+			Data:    encodedData,
+			Digest:  digest,
+			Height:  json.Uint64(entry.height),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// Package encoding encodes the data, hashes and keys that the timestamp VM's
+// API exchanges as strings, so that the VM, its client and its tools agree
+// on formats and checksums. Like the proof package, it doesn't import the VM.
+package encoding
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ava-labs/avalanchego/utils/cb58"
+	"github.com/mr-tron/base58/base58"
+)
+
+const (
+	// CB58 is base 58 followed by a 4 byte checksum, which is how the API
+	// encodes bytes
+	CB58 Format = "cb58"
+	// Hex is hex without a checksum. It's decoded with or without a 0x
+	// prefix.
+	Hex Format = "hex"
+	// Base64 is standard, padded base 64 without a checksum
+	Base64 Format = "base64"
+
+	// ChecksumLen is the length of the checksum that cb58 appends to the
+	// encoded bytes: the end of their SHA-256 hash
+	ChecksumLen = 4
+
+	// maxStackLen is the length of the longest bytes that [EncodeCB58]
+	// checksums without allocating
+	maxStackLen = 64
+)
+
+// ErrUnknownFormat is returned for a format other than those above
+var ErrUnknownFormat = errors.New("unknown encoding")
+
+// Format is how bytes are written as a string
+type Format string
+
+// Encode returns the repr. of [b] in the format. The empty format is [CB58].
+func (f Format) Encode(b []byte) (string, error) {
+	switch f {
+	case CB58, "":
+		return EncodeCB58(b), nil
+	case Hex:
+		return hex.EncodeToString(b), nil
+	case Base64:
+		return base64.StdEncoding.EncodeToString(b), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownFormat, f)
+	}
+}
+
+// Decode returns the bytes whose repr. in the format is [s]. The empty format
+// is [CB58].
+func (f Format) Decode(s string) ([]byte, error) {
+	switch f {
+	case CB58, "":
+		return DecodeCB58(s)
+	case Hex:
+		if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+			s = s[2:]
+		}
+		return hex.DecodeString(s)
+	case Base64:
+		return base64.StdEncoding.DecodeString(s)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, f)
+	}
+}
+
+// EncodeCB58 returns the cb58 repr. of [b]. It's the same string as
+// cb58.Encode([b]), but bytes of at most 64 bytes are checksummed on the
+// stack, so the only allocations are base58's.
+func EncodeCB58(b []byte) string {
+	var buf [maxStackLen + ChecksumLen]byte
+	checked := append(buf[:0], b...)
+	hash := sha256.Sum256(b)
+	checked = append(checked, hash[len(hash)-ChecksumLen:]...)
+	return base58.Encode(checked)
+}
+
+// DecodeCB58 returns the bytes whose cb58 repr. is [s], checking their
+// checksum
+func DecodeCB58(s string) ([]byte, error) {
+	return cb58.Decode(s)
+}
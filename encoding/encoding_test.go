@@ -0,0 +1,53 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/utils/cb58"
+)
+
+func TestEncodeCB58(t *testing.T) {
+	// Bytes longer than [maxStackLen] are encoded the same way
+	for _, n := range []int{0, 1, 32, maxStackLen, maxStackLen + 1, 200} {
+		b := bytes.Repeat([]byte{byte(n)}, n)
+		expected, err := cb58.Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded := EncodeCB58(b); encoded != expected {
+			t.Fatalf("expected %q for %d bytes but got %q", expected, n, encoded)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	b := []byte{0, 1, 0xff}
+	for _, format := range []Format{CB58, Hex, Base64, ""} {
+		encoded, err := format.Encode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := format.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, b) {
+			t.Fatalf("expected %q to round trip but got %x", format, decoded)
+		}
+	}
+
+	if decoded, err := Hex.Decode("0x0001ff"); err != nil || !bytes.Equal(decoded, b) {
+		t.Fatalf("expected the 0x prefix to be ignored but got %x, %v", decoded, err)
+	}
+	if _, err := CB58.Decode("W8BTQxY"); !errors.Is(err, cb58.ErrBadChecksum) {
+		t.Fatalf("expected %s but got %v", cb58.ErrBadChecksum, err)
+	}
+	if _, err := Format("utf8").Decode("hi"); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("expected %s but got %v", ErrUnknownFormat, err)
+	}
+}
@@ -0,0 +1,577 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// EncryptionKeyLen is the length of a recipient's public key, such as
+	// an X25519 key
+	EncryptionKeyLen = 32
+	// MaxCiphertextSize is the max number of bytes of an encrypted payload
+	MaxCiphertextSize = 1024
+
+	encryptedHeaderLen = 8 + ids.ShortIDLen + 8
+)
+
+var (
+	errEncryptionDisabled  = errors.New("chain doesn't have encrypted payloads")
+	errTooManyKeys         = errors.New("block has too many key registrations")
+	errBadKeyVersion       = errors.New("key registration has the wrong version")
+	errTooManyEncrypted    = errors.New("block has too many encrypted payloads")
+	errBadCiphertextSize   = fmt.Errorf("ciphertext must be base 58 repr. of 1 to %d bytes", MaxCiphertextSize)
+	errNoEncryptionKey     = errors.New("recipient has no key of that version")
+	errDuplicateEncrypted  = errors.New("encrypted payload is already accepted")
+	errNoSuchEncrypted     = errors.New("encrypted payload isn't accepted")
+	errBadEncryptionKey    = fmt.Errorf("key must be base 58 repr. of %d bytes", EncryptionKeyLen)
+	errBadEncryptedPayload = fmt.Errorf("encrypted payload must be at least %d bytes", encryptedHeaderLen)
+)
+
+// KeyRegistration makes [Key] the key of version [Version] of the address
+// that signs it. An address's first key is version 1 and each registration
+// must be the next version, so a registration can't be replayed. Payloads
+// are encrypted to one version of a recipient's key.
+type KeyRegistration struct {
+	Key     [EncryptionKeyLen]byte `serialize:"true"`
+	Version uint64                 `serialize:"true"`
+	// Owner's signature of the registration's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	ownerAddr  ids.ShortID // address of this registration's owner, if [ownerKnown]
+	ownerKnown bool
+}
+
+// Hash returns the hash of [r] on the chain [chainID], which is what the
+// key's owner signs
+func (r *KeyRegistration) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+EncryptionKeyLen+8)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, keyRegistrationTag)
+	msg = append(msg, r.Key[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, r.Version)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [r]'s signature to [key]'s signature of [r] on the chain
+// [chainID]. [key]'s address owns the registered key.
+func (r *KeyRegistration) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(r.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(r.Sig[:], sig)
+	r.ownerKnown = false
+	return nil
+}
+
+// owner returns the address that signed [r] on the chain [chainID]
+func (r *KeyRegistration) owner(chainID ids.ID) (ids.ShortID, error) {
+	if r.ownerKnown {
+		return r.ownerAddr, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(r.Hash(chainID), r.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	r.ownerAddr = key.Address()
+	r.ownerKnown = true
+	return r.ownerAddr, nil
+}
+
+// EncryptedPayload is a payload that was encrypted by its submitter to
+// version [KeyVersion] of [Recipient]'s key. The chain only stores it; the
+// ciphertext's scheme is up to the submitter and the recipient.
+type EncryptedPayload struct {
+	Recipient  ids.ShortID `serialize:"true"`
+	KeyVersion uint64      `serialize:"true"`
+	Ciphertext []byte      `serialize:"true"`
+}
+
+// ID returns the hash that identifies [p]
+func (p *EncryptedPayload) ID() [dataLen]byte {
+	msg := make([]byte, 0, ids.ShortIDLen+8+len(p.Ciphertext))
+	msg = append(msg, p.Recipient[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, p.KeyVersion)
+	msg = append(msg, p.Ciphertext...)
+	return sha256.Sum256(msg)
+}
+
+// encryptedEntry is an accepted encrypted payload and the height of its
+// block
+type encryptedEntry struct {
+	payload EncryptedPayload
+	height  uint64
+}
+
+func parseEncryptedEntry(b []byte) (encryptedEntry, error) {
+	if len(b) < encryptedHeaderLen {
+		return encryptedEntry{}, errBadEncryptedPayload
+	}
+	e := encryptedEntry{height: binary.BigEndian.Uint64(b)}
+	copy(e.payload.Recipient[:], b[8:])
+	e.payload.KeyVersion = binary.BigEndian.Uint64(b[8+ids.ShortIDLen:])
+	e.payload.Ciphertext = b[encryptedHeaderLen:]
+	return e, nil
+}
+
+func (e encryptedEntry) bytes() []byte {
+	b := make([]byte, 0, encryptedHeaderLen+len(e.payload.Ciphertext))
+	b = binary.BigEndian.AppendUint64(b, e.height)
+	b = append(b, e.payload.Recipient[:]...)
+	b = binary.BigEndian.AppendUint64(b, e.payload.KeyVersion)
+	return append(b, e.payload.Ciphertext...)
+}
+
+// keyVersionAfter returns the version of [addr]'s latest key after [blk]
+// is accepted. Zero means [addr] has no key.
+func (vm *VM) keyVersionAfter(blk *Block, addr ids.ShortID) (uint64, error) {
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return 0, err
+	}
+	version, err := vm.state.getKeyVersion(addr)
+	if err != nil {
+		return 0, err
+	}
+	for _, ancestor := range processing {
+		for i := range ancestor.KeyRegs {
+			owner, err := ancestor.KeyRegs[i].owner(vm.ctx.ChainID)
+			if err != nil {
+				return 0, err
+			}
+			if owner == addr {
+				version++
+			}
+		}
+	}
+	return version, nil
+}
+
+// encryptedAfter returns true iff the encrypted payload [id] is accepted
+// once [blk] is accepted
+func (vm *VM) encryptedAfter(blk *Block, id [dataLen]byte) (bool, error) {
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return false, err
+	}
+	for _, ancestor := range processing {
+		for i := range ancestor.Encrypted {
+			if ancestor.Encrypted[i].ID() == id {
+				return true, nil
+			}
+		}
+	}
+	return vm.state.hasEncrypted(id)
+}
+
+// verifyKeyRegs returns nil iff each of [b]'s key registrations is the next
+// version of its owner's key after [parent] is accepted
+func (b *Block) verifyKeyRegs(parent *Block) error {
+	switch {
+	case len(b.KeyRegs) == 0:
+		return nil
+	case !b.vm.genesis.Params.Encryption:
+		return errEncryptionDisabled
+	case len(b.KeyRegs) > maxBatchSize:
+		return errTooManyKeys
+	}
+	versions := make(map[ids.ShortID]uint64)
+	for i := range b.KeyRegs {
+		r := &b.KeyRegs[i]
+		owner, err := r.owner(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		version, ok := versions[owner]
+		if !ok {
+			if version, err = b.vm.keyVersionAfter(parent, owner); err != nil {
+				return err
+			}
+		}
+		if r.Version != version+1 {
+			return errBadKeyVersion
+		}
+		versions[owner] = r.Version
+	}
+	return nil
+}
+
+// verifyEncryptedPayload returns nil iff [p] can be accepted in a child of
+// [parent]. It must be encrypted to a key registered before the child.
+func (vm *VM) verifyEncryptedPayload(parent *Block, p *EncryptedPayload) error {
+	if len(p.Ciphertext) == 0 || len(p.Ciphertext) > MaxCiphertextSize {
+		return errBadCiphertextSize
+	}
+	version, err := vm.keyVersionAfter(parent, p.Recipient)
+	if err != nil {
+		return err
+	}
+	if p.KeyVersion == 0 || p.KeyVersion > version {
+		return errNoEncryptionKey
+	}
+	duplicate, err := vm.encryptedAfter(parent, p.ID())
+	if err != nil {
+		return err
+	}
+	if duplicate {
+		return errDuplicateEncrypted
+	}
+	return nil
+}
+
+// verifyEncrypted returns nil iff each of [b]'s encrypted payloads is new
+// and is encrypted to a key registered before [b]
+func (b *Block) verifyEncrypted(parent *Block) error {
+	switch {
+	case len(b.Encrypted) == 0:
+		return nil
+	case !b.vm.genesis.Params.Encryption:
+		return errEncryptionDisabled
+	case len(b.Encrypted) > maxBatchSize:
+		return errTooManyEncrypted
+	}
+	payloads := set.NewSet[[dataLen]byte](len(b.Encrypted))
+	for i := range b.Encrypted {
+		p := &b.Encrypted[i]
+		id := p.ID()
+		if payloads.Contains(id) {
+			return errDuplicateEncrypted
+		}
+		payloads.Add(id)
+		if err := b.vm.verifyEncryptedPayload(parent, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEncryption registers [b]'s keys and stores its encrypted payloads
+func (b *Block) applyEncryption() error {
+	for i := range b.KeyRegs {
+		r := &b.KeyRegs[i]
+		owner, err := r.owner(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.putKey(owner, r.Version, r.Key); err != nil {
+			return err
+		}
+	}
+	for i := range b.Encrypted {
+		p := &b.Encrypted[i]
+		if err := b.vm.state.putEncrypted(p.ID(), encryptedEntry{payload: *p, height: b.Height()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingEncryption holds key registrations and encrypted payloads submitted
+// over the API until they are accepted
+type pendingEncryption struct {
+	lock     sync.Mutex
+	keyRegs  []KeyRegistration
+	payloads []EncryptedPayload
+}
+
+// addKeyRegistration adds [r] to the pending key registrations
+func (p *pendingEncryption) addKeyRegistration(r KeyRegistration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.keyRegs = append(p.keyRegs, r)
+}
+
+// addEncrypted adds [payload] to the pending encrypted payloads
+func (p *pendingEncryption) addEncrypted(payload EncryptedPayload) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.payloads = append(p.payloads, payload)
+}
+
+// next returns the pending key registrations and encrypted payloads that can
+// be accepted in a child of [parent]. Payloads encrypted to keys that aren't
+// accepted yet stay pending.
+func (p *pendingEncryption) next(vm *VM, parent *Block) ([]KeyRegistration, []EncryptedPayload) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	versions := make(map[ids.ShortID]uint64)
+	var keyRegs []KeyRegistration
+	included := make([]bool, len(p.keyRegs))
+	for found := true; found && len(keyRegs) < maxBatchSize; {
+		found = false
+		for i := range p.keyRegs {
+			r := &p.keyRegs[i]
+			if included[i] {
+				continue
+			}
+			owner, err := r.owner(vm.ctx.ChainID)
+			if err != nil {
+				continue
+			}
+			version, ok := versions[owner]
+			if !ok {
+				if version, err = vm.keyVersionAfter(parent, owner); err != nil {
+					continue
+				}
+			}
+			if r.Version != version+1 {
+				continue
+			}
+			versions[owner] = r.Version
+			included[i] = true
+			keyRegs = append(keyRegs, *r)
+			found = true
+			if len(keyRegs) == maxBatchSize {
+				break
+			}
+		}
+	}
+
+	seen := set.NewSet[[dataLen]byte](len(p.payloads))
+	var payloads []EncryptedPayload
+	for i := range p.payloads {
+		payload := &p.payloads[i]
+		id := payload.ID()
+		if seen.Contains(id) || vm.verifyEncryptedPayload(parent, payload) != nil {
+			continue
+		}
+		seen.Add(id)
+		payloads = append(payloads, *payload)
+		if len(payloads) == maxBatchSize {
+			break
+		}
+	}
+	return keyRegs, payloads
+}
+
+// prune drops the pending key registrations whose versions were used and
+// the pending encrypted payloads that are accepted
+func (p *pendingEncryption) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.keyRegs, err = pruneOps(vm.opJournal, keyRegistrationKind, p.keyRegs, func(r *KeyRegistration) bool {
+		owner, err := r.owner(vm.ctx.ChainID)
+		if err != nil {
+			return false
+		}
+		version, err := vm.state.getKeyVersion(owner)
+		return err != nil || r.Version > version
+	})
+	if err != nil {
+		return err
+	}
+
+	p.payloads, err = pruneOps(vm.opJournal, encryptedKind, p.payloads, func(payload *EncryptedPayload) bool {
+		accepted, err := vm.state.hasEncrypted(payload.ID())
+		return err != nil || !accepted
+	})
+	return err
+}
+
+// len returns the number of pending key registrations and encrypted payloads
+func (p *pendingEncryption) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.keyRegs) + len(p.payloads)
+}
+
+// RegisterKeyArgs are the arguments to RegisterKey
+type RegisterKeyArgs struct {
+	// Base 58 repr. of the public key
+	Key     string      `json:"key"`
+	Version json.Uint64 `json:"version"`
+	// Base 58 repr. of the owner's signature of the registration
+	Signature string `json:"signature"`
+
+	key []byte
+	sig [secp256k1.SignatureLen]byte
+}
+
+func (a *RegisterKeyArgs) validate(v *argValidator) {
+	a.key = v.bytes("key", a.Key, EncryptionKeyLen, EncryptionKeyLen, errBadEncryptionKey)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// RegisterKeyReply is the reply from RegisterKey
+type RegisterKeyReply struct {
+	// Address that signed the registration, which owns the key
+	Owner ids.ShortID `json:"owner"`
+}
+
+// RegisterKey is an API method to propose a signed key registration. The
+// registration is included in a block built by this node once it's the
+// next version of its owner's key.
+func (s *Service) RegisterKey(_ *http.Request, args *RegisterKeyArgs, reply *RegisterKeyReply) error {
+	if !s.backend.chainParams().Encryption {
+		return errEncryptionDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	r := KeyRegistration{
+		Version: uint64(args.Version),
+		Sig:     args.sig,
+	}
+	copy(r.Key[:], args.key)
+	var err error
+	if reply.Owner, err = r.owner(s.backend.chainID()); err != nil {
+		return err
+	}
+	if err := s.backend.addKeyRegistration(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetKeyArgs are the arguments to GetKey
+type GetKeyArgs struct {
+	Address ids.ShortID `json:"address"`
+	// Version of the key. Zero means the latest version.
+	Version json.Uint64 `json:"version"`
+}
+
+// GetKeyReply is the reply from GetKey
+type GetKeyReply struct {
+	// Base 58 repr. of the public key
+	Key     string      `json:"key"`
+	Version json.Uint64 `json:"version"`
+}
+
+// GetKey returns the key of [args.Address] that payloads for it are
+// encrypted to, after the last accepted block
+func (s *Service) GetKey(_ *http.Request, args *GetKeyArgs, reply *GetKeyReply) error {
+	if !s.backend.chainParams().Encryption {
+		return errEncryptionDisabled
+	}
+	key, version, err := s.backend.encryptionKey(args.Address, uint64(args.Version))
+	if err == database.ErrNotFound {
+		return errNoEncryptionKey
+	}
+	if err != nil {
+		return err
+	}
+	reply.Key = encoding.EncodeCB58(key[:])
+	reply.Version = json.Uint64(version)
+	return nil
+}
+
+// ProposeEncryptedArgs are the arguments to ProposeEncrypted
+type ProposeEncryptedArgs struct {
+	Recipient ids.ShortID `json:"recipient"`
+	// Version of the recipient's key the payload is encrypted to. Zero means
+	// the latest version.
+	KeyVersion json.Uint64 `json:"keyVersion"`
+	// Base 58 repr. of the ciphertext
+	Ciphertext string `json:"ciphertext"`
+
+	ciphertext []byte
+}
+
+func (a *ProposeEncryptedArgs) validate(v *argValidator) {
+	a.ciphertext = v.bytes("ciphertext", a.Ciphertext, 1, MaxCiphertextSize, errBadCiphertextSize)
+}
+
+// ProposeEncryptedReply is the reply from ProposeEncrypted
+type ProposeEncryptedReply struct {
+	// Base 58 repr. of the payload's ID
+	ID         string      `json:"id"`
+	KeyVersion json.Uint64 `json:"keyVersion"`
+}
+
+// ProposeEncrypted is an API method to propose a payload that was encrypted
+// to a registered key. The payload is included in a block built by this
+// node.
+func (s *Service) ProposeEncrypted(_ *http.Request, args *ProposeEncryptedArgs, reply *ProposeEncryptedReply) error {
+	if !s.backend.chainParams().Encryption {
+		return errEncryptionDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	_, version, err := s.backend.encryptionKey(args.Recipient, uint64(args.KeyVersion))
+	if err == database.ErrNotFound {
+		return errNoEncryptionKey
+	}
+	if err != nil {
+		return err
+	}
+	p := EncryptedPayload{
+		Recipient:  args.Recipient,
+		KeyVersion: version,
+		Ciphertext: args.ciphertext,
+	}
+	id := p.ID()
+	reply.ID = encoding.EncodeCB58(id[:])
+	reply.KeyVersion = json.Uint64(version)
+	if err := s.backend.addEncrypted(p); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetEncryptedArgs are the arguments to GetEncrypted
+type GetEncryptedArgs struct {
+	// Base 58 repr. of the payload's ID
+	ID string `json:"id"`
+
+	id [dataLen]byte
+}
+
+func (a *GetEncryptedArgs) validate(v *argValidator) {
+	a.id = v.data("id", a.ID)
+}
+
+// GetEncryptedReply is the reply from GetEncrypted
+type GetEncryptedReply struct {
+	Recipient  ids.ShortID `json:"recipient"`
+	KeyVersion json.Uint64 `json:"keyVersion"`
+	// Base 58 repr. of the ciphertext
+	Ciphertext string `json:"ciphertext"`
+	// Height of the accepted block that contains the payload
+	Height json.Uint64 `json:"height"`
+}
+
+// GetEncrypted returns the accepted encrypted payload [args.ID]
+func (s *Service) GetEncrypted(_ *http.Request, args *GetEncryptedArgs, reply *GetEncryptedReply) error {
+	if !s.backend.chainParams().Encryption {
+		return errEncryptionDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	entry, err := s.backend.encrypted(args.id)
+	if err == database.ErrNotFound {
+		return errNoSuchEncrypted
+	}
+	if err != nil {
+		return err
+	}
+	reply.Ciphertext = encoding.EncodeCB58(entry.payload.Ciphertext)
+	reply.Recipient = entry.payload.Recipient
+	reply.KeyVersion = json.Uint64(entry.payload.KeyVersion)
+	reply.Height = json.Uint64(entry.height)
+	return nil
+}
@@ -0,0 +1,44 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/ids"
+)
+
+// BlockEvent is sent to webhooks and published to the message bus when a
+// block is accepted
+type BlockEvent struct {
+	ChainID ids.ID   `json:"chainID"`
+	Block   APIBlock `json:"block"`
+}
+
+// emitAccepted sends the [BlockEvent] of [b], which was just accepted, to the
+// configured webhooks and message bus
+func (vm *VM) emitAccepted(b *Block) {
+	if vm.webhooks == nil && vm.publisher == nil {
+		return
+	}
+	event, err := json.Marshal(BlockEvent{
+		ChainID: vm.ctx.ChainID,
+		Block:   newAPIBlock(b),
+	})
+	if err != nil {
+		vm.ctx.Log.Error("couldn't marshal block event",
+			zap.Stringer("blkID", b.ID()),
+			zap.Error(err),
+		)
+		return
+	}
+	if vm.webhooks != nil {
+		vm.webhooks.notify(event)
+	}
+	if vm.publisher != nil {
+		vm.publisher.publish(b.ID(), event)
+	}
+}
@@ -0,0 +1,372 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	submitterStatsLen = 16
+
+	defaultExplorerPageSize = 25
+	maxExplorerPageSize     = 100
+	maxExplorerDays         = 366
+	dayFormat               = time.DateOnly
+)
+
+var (
+	errBadSubmitterStats = errors.New("submitter stats must be 16 bytes")
+	errBadDays           = fmt.Errorf("days must be in [1, %d]", maxExplorerDays)
+	errBadDay            = fmt.Errorf("day must be formatted as %s", dayFormat)
+	errNoSearchResult    = errors.New("no block ID, height or accepted data matches the query")
+)
+
+// submitterStats are the totals of the accepted blocks signed by an address
+type submitterStats struct {
+	blocks uint64
+	data   uint64
+}
+
+func parseSubmitterStats(b []byte) (submitterStats, error) {
+	if len(b) != submitterStatsLen {
+		return submitterStats{}, errBadSubmitterStats
+	}
+	return submitterStats{
+		blocks: binary.BigEndian.Uint64(b),
+		data:   binary.BigEndian.Uint64(b[8:]),
+	}, nil
+}
+
+func (s submitterStats) bytes() []byte {
+	b := make([]byte, submitterStatsLen)
+	binary.BigEndian.PutUint64(b, s.blocks)
+	binary.BigEndian.PutUint64(b[8:], s.data)
+	return b
+}
+
+// submitterSummary is the stats of the blocks signed by [addr]
+type submitterSummary struct {
+	addr ids.ShortID
+	submitterStats
+}
+
+// recordSubmitter adds [b] to the stats of its signer. Blocks of chains that
+// don't sign blocks have no submitter.
+func (b *Block) recordSubmitter() error {
+	if !b.vm.genesis.Params.signsBlocks() || b.Height() == 0 {
+		return nil
+	}
+	signer, err := b.signer()
+	if err != nil {
+		return err
+	}
+	stats, err := b.vm.state.getSubmitterStats(signer)
+	if err != nil {
+		return err
+	}
+	stats.blocks++
+	stats.data += uint64(len(b.Dt))
+	return b.vm.state.putSubmitterStats(signer, stats)
+}
+
+// ListBlocksArgs are the arguments to ListBlocks
+type ListBlocksArgs struct {
+	// Page of accepted blocks, newest first. Page 0 starts at the last
+	// accepted block.
+	Page json.Uint64 `json:"page"`
+	// Number of blocks in each page. Zero means 25. At most 100.
+	PageSize json.Uint64 `json:"pageSize"`
+	// If set, the page starts where the previous page's nextCursor says,
+	// instead of at [Page]
+	Cursor string `json:"cursor"`
+
+	pageSize int
+	start    pageCursor
+}
+
+func (a *ListBlocksArgs) validate(v *argValidator) {
+	a.pageSize = v.limit("pageSize", uint64(a.PageSize), defaultExplorerPageSize, maxExplorerPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: blocksCursor, direction: backward})
+}
+
+// ListBlocksReply is the reply from ListBlocks
+type ListBlocksReply struct {
+	Blocks []APIBlock `json:"blocks"`
+	// Number of accepted blocks, including the genesis block
+	Total json.Uint64 `json:"total"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListBlocks returns a page of accepted blocks, newest first, along with the
+// number of accepted blocks
+func (s *Service) ListBlocks(r *http.Request, args *ListBlocksArgs, reply *ListBlocksReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	pageSize := uint64(args.pageSize)
+	lastHeight, err := s.lastAcceptedHeight(ctx)
+	if err != nil {
+		return err
+	}
+	reply.Total = json.Uint64(lastHeight + 1)
+	reply.Blocks = []APIBlock{}
+
+	start := min(args.start.position, lastHeight)
+	if args.Cursor == "" {
+		skip := uint64(args.Page) * pageSize
+		if uint64(args.Page) != 0 && skip/uint64(args.Page) != pageSize || skip > lastHeight {
+			return nil
+		}
+		start = lastHeight - skip
+	}
+	for height := start; ; height-- {
+		if uint64(len(reply.Blocks)) == pageSize {
+			reply.NextCursor = args.start.at(height).String()
+			break
+		}
+		blk, err := s.acceptedBlock(ctx, height)
+		if err != nil {
+			return err
+		}
+		reply.Blocks = append(reply.Blocks, newAPIBlock(blk))
+		if height == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+// SearchArgs are the arguments to Search
+type SearchArgs struct {
+	// Block ID, height, or base 58 repr. of a piece of data
+	Query string `json:"query"`
+}
+
+// SearchReply is the reply from Search
+type SearchReply struct {
+	// What the query matched: "id", "height" or "data"
+	Match string   `json:"match"`
+	Block APIBlock `json:"block"`
+}
+
+// Search returns the block with the ID or height [args.Query], or the
+// accepted block that contains the data [args.Query]
+func (s *Service) Search(r *http.Request, args *SearchArgs, reply *SearchReply) error {
+	ctx := requestContext(r)
+	if blkID, err := ids.FromString(args.Query); err == nil {
+		if blk, err := s.backend.lookupBlock(ctx, blkID); err == nil {
+			reply.Match = "id"
+			reply.Block = newAPIBlock(blk)
+			return nil
+		}
+	}
+	if height, err := strconv.ParseUint(args.Query, 10, 64); err == nil {
+		if blk, err := s.acceptedBlock(ctx, height); err == nil {
+			reply.Match = "height"
+			reply.Block = newAPIBlock(blk)
+			return nil
+		}
+	}
+	if decoded, err := encoding.DecodeCB58(args.Query); err == nil && len(decoded) <= dataLen {
+		var data [dataLen]byte
+		copy(data[:], decoded)
+		if blkID, err := s.backend.dataBlock(ctx, data); err == nil {
+			if blk, err := s.backend.lookupBlock(ctx, blkID); err == nil {
+				reply.Match = "data"
+				reply.Block = newAPIBlock(blk)
+				return nil
+			}
+		}
+	}
+	return errNoSearchResult
+}
+
+// GetDailyBlockCountsArgs are the arguments to GetDailyBlockCounts
+type GetDailyBlockCountsArgs struct {
+	// First day to count, in UTC, formatted as YYYY-MM-DD
+	Start string `json:"start"`
+	// Number of days to count. At most 366.
+	Days int `json:"days"`
+}
+
+// DailyBlockCount is the number of blocks accepted with timestamps in a day
+type DailyBlockCount struct {
+	Day   string      `json:"day"`
+	Count json.Uint64 `json:"count"`
+}
+
+// GetDailyBlockCountsReply is the reply from GetDailyBlockCounts
+type GetDailyBlockCountsReply struct {
+	Counts []DailyBlockCount `json:"counts"`
+}
+
+// GetDailyBlockCounts returns the number of accepted blocks whose timestamps
+// are in each of [args.Days] days, starting at [args.Start]. Block timestamps
+// never decrease, so each day's blocks are found by binary search.
+func (s *Service) GetDailyBlockCounts(r *http.Request, args *GetDailyBlockCountsArgs, reply *GetDailyBlockCountsReply) error {
+	ctx := requestContext(r)
+	if args.Days <= 0 || args.Days > maxExplorerDays {
+		return errBadDays
+	}
+	start, err := time.Parse(dayFormat, args.Start)
+	if err != nil {
+		return errBadDay
+	}
+	lastHeight, err := s.lastAcceptedHeight(ctx)
+	if err != nil {
+		return err
+	}
+
+	reply.Counts = make([]DailyBlockCount, args.Days)
+	from, err := s.firstHeightAtOrAfter(ctx, start.Unix(), lastHeight)
+	if err != nil {
+		return err
+	}
+	for i := range reply.Counts {
+		day := start.AddDate(0, 0, i)
+		to, err := s.firstHeightAtOrAfter(ctx, day.AddDate(0, 0, 1).Unix(), lastHeight)
+		if err != nil {
+			return err
+		}
+		reply.Counts[i] = DailyBlockCount{
+			Day:   day.Format(dayFormat),
+			Count: json.Uint64(to - from),
+		}
+		from = to
+	}
+	return nil
+}
+
+// SubmitterSummary is the totals of the accepted blocks signed by an address
+type SubmitterSummary struct {
+	Address ids.ShortID `json:"address"`
+	Blocks  json.Uint64 `json:"blocks"`
+	Data    json.Uint64 `json:"data"`
+}
+
+// ListSubmittersArgs are the arguments to ListSubmitters
+type ListSubmittersArgs struct {
+	// Max number of submitters to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the submitters start where the previous page's nextCursor
+	// says, instead of at the first one. Addresses that first sign a block
+	// after the previous page may move a submitter onto the next page too.
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *ListSubmittersArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultExplorerPageSize, maxExplorerPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: submittersCursor, direction: forward})
+}
+
+// ListSubmittersReply is the reply from ListSubmitters
+type ListSubmittersReply struct {
+	Submitters []SubmitterSummary `json:"submitters"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListSubmitters returns the totals of the accepted blocks signed by each
+// address, in the order of the addresses. Only chains that sign blocks have
+// submitters.
+func (s *Service) ListSubmitters(r *http.Request, args *ListSubmittersArgs, reply *ListSubmittersReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	summaries, err := s.backend.submitters(ctx, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(summaries) > args.limit {
+		reply.NextCursor = args.start.at(args.start.position + uint64(args.limit)).String()
+		summaries = summaries[:args.limit]
+	}
+	reply.Submitters = make([]SubmitterSummary, len(summaries))
+	for i, summary := range summaries {
+		reply.Submitters[i] = SubmitterSummary{
+			Address: summary.addr,
+			Blocks:  json.Uint64(summary.blocks),
+			Data:    json.Uint64(summary.data),
+		}
+	}
+	return nil
+}
+
+// lastAcceptedHeight returns the height of the last accepted block. Returns
+// [ctx]'s error once it's cancelled.
+func (s *Service) lastAcceptedHeight(ctx context.Context) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	blkID, err := s.backend.lastAcceptedID(ctx)
+	if err != nil {
+		return 0, err
+	}
+	header, err := s.backend.lookupHeader(ctx, blkID)
+	if err != nil {
+		return 0, ErrBlockNotFound
+	}
+	return header.Height, nil
+}
+
+// acceptedBlock returns the accepted block at [height]. Returns [ctx]'s error
+// once it's cancelled.
+func (s *Service) acceptedBlock(ctx context.Context, height uint64) (*Block, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	blkID, err := s.backend.acceptedAtHeight(ctx, height)
+	if err != nil {
+		return nil, ErrBlockNotFound
+	}
+	blk, err := s.backend.lookupBlock(ctx, blkID)
+	if err != nil {
+		return nil, ErrBlockNotFound
+	}
+	return blk, nil
+}
+
+// firstHeightAtOrAfter returns the height of the first accepted block with a
+// timestamp at or after [timestamp], or [lastHeight] + 1 if there's none
+func (s *Service) firstHeightAtOrAfter(ctx context.Context, timestamp int64, lastHeight uint64) (uint64, error) {
+	low, high := uint64(0), lastHeight+1
+	for low < high {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		mid := low + (high-low)/2
+		blkID, err := s.backend.acceptedAtHeight(ctx, mid)
+		if err != nil {
+			return 0, ErrBlockNotFound
+		}
+		header, err := s.backend.lookupHeader(ctx, blkID)
+		if err != nil {
+			return 0, ErrBlockNotFound
+		}
+		if header.Timestamp < timestamp {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
@@ -5,16 +5,19 @@ package timestampvm
 
 import (
 	"github.com/ava-labs/avalanchego/ids"
-	"github.com/ava-labs/avalanchego/snow"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/vms"
 )
 
 // ID is a unique identifier for this VM
 var (
 	ID = ids.ID{'t', 'i', 'm', 'e', 's', 't', 'a', 'm', 'p'}
+
+	_ vms.Factory = &Factory{}
 )
 
 // Factory ...
 type Factory struct{}
 
 // New ...
-func (f *Factory) New(*snow.Context) (interface{}, error) { return &VM{}, nil }
+func (*Factory) New(logging.Logger) (interface{}, error) { return NewVM() }
@@ -0,0 +1,526 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// FeedIDLen is the length of a feed's ID, which is zero-padded
+	FeedIDLen = 16
+
+	feedEntryLen = 8 + 8 + ids.ShortIDLen
+
+	defaultFeedPageSize = 25
+	maxFeedPageSize     = 100
+)
+
+var (
+	errFeedsDisabled     = errors.New("chain doesn't have oracle feeds")
+	errBadFeedID         = fmt.Errorf("feed ID must be 1 to %d bytes with no zero bytes", FeedIDLen)
+	errDuplicateFeed     = errors.New("feed is registered more than once")
+	errFeedWithoutOracle = errors.New("feed has no oracles")
+	errTooManyFeedUpdate = errors.New("block has too many feed updates")
+	errNotOracle         = errors.New("feed update isn't signed by one of the feed's oracles")
+	errStaleFeedUpdate   = errors.New("feed update isn't newer than the feed's latest update")
+	errFutureFeedUpdate  = errors.New("feed update is newer than its block")
+	errNoFeedUpdate      = errors.New("feed has no accepted updates")
+	errBadFeedEntry      = fmt.Errorf("feed entry must be %d bytes", feedEntryLen)
+)
+
+// FeedConfig registers an oracle data feed in the genesis
+type FeedConfig struct {
+	// ID of the feed, which is zero-padded to [FeedIDLen] bytes
+	ID string `json:"id"`
+	// Addresses that may sign the feed's updates
+	Oracles []ids.ShortID `json:"oracles"`
+}
+
+// parseFeedID returns the zero-padded form of [feed]
+func parseFeedID(feed string) ([FeedIDLen]byte, error) {
+	var padded [FeedIDLen]byte
+	if len(feed) == 0 || len(feed) > FeedIDLen || bytes.IndexByte([]byte(feed), 0) != -1 {
+		return padded, errBadFeedID
+	}
+	copy(padded[:], feed)
+	return padded, nil
+}
+
+// feedString returns the ID that is zero-padded to [feed]
+func feedString(feed [FeedIDLen]byte) string {
+	return string(bytes.TrimRight(feed[:], "\x00"))
+}
+
+// verifyFeeds returns nil iff [feeds] have distinct IDs and each has an
+// oracle
+func verifyFeeds(feeds []FeedConfig) error {
+	registered := set.NewSet[[FeedIDLen]byte](len(feeds))
+	for _, feed := range feeds {
+		id, err := parseFeedID(feed.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case registered.Contains(id):
+			return fmt.Errorf("%w: %s", errDuplicateFeed, feed.ID)
+		case len(feed.Oracles) == 0:
+			return fmt.Errorf("%w: %s", errFeedWithoutOracle, feed.ID)
+		}
+		registered.Add(id)
+		if err := verifyAddresses(feed.Oracles); err != nil {
+			return fmt.Errorf("%s oracles: %w", feed.ID, err)
+		}
+	}
+	return nil
+}
+
+// hasFeeds returns true iff the chain has oracle feeds
+func (p *ChainParams) hasFeeds() bool {
+	return len(p.Feeds) > 0
+}
+
+// feedConfig returns the registration of [feed], or nil if it isn't
+// registered
+func (p *ChainParams) feedConfig(feed [FeedIDLen]byte) *FeedConfig {
+	for i := range p.Feeds {
+		// The feed IDs are checked when the genesis is parsed
+		if padded, _ := parseFeedID(p.Feeds[i].ID); padded == feed {
+			return &p.Feeds[i]
+		}
+	}
+	return nil
+}
+
+// FeedUpdate is the value of a feed at a time, signed by one of the
+// feed's oracles. Each feed's updates are accepted in the order of their
+// timestamps, so an update can't be replayed.
+type FeedUpdate struct {
+	Feed [FeedIDLen]byte `serialize:"true"`
+	// The value's unit and scale are up to the feed
+	Value int64 `serialize:"true"`
+	// Unix time of the value, in seconds. It may not be after the update's
+	// block.
+	Timestamp uint64 `serialize:"true"`
+	// Oracle's signature of the update's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	oracleAddr  ids.ShortID // address of this update's oracle, if [oracleKnown]
+	oracleKnown bool
+}
+
+// Hash returns the hash of [u] on the chain [chainID], which is what the
+// oracle signs
+func (u *FeedUpdate) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+FeedIDLen+8+8)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, feedUpdateTag)
+	msg = append(msg, u.Feed[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(u.Value))
+	msg = binary.BigEndian.AppendUint64(msg, u.Timestamp)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [u]'s signature to [key]'s signature of [u] on the chain
+// [chainID]
+func (u *FeedUpdate) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(u.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(u.Sig[:], sig)
+	u.oracleKnown = false
+	return nil
+}
+
+// oracle returns the address that signed [u] on the chain [chainID]
+func (u *FeedUpdate) oracle(chainID ids.ID) (ids.ShortID, error) {
+	if u.oracleKnown {
+		return u.oracleAddr, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(u.Hash(chainID), u.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	u.oracleAddr = key.Address()
+	u.oracleKnown = true
+	return u.oracleAddr, nil
+}
+
+// feedEntry is an accepted feed update
+type feedEntry struct {
+	value     int64
+	timestamp uint64
+	height    uint64 // height of the update's block
+	oracle    ids.ShortID
+}
+
+func parseFeedEntry(timestamp uint64, b []byte) (feedEntry, error) {
+	if len(b) != feedEntryLen {
+		return feedEntry{}, errBadFeedEntry
+	}
+	e := feedEntry{
+		value:     int64(binary.BigEndian.Uint64(b)),
+		timestamp: timestamp,
+		height:    binary.BigEndian.Uint64(b[8:]),
+	}
+	copy(e.oracle[:], b[16:])
+	return e, nil
+}
+
+func (e feedEntry) bytes() []byte {
+	b := make([]byte, 0, feedEntryLen)
+	b = binary.BigEndian.AppendUint64(b, uint64(e.value))
+	b = binary.BigEndian.AppendUint64(b, e.height)
+	return append(b, e.oracle[:]...)
+}
+
+// feedTimestampAfter returns the timestamp of [feed]'s latest update after
+// [blk] is accepted. Zero means [feed] has no updates.
+func (vm *VM) feedTimestampAfter(blk *Block, feed [FeedIDLen]byte) (uint64, error) {
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return 0, err
+	}
+	// The newest processing ancestor with an update of [feed] has its latest
+	for _, ancestor := range processing {
+		var latest uint64
+		for i := range ancestor.FeedUpdates {
+			if u := &ancestor.FeedUpdates[i]; u.Feed == feed {
+				latest = max(latest, u.Timestamp)
+			}
+		}
+		if latest > 0 {
+			return latest, nil
+		}
+	}
+	return vm.state.getFeedTimestamp(feed)
+}
+
+// verifyFeedUpdate returns nil iff [u] is signed by one of its feed's
+// oracles and is newer than [latest], the timestamp of the feed's latest
+// update, and not newer than [blkTimestamp]
+func (vm *VM) verifyFeedUpdate(u *FeedUpdate, latest uint64, blkTimestamp int64) error {
+	oracle, err := u.oracle(vm.ctx.ChainID)
+	if err != nil {
+		return err
+	}
+	isOracle, err := vm.state.isOracle(u.Feed, oracle)
+	if err != nil {
+		return errDatabaseGet
+	}
+	switch {
+	case !isOracle:
+		return errNotOracle
+	case u.Timestamp <= latest:
+		return errStaleFeedUpdate
+	case blkTimestamp < 0 || u.Timestamp > uint64(blkTimestamp):
+		return errFutureFeedUpdate
+	}
+	return nil
+}
+
+// verifyFeedUpdates returns nil iff each of [b]'s feed updates is signed by
+// one of its feed's oracles and is newer than the feed's previous update
+func (b *Block) verifyFeedUpdates(parent *Block) error {
+	switch {
+	case len(b.FeedUpdates) == 0:
+		return nil
+	case !b.vm.genesis.Params.hasFeeds():
+		return errFeedsDisabled
+	case len(b.FeedUpdates) > maxBatchSize:
+		return errTooManyFeedUpdate
+	}
+	latest := make(map[[FeedIDLen]byte]uint64)
+	for i := range b.FeedUpdates {
+		u := &b.FeedUpdates[i]
+		timestamp, ok := latest[u.Feed]
+		if !ok {
+			var err error
+			if timestamp, err = b.vm.feedTimestampAfter(parent, u.Feed); err != nil {
+				return err
+			}
+		}
+		if err := b.vm.verifyFeedUpdate(u, timestamp, b.Tmstmp); err != nil {
+			return err
+		}
+		latest[u.Feed] = u.Timestamp
+	}
+	return nil
+}
+
+// applyFeedUpdates records [b]'s feed updates
+func (b *Block) applyFeedUpdates() error {
+	for i := range b.FeedUpdates {
+		u := &b.FeedUpdates[i]
+		oracle, err := u.oracle(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		entry := feedEntry{
+			value:     u.Value,
+			timestamp: u.Timestamp,
+			height:    b.Height(),
+			oracle:    oracle,
+		}
+		if err := b.vm.state.putFeedEntry(u.Feed, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingFeedUpdates holds feed updates submitted over the API until they
+// are accepted
+type pendingFeedUpdates struct {
+	lock    sync.Mutex
+	updates []FeedUpdate
+}
+
+// add adds [u] to the pending feed updates
+func (p *pendingFeedUpdates) add(u FeedUpdate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.updates = append(p.updates, u)
+}
+
+// next returns the pending feed updates that can be accepted in a child of
+// [parent] with the timestamp [blkTimestamp], oldest first. Updates newer
+// than [blkTimestamp] stay pending.
+func (p *pendingFeedUpdates) next(vm *VM, parent *Block, blkTimestamp int64) []FeedUpdate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	candidates := slices.Clone(p.updates)
+	slices.SortStableFunc(candidates, func(a, b FeedUpdate) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+	latest := make(map[[FeedIDLen]byte]uint64)
+	var next []FeedUpdate
+	for i := range candidates {
+		u := &candidates[i]
+		timestamp, ok := latest[u.Feed]
+		if !ok {
+			var err error
+			if timestamp, err = vm.feedTimestampAfter(parent, u.Feed); err != nil {
+				continue
+			}
+		}
+		if vm.verifyFeedUpdate(u, timestamp, blkTimestamp) != nil {
+			continue
+		}
+		latest[u.Feed] = u.Timestamp
+		next = append(next, *u)
+		if len(next) == maxBatchSize {
+			break
+		}
+	}
+	return next
+}
+
+// prune drops the pending feed updates that are no newer than their feed's
+// latest accepted update, which can never be accepted
+func (p *pendingFeedUpdates) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.updates, err = pruneOps(vm.opJournal, feedUpdateKind, p.updates, func(u *FeedUpdate) bool {
+		latest, err := vm.state.getFeedTimestamp(u.Feed)
+		return err != nil || u.Timestamp > latest
+	})
+	return err
+}
+
+// len returns the number of pending feed updates
+func (p *pendingFeedUpdates) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.updates)
+}
+
+// SubmitFeedUpdateArgs are the arguments to SubmitFeedUpdate
+type SubmitFeedUpdateArgs struct {
+	Feed  string `json:"feed"`
+	Value int64  `json:"value"`
+	// Unix time of the value, in seconds
+	Timestamp json.Uint64 `json:"timestamp"`
+	// Base 58 repr. of the oracle's signature of the update
+	Signature string `json:"signature"`
+
+	feed [FeedIDLen]byte
+	sig  [secp256k1.SignatureLen]byte
+}
+
+func (a *SubmitFeedUpdateArgs) validate(v *argValidator) {
+	var err error
+	a.feed, err = parseFeedID(a.Feed)
+	v.add("feed", err)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// SubmitFeedUpdateReply is the reply from SubmitFeedUpdate
+type SubmitFeedUpdateReply struct {
+	// Address that signed the update
+	Oracle ids.ShortID `json:"oracle"`
+}
+
+// SubmitFeedUpdate is an API method to propose an oracle's signed update of
+// a feed. The update is included in a block built by this node once the
+// block's timestamp reaches the update's.
+func (s *Service) SubmitFeedUpdate(_ *http.Request, args *SubmitFeedUpdateArgs, reply *SubmitFeedUpdateReply) error {
+	if !s.backend.chainParams().hasFeeds() {
+		return errFeedsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	u := FeedUpdate{
+		Feed:      args.feed,
+		Value:     args.Value,
+		Timestamp: uint64(args.Timestamp),
+		Sig:       args.sig,
+	}
+	oracle, err := u.oracle(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	isOracle, err := s.backend.isOracle(args.feed, oracle)
+	if err != nil {
+		return err
+	}
+	if !isOracle {
+		return errNotOracle
+	}
+	reply.Oracle = oracle
+	if err := s.backend.addFeedUpdate(u); err != nil {
+		return err
+	}
+	return nil
+}
+
+// APIFeedUpdate is an accepted feed update
+type APIFeedUpdate struct {
+	Value int64 `json:"value"`
+	// Unix time of the value, in seconds
+	Timestamp json.Uint64 `json:"timestamp"`
+	// Address that signed the update
+	Oracle ids.ShortID `json:"oracle"`
+	// Height of the accepted block that contains the update
+	Height json.Uint64 `json:"height"`
+}
+
+func newAPIFeedUpdate(e feedEntry) APIFeedUpdate {
+	return APIFeedUpdate{
+		Value:     e.value,
+		Timestamp: json.Uint64(e.timestamp),
+		Oracle:    e.oracle,
+		Height:    json.Uint64(e.height),
+	}
+}
+
+// GetFeedValueArgs are the arguments to GetFeedValue
+type GetFeedValueArgs struct {
+	Feed string `json:"feed"`
+
+	feed [FeedIDLen]byte
+}
+
+func (a *GetFeedValueArgs) validate(v *argValidator) {
+	var err error
+	a.feed, err = parseFeedID(a.Feed)
+	v.add("feed", err)
+}
+
+// GetFeedValue returns [args.Feed]'s latest update after the last accepted
+// block
+func (s *Service) GetFeedValue(_ *http.Request, args *GetFeedValueArgs, reply *APIFeedUpdate) error {
+	if !s.backend.chainParams().hasFeeds() {
+		return errFeedsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	e, err := s.backend.feedValue(args.feed)
+	if err == database.ErrNotFound {
+		return errNoFeedUpdate
+	}
+	if err != nil {
+		return err
+	}
+	*reply = newAPIFeedUpdate(e)
+	return nil
+}
+
+// GetFeedHistoryArgs are the arguments to GetFeedHistory
+type GetFeedHistoryArgs struct {
+	Feed string `json:"feed"`
+	// Unix time, in seconds, of the first update that is returned
+	StartTime json.Uint64 `json:"startTime"`
+	// Max number of updates to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the updates start where the previous page's nextCursor says,
+	// instead of at [StartTime]
+	Cursor string `json:"cursor"`
+
+	feed  [FeedIDLen]byte
+	limit int
+	start pageCursor
+}
+
+func (a *GetFeedHistoryArgs) validate(v *argValidator) {
+	var err error
+	a.feed, err = parseFeedID(a.Feed)
+	v.add("feed", err)
+	a.limit = v.limit("limit", uint64(a.Limit), defaultFeedPageSize, maxFeedPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: feedHistoryCursor, direction: forward, position: uint64(a.StartTime)})
+}
+
+// GetFeedHistoryReply is the reply from GetFeedHistory
+type GetFeedHistoryReply struct {
+	Updates []APIFeedUpdate `json:"updates"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetFeedHistory returns [args.Feed]'s accepted updates, oldest first,
+// starting at [args.StartTime]
+func (s *Service) GetFeedHistory(r *http.Request, args *GetFeedHistoryArgs, reply *GetFeedHistoryReply) error {
+	ctx := requestContext(r)
+	if !s.backend.chainParams().hasFeeds() {
+		return errFeedsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	entries, err := s.backend.feedHistory(ctx, args.feed, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(entries) > args.limit {
+		reply.NextCursor = args.start.at(entries[args.limit].timestamp).String()
+		entries = entries[:args.limit]
+	}
+	reply.Updates = make([]APIFeedUpdate, len(entries))
+	for i, e := range entries {
+		reply.Updates[i] = newAPIFeedUpdate(e)
+	}
+	return nil
+}
@@ -0,0 +1,469 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/math"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const defaultFeeChangeDenominator = 8
+
+var (
+	errInsufficientBalance  = errors.New("block's signer or an operation's signer can't pay its fee")
+	errDynamicFeeWithoutFee = errors.New("dynamic fee needs a non-zero fee")
+	errBadTargetData        = fmt.Errorf("target data must be in [1, %d]", maxBatchSize)
+	errBadDecayInterval     = errors.New("decay interval must not be negative")
+)
+
+// DynamicFeeConfig configures the base fee of a chain with a dynamic fee.
+// Each block's base fee is computed from its parent's, so every node
+// charges the same fee for a block.
+type DynamicFeeConfig struct {
+	// Items per block, pieces of data and signed operations, that the base
+	// fee steers towards. A block with more items raises its child's base
+	// fee, and one with fewer lowers it.
+	TargetData int `json:"targetData"`
+	// The base fee changes by at most 1/[ChangeDenominator] of itself for
+	// each block. Defaults to 8.
+	ChangeDenominator uint64 `json:"changeDenominator"`
+	// If non-zero, the base fee also falls by 1/[ChangeDenominator] of itself
+	// for each interval between a block's timestamp and its parent's, so it
+	// decays while the chain is idle
+	DecayInterval Duration `json:"decayInterval"`
+}
+
+// Verify returns nil iff [c] is a valid dynamic fee config
+func (c *DynamicFeeConfig) Verify() error {
+	switch {
+	case c.TargetData <= 0 || c.TargetData > maxBatchSize:
+		return errBadTargetData
+	case c.DecayInterval.Duration < 0:
+		return errBadDecayInterval
+	}
+	return nil
+}
+
+// next returns the base fee of a block [elapsed] seconds after its parent,
+// which has base fee [parentFee] and [parentData] pieces of data. The base
+// fee never falls below [minFee].
+func (c *DynamicFeeConfig) next(parentFee, minFee uint64, parentData int, elapsed int64) uint64 {
+	denominator := c.ChangeDenominator
+	if denominator == 0 {
+		denominator = defaultFeeChangeDenominator
+	}
+	target := uint64(c.TargetData)
+	fee := parentFee
+	switch data := uint64(parentData); {
+	case data > target:
+		delta, err := math.Mul(fee/denominator, data-target)
+		if err != nil {
+			delta = math.MaxUint[uint64]()
+		}
+		fee, err = math.Add(fee, max(delta/target, 1))
+		if err != nil {
+			fee = math.MaxUint[uint64]()
+		}
+	case data < target:
+		fee -= fee / denominator * (target - data) / target
+	}
+	if interval := int64(c.DecayInterval.Seconds()); interval > 0 {
+		// Each step takes at least 1 off the fee, so this ends once the fee
+		// reaches [minFee] rather than after every elapsed interval
+		for i := elapsed / interval; i > 0 && fee > minFee; i-- {
+			fee -= max(fee/denominator, 1)
+		}
+	}
+	return max(fee, minFee)
+}
+
+// Allocation is the balance of an address at genesis
+type Allocation struct {
+	Address ids.ShortID `json:"address"`
+	Balance uint64      `json:"balance"`
+}
+
+// fee returns the fee [payer] pays for [numItems] items of a block whose base
+// fee is [baseFee]
+func (p *ChainParams) fee(payer ids.ShortID, baseFee uint64, numItems int) (uint64, error) {
+	if p.isFeeExempt(payer) {
+		return 0, nil
+	}
+	return math.Mul(baseFee, uint64(numItems))
+}
+
+// numItems returns the number of pieces of data and signed operations in [b]
+func (b *Block) numItems() int {
+	return len(b.Dt) +
+		len(b.Ops) +
+		len(b.Transfers) +
+		len(b.ClaimTransfers) +
+		len(b.ACLOps) +
+		len(b.Reveals) +
+		len(b.KeyRegs) +
+		len(b.Encrypted) +
+		len(b.FeedUpdates) +
+		len(b.WarpMessages) +
+		len(b.Votes) +
+		len(b.Multisigs) +
+		len(b.Submissions)
+}
+
+// payers returns the number of [b]'s items each address pays the fee for.
+// An operation signed by one address is paid for by that address. [b]'s
+// signer, [signer], pays for the rest: its data, its reveals, encrypted
+// payloads, Warp messages and multisig proposals.
+func (b *Block) payers(signer ids.ShortID) (map[ids.ShortID]int, error) {
+	chainID := b.vm.ctx.ChainID
+	payers := map[ids.ShortID]int{
+		signer: len(b.Dt) + len(b.Reveals) + len(b.Encrypted) + len(b.WarpMessages) + len(b.Multisigs),
+	}
+	for i := range b.Ops {
+		admin, err := b.Ops[i].admin(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[admin]++
+	}
+	for i := range b.Transfers {
+		sender, err := b.Transfers[i].sender(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[sender]++
+	}
+	for i := range b.ClaimTransfers {
+		sender, err := b.ClaimTransfers[i].sender(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[sender]++
+	}
+	for i := range b.ACLOps {
+		admin, err := b.ACLOps[i].admin(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[admin]++
+	}
+	for i := range b.KeyRegs {
+		owner, err := b.KeyRegs[i].owner(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[owner]++
+	}
+	for i := range b.FeedUpdates {
+		oracle, err := b.FeedUpdates[i].oracle(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[oracle]++
+	}
+	for i := range b.Votes {
+		voter, err := b.Votes[i].voter(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[voter]++
+	}
+	for i := range b.Submissions {
+		key, err := b.Submissions[i].submitter(chainID)
+		if err != nil {
+			return nil, err
+		}
+		payers[key.Address()]++
+	}
+	return payers, nil
+}
+
+// payerItems returns the number of [b]'s items each address pays the fee
+// for
+func (b *Block) payerItems() (map[ids.ShortID]int, error) {
+	if b.payerCounts != nil {
+		return b.payerCounts, nil
+	}
+	signer, err := b.signer()
+	if err != nil {
+		return nil, err
+	}
+	payers, err := b.payers(signer)
+	if err != nil {
+		return nil, err
+	}
+	b.payerCounts = payers
+	return payers, nil
+}
+
+// feeOf returns the fee [addr] pays for [b], which has parameters [params].
+// The genesis block pays no fee.
+func (b *Block) feeOf(params *ChainParams, addr ids.ShortID) (uint64, error) {
+	if params.Fee == 0 || b.Height() == 0 {
+		return 0, nil
+	}
+	payers, err := b.payerItems()
+	if err != nil {
+		return 0, err
+	}
+	baseFee, err := b.baseFee(params)
+	if err != nil {
+		return 0, err
+	}
+	return params.fee(addr, baseFee, payers[addr])
+}
+
+// baseFee returns the fee for each item in [b], which has parameters
+// [params]
+func (b *Block) baseFee(params *ChainParams) (uint64, error) {
+	if b.baseFeeKnown {
+		return b.dataFee, nil
+	}
+	if params.DynamicFee == nil || b.Height() == 0 {
+		return params.Fee, nil
+	}
+	parent, err := b.vm.getBlock(b.Parent())
+	if err != nil {
+		return 0, errDatabaseGet
+	}
+	fee, err := b.vm.baseFeeAfter(parent, params, b.Tmstmp)
+	if err != nil {
+		return 0, err
+	}
+	b.dataFee = fee
+	b.baseFeeKnown = true
+	return fee, nil
+}
+
+// baseFeeAfter returns the base fee of a child of [parent] with parameters
+// [params] and timestamp [timestamp]
+func (vm *VM) baseFeeAfter(parent *Block, params *ChainParams, timestamp int64) (uint64, error) {
+	if params.DynamicFee == nil {
+		return params.Fee, nil
+	}
+	var (
+		parentFee uint64
+		err       error
+	)
+	if !parent.baseFeeKnown && parent.Status() == choices.Accepted {
+		// Processing blocks are built on the last accepted block, which is
+		// the only accepted block whose base fee is persisted
+		parentFee, err = vm.state.getBaseFee()
+	} else {
+		var parentParams *ChainParams
+		if parentParams, err = parent.activeParams(); err == nil {
+			parentFee, err = parent.baseFee(parentParams)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	// The genesis data doesn't compete for space in a block, so it doesn't
+	// move the base fee
+	parentData := parent.numItems()
+	if parent.Height() == 0 {
+		parentData = params.DynamicFee.TargetData
+	}
+	return params.DynamicFee.next(parentFee, params.Fee, parentData, timestamp-parent.Tmstmp), nil
+}
+
+// balanceAfter returns the balance of [addr] after [blk] is accepted
+func (vm *VM) balanceAfter(blk *Block, addr ids.ShortID) (uint64, error) {
+	a, err := vm.accountAfter(blk, addr)
+	return a.balance, err
+}
+
+// verifyFee returns nil iff each of [b]'s payers can pay its fee after
+// [parent] is accepted
+func (b *Block) verifyFee(parent *Block) error {
+	params, err := b.activeParams()
+	if err != nil {
+		return err
+	}
+	if params.Fee == 0 {
+		return nil
+	}
+	payers, err := b.payerItems()
+	if err != nil {
+		return err
+	}
+	for addr := range payers {
+		fee, err := b.feeOf(params, addr)
+		if err != nil {
+			return err
+		}
+		balance, err := b.vm.balanceAfter(parent, addr)
+		if err != nil {
+			return err
+		}
+		if balance < fee {
+			return errInsufficientBalance
+		}
+	}
+	return nil
+}
+
+// chargeFee deducts each of [b]'s payers' fee from its balance and burns
+// it, and stores [b]'s base fee if the chain has a dynamic fee. The genesis
+// block pays no fee.
+func (b *Block) chargeFee() error {
+	params, err := b.activeParams()
+	if err != nil {
+		return err
+	}
+	if b.Height() == 0 {
+		return nil
+	}
+	baseFee, err := b.baseFee(params)
+	if err != nil {
+		return err
+	}
+	if params.DynamicFee != nil {
+		if err := b.vm.state.putBaseFee(baseFee); err != nil {
+			return err
+		}
+	}
+	if params.Fee == 0 {
+		return nil
+	}
+	payers, err := b.payerItems()
+	if err != nil {
+		return err
+	}
+	burned, err := b.vm.state.getBurned()
+	if err != nil {
+		return err
+	}
+	for addr := range payers {
+		fee, err := b.feeOf(params, addr)
+		if err != nil {
+			return err
+		}
+		balance, err := b.vm.state.getBalance(addr)
+		if err != nil {
+			return err
+		}
+		if balance < fee {
+			return errInsufficientBalance
+		}
+		if err := b.vm.state.putBalance(addr, balance-fee); err != nil {
+			return err
+		}
+		if burned, err = math.Add(burned, fee); err != nil {
+			return err
+		}
+	}
+	return b.vm.state.putBurned(burned)
+}
+
+// dropUnpaid drops the operations of [blk], a block this node is building on
+// [parent] with parameters [params], whose payers can't pay their fees after
+// [parent] is accepted. The operations stay pending. [blk]'s data is never
+// dropped, since this node only takes the data it can pay for.
+func (vm *VM) dropUnpaid(blk *Block, parent *Block, params *ChainParams) error {
+	if params.Fee == 0 {
+		return nil
+	}
+	for {
+		payers, err := blk.payers(vm.signer.Address())
+		if err != nil {
+			return err
+		}
+		blk.payerCounts = payers
+		unpaid := set.NewSet[ids.ShortID](0)
+		for addr := range payers {
+			a, err := vm.accountAfter(parent, addr)
+			if err != nil {
+				return err
+			}
+			if a.apply(vm, blk, addr) != nil {
+				unpaid.Add(addr)
+			}
+		}
+		if unpaid.Len() == 0 {
+			return nil
+		}
+		if !blk.dropPaidBy(vm.signer.Address(), unpaid) {
+			return errInsufficientBalance
+		}
+	}
+}
+
+// dropPaidBy removes the operations of [b] that an address in [payers] pays
+// for, where [b]'s signer is [signer], and returns true iff it removed any.
+// [b]'s data isn't removed.
+func (b *Block) dropPaidBy(signer ids.ShortID, payers set.Set[ids.ShortID]) bool {
+	chainID := b.vm.ctx.ChainID
+	before := b.numItems()
+	paidBy := func(addr ids.ShortID, err error) bool {
+		return err != nil || payers.Contains(addr)
+	}
+	if payers.Contains(signer) {
+		b.Reveals = nil
+		b.Encrypted = nil
+		b.WarpMessages = nil
+		b.Multisigs = nil
+	}
+	b.Ops = slices.DeleteFunc(b.Ops, func(op SignerOp) bool { return paidBy(op.admin(chainID)) })
+	b.Transfers = slices.DeleteFunc(b.Transfers, func(t Transfer) bool { return paidBy(t.sender(chainID)) })
+	b.ClaimTransfers = slices.DeleteFunc(b.ClaimTransfers, func(t ClaimTransfer) bool { return paidBy(t.sender(chainID)) })
+	b.ACLOps = slices.DeleteFunc(b.ACLOps, func(op ACLOp) bool { return paidBy(op.admin(chainID)) })
+	b.KeyRegs = slices.DeleteFunc(b.KeyRegs, func(r KeyRegistration) bool { return paidBy(r.owner(chainID)) })
+	b.FeedUpdates = slices.DeleteFunc(b.FeedUpdates, func(u FeedUpdate) bool { return paidBy(u.oracle(chainID)) })
+	b.Votes = slices.DeleteFunc(b.Votes, func(v GovernanceVote) bool { return paidBy(v.voter(chainID)) })
+	b.Submissions = slices.DeleteFunc(b.Submissions, func(s SignedSubmission) bool {
+		key, err := s.submitter(chainID)
+		return err != nil || payers.Contains(key.Address())
+	})
+	b.payerCounts = nil
+	return b.numItems() < before
+}
+
+// affordableData returns how many pieces of data this node can pay the fee
+// for in a child of [parent] with parameters [params] and base fee
+// [baseFee], up to [numData]
+func (vm *VM) affordableData(parent *Block, params *ChainParams, baseFee uint64, numData int) (int, error) {
+	if params.Fee == 0 || params.isFeeExempt(vm.signer.Address()) {
+		return numData, nil
+	}
+	balance, err := vm.balanceAfter(parent, vm.signer.Address())
+	if err != nil {
+		return 0, err
+	}
+	if affordable := balance / baseFee; affordable < uint64(numData) {
+		return int(affordable), nil
+	}
+	return numData, nil
+}
+
+// GetCurrentFeeReply is the reply from GetCurrentFee
+type GetCurrentFeeReply struct {
+	// Fee for each piece of data or signed operation in a block built now on
+	// the last accepted block. Fee exempt addresses pay nothing.
+	Fee json.Uint64 `json:"fee"`
+	// Lowest fee for each item
+	MinFee json.Uint64 `json:"minFee"`
+	// True iff the fee follows the chain's dynamic base fee
+	Dynamic bool `json:"dynamic"`
+}
+
+// GetCurrentFee returns the fee for each item in the next block, so that a
+// signer can tell how many items its balance pays for
+func (s *Service) GetCurrentFee(_ *http.Request, _ *struct{}, reply *GetCurrentFeeReply) error {
+	params, fee, err := s.backend.currentFee()
+	if err != nil {
+		return err
+	}
+	reply.Fee = json.Uint64(fee)
+	reply.MinFee = json.Uint64(params.Fee)
+	reply.Dynamic = params.DynamicFee != nil
+	return nil
+}
@@ -0,0 +1,91 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/cb58"
+)
+
+func FuzzParseBlock(f *testing.F) {
+	vm := newTestVMWithGenesis(f, &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}, nil)
+	for _, data := range [][][dataLen]byte{nil, {{1}}, benchmarkData(0, 3)} {
+		blk, err := vm.NewBlock(vm.preferred, 1, data, time.Unix(1, 0))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(blk.Bytes())
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, blockBytes []byte) {
+		blk, err := vm.ParseBlock(context.Background(), blockBytes)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(blk.Bytes(), blockBytes) {
+			t.Fatal("parsed block has different bytes")
+		}
+		// Blocks the codec parses have a header that decodes to the same
+		// fields
+		header, err := parseHeader(blockBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != blk.(*Block).header() {
+			t.Fatalf("expected header %+v but got %+v", blk.(*Block).header(), header)
+		}
+	})
+}
+
+func FuzzParseHeader(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(make([]byte, headerLen))
+	f.Fuzz(func(_ *testing.T, blockBytes []byte) {
+		_, _ = parseHeader(blockBytes)
+		_, _, _ = unwrapBlock(blockBytes)
+	})
+}
+
+func FuzzParseGenesis(f *testing.F) {
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"params": {"maxPayloadSize": 8, "fee": 1}, "data": ["W8BTQxZ"], "allocations": [{"address": "6Y3kysjF9jnHnYkdS9yGAuoHyae2eNmeV", "balance": 5}]}`))
+	f.Add([]byte(`{"params": {"payloadRules": ["nonZero"], "medianTimePastWindow": 3}}`))
+	f.Fuzz(func(t *testing.T, genesisBytes []byte) {
+		genesis, err := ParseGenesis(genesisBytes)
+		if err != nil {
+			return
+		}
+		// A genesis that parses can be built again
+		rebuilt, err := BuildGenesisBytes(genesis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseGenesis(rebuilt); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func FuzzServiceArgs(f *testing.F) {
+	service := &Service{newFakeBackend(f, ChainParams{Signers: []ids.ShortID{{1}}, Admins: []ids.ShortID{{2}}})}
+	encoded, err := cb58.Encode([]byte{1, 2, 3})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(encoded)
+	f.Add("")
+	f.Add("0x0102")
+	f.Fuzz(func(_ *testing.T, arg string) {
+		_ = service.ProposeBlock(nil, &ProposeBlockArgs{Data: arg}, &ProposeBlockReply{})
+		_ = service.ProposeSignerOp(nil, &ProposeSignerOpArgs{Signature: arg}, &ProposeSignerOpReply{})
+		_ = service.GetBlock(nil, &GetBlockArgs{ID: arg}, &GetBlockReply{})
+		_ = service.GetBlockHeader(nil, &GetBlockArgs{ID: arg}, &GetBlockHeaderReply{})
+	})
+}
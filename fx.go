@@ -0,0 +1,118 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ava-labs/avalanchego/snow/engine/common"
+)
+
+var (
+	errUnknownFx        = errors.New("fx doesn't implement timestampvm.Fx")
+	errDuplicateHandler = errors.New("handler extension is already registered")
+)
+
+// Fx is a feature extension that can be passed to the VM at chain creation.
+// An Fx may also implement BlockVerifier, PayloadVerifier and/or APIExtender
+// to hook into block verification and the VM's API.
+type Fx interface {
+	// Initialize is called once during the VM's initialization, after the
+	// VM's config and state are loaded
+	Initialize(vm *VM) error
+}
+
+// BlockVerifier is implemented by fxs that enforce additional rules on blocks
+type BlockVerifier interface {
+	// VerifyBlock is called by [blk].Verify after the VM's own rules pass.
+	// A non-nil error makes [blk] invalid.
+	VerifyBlock(blk *Block) error
+}
+
+// PayloadVerifier is implemented by fxs that check each piece of data on its
+// own, such as a signature or proof that the data commits to. The fxs of a
+// chain are fixed when it's created, so every validator runs the same
+// verifiers and payload validity is a consensus rule.
+type PayloadVerifier interface {
+	// VerifyPayload is called by Verify for each piece of a block's data,
+	// after the chain's payload rules pass, and by the API for each
+	// proposal, zero-padded to [dataLen] bytes. A non-nil error makes the
+	// data invalid. It may be called concurrently.
+	VerifyPayload(data [dataLen]byte) error
+}
+
+// APIExtender is implemented by fxs that serve additional APIs
+type APIExtender interface {
+	// CreateHandlers returns handlers keyed by path extension.
+	// Extensions must not collide with the VM's own or another fx's.
+	CreateHandlers(context.Context) (map[string]http.Handler, error)
+}
+
+// initializeFxs initializes every fx in [fxs] and records their hooks
+func (vm *VM) initializeFxs(fxs []*common.Fx) error {
+	for _, fxContainer := range fxs {
+		fx, ok := fxContainer.Fx.(Fx)
+		if !ok {
+			return fmt.Errorf("%w: %s", errUnknownFx, fxContainer.ID)
+		}
+		if err := fx.Initialize(vm); err != nil {
+			return fmt.Errorf("couldn't initialize fx %s: %w", fxContainer.ID, err)
+		}
+		vm.fxs = append(vm.fxs, fx)
+	}
+	return nil
+}
+
+// verifyFxs returns the first error returned by an fx's VerifyBlock hook
+func (vm *VM) verifyFxs(blk *Block) error {
+	for _, fx := range vm.fxs {
+		verifier, ok := fx.(BlockVerifier)
+		if !ok {
+			continue
+		}
+		if err := verifier.VerifyBlock(blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyPayloadFxs returns the first error returned by an fx's
+// VerifyPayload hook for [data]
+func (vm *VM) verifyPayloadFxs(data [dataLen]byte) error {
+	for _, fx := range vm.fxs {
+		verifier, ok := fx.(PayloadVerifier)
+		if !ok {
+			continue
+		}
+		if err := verifier.VerifyPayload(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addFxHandlers adds the handlers of every fx's APIExtender hook to [handlers]
+func (vm *VM) addFxHandlers(ctx context.Context, handlers map[string]http.Handler) error {
+	for _, fx := range vm.fxs {
+		extender, ok := fx.(APIExtender)
+		if !ok {
+			continue
+		}
+		fxHandlers, err := extender.CreateHandlers(ctx)
+		if err != nil {
+			return err
+		}
+		for extension, handler := range fxHandlers {
+			if _, exists := handlers[extension]; exists {
+				return fmt.Errorf("%w: %q", errDuplicateHandler, extension)
+			}
+			handlers[extension] = handler
+		}
+	}
+	return nil
+}
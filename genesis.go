@@ -0,0 +1,309 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+var (
+	errBadGenesisPayloadSize = fmt.Errorf("genesis max payload size must be in [1, %d]", dataLen)
+	errTooMuchGenesisData    = fmt.Errorf("genesis has more than %d pieces of data", maxBatchSize)
+	errPayloadTooLarge       = errors.New("data is larger than the max payload size")
+	errBadMaxClockSkew       = errors.New("max clock skew must not be negative")
+	errBadMinBlockInterval   = errors.New("min block interval must not be negative")
+	errBadMedianTimeWindow   = fmt.Errorf("median time past window must be in [0, %d]", maxMedianTimeWindow)
+)
+
+const defaultMaxClockSkew = time.Hour
+
+// ChainParams are the consensus parameters of a chain, fixed at genesis
+type ChainParams struct {
+	// Maximum number of bytes of data in each piece of data. The remaining
+	// bytes of each 32 byte piece of data must be zero. Defaults to 32.
+	MaxPayloadSize int `json:"maxPayloadSize"`
+	// Fee charged for each item of a block: each piece of data and each
+	// signed operation. If non-zero, every block after the genesis block must
+	// be signed. An operation signed by one address is paid for by that
+	// address from its balance, and the block's signer pays for the rest.
+	// Fees are burned.
+	Fee uint64 `json:"fee"`
+	// If set, the fee for each piece of data follows a base fee that rises
+	// while blocks hold more data than the target and decays otherwise. [Fee]
+	// is then the lowest the base fee can fall to, so it must be non-zero.
+	DynamicFee *DynamicFeeConfig `json:"dynamicFee"`
+	// Rules that every piece of data, including the genesis data, must follow
+	PayloadRules []PayloadRule `json:"payloadRules"`
+	// Validators that every piece of data, including the genesis data, must
+	// pass, after the payload rules
+	PayloadValidators []PayloadValidatorConfig `json:"payloadValidators"`
+	// How far ahead of a node's local time a block's timestamp may be.
+	// Defaults to 1 hour.
+	MaxClockSkew Duration `json:"maxClockSkew"`
+	// If true, a block's timestamp must be after its parent's. Otherwise it
+	// may be equal to its parent's.
+	StrictlyIncreasingTimestamps bool `json:"strictlyIncreasingTimestamps"`
+	// If non-zero, a block's timestamp must be at least this long after its
+	// parent's, which limits how often blocks are produced
+	MinBlockInterval Duration `json:"minBlockInterval"`
+	// If non-zero, a block's timestamp must also be after the median
+	// timestamp of this many of its most recent ancestors, so that a block
+	// can't be timestamped behind the recent chain even if its parent is. The
+	// genesis block doesn't count towards the median.
+	MedianTimePastWindow int `json:"medianTimePastWindow"`
+	// If non-empty, every block after the genesis block must be signed by an
+	// allowed signer. These are the initial allowed signers.
+	Signers []ids.ShortID `json:"signers"`
+	// Addresses that may sign operations that change the allowed signers
+	Admins []ids.ShortID `json:"admins"`
+	// Addresses that pay no fees, such as the operator's own services
+	FeeExempt []ids.ShortID `json:"feeExempt"`
+	// If true, balances can be moved with signed transfers, which are put in
+	// blocks alongside data, and every block after the genesis block must be
+	// signed
+	Transfers bool `json:"transfers"`
+	// If true, the signer of the first accepted block that contains a piece
+	// of data owns a claim on it, which can be given to another address with
+	// a signed claim transfer, and every block after the genesis block must
+	// be signed
+	Claims bool `json:"claims"`
+	// If true, data proposed as the commitment of other data can later be
+	// opened with a reveal of that data and the commitment's salt, and every
+	// block after the genesis block must be signed
+	Reveals bool `json:"reveals"`
+	// If true, addresses can register public keys, and payloads encrypted to
+	// a registered key are stored alongside data, and every block after the
+	// genesis block must be signed
+	Encryption bool `json:"encryption"`
+	// Oracle data feeds, whose updates are signed by the feed's oracles and
+	// put in blocks alongside data. If any, every block after the genesis
+	// block must be signed.
+	Feeds []FeedConfig `json:"feeds"`
+	// Sets of signers, a threshold of whom must sign a piece of data before
+	// it can be proposed with the set. Signed proposals are put in blocks
+	// alongside data. If any, every block after the genesis block must be
+	// signed.
+	Multisigs []MultisigConfig `json:"multisigs"`
+	// If true, addresses can submit data signed with their key and the next
+	// nonce of their account, which is created by their first accepted
+	// submission. Signed submissions are put in blocks alongside data, and
+	// every block after the genesis block must be signed.
+	Accounts bool `json:"accounts"`
+	// Chains whose validators may attest hashes with Warp messages, which
+	// are put in blocks alongside data. If set, every block after the
+	// genesis block must be signed.
+	Warp *WarpConfig `json:"warp"`
+	// Namespaces whose data may only be written by some block signers. If
+	// any, every block after the genesis block must be signed, and each
+	// piece of data may have a namespace.
+	ACLs []NamespaceACL `json:"acls"`
+	// If true, each piece of data has the namespace of its tenant alongside
+	// it in its block, and accepted data is indexed by namespace. The
+	// genesis data has no namespace.
+	Namespaces bool `json:"namespaces"`
+	// Max number of pieces of one namespace's data in a block. Zero means
+	// there's no quota.
+	MaxNamespaceData int `json:"maxNamespaceData"`
+	// If true, the allowed signers can vote to change the max payload size,
+	// fee and max clock skew from a future height on. Votes are put in
+	// blocks alongside data, and a change passes once more than half of the
+	// allowed signers voted for it. Requires a signer set.
+	Governance bool `json:"governance"`
+}
+
+// Genesis is the JSON representation of a chain's genesis, passed to
+// Initialize as the genesisBytes
+type Genesis struct {
+	Params ChainParams `json:"params"`
+	// Base 58 repr. of each piece of data in the genesis block
+	Data []string `json:"data"`
+	// Initial balances, which pay for fees
+	Allocations []Allocation `json:"allocations"`
+}
+
+// ParseGenesis parses and verifies [genesisBytes]
+func ParseGenesis(genesisBytes []byte) (*Genesis, error) {
+	decoder := json.NewDecoder(bytes.NewReader(genesisBytes))
+	decoder.DisallowUnknownFields()
+	genesis := &Genesis{}
+	if err := decoder.Decode(genesis); err != nil {
+		return nil, fmt.Errorf("couldn't parse genesis: %w", err)
+	}
+	if genesis.Params.MaxPayloadSize == 0 {
+		genesis.Params.MaxPayloadSize = dataLen
+	}
+	if genesis.Params.MaxClockSkew.Duration == 0 {
+		genesis.Params.MaxClockSkew.Duration = defaultMaxClockSkew
+	}
+	return genesis, genesis.Verify()
+}
+
+// BuildGenesisBytes verifies [genesis] and returns the genesis bytes to
+// create a chain with
+func BuildGenesisBytes(genesis *Genesis) ([]byte, error) {
+	if err := genesis.Verify(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(genesis)
+}
+
+// Verify returns nil iff [g] is a valid genesis
+func (g *Genesis) Verify() error {
+	if err := g.Params.Verify(); err != nil {
+		return err
+	}
+	if len(g.Data) > maxBatchSize {
+		return errTooMuchGenesisData
+	}
+	addrs := make([]ids.ShortID, len(g.Allocations))
+	for i, allocation := range g.Allocations {
+		addrs[i] = allocation.Address
+	}
+	if err := verifyAddresses(addrs); err != nil {
+		return fmt.Errorf("allocations: %w", err)
+	}
+	data, err := g.decodeData()
+	if err != nil {
+		return err
+	}
+	validators, err := payloadValidators(g.Params.PayloadValidators)
+	if err != nil {
+		return err
+	}
+	for i, d := range data {
+		for _, rule := range g.Params.PayloadRules {
+			if err := rule.verifyData(d); err != nil {
+				return fmt.Errorf("genesis data %d: %w", i, err)
+			}
+		}
+		if err := validatePayload(validators, d); err != nil {
+			return fmt.Errorf("genesis data %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// decodeData returns the pieces of data in the genesis block
+func (g *Genesis) decodeData() ([][dataLen]byte, error) {
+	data := make([][dataLen]byte, len(g.Data))
+	for i, encoded := range g.Data {
+		decoded, err := encoding.DecodeCB58(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode genesis data %d: %w", i, err)
+		}
+		if len(decoded) > g.Params.MaxPayloadSize {
+			return nil, fmt.Errorf("genesis data %d: %w", i, errPayloadTooLarge)
+		}
+		copy(data[i][:], decoded)
+	}
+	return data, nil
+}
+
+// Verify returns nil iff [p] are valid chain parameters
+func (p *ChainParams) Verify() error {
+	switch {
+	case p.MaxPayloadSize <= 0 || p.MaxPayloadSize > dataLen:
+		return errBadGenesisPayloadSize
+	case p.MaxClockSkew.Duration < 0:
+		return errBadMaxClockSkew
+	case p.MinBlockInterval.Duration < 0:
+		return errBadMinBlockInterval
+	case p.MedianTimePastWindow < 0 || p.MedianTimePastWindow > maxMedianTimeWindow:
+		return errBadMedianTimeWindow
+	case p.MaxNamespaceData < 0 || (p.MaxNamespaceData > 0 && !p.Namespaces):
+		return errBadNamespaceQuota
+	}
+
+	if len(p.Admins) > 0 && len(p.Signers) == 0 {
+		return errAdminsWithoutSigner
+	}
+	if p.Governance && len(p.Signers) == 0 {
+		return errGovernanceWithoutSigner
+	}
+	if err := verifyAddresses(p.Signers); err != nil {
+		return fmt.Errorf("signers: %w", err)
+	}
+	if err := verifyAddresses(p.Admins); err != nil {
+		return fmt.Errorf("admins: %w", err)
+	}
+	if err := verifyAddresses(p.FeeExempt); err != nil {
+		return fmt.Errorf("fee exempt: %w", err)
+	}
+	if err := verifyACLs(p.ACLs); err != nil {
+		return fmt.Errorf("ACLs: %w", err)
+	}
+	if err := verifyFeeds(p.Feeds); err != nil {
+		return fmt.Errorf("feeds: %w", err)
+	}
+	if err := verifyMultisigConfigs(p.Multisigs); err != nil {
+		return fmt.Errorf("multisigs: %w", err)
+	}
+	if p.DynamicFee != nil {
+		if p.Fee == 0 {
+			return errDynamicFeeWithoutFee
+		}
+		if err := p.DynamicFee.Verify(); err != nil {
+			return fmt.Errorf("dynamic fee: %w", err)
+		}
+	}
+	if p.Warp != nil {
+		if err := p.Warp.Verify(); err != nil {
+			return fmt.Errorf("warp: %w", err)
+		}
+	}
+	if _, err := payloadValidators(p.PayloadValidators); err != nil {
+		return fmt.Errorf("payload validators: %w", err)
+	}
+	return verifyPayloadRules(p.PayloadRules, p)
+}
+
+// isPermissioned returns true iff blocks must be signed by an allowed signer
+func (p *ChainParams) isPermissioned() bool {
+	return len(p.Signers) > 0
+}
+
+// signsBlocks returns true iff every block after the genesis block must be
+// signed
+func (p *ChainParams) signsBlocks() bool {
+	return p.isPermissioned() || p.Fee > 0 || p.Transfers || p.Claims || p.hasACLs() || p.Reveals || p.Encryption || p.hasFeeds() || p.hasWarp() || p.hasMultisigs() || p.Accounts
+}
+
+// isFeeExempt returns true iff [addr] pays no fees
+func (p *ChainParams) isFeeExempt(addr ids.ShortID) bool {
+	for _, exempt := range p.FeeExempt {
+		if exempt == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin returns true iff [addr] may sign signer operations
+func (p *ChainParams) isAdmin(addr ids.ShortID) bool {
+	for _, admin := range p.Admins {
+		if admin == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPayloadSize returns errPayloadTooLarge if any byte of [data] past
+// the max payload size is non-zero
+func (p *ChainParams) verifyPayloadSize(data [dataLen]byte) error {
+	for _, b := range data[p.MaxPayloadSize:] {
+		if b != 0 {
+			return errPayloadTooLarge
+		}
+	}
+	return nil
+}
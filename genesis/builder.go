@@ -0,0 +1,124 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// Package genesis builds the genesis bytes of chains that use the timestamp
+// VM from human-readable inputs.
+package genesis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// CB58 data is decoded from cb58, which is how the genesis bytes encode
+	// data
+	CB58 Encoding = "cb58"
+	// Hex data is decoded from hex, with or without a 0x prefix
+	Hex Encoding = "hex"
+	// UTF8 data is the bytes of the string
+	UTF8 Encoding = "utf8"
+
+	// dataLen is the length of a piece of data in a block
+	dataLen = 32
+)
+
+var (
+	errUnknownEncoding = errors.New("unknown data encoding")
+	errRoundTrip       = errors.New("genesis bytes don't parse to the given genesis")
+)
+
+// Encoding is how a piece of data is written in a [Config]
+type Encoding string
+
+// Decode returns the bytes that [s] encodes
+func (e Encoding) Decode(s string) ([]byte, error) {
+	switch e {
+	case CB58, "":
+		return encoding.CB58.Decode(s)
+	case Hex:
+		return encoding.Hex.Decode(s)
+	case UTF8:
+		return []byte(s), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownEncoding, e)
+	}
+}
+
+// Config is a human-readable genesis
+type Config struct {
+	Params timestampvm.ChainParams `json:"params"`
+	// Encoding of [Data]. Defaults to [CB58].
+	Encoding Encoding `json:"encoding"`
+	// Pieces of data in the genesis block
+	Data        []string                 `json:"data"`
+	Allocations []timestampvm.Allocation `json:"allocations"`
+}
+
+// Build returns the genesis bytes of [c]
+func (c *Config) Build() ([]byte, error) {
+	data := make([][]byte, len(c.Data))
+	for i, encoded := range c.Data {
+		decoded, err := c.Encoding.Decode(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode data %d: %w", i, err)
+		}
+		data[i] = decoded
+	}
+	return Build(c.Params, data, c.Allocations)
+}
+
+// Build returns the genesis bytes of a chain with parameters [params], genesis
+// data [data] and balances [allocations]. The max payload size defaults to 32
+// bytes. The bytes are parsed again to check that they create the given
+// chain.
+func Build(params timestampvm.ChainParams, data [][]byte, allocations []timestampvm.Allocation) ([]byte, error) {
+	if params.MaxPayloadSize == 0 {
+		params.MaxPayloadSize = dataLen
+	}
+	genesis := &timestampvm.Genesis{
+		Params:      params,
+		Data:        make([]string, len(data)),
+		Allocations: allocations,
+	}
+	for i, d := range data {
+		encoded := encoding.EncodeCB58(d)
+		genesis.Data[i] = encoded
+	}
+	genesisBytes, err := timestampvm.BuildGenesisBytes(genesis)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyRoundTrip(genesisBytes, data, allocations); err != nil {
+		return nil, err
+	}
+	return genesisBytes, nil
+}
+
+// verifyRoundTrip returns nil iff [genesisBytes] parse to a genesis with
+// [data] and [allocations]
+func verifyRoundTrip(genesisBytes []byte, data [][]byte, allocations []timestampvm.Allocation) error {
+	parsed, err := timestampvm.ParseGenesis(genesisBytes)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errRoundTrip, err)
+	}
+	if len(parsed.Data) != len(data) || len(parsed.Allocations) != len(allocations) {
+		return errRoundTrip
+	}
+	for i, encoded := range parsed.Data {
+		decoded, err := encoding.DecodeCB58(encoded)
+		if err != nil || !bytes.Equal(decoded, data[i]) {
+			return fmt.Errorf("%w: data %d", errRoundTrip, i)
+		}
+	}
+	for i, allocation := range parsed.Allocations {
+		if allocation != allocations[i] {
+			return fmt.Errorf("%w: allocation %d", errRoundTrip, i)
+		}
+	}
+	return nil
+}
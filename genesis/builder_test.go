@@ -0,0 +1,105 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package genesis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/cb58"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+)
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       Config
+		expectedData []string // cb58
+		expectedErr  error
+	}{
+		{
+			name:         "hex",
+			config:       Config{Encoding: Hex, Data: []string{"0x0102", "ff"}},
+			expectedData: []string{"W8BTQxZ", "VphkHCt"},
+		},
+		{
+			name:         "utf8",
+			config:       Config{Encoding: UTF8, Data: []string{"hi"}},
+			expectedData: []string{mustEncode(t, []byte("hi"))},
+		},
+		{
+			name:         "cb58 by default",
+			config:       Config{Data: []string{"W8BTQxZ"}},
+			expectedData: []string{"W8BTQxZ"},
+		},
+		{
+			name:        "unknown encoding",
+			config:      Config{Encoding: "base64", Data: []string{"AQI="}},
+			expectedErr: errUnknownEncoding,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Allocations = []timestampvm.Allocation{{Address: ids.ShortID{1}, Balance: 2}}
+			genesisBytes, err := test.config.Build()
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v but got %v", test.expectedErr, err)
+			}
+			if test.expectedErr != nil {
+				return
+			}
+
+			genesis, err := timestampvm.ParseGenesis(genesisBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(genesis.Data) != len(test.expectedData) {
+				t.Fatalf("expected %d pieces of data but got %d", len(test.expectedData), len(genesis.Data))
+			}
+			for i, data := range genesis.Data {
+				if data != test.expectedData[i] {
+					t.Fatalf("expected data %d to be %s but got %s", i, test.expectedData[i], data)
+				}
+			}
+			if len(genesis.Allocations) != 1 || genesis.Allocations[0] != test.config.Allocations[0] {
+				t.Fatalf("unexpected allocations %v", genesis.Allocations)
+			}
+		})
+	}
+}
+
+// Assert that a genesis the VM would refuse isn't built
+func TestBuildInvalid(t *testing.T) {
+	config := Config{Params: timestampvm.ChainParams{MaxPayloadSize: 1}, Encoding: Hex, Data: []string{"0102"}}
+	if _, err := config.Build(); err == nil {
+		t.Fatal("expected data larger than the max payload size to be refused")
+	}
+}
+
+func mustEncode(t *testing.T, b []byte) string {
+	encoded, err := cb58.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add("0x0102")
+	f.Add("W8BTQxZ")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, s string) {
+		for _, encoding := range []Encoding{CB58, Hex, UTF8} {
+			decoded, err := encoding.Decode(s)
+			if err != nil {
+				continue
+			}
+			if _, err := Build(timestampvm.ChainParams{}, [][]byte{decoded}, nil); err != nil && len(decoded) <= dataLen {
+				t.Fatalf("couldn't build genesis with %d bytes of %s data: %s", len(decoded), encoding, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,137 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/cb58"
+)
+
+func TestGenesisRoundTrip(t *testing.T) {
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: 8,
+			PayloadRules:   []PayloadRule{NonZeroPayloadRule},
+		},
+		Data: []string{"Abj82M"}, // cb58 of 0x01
+	}
+	genesisBytes, err := BuildGenesisBytes(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseGenesis(genesisBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Params.MaxPayloadSize != 8 || len(parsed.Params.PayloadRules) != 1 || parsed.Params.PayloadRules[0] != NonZeroPayloadRule {
+		t.Fatalf("expected params %+v but got %+v", genesis.Params, parsed.Params)
+	}
+	data, err := parsed.decodeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data[0] != ([dataLen]byte{1}) {
+		t.Fatalf("expected genesis data [1] but got %v", data)
+	}
+}
+
+func TestGenesisVerify(t *testing.T) {
+	zeroData, err := cb58.Encode(make([]byte, dataLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		genesis     Genesis
+		expectedErr error
+	}{
+		{
+			name:        "payload size too large",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen + 1}},
+			expectedErr: errBadGenesisPayloadSize,
+		},
+		{
+			name:        "duplicate allocation",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Fee: 1}, Allocations: []Allocation{{Address: ids.ShortID{1}}, {Address: ids.ShortID{1}}}},
+			expectedErr: errDuplicateAddress,
+		},
+		{
+			name:        "data larger than max payload size",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: 1}, Data: []string{"W8BTQxZ"}}, // cb58 of 0x0102
+			expectedErr: errPayloadTooLarge,
+		},
+		{
+			name:        "negative max clock skew",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, MaxClockSkew: Duration{Duration: -time.Second}}},
+			expectedErr: errBadMaxClockSkew,
+		},
+		{
+			name:        "negative min block interval",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, MinBlockInterval: Duration{Duration: -time.Second}}},
+			expectedErr: errBadMinBlockInterval,
+		},
+		{
+			name:        "median time past window too large",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, MedianTimePastWindow: maxMedianTimeWindow + 1}},
+			expectedErr: errBadMedianTimeWindow,
+		},
+		{
+			name:        "unknown payload rule",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{"prime"}}},
+			expectedErr: errUnknownPayloadRule,
+		},
+		{
+			name:        "digest rule with short payloads",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: 20, PayloadRules: []PayloadRule{DigestPayloadRule}}},
+			expectedErr: errDigestPayloadSize,
+		},
+		{
+			name:        "conflicting payload rules",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{KeyValuePayloadRule, DocumentPayloadRule}}},
+			expectedErr: errConflictingRules,
+		},
+		{
+			name:        "unknown payload validator",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadValidators: []PayloadValidatorConfig{{Type: "checksum"}}}},
+			expectedErr: errUnknownValidator,
+		},
+		{
+			name:        "genesis data fails payload validator",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadValidators: []PayloadValidatorConfig{{Type: SizeValidatorType, MinSize: 1}}}, Data: []string{"1c7hwa"}}, // cb58 of 0x00
+			expectedErr: errPayloadSizeOutRange,
+		},
+		{
+			name:        "genesis data breaks payload rule",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{NonZeroPayloadRule}}, Data: []string{zeroData}},
+			expectedErr: errZeroPayload,
+		},
+		{
+			name:        "genesis data isn't a key-value operation",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{KeyValuePayloadRule}}, Data: []string{zeroData}},
+			expectedErr: errBadKVOp,
+		},
+		{
+			name:        "admins without signers",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Admins: []ids.ShortID{{1}}}},
+			expectedErr: errAdminsWithoutSigner,
+		},
+		{
+			name:        "duplicate signer",
+			genesis:     Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Signers: []ids.ShortID{{1}, {1}}}},
+			expectedErr: errDuplicateAddress,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.genesis.Verify(); !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected error %v but got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
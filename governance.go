@@ -0,0 +1,702 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+// The chain parameters that governance can change
+const (
+	// MaxPayloadSizeParam is the max payload size, in bytes
+	MaxPayloadSizeParam GovernanceParam = iota + 1
+	// FeeParam is the fee charged for each piece of data
+	FeeParam
+	// MaxClockSkewParam is the max clock skew, in seconds
+	MaxClockSkewParam
+)
+
+const (
+	paramChangeLen = 8 + 1 + 8
+	paramSlotLen   = 8 + 1
+
+	// maxClockSkewSeconds is the longest max clock skew that fits in a
+	// time.Duration
+	maxClockSkewSeconds = math.MaxInt64 / uint64(time.Second)
+)
+
+var (
+	errGovernanceDisabled      = errors.New("chain doesn't have governance")
+	errGovernanceWithoutSigner = errors.New("governance requires a signer set")
+	errTooManyVotes            = errors.New("block has too many governance votes")
+	errUnknownParam            = errors.New("unknown governance parameter")
+	errBadParamValue           = errors.New("governance parameter value is out of range")
+	errActivationNotFuture     = errors.New("parameter change's activation height isn't after its vote's block")
+	errNotVoter                = errors.New("governance vote isn't signed by an allowed signer")
+	errDuplicateVote           = errors.New("signer already voted for the parameter change")
+	errParamChangePassed       = errors.New("a change of the parameter at that activation height already passed")
+	errBadParamChange          = fmt.Errorf("parameter change must be %d bytes", paramChangeLen)
+
+	paramNames = map[GovernanceParam]string{
+		MaxPayloadSizeParam: "maxPayloadSize",
+		FeeParam:            "fee",
+		MaxClockSkewParam:   "maxClockSkew",
+	}
+)
+
+// GovernanceParam is a chain parameter that the allowed signers can change
+// by voting
+type GovernanceParam byte
+
+// String returns the name of [p] in the API
+func (p GovernanceParam) String() string {
+	if name, ok := paramNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("GovernanceParam(%d)", byte(p))
+}
+
+// parseGovernanceParam returns the parameter whose name in the API is [name]
+func parseGovernanceParam(name string) (GovernanceParam, error) {
+	for p, n := range paramNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q", errUnknownParam, name)
+}
+
+// ParamChange sets a chain parameter to a new value from an activation
+// height on. Of the changes of a parameter at one activation height, at most
+// one can pass.
+type ParamChange struct {
+	Param GovernanceParam
+	Value uint64
+	// Height of the first block that the new value applies to
+	ActivationHeight uint64
+}
+
+// paramSlot is a parameter at an activation height
+type paramSlot struct {
+	param            GovernanceParam
+	activationHeight uint64
+}
+
+func (c ParamChange) slot() paramSlot {
+	return paramSlot{param: c.Param, activationHeight: c.ActivationHeight}
+}
+
+// bytes returns the encoding of [c], which starts with the key of its slot,
+// so that changes are stored in activation order
+func (c ParamChange) bytes() []byte {
+	b := c.slot().key()
+	return binary.BigEndian.AppendUint64(b, c.Value)
+}
+
+func (s paramSlot) key() []byte {
+	b := make([]byte, 0, paramChangeLen)
+	b = binary.BigEndian.AppendUint64(b, s.activationHeight)
+	return append(b, byte(s.param))
+}
+
+func parseParamChange(b []byte) (ParamChange, error) {
+	if len(b) != paramChangeLen {
+		return ParamChange{}, errBadParamChange
+	}
+	return ParamChange{
+		ActivationHeight: binary.BigEndian.Uint64(b),
+		Param:            GovernanceParam(b[8]),
+		Value:            binary.BigEndian.Uint64(b[paramSlotLen:]),
+	}, nil
+}
+
+// apply sets [c]'s parameter in [p]. [c] must have been verified.
+func (c ParamChange) apply(p *ChainParams) {
+	switch c.Param {
+	case MaxPayloadSizeParam:
+		p.MaxPayloadSize = int(c.Value)
+	case FeeParam:
+		p.Fee = c.Value
+	case MaxClockSkewParam:
+		p.MaxClockSkew.Duration = time.Duration(c.Value) * time.Second
+	}
+}
+
+// verifyParamChange returns nil iff [c] sets a known parameter to a value the
+// chain can enforce
+func (vm *VM) verifyParamChange(c ParamChange) error {
+	switch c.Param {
+	case MaxPayloadSizeParam:
+		if c.Value == 0 || c.Value > dataLen {
+			return errBadParamValue
+		}
+		// Some payload rules need the whole 32 bytes of each piece of data
+		params := vm.genesis.Params
+		c.apply(&params)
+		return verifyPayloadRules(allPayloadRules(&params, &vm.upgrades), &params)
+	case FeeParam:
+	case MaxClockSkewParam:
+		if c.Value > maxClockSkewSeconds {
+			return errBadParamValue
+		}
+	default:
+		return errUnknownParam
+	}
+	return nil
+}
+
+// GovernanceVote is an allowed signer's vote for a parameter change. A
+// change passes once more than half of the allowed signers voted for it.
+type GovernanceVote struct {
+	Param            GovernanceParam `serialize:"true"`
+	Value            uint64          `serialize:"true"`
+	ActivationHeight uint64          `serialize:"true"`
+	// Voter's signature of the vote's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	voterAddr  ids.ShortID // address of this vote's voter, if [voterKnown]
+	voterKnown bool
+}
+
+// change returns the parameter change [v] votes for
+func (v *GovernanceVote) change() ParamChange {
+	return ParamChange{
+		Param:            v.Param,
+		Value:            v.Value,
+		ActivationHeight: v.ActivationHeight,
+	}
+}
+
+// Hash returns the hash of [v] on the chain [chainID], which is what the
+// voter signs
+func (v *GovernanceVote) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+1+8+8)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, governanceVoteTag)
+	msg = append(msg, byte(v.Param))
+	msg = binary.BigEndian.AppendUint64(msg, v.Value)
+	msg = binary.BigEndian.AppendUint64(msg, v.ActivationHeight)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [v]'s signature to [key]'s signature of [v] on the chain
+// [chainID]. [key]'s address is the voter.
+func (v *GovernanceVote) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(v.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(v.Sig[:], sig)
+	v.voterKnown = false
+	return nil
+}
+
+// voter returns the address that signed [v] on the chain [chainID]
+func (v *GovernanceVote) voter(chainID ids.ID) (ids.ShortID, error) {
+	if v.voterKnown {
+		return v.voterAddr, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(v.Hash(chainID), v.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	v.voterAddr = key.Address()
+	v.voterKnown = true
+	return v.voterAddr, nil
+}
+
+// governance is the tally of votes and the passed parameter changes after
+// some block. Accepted votes and changes are read from state as needed.
+type governance struct {
+	vm *VM
+	// Allowed signers, who may vote and whose votes count
+	signers *signerSet
+	voters  map[ParamChange]set.Set[ids.ShortID]
+	passed  map[paramSlot]bool
+	// Changes that passed in processing blocks, oldest first
+	processing []ParamChange
+}
+
+// governanceAfter returns the governance tally after [blk] is accepted
+func (vm *VM) governanceAfter(blk *Block) (*governance, error) {
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := vm.state.getSigners()
+	if err != nil {
+		return nil, err
+	}
+	g := &governance{
+		vm:      vm,
+		signers: signers,
+		voters:  make(map[ParamChange]set.Set[ids.ShortID]),
+		passed:  make(map[paramSlot]bool),
+	}
+	// A block's votes are counted against the signers after its parent, so
+	// they are applied before its signer operations
+	for i := len(processing) - 1; i >= 0; i-- {
+		ancestor := processing[i]
+		for j := range ancestor.Votes {
+			if _, err := g.apply(&ancestor.Votes[j]); err != nil {
+				return nil, err
+			}
+		}
+		for _, op := range ancestor.Ops {
+			g.signers.apply(op)
+		}
+	}
+	return g, nil
+}
+
+func (g *governance) getVoters(c ParamChange) (set.Set[ids.ShortID], error) {
+	if voters, ok := g.voters[c]; ok {
+		return voters, nil
+	}
+	voters, err := g.vm.state.getVoters(c)
+	if err != nil {
+		return nil, err
+	}
+	g.voters[c] = voters
+	return voters, nil
+}
+
+func (g *governance) isPassed(s paramSlot) (bool, error) {
+	if passed, ok := g.passed[s]; ok {
+		return passed, nil
+	}
+	passed, err := g.vm.state.hasParamChange(s)
+	if err != nil {
+		return false, err
+	}
+	g.passed[s] = passed
+	return passed, nil
+}
+
+// verify returns nil iff [v] may be accepted in a block at [height]
+func (g *governance) verify(v *GovernanceVote, height uint64) error {
+	c := v.change()
+	if err := g.vm.verifyParamChange(c); err != nil {
+		return err
+	}
+	if c.ActivationHeight <= height {
+		return errActivationNotFuture
+	}
+	voter, err := v.voter(g.vm.ctx.ChainID)
+	if err != nil {
+		return err
+	}
+	if !g.signers.signers.Contains(voter) {
+		return errNotVoter
+	}
+	passed, err := g.isPassed(c.slot())
+	if err != nil {
+		return errDatabaseGet
+	}
+	if passed {
+		return errParamChangePassed
+	}
+	voters, err := g.getVoters(c)
+	if err != nil {
+		return errDatabaseGet
+	}
+	if voters.Contains(voter) {
+		return errDuplicateVote
+	}
+	return nil
+}
+
+// apply counts [v] without checking it and returns true iff its change
+// passed with it
+func (g *governance) apply(v *GovernanceVote) (bool, error) {
+	voter, err := v.voter(g.vm.ctx.ChainID)
+	if err != nil {
+		return false, err
+	}
+	c := v.change()
+	voters, err := g.getVoters(c)
+	if err != nil {
+		return false, err
+	}
+	voters.Add(voter)
+
+	// Votes of addresses that are no longer allowed signers don't count
+	count := 0
+	for addr := range voters {
+		if g.signers.signers.Contains(addr) {
+			count++
+		}
+	}
+	if 2*count <= g.signers.signers.Len() {
+		return false, nil
+	}
+	g.passed[c.slot()] = true
+	g.processing = append(g.processing, c)
+	return true, nil
+}
+
+// paramsAt returns the parameters of a block at [height] whose parent is
+// [parent]: the genesis parameters with every change that passed at or
+// before [parent] and activates at or before [height]
+func (vm *VM) paramsAt(parent *Block, height uint64) (*ChainParams, error) {
+	if !vm.genesis.Params.Governance {
+		return &vm.genesis.Params, nil
+	}
+	changes, err := vm.state.getParamChanges()
+	if err != nil {
+		return nil, err
+	}
+	g, err := vm.governanceAfter(parent)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, g.processing...)
+	slices.SortStableFunc(changes, func(a, b ParamChange) int {
+		return cmp.Compare(a.ActivationHeight, b.ActivationHeight)
+	})
+	params := vm.genesis.Params
+	for _, c := range changes {
+		if c.ActivationHeight > height {
+			break
+		}
+		c.apply(&params)
+	}
+	return &params, nil
+}
+
+// activeParams returns the parameters that apply to [b]
+func (b *Block) activeParams() (*ChainParams, error) {
+	if b.params != nil {
+		return b.params, nil
+	}
+	if !b.vm.genesis.Params.Governance || b.Height() == 0 {
+		return &b.vm.genesis.Params, nil
+	}
+	parent, err := b.vm.getBlock(b.Parent())
+	if err != nil {
+		return nil, errDatabaseGet
+	}
+	params, err := b.vm.paramsAt(parent, b.Height())
+	if err != nil {
+		return nil, err
+	}
+	b.params = params
+	return params, nil
+}
+
+// nextParams returns the parameters of the next block after the last
+// accepted block
+func (vm *VM) nextParams() (*ChainParams, error) {
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return nil, err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return nil, err
+	}
+	return vm.paramsAt(lastAccepted, lastAccepted.Height()+1)
+}
+
+// verifyVotes returns nil iff each of [b]'s votes is by an allowed signer
+// that hasn't voted for its change yet, for a valid change that activates
+// after [b] and whose parameter hasn't had a change at that height pass
+func (b *Block) verifyVotes(parent *Block) error {
+	switch {
+	case len(b.Votes) == 0:
+		return nil
+	case !b.vm.genesis.Params.Governance:
+		return errGovernanceDisabled
+	case len(b.Votes) > maxBatchSize:
+		return errTooManyVotes
+	}
+	g, err := b.vm.governanceAfter(parent)
+	if err != nil {
+		return err
+	}
+	for i := range b.Votes {
+		v := &b.Votes[i]
+		if err := g.verify(v, b.Height()); err != nil {
+			return err
+		}
+		if _, err := g.apply(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyVotes records [b]'s votes and the changes that passed with them.
+// The votes are counted against the signers after [b]'s parent, so they
+// must be applied before [b]'s signer operations.
+func (b *Block) applyVotes() error {
+	if len(b.Votes) == 0 {
+		return nil
+	}
+	parent, err := b.vm.getBlock(b.Parent())
+	if err != nil {
+		return errDatabaseGet
+	}
+	g, err := b.vm.governanceAfter(parent)
+	if err != nil {
+		return err
+	}
+	for i := range b.Votes {
+		v := &b.Votes[i]
+		voter, err := v.voter(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		passed, err := g.apply(v)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.putVote(v.change(), voter); err != nil {
+			return err
+		}
+		if passed {
+			if err := b.vm.state.putParamChange(v.change()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withinPayloadSize returns the entries whose data fits in the max payload
+// size of [params] and the entries whose data doesn't, which wait in the
+// mempool until the max payload size grows again
+func withinPayloadSize(params *ChainParams, entries []MempoolEntry) ([]MempoolEntry, []MempoolEntry) {
+	var fit, oversized []MempoolEntry
+	for _, entry := range entries {
+		if params.verifyPayloadSize(entry.data) == nil {
+			fit = append(fit, entry)
+		} else {
+			oversized = append(oversized, entry)
+		}
+	}
+	return fit, oversized
+}
+
+// pendingVotes holds governance votes submitted over the API until they are
+// accepted
+type pendingVotes struct {
+	lock  sync.Mutex
+	votes []GovernanceVote
+}
+
+// add adds [v] to the pending votes
+func (p *pendingVotes) add(v GovernanceVote) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.votes = append(p.votes, v)
+}
+
+// next returns the pending votes that can be accepted in a child of
+// [parent], in the order they were submitted
+func (p *pendingVotes) next(vm *VM, parent *Block) []GovernanceVote {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.votes) == 0 {
+		return nil
+	}
+	g, err := vm.governanceAfter(parent)
+	if err != nil {
+		return nil
+	}
+	var next []GovernanceVote
+	for i := range p.votes {
+		v := &p.votes[i]
+		if g.verify(v, parent.Height()+1) != nil {
+			continue
+		}
+		if _, err := g.apply(v); err != nil {
+			continue
+		}
+		next = append(next, *v)
+		if len(next) == maxBatchSize {
+			break
+		}
+	}
+	return next
+}
+
+// prune drops the pending votes that can't be accepted after
+// [lastAccepted], the last accepted block, such as votes whose activation
+// height was reached or whose voter's vote was already accepted
+func (p *pendingVotes) prune(vm *VM, lastAccepted *Block) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	g, err := vm.governanceAfter(lastAccepted)
+	if err != nil {
+		return err
+	}
+	p.votes, err = pruneOps(vm.opJournal, voteKind, p.votes, func(v *GovernanceVote) bool {
+		return g.verify(v, lastAccepted.Height()+1) == nil
+	})
+	return err
+}
+
+// len returns the number of pending votes
+func (p *pendingVotes) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.votes)
+}
+
+// APIParamChange is a parameter change in the API
+type APIParamChange struct {
+	// Name of the parameter: maxPayloadSize, fee or maxClockSkew
+	Param string      `json:"param"`
+	Value json.Uint64 `json:"value"`
+	// Height of the first block that the new value applies to
+	ActivationHeight json.Uint64 `json:"activationHeight"`
+}
+
+func newAPIParamChange(c ParamChange) APIParamChange {
+	return APIParamChange{
+		Param:            c.Param.String(),
+		Value:            json.Uint64(c.Value),
+		ActivationHeight: json.Uint64(c.ActivationHeight),
+	}
+}
+
+// change returns the parameter change [c] is the API repr. of
+func (c *APIParamChange) change() (ParamChange, error) {
+	param, err := parseGovernanceParam(c.Param)
+	if err != nil {
+		return ParamChange{}, err
+	}
+	return ParamChange{
+		Param:            param,
+		Value:            uint64(c.Value),
+		ActivationHeight: uint64(c.ActivationHeight),
+	}, nil
+}
+
+// SubmitGovernanceVoteArgs are the arguments to SubmitGovernanceVote
+type SubmitGovernanceVoteArgs struct {
+	APIParamChange
+	// Base 58 repr. of the voter's signature of the vote
+	Signature string `json:"signature"`
+
+	change ParamChange
+	sig    [secp256k1.SignatureLen]byte
+}
+
+func (a *SubmitGovernanceVoteArgs) validate(v *argValidator) {
+	var err error
+	a.change, err = a.APIParamChange.change()
+	v.add("param", err)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// SubmitGovernanceVoteReply is the reply from SubmitGovernanceVote
+type SubmitGovernanceVoteReply struct {
+	// Address that signed the vote
+	Voter ids.ShortID `json:"voter"`
+}
+
+// SubmitGovernanceVote is an API method to propose an allowed signer's
+// signed vote for a parameter change. The vote must be acceptable after the
+// last accepted block.
+func (s *Service) SubmitGovernanceVote(_ *http.Request, args *SubmitGovernanceVoteArgs, reply *SubmitGovernanceVoteReply) error {
+	if !s.backend.chainParams().Governance {
+		return errGovernanceDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	v := GovernanceVote{
+		Param:            args.change.Param,
+		Value:            args.change.Value,
+		ActivationHeight: args.change.ActivationHeight,
+		Sig:              args.sig,
+	}
+	voter, err := v.voter(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	if err := s.backend.addVote(v); err != nil {
+		return err
+	}
+	reply.Voter = voter
+	return nil
+}
+
+// GetGovernanceReply is the reply from GetGovernance
+type GetGovernanceReply struct {
+	// Parameters of the next block after the last accepted block
+	MaxPayloadSize int         `json:"maxPayloadSize"`
+	Fee            json.Uint64 `json:"fee"`
+	// In seconds
+	MaxClockSkew json.Uint64 `json:"maxClockSkew"`
+	// Accepted changes that activate after the next block, in activation
+	// order
+	Scheduled []APIParamChange `json:"scheduled"`
+}
+
+// GetGovernance returns the governed parameters that apply to the next
+// block and the accepted changes that are scheduled after it
+func (s *Service) GetGovernance(_ *http.Request, _ *struct{}, reply *GetGovernanceReply) error {
+	if !s.backend.chainParams().Governance {
+		return errGovernanceDisabled
+	}
+	params, scheduled, err := s.backend.governance()
+	if err != nil {
+		return err
+	}
+	reply.MaxPayloadSize = params.MaxPayloadSize
+	reply.Fee = json.Uint64(params.Fee)
+	reply.MaxClockSkew = json.Uint64(params.MaxClockSkew.Duration / time.Second)
+	reply.Scheduled = make([]APIParamChange, len(scheduled))
+	for i, c := range scheduled {
+		reply.Scheduled[i] = newAPIParamChange(c)
+	}
+	return nil
+}
+
+// GetProposalVotesReply is the reply from GetProposalVotes
+type GetProposalVotesReply struct {
+	// Addresses whose votes for the change were accepted
+	Voters []ids.ShortID `json:"voters"`
+	Passed bool          `json:"passed"`
+}
+
+// GetProposalVotes returns the accepted votes for the parameter change
+// [args] and whether it passed
+func (s *Service) GetProposalVotes(_ *http.Request, args *APIParamChange, reply *GetProposalVotesReply) error {
+	if !s.backend.chainParams().Governance {
+		return errGovernanceDisabled
+	}
+	c, err := args.change()
+	if err != nil {
+		return err
+	}
+	voters, passed, err := s.backend.proposalVotes(c)
+	if err != nil {
+		return err
+	}
+	reply.Voters = voters
+	reply.Passed = passed
+	return nil
+}
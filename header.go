@@ -0,0 +1,96 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/wrappers"
+)
+
+// A block's bytes start with the codec version followed by the parent ID,
+// height and timestamp, in the order of [Block]'s fields.
+const (
+	headerParentOffset    = wrappers.ShortLen
+	headerHeightOffset    = headerParentOffset + ids.IDLen
+	headerTimestampOffset = headerHeightOffset + wrappers.LongLen
+	headerLen             = headerTimestampOffset + wrappers.LongLen
+
+	// A stored block is its codec version, the length of the block's bytes,
+	// the block's bytes and its status, in the order of [blkWrapper]'s fields.
+	wrappedBlockOffset = wrappers.ShortLen + wrappers.IntLen
+)
+
+var errBadHeader = errors.New("block bytes are too short or have an unknown codec version")
+
+// blockHeader is the part of a block that's needed to walk the chain
+type blockHeader struct {
+	ID        ids.ID
+	ParentID  ids.ID
+	Height    uint64
+	Timestamp int64
+}
+
+// parseHeader returns the header of the block [blockBytes] without decoding
+// its data
+func parseHeader(blockBytes []byte) (blockHeader, error) {
+	if len(blockBytes) < headerLen {
+		return blockHeader{}, errBadHeader
+	}
+	switch binary.BigEndian.Uint16(blockBytes) {
+	case codecVersion, signedCodecVersion, transferCodecVersion, namespacedCodecVersion, namespacedSignedCodecVersion, namespacedTransferCodecVersion:
+	default:
+		return blockHeader{}, errBadHeader
+	}
+	return blockHeader{
+		ID:        hashing.ComputeHash256Array(blockBytes),
+		ParentID:  ids.ID(blockBytes[headerParentOffset:headerHeightOffset]),
+		Height:    binary.BigEndian.Uint64(blockBytes[headerHeightOffset:]),
+		Timestamp: int64(binary.BigEndian.Uint64(blockBytes[headerTimestampOffset:])),
+	}, nil
+}
+
+// header returns the header of [b]
+func (b *Block) header() blockHeader {
+	return blockHeader{
+		ID:        b.ID(),
+		ParentID:  b.Parent(),
+		Height:    b.Height(),
+		Timestamp: b.Tmstmp,
+	}
+}
+
+// unwrapBlock returns the block's bytes and status in the stored block
+// [wrappedBytes]. The block's bytes aren't copied.
+func unwrapBlock(wrappedBytes []byte) ([]byte, choices.Status, error) {
+	if len(wrappedBytes) < wrappedBlockOffset {
+		return nil, choices.Unknown, errBadHeader
+	}
+	blockLen := uint64(binary.BigEndian.Uint32(wrappedBytes[wrappers.ShortLen:]))
+	if uint64(len(wrappedBytes)) != wrappedBlockOffset+blockLen+wrappers.IntLen {
+		return nil, choices.Unknown, errBadHeader
+	}
+	blockEnd := wrappedBlockOffset + int(blockLen)
+	status := choices.Status(binary.BigEndian.Uint32(wrappedBytes[blockEnd:]))
+	return wrappedBytes[wrappedBlockOffset:blockEnd], status, nil
+}
+
+// getHeader returns the header and bytes of the block with ID [blkID],
+// looking at processing blocks before the database. Stored blocks' data
+// isn't decoded.
+func (vm *VM) getHeader(blkID ids.ID) (blockHeader, []byte, error) {
+	if blk, ok := vm.processing.get(blkID); ok {
+		return blk.header(), blk.Bytes(), nil
+	}
+	blockBytes, _, err := vm.state.getBlockBytes(blkID)
+	if err != nil {
+		return blockHeader{}, nil, err
+	}
+	header, err := parseHeader(blockBytes)
+	return header, blockBytes, err
+}
@@ -0,0 +1,516 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	// hookGasExport is the name of the global through which a metered hook
+	// module exports the gas it has left. A run is out of gas once it's
+	// negative.
+	hookGasExport = "timestampvm.gas"
+
+	wasmHeaderLen = 8
+
+	wasmImportSection = 2
+	wasmGlobalSection = 6
+	wasmExportSection = 7
+	wasmCodeSection   = 10
+
+	wasmImportFunc   = 0x00
+	wasmImportTable  = 0x01
+	wasmImportMemory = 0x02
+	wasmImportGlobal = 0x03
+	wasmExportGlobal = 0x03
+
+	wasmI32      = 0x7f
+	wasmI64      = 0x7e
+	wasmMutable  = 0x01
+	wasmVoidType = 0x40
+)
+
+var (
+	errBadHookModule = errors.New("hook module isn't a valid WASM module")
+	errHookUnmetered = errors.New("hook module uses an instruction that can't be metered")
+)
+
+// wasmSectionOrder is the position of each non-custom section in a module,
+// by section ID: types, imports, functions, tables, memories, globals,
+// exports, start, elements, data count, code and data
+var wasmSectionOrder = map[byte]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 7, 8: 8, 9: 9, 12: 10, 10: 11, 11: 12}
+
+// meterHookModule returns [wasm] with every basic block of its functions
+// charging its number of instructions to a gas global, which starts at
+// [gasLimit] and is exported as [hookGasExport]. Bulk memory and table
+// instructions also charge their length. The block that would take the
+// global below zero traps before it runs, so a run without host calls is
+// stopped after the same instructions on every node. [wasm] must be valid,
+// so that none of its instructions refer to the globals that are added.
+func meterHookModule(wasm []byte, gasLimit uint64) ([]byte, error) {
+	sections, err := parseWasmSections(wasm)
+	if err != nil {
+		return nil, err
+	}
+	var importedGlobals, definedGlobals uint32
+	if s := sections.find(wasmImportSection); s != nil {
+		if importedGlobals, err = countImportedGlobals(s.content); err != nil {
+			return nil, err
+		}
+	}
+	if s := sections.find(wasmGlobalSection); s != nil {
+		if definedGlobals, _, err = readWasmU32(s.content, 0); err != nil {
+			return nil, err
+		}
+	}
+	// The gas global and the scratch global that holds the length of a bulk
+	// instruction come after the others, so no index changes
+	gas := importedGlobals + definedGlobals
+	if gas > math.MaxUint32-2 {
+		return nil, errBadHookModule
+	}
+
+	global := []byte{wasmI64, wasmMutable, 0x42}
+	global = appendWasmS64(global, int64(gasLimit))
+	global = append(global, 0x0b)
+	if err := sections.appendEntry(wasmGlobalSection, global); err != nil {
+		return nil, err
+	}
+	// i32.const 0
+	if err := sections.appendEntry(wasmGlobalSection, []byte{wasmI32, wasmMutable, 0x41, 0x00, 0x0b}); err != nil {
+		return nil, err
+	}
+	export := appendWasmName(nil, hookGasExport)
+	export = append(export, wasmExportGlobal)
+	export = appendWasmU32(export, gas)
+	if err := sections.appendEntry(wasmExportSection, export); err != nil {
+		return nil, err
+	}
+	code := sections.find(wasmCodeSection)
+	if code == nil {
+		return nil, errBadHookModule
+	}
+	if code.content, err = meterCode(code.content, gas); err != nil {
+		return nil, err
+	}
+	return sections.bytes(), nil
+}
+
+// wasmSection is a section of a WASM module
+type wasmSection struct {
+	id      byte
+	content []byte
+}
+
+type wasmSections []*wasmSection
+
+func parseWasmSections(wasm []byte) (wasmSections, error) {
+	if len(wasm) < wasmHeaderLen || string(wasm[:4]) != "\x00asm" || binary.LittleEndian.Uint32(wasm[4:]) != 1 {
+		return nil, errBadHookModule
+	}
+	var sections wasmSections
+	for pos := wasmHeaderLen; pos < len(wasm); {
+		id := wasm[pos]
+		size, next, err := readWasmU32(wasm, pos+1)
+		if err != nil || uint64(next)+uint64(size) > uint64(len(wasm)) {
+			return nil, errBadHookModule
+		}
+		pos = next + int(size)
+		sections = append(sections, &wasmSection{id: id, content: wasm[next:pos]})
+	}
+	return sections, nil
+}
+
+// find returns the section with [id], or nil if there's none
+func (s wasmSections) find(id byte) *wasmSection {
+	for _, section := range s {
+		if section.id == id {
+			return section
+		}
+	}
+	return nil
+}
+
+// appendEntry appends [entry] to the vector of the section with [id],
+// adding the section where it belongs if there's none
+func (s *wasmSections) appendEntry(id byte, entry []byte) error {
+	section := s.find(id)
+	if section == nil {
+		i := len(*s)
+		for j, other := range *s {
+			if order, ok := wasmSectionOrder[other.id]; ok && order > wasmSectionOrder[id] {
+				i = j
+				break
+			}
+		}
+		section = &wasmSection{id: id, content: []byte{0}}
+		*s = append((*s)[:i], append(wasmSections{section}, (*s)[i:]...)...)
+	}
+	count, pos, err := readWasmU32(section.content, 0)
+	if err != nil || count == math.MaxUint32 {
+		return errBadHookModule
+	}
+	content := appendWasmU32(nil, count+1)
+	content = append(content, section.content[pos:]...)
+	section.content = append(content, entry...)
+	return nil
+}
+
+// bytes returns the module made of [s]
+func (s wasmSections) bytes() []byte {
+	b := []byte{0x00, 'a', 's', 'm', 1, 0, 0, 0}
+	for _, section := range s {
+		b = append(b, section.id)
+		b = appendWasmU32(b, uint32(len(section.content)))
+		b = append(b, section.content...)
+	}
+	return b
+}
+
+// countImportedGlobals returns the number of globals imported by the import
+// section [content]
+func countImportedGlobals(content []byte) (uint32, error) {
+	count, pos, err := readWasmU32(content, 0)
+	if err != nil {
+		return 0, err
+	}
+	var globals uint32
+	for i := uint32(0); i < count; i++ {
+		// Module and field names
+		for j := 0; j < 2; j++ {
+			var n uint32
+			if n, pos, err = readWasmU32(content, pos); err != nil {
+				return 0, err
+			}
+			pos += int(n)
+		}
+		if pos >= len(content) {
+			return 0, errBadHookModule
+		}
+		kind := content[pos]
+		pos++
+		switch kind {
+		case wasmImportFunc:
+			_, pos, err = readWasmU32(content, pos)
+		case wasmImportTable:
+			pos, err = skipWasmLimits(content, pos+1)
+		case wasmImportMemory:
+			pos, err = skipWasmLimits(content, pos)
+		case wasmImportGlobal:
+			globals++
+			pos += 2
+		default:
+			err = errBadHookModule
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return globals, nil
+}
+
+func skipWasmLimits(b []byte, pos int) (int, error) {
+	if pos >= len(b) {
+		return 0, errBadHookModule
+	}
+	hasMax := b[pos]&1 == 1
+	_, pos, err := readWasmU32(b, pos+1)
+	if err == nil && hasMax {
+		_, pos, err = readWasmU32(b, pos)
+	}
+	return pos, err
+}
+
+// meterCode returns the code section [content] with each function body
+// charging the global [gas] for its basic blocks. The scratch global follows
+// [gas].
+func meterCode(content []byte, gas uint32) ([]byte, error) {
+	count, pos, err := readWasmU32(content, 0)
+	if err != nil {
+		return nil, err
+	}
+	metered := appendWasmU32(nil, count)
+	for i := uint32(0); i < count; i++ {
+		var size uint32
+		if size, pos, err = readWasmU32(content, pos); err != nil {
+			return nil, err
+		}
+		if uint64(pos)+uint64(size) > uint64(len(content)) {
+			return nil, errBadHookModule
+		}
+		body, err := meterBody(content[pos:pos+int(size)], gas)
+		if err != nil {
+			return nil, err
+		}
+		metered = appendWasmU32(metered, uint32(len(body)))
+		metered = append(metered, body...)
+		pos += int(size)
+	}
+	return metered, nil
+}
+
+// meterBody returns the function body [body] with a charge to the global
+// [gas] at the start of each basic block. A basic block ends with an
+// instruction that may branch, or that is branched to the end of. Bulk
+// instructions start a new basic block, after a charge of their length.
+func meterBody(body []byte, gas uint32) ([]byte, error) {
+	// Locals
+	count, pos, err := readWasmU32(body, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		if _, pos, err = readWasmU32(body, pos); err != nil {
+			return nil, err
+		}
+		pos++
+	}
+	if pos > len(body) {
+		return nil, errBadHookModule
+	}
+
+	metered := append([]byte(nil), body[:pos]...)
+	start, instructions := pos, int64(0)
+	for pos < len(body) {
+		opcode := body[pos]
+		if isWasmBulkInstruction(body, pos) {
+			if instructions > 0 {
+				metered = appendGasCharge(metered, gas, instructions)
+			}
+			metered = append(metered, body[start:pos]...)
+			metered = appendLengthCharge(metered, gas)
+			start, instructions = pos, 0
+		}
+		if pos, err = skipWasmInstruction(body, pos); err != nil {
+			return nil, err
+		}
+		instructions++
+		switch opcode {
+		case 0x00, 0x02, 0x03, 0x04, 0x05, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f:
+			// unreachable, block, loop, if, else, end, br, br_if, br_table
+			// and return
+			metered = appendGasCharge(metered, gas, instructions)
+			metered = append(metered, body[start:pos]...)
+			start, instructions = pos, 0
+		}
+	}
+	if instructions != 0 {
+		// The body must end with the function's end
+		return nil, errBadHookModule
+	}
+	return metered, nil
+}
+
+// appendGasCharge appends to [b] the instructions that take [cost] from the
+// global [gas] and trap if it goes below zero
+func appendGasCharge(b []byte, gas uint32, cost int64) []byte {
+	b = append(b, 0x23) // global.get
+	b = appendWasmU32(b, gas)
+	b = append(b, 0x42) // i64.const
+	b = appendWasmS64(b, cost)
+	return appendGasSub(b, gas)
+}
+
+// appendLengthCharge appends to [b] the instructions that take the i32 on
+// top of the stack, the length of a bulk instruction, from the global [gas]
+// and trap if it goes below zero. The length is kept on the stack through the
+// scratch global after [gas].
+func appendLengthCharge(b []byte, gas uint32) []byte {
+	scratch := gas + 1
+	b = append(b, 0x24) // global.set
+	b = appendWasmU32(b, scratch)
+	b = append(b, 0x23) // global.get
+	b = appendWasmU32(b, scratch)
+	b = append(b, 0x23) // global.get
+	b = appendWasmU32(b, gas)
+	b = append(b, 0x23) // global.get
+	b = appendWasmU32(b, scratch)
+	b = append(b, 0xad) // i64.extend_i32_u
+	return appendGasSub(b, gas)
+}
+
+// appendGasSub appends to [b] the instructions that subtract the i64 on top
+// of the stack from the global [gas] below it and trap if the result is below
+// zero
+func appendGasSub(b []byte, gas uint32) []byte {
+	b = append(b, 0x7d, 0x24) // i64.sub, global.set
+	b = appendWasmU32(b, gas)
+	b = append(b, 0x23) // global.get
+	b = appendWasmU32(b, gas)
+	// i64.const 0, i64.lt_s, if, unreachable, end
+	return append(b, 0x42, 0x00, 0x53, 0x04, wasmVoidType, 0x00, 0x0b)
+}
+
+// isWasmBulkInstruction returns true iff the instruction at [pos] of [b]
+// takes a number of bytes or table elements from the top of the stack:
+// memory.init, memory.copy, memory.fill, table.init, table.copy, table.grow
+// or table.fill
+func isWasmBulkInstruction(b []byte, pos int) bool {
+	if b[pos] != 0xfc {
+		return false
+	}
+	op, _, err := readWasmU32(b, pos+1)
+	if err != nil {
+		return false
+	}
+	switch op {
+	case 8, 10, 11, 12, 14, 15, 17:
+		return true
+	default:
+		return false
+	}
+}
+
+// skipWasmInstruction returns the position after the instruction at [pos]
+// of [b]. SIMD and other instructions of proposals the interpreter doesn't
+// enable aren't metered.
+func skipWasmInstruction(b []byte, pos int) (int, error) {
+	opcode := b[pos]
+	pos++
+	switch {
+	case opcode >= 0x28 && opcode <= 0x3e:
+		// Loads and stores, with an alignment and an offset
+		return skipWasmLEBs(b, pos, 2)
+	case opcode >= 0x45 && opcode <= 0xc4:
+		// Numeric instructions
+		return pos, nil
+	}
+	switch opcode {
+	case 0x00, 0x01, 0x05, 0x0b, 0x0f, 0x1a, 0x1b, 0xd1:
+		// Instructions without immediates
+		return pos, nil
+	case 0x02, 0x03, 0x04, 0x0c, 0x0d, 0x10, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x41, 0x42, 0xd2:
+		// Block types, labels, functions, variables, tables, integer consts
+		return skipWasmLEBs(b, pos, 1)
+	case 0x11:
+		// call_indirect, with a type and a table
+		return skipWasmLEBs(b, pos, 2)
+	case 0x0e:
+		// br_table, with a vector of labels and a default label
+		n, pos, err := readWasmU32(b, pos)
+		if err != nil {
+			return 0, err
+		}
+		return skipWasmLEBs(b, pos, int(n)+1)
+	case 0x1c:
+		// select, with a vector of value types
+		n, pos, err := readWasmU32(b, pos)
+		if err != nil {
+			return 0, err
+		}
+		return skipWasmBytes(b, pos, int(n))
+	case 0x3f, 0x40, 0xd0:
+		// memory.size and memory.grow, with a memory, and ref.null, with a
+		// heap type
+		return skipWasmBytes(b, pos, 1)
+	case 0x43:
+		return skipWasmBytes(b, pos, 4)
+	case 0x44:
+		return skipWasmBytes(b, pos, 8)
+	case 0xfc:
+		return skipWasmMiscInstruction(b, pos)
+	}
+	return 0, errHookUnmetered
+}
+
+// skipWasmMiscInstruction returns the position after the 0xfc prefixed
+// instruction whose subopcode is at [pos] of [b]
+func skipWasmMiscInstruction(b []byte, pos int) (int, error) {
+	op, pos, err := readWasmU32(b, pos)
+	if err != nil {
+		return 0, err
+	}
+	switch op {
+	case 0, 1, 2, 3, 4, 5, 6, 7:
+		// Saturating truncations
+		return pos, nil
+	case 8:
+		// memory.init, with a data segment and a memory
+		if pos, err = skipWasmLEBs(b, pos, 1); err != nil {
+			return 0, err
+		}
+		return skipWasmBytes(b, pos, 1)
+	case 9, 13, 15, 16, 17:
+		// data.drop, elem.drop, table.grow, table.size and table.fill
+		return skipWasmLEBs(b, pos, 1)
+	case 10:
+		// memory.copy, with two memories
+		return skipWasmBytes(b, pos, 2)
+	case 11:
+		// memory.fill, with a memory
+		return skipWasmBytes(b, pos, 1)
+	case 12, 14:
+		// table.init and table.copy
+		return skipWasmLEBs(b, pos, 2)
+	}
+	return 0, errHookUnmetered
+}
+
+// readWasmU32 returns the unsigned LEB128 integer at [pos] of [b] and the
+// position after it
+func readWasmU32(b []byte, pos int) (uint32, int, error) {
+	var v uint64
+	for shift := 0; shift < 35; shift += 7 {
+		if pos >= len(b) {
+			break
+		}
+		c := b[pos]
+		pos++
+		v |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			if v > math.MaxUint32 {
+				break
+			}
+			return uint32(v), pos, nil
+		}
+	}
+	return 0, 0, errBadHookModule
+}
+
+// skipWasmLEBs returns the position after the [n] LEB128 integers at [pos]
+// of [b]
+func skipWasmLEBs(b []byte, pos int, n int) (int, error) {
+	for i := 0; i < n; i++ {
+		end := min(pos+10, len(b))
+		for pos < end && b[pos]&0x80 != 0 {
+			pos++
+		}
+		if pos == end {
+			return 0, errBadHookModule
+		}
+		pos++
+	}
+	return pos, nil
+}
+
+// skipWasmBytes returns the position after the [n] bytes at [pos] of [b]
+func skipWasmBytes(b []byte, pos int, n int) (int, error) {
+	if n > len(b)-pos {
+		return 0, errBadHookModule
+	}
+	return pos + n, nil
+}
+
+func appendWasmU32(b []byte, v uint32) []byte {
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendWasmS64(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendWasmName(b []byte, name string) []byte {
+	b = appendWasmU32(b, uint32(len(name)))
+	return append(b, name...)
+}
@@ -0,0 +1,678 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/database/prefixdb"
+	"github.com/ava-labs/avalanchego/database/versiondb"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/logging"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// hookModuleName is the name of the host module whose functions a hook
+	// imports
+	hookModuleName = "env"
+	// hookEntrypoint is the function a hook exports, which is called as
+	// on_payload(height i64, timestamp i64, index i32) -> i32 for each
+	// accepted piece of data. A non-zero result is a failure.
+	hookEntrypoint = "on_payload"
+
+	defaultHookGasLimit    = 1_000_000
+	defaultHookMemoryPages = 16
+	defaultHookTimeout     = 100 * time.Millisecond
+	maxHookMemoryPages     = 1 << 16
+	maxHookKeyLen          = 64
+	maxHookValueLen        = 1024
+	maxHookEvents          = 16
+	maxHookEventLen        = 1024
+	hookResultKeyLen       = 8 + 2
+	hookResultHeaderLen    = 1 + 8
+
+	hookSucceeded byte = 1
+)
+
+var (
+	hookPrefix       = []byte("hooks")
+	hookResultPrefix = []byte("result")
+	hookEventPrefix  = []byte("event")
+	hookIndexPrefix  = []byte("index")
+	hookNextKey      = []byte("next")
+
+	errHooksDisabled     = errors.New("WASM hooks aren't enabled on this node")
+	errNoHookModule      = errors.New("hook config must have a module path")
+	errBadHookGas        = fmt.Errorf("hook gas limit must be at most %d", math.MaxInt64)
+	errBadHookMemory     = fmt.Errorf("hook max memory must be at most %d pages", maxHookMemoryPages)
+	errBadHookTimeout    = errors.New("hook timeout must not be negative")
+	errBadHookEntrypoint = fmt.Errorf("hook module must export %s(i64, i64, i32) -> i32", hookEntrypoint)
+	errHookPending       = errors.New("hooks haven't run on the block yet")
+	errNoHookIndexEntry  = errors.New("hooks didn't derive an index entry with that key")
+	errBadHookIndexKey   = fmt.Errorf("hook index key must be base 58 repr. of 1 to %d bytes", maxHookKeyLen)
+	errBadHookResult     = errors.New("hook result is malformed")
+	errHookTimeout       = errors.New("hook ran out of time")
+	errHooksHalted       = errors.New("hooks were halted because a run ran out of time")
+
+	// Failures of a run. A run that fails has no effects.
+	errHookOutOfGas      = errors.New("hook ran out of gas")
+	errHookTrap          = errors.New("hook trapped")
+	errHookExit          = errors.New("hook returned a failure")
+	errHookMemoryAccess  = errors.New("hook accessed memory out of bounds")
+	errHookTooManyEvents = fmt.Errorf("hook emitted more than %d events", maxHookEvents)
+	errHookEntryTooLarge = fmt.Errorf("hook index entries must have keys of 1 to %d bytes and values of at most %d bytes", maxHookKeyLen, maxHookValueLen)
+	errHookEventTooLarge = fmt.Errorf("hook events must be at most %d bytes", maxHookEventLen)
+)
+
+// HookConfig configures a WASM module that runs on each piece of accepted
+// data, to derive an index or emit events on this node.
+// The module is instantiated afresh for each piece of data and can only
+// import the functions of the "env" host module:
+//
+//	payload(ptr i32): writes the 32 bytes of data to memory at ptr
+//	put_index(keyPtr, keyLen, valuePtr, valueLen i32): sets an entry of the
+//	    derived index
+//	emit(ptr, len i32): emits an event
+//
+// and must export on_payload(height i64, timestamp i64, index i32) -> i32,
+// which returns zero on success.
+type HookConfig struct {
+	// Path of the WASM module
+	Module string `json:"module"`
+	// Max gas of one run. Each instruction costs 1 gas, bulk memory and
+	// table instructions also cost 1 gas for each byte or element, and each
+	// call of a host function costs 1 gas plus 1 gas for each byte passed to
+	// or from the host. Defaults to 1,000,000.
+	GasLimit uint64 `json:"gasLimit"`
+	// Max memory of the module, in 64 KiB pages. Defaults to 16.
+	MaxMemoryPages uint32 `json:"maxMemoryPages"`
+	// Max duration of one run. Gas stops runs the same way on every node, so
+	// this is only a backstop for a node too slow for the gas limit: once a
+	// run is out of time, the node stops running the hook instead of
+	// recording a result that depends on its speed. Defaults to 100ms.
+	Timeout Duration `json:"timeout"`
+}
+
+// Verify returns nil iff [c] is a valid hook config
+func (c *HookConfig) Verify() error {
+	switch {
+	case c.Module == "":
+		return errNoHookModule
+	case c.GasLimit > math.MaxInt64:
+		return errBadHookGas
+	case c.MaxMemoryPages > maxHookMemoryPages:
+		return errBadHookMemory
+	case c.Timeout.Duration < 0:
+		return errBadHookTimeout
+	}
+	return nil
+}
+
+// hookResult is the outcome of running the hook on a piece of data
+type hookResult struct {
+	err     error
+	gasUsed uint64
+	// Set only if the run succeeded
+	events       [][]byte
+	indexEntries [][2][]byte
+}
+
+// bytes returns the encoding of [r] in the result index:
+// succeeded | gas used | failure message
+func (r *hookResult) bytes() []byte {
+	b := make([]byte, 1, hookResultHeaderLen)
+	if r.err == nil {
+		b[0] = hookSucceeded
+	}
+	b = binary.BigEndian.AppendUint64(b, r.gasUsed)
+	if r.err != nil {
+		b = append(b, r.err.Error()...)
+	}
+	return b
+}
+
+// hookRun is the state of one run of the hook, which its host functions
+// read and write
+type hookRun struct {
+	data [dataLen]byte
+	// Gas the run had left when it returned. Negative if it ran out.
+	gasLeft int64
+	result  *hookResult
+	// Set when a host function stops the run
+	err error
+}
+
+type hookRunKey struct{}
+
+// consume charges [gas] to [run] through the gas global of [mod], the run's
+// instance, which its instructions are charged to as well. The run stops
+// once it's out of gas.
+func (run *hookRun) consume(mod api.Module, gas uint64) {
+	global := mod.ExportedGlobal(hookGasExport).(api.MutableGlobal)
+	left := int64(global.Get()) - int64(gas)
+	global.Set(uint64(left))
+	if left < 0 {
+		run.stop(errHookOutOfGas)
+	}
+}
+
+// stop stops [run] with [err]. wazero turns the panic into an error of the
+// call, and [err] is kept because wazero's error wraps it as text.
+func (run *hookRun) stop(err error) {
+	run.err = err
+	panic(err)
+}
+
+// read returns [length] bytes of [mod]'s memory at [ptr]
+func (run *hookRun) read(mod api.Module, ptr, length uint32) []byte {
+	run.consume(mod, uint64(length))
+	b, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		run.stop(errHookMemoryAccess)
+	}
+	return append([]byte(nil), b...)
+}
+
+// hookRunner runs the hook on each piece of accepted data, in the order it
+// was accepted, on its own goroutine so that a slow hook doesn't hold up
+// consensus. The results, events and index entries aren't part of the
+// chain's state; they are written to a database on this node with the
+// height of the last block the hook ran on, so the hook resumes after that
+// block when the node restarts.
+// Runs are deterministic: the module has no access to the clock or to
+// randomness, its instructions are metered, and a run that fails, by
+// trapping, returning non-zero or running out of gas, has no effects. Only
+// running out of time depends on the node's speed, so a run that does halts
+// the runner without recording the block's results.
+// Shutdown is called with the context lock held, so stop doesn't wait for
+// the runner, which may be waiting for the lock.
+type hookRunner struct {
+	vm       *VM
+	runtime  wazero.Runtime
+	module   wazero.CompiledModule
+	gasLimit uint64
+	timeout  time.Duration
+	log      logging.Logger
+	// Set once a run ran out of time, after which the hook doesn't run
+	halted atomic.Bool
+
+	db      *versiondb.Database
+	results database.Database // hookResultKey -> hookResult
+	events  database.Database // hookResultKey + event number -> event
+	index   database.Database // key -> value of the derived index
+
+	accepted chan struct{}
+	shutdown chan struct{}
+}
+
+// newHookRunner compiles the module of [config] and starts running it on the
+// data accepted after the last block it ran on
+func newHookRunner(vm *VM, config HookConfig, db database.Database, log logging.Logger) (*hookRunner, error) {
+	if config.GasLimit == 0 {
+		config.GasLimit = defaultHookGasLimit
+	}
+	if config.MaxMemoryPages == 0 {
+		config.MaxMemoryPages = defaultHookMemoryPages
+	}
+	if config.Timeout.Duration == 0 {
+		config.Timeout.Duration = defaultHookTimeout
+	}
+	wasm, err := os.ReadFile(config.Module)
+	if err != nil {
+		return nil, err
+	}
+
+	// The interpreter behaves the same on every platform
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().
+		WithMemoryLimitPages(config.MaxMemoryPages).
+		WithCloseOnContextDone(true),
+	)
+	hostModule := runtime.NewHostModuleBuilder(hookModuleName)
+	hostModule.NewFunctionBuilder().WithFunc(hostPayload).Export("payload")
+	hostModule.NewFunctionBuilder().WithFunc(hostPutIndex).Export("put_index")
+	hostModule.NewFunctionBuilder().WithFunc(hostEmit).Export("emit")
+	if _, err := hostModule.Instantiate(ctx); err != nil {
+		_ = runtime.Close(ctx)
+		return nil, err
+	}
+	module, err := compileHook(ctx, runtime, wasm, config.GasLimit)
+	if err != nil {
+		_ = runtime.Close(ctx)
+		return nil, err
+	}
+
+	versioned := versiondb.New(db)
+	h := &hookRunner{
+		vm:       vm,
+		runtime:  runtime,
+		module:   module,
+		gasLimit: config.GasLimit,
+		timeout:  config.Timeout.Duration,
+		log:      log,
+		db:       versioned,
+		results:  prefixdb.New(hookResultPrefix, versioned),
+		events:   prefixdb.New(hookEventPrefix, versioned),
+		index:    prefixdb.New(hookIndexPrefix, versioned),
+		accepted: make(chan struct{}, 1),
+		shutdown: make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+// compileHook compiles [wasm] with its instructions metered, so that each
+// instance starts with [gasLimit] gas
+func compileHook(ctx context.Context, runtime wazero.Runtime, wasm []byte, gasLimit uint64) (wazero.CompiledModule, error) {
+	// Metering adds globals, so a module that refers to them is only caught
+	// before it's metered
+	original, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return nil, err
+	}
+	if err := original.Close(ctx); err != nil {
+		return nil, err
+	}
+	metered, err := meterHookModule(wasm, gasLimit)
+	if err != nil {
+		return nil, err
+	}
+	module, err := runtime.CompileModule(ctx, metered)
+	if err != nil {
+		return nil, err
+	}
+	if !hasHookEntrypoint(module) {
+		return nil, errBadHookEntrypoint
+	}
+	return module, nil
+}
+
+// hasHookEntrypoint returns true iff [module] exports the hook's entrypoint
+// with the right signature
+func hasHookEntrypoint(module wazero.CompiledModule) bool {
+	def, ok := module.ExportedFunctions()[hookEntrypoint]
+	if !ok {
+		return false
+	}
+	params, results := def.ParamTypes(), def.ResultTypes()
+	return len(params) == 3 && params[0] == api.ValueTypeI64 && params[1] == api.ValueTypeI64 && params[2] == api.ValueTypeI32 &&
+		len(results) == 1 && results[0] == api.ValueTypeI32
+}
+
+func hostPayload(ctx context.Context, mod api.Module, ptr uint32) {
+	run := ctx.Value(hookRunKey{}).(*hookRun)
+	run.consume(mod, 1+dataLen)
+	if !mod.Memory().Write(ptr, run.data[:]) {
+		run.stop(errHookMemoryAccess)
+	}
+}
+
+func hostPutIndex(ctx context.Context, mod api.Module, keyPtr, keyLen, valuePtr, valueLen uint32) {
+	run := ctx.Value(hookRunKey{}).(*hookRun)
+	run.consume(mod, 1)
+	if keyLen == 0 || keyLen > maxHookKeyLen || valueLen > maxHookValueLen {
+		run.stop(errHookEntryTooLarge)
+	}
+	key := run.read(mod, keyPtr, keyLen)
+	value := run.read(mod, valuePtr, valueLen)
+	run.result.indexEntries = append(run.result.indexEntries, [2][]byte{key, value})
+}
+
+func hostEmit(ctx context.Context, mod api.Module, ptr, length uint32) {
+	run := ctx.Value(hookRunKey{}).(*hookRun)
+	run.consume(mod, 1)
+	switch {
+	case length > maxHookEventLen:
+		run.stop(errHookEventTooLarge)
+	case len(run.result.events) == maxHookEvents:
+		run.stop(errHookTooManyEvents)
+	}
+	run.result.events = append(run.result.events, run.read(mod, ptr, length))
+}
+
+// runHook runs the hook on [data], the [index]th piece of data of the block
+// at [height] with time [timestamp]
+func (h *hookRunner) runHook(height uint64, timestamp int64, index int, data [dataLen]byte) *hookResult {
+	run := &hookRun{
+		data:    data,
+		gasLeft: int64(h.gasLimit),
+		result:  &hookResult{},
+	}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), hookRunKey{}, run), h.timeout)
+	defer cancel()
+
+	err := h.call(ctx, run, height, timestamp, index)
+	result := run.result
+	result.gasUsed = h.gasLimit - uint64(max(run.gasLeft, 0))
+	if err != nil {
+		// A failed run has no effects
+		*result = hookResult{err: err, gasUsed: result.gasUsed}
+	}
+	return result
+}
+
+func (h *hookRunner) call(ctx context.Context, run *hookRun, height uint64, timestamp int64, index int) error {
+	// Each run gets a fresh instance, so runs don't depend on each other
+	mod, err := h.runtime.InstantiateModule(ctx, h.module, wazero.NewModuleConfig().WithName(""))
+	if err == nil {
+		defer mod.Close(context.Background())
+		var results []uint64
+		results, err = mod.ExportedFunction(hookEntrypoint).Call(ctx, uint64(height), uint64(timestamp), uint64(index))
+		run.gasLeft = int64(mod.ExportedGlobal(hookGasExport).Get())
+		if err == nil && api.DecodeI32(results[0]) != 0 {
+			return errHookExit
+		}
+	}
+	switch {
+	case err == nil:
+		return nil
+	case run.err != nil:
+		return run.err
+	case run.gasLeft < 0:
+		// The metered instructions trap once they're out of gas
+		return errHookOutOfGas
+	case ctx.Err() != nil:
+		return errHookTimeout
+	default:
+		return errHookTrap
+	}
+}
+
+// notify wakes the runner up once a block is accepted
+func (h *hookRunner) notify() {
+	select {
+	case h.accepted <- struct{}{}:
+	default:
+	}
+}
+
+// stopped returns true iff [h] was stopped
+func (h *hookRunner) stopped() bool {
+	select {
+	case <-h.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops running the hook
+func (h *hookRunner) stop() {
+	close(h.shutdown)
+}
+
+func (h *hookRunner) run() {
+	defer h.runtime.Close(context.Background())
+
+	for {
+		ran, err := h.runNext()
+		if err == errHookTimeout {
+			h.halted.Store(true)
+			h.log.Error("halting hooks because a run ran out of time",
+				zap.Duration("timeout", h.timeout),
+			)
+			return
+		}
+		if err != nil {
+			h.log.Warn("couldn't run hook", zap.Error(err))
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-h.accepted:
+		case <-h.shutdown:
+			return
+		}
+	}
+}
+
+// runNext runs the hook on the data of the accepted block after the last one
+// it ran on. Returns false if there's no such block.
+func (h *hookRunner) runNext() (bool, error) {
+	height, blk, err := h.nextBlock()
+	if err != nil || blk == nil {
+		return false, err
+	}
+
+	// The hook runs without the context lock, so it doesn't hold up
+	// consensus
+	results := make([]*hookResult, len(blk.Dt))
+	for i, d := range blk.Dt {
+		results[i] = h.runHook(height, blk.Tmstmp, i, d)
+		// Whether a run runs out of time depends on the node's speed, so
+		// the block's results aren't recorded
+		if results[i].err == errHookTimeout {
+			return false, errHookTimeout
+		}
+	}
+
+	h.vm.ctx.Lock.Lock()
+	defer h.vm.ctx.Lock.Unlock()
+
+	// The database is closed once the VM is shut down
+	if h.stopped() {
+		return false, nil
+	}
+	return true, h.record(height, results)
+}
+
+// nextBlock returns the height after the last block the hook ran on and the
+// accepted block at that height, which is nil if no block is accepted at
+// that height yet
+func (h *hookRunner) nextBlock() (uint64, *Block, error) {
+	h.vm.ctx.Lock.Lock()
+	defer h.vm.ctx.Lock.Unlock()
+
+	if h.stopped() {
+		return 0, nil, nil
+	}
+	height, err := database.WithDefault(database.GetUInt64, h.db, hookNextKey, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	lastAcceptedID, err := h.vm.state.getLastAccepted()
+	if err != nil {
+		return 0, nil, err
+	}
+	lastAccepted, err := h.vm.state.getBlock(lastAcceptedID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if height > lastAccepted.Height() {
+		return 0, nil, nil
+	}
+	blkID, err := h.vm.state.getBlockIDAtHeight(height)
+	if err == database.ErrNotFound {
+		// A node that state synced has no blocks before its checkpoint, so
+		// the hook doesn't run on them
+		return height, &Block{}, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	blk, err := h.vm.state.getBlock(blkID)
+	return height, blk, err
+}
+
+// record writes [results], the outcome of the hook on each piece of data of
+// the block at [height]
+func (h *hookRunner) record(height uint64, results []*hookResult) error {
+	defer h.db.Abort()
+
+	for i, result := range results {
+		key := hookResultKey(height, i)
+		if err := h.results.Put(key, result.bytes()); err != nil {
+			return err
+		}
+		for j, event := range result.events {
+			if err := h.events.Put(append(key, byte(j)), event); err != nil {
+				return err
+			}
+		}
+		for _, entry := range result.indexEntries {
+			if err := h.index.Put(entry[0], entry[1]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := database.PutUInt64(h.db, hookNextKey, height+1); err != nil {
+		return err
+	}
+	return h.db.Commit()
+}
+
+// hookResultKey is the key of the result of the hook on the [index]th piece
+// of data of the block at [height]
+func hookResultKey(height uint64, index int) []byte {
+	b := make([]byte, hookResultKeyLen, hookResultKeyLen+1)
+	binary.BigEndian.PutUint64(b, height)
+	binary.BigEndian.PutUint16(b[8:], uint16(index))
+	return b
+}
+
+// APIHookResult is the outcome of the hook on a piece of accepted data
+type APIHookResult struct {
+	Success bool        `json:"success"`
+	GasUsed json.Uint64 `json:"gasUsed"`
+	// Why the run failed. Empty if it succeeded.
+	Error string `json:"error,omitempty"`
+	// Base 58 repr. of the events the hook emitted
+	Events []string `json:"events"`
+}
+
+// blockResults returns the outcome of the hook on each piece of [blk]'s data
+func (h *hookRunner) blockResults(blk *Block) ([]APIHookResult, error) {
+	next, err := database.WithDefault(database.GetUInt64, h.db, hookNextKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	if blk.Height() >= next {
+		if h.halted.Load() {
+			return nil, errHooksHalted
+		}
+		return nil, errHookPending
+	}
+	results := make([]APIHookResult, len(blk.Dt))
+	for i := range blk.Dt {
+		key := hookResultKey(blk.Height(), i)
+		b, err := h.results.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < hookResultHeaderLen {
+			return nil, errBadHookResult
+		}
+		results[i] = APIHookResult{
+			Success: b[0] == hookSucceeded,
+			GasUsed: json.Uint64(binary.BigEndian.Uint64(b[1:])),
+			Error:   string(b[hookResultHeaderLen:]),
+		}
+		if results[i].Events, err = h.runEvents(key); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// runEvents returns the base 58 repr. of the events of the run with
+// [key]
+func (h *hookRunner) runEvents(key []byte) ([]string, error) {
+	it := h.events.NewIteratorWithPrefix(key)
+	defer it.Release()
+
+	events := []string{}
+	for it.Next() {
+		events = append(events, encoding.EncodeCB58(it.Value()))
+	}
+	return events, it.Error()
+}
+
+func (vm *VM) wasmHooks() *hookRunner {
+	return vm.hooks
+}
+
+// GetHookResultsArgs are the arguments to GetHookResults
+type GetHookResultsArgs struct {
+	BlockID ids.ID `json:"blockID"`
+}
+
+// GetHookResultsReply is the reply from GetHookResults
+type GetHookResultsReply struct {
+	// Outcome of the hook on each piece of the block's data, in the block's
+	// order
+	Results []APIHookResult `json:"results"`
+}
+
+// GetHookResults returns the outcome of this node's WASM hook on each piece
+// of the accepted block [args.BlockID]'s data
+func (s *Service) GetHookResults(r *http.Request, args *GetHookResultsArgs, reply *GetHookResultsReply) error {
+	ctx := requestContext(r)
+	hooks := s.backend.wasmHooks()
+	if hooks == nil {
+		return errHooksDisabled
+	}
+	blk, err := s.backend.lookupBlock(ctx, args.BlockID)
+	if err != nil || blk.Status() != choices.Accepted {
+		return ErrBlockNotFound
+	}
+	reply.Results, err = hooks.blockResults(blk)
+	return err
+}
+
+// GetHookIndexArgs are the arguments to GetHookIndex
+type GetHookIndexArgs struct {
+	// Base 58 repr. of the key
+	Key string `json:"key"`
+
+	key []byte
+}
+
+func (a *GetHookIndexArgs) validate(v *argValidator) {
+	a.key = v.bytes("key", a.Key, 1, maxHookKeyLen, errBadHookIndexKey)
+}
+
+// GetHookIndexReply is the reply from GetHookIndex
+type GetHookIndexReply struct {
+	// Base 58 repr. of the value
+	Value string `json:"value"`
+}
+
+// GetHookIndex returns the value that this node's WASM hook last set for
+// [args.Key] in its derived index
+func (s *Service) GetHookIndex(_ *http.Request, args *GetHookIndexArgs, reply *GetHookIndexReply) error {
+	hooks := s.backend.wasmHooks()
+	if hooks == nil {
+		return errHooksDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	value, err := hooks.index.Get(args.key)
+	if err == database.ErrNotFound {
+		return errNoHookIndexEntry
+	}
+	if err != nil {
+		return err
+	}
+	reply.Value = encoding.EncodeCB58(value)
+	return nil
+}
@@ -0,0 +1,180 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+
+	"github.com/ava-labs/avalanchego/utils/json"
+)
+
+const (
+	// AcceptedEvent is the event of the acceptance of a block
+	AcceptedEvent = "accepted"
+	// TombstoneEvent is the event of the removal of a piece of an accepted
+	// block's data from this node's namespace index, or of its replacement
+	// with its hash, under its namespace's retention policy
+	TombstoneEvent = "tombstone"
+
+	defaultIndexerPageSize = 25
+	maxIndexerPageSize     = 100
+
+	acceptedEventKind  byte = 0
+	tombstoneEventKind byte = 1
+
+	// An event is its kind followed by the height of its block. A tombstone
+	// is also followed by the index of the data in the block and whether
+	// only its hash is kept.
+	acceptedEventLen  = 1 + 8
+	tombstoneEventLen = acceptedEventLen + 2 + 1
+)
+
+var errBadIndexerEvent = errors.New("invalid indexer event")
+
+// indexerEvent is an entry of the indexer feed: the log of the changes to the
+// accepted chain, as this node serves it, in the order they happened
+type indexerEvent struct {
+	// Position of the event in the feed
+	sequence  uint64
+	height    uint64
+	tombstone bool
+	// Index of the compacted data in its block, and whether only its hash is
+	// kept. Only set for tombstones.
+	index    int
+	hashOnly bool
+}
+
+func (e indexerEvent) bytes() []byte {
+	if !e.tombstone {
+		b := make([]byte, acceptedEventLen)
+		b[0] = acceptedEventKind
+		binary.BigEndian.PutUint64(b[1:], e.height)
+		return b
+	}
+	b := make([]byte, tombstoneEventLen)
+	b[0] = tombstoneEventKind
+	binary.BigEndian.PutUint64(b[1:], e.height)
+	binary.BigEndian.PutUint16(b[acceptedEventLen:], uint16(e.index))
+	if e.hashOnly {
+		b[acceptedEventLen+2] = 1
+	}
+	return b
+}
+
+func parseIndexerEvent(sequence uint64, b []byte) (indexerEvent, error) {
+	e := indexerEvent{sequence: sequence}
+	switch {
+	case len(b) == acceptedEventLen && b[0] == acceptedEventKind:
+	case len(b) == tombstoneEventLen && b[0] == tombstoneEventKind:
+		e.tombstone = true
+		e.index = int(binary.BigEndian.Uint16(b[acceptedEventLen:]))
+		e.hashOnly = b[acceptedEventLen+2] == 1
+	default:
+		return indexerEvent{}, errBadIndexerEvent
+	}
+	e.height = binary.BigEndian.Uint64(b[1:])
+	return e, nil
+}
+
+func (vm *VM) indexerEvents(ctx context.Context, start uint64, limit int) ([]indexerEvent, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getIndexerEvents(ctx, start, limit)
+}
+
+// GetIndexerFeedArgs are the arguments to GetIndexerFeed
+type GetIndexerFeedArgs struct {
+	// The nextCursor of the previous call. If empty, the feed starts at its
+	// first event.
+	Cursor string `json:"cursor"`
+	// Max number of events to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *GetIndexerFeedArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultIndexerPageSize, maxIndexerPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: indexerFeedCursor, direction: forward})
+}
+
+// APITombstone is a piece of an accepted block's data that this node no
+// longer serves in full
+type APITombstone struct {
+	// Index of the data in its block
+	Index json.Uint32 `json:"index"`
+	// [DeletedStatus] or [HashOnlyStatus]
+	Status string `json:"status"`
+}
+
+// IndexerEvent is a change to the accepted chain
+type IndexerEvent struct {
+	// Position of the event in the feed
+	Sequence json.Uint64 `json:"sequence"`
+	// One of [AcceptedEvent] or [TombstoneEvent]
+	Kind string `json:"kind"`
+	// Height of the block the event is about
+	Height json.Uint64 `json:"height"`
+	// The accepted block, for an [AcceptedEvent]
+	Block *APIBlock `json:"block,omitempty"`
+	// The compacted data, for a [TombstoneEvent]
+	Tombstone *APITombstone `json:"tombstone,omitempty"`
+}
+
+// GetIndexerFeedReply is the reply from GetIndexerFeed
+type GetIndexerFeedReply struct {
+	Events []IndexerEvent `json:"events"`
+	// Cursor of the events after these. It's returned at the end of the feed
+	// too, so that the next call returns the events that happen until then.
+	NextCursor string `json:"nextCursor"`
+}
+
+// GetIndexerFeed returns the changes to the accepted chain after
+// [args.Cursor], in the order they happened on this node: the acceptance of
+// each block and the compaction of its data. Events never change once they
+// are in the feed, so an indexer that stores each page's nextCursor along
+// with the page consumes each event once, even across restarts of either
+// side.
+func (s *Service) GetIndexerFeed(r *http.Request, args *GetIndexerFeedArgs, reply *GetIndexerFeedReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	events, err := s.backend.indexerEvents(ctx, args.start.position, args.limit)
+	if err != nil {
+		return err
+	}
+	next := args.start.position
+	reply.Events = make([]IndexerEvent, len(events))
+	for i, e := range events {
+		event := IndexerEvent{
+			Sequence: json.Uint64(e.sequence),
+			Kind:     AcceptedEvent,
+			Height:   json.Uint64(e.height),
+		}
+		if e.tombstone {
+			event.Kind = TombstoneEvent
+			event.Tombstone = &APITombstone{Index: json.Uint32(e.index), Status: DeletedStatus}
+			if e.hashOnly {
+				event.Tombstone.Status = HashOnlyStatus
+			}
+		} else {
+			blk, err := s.acceptedBlock(ctx, e.height)
+			if err != nil {
+				return err
+			}
+			apiBlock := newAPIBlock(blk)
+			event.Block = &apiBlock
+		}
+		reply.Events[i] = event
+		next = e.sequence + 1
+	}
+	reply.NextCursor = args.start.at(next).String()
+	return nil
+}
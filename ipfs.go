@@ -0,0 +1,102 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"mime"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	defaultAnchorPageSize = 25
+	maxAnchorPageSize     = 100
+)
+
+var (
+	anchorPrefix = []byte("anchor")
+
+	errAnchoringDisabled = errors.New("IPFS anchoring isn't enabled on this node")
+	errBadCID            = errors.New("CID must be a valid IPFS CID")
+	errUnsupportedHash   = errors.New("CID's content must be hashed with sha2-256")
+	errBadContentType    = errors.New("content type must be a MIME type")
+)
+
+// anchor is IPFS content whose CID was anchored through this node's API.
+// Only the CID's sha2-256 digest is put on the chain; the CID itself and the
+// content type are only known to this node.
+type anchor struct {
+	cid         cid.Cid
+	contentType string
+}
+
+// parseAnchor returns the anchor of the content with CID [s] and content type
+// [contentType], which may be empty
+func parseAnchor(s, contentType string) (anchor, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return anchor{}, errBadCID
+	}
+	hash, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return anchor{}, errBadCID
+	}
+	if hash.Code != multihash.SHA2_256 || len(hash.Digest) != dataLen {
+		return anchor{}, errUnsupportedHash
+	}
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return anchor{}, errBadContentType
+		}
+	}
+	return anchor{
+		cid:         c,
+		contentType: contentType,
+	}, nil
+}
+
+// data returns the piece of data that anchors [a] on the chain, which is the
+// digest of its CID
+func (a anchor) data() [dataLen]byte {
+	// The digest is checked when the anchor is parsed
+	hash, _ := multihash.Decode(a.cid.Hash())
+	var data [dataLen]byte
+	copy(data[:], hash.Digest)
+	return data
+}
+
+func (vm *VM) anchoringEnabled() bool {
+	return vm.config.Load().IPFSAnchoring
+}
+
+// putAnchor records [a] in this node's anchor index. The index isn't part of
+// the chain's state, so it's written to the database immediately.
+func (vm *VM) putAnchor(a anchor) error {
+	return vm.anchorDB.Put(a.cid.Bytes(), []byte(a.contentType))
+}
+
+func (vm *VM) anchors(ctx context.Context, start uint64, limit int) ([]anchor, error) {
+	it := vm.anchorDB.NewIterator()
+	defer it.Release()
+
+	skip(it, start)
+	var anchors []anchor
+	for len(anchors) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		c, err := cid.Cast(it.Key())
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, anchor{
+			cid:         c,
+			contentType: string(it.Value()),
+		})
+	}
+	return anchors, it.Error()
+}
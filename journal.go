@@ -0,0 +1,117 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ava-labs/avalanchego/database"
+)
+
+var errBadJournalEntry = errors.New("journal entry has the wrong length")
+
+// A journal entry is the proposed data, followed by its earliest inclusion
+// time if it has one, then by its namespace if it has one. Each combination
+// has a different length.
+const (
+	// scheduledEntryLen is the length of the journal entry of data with an
+	// earliest inclusion time
+	scheduledEntryLen = dataLen + 8
+	// namespacedEntryLen is the length of the journal entry of data with a
+	// namespace
+	namespacedEntryLen = dataLen + NamespaceLen
+	// scheduledNamespacedEntryLen is the length of the journal entry of data
+	// with an earliest inclusion time and a namespace
+	scheduledNamespacedEntryLen = scheduledEntryLen + NamespaceLen
+)
+
+// journal is a write-ahead log of proposed data.
+// An entry is written before a proposal is acknowledged and is only deleted
+// once the block containing it is decided, so proposals in the mempool or in
+// blocks that were still processing survive an unclean shutdown.
+//
+// Entries are written directly to the underlying database rather than
+// through the VM's versiondb so that each one is durable as soon as it is
+// acknowledged. Deletions go through the versiondb so that they are
+// committed atomically with the decision of the block.
+type journal struct {
+	db      database.Database
+	nextSeq uint64
+}
+
+// newJournal returns the journal stored in [db] and the entries in it, in
+// the order they were written
+func newJournal(db database.Database) (*journal, []MempoolEntry, error) {
+	it := db.NewIterator()
+	defer it.Release()
+
+	j := &journal{db: db}
+	var entries []MempoolEntry
+	for it.Next() {
+		seq, err := database.ParseUInt64(it.Key())
+		if err != nil {
+			return nil, nil, err
+		}
+		value := it.Value()
+		entry := MempoolEntry{seq: seq}
+		switch len(value) {
+		case dataLen:
+		case scheduledEntryLen:
+			entry.notBefore = int64(binary.BigEndian.Uint64(value[dataLen:]))
+		case namespacedEntryLen:
+			copy(entry.namespace[:], value[dataLen:])
+		case scheduledNamespacedEntryLen:
+			entry.notBefore = int64(binary.BigEndian.Uint64(value[dataLen:]))
+			copy(entry.namespace[:], value[scheduledEntryLen:])
+		default:
+			return nil, nil, fmt.Errorf("%w: %d", errBadJournalEntry, seq)
+		}
+		copy(entry.data[:], value)
+		entries = append(entries, entry)
+		j.nextSeq = seq + 1
+	}
+	return j, entries, it.Error()
+}
+
+// append durably writes [data] in [namespace], which isn't put into a block
+// before [notBefore], to the journal
+func (j *journal) append(data [dataLen]byte, namespace [NamespaceLen]byte, notBefore int64) (MempoolEntry, error) {
+	entry := MempoolEntry{
+		seq:       j.nextSeq,
+		data:      data,
+		namespace: namespace,
+		notBefore: notBefore,
+	}
+	value := data[:]
+	if notBefore != 0 {
+		value = binary.BigEndian.AppendUint64(slices.Clone(value), uint64(notBefore))
+	}
+	if namespace != [NamespaceLen]byte{} {
+		value = append(slices.Clip(value), namespace[:]...)
+	}
+	if err := j.db.Put(database.PackUInt64(entry.seq), value); err != nil {
+		return MempoolEntry{}, err
+	}
+	j.nextSeq++
+	return entry, nil
+}
+
+// delete durably removes [entry], which was cancelled before it was put into
+// a block, from the journal
+func (j *journal) delete(entry MempoolEntry) error {
+	return j.db.Delete(database.PackUInt64(entry.seq))
+}
+
+// deleteJournalEntries removes [entries] from the journal stored in [db]
+func deleteJournalEntries(db database.KeyValueDeleter, entries []MempoolEntry) error {
+	for _, entry := range entries {
+		if err := db.Delete(database.PackUInt64(entry.seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+)
+
+// Keys are managed by the client so that signed submissions, such as signer
+// operations, never expose a key to the node they're submitted to.
+
+// GenerateKey returns a new secp256k1 key
+func GenerateKey() (*secp256k1.PrivateKey, error) {
+	return secp256k1.NewPrivateKey()
+}
+
+// ParseKey parses a key in its string form, "PrivateKey-" followed by the
+// cb58 encoding of the key
+func ParseKey(s string) (*secp256k1.PrivateKey, error) {
+	key := &secp256k1.PrivateKey{}
+	if err := key.UnmarshalText([]byte(s)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadKey reads the key in the file at [path], which holds the key's string
+// form
+func LoadKey(path string) (*secp256k1.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(bytes.TrimSpace(keyBytes)))
+}
+
+// SaveKey writes [key] to a new file at [path] that only its owner can read.
+// An existing file isn't overwritten.
+func SaveKey(path string, key *secp256k1.PrivateKey) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(key.String() + "\n"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,319 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// KVKeyLen is the max number of bytes in a key of the key-value state
+	KVKeyLen = 15
+	// KVValueLen is the max number of bytes in a value of the key-value state
+	KVValueLen = 16
+
+	kvPut    byte = 1
+	kvDelete byte = 2
+
+	kvValueStart    = 1 + KVKeyLen
+	kvEntryLen      = KVValueLen + 8
+	kvHistoryKeyLen = KVKeyLen + 8 + 2
+
+	defaultKVPageSize = 25
+	maxKVPageSize     = 100
+)
+
+var (
+	errBadKVOp    = errors.New("data must be a put or delete of a key")
+	errBadKey     = fmt.Errorf("key must be 1 to %d bytes without zero bytes", KVKeyLen)
+	errBadValue   = fmt.Errorf("value must be at most %d bytes", KVValueLen)
+	errBadKVEntry = fmt.Errorf("key-value entry must be %d bytes", kvEntryLen)
+	errNoSuchKey  = errors.New("key has no value")
+	errKVDisabled = fmt.Errorf("chain doesn't have the %s payload rule", KeyValuePayloadRule)
+)
+
+// kvOp is a put or delete of a key, encoded in one piece of data as
+//
+//	op (1 byte) | key (15 bytes) | value (16 bytes)
+//
+// where op is 1 for a put and 2 for a delete, the key is zero-padded and a
+// delete's value is zero.
+type kvOp struct {
+	delete bool
+	key    [KVKeyLen]byte
+	value  [KVValueLen]byte
+}
+
+// parseKVOp returns the operation that [data] encodes
+func parseKVOp(data [dataLen]byte) (kvOp, error) {
+	op := kvOp{delete: data[0] == kvDelete}
+	copy(op.key[:], data[1:kvValueStart])
+	copy(op.value[:], data[kvValueStart:])
+	switch {
+	case data[0] != kvPut && data[0] != kvDelete:
+		return kvOp{}, errBadKVOp
+	case !canonicalKey(op.key):
+		return kvOp{}, errBadKVOp
+	case op.delete && op.value != [KVValueLen]byte{}:
+		return kvOp{}, errBadKVOp
+	}
+	return op, nil
+}
+
+// data returns the piece of data that encodes [op]
+func (op kvOp) data() [dataLen]byte {
+	var data [dataLen]byte
+	data[0] = kvPut
+	if op.delete {
+		data[0] = kvDelete
+	}
+	copy(data[1:], op.key[:])
+	copy(data[kvValueStart:], op.value[:])
+	return data
+}
+
+// canonicalKey returns true iff [key] is non-empty and is only followed by
+// zero padding
+func canonicalKey(key [KVKeyLen]byte) bool {
+	return isZeroPadded(key[:])
+}
+
+// isZeroPadded returns true iff [b] starts with a non-zero byte and any zero
+// byte is only followed by zero bytes
+func isZeroPadded(b []byte) bool {
+	end := bytes.IndexByte(b, 0)
+	if end == -1 {
+		return true
+	}
+	return end > 0 && bytes.Count(b[end:], []byte{0}) == len(b)-end
+}
+
+// parseKey returns the zero-padded form of [key]
+func parseKey(key string) ([KVKeyLen]byte, error) {
+	var padded [KVKeyLen]byte
+	if len(key) == 0 || len(key) > KVKeyLen || bytes.IndexByte([]byte(key), 0) != -1 {
+		return padded, errBadKey
+	}
+	copy(padded[:], key)
+	return padded, nil
+}
+
+// EncodePut returns the piece of data that sets [key] to [value]. Shorter
+// values are zero-padded, so a value's trailing zeros aren't preserved.
+func EncodePut(key string, value []byte) ([dataLen]byte, error) {
+	padded, err := parseKey(key)
+	if err != nil {
+		return [dataLen]byte{}, err
+	}
+	if len(value) > KVValueLen {
+		return [dataLen]byte{}, errBadValue
+	}
+	op := kvOp{key: padded}
+	copy(op.value[:], value)
+	return op.data(), nil
+}
+
+// EncodeDelete returns the piece of data that deletes [key]
+func EncodeDelete(key string) ([dataLen]byte, error) {
+	padded, err := parseKey(key)
+	if err != nil {
+		return [dataLen]byte{}, err
+	}
+	return kvOp{delete: true, key: padded}.data(), nil
+}
+
+// kvEntry is the value of a key and the height of the block that set it
+type kvEntry struct {
+	value  [KVValueLen]byte
+	height uint64
+}
+
+func parseKVEntry(b []byte) (kvEntry, error) {
+	if len(b) != kvEntryLen {
+		return kvEntry{}, errBadKVEntry
+	}
+	entry := kvEntry{height: binary.BigEndian.Uint64(b[KVValueLen:])}
+	copy(entry.value[:], b)
+	return entry, nil
+}
+
+func (e kvEntry) bytes() []byte {
+	b := make([]byte, kvEntryLen)
+	copy(b, e.value[:])
+	binary.BigEndian.PutUint64(b[KVValueLen:], e.height)
+	return b
+}
+
+// kvHistoryEntry is an operation on a key and the height of its block
+type kvHistoryEntry struct {
+	op     kvOp
+	height uint64
+	// Index of the operation's data in its block
+	index int
+}
+
+// kvHistoryKey is the key of the [index]th piece of data of the block at
+// [height], which operates on [key], in the history index. Keys sort by
+// key, then in the order the operations were accepted.
+func kvHistoryKey(key [KVKeyLen]byte, height uint64, index int) []byte {
+	b := make([]byte, kvHistoryKeyLen)
+	copy(b, key[:])
+	binary.BigEndian.PutUint64(b[KVKeyLen:], height)
+	binary.BigEndian.PutUint16(b[KVKeyLen+8:], uint16(index))
+	return b
+}
+
+// applyKVOps applies [b]'s key-value operations to the state if [b] follows
+// the key-value payload rule
+func (b *Block) applyKVOps() error {
+	if !hasPayloadRule(b.vm.payloadRules(b.Height(), b.Timestamp()), KeyValuePayloadRule) {
+		return nil
+	}
+	for i, d := range b.Dt {
+		op, err := parseKVOp(d)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.applyKVOp(op, b.Height(), i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) kvEnabled() bool {
+	return hasPayloadRule(vm.genesis.Params.PayloadRules, KeyValuePayloadRule) ||
+		(vm.upgrades.PayloadPolicy != nil && hasPayloadRule(vm.upgrades.PayloadPolicy.Rules, KeyValuePayloadRule))
+}
+
+func (vm *VM) kvValue(key [KVKeyLen]byte) (kvEntry, error) {
+	if !vm.kvEnabled() {
+		return kvEntry{}, errKVDisabled
+	}
+	return vm.state.getKV(key)
+}
+
+func (vm *VM) kvHistory(ctx context.Context, key [KVKeyLen]byte, start uint64, index int, limit int) ([]kvHistoryEntry, error) {
+	if !vm.kvEnabled() {
+		return nil, errKVDisabled
+	}
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getKVHistory(ctx, key, start, index, limit)
+}
+
+// GetValueArgs are the arguments to GetValue
+type GetValueArgs struct {
+	Key string `json:"key"`
+
+	key [KVKeyLen]byte
+}
+
+func (a *GetValueArgs) validate(v *argValidator) {
+	var err error
+	a.key, err = parseKey(a.Key)
+	v.add("key", err)
+}
+
+// GetValueReply is the reply from GetValue
+type GetValueReply struct {
+	// Base 58 repr. of the key's zero-padded value
+	Value string `json:"value"`
+	// Height of the accepted block that set the value
+	Height json.Uint64 `json:"height"`
+}
+
+// GetValue returns the value of [args.Key] after the last accepted block
+func (s *Service) GetValue(_ *http.Request, args *GetValueArgs, reply *GetValueReply) error {
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	entry, err := s.backend.kvValue(args.key)
+	if err == database.ErrNotFound {
+		return errNoSuchKey
+	}
+	if err != nil {
+		return err
+	}
+	reply.Value = encoding.EncodeCB58(entry.value[:])
+	reply.Height = json.Uint64(entry.height)
+	return nil
+}
+
+// APIKVOp is the API representation of an operation on a key
+type APIKVOp struct {
+	// "put" or "delete"
+	Op string `json:"op"`
+	// Base 58 repr. of the zero-padded value put. Empty for deletes.
+	Value  string      `json:"value,omitempty"`
+	Height json.Uint64 `json:"height"`
+}
+
+// GetHistoryArgs are the arguments to GetHistory
+type GetHistoryArgs struct {
+	Key string `json:"key"`
+	// Max number of operations to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the operations start where the previous page's nextCursor
+	// says, instead of at the first one
+	Cursor string `json:"cursor"`
+
+	key   [KVKeyLen]byte
+	limit int
+	start pageCursor
+}
+
+func (a *GetHistoryArgs) validate(v *argValidator) {
+	var err error
+	a.key, err = parseKey(a.Key)
+	v.add("key", err)
+	a.limit = v.limit("limit", uint64(a.Limit), defaultKVPageSize, maxKVPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: kvHistoryCursor, direction: forward})
+}
+
+// GetHistoryReply is the reply from GetHistory
+type GetHistoryReply struct {
+	History []APIKVOp `json:"history"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetHistory returns the accepted operations on [args.Key], oldest first
+func (s *Service) GetHistory(r *http.Request, args *GetHistoryArgs, reply *GetHistoryReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	history, err := s.backend.kvHistory(ctx, args.key, args.start.position, int(args.start.index), args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(history) > args.limit {
+		next := args.start.at(history[args.limit].height)
+		next.index = uint16(history[args.limit].index)
+		reply.NextCursor = next.String()
+		history = history[:args.limit]
+	}
+	reply.History = make([]APIKVOp, len(history))
+	for i, entry := range history {
+		apiOp := APIKVOp{Op: "delete", Height: json.Uint64(entry.height)}
+		if !entry.op.delete {
+			apiOp.Op = "put"
+			apiOp.Value = encoding.EncodeCB58(entry.op.value[:])
+		}
+		reply.History[i] = apiOp
+	}
+	return nil
+}
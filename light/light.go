@@ -0,0 +1,155 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// Package light lets resource-constrained clients follow a chain that uses
+// the timestamp VM from compact headers instead of full blocks. Each header
+// commits to its parent's header and to the Merkle root of its block's data,
+// so a client that trusts one header can check every header after it, and
+// the data in their blocks, without fetching the blocks. Like the proof
+// package, it doesn't import the VM.
+package light
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+// HeaderLen is the number of bytes of an encoded header
+const HeaderLen = ids.IDLen + 8 + 8 + ids.IDLen
+
+// checkpointPrefix starts the message of a header checkpoint signature, so
+// that it can't be replayed as a signature of a block checkpoint
+var checkpointPrefix = []byte("timestampvm light checkpoint")
+
+var (
+	errBadHeaderLen     = errors.New("header must be 80 bytes")
+	errWrongParent      = errors.New("header's parent isn't the previous header")
+	errWrongHeight      = errors.New("header's height isn't one more than the previous header's")
+	errTimestampTooLow  = errors.New("header's timestamp is before the previous header's")
+	errWrongPayloadRoot = errors.New("data's path doesn't lead to the header's payload root")
+	errBadCheckpoint    = errors.New("header checkpoint isn't signed by its signer")
+	errUntrustedSigner  = errors.New("header checkpoint signer isn't trusted")
+	errBadSignatureSize = errors.New("checkpoint signature must be 65 bytes")
+)
+
+// Header is the compact header of an accepted block
+type Header struct {
+	// ID of the parent block's header. Empty for the genesis block.
+	ParentID ids.ID `json:"parentID"`
+	Height   uint64 `json:"height"`
+	// Unix time of the block, in seconds
+	Timestamp int64 `json:"timestamp"`
+	// Root of the Merkle tree of the block's data, built like
+	// [proof.MerkleTree]. Empty if the block has no data.
+	PayloadRoot ids.ID `json:"payloadRoot"`
+}
+
+// NewHeader returns the header of the block at [height] with time
+// [timestamp] and data [data], whose parent's header has ID [parentID]
+func NewHeader(parentID ids.ID, height uint64, timestamp int64, data [][proof.DataLen]byte) Header {
+	h := Header{
+		ParentID:  parentID,
+		Height:    height,
+		Timestamp: timestamp,
+	}
+	if len(data) > 0 {
+		root, _ := proof.MerkleTree(data)
+		h.PayloadRoot = root
+	}
+	return h
+}
+
+// ParseHeader returns the header encoded as [b]
+func ParseHeader(b []byte) (Header, error) {
+	if len(b) != HeaderLen {
+		return Header{}, errBadHeaderLen
+	}
+	return Header{
+		ParentID:    ids.ID(b[:ids.IDLen]),
+		Height:      binary.BigEndian.Uint64(b[ids.IDLen:]),
+		Timestamp:   int64(binary.BigEndian.Uint64(b[ids.IDLen+8:])),
+		PayloadRoot: ids.ID(b[ids.IDLen+16:]),
+	}, nil
+}
+
+// Bytes returns the encoding of [h]
+func (h *Header) Bytes() []byte {
+	b := make([]byte, 0, HeaderLen)
+	b = append(b, h.ParentID[:]...)
+	b = binary.BigEndian.AppendUint64(b, h.Height)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Timestamp))
+	return append(b, h.PayloadRoot[:]...)
+}
+
+// ID returns the hash of [h], which its child's header commits to
+func (h *Header) ID() ids.ID {
+	return sha256.Sum256(h.Bytes())
+}
+
+// VerifyChain returns nil iff [headers] follow [trusted] in order: each is
+// the child of the header before it
+func VerifyChain(trusted Header, headers []Header) error {
+	prev := trusted
+	for _, h := range headers {
+		switch {
+		case h.ParentID != prev.ID():
+			return errWrongParent
+		case h.Height != prev.Height+1:
+			return errWrongHeight
+		case h.Timestamp < prev.Timestamp:
+			return errTimestampTooLow
+		}
+		prev = h
+	}
+	return nil
+}
+
+// VerifyData returns nil iff [path] shows that [data] is in the block of [h]
+func (h *Header) VerifyData(data [proof.DataLen]byte, path *proof.MerklePath) error {
+	root, err := path.Root(data)
+	if err != nil {
+		return err
+	}
+	if root != h.PayloadRoot {
+		return errWrongPayloadRoot
+	}
+	return nil
+}
+
+// CheckpointHash returns the hash that a node signs to attest that the
+// header [headerID] at [height] is the header of a block accepted by the
+// chain [chainID]
+func CheckpointHash(chainID, headerID ids.ID, height uint64) []byte {
+	hasher := sha256.New()
+	_, _ = hasher.Write(checkpointPrefix)
+	_, _ = hasher.Write(chainID[:])
+	_, _ = hasher.Write(headerID[:])
+	_ = binary.Write(hasher, binary.BigEndian, height)
+	return hasher.Sum(nil)
+}
+
+// VerifyCheckpoint returns nil iff [checkpoint] is a signature by one of
+// [trusted] that [h] is the header of a block accepted by the chain
+// [chainID]. A client that verifies a checkpoint can trust [h] and follow
+// the chain from it with [VerifyChain].
+func (h *Header) VerifyCheckpoint(chainID ids.ID, checkpoint *proof.Checkpoint, trusted ...ids.ShortID) error {
+	if len(checkpoint.Signature) != secp256k1.SignatureLen {
+		return errBadSignatureSize
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(CheckpointHash(chainID, h.ID(), h.Height), checkpoint.Signature)
+	if err != nil || key.Address() != checkpoint.Signer {
+		return errBadCheckpoint
+	}
+	for _, addr := range trusted {
+		if addr == checkpoint.Signer {
+			return nil
+		}
+	}
+	return errUntrustedSigner
+}
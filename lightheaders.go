@@ -0,0 +1,170 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/light"
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+const (
+	defaultHeaderPageSize = 25
+	maxHeaderPageSize     = 100
+)
+
+var errNoLightHeaders = errors.New("node has no light headers at that height")
+
+// lightHeader returns [b]'s light header, whose parent is [parentID]
+func (b *Block) lightHeader(parentID ids.ID) light.Header {
+	return light.NewHeader(parentID, b.Height(), b.Tmstmp, b.Dt)
+}
+
+// putLightHeader adds [b]'s light header to the header chain. A node that
+// state synced has no header for the blocks before its checkpoint, so it
+// can't extend the chain and doesn't serve light headers.
+func (b *Block) putLightHeader() error {
+	if b.Height() == 0 {
+		return b.vm.state.putLightHeader(b.lightHeader(ids.Empty))
+	}
+	parent, err := b.vm.state.getLightHeader(b.Height() - 1)
+	if err == database.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.vm.state.putLightHeader(b.lightHeader(parent.ID()))
+}
+
+func (vm *VM) lightHeaders(ctx context.Context, start uint64, limit int) ([]light.Header, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getLightHeaders(ctx, start, limit)
+}
+
+// GetHeadersArgs are the arguments to GetHeaders
+type GetHeadersArgs struct {
+	// Height of the first header that is returned
+	StartHeight json.Uint64 `json:"startHeight"`
+	// Max number of headers to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the headers start where the previous page's nextCursor says,
+	// instead of at [StartHeight]
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *GetHeadersArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultHeaderPageSize, maxHeaderPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: headersCursor, direction: forward, position: uint64(a.StartHeight)})
+}
+
+// GetHeadersReply is the reply from GetHeaders
+type GetHeadersReply struct {
+	Headers []light.Header `json:"headers"`
+	// This node's signature of the last header, if it has a signer
+	Checkpoint *proof.Checkpoint `json:"checkpoint,omitempty"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetHeaders returns the light headers of the accepted blocks starting
+// at [args.StartHeight]. They can be checked with [light.VerifyChain].
+func (s *Service) GetHeaders(r *http.Request, args *GetHeadersArgs, reply *GetHeadersReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	headers, err := s.backend.lightHeaders(ctx, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(headers) == 0 {
+		return errNoLightHeaders
+	}
+	if len(headers) > args.limit {
+		reply.NextCursor = args.start.at(headers[args.limit].Height).String()
+		headers = headers[:args.limit]
+	}
+	reply.Headers = headers
+
+	if signer := s.backend.checkpointSigner(); signer != nil {
+		last := headers[len(headers)-1]
+		hash := light.CheckpointHash(s.backend.chainID(), last.ID(), last.Height)
+		sig, err := signer.SignHash(ctx, hash)
+		if err != nil {
+			return err
+		}
+		reply.Checkpoint = &proof.Checkpoint{
+			Signer:    signer.Address(),
+			Signature: sig,
+		}
+	}
+	return nil
+}
+
+// GetPayloadPathArgs are the arguments to GetPayloadPath
+type GetPayloadPathArgs struct {
+	// Base 58 repr. of the data
+	Data string `json:"data"`
+
+	data [dataLen]byte
+}
+
+func (a *GetPayloadPathArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+}
+
+// GetPayloadPathReply is the reply from GetPayloadPath
+type GetPayloadPathReply struct {
+	// Light header of the accepted block that contains the data
+	Header light.Header `json:"header"`
+	// Path of the data to the header's payload root
+	Path proof.MerklePath `json:"path"`
+}
+
+// GetPayloadPath returns the light header of the accepted block that
+// contains [args.Data] and the data's path to its payload root, which can be
+// checked with [light.Header.VerifyData]
+func (s *Service) GetPayloadPath(r *http.Request, args *GetPayloadPathArgs, reply *GetPayloadPathReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	data := args.data
+	blkID, err := s.backend.dataBlock(ctx, data)
+	if err == database.ErrNotFound {
+		return errDataNotAccepted
+	}
+	if err != nil {
+		return err
+	}
+	blk, err := s.backend.lookupBlock(ctx, blkID)
+	if err != nil {
+		return ErrBlockNotFound
+	}
+	headers, err := s.backend.lightHeaders(ctx, blk.Height(), 1)
+	if err != nil {
+		return err
+	}
+	if len(headers) == 0 || headers[0].Height != blk.Height() {
+		return errNoLightHeaders
+	}
+	_, paths := proof.MerkleTree(blk.Dt)
+	reply.Header = headers[0]
+	reply.Path = paths[slices.Index(blk.Dt, data)]
+	return nil
+}
@@ -0,0 +1,144 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+const (
+	// APISubsystem logs the API calls to this node
+	APISubsystem = "api"
+	// BuilderSubsystem logs the building of blocks
+	BuilderSubsystem = "builder"
+	// MempoolSubsystem logs the data entering and leaving the mempool
+	MempoolSubsystem = "mempool"
+)
+
+var (
+	errUnknownSubsystem = errors.New("unknown log subsystem")
+	errNoChainLevel     = errors.New("the chain's log level can't be unset")
+)
+
+// levelCore logs at its subsystem's level, if one is set, instead of the
+// level of the core it wraps. The wrapped core still writes every entry.
+type levelCore struct {
+	zapcore.Core
+	level *atomic.Pointer[zapcore.Level]
+}
+
+func (c *levelCore) Enabled(lvl zapcore.Level) bool {
+	if level := c.level.Load(); level != nil {
+		return lvl >= *level
+	}
+	return c.Core.Enabled(lvl)
+}
+
+// Level implements zapcore.LevelEnabler so that the logger reports the
+// subsystem's level
+func (c *levelCore) Level() zapcore.Level {
+	if level := c.level.Load(); level != nil {
+		return *level
+	}
+	return zapcore.LevelOf(c.Core)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.level.Load() == nil {
+		return c.Core.Check(entry, checked)
+	}
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+// subsystemLogs are the loggers of the VM's subsystems. Each logs at the
+// chain's level unless its own level is set.
+type subsystemLogs struct {
+	chain   logging.Logger
+	api     logging.Logger
+	builder logging.Logger
+	mempool logging.Logger
+
+	// Subsystem --> Its level, or nil if it logs at the chain's level
+	levels map[string]*atomic.Pointer[zapcore.Level]
+}
+
+// newSubsystemLogs returns the loggers of the subsystems of the chain that
+// logs to [chain]
+func newSubsystemLogs(chain logging.Logger) *subsystemLogs {
+	l := &subsystemLogs{
+		chain:  chain,
+		levels: make(map[string]*atomic.Pointer[zapcore.Level]),
+	}
+	newLogger := func(subsystem string) logging.Logger {
+		level := &atomic.Pointer[zapcore.Level]{}
+		l.levels[subsystem] = level
+		return chain.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return &levelCore{Core: core, level: level}
+		})).With(zap.String("subsystem", subsystem))
+	}
+	l.api = newLogger(APISubsystem)
+	l.builder = newLogger(BuilderSubsystem)
+	l.mempool = newLogger(MempoolSubsystem)
+	return l
+}
+
+// setLevel sets the level of [subsystem] to [level]. If [subsystem] is
+// empty, the chain's level is set instead, which every subsystem without a
+// level of its own follows. If [level] is nil, [subsystem] follows the
+// chain's level again.
+func (l *subsystemLogs) setLevel(subsystem string, level *logging.Level) error {
+	if subsystem == "" {
+		if level == nil {
+			return errNoChainLevel
+		}
+		l.chain.SetLevel(*level)
+		return nil
+	}
+	subsystemLevel, ok := l.levels[subsystem]
+	if !ok {
+		return fmt.Errorf("%w: %q", errUnknownSubsystem, subsystem)
+	}
+	if level == nil {
+		subsystemLevel.Store(nil)
+		return nil
+	}
+	zapLevel := zapcore.Level(*level)
+	subsystemLevel.Store(&zapLevel)
+	return nil
+}
+
+// chainLevel returns the level the chain logs at
+func (l *subsystemLogs) chainLevel() logging.Level {
+	for level := logging.Verbo; level < logging.Off; level++ {
+		if l.chain.Enabled(level) {
+			return level
+		}
+	}
+	return logging.Off
+}
+
+// subsystemLevels returns the level of each subsystem that has its own
+func (l *subsystemLogs) subsystemLevels() map[string]logging.Level {
+	levels := make(map[string]logging.Level)
+	for subsystem, level := range l.levels {
+		if zapLevel := level.Load(); zapLevel != nil {
+			levels[subsystem] = logging.Level(*zapLevel)
+		}
+	}
+	return levels
+}
@@ -0,0 +1,122 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import "slices"
+
+// cancelTokenLen is the length of the random token that cancels a proposal
+const cancelTokenLen = 32
+
+var _ CancellableMempool = &fifoMempool{}
+
+// MempoolEntry is a proposed piece of data that may not have been accepted yet
+type MempoolEntry struct {
+	seq  uint64 // Position of this entry in the journal
+	data [dataLen]byte
+	// Namespace of [data] on chains whose data has namespaces. Zero
+	// otherwise.
+	namespace [NamespaceLen]byte
+	// Unix time, in seconds, before which [data] isn't put into a block.
+	// Zero means it may be put into a block right away.
+	notBefore int64
+	// Secret returned to the proposer of [data], which cancels it. It isn't
+	// journaled, so it's zero for entries restored on restart, which only an
+	// admin may cancel.
+	cancelToken [cancelTokenLen]byte
+}
+
+// ID returns the ID of the proposal, which is unique among pending proposals
+func (e MempoolEntry) ID() uint64 {
+	return e.seq
+}
+
+// Data returns the proposed data, zero-padded to 32 bytes
+func (e MempoolEntry) Data() [dataLen]byte {
+	return e.data
+}
+
+// Namespace returns the namespace of the data, which is zero if it has none
+func (e MempoolEntry) Namespace() [NamespaceLen]byte {
+	return e.namespace
+}
+
+// NotBefore returns the Unix time, in seconds, before which the data isn't
+// put into a block. Zero means it may be put into a block right away.
+func (e MempoolEntry) NotBefore() int64 {
+	return e.notBefore
+}
+
+// Mempool holds the proposed data that's due to be put into a block. It's
+// only accessed by the block builder's goroutine, so it needn't be safe for
+// concurrent use. Data that isn't due yet is held by the builder until it is.
+type Mempool interface {
+	// Push adds [entry] to the mempool
+	Push(entry MempoolEntry)
+	// Requeue puts back [entries], which were popped from the mempool, so
+	// that they're popped before the entries pushed since
+	Requeue(entries []MempoolEntry)
+	// Pop removes and returns up to [n] entries to put into the next block
+	Pop(n int) []MempoolEntry
+	// Len returns the number of entries in the mempool
+	Len() int
+}
+
+// CancellableMempool is a [Mempool] whose entries can be cancelled before
+// they're put into a block. Proposals that are due can only be cancelled if
+// the VM's mempool implements it.
+type CancellableMempool interface {
+	Mempool
+	// Get returns the entry whose ID is [id], if it's in the mempool
+	Get(id uint64) (MempoolEntry, bool)
+	// Remove removes the entry whose ID is [id], if it's in the mempool
+	Remove(id uint64)
+}
+
+// fifoMempool is the default [Mempool], which puts data into blocks in the
+// order it was proposed
+type fifoMempool struct {
+	entries []MempoolEntry
+}
+
+func (m *fifoMempool) Push(entry MempoolEntry) {
+	m.entries = append(m.entries, entry)
+}
+
+func (m *fifoMempool) Requeue(entries []MempoolEntry) {
+	m.entries = append(entries, m.entries...)
+}
+
+func (m *fifoMempool) Pop(n int) []MempoolEntry {
+	n = min(n, len(m.entries))
+	popped := make([]MempoolEntry, n)
+	copy(popped, m.entries)
+	m.entries = m.entries[n:]
+	return popped
+}
+
+func (m *fifoMempool) Get(id uint64) (MempoolEntry, bool) {
+	i := m.index(id)
+	if i == -1 {
+		return MempoolEntry{}, false
+	}
+	return m.entries[i], true
+}
+
+func (m *fifoMempool) Remove(id uint64) {
+	if i := m.index(id); i != -1 {
+		m.entries = slices.Delete(m.entries, i, i+1)
+	}
+}
+
+// index returns the index of the entry whose ID is [id], or -1 if there is
+// none
+func (m *fifoMempool) index(id uint64) int {
+	return slices.IndexFunc(m.entries, func(e MempoolEntry) bool {
+		return e.seq == id
+	})
+}
+
+func (m *fifoMempool) Len() int {
+	return len(m.entries)
+}
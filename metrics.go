@@ -0,0 +1,83 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the chain's metrics, which are reported in the node's
+// Prometheus output
+type metrics struct {
+	registerer prometheus.Registerer
+
+	blocksBuilt    prometheus.Counter
+	buildFailures  prometheus.Counter
+	blocksAccepted prometheus.Counter
+	blocksRejected prometheus.Counter
+	verifyDuration prometheus.Histogram
+	commitDuration prometheus.Histogram
+}
+
+func newMetrics(registerer prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		registerer: registerer,
+		blocksBuilt: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blocks_built",
+			Help: "number of blocks built by this node",
+		}),
+		buildFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "block_build_failures",
+			Help: "number of blocks this node failed to build after taking their data from the mempool",
+		}),
+		blocksAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blocks_accepted",
+			Help: "number of blocks accepted",
+		}),
+		blocksRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "blocks_rejected",
+			Help: "number of blocks rejected",
+		}),
+		verifyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "block_verify_duration_seconds",
+			Help:    "time spent verifying blocks",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		commitDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "db_commit_duration_seconds",
+			Help:    "time spent committing writes to the database",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+	}
+	err := errors.Join(
+		registerer.Register(m.blocksBuilt),
+		registerer.Register(m.buildFailures),
+		registerer.Register(m.blocksAccepted),
+		registerer.Register(m.blocksRejected),
+		registerer.Register(m.verifyDuration),
+		registerer.Register(m.commitDuration),
+	)
+	return m, err
+}
+
+// registerMempoolSize reports the number of pieces of data in the mempool,
+// which is [mempoolLen]. The mempool is created after the chain is
+// initialized, so it's registered separately.
+func (m *metrics) registerMempoolSize(mempoolLen func() int) error {
+	return m.registerer.Register(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "mempool_size",
+			Help: "number of pieces of data waiting to be put into a block",
+		},
+		func() float64 { return float64(mempoolLen()) },
+	))
+}
+
+// observeSince records the time since [start] in [histogram]
+func observeSince(histogram prometheus.Histogram, start time.Time) {
+	histogram.Observe(time.Since(start).Seconds())
+}
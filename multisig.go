@@ -0,0 +1,566 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// MultisigIDLen is the length of a multisig set's ID, which is
+	// zero-padded
+	MultisigIDLen = 16
+
+	multisigKeyLen = MultisigIDLen + dataLen + NamespaceLen
+
+	// PendingMultisig is the status of a multisig proposal whose signatures
+	// are still being collected, or that isn't accepted yet
+	PendingMultisig = "pending"
+	// AcceptedMultisig is the status of a multisig proposal that is in an
+	// accepted block
+	AcceptedMultisig = "accepted"
+)
+
+var (
+	errMultisigsDisabled      = errors.New("chain doesn't have multisig sets")
+	errBadMultisigID          = fmt.Errorf("multisig set ID must be 1 to %d bytes with no zero bytes", MultisigIDLen)
+	errDuplicateMultisig      = errors.New("multisig set is registered more than once")
+	errBadMultisigThreshold   = errors.New("multisig threshold must be between 1 and the number of signers")
+	errUnknownMultisig        = errors.New("multisig set isn't registered")
+	errTooManyMultisigs       = errors.New("block has too many multisig proposals")
+	errTooManyMultisigSigs    = errors.New("multisig proposal has more signatures than its set has signers")
+	errNotMultisigSigner      = errors.New("signature isn't by one of the multisig set's signers")
+	errDuplicateMultisigSig   = errors.New("signer already signed the multisig proposal")
+	errMultisigBelowThreshold = errors.New("multisig proposal has fewer signatures than its set's threshold")
+	errMultisigAccepted       = errors.New("data is already accepted with the multisig set's signatures")
+	errNoSuchMultisig         = errors.New("no signatures of the data by the multisig set are known")
+	errBadMultisigEntry       = errors.New("multisig entry is malformed")
+)
+
+// MultisigConfig registers a set of signers in the genesis, of which
+// [Threshold] must sign a piece of data before it can be proposed with the
+// set
+type MultisigConfig struct {
+	// ID of the set, which is zero-padded to [MultisigIDLen] bytes
+	ID      string        `json:"id"`
+	Signers []ids.ShortID `json:"signers"`
+	// Number of the signers that must sign a proposal
+	Threshold int `json:"threshold"`
+}
+
+// parseMultisigID returns the zero-padded form of [id]
+func parseMultisigID(id string) ([MultisigIDLen]byte, error) {
+	var padded [MultisigIDLen]byte
+	if len(id) == 0 || len(id) > MultisigIDLen || bytes.IndexByte([]byte(id), 0) != -1 {
+		return padded, errBadMultisigID
+	}
+	copy(padded[:], id)
+	return padded, nil
+}
+
+// verifyMultisigConfigs returns nil iff [configs] have distinct IDs and each
+// has distinct signers and a threshold they can reach
+func verifyMultisigConfigs(configs []MultisigConfig) error {
+	registered := set.NewSet[[MultisigIDLen]byte](len(configs))
+	for _, config := range configs {
+		id, err := parseMultisigID(config.ID)
+		if err != nil {
+			return err
+		}
+		switch {
+		case registered.Contains(id):
+			return fmt.Errorf("%w: %s", errDuplicateMultisig, config.ID)
+		case config.Threshold < 1 || config.Threshold > len(config.Signers):
+			return fmt.Errorf("%w: %s", errBadMultisigThreshold, config.ID)
+		}
+		registered.Add(id)
+		if err := verifyAddresses(config.Signers); err != nil {
+			return fmt.Errorf("%s signers: %w", config.ID, err)
+		}
+	}
+	return nil
+}
+
+// hasMultisigs returns true iff the chain has multisig sets
+func (p *ChainParams) hasMultisigs() bool {
+	return len(p.Multisigs) > 0
+}
+
+// multisigConfig returns the registration of the set [id], or nil if it
+// isn't registered
+func (p *ChainParams) multisigConfig(id [MultisigIDLen]byte) *MultisigConfig {
+	for i := range p.Multisigs {
+		// The IDs are checked when the genesis is parsed
+		if padded, _ := parseMultisigID(p.Multisigs[i].ID); padded == id {
+			return &p.Multisigs[i]
+		}
+	}
+	return nil
+}
+
+// MultisigProposal is a piece of data signed by the signers of a multisig
+// set. It's valid for inclusion once it has the signatures of at least the
+// set's threshold of distinct signers. Each piece of data is accepted with
+// each set at most once.
+type MultisigProposal struct {
+	Set  [MultisigIDLen]byte `serialize:"true"`
+	Data [dataLen]byte       `serialize:"true"`
+	// Namespace of [Data] on chains whose data has namespaces. Zero
+	// otherwise.
+	Namespace [NamespaceLen]byte `namespace:"true"`
+	// Signers' signatures of the proposal's hash on this chain
+	Sigs [][secp256k1.SignatureLen]byte `serialize:"true"`
+
+	signerAddrs  []ids.ShortID // addresses of the signers of [Sigs], if [signersKnown]
+	signersKnown bool
+}
+
+// key returns the key of [p]'s set, data and namespace
+func (p *MultisigProposal) key() []byte {
+	key := make([]byte, 0, multisigKeyLen)
+	key = append(key, p.Set[:]...)
+	key = append(key, p.Data[:]...)
+	return append(key, p.Namespace[:]...)
+}
+
+// withSignature returns the proposal of [p]'s set, data and namespace with
+// only the signature [sig], which is how each signature is journaled
+func (p *MultisigProposal) withSignature(sig [secp256k1.SignatureLen]byte) *MultisigProposal {
+	return &MultisigProposal{
+		Set:       p.Set,
+		Data:      p.Data,
+		Namespace: p.Namespace,
+		Sigs:      [][secp256k1.SignatureLen]byte{sig},
+	}
+}
+
+// Hash returns the hash of [p] on the chain [chainID], which is what each
+// signer signs
+func (p *MultisigProposal) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+multisigKeyLen)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, multisigTag)
+	msg = append(msg, p.key()...)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign adds [key]'s signature of [p] on the chain [chainID] to [p]'s
+// signatures
+func (p *MultisigProposal) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(p.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	p.Sigs = append(p.Sigs, [secp256k1.SignatureLen]byte(sig))
+	p.signersKnown = false
+	return nil
+}
+
+// signers returns the addresses that signed [p] on the chain [chainID], in
+// the order of [p]'s signatures
+func (p *MultisigProposal) signers(chainID ids.ID) ([]ids.ShortID, error) {
+	if p.signersKnown {
+		return p.signerAddrs, nil
+	}
+	hash := p.Hash(chainID)
+	addrs := make([]ids.ShortID, len(p.Sigs))
+	for i, sig := range p.Sigs {
+		key, err := secp256k1.RecoverPublicKeyFromHash(hash, sig[:])
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = key.Address()
+	}
+	p.signerAddrs = addrs
+	p.signersKnown = true
+	return addrs, nil
+}
+
+// verifySigners returns nil iff [p]'s signatures are by distinct signers of
+// [config]. If [complete], there must also be at least [config]'s threshold
+// of them.
+func (p *MultisigProposal) verifySigners(chainID ids.ID, config *MultisigConfig, complete bool) error {
+	// Checked before the signatures are recovered
+	if len(p.Sigs) > len(config.Signers) {
+		return errTooManyMultisigSigs
+	}
+	addrs, err := p.signers(chainID)
+	if err != nil {
+		return err
+	}
+	seen := set.NewSet[ids.ShortID](len(addrs))
+	for _, addr := range addrs {
+		switch {
+		case !slices.Contains(config.Signers, addr):
+			return errNotMultisigSigner
+		case seen.Contains(addr):
+			return errDuplicateMultisigSig
+		}
+		seen.Add(addr)
+	}
+	if complete && len(addrs) < config.Threshold {
+		return errMultisigBelowThreshold
+	}
+	return nil
+}
+
+// multisigEntry is an accepted multisig proposal: the height of its block
+// and its signers
+type multisigEntry struct {
+	height  uint64
+	signers []ids.ShortID
+}
+
+func parseMultisigEntry(b []byte) (multisigEntry, error) {
+	if len(b) < 8 || (len(b)-8)%ids.ShortIDLen != 0 {
+		return multisigEntry{}, errBadMultisigEntry
+	}
+	e := multisigEntry{height: binary.BigEndian.Uint64(b)}
+	for b = b[8:]; len(b) > 0; b = b[ids.ShortIDLen:] {
+		e.signers = append(e.signers, ids.ShortID(b[:ids.ShortIDLen]))
+	}
+	return e, nil
+}
+
+func (e multisigEntry) bytes() []byte {
+	b := make([]byte, 8, 8+len(e.signers)*ids.ShortIDLen)
+	binary.BigEndian.PutUint64(b, e.height)
+	for _, addr := range e.signers {
+		b = append(b, addr[:]...)
+	}
+	return b
+}
+
+// verifyMultisigUnaccepted returns nil iff no multisig proposal with [key]
+// is in [parent] or its ancestors
+func (vm *VM) verifyMultisigUnaccepted(parent *Block, key []byte) error {
+	// Processing ancestors aren't indexed yet
+	processing, err := vm.processingAncestors(parent)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range processing {
+		for i := range ancestor.Multisigs {
+			if bytes.Equal(ancestor.Multisigs[i].key(), key) {
+				return errMultisigAccepted
+			}
+		}
+	}
+	accepted, err := vm.state.hasMultisig(key)
+	if err != nil {
+		return errDatabaseGet
+	}
+	if accepted {
+		return errMultisigAccepted
+	}
+	return nil
+}
+
+// verifyMultisigs returns nil iff each of [b]'s multisig proposals has the
+// signatures of at least its set's threshold of distinct signers and isn't
+// accepted after [parent]
+func (b *Block) verifyMultisigs(parent *Block) error {
+	switch {
+	case len(b.Multisigs) == 0:
+		return nil
+	case !b.vm.genesis.Params.hasMultisigs():
+		return errMultisigsDisabled
+	case len(b.Multisigs) > maxBatchSize:
+		return errTooManyMultisigs
+	}
+	keys := set.NewSet[[multisigKeyLen]byte](len(b.Multisigs))
+	for i := range b.Multisigs {
+		p := &b.Multisigs[i]
+		config := b.vm.genesis.Params.multisigConfig(p.Set)
+		if config == nil {
+			return errUnknownMultisig
+		}
+		if err := p.verifySigners(b.vm.ctx.ChainID, config, true); err != nil {
+			return err
+		}
+		key := [multisigKeyLen]byte(p.key())
+		if keys.Contains(key) {
+			return errMultisigAccepted
+		}
+		keys.Add(key)
+		if err := b.vm.verifyMultisigUnaccepted(parent, key[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMultisigs records [b]'s multisig proposals and their signers
+func (b *Block) applyMultisigs() error {
+	for i := range b.Multisigs {
+		p := &b.Multisigs[i]
+		signers, err := p.signers(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		e := multisigEntry{height: b.Height(), signers: signers}
+		if err := b.vm.state.putMultisig(p.key(), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMultisigs collects the signatures of multisig proposals submitted
+// over the API until the proposals are accepted. A proposal is put in a
+// block once it has enough signatures.
+// Signatures aren't gossiped, so each signer must submit their signature to
+// the same node.
+type pendingMultisigs struct {
+	lock      sync.Mutex
+	proposals []*MultisigProposal // in the order of their first signature
+}
+
+// get returns the pending proposal with [key], or nil if there is none
+func (p *pendingMultisigs) get(key []byte) *MultisigProposal {
+	for _, proposal := range p.proposals {
+		if bytes.Equal(proposal.key(), key) {
+			return proposal
+		}
+	}
+	return nil
+}
+
+// addSignature adds the signature [sig] of [set]'s signers to the pending
+// proposal of [data] in [namespace] with [set] and returns the proposal with
+// it
+func (p *pendingMultisigs) addSignature(chainID ids.ID, config *MultisigConfig, set [MultisigIDLen]byte, data [dataLen]byte, namespace [NamespaceLen]byte, sig [secp256k1.SignatureLen]byte) (MultisigProposal, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	proposal := MultisigProposal{Set: set, Data: data, Namespace: namespace}
+	if pending := p.get(proposal.key()); pending != nil {
+		proposal.Sigs = slices.Clone(pending.Sigs)
+	}
+	proposal.Sigs = append(proposal.Sigs, sig)
+	if err := proposal.verifySigners(chainID, config, false); err != nil {
+		return MultisigProposal{}, err
+	}
+	if pending := p.get(proposal.key()); pending != nil {
+		*pending = proposal
+	} else {
+		p.proposals = append(p.proposals, &proposal)
+	}
+	return proposal, nil
+}
+
+// signers returns the signers of the pending proposal with [key] and
+// whether there is one
+func (p *pendingMultisigs) signers(chainID ids.ID, key []byte) ([]ids.ShortID, bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	proposal := p.get(key)
+	if proposal == nil {
+		return nil, false, nil
+	}
+	signers, err := proposal.signers(chainID)
+	return signers, true, err
+}
+
+// next returns up to [limit] pending proposals that have enough signatures
+// and can be accepted in a child of [parent] with parameters [params],
+// timestamp [timestamp] and the data [data] in [namespaces]. The child's
+// signer writes the proposals' data.
+func (p *pendingMultisigs) next(vm *VM, parent *Block, params *ChainParams, timestamp time.Time, data [][dataLen]byte, namespaces [][NamespaceLen]byte, limit int) []MultisigProposal {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	limit = min(limit, maxBatchSize)
+	var next []MultisigProposal
+	for _, proposal := range p.proposals {
+		if len(next) == limit {
+			break
+		}
+		config := vm.genesis.Params.multisigConfig(proposal.Set)
+		if config == nil || len(proposal.Sigs) < config.Threshold {
+			continue
+		}
+		if vm.verifyMultisigUnaccepted(parent, proposal.key()) != nil {
+			continue
+		}
+		if vm.verifySignedData(parent, params, timestamp, vm.signer.Address(), proposal.Data, proposal.Namespace) != nil || !vm.fitsBlock(data, namespaces, proposal.Data, proposal.Namespace) {
+			continue
+		}
+		next = append(next, *proposal)
+		data = append(data, proposal.Data)
+		namespaces = append(namespaces, proposal.Namespace)
+	}
+	return next
+}
+
+// prune drops the pending proposals that are accepted
+func (p *pendingMultisigs) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var dropped []*MultisigProposal
+	remaining := p.proposals[:0]
+	for _, proposal := range p.proposals {
+		if accepted, err := vm.state.hasMultisig(proposal.key()); err != nil || !accepted {
+			remaining = append(remaining, proposal)
+		} else {
+			dropped = append(dropped, proposal)
+		}
+	}
+	p.proposals = remaining
+	for _, proposal := range dropped {
+		for _, sig := range proposal.Sigs {
+			if err := vm.opJournal.delete(multisigSignatureKind, proposal.withSignature(sig)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// len returns the number of pending proposals
+func (p *pendingMultisigs) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.proposals)
+}
+
+// SubmitMultisigSignatureArgs are the arguments to SubmitMultisigSignature
+type SubmitMultisigSignatureArgs struct {
+	// ID of the multisig set
+	Set string `json:"set"`
+	// Base 58 repr. of the signed data
+	Data string `json:"data"`
+	// Namespace of the data on chains whose data has namespaces
+	Namespace string `json:"namespace"`
+	// Base 58 repr. of the signer's signature of the proposal
+	Signature string `json:"signature"`
+
+	set       [MultisigIDLen]byte
+	data      [dataLen]byte
+	namespace [NamespaceLen]byte
+	sig       [secp256k1.SignatureLen]byte
+}
+
+func (a *SubmitMultisigSignatureArgs) validate(v *argValidator) {
+	var err error
+	a.set, err = parseMultisigID(a.Set)
+	v.add("set", err)
+	a.data = v.data("data", a.Data)
+	a.namespace = v.namespace("namespace", a.Namespace)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// SubmitMultisigSignatureReply is the reply from SubmitMultisigSignature
+type SubmitMultisigSignatureReply struct {
+	// Address that signed the proposal
+	Signer ids.ShortID `json:"signer"`
+	// Number of signatures collected so far, including this one
+	Signatures json.Uint32 `json:"signatures"`
+	// Number of signatures the proposal needs
+	Threshold json.Uint32 `json:"threshold"`
+}
+
+// SubmitMultisigSignature is an API method to add a signer's signature to
+// the multisig proposal of [args.Data] in [args.Namespace] with the set
+// [args.Set]. This node
+// collects the signatures and, once the set's threshold is reached, includes
+// the proposal in a block it builds.
+func (s *Service) SubmitMultisigSignature(_ *http.Request, args *SubmitMultisigSignatureArgs, reply *SubmitMultisigSignatureReply) error {
+	if !s.backend.chainParams().hasMultisigs() {
+		return errMultisigsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	proposal, threshold, err := s.backend.addMultisigSignature(args.set, args.data, args.namespace, args.sig)
+	if err != nil {
+		return err
+	}
+	signers, err := proposal.signers(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	reply.Signer = signers[len(signers)-1]
+	reply.Signatures = json.Uint32(len(signers))
+	reply.Threshold = json.Uint32(threshold)
+	return nil
+}
+
+// GetMultisigArgs are the arguments to GetMultisig
+type GetMultisigArgs struct {
+	// ID of the multisig set
+	Set string `json:"set"`
+	// Base 58 repr. of the signed data
+	Data string `json:"data"`
+	// Namespace of the data on chains whose data has namespaces
+	Namespace string `json:"namespace"`
+
+	set       [MultisigIDLen]byte
+	data      [dataLen]byte
+	namespace [NamespaceLen]byte
+}
+
+func (a *GetMultisigArgs) validate(v *argValidator) {
+	var err error
+	a.set, err = parseMultisigID(a.Set)
+	v.add("set", err)
+	a.data = v.data("data", a.Data)
+	a.namespace = v.namespace("namespace", a.Namespace)
+}
+
+// GetMultisigReply is the reply from GetMultisig
+type GetMultisigReply struct {
+	// "pending" or "accepted"
+	Status string `json:"status"`
+	// Addresses whose signatures were collected or accepted
+	Signers   []ids.ShortID `json:"signers"`
+	Threshold json.Uint32   `json:"threshold"`
+	// Height of the accepted block with the proposal. Only set if it's
+	// accepted.
+	Height json.Uint64 `json:"height"`
+}
+
+// GetMultisig returns the signers of the multisig proposal of [args.Data] in
+// [args.Namespace] with the set [args.Set], and whether it's accepted
+func (s *Service) GetMultisig(_ *http.Request, args *GetMultisigArgs, reply *GetMultisigReply) error {
+	params := s.backend.chainParams()
+	if !params.hasMultisigs() {
+		return errMultisigsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	config := params.multisigConfig(args.set)
+	if config == nil {
+		return errUnknownMultisig
+	}
+	e, accepted, err := s.backend.multisig(args.set, args.data, args.namespace)
+	if err != nil {
+		return err
+	}
+	reply.Status = PendingMultisig
+	if accepted {
+		reply.Status = AcceptedMultisig
+		reply.Height = json.Uint64(e.height)
+	}
+	reply.Signers = e.signers
+	reply.Threshold = json.Uint32(config.Threshold)
+	return nil
+}
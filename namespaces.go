@@ -0,0 +1,337 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// The codec versions of the blocks of chains with namespaces or namespace
+	// ACLs. Each is the codec version of [codecVersion], [signedCodecVersion]
+	// or [transferCodecVersion] that also serializes the fields tagged with
+	// [namespaceTagName], which hold the namespace of each piece of data.
+	namespacedCodecVersion         = 3
+	namespacedSignedCodecVersion   = 4
+	namespacedTransferCodecVersion = 5
+	namespaceTagName               = "namespace"
+
+	namespaceIndexKeyLen = NamespaceLen + 8 + 2
+
+	defaultNamespacePageSize = 25
+	maxNamespacePageSize     = 100
+)
+
+var (
+	errNamespacesDisabled = errors.New("chain doesn't have namespaces")
+	errBadNamespaceQuota  = errors.New("max namespace data must be non-negative and requires namespaces")
+	errNamespaceQuota     = errors.New("block has more of a namespace's data than the namespace quota")
+	errBadDataNamespace   = fmt.Errorf("data must have a namespace of 1 to %d bytes, zero-padded", NamespaceLen)
+	errNamespaceCount     = errors.New("block must have a namespace for each piece of its data")
+)
+
+// namespaced returns true iff each piece of data of a chain with parameters
+// [p] has a namespace, which chains with namespaces or namespace ACLs do
+func (p *ChainParams) namespaced() bool {
+	return p.Namespaces || p.hasACLs()
+}
+
+// verifyNamespace returns nil iff [namespace] may be the namespace of a
+// piece of data on a chain with parameters [p]. On chains with namespaces,
+// each piece of data has a valid namespace. On chains that only have
+// namespace ACLs, data without a namespace may be written by any block
+// signer. On other chains, data has no namespace.
+func (p *ChainParams) verifyNamespace(namespace [NamespaceLen]byte) error {
+	switch {
+	case !p.namespaced() && namespace != [NamespaceLen]byte{}:
+		return errNamespacesDisabled
+	case !p.namespaced() || validNamespace(namespace):
+		return nil
+	case !p.Namespaces && namespace == [NamespaceLen]byte{}:
+		return nil
+	default:
+		return errBadDataNamespace
+	}
+}
+
+// validNamespace returns true iff [namespace] is non-empty and is only
+// followed by zero padding
+func validNamespace(namespace [NamespaceLen]byte) bool {
+	end := bytes.IndexByte(namespace[:], 0)
+	if end == -1 {
+		return true
+	}
+	return end > 0 && bytes.Count(namespace[end:], []byte{0}) == NamespaceLen-end
+}
+
+// namespaceString returns [namespace] without its zero padding
+func namespaceString(namespace [NamespaceLen]byte) string {
+	return string(bytes.TrimRight(namespace[:], "\x00"))
+}
+
+// verifyNamespaces returns nil iff each of [namespaces] may be the namespace
+// of a piece of data on a chain with parameters [p] and no namespace is in
+// [namespaces] more often than the namespace quota allows
+func (p *ChainParams) verifyNamespaces(namespaces [][NamespaceLen]byte) error {
+	counts := make(map[[NamespaceLen]byte]int)
+	for _, namespace := range namespaces {
+		if err := p.verifyNamespace(namespace); err != nil {
+			return err
+		}
+		counts[namespace]++
+		if p.MaxNamespaceData > 0 && counts[namespace] > p.MaxNamespaceData {
+			return errNamespaceQuota
+		}
+	}
+	return nil
+}
+
+// namespaces returns the namespace of each piece of [b]'s data, in the order
+// of [Block.data]
+func (b *Block) namespaces() [][NamespaceLen]byte {
+	if len(b.Submissions) == 0 && len(b.Multisigs) == 0 {
+		return b.Ns
+	}
+	namespaces := make([][NamespaceLen]byte, 0, len(b.Ns)+len(b.Submissions)+len(b.Multisigs))
+	namespaces = append(namespaces, b.Ns...)
+	for i := range b.Submissions {
+		namespaces = append(namespaces, b.Submissions[i].Namespace)
+	}
+	for i := range b.Multisigs {
+		namespaces = append(namespaces, b.Multisigs[i].Namespace)
+	}
+	return namespaces
+}
+
+// verifyNamespaces returns nil iff [b] has a namespace for each piece of the
+// data it holds directly on chains whose data has namespaces, and its data
+// follows the chain's namespaces
+func (b *Block) verifyNamespaces() error {
+	params := &b.vm.genesis.Params
+	if params.namespaced() && len(b.Ns) != len(b.Dt) {
+		return errNamespaceCount
+	}
+	return params.verifyNamespaces(b.namespaces())
+}
+
+// withinNamespaceQuota splits [entries] into the data that fits in the
+// namespace quota of one block and the rest
+func (vm *VM) withinNamespaceQuota(entries []MempoolEntry) ([]MempoolEntry, []MempoolEntry) {
+	maxData := vm.genesis.Params.MaxNamespaceData
+	if !vm.genesis.Params.Namespaces || maxData == 0 {
+		return entries, nil
+	}
+	counts := make(map[[NamespaceLen]byte]int)
+	var within, over []MempoolEntry
+	for _, entry := range entries {
+		if counts[entry.namespace] == maxData {
+			over = append(over, entry)
+			continue
+		}
+		counts[entry.namespace]++
+		within = append(within, entry)
+	}
+	return within, over
+}
+
+// namespaceIndexKey is the key of the [index]th piece of data of the block
+// at [height], which is in [namespace], in the namespace index. Keys sort by
+// namespace, then in the order the data was accepted.
+func namespaceIndexKey(namespace [NamespaceLen]byte, height uint64, index int) []byte {
+	b := make([]byte, namespaceIndexKeyLen)
+	copy(b, namespace[:])
+	binary.BigEndian.PutUint64(b[NamespaceLen:], height)
+	binary.BigEndian.PutUint16(b[NamespaceLen+8:], uint16(index))
+	return b
+}
+
+// namespaceEntry is a piece of accepted data and the height of its block
+type namespaceEntry struct {
+	// The data, or its SHA-256 hash if [hashOnly]
+	data     [dataLen]byte
+	hashOnly bool
+	height   uint64
+	// Index of the data in its block
+	index int
+}
+
+// namespaceSummary is the number of accepted pieces of data in [namespace]
+type namespaceSummary struct {
+	namespace [NamespaceLen]byte
+	count     uint64
+}
+
+// indexNamespaces adds [b]'s data to the index of its namespace on chains
+// with namespaces. The genesis data has no namespace, so it isn't indexed.
+func (b *Block) indexNamespaces() error {
+	if !b.vm.genesis.Params.Namespaces {
+		return nil
+	}
+	for i, namespace := range b.Ns {
+		if err := b.vm.state.putNamespaceData(namespace, b.Height(), i, b.Dt[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) namespaceData(ctx context.Context, namespace [NamespaceLen]byte, start uint64, index int, limit int) ([]namespaceEntry, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getNamespaceData(ctx, namespace, start, index, limit)
+}
+
+func (vm *VM) namespaces(ctx context.Context, start uint64, limit int) ([]namespaceSummary, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	return vm.state.getNamespaces(ctx, start, limit)
+}
+
+// GetNamespaceDataArgs are the arguments to GetNamespaceData
+type GetNamespaceDataArgs struct {
+	Namespace string `json:"namespace"`
+	// Height of the first block whose data is returned
+	StartHeight json.Uint64 `json:"startHeight"`
+	// Max number of pieces of data to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the data starts where the previous page's nextCursor says,
+	// instead of at [StartHeight]
+	Cursor string `json:"cursor"`
+
+	namespace [NamespaceLen]byte
+	limit     int
+	start     pageCursor
+}
+
+func (a *GetNamespaceDataArgs) validate(v *argValidator) {
+	var err error
+	a.namespace, err = parseNamespace(a.Namespace)
+	v.add("namespace", err)
+	a.limit = v.limit("limit", uint64(a.Limit), defaultNamespacePageSize, maxNamespacePageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: namespaceDataCursor, direction: forward, position: uint64(a.StartHeight)})
+}
+
+// APINamespaceData is a piece of accepted data in a namespace
+type APINamespaceData struct {
+	// Base 58 repr. of the data. Empty if the namespace's retention policy
+	// only keeps the data's hash.
+	Data string `json:"data,omitempty"`
+	// Base 58 repr. of the SHA-256 hash of the data, if only its hash is
+	// kept
+	Hash string `json:"hash,omitempty"`
+	// Height of the accepted block that contains the data
+	Height json.Uint64 `json:"height"`
+}
+
+// GetNamespaceDataReply is the reply from GetNamespaceData
+type GetNamespaceDataReply struct {
+	Data []APINamespaceData `json:"data"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// GetNamespaceData returns [args.Namespace]'s accepted data, oldest first,
+// starting at the block at [args.StartHeight]. Data removed by the
+// namespace's retention policy isn't returned.
+func (s *Service) GetNamespaceData(r *http.Request, args *GetNamespaceDataArgs, reply *GetNamespaceDataReply) error {
+	ctx := requestContext(r)
+	if !s.backend.chainParams().Namespaces {
+		return errNamespacesDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	entries, err := s.backend.namespaceData(ctx, args.namespace, args.start.position, int(args.start.index), args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(entries) > args.limit {
+		next := args.start.at(entries[args.limit].height)
+		next.index = uint16(entries[args.limit].index)
+		reply.NextCursor = next.String()
+		entries = entries[:args.limit]
+	}
+	reply.Data = make([]APINamespaceData, len(entries))
+	for i, entry := range entries {
+		encoded := encoding.EncodeCB58(entry.data[:])
+		reply.Data[i] = APINamespaceData{Height: json.Uint64(entry.height)}
+		if entry.hashOnly {
+			reply.Data[i].Hash = encoded
+		} else {
+			reply.Data[i].Data = encoded
+		}
+	}
+	return nil
+}
+
+// NamespaceSummary is the number of accepted pieces of data in a namespace
+type NamespaceSummary struct {
+	Namespace string      `json:"namespace"`
+	Count     json.Uint64 `json:"count"`
+}
+
+// ListNamespacesArgs are the arguments to ListNamespaces
+type ListNamespacesArgs struct {
+	// Max number of namespaces to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the namespaces start where the previous page's nextCursor
+	// says, instead of at the first one. Namespaces that get their first
+	// data after the previous page may move a namespace onto the next page
+	// too.
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *ListNamespacesArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultNamespacePageSize, maxNamespacePageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: namespacesCursor, direction: forward})
+}
+
+// ListNamespacesReply is the reply from ListNamespaces
+type ListNamespacesReply struct {
+	Namespaces []NamespaceSummary `json:"namespaces"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListNamespaces returns each namespace with accepted data and how much data
+// it has, in the order of the namespaces' bytes
+func (s *Service) ListNamespaces(r *http.Request, args *ListNamespacesArgs, reply *ListNamespacesReply) error {
+	ctx := requestContext(r)
+	if !s.backend.chainParams().Namespaces {
+		return errNamespacesDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	summaries, err := s.backend.namespaces(ctx, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(summaries) > args.limit {
+		reply.NextCursor = args.start.at(args.start.position + uint64(args.limit)).String()
+		summaries = summaries[:args.limit]
+	}
+	reply.Namespaces = make([]NamespaceSummary, len(summaries))
+	for i, summary := range summaries {
+		reply.Namespaces[i] = NamespaceSummary{
+			Namespace: namespaceString(summary.namespace),
+			Count:     json.Uint64(summary.count),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/codec"
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+)
+
+// The kinds of operations in the operation journal. The kind is the first
+// byte of an operation's key.
+const (
+	signerOpKind byte = iota
+	transferKind
+	claimTransferKind
+	aclOpKind
+	revealKind
+	keyRegistrationKind
+	encryptedKind
+	feedUpdateKind
+	warpMessageKind
+	voteKind
+	// A multisig signature is journaled as a proposal with only that
+	// signature
+	multisigSignatureKind
+	submissionKind
+)
+
+var opJournalPrefix = []byte("opJournal")
+
+// opJournal is a write-ahead log of the operations submitted over the API.
+// An operation is written before it's acknowledged and is only deleted once
+// it's dropped from its pending pool, so operations that weren't accepted
+// before the node stopped are put back into their pools when it restarts.
+// An operation's key is its kind followed by the hash of its bytes.
+type opJournal struct {
+	codec codec.Manager
+	db    database.Database // kind + hash -> operation
+}
+
+// key returns the key of the operation of [kind] with the bytes [b]
+func (j *opJournal) key(kind byte, b []byte) []byte {
+	return append([]byte{kind}, hashing.ComputeHash256(b)...)
+}
+
+// marshal returns the bytes of [op]. Operations are marshaled with the codec
+// that serializes every field of them.
+func (j *opJournal) marshal(op any) ([]byte, error) {
+	return j.codec.Marshal(namespacedCodecVersion, op)
+}
+
+// put durably writes [op] of [kind] to the journal
+func (j *opJournal) put(kind byte, op any) error {
+	b, err := j.marshal(op)
+	if err != nil {
+		return err
+	}
+	return j.db.Put(j.key(kind, b), b)
+}
+
+// delete durably removes [op] of [kind] from the journal
+func (j *opJournal) delete(kind byte, op any) error {
+	b, err := j.marshal(op)
+	if err != nil {
+		return err
+	}
+	return j.db.Delete(j.key(kind, b))
+}
+
+// restoreOps passes each operation of [kind] in [j] to [restore]. Operations
+// that can't be parsed or restored are removed from the journal.
+func restoreOps[T any](j *opJournal, kind byte, restore func(T) error) (int, error) {
+	it := j.db.NewIteratorWithPrefix([]byte{kind})
+	defer it.Release()
+
+	var (
+		restored int
+		dropped  [][]byte
+	)
+	for it.Next() {
+		var op T
+		if _, err := j.codec.Unmarshal(it.Value(), &op); err != nil || restore(op) != nil {
+			dropped = append(dropped, it.Key())
+			continue
+		}
+		restored++
+	}
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	for _, key := range dropped {
+		if err := j.db.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	return restored, nil
+}
+
+// pruneOps returns the operations in [ops] that [keep] returns true for and
+// removes the others, which are of [kind], from [j]. [ops] is modified.
+func pruneOps[T any](j *opJournal, kind byte, ops []T, keep func(*T) bool) ([]T, error) {
+	var dropped []T
+	remaining := ops[:0]
+	for _, op := range ops {
+		if keep(&op) {
+			remaining = append(remaining, op)
+		} else {
+			dropped = append(dropped, op)
+		}
+	}
+	for i := range dropped {
+		if err := j.delete(kind, &dropped[i]); err != nil {
+			return remaining, err
+		}
+	}
+	return remaining, nil
+}
+
+// restorePendingOps puts the operations in the journal back into their
+// pending pools and drops the ones that can't be accepted after
+// [lastAccepted], the last accepted block
+func (vm *VM) restorePendingOps(lastAccepted *Block) error {
+	j := vm.opJournal
+	total := 0
+	for _, restore := range []func() (int, error){
+		func() (int, error) {
+			return restoreOps(j, signerOpKind, func(op SignerOp) error {
+				vm.pendingOps.add(op)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, transferKind, func(t Transfer) error {
+				vm.pendingTransfers.add(t)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, claimTransferKind, func(t ClaimTransfer) error {
+				vm.pendingClaims.add(t)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, aclOpKind, func(op ACLOp) error {
+				vm.pendingACLOps.add(op)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, revealKind, func(r Reveal) error {
+				vm.pendingReveals.add(r)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, keyRegistrationKind, func(r KeyRegistration) error {
+				vm.pendingEncryption.addKeyRegistration(r)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, encryptedKind, func(p EncryptedPayload) error {
+				vm.pendingEncryption.addEncrypted(p)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, feedUpdateKind, func(u FeedUpdate) error {
+				vm.pendingFeeds.add(u)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, warpMessageKind, func(msg []byte) error {
+				vm.pendingWarp.add(msg)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, voteKind, func(v GovernanceVote) error {
+				vm.pendingVotes.add(v)
+				return nil
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, multisigSignatureKind, func(p MultisigProposal) error {
+				config := vm.genesis.Params.multisigConfig(p.Set)
+				if config == nil || len(p.Sigs) != 1 {
+					return errUnknownMultisig
+				}
+				_, err := vm.pendingMultisigs.addSignature(vm.ctx.ChainID, config, p.Set, p.Data, p.Namespace, p.Sigs[0])
+				return err
+			})
+		},
+		func() (int, error) {
+			return restoreOps(j, submissionKind, func(s SignedSubmission) error {
+				vm.pendingSubmissions.add(s)
+				return nil
+			})
+		},
+	} {
+		count, err := restore()
+		if err != nil {
+			return fmt.Errorf("couldn't restore operations from journal: %w", err)
+		}
+		total += count
+	}
+	if total == 0 {
+		return nil
+	}
+	vm.logs.mempool.Info("restoring submitted operations from journal", zap.Int("numPending", total))
+	if err := vm.prunePendingOps(lastAccepted); err != nil {
+		return err
+	}
+	vm.builder.markReady()
+	return nil
+}
+
+// prunePendingOps drops the pending operations of every kind that can't be
+// accepted after [lastAccepted], the last accepted block
+func (vm *VM) prunePendingOps(lastAccepted *Block) error {
+	for _, prune := range []func() error{
+		func() error { return vm.pendingOps.prune(vm) },
+		func() error { return vm.pendingTransfers.prune(vm) },
+		func() error { return vm.pendingClaims.prune(vm) },
+		func() error { return vm.pendingACLOps.prune(vm) },
+		func() error { return vm.pendingReveals.prune(vm) },
+		func() error { return vm.pendingEncryption.prune(vm) },
+		func() error { return vm.pendingFeeds.prune(vm) },
+		func() error { return vm.pendingWarp.prune(vm) },
+		func() error { return vm.pendingVotes.prune(vm, lastAccepted) },
+		func() error { return vm.pendingMultisigs.prune(vm) },
+		func() error { return vm.pendingSubmissions.prune(vm) },
+	} {
+		if err := prune(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
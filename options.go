@@ -0,0 +1,80 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"github.com/ava-labs/avalanchego/codec"
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/database/versiondb"
+	"github.com/ava-labs/avalanchego/utils/timer/mockable"
+)
+
+// Option sets a dependency of a VM built by [NewVM]
+type Option func(*VM)
+
+// WithDatabase makes the VM store its chain and indexes in [db] instead of
+// the database it's initialized with
+func WithDatabase(db database.Database) Option {
+	return func(vm *VM) {
+		vm.baseDB = db
+	}
+}
+
+// WithCodec makes the VM marshal and unmarshal values of codec [version]
+// with [c] instead of its own codec of that version. Nodes running VMs with
+// different codecs can't parse each other's blocks.
+func WithCodec(version uint16, c codec.Codec) Option {
+	return func(vm *VM) {
+		if vm.codecOverrides == nil {
+			vm.codecOverrides = make(map[uint16]codec.Codec)
+		}
+		vm.codecOverrides[version] = c
+	}
+}
+
+// WithClock makes the VM read local time from [clock]. The VMs of a
+// simulated network may share a clock.
+func WithClock(clock *mockable.Clock) Option {
+	return func(vm *VM) {
+		vm.clock = clock
+	}
+}
+
+// WithMempool makes the VM hold the proposed data that's due in [mempool],
+// which decides the order it's put into blocks in
+func WithMempool(mempool Mempool) Option {
+	return func(vm *VM) {
+		vm.mempool = mempool
+	}
+}
+
+// NewVM returns a VM with the dependencies set by [opts]. The VM must still
+// be initialized to run on a chain, but if it has a database, blocks can be
+// created, parsed and stored before then, so tests and embedders can
+// exercise them without a snow context. Initialize keeps the dependencies
+// set here.
+func NewVM(opts ...Option) (*VM, error) {
+	vm := &VM{}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	// Until Initialize parses the chain's config, the vm runs with the
+	// zero config
+	vm.config.Store(&Config{})
+	if vm.clock == nil {
+		vm.clock = &mockable.Clock{}
+	}
+	if vm.mempool == nil {
+		vm.mempool = &fifoMempool{}
+	}
+	if err := vm.initializeCodecs(); err != nil {
+		return nil, err
+	}
+	if vm.baseDB != nil {
+		vm.db = versiondb.New(vm.baseDB)
+		vm.state = newState(vm, vm.db)
+		vm.processing = newBlockTree()
+	}
+	return vm, nil
+}
@@ -0,0 +1,262 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+)
+
+const (
+	// NonZeroPayloadRule makes data that is all zeros invalid
+	NonZeroPayloadRule PayloadRule = "nonZero"
+	// DigestPayloadRule requires every piece of data to be a full 32 byte
+	// SHA-256 digest. Data is always 32 bytes on chain, so at the consensus
+	// level this rule requires the chain's max payload size to be 32 bytes;
+	// the API also rejects proposals shorter than 32 bytes.
+	DigestPayloadRule PayloadRule = "sha256Digest"
+	// KeyValuePayloadRule requires every piece of data to be a put or delete
+	// of a key, which is applied to the chain's key-value state when the
+	// block is accepted. See [EncodePut] for the format. Like
+	// [DigestPayloadRule], it requires a max payload size of 32 bytes.
+	KeyValuePayloadRule PayloadRule = "keyValue"
+	// DocumentPayloadRule requires every piece of data to be a version of a
+	// document, which is added to the document's history when the block is
+	// accepted. See [EncodeDocumentVersion] for the format. Like
+	// [DigestPayloadRule], it requires a max payload size of 32 bytes.
+	DocumentPayloadRule PayloadRule = "document"
+)
+
+var (
+	errUnknownPayloadRule = errors.New("unknown payload rule")
+	errDigestPayloadSize  = fmt.Errorf("%s rule requires a max payload size of %d", DigestPayloadRule, dataLen)
+	errZeroPayload        = errors.New("data must not be all zeros")
+	errShortDigest        = fmt.Errorf("data must be a %d byte digest", dataLen)
+	errKeyValuePayload    = fmt.Errorf("%s rule requires a max payload size of %d", KeyValuePayloadRule, dataLen)
+	errConflictingRules   = errors.New("payload rules conflict")
+)
+
+// PayloadRule is a consensus rule that every piece of data in a block must
+// follow
+type PayloadRule string
+
+// verifyPayloadRules returns nil iff every rule in [rules] is known and can be
+// enforced on a chain with parameters [params], and no two of them conflict.
+// [DigestPayloadRule], [KeyValuePayloadRule] and [DocumentPayloadRule] each
+// give data a different format, so at most one of them may be in [rules].
+func verifyPayloadRules(rules []PayloadRule, params *ChainParams) error {
+	var format PayloadRule
+	for _, rule := range rules {
+		switch rule {
+		case NonZeroPayloadRule:
+			continue
+		case DigestPayloadRule:
+			if params.MaxPayloadSize != dataLen {
+				return errDigestPayloadSize
+			}
+		case KeyValuePayloadRule:
+			if params.MaxPayloadSize != dataLen {
+				return errKeyValuePayload
+			}
+		case DocumentPayloadRule:
+			if params.MaxPayloadSize != dataLen {
+				return errDocumentPayload
+			}
+		default:
+			return fmt.Errorf("%w: %q", errUnknownPayloadRule, rule)
+		}
+		if format != "" && format != rule {
+			return fmt.Errorf("%w: %q and %q", errConflictingRules, format, rule)
+		}
+		format = rule
+	}
+	return nil
+}
+
+// verifyData returns nil iff [data] follows [r]
+func (r PayloadRule) verifyData(data [dataLen]byte) error {
+	switch r {
+	case NonZeroPayloadRule:
+		if data == [dataLen]byte{} {
+			return errZeroPayload
+		}
+	case KeyValuePayloadRule:
+		_, err := parseKVOp(data)
+		return err
+	case DocumentPayloadRule:
+		_, err := parseDocVersion(data)
+		return err
+	}
+	return nil
+}
+
+// verifyProposal returns nil iff [proposal], the bytes of a piece of data
+// before it's zero-padded, follows [r]
+func (r PayloadRule) verifyProposal(proposal []byte) error {
+	if r == DigestPayloadRule && len(proposal) != dataLen {
+		return errShortDigest
+	}
+	var data [dataLen]byte
+	copy(data[:], proposal)
+	return r.verifyData(data)
+}
+
+// PayloadPolicyUpgrade adds payload rules and validators at an activation
+// point
+type PayloadPolicyUpgrade struct {
+	Activation
+	Rules      []PayloadRule            `json:"rules"`
+	Validators []PayloadValidatorConfig `json:"validators"`
+}
+
+// payloadRules returns the payload rules that a block at [height] with time
+// [timestamp] must follow
+func (vm *VM) payloadRules(height uint64, timestamp time.Time) []PayloadRule {
+	rules := vm.genesis.Params.PayloadRules
+	if upgrade := vm.upgrades.PayloadPolicy; upgrade != nil && vm.upgrades.IsActive(PayloadPolicyFeature, height, timestamp) {
+		rules = append(rules[:len(rules):len(rules)], upgrade.Rules...)
+	}
+	return rules
+}
+
+// allPayloadRules returns the payload rules of a chain with parameters
+// [params] once every upgrade in [upgrades] is active
+func allPayloadRules(params *ChainParams, upgrades *UpgradeConfig) []PayloadRule {
+	rules := params.PayloadRules
+	if upgrades.PayloadPolicy != nil {
+		rules = append(rules[:len(rules):len(rules)], upgrades.PayloadPolicy.Rules...)
+	}
+	return rules
+}
+
+// hasPayloadRule returns true iff [rule] is one of [rules]
+func hasPayloadRule(rules []PayloadRule, rule PayloadRule) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyProposal returns nil iff [proposal] follows the payload rules of the
+// block after the last accepted block and is accepted by the payload
+// validators of that block and of this node's API and the fxs' payload
+// verifiers, and this node's signer may write it in [namespace]
+func (vm *VM) verifyProposal(proposal []byte, namespace [NamespaceLen]byte) error {
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	lastAccepted, err := vm.state.getBlock(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	height, now := lastAccepted.Height()+1, vm.clock.Time()
+	for _, rule := range vm.payloadRules(height, now) {
+		if err := rule.verifyProposal(proposal); err != nil {
+			return err
+		}
+	}
+	if err := vm.genesis.Params.verifyNamespace(namespace); err != nil {
+		return err
+	}
+	var data [dataLen]byte
+	copy(data[:], proposal)
+	if err := validatePayload(vm.payloadValidators(height, now), data); err != nil {
+		return err
+	}
+	if err := validatePayload(vm.apiValidators, data); err != nil {
+		return err
+	}
+	if err := vm.verifyPayloadFxs(data); err != nil {
+		return err
+	}
+	return vm.verifyCanWrite(lastAccepted, namespace)
+}
+
+// verifyData returns nil iff [data] follows [rules] and is accepted by
+// [validators] and the fxs' payload verifiers
+func (vm *VM) verifyData(rules []PayloadRule, validators []PayloadValidator, data [dataLen]byte) error {
+	for _, rule := range rules {
+		if err := rule.verifyData(data); err != nil {
+			return err
+		}
+	}
+	if err := validatePayload(validators, data); err != nil {
+		return err
+	}
+	return vm.verifyPayloadFxs(data)
+}
+
+// verifySignedData returns nil iff [data] in [namespace], which [writer]
+// signed, can be put in a child of [parent] with parameters [params] and
+// timestamp [timestamp]. It checks the data on its own; the namespace quota
+// and the other data of the child are checked by [Block.verify].
+func (vm *VM) verifySignedData(parent *Block, params *ChainParams, timestamp time.Time, writer ids.ShortID, data [dataLen]byte, namespace [NamespaceLen]byte) error {
+	height := parent.Height() + 1
+	if err := vm.verifyData(vm.payloadRules(height, timestamp), vm.payloadValidators(height, timestamp), data); err != nil {
+		return err
+	}
+	if err := vm.genesis.Params.verifyNamespace(namespace); err != nil {
+		return err
+	}
+	if err := params.verifyPayloadSize(data); err != nil {
+		return err
+	}
+	if vm.upgrades.IsActive(DuplicateRejectionFeature, height, timestamp) {
+		duplicate, err := vm.hasDataAfter(parent, data)
+		if err != nil {
+			return err
+		}
+		if duplicate {
+			return errDuplicateData
+		}
+	}
+	writable, err := vm.canWrite(parent, writer, namespace)
+	if err != nil {
+		return err
+	}
+	if !writable {
+		return errNoWritePermission
+	}
+	return nil
+}
+
+// verifyNextSignedData returns nil iff [data] in [namespace], which [writer]
+// signed, can be put in the block after the last accepted block and is
+// accepted by the payload validators of this node's API
+func (vm *VM) verifyNextSignedData(writer ids.ShortID, data [dataLen]byte, namespace [NamespaceLen]byte) error {
+	lastAcceptedID, err := vm.state.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	params, err := vm.paramsAt(lastAccepted, lastAccepted.Height()+1)
+	if err != nil {
+		return err
+	}
+	if err := vm.verifySignedData(lastAccepted, params, vm.clock.Time(), writer, data, namespace); err != nil {
+		return err
+	}
+	return validatePayload(vm.apiValidators, data)
+}
+
+// fitsBlock returns true iff [d] in [namespace] can be added to a block being
+// built whose data is [data] in [namespaces] without repeating a piece of
+// data or going over the namespace quota
+func (vm *VM) fitsBlock(data [][dataLen]byte, namespaces [][NamespaceLen]byte, d [dataLen]byte, namespace [NamespaceLen]byte) bool {
+	if slices.Contains(data, d) {
+		return false
+	}
+	params := &vm.genesis.Params
+	return !params.Namespaces || params.verifyNamespaces(append(namespaces[:len(namespaces):len(namespaces)], namespace)) == nil
+}
@@ -0,0 +1,50 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+)
+
+// profilerEndpoint is the path extension of the chain's profiler
+const profilerEndpoint = "/pprof"
+
+// profiler serves profiles of the node's process to requests that carry the
+// configured bearer token.
+// The profile is chosen with the "profile" query parameter: "cpu" for a CPU
+// profile and "trace" for an execution trace, both over the number of
+// seconds in the "seconds" query parameter, or the name of a runtime profile
+// such as "heap", "goroutine" or "mutex".
+type profiler struct {
+	token string
+}
+
+func (p *profiler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, p.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch name := r.URL.Query().Get("profile"); name {
+	case "cpu":
+		pprof.Profile(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		if runtimepprof.Lookup(name) == nil {
+			http.Error(w, "unknown profile", http.StatusNotFound)
+			return
+		}
+		pprof.Handler(name).ServeHTTP(w, r)
+	}
+}
+
+// authorized returns true iff [r] carries the bearer token [token]
+func authorized(r *http.Request, token string) bool {
+	authorization := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) == 1
+}
@@ -0,0 +1,41 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package proof
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp/payload"
+)
+
+var (
+	errBadAttestation   = errors.New("attestation isn't a Warp message whose payload is a hash")
+	errWrongAttestation = errors.New("attestation isn't of the block by the chain")
+)
+
+// VerifyAttestation returns nil iff [msg] is a Warp message from the chain
+// [chainID] on the network [networkID] that attests the block [blockID], and
+// is signed by at least [quorumNum]/[quorumDen] of the weight of
+// [validators]. [validators] is the validator set of the chain's subnet at
+// the P-Chain height the attestation was aggregated at.
+// With the block ID of a verified [Proof], this shows that a quorum of stake
+// endorsed the timestamp of the proof's data.
+func VerifyAttestation(msg []byte, networkID uint32, chainID, blockID ids.ID, validators validators.WarpSet, quorumNum, quorumDen uint64) error {
+	m, err := warp.ParseMessage(msg)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadAttestation, err)
+	}
+	hash, err := payload.ParseHash(m.Payload)
+	if err != nil {
+		return errBadAttestation
+	}
+	if m.NetworkID != networkID || m.SourceChainID != chainID || hash.Hash != blockID {
+		return errWrongAttestation
+	}
+	return m.Signature.Verify(&m.UnsignedMessage, networkID, validators, quorumNum, quorumDen)
+}
@@ -0,0 +1,109 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package proof
+
+import (
+	"crypto/sha256"
+	"errors"
+	"slices"
+)
+
+// Leaves and interior nodes are hashed with different prefixes, so an
+// interior node can't be passed off as a leaf
+const (
+	leafPrefix byte = 0
+	nodePrefix byte = 1
+)
+
+var (
+	errBadMerkleStep = errors.New("merkle step must have a 32 byte hash")
+	errBadLeaf       = errors.New("aggregated data must be a 32 byte hash")
+)
+
+// MerkleStep is the sibling of a node on the path from a leaf of a Merkle
+// tree to its root
+type MerkleStep struct {
+	Hash []byte `json:"hash"`
+	// If true, the sibling is the left child of the parent
+	Left bool `json:"left"`
+}
+
+// MerklePath shows that a hash is a leaf of a Merkle tree. The tree's root
+// is the data in the proof's block.
+type MerklePath struct {
+	// Siblings from the leaf up to the root
+	Steps []MerkleStep `json:"steps"`
+}
+
+// LeafHash returns the hash of the leaf of [hash] in a Merkle tree
+func LeafHash(hash [DataLen]byte) [DataLen]byte {
+	return sha256.Sum256(append([]byte{leafPrefix}, hash[:]...))
+}
+
+// NodeHash returns the hash of the interior node whose children are [left]
+// and [right]
+func NodeHash(left, right [DataLen]byte) [DataLen]byte {
+	msg := make([]byte, 0, 1+2*DataLen)
+	msg = append(msg, nodePrefix)
+	msg = append(msg, left[:]...)
+	msg = append(msg, right[:]...)
+	return sha256.Sum256(msg)
+}
+
+// Root returns the root of the Merkle tree that [p] shows [hash] is a leaf
+// of
+func (p *MerklePath) Root(hash [DataLen]byte) ([DataLen]byte, error) {
+	node := LeafHash(hash)
+	for _, step := range p.Steps {
+		if len(step.Hash) != DataLen {
+			return [DataLen]byte{}, errBadMerkleStep
+		}
+		var sibling [DataLen]byte
+		copy(sibling[:], step.Hash)
+		if step.Left {
+			node = NodeHash(sibling, node)
+		} else {
+			node = NodeHash(node, sibling)
+		}
+	}
+	return node, nil
+}
+
+// MerkleTree returns the root of the Merkle tree whose leaves are [hashes],
+// in order, and the path of each leaf. A node without a sibling is carried
+// up to the next level unchanged. [hashes] must not be empty.
+func MerkleTree(hashes [][DataLen]byte) ([DataLen]byte, []MerklePath) {
+	paths := make([]MerklePath, len(hashes))
+	level := make([][DataLen]byte, len(hashes))
+	// members[i] are the indices of the leaves under the ith node of [level]
+	members := make([][]int, len(hashes))
+	for i, hash := range hashes {
+		level[i] = LeafHash(hash)
+		members[i] = []int{i}
+	}
+	for len(level) > 1 {
+		var (
+			nextLevel   [][DataLen]byte
+			nextMembers [][]int
+		)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				nextLevel = append(nextLevel, level[i])
+				nextMembers = append(nextMembers, members[i])
+				continue
+			}
+			left, right := level[i], level[i+1]
+			for _, leaf := range members[i] {
+				paths[leaf].Steps = append(paths[leaf].Steps, MerkleStep{Hash: right[:]})
+			}
+			for _, leaf := range members[i+1] {
+				paths[leaf].Steps = append(paths[leaf].Steps, MerkleStep{Hash: left[:], Left: true})
+			}
+			nextLevel = append(nextLevel, NodeHash(left, right))
+			nextMembers = append(nextMembers, slices.Concat(members[i], members[i+1]))
+		}
+		level, members = nextLevel, nextMembers
+	}
+	return level[0], paths
+}
@@ -0,0 +1,155 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+// Package proof verifies that a piece of data was timestamped by a chain
+// that uses the timestamp VM, without access to the chain. It doesn't import
+// the VM, so third parties can verify proofs offline with few dependencies.
+package proof
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+)
+
+const (
+	// DataLen is the length of a piece of data in a block
+	DataLen = 32
+
+	// A block's bytes start with the codec version followed by the parent ID,
+	// height, timestamp and the number of pieces of data, which are followed
+	// by the data. This is the layout of every codec version of the VM.
+	heightOffset    = 2 + ids.IDLen
+	timestampOffset = heightOffset + 8
+	numDataOffset   = timestampOffset + 8
+	dataOffset      = numDataOffset + 4
+	maxCodecVersion = 2
+)
+
+// checkpointPrefix starts the message of a checkpoint signature, so that it
+// can't be replayed as a signature of a block or an operation
+var checkpointPrefix = []byte("timestampvm checkpoint")
+
+var (
+	errBadBlock         = errors.New("proof's block isn't a block of the timestamp VM")
+	errBadIndex         = errors.New("proof's index isn't a position of the block's data")
+	errWrongData        = errors.New("proof's block has other data at the proof's index")
+	errNoCheckpoint     = errors.New("proof has no checkpoint signature")
+	errBadCheckpoint    = errors.New("proof's checkpoint isn't signed by its signer")
+	errUntrustedSigner  = errors.New("proof's checkpoint signer isn't trusted")
+	errBadSignatureSize = errors.New("checkpoint signature must be 65 bytes")
+)
+
+// Proof shows that a piece of data is in a block accepted by a chain
+type Proof struct {
+	// ID of the chain that accepted the block
+	ChainID ids.ID `json:"chainID"`
+	// Bytes of the block, whose hash is the block's ID
+	Block []byte `json:"block"`
+	// Position of the data among the block's data
+	Index uint32 `json:"index"`
+	// Signature of a node that the block is accepted. Nil if the node that
+	// made the proof has no signer.
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+	// If set, the proof is of a hash that was aggregated with others into a
+	// Merkle tree, and the data at [Index] is the tree's root
+	Merkle *MerklePath `json:"merkle,omitempty"`
+}
+
+// Checkpoint is a node's signature that a block is accepted
+type Checkpoint struct {
+	Signer ids.ShortID `json:"signer"`
+	// 65 byte recoverable secp256k1 signature of the checkpoint's hash
+	Signature []byte `json:"signature"`
+}
+
+// Timestamp is what a valid proof shows
+type Timestamp struct {
+	BlockID ids.ID
+	Height  uint64
+	// Time of the block that contains the data
+	Time time.Time
+	// Signer of the checkpoint, if the proof has one
+	Signer ids.ShortID
+}
+
+// CheckpointHash returns the hash that a node signs to attest that the block
+// [blockID] at [height] is accepted by the chain [chainID]
+func CheckpointHash(chainID, blockID ids.ID, height uint64) []byte {
+	hasher := sha256.New()
+	_, _ = hasher.Write(checkpointPrefix)
+	_, _ = hasher.Write(chainID[:])
+	_, _ = hasher.Write(blockID[:])
+	_ = binary.Write(hasher, binary.BigEndian, height)
+	return hasher.Sum(nil)
+}
+
+// Verify returns when [data], zero-padded to [DataLen] bytes, was timestamped
+// if [p] shows that it is in an accepted block. If [p] has a Merkle path,
+// [data] is the aggregated hash instead.
+// If [trusted] is empty, the checkpoint isn't checked, so the proof only
+// shows that the data is in the block; the caller must know by some other
+// means that the block is accepted. Otherwise the checkpoint must be signed
+// by one of [trusted].
+func (p *Proof) Verify(data []byte, trusted ...ids.ShortID) (*Timestamp, error) {
+	if len(data) > DataLen {
+		return nil, errWrongData
+	}
+	if p.Merkle != nil {
+		if len(data) != DataLen {
+			return nil, errBadLeaf
+		}
+		root, err := p.Merkle.Root([DataLen]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		data = root[:]
+	}
+	if len(p.Block) < dataOffset || binary.BigEndian.Uint16(p.Block) > maxCodecVersion {
+		return nil, errBadBlock
+	}
+	numData := binary.BigEndian.Uint32(p.Block[numDataOffset:])
+	if p.Index >= numData {
+		return nil, errBadIndex
+	}
+	start := dataOffset + int(p.Index)*DataLen
+	if len(p.Block) < start+DataLen {
+		return nil, errBadBlock
+	}
+	var padded [DataLen]byte
+	copy(padded[:], data)
+	if !bytes.Equal(p.Block[start:start+DataLen], padded[:]) {
+		return nil, errWrongData
+	}
+
+	timestamp := &Timestamp{
+		BlockID: sha256.Sum256(p.Block),
+		Height:  binary.BigEndian.Uint64(p.Block[heightOffset:]),
+		Time:    time.Unix(int64(binary.BigEndian.Uint64(p.Block[timestampOffset:])), 0),
+	}
+	if len(trusted) == 0 {
+		return timestamp, nil
+	}
+	if p.Checkpoint == nil {
+		return nil, errNoCheckpoint
+	}
+	if len(p.Checkpoint.Signature) != secp256k1.SignatureLen {
+		return nil, errBadSignatureSize
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(CheckpointHash(p.ChainID, timestamp.BlockID, timestamp.Height), p.Checkpoint.Signature)
+	if err != nil || key.Address() != p.Checkpoint.Signer {
+		return nil, errBadCheckpoint
+	}
+	for _, addr := range trusted {
+		if addr == p.Checkpoint.Signer {
+			timestamp.Signer = addr
+			return timestamp, nil
+		}
+	}
+	return nil, errUntrustedSigner
+}
@@ -0,0 +1,84 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/ava-labs/avalanchego/database"
+
+	"github.com/hitrich/AVM-TEST/proof"
+)
+
+var errDataNotAccepted = errors.New("data isn't in an accepted block")
+
+func (vm *VM) checkpointSigner() Signer {
+	return vm.signer
+}
+
+// GetProofArgs are the arguments to GetProof
+type GetProofArgs struct {
+	// Base 58 repr. of the data
+	Data string `json:"data"`
+
+	data [dataLen]byte
+}
+
+func (a *GetProofArgs) validate(v *argValidator) {
+	a.data = v.data("data", a.Data)
+}
+
+// GetProofReply is the reply from GetProof
+type GetProofReply struct {
+	proof.Proof
+}
+
+// GetProof returns a proof that [args.Data] is in an accepted block, which
+// can be checked offline with [proof.Proof.Verify]. If this node has a
+// signer, the proof has its checkpoint signature of the block.
+func (s *Service) GetProof(r *http.Request, args *GetProofArgs, reply *GetProofReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	var err error
+	reply.Proof, err = s.dataProof(ctx, args.data)
+	return err
+}
+
+// dataProof returns a proof that [data] is in an accepted block
+func (s *Service) dataProof(ctx context.Context, data [dataLen]byte) (proof.Proof, error) {
+	blkID, err := s.backend.dataBlock(ctx, data)
+	if err == database.ErrNotFound {
+		return proof.Proof{}, errDataNotAccepted
+	}
+	if err != nil {
+		return proof.Proof{}, err
+	}
+	blk, err := s.backend.lookupBlock(ctx, blkID)
+	if err != nil {
+		return proof.Proof{}, ErrBlockNotFound
+	}
+
+	chainID := s.backend.chainID()
+	p := proof.Proof{
+		ChainID: chainID,
+		Block:   blk.Bytes(),
+		Index:   uint32(slices.Index(blk.Dt, data)),
+	}
+	if signer := s.backend.checkpointSigner(); signer != nil {
+		sig, err := signer.SignHash(ctx, proof.CheckpointHash(chainID, blkID, blk.Height()))
+		if err != nil {
+			return proof.Proof{}, err
+		}
+		p.Checkpoint = &proof.Checkpoint{
+			Signer:    signer.Address(),
+			Signature: sig,
+		}
+	}
+	return p, nil
+}
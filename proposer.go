@@ -0,0 +1,151 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/consensus/snowman"
+	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
+	"github.com/ava-labs/avalanchego/utils/math"
+	"github.com/ava-labs/avalanchego/vms/proposervm/proposer"
+)
+
+// maxBuildBackoffFactor bounds a node's build backoff to this many times the
+// configured build backoff
+const maxBuildBackoffFactor = 10
+
+var (
+	errNotProposer  = errors.New("this node isn't the expected proposer for the current slot")
+	errBuildBackoff = errors.New("this node's build backoff hasn't elapsed")
+
+	_ block.BuildBlockWithContextChainVM = &VM{}
+)
+
+// BuildBlockWithContext is called instead of BuildBlock when the chain is
+// wrapped by the ProposerVM. [blockCtx].PChainHeight is the P-Chain height
+// the new block will be verified against.
+// If proposer window building is enabled, no block is built (and the
+// mempool is left untouched) unless this node is the expected proposer for
+// the current slot.
+func (vm *VM) BuildBlockWithContext(ctx context.Context, blockCtx *block.Context) (snowman.Block, error) {
+	if vm.config.Load().ProposerWindowBuilding {
+		if err := vm.verifyProposerSlot(ctx, blockCtx.PChainHeight); err != nil {
+			return nil, err
+		}
+	}
+	return vm.traceBuildBlock(ctx, blockCtx)
+}
+
+// verifyProposerSlot returns nil iff this node may propose a child of the
+// preferred block now, according to the validator set at [pChainHeight].
+// Slots are measured from the preferred block's timestamp.
+func (vm *VM) verifyProposerSlot(ctx context.Context, pChainHeight uint64) error {
+	parent, err := vm.getBlock(vm.preferred)
+	if err != nil {
+		return err
+	}
+
+	slot := proposer.TimeToSlot(parent.Timestamp(), vm.clock.Time())
+	expectedProposer, err := vm.windower.ExpectedProposer(ctx, parent.Height()+1, pChainHeight, slot)
+	switch {
+	case errors.Is(err, proposer.ErrAnyoneCanPropose):
+		return nil
+	case err != nil:
+		return err
+	case expectedProposer != vm.ctx.NodeID:
+		vm.logs.builder.Debug("skipping block building outside of this node's slot",
+			zap.Uint64("slot", slot),
+			zap.Uint64("pChainHeight", pChainHeight),
+			zap.Stringer("expectedProposer", expectedProposer),
+		)
+		return errNotProposer
+	default:
+		return nil
+	}
+}
+
+// buildBackoff is the time before which this node doesn't build a child of
+// [parentID]
+type buildBackoff struct {
+	parentID ids.ID
+	until    time.Time
+}
+
+// verifyBuildBackoff returns nil iff this node's build backoff for a child of
+// [parent] has elapsed. The backoff is drawn the first time this node tries
+// to build a child of [parent], and the engine is told to try again once it
+// elapses.
+func (vm *VM) verifyBuildBackoff(ctx context.Context, parent *Block) error {
+	if vm.config.Load().BuildBackoff.Duration == 0 {
+		return nil
+	}
+	now := vm.clock.Time()
+	if vm.backoff.parentID != parent.ID() {
+		delay, err := vm.drawBuildBackoff(ctx)
+		if err != nil {
+			return err
+		}
+		vm.backoff = buildBackoff{
+			parentID: parent.ID(),
+			until:    now.Add(delay),
+		}
+	}
+	if now.Before(vm.backoff.until) {
+		vm.builder.retryAt(vm.backoff.until)
+		return errBuildBackoff
+	}
+	return nil
+}
+
+// drawBuildBackoff returns a random delay, weighted by this node's stake in
+// the current validator set, before this node builds a block.
+// Each validator's delay is exponentially distributed with a rate
+// proportional to its weight, so each validator is the first to build with
+// probability proportional to its weight, and the first validator builds
+// after the configured build backoff on average. Nodes that aren't validators
+// wait the longest possible backoff.
+func (vm *VM) drawBuildBackoff(ctx context.Context) (time.Duration, error) {
+	height, err := vm.ctx.ValidatorState.GetCurrentHeight(ctx)
+	if err != nil {
+		return 0, err
+	}
+	validators, err := vm.ctx.ValidatorState.GetValidatorSet(ctx, height, vm.ctx.SubnetID)
+	if err != nil {
+		return 0, err
+	}
+	var totalWeight, weight uint64
+	for nodeID, vdr := range validators {
+		totalWeight, err = math.Add(totalWeight, vdr.Weight)
+		if err != nil {
+			return 0, err
+		}
+		if nodeID == vm.ctx.NodeID {
+			weight = vdr.Weight
+		}
+	}
+
+	backoff := vm.config.Load().BuildBackoff.Duration
+	maxBackoff := maxBuildBackoffFactor * backoff
+	switch {
+	case totalWeight == 0:
+		return 0, nil
+	case weight == 0:
+		return maxBackoff, nil
+	}
+	mean := float64(backoff) * float64(totalWeight) / float64(weight)
+	delay := time.Duration(min(rand.ExpFloat64()*mean, float64(maxBackoff)))
+	vm.logs.builder.Debug("drew build backoff",
+		zap.Duration("backoff", delay),
+		zap.Uint64("weight", weight),
+		zap.Uint64("totalWeight", totalWeight),
+	)
+	return delay, nil
+}
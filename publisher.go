@@ -0,0 +1,213 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+const (
+	// KafkaPublisher publishes block events to a Kafka topic
+	KafkaPublisher = "kafka"
+	// NATSPublisher publishes block events to a NATS subject
+	NATSPublisher = "nats"
+
+	defaultPublisherQueueSize = 1024
+	publishTimeout            = 10 * time.Second
+)
+
+var (
+	errBadPublisherType = errors.New("unknown publisher type")
+	errNoPublisherAddrs = errors.New("publisher needs at least one address")
+	errNoPublisherTopic = errors.New("publisher needs a topic")
+	errBadQueueSize     = errors.New("publisher queue size must not be negative")
+)
+
+// PublisherConfig configures the message bus that a [BlockEvent] is published
+// to for each block accepted after the node has bootstrapped
+type PublisherConfig struct {
+	// One of [KafkaPublisher] or [NATSPublisher]
+	Type string `json:"type"`
+	// Kafka brokers, or NATS server URLs, to connect to
+	Addrs []string `json:"addrs"`
+	// Kafka topic, or NATS subject, that events are published to
+	Topic string `json:"topic"`
+	// Number of events waiting to be published, beyond which events are
+	// dropped. Zero means 1024.
+	QueueSize int `json:"queueSize"`
+}
+
+// Verify returns nil iff [c] is a valid publisher config
+func (c *PublisherConfig) Verify() error {
+	switch {
+	case c.Type != KafkaPublisher && c.Type != NATSPublisher:
+		return fmt.Errorf("%w: %q", errBadPublisherType, c.Type)
+	case len(c.Addrs) == 0:
+		return errNoPublisherAddrs
+	case c.Topic == "":
+		return errNoPublisherTopic
+	case c.QueueSize < 0:
+		return errBadQueueSize
+	}
+	return nil
+}
+
+// messageBus is a connection to a message bus
+type messageBus interface {
+	// send publishes [event], the encoded event of the block [blkID]
+	send(ctx context.Context, blkID ids.ID, event []byte) error
+	close() error
+}
+
+// kafkaBus publishes events to a Kafka topic, keyed by block ID
+type kafkaBus struct {
+	writer *kafka.Writer
+}
+
+func (k *kafkaBus) send(ctx context.Context, blkID ids.ID, event []byte) error {
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Key:   blkID[:],
+		Value: event,
+	})
+}
+
+func (k *kafkaBus) close() error {
+	return k.writer.Close()
+}
+
+// natsBus publishes events to a NATS subject
+type natsBus struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func (n *natsBus) send(ctx context.Context, _ ids.ID, event []byte) error {
+	if err := n.conn.Publish(n.subject, event); err != nil {
+		return err
+	}
+	// Wait for the server to receive the event, so that errors are reported
+	return n.conn.FlushWithContext(ctx)
+}
+
+func (n *natsBus) close() error {
+	n.conn.Close()
+	return nil
+}
+
+// dialMessageBus connects to the message bus in [config]
+func dialMessageBus(config PublisherConfig) (messageBus, error) {
+	switch config.Type {
+	case KafkaPublisher:
+		return &kafkaBus{
+			writer: &kafka.Writer{
+				Addr:         kafka.TCP(config.Addrs...),
+				Topic:        config.Topic,
+				Balancer:     &kafka.Hash{},
+				RequiredAcks: kafka.RequireAll,
+			},
+		}, nil
+	case NATSPublisher:
+		// The chain starts even if the servers are down; events are buffered
+		// until a connection is made
+		conn, err := nats.Connect(strings.Join(config.Addrs, ","),
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return &natsBus{
+			conn:    conn,
+			subject: config.Topic,
+		}, nil
+	default:
+		return nil, errBadPublisherType
+	}
+}
+
+// queuedEvent is an event waiting to be published
+type queuedEvent struct {
+	blkID ids.ID
+	event []byte
+}
+
+// publisher publishes the events of accepted blocks to a message bus, in the
+// order the blocks were accepted
+type publisher struct {
+	bus   messageBus
+	log   logging.Logger
+	queue chan queuedEvent
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newPublisher starts publishing events to [bus]
+func newPublisher(bus messageBus, queueSize int, log logging.Logger) *publisher {
+	if queueSize == 0 {
+		queueSize = defaultPublisherQueueSize
+	}
+	p := &publisher{
+		bus:   bus,
+		log:   log,
+		queue: make(chan queuedEvent, queueSize),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.wg.Add(1)
+	go p.run()
+	return p
+}
+
+// publish queues [event], the encoded event of the block [blkID], which was
+// just accepted. It never blocks; if the queue is full, the event is dropped.
+func (p *publisher) publish(blkID ids.ID, event []byte) {
+	select {
+	case p.queue <- queuedEvent{blkID: blkID, event: event}:
+	default:
+		p.log.Warn("dropping block event because the publisher queue is full",
+			zap.Stringer("blkID", blkID),
+		)
+	}
+}
+
+// stop stops publishing events and closes the connection to the message bus.
+// Events that weren't published are dropped.
+func (p *publisher) stop() error {
+	p.cancel()
+	p.wg.Wait()
+	return p.bus.close()
+}
+
+func (p *publisher) run() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case e := <-p.queue:
+			ctx, cancel := context.WithTimeout(p.ctx, publishTimeout)
+			err := p.bus.send(ctx, e.blkID, e.event)
+			cancel()
+			if err != nil {
+				p.log.Warn("couldn't publish block event",
+					zap.Stringer("blkID", e.blkID),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+const (
+	// RequestIDHeader is the header of the ID that each API request is
+	// logged with. The ID is returned in the response, so that a failure a
+	// client reports can be matched to this node's logs.
+	RequestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLen is the max length of a request ID chosen by the client
+	maxRequestIDLen = 64
+)
+
+type requestIDKey struct{}
+
+// requestID returns the ID of the API request that [ctx] is the context of,
+// or the empty string if it has none
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDHandler gives each request an ID, puts it in the request's context
+// and returns it in the [RequestIDHeader] header of the response. The ID is
+// the request's own [RequestIDHeader] header if it's a valid ID, so that
+// clients can choose it, and random otherwise. The calls of a batch request
+// share the batch's ID.
+type requestIDHandler struct {
+	next http.Handler
+}
+
+func (h *requestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	h.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+}
+
+// validRequestID returns true iff [id] is a non-empty string of at most
+// [maxRequestIDLen] letters, digits, '-', '_', '.' and ':', so that it can't
+// forge log lines or response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,468 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// KeepForever keeps a namespace's data in the index forever
+	KeepForever = "forever"
+	// KeepDays removes a namespace's data from the index once its block is
+	// older than the policy's days
+	KeepDays = "days"
+	// HashOnly replaces a namespace's data in the index with its SHA-256
+	// hash once its block is older than the policy's days
+	HashOnly = "hashOnly"
+
+	// RetainedStatus is the status of data that is in the namespace index.
+	// The statuses only describe the namespace index: the data stays in its
+	// block, which GetBlock, the range queries and the indexer feed still
+	// serve in full.
+	RetainedStatus = "retained"
+	// HashOnlyStatus is the status of data whose hash replaced it in the
+	// namespace index
+	HashOnlyStatus = "hashOnly"
+	// DeletedStatus is the status of data removed from the namespace index
+	DeletedStatus = "deleted"
+
+	defaultCompactionInterval = time.Hour
+	// Max number of pieces of a namespace's data compacted at once, so that
+	// a pass doesn't hold the context lock for long
+	maxCompactedPerPass = 1024
+
+	// A hash-only value in the namespace index is a marker byte followed by
+	// the hash, so it's longer than the data it replaces
+	hashOnlyMarker   = 1
+	hashOnlyValueLen = 1 + sha256.Size
+)
+
+var (
+	errRetentionDisabled          = errors.New("data retention isn't enabled on this node")
+	errRetentionWithoutNamespaces = errors.New("retention requires a chain with namespaces")
+	errBadRetentionMode           = errors.New("unknown retention mode")
+	errBadRetentionDays           = errors.New("retention days must be positive, or zero to keep data forever")
+	errDuplicateRetention         = errors.New("namespace has more than one retention policy")
+	errBadCompactionInterval      = errors.New("compaction interval must not be negative")
+	errRetentionNotAccepted       = errors.New("only the retention of accepted blocks is reported")
+)
+
+// RetentionPolicy is how long this node keeps a namespace's data in its
+// namespace index
+type RetentionPolicy struct {
+	// One of [KeepForever], [KeepDays] or [HashOnly]. Defaults to
+	// [KeepForever].
+	Mode string `json:"mode"`
+	// Age in days of the blocks whose data is compacted
+	Days int `json:"days"`
+}
+
+// Verify returns nil iff [p] is a valid retention policy
+func (p *RetentionPolicy) Verify() error {
+	switch p.Mode {
+	case "", KeepForever:
+		if p.Days != 0 {
+			return errBadRetentionDays
+		}
+	case KeepDays, HashOnly:
+		if p.Days <= 0 {
+			return errBadRetentionDays
+		}
+	default:
+		return fmt.Errorf("%w: %q", errBadRetentionMode, p.Mode)
+	}
+	return nil
+}
+
+// forever returns true iff [p] keeps data forever
+func (p *RetentionPolicy) forever() bool {
+	return p.Mode == "" || p.Mode == KeepForever
+}
+
+// modeByte is the key of [p]'s mode in the compaction index
+func (p *RetentionPolicy) modeByte() byte {
+	if p.Mode == KeepDays {
+		return 1
+	}
+	return 2
+}
+
+// expiry returns when the data of a block at Unix time [timestamp] is
+// compacted under [p]
+func (p *RetentionPolicy) expiry(timestamp int64) time.Time {
+	return time.Unix(timestamp, 0).AddDate(0, 0, p.Days)
+}
+
+// NamespaceRetention is the retention policy of one namespace
+type NamespaceRetention struct {
+	Namespace string `json:"namespace"`
+	RetentionPolicy
+}
+
+// RetentionConfig configures how long this node keeps the data of each
+// namespace in its namespace index. Blocks are kept regardless, since the
+// chain's validity depends on them; retention only applies to the data this
+// node indexes and serves by namespace. Compacted data is still served in
+// full by every method that returns blocks.
+type RetentionConfig struct {
+	// Policy of the namespaces that don't have their own
+	Default RetentionPolicy `json:"default"`
+	// Policies of particular namespaces
+	Namespaces []NamespaceRetention `json:"namespaces"`
+	// How often expired data is compacted. Defaults to 1h.
+	Interval Duration `json:"interval"`
+}
+
+// Verify returns nil iff [c] is a valid retention config
+func (c *RetentionConfig) Verify() error {
+	if c.Interval.Duration < 0 {
+		return errBadCompactionInterval
+	}
+	if err := c.Default.Verify(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	namespaces := set.NewSet[[NamespaceLen]byte](len(c.Namespaces))
+	for _, n := range c.Namespaces {
+		namespace, err := parseNamespace(n.Namespace)
+		if err != nil {
+			return err
+		}
+		if namespaces.Contains(namespace) {
+			return fmt.Errorf("%w: %q", errDuplicateRetention, n.Namespace)
+		}
+		namespaces.Add(namespace)
+		if err := n.Verify(); err != nil {
+			return fmt.Errorf("namespace %q: %w", n.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// policy returns the retention policy of [namespace]
+func (c *RetentionConfig) policy(namespace [NamespaceLen]byte) RetentionPolicy {
+	for _, n := range c.Namespaces {
+		if padded, _ := parseNamespace(n.Namespace); padded == namespace {
+			return n.RetentionPolicy
+		}
+	}
+	return c.Default
+}
+
+// hashOnlyValue returns the value that replaces [data] in the namespace
+// index under the [HashOnly] mode
+func hashOnlyValue(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return append([]byte{hashOnlyMarker}, hash[:]...)
+}
+
+// parseNamespaceValue returns the data, or the hash of the data, that [value]
+// in the namespace index records
+func parseNamespaceValue(value []byte) ([dataLen]byte, bool) {
+	var data [dataLen]byte
+	if len(value) == hashOnlyValueLen && value[0] == hashOnlyMarker {
+		copy(data[:], value[1:])
+		return data, true
+	}
+	copy(data[:], value)
+	return data, false
+}
+
+// compactor periodically compacts the expired data in the namespace index.
+// Shutdown is called with the context lock held, so stop doesn't wait for a
+// pass that is waiting for the lock; a pass checks for shutdown once it holds
+// the lock instead.
+type compactor struct {
+	compact  func(now time.Time) error
+	log      logging.Logger
+	interval time.Duration
+
+	shutdown chan struct{}
+}
+
+// newCompactor calls [compact] every interval of [config]
+func newCompactor(config RetentionConfig, compact func(time.Time) error, log logging.Logger) *compactor {
+	if config.Interval.Duration == 0 {
+		config.Interval.Duration = defaultCompactionInterval
+	}
+	c := &compactor{
+		compact:  compact,
+		log:      log,
+		interval: config.Interval.Duration,
+		shutdown: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// stopped returns true iff [c] was stopped
+func (c *compactor) stopped() bool {
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops compacting
+func (c *compactor) stop() {
+	close(c.shutdown)
+}
+
+func (c *compactor) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := c.compact(now); err != nil {
+				c.log.Warn("couldn't compact expired data", zap.Error(err))
+			}
+		case <-c.shutdown:
+			return
+		}
+	}
+}
+
+// compactRetention removes or hashes the data in the namespace index whose
+// blocks are older than their namespaces' retention policies at [now]
+func (vm *VM) compactRetention(now time.Time) error {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	// While bootstrapping, the writes of accepted blocks are committed in
+	// batches, which a pass mustn't commit early
+	if vm.compactor.stopped() || !vm.bootstrapped {
+		return nil
+	}
+	summaries, err := vm.state.getNamespaces(context.Background(), 0, math.MaxInt)
+	if err != nil {
+		return err
+	}
+	compacted := 0
+	for _, summary := range summaries {
+		policy := vm.config.Load().Retention.policy(summary.namespace)
+		if policy.forever() {
+			continue
+		}
+		n, err := vm.compactNamespace(summary.namespace, policy, now)
+		if err != nil {
+			vm.abort()
+			return err
+		}
+		compacted += n
+	}
+	if compacted == 0 {
+		return nil
+	}
+	vm.ctx.Log.Debug("compacted expired data", zap.Int("numData", compacted))
+	if err := vm.commit(); err != nil {
+		vm.abort()
+		return err
+	}
+	return nil
+}
+
+// compactNamespace compacts up to [maxCompactedPerPass] pieces of
+// [namespace]'s expired data under [policy]. Returns how many were compacted.
+func (vm *VM) compactNamespace(namespace [NamespaceLen]byte, policy RetentionPolicy, now time.Time) (int, error) {
+	mode := policy.modeByte()
+	start, err := vm.state.getCompactedHeight(namespace, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	// The index is only written to once the iterator is released
+	type expired struct {
+		key   []byte
+		value []byte
+	}
+	var (
+		toCompact  []expired
+		timestamps = make(map[uint64]int64)
+		height     = start
+	)
+	it := vm.state.namespaceIterator(namespace, start)
+	for len(toCompact) < maxCompactedPerPass && it.Next() {
+		entryHeight := binary.BigEndian.Uint64(it.Key()[NamespaceLen:])
+		timestamp, ok := timestamps[entryHeight]
+		if !ok {
+			timestamp, err = vm.acceptedTimestamp(entryHeight)
+			if err != nil {
+				it.Release()
+				return 0, err
+			}
+			timestamps[entryHeight] = timestamp
+		}
+		// Blocks are in timestamp order, so no later data is expired either
+		if policy.expiry(timestamp).After(now) {
+			break
+		}
+		height = entryHeight
+		if _, hashOnly := parseNamespaceValue(it.Value()); hashOnly {
+			continue
+		}
+		toCompact = append(toCompact, expired{
+			key:   append([]byte(nil), it.Key()...),
+			value: append([]byte(nil), it.Value()...),
+		})
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range toCompact {
+		if policy.Mode == KeepDays {
+			err = vm.state.deleteNamespaceValue(e.key)
+		} else {
+			err = vm.state.putNamespaceValue(e.key, hashOnlyValue(e.value))
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = vm.state.appendIndexerEvent(indexerEvent{
+			height:    binary.BigEndian.Uint64(e.key[NamespaceLen:]),
+			tombstone: true,
+			index:     int(binary.BigEndian.Uint16(e.key[NamespaceLen+8:])),
+			hashOnly:  policy.Mode == HashOnly,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	if height == start {
+		return len(toCompact), nil
+	}
+	// Data at [height] may not all be compacted yet, so the next pass starts
+	// there
+	return len(toCompact), vm.state.putCompactedHeight(namespace, mode, height)
+}
+
+// acceptedTimestamp returns the timestamp of the accepted block at [height]
+func (vm *VM) acceptedTimestamp(height uint64) (int64, error) {
+	blkID, err := vm.state.getBlockIDAtHeight(height)
+	if err != nil {
+		return 0, err
+	}
+	blk, err := vm.state.getBlock(blkID)
+	if err != nil {
+		return 0, err
+	}
+	return blk.Tmstmp, nil
+}
+
+// dataRetention is the retention status of a piece of a block's data
+type dataRetention struct {
+	namespace [NamespaceLen]byte
+	status    string
+	// When the data is compacted. Zero if it's kept forever.
+	expiry time.Time
+}
+
+func (vm *VM) retentionEnabled() bool {
+	return vm.compactor != nil
+}
+
+func (vm *VM) blockRetention(blk *Block) ([]dataRetention, error) {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	retention := make([]dataRetention, len(blk.Ns))
+	for i, namespace := range blk.Ns {
+		policy := vm.config.Load().Retention.policy(namespace)
+		retention[i] = dataRetention{
+			namespace: namespace,
+			status:    RetainedStatus,
+		}
+		if !policy.forever() {
+			retention[i].expiry = policy.expiry(blk.Tmstmp)
+		}
+		value, err := vm.state.getNamespaceValue(namespaceIndexKey(namespace, blk.Height(), i))
+		switch {
+		case err == database.ErrNotFound:
+			retention[i].status = DeletedStatus
+		case err != nil:
+			return nil, err
+		default:
+			if _, hashOnly := parseNamespaceValue(value); hashOnly {
+				retention[i].status = HashOnlyStatus
+			}
+		}
+	}
+	return retention, nil
+}
+
+// GetBlockRetentionArgs are the arguments to GetBlockRetention
+type GetBlockRetentionArgs struct {
+	BlockID ids.ID `json:"blockID"`
+}
+
+// APIDataRetention is the retention status of a piece of a block's data
+type APIDataRetention struct {
+	Namespace string `json:"namespace"`
+	// One of [RetainedStatus], [HashOnlyStatus] or [DeletedStatus]
+	Status string `json:"status"`
+	// Unix time, in seconds, when the data is compacted. Zero if the
+	// namespace keeps its data forever.
+	Expiry json.Uint64 `json:"expiry"`
+}
+
+// GetBlockRetentionReply is the reply from GetBlockRetention
+type GetBlockRetentionReply struct {
+	// Retention status of each piece of the block's data, in the block's
+	// order
+	Data []APIDataRetention `json:"data"`
+}
+
+// GetBlockRetention returns whether this node still indexes each piece of
+// the accepted block [args.BlockID]'s data, under the retention policy of
+// the data's namespace. The block itself keeps all of its data. The genesis
+// data has no namespace, so it has no retention status.
+func (s *Service) GetBlockRetention(r *http.Request, args *GetBlockRetentionArgs, reply *GetBlockRetentionReply) error {
+	ctx := requestContext(r)
+	if !s.backend.retentionEnabled() {
+		return errRetentionDisabled
+	}
+	blk, err := s.backend.lookupBlock(ctx, args.BlockID)
+	if err != nil {
+		return ErrBlockNotFound
+	}
+	if blk.Status() != choices.Accepted {
+		return errRetentionNotAccepted
+	}
+	retention, err := s.backend.blockRetention(blk)
+	if err != nil {
+		return err
+	}
+	reply.Data = make([]APIDataRetention, len(retention))
+	for i, r := range retention {
+		reply.Data[i] = APIDataRetention{
+			Namespace: namespaceString(r.namespace),
+			Status:    r.status,
+		}
+		if !r.expiry.IsZero() {
+			reply.Data[i].Expiry = json.Uint64(r.expiry.Unix())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	// SaltLen is the length of the salt of a commitment
+	SaltLen = 32
+	// MaxRevealSize is the max number of bytes of revealed data
+	MaxRevealSize = 1024
+)
+
+var (
+	errRevealsDisabled  = errors.New("chain doesn't have reveals")
+	errTooManyReveals   = errors.New("block has too many reveals")
+	errRevealTooLarge   = fmt.Errorf("revealed data must be at most %d bytes", MaxRevealSize)
+	errBadRevealData    = fmt.Errorf("revealed data must be base 58 repr. of at most %d bytes", MaxRevealSize)
+	errNoCommitment     = errors.New("reveal doesn't match data in an earlier block")
+	errAlreadyRevealed  = errors.New("commitment is already revealed")
+	errNoSuchReveal     = errors.New("commitment isn't revealed")
+	errBadSalt          = fmt.Errorf("salt must be base 58 repr. of %d bytes", SaltLen)
+	errBadRevealedBytes = errors.New("revealed data must be at least 8 bytes")
+)
+
+// Commitment returns the hash of [data] and [salt] that is proposed as data
+// to commit to [data] without revealing it
+func Commitment(data []byte, salt [SaltLen]byte) [dataLen]byte {
+	msg := make([]byte, 0, len(data)+SaltLen)
+	msg = append(msg, data...)
+	msg = append(msg, salt[:]...)
+	return sha256.Sum256(msg)
+}
+
+// Reveal opens a commitment that is in an earlier block by giving the data
+// and salt it's the hash of. Each commitment is revealed at most once.
+type Reveal struct {
+	Data []byte        `serialize:"true"`
+	Salt [SaltLen]byte `serialize:"true"`
+}
+
+// Commitment returns the commitment that [r] opens
+func (r *Reveal) Commitment() [dataLen]byte {
+	return Commitment(r.Data, r.Salt)
+}
+
+// revealed is revealed data and the height of the block that revealed it
+type revealed struct {
+	data   []byte
+	height uint64
+}
+
+func parseRevealed(b []byte) (revealed, error) {
+	if len(b) < 8 {
+		return revealed{}, errBadRevealedBytes
+	}
+	return revealed{
+		data:   b[8:],
+		height: binary.BigEndian.Uint64(b),
+	}, nil
+}
+
+func (r revealed) bytes() []byte {
+	b := make([]byte, 8, 8+len(r.data))
+	binary.BigEndian.PutUint64(b, r.height)
+	return append(b, r.data...)
+}
+
+// verifyReveal returns nil iff [commitment] can be revealed in a child of
+// [parent]: it's data in [parent] or one of its ancestors and none of them
+// revealed it
+func (vm *VM) verifyReveal(parent *Block, commitment [dataLen]byte) error {
+	committed := false
+	// Processing ancestors aren't indexed yet
+	processing, err := vm.processingAncestors(parent)
+	if err != nil {
+		return err
+	}
+	for _, ancestor := range processing {
+		for i := range ancestor.Reveals {
+			if ancestor.Reveals[i].Commitment() == commitment {
+				return errAlreadyRevealed
+			}
+		}
+		for _, d := range ancestor.Dt {
+			committed = committed || d == commitment
+		}
+	}
+
+	isRevealed, err := vm.state.hasReveal(commitment)
+	if err != nil {
+		return errDatabaseGet
+	}
+	if isRevealed {
+		return errAlreadyRevealed
+	}
+	if !committed {
+		committed, err = vm.state.hasData(commitment)
+		if err != nil {
+			return errDatabaseGet
+		}
+	}
+	if !committed {
+		return errNoCommitment
+	}
+	return nil
+}
+
+// verifyReveals returns nil iff each of [b]'s reveals opens a different
+// commitment that can be revealed after [parent] is accepted
+func (b *Block) verifyReveals(parent *Block) error {
+	switch {
+	case len(b.Reveals) == 0:
+		return nil
+	case !b.vm.genesis.Params.Reveals:
+		return errRevealsDisabled
+	case len(b.Reveals) > maxBatchSize:
+		return errTooManyReveals
+	}
+	commitments := set.NewSet[[dataLen]byte](len(b.Reveals))
+	for i := range b.Reveals {
+		r := &b.Reveals[i]
+		if len(r.Data) > MaxRevealSize {
+			return errRevealTooLarge
+		}
+		commitment := r.Commitment()
+		if commitments.Contains(commitment) {
+			return errAlreadyRevealed
+		}
+		commitments.Add(commitment)
+		if err := b.vm.verifyReveal(parent, commitment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyReveals records the data that [b] reveals
+func (b *Block) applyReveals() error {
+	for i := range b.Reveals {
+		r := &b.Reveals[i]
+		if err := b.vm.state.putReveal(r.Commitment(), revealed{data: r.Data, height: b.Height()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingReveals holds reveals submitted over the API until they are
+// accepted
+type pendingReveals struct {
+	lock    sync.Mutex
+	reveals []Reveal
+}
+
+// add adds [r] to the pending reveals
+func (p *pendingReveals) add(r Reveal) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.reveals = append(p.reveals, r)
+}
+
+// next returns the pending reveals that can be accepted in a child of
+// [parent]. Reveals whose commitments aren't accepted yet stay pending.
+func (p *pendingReveals) next(vm *VM, parent *Block) []Reveal {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	commitments := set.NewSet[[dataLen]byte](len(p.reveals))
+	var next []Reveal
+	for _, r := range p.reveals {
+		commitment := r.Commitment()
+		if commitments.Contains(commitment) || vm.verifyReveal(parent, commitment) != nil {
+			continue
+		}
+		commitments.Add(commitment)
+		next = append(next, r)
+		if len(next) == maxBatchSize {
+			break
+		}
+	}
+	return next
+}
+
+// prune drops the pending reveals of commitments that are revealed
+func (p *pendingReveals) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.reveals, err = pruneOps(vm.opJournal, revealKind, p.reveals, func(r *Reveal) bool {
+		isRevealed, err := vm.state.hasReveal(r.Commitment())
+		return err != nil || !isRevealed
+	})
+	return err
+}
+
+// len returns the number of pending reveals
+func (p *pendingReveals) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.reveals)
+}
+
+// RevealArgs are the arguments to Reveal
+type RevealArgs struct {
+	// Base 58 repr. of the committed data
+	Data string `json:"data"`
+	// Base 58 repr. of the commitment's salt
+	Salt string `json:"salt"`
+
+	data []byte
+	salt []byte
+}
+
+func (a *RevealArgs) validate(v *argValidator) {
+	a.data = v.bytes("data", a.Data, 0, MaxRevealSize, errBadRevealData)
+	a.salt = v.bytes("salt", a.Salt, SaltLen, SaltLen, errBadSalt)
+}
+
+// RevealReply is the reply from Reveal
+type RevealReply struct {
+	// Base 58 repr. of the commitment that the reveal opens
+	Commitment string `json:"commitment"`
+}
+
+// Reveal is an API method to propose the reveal of a commitment, which is
+// the data of an earlier proposal. The reveal is included in a block built
+// by this node once the commitment is accepted.
+func (s *Service) Reveal(_ *http.Request, args *RevealArgs, reply *RevealReply) error {
+	if !s.backend.chainParams().Reveals {
+		return errRevealsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	r := Reveal{Data: args.data}
+	copy(r.Salt[:], args.salt)
+	commitment := r.Commitment()
+	reply.Commitment = encoding.EncodeCB58(commitment[:])
+	if err := s.backend.addReveal(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRevealArgs are the arguments to GetReveal
+type GetRevealArgs struct {
+	// Base 58 repr. of the commitment
+	Commitment string `json:"commitment"`
+
+	commitment [dataLen]byte
+}
+
+func (a *GetRevealArgs) validate(v *argValidator) {
+	a.commitment = v.data("commitment", a.Commitment)
+}
+
+// GetRevealReply is the reply from GetReveal
+type GetRevealReply struct {
+	// Base 58 repr. of the revealed data
+	Data string `json:"data"`
+	// Height of the accepted block that revealed the data
+	Height json.Uint64 `json:"height"`
+}
+
+// GetReveal returns the data that an accepted block revealed for
+// [args.Commitment]
+func (s *Service) GetReveal(_ *http.Request, args *GetRevealArgs, reply *GetRevealReply) error {
+	if !s.backend.chainParams().Reveals {
+		return errRevealsDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	r, err := s.backend.reveal(args.commitment)
+	if err == database.ErrNotFound {
+		return errNoSuchReveal
+	}
+	if err != nil {
+		return err
+	}
+	reply.Data = encoding.EncodeCB58(r.data)
+	reply.Height = json.Uint64(r.height)
+	return nil
+}
@@ -0,0 +1,492 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ava-labs/avalanchego/database"
+)
+
+const (
+	// tsaEndpoint is the path extension of the chain's RFC 3161 time-stamp
+	// authority
+	tsaEndpoint = "/tsa"
+
+	timeStampQueryContentType = "application/timestamp-query"
+	timeStampReplyContentType = "application/timestamp-reply"
+
+	maxTimeStampReqSize = 4 * 1024
+
+	pkiStatusGranted   = 0
+	pkiStatusRejection = 2
+
+	// Bits of a PKIFailureInfo
+	failBadAlg           = 0
+	failBadDataFormat    = 5
+	failUnacceptedPolicy = 15
+	failSystemFailure    = 25
+)
+
+var (
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidSHA256               = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA256WithRSA        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	// Serial numbers of time-stamp tokens are random numbers below this
+	maxTSTSerialNumber = new(big.Int).Lsh(big.NewInt(1), 128)
+
+	errNoTSACert         = errors.New("time-stamp authority needs a certificate file")
+	errNoTSAKey          = errors.New("time-stamp authority needs a key file")
+	errBadTSAPolicy      = errors.New("time-stamp authority policy must be a dotted object identifier")
+	errNoPEMBlock        = errors.New("file has no PEM block")
+	errBadTSACert        = errors.New("time-stamp authority certificate must allow time stamping")
+	errUnsupportedTSAKey = errors.New("time-stamp authority key must be an RSA or ECDSA key")
+	errTSAKeyMismatch    = errors.New("time-stamp authority key doesn't match its certificate")
+)
+
+// TSAConfig configures the chain's RFC 3161 time-stamp authority
+type TSAConfig struct {
+	// PEM file whose first certificate is the operator certificate that
+	// signs time-stamp tokens. It must allow time stamping as its extended
+	// key usage.
+	CertFile string `json:"certFile"`
+	// PEM file of the certificate's RSA or ECDSA private key
+	KeyFile string `json:"keyFile"`
+	// Dotted object identifier of the policy that tokens are issued under
+	Policy string `json:"policy"`
+}
+
+// Verify returns nil iff [c] is a valid time-stamp authority config
+func (c *TSAConfig) Verify() error {
+	switch {
+	case c.CertFile == "":
+		return errNoTSACert
+	case c.KeyFile == "":
+		return errNoTSAKey
+	}
+	_, err := parseOID(c.Policy)
+	return err
+}
+
+// parseOID parses the dotted object identifier [s], such as "1.2.3"
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errBadTSAPolicy
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errBadTSAPolicy
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// timeStampAuthority answers RFC 3161 time-stamp requests for data in
+// accepted blocks.
+// A request's message imprint must be the SHA-256 hash that was proposed as
+// data. The token's time is the timestamp of the block that accepted it.
+type timeStampAuthority struct {
+	backend backend
+	cert    *x509.Certificate
+	key     crypto.Signer
+	policy  asn1.ObjectIdentifier
+}
+
+// newTimeStampAuthority returns the time-stamp authority configured by
+// [config] for the data accepted by [b]
+func newTimeStampAuthority(config TSAConfig, b backend) (*timeStampAuthority, error) {
+	policy, err := parseOID(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, err := readPEM(config.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageTimeStamping) {
+		return nil, errBadTSACert
+	}
+	keyBlock, err := readPEM(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyBlock)
+	if err != nil {
+		return nil, err
+	}
+	if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.PublicKey) {
+		return nil, errTSAKeyMismatch
+	}
+	return &timeStampAuthority{
+		backend: b,
+		cert:    cert,
+		key:     key,
+		policy:  policy,
+	}, nil
+}
+
+// readPEM returns the first PEM block of the file at [path]
+func readPEM(path string) (*pem.Block, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%w: %s", errNoPEMBlock, path)
+	}
+	return block, nil
+}
+
+// parsePrivateKey parses the PKCS #8, SEC 1 or PKCS #1 private key in [block]
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var (
+		key any
+		err error
+	)
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case *rsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, errUnsupportedTSAKey
+	}
+}
+
+func (a *timeStampAuthority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "time-stamp requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != timeStampQueryContentType {
+		http.Error(w, "content type must be "+timeStampQueryContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	req, err := io.ReadAll(io.LimitReader(r.Body, maxTimeStampReqSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := a.respond(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", timeStampReplyContentType)
+	_, _ = w.Write(resp)
+}
+
+// respond returns the DER encoded TimeStampResp to the DER encoded
+// TimeStampReq [req]. Requests that can't be granted get a rejection.
+func (a *timeStampAuthority) respond(ctx context.Context, req []byte) ([]byte, error) {
+	var tsReq timeStampReq
+	if rest, err := asn1.Unmarshal(req, &tsReq); err != nil || len(rest) != 0 || tsReq.Version != 1 {
+		return rejection(failBadDataFormat, "request isn't a version 1 TimeStampReq")
+	}
+	imprint := tsReq.MessageImprint
+	if !imprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || len(imprint.HashedMessage) != dataLen {
+		return rejection(failBadAlg, "message imprint must be a SHA-256 hash")
+	}
+	if len(tsReq.ReqPolicy) != 0 && !tsReq.ReqPolicy.Equal(a.policy) {
+		return rejection(failUnacceptedPolicy, "requested policy isn't this authority's policy")
+	}
+
+	var data [dataLen]byte
+	copy(data[:], imprint.HashedMessage)
+	blkID, err := a.backend.dataBlock(ctx, data)
+	if err == database.ErrNotFound {
+		return rejection(-1, errDataNotAccepted.Error())
+	}
+	if err != nil {
+		return rejection(failSystemFailure, err.Error())
+	}
+	blk, err := a.backend.lookupBlock(ctx, blkID)
+	if err != nil {
+		return rejection(failSystemFailure, ErrBlockNotFound.Error())
+	}
+	token, err := a.token(&tsReq, blk.Timestamp())
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(timeStampResp{
+		Status:         pkiStatusInfo{Status: pkiStatusGranted},
+		TimeStampToken: token,
+	})
+}
+
+// rejection returns a TimeStampResp that rejects a request because of
+// [failure], which is a bit of a PKIFailureInfo or -1 if none applies
+func rejection(failure int, reason string) ([]byte, error) {
+	status := pkiStatusInfo{
+		Status: pkiStatusRejection,
+		StatusString: []asn1.RawValue{{
+			Tag:   asn1.TagUTF8String,
+			Bytes: []byte(reason),
+		}},
+	}
+	if failure >= 0 {
+		status.FailInfo = asn1.BitString{
+			Bytes:     make([]byte, failure/8+1),
+			BitLength: failure + 1,
+		}
+		status.FailInfo.Bytes[failure/8] = 0x80 >> (failure % 8)
+	}
+	return asn1.Marshal(timeStampResp{Status: status})
+}
+
+// token returns the ContentInfo of a time-stamp token that [tsReq]'s
+// message imprint existed at [genTime]
+func (a *timeStampAuthority) token(tsReq *timeStampReq, genTime time.Time) (asn1.RawValue, error) {
+	serialNumber, err := rand.Int(rand.Reader, maxTSTSerialNumber)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	info, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         a.policy,
+		MessageImprint: tsReq.MessageImprint,
+		SerialNumber:   serialNumber,
+		GenTime:        genTime.UTC(),
+		Nonce:          tsReq.Nonce,
+	})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	eContent, err := asn1.Marshal(info)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	infoDigest := sha256.Sum256(info)
+	certHash := sha256.Sum256(a.cert.Raw)
+	attrs, err := signedAttributes(
+		signedAttribute{Type: oidContentType, Value: oidTSTInfo},
+		signedAttribute{Type: oidMessageDigest, Value: infoDigest[:]},
+		signedAttribute{Type: oidSigningCertificateV2, Value: signingCertificateV2{
+			Certs: []essCertIDv2{{CertHash: certHash[:]}},
+		}},
+	)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	digest := sha256.Sum256(signed)
+	sig, err := a.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+
+	signatureAlgorithm := algorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	if _, ok := a.key.(*rsa.PrivateKey); ok {
+		signatureAlgorithm = algorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+	}
+	sha256Algorithm := algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd := signedData{
+		Version:          3,
+		DigestAlgorithms: []algorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: encapsulatedContentInfo{
+			EContentType: oidTSTInfo,
+			EContent:     contextSpecific(0, eContent),
+		},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			SID: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: a.cert.RawIssuer},
+				SerialNumber: a.cert.SerialNumber,
+			},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        contextSpecific(0, attrs),
+			SignatureAlgorithm: signatureAlgorithm,
+			Signature:          sig,
+		}},
+	}
+	if tsReq.CertReq {
+		sd.Certificates = contextSpecific(0, a.cert.Raw)
+	}
+	content, err := asn1.Marshal(sd)
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	ci, err := asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     contextSpecific(0, content),
+	})
+	if err != nil {
+		return asn1.RawValue{}, err
+	}
+	return asn1.RawValue{FullBytes: ci}, nil
+}
+
+// signedAttributes returns the DER encodings of [attrs], sorted as the
+// members of a SET OF must be
+func signedAttributes(attrs ...signedAttribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		value, err := asn1.Marshal(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i], err = asn1.Marshal(rawAttribute{
+			Type:   attr.Type,
+			Values: []asn1.RawValue{{FullBytes: value}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(encoded, bytes.Compare)
+	return bytes.Join(encoded, nil), nil
+}
+
+// contextSpecific returns the constructed value [b] with the context
+// specific [tag]
+func contextSpecific(tag int, b []byte) asn1.RawValue {
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      b,
+	}
+}
+
+// ASN.1 structures of RFC 3161 and of the Cryptographic Message Syntax
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type messageImprint struct {
+	HashAlgorithm algorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     asn1.RawValue         `asn1:"optional,tag:0"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+	FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Ordering       bool      `asn1:"optional"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []algorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    algorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm algorithmIdentifier
+	Signature          []byte
+}
+
+// signedAttribute is a signed attribute with a single value
+type signedAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value any
+}
+
+type rawAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type essCertIDv2 struct {
+	CertHash []byte
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
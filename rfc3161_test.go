@@ -0,0 +1,176 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTSACert writes a self-signed time stamping certificate and its key to
+// [dir] and returns the certificate and the paths of both files
+func writeTSACert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "timestampvm tsa"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tsa.crt")
+	keyFile := filepath.Join(dir, "tsa.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+// postTimeStampReq POSTs a request for a token of [hash] with [nonce] to
+// [handler] and returns the parsed response
+func postTimeStampReq(t *testing.T, handler http.Handler, hash []byte, nonce int64) timeStampResp {
+	reqBytes, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: algorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: hash,
+		},
+		Nonce:   big.NewInt(nonce),
+		CertReq: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, tsaEndpoint, bytes.NewReader(reqBytes))
+	req.Header.Set("Content-Type", timeStampQueryContentType)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != timeStampReplyContentType {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body)
+	}
+	var resp timeStampResp
+	if rest, err := asn1.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(rest) != 0 {
+		t.Fatalf("couldn't parse response: %v", err)
+	}
+	return resp
+}
+
+// Assert that the time-stamp authority signs tokens of accepted data, with
+// the time of the block that accepted it, and rejects other data
+func TestTimeStampAuthority(t *testing.T) {
+	cert, certFile, keyFile := writeTSACert(t, t.TempDir())
+	config := fmt.Sprintf(`{"buildBatchWindow": "0s", "tsa": {"certFile": %q, "keyFile": %q, "policy": "1.2.3.4"}}`, certFile, keyFile)
+	vm := newTestVMWithGenesis(t, &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}, []byte(config))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, ok := handlers[tsaEndpoint]
+	if !ok {
+		t.Fatal("expected a time-stamp authority")
+	}
+
+	hash := sha256.Sum256([]byte("document"))
+	resp := postTimeStampReq(t, handler, hash[:], 42)
+	if resp.Status.Status != pkiStatusRejection || len(resp.TimeStampToken.FullBytes) != 0 {
+		t.Fatalf("expected a rejection of data that isn't accepted but got %+v", resp.Status)
+	}
+
+	if err := vm.proposeBlock(hash); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = postTimeStampReq(t, handler, hash[:], 42)
+	if resp.Status.Status != pkiStatusGranted {
+		t.Fatalf("expected the request to be granted but got %+v", resp.Status)
+	}
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(resp.TimeStampToken.FullBytes, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("token isn't signed data: %v", err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sd.Certificates.Bytes, cert.Raw) {
+		t.Fatal("expected the token to have the operator certificate")
+	}
+	var info []byte
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &info); err != nil {
+		t.Fatal(err)
+	}
+	var tst tstInfo
+	if _, err := asn1.Unmarshal(info, &tst); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tst.MessageImprint.HashedMessage, hash[:]) || tst.Nonce.Int64() != 42 || !tst.GenTime.Equal(blk.Timestamp()) {
+		t.Fatalf("unexpected TSTInfo %+v", tst)
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		t.Fatalf("expected 1 signer but got %d", len(sd.SignerInfos))
+	}
+	signer := sd.SignerInfos[0]
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signer.SignedAttrs.Bytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, signed, signer.Signature); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(info)
+	digestAttr, err := asn1.Marshal(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signer.SignedAttrs.Bytes, digestAttr) {
+		t.Fatal("expected the signed attributes to have the TSTInfo's digest")
+	}
+}
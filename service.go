@@ -4,51 +4,207 @@
 package timestampvm
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
 
+	"github.com/ava-labs/avalanchego/database"
 	"github.com/ava-labs/avalanchego/ids"
-	"github.com/ava-labs/avalanchego/utils/formatting"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
 	"github.com/ava-labs/avalanchego/utils/json"
+
+	"github.com/hitrich/AVM-TEST/encoding"
 )
 
 var (
-	errBadData     = errors.New("data must be base 58 repr. of 32 bytes")
-	errNoSuchBlock = errors.New("couldn't get block from database. Does it exist?")
+	// ErrBadData is returned for proposed data that isn't the base 58 repr.
+	// of at most the max payload size
+	ErrBadData = errors.New("data must be base 58 repr. of at most 32 bytes")
+	// ErrBlockNotFound is returned for a block this node doesn't have
+	ErrBlockNotFound = errors.New("couldn't get block from database. Does it exist?")
+
+	errBadSig       = fmt.Errorf("signature must be base 58 repr. of %d bytes", secp256k1.SignatureLen)
+	errNoSignerSet  = errors.New("chain has no allowed signer set")
+	errBadNotBefore = errors.New("earliest inclusion time is out of range")
 )
 
 // Service is the API service for this VM
-type Service struct{ vm *VM }
+type Service struct{ backend backend }
+
+// requestContext returns the context of [r], which is cancelled when the
+// client disconnects, so that long queries stop early. Calls made without a
+// request, such as in tests, are never cancelled.
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
 
 // ProposeBlockArgs are the arguments to function ProposeValue
 type ProposeBlockArgs struct {
-	// Data in the block. Must be base 58 encoding of 32 bytes.
+	// Data in the block. Must be base 58 encoding of at most the chain's and
+	// this node's max payload size (32 bytes by default). Shorter data is
+	// zero-padded.
 	Data string `json:"data"`
+	// Namespace of the data. Required on chains with namespaces, and may be
+	// set on chains with namespace ACLs.
+	Namespace string `json:"namespace"`
+	// Unix time, in seconds, before which the data isn't put into a block.
+	// Zero means the data may be put into a block right away.
+	NotBefore json.Uint64 `json:"notBefore"`
+
+	data      []byte
+	namespace [NamespaceLen]byte
+}
+
+func (a *ProposeBlockArgs) validate(v *argValidator) {
+	v.check("notBefore", a.NotBefore <= math.MaxInt64, errBadNotBefore)
+	a.data = v.payload("data", a.Data)
+	a.namespace = v.namespace("namespace", a.Namespace)
 }
 
 // ProposeBlockReply is the reply from function ProposeBlock
-type ProposeBlockReply struct{ Success bool }
+type ProposeBlockReply struct {
+	Success bool
+	// ID of the proposal, which CancelProposal takes while it's pending
+	ID json.Uint64 `json:"id"`
+	// Base 58 repr. of the random secret that CancelProposal takes to
+	// cancel the proposal. Only the proposer gets it.
+	CancelToken string `json:"cancelToken"`
+}
 
 // ProposeBlock is an API method to propose a new block whose data is [args].Data.
-// [args].Data must be a string repr. of a 32 byte array
+// [args].Data must be a string repr. of at most the chain's and this node's
+// max payload size. The data is put into a block in [args].Namespace. If
+// [args].NotBefore is set, this node holds the data until then before
+// putting it into a block.
 func (s *Service) ProposeBlock(_ *http.Request, args *ProposeBlockArgs, reply *ProposeBlockReply) error {
-	bytes, err := formatting.Decode(formatting.CB58, args.Data)
-	if err != nil || len(bytes) != dataLen {
-		return errBadData
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	if err := s.backend.verifyProposal(args.data, args.namespace); err != nil {
+		return err
+	}
+	var data [dataLen]byte   // The data as an array of bytes
+	copy(data[:], args.data) // Copy the bytes in dataSlice to data
+	id, cancelToken, err := s.backend.submitProposal(data, args.namespace, int64(args.NotBefore))
+	if err != nil {
+		return err
 	}
-	var data [dataLen]byte         // The data as an array of bytes
-	copy(data[:], bytes[:dataLen]) // Copy the bytes in dataSlice to data
-	s.vm.proposeBlock(data)
 	reply.Success = true
+	reply.ID = json.Uint64(id)
+	reply.CancelToken = encoding.EncodeCB58(cancelToken[:])
+	return nil
+}
+
+// CancelProposalArgs are the arguments to CancelProposal
+type CancelProposalArgs struct {
+	// ID returned by ProposeBlock
+	ID json.Uint64 `json:"id"`
+	// Cancel token returned by ProposeBlock. May be empty if the request
+	// carries the admin token.
+	CancelToken string `json:"cancelToken"`
+
+	cancelToken [cancelTokenLen]byte
+}
+
+func (a *CancelProposalArgs) validate(v *argValidator) {
+	if a.CancelToken != "" {
+		copy(a.cancelToken[:], v.bytes("cancelToken", a.CancelToken, cancelTokenLen, cancelTokenLen, errBadCancelToken))
+	}
+}
+
+// CancelProposal removes the proposal [args.ID] from this node's mempool, or
+// its schedule, before it's put into a block. The request must carry the
+// proposal's cancel token, or the header "Authorization: Bearer <adminToken>".
+// Proposals restored from the journal on restart can only be cancelled with
+// the admin token.
+func (s *Service) CancelProposal(r *http.Request, args *CancelProposalArgs, _ *struct{}) error {
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	config := s.backend.nodeConfig()
+	admin := r != nil && config.AdminToken != "" && authorized(r, config.AdminToken)
+	return s.backend.cancelProposal(uint64(args.ID), args.cancelToken, admin)
+}
+
+// parseData returns the zero-padded data whose base 58 repr. is [s]
+func parseData(s string) ([dataLen]byte, error) {
+	var data [dataLen]byte
+	decoded, err := encoding.DecodeCB58(s)
+	if err != nil || len(decoded) == 0 || len(decoded) > dataLen {
+		return data, ErrBadData
+	}
+	copy(data[:], decoded)
+	return data, nil
+}
+
+// GetMempoolSizeReply is the reply from GetMempoolSize
+type GetMempoolSizeReply struct {
+	// Number of pieces of data waiting to be put into a block
+	Size json.Uint64 `json:"size"`
+	// Number of pieces of data held until their earliest inclusion time
+	Scheduled json.Uint64 `json:"scheduled"`
+}
+
+// GetMempoolSize returns the number of pieces of data in this node's mempool
+// and how many more are scheduled
+func (s *Service) GetMempoolSize(_ *http.Request, _ *struct{}, reply *GetMempoolSizeReply) error {
+	reply.Size = json.Uint64(s.backend.mempoolLen())
+	reply.Scheduled = json.Uint64(s.backend.scheduledLen())
+	return nil
+}
+
+// GetGenesisReply is the reply from GetGenesis
+type GetGenesisReply struct {
+	Genesis *Genesis `json:"genesis"`
+	// Consensus rules added after genesis and when they activate
+	Upgrades UpgradeConfig `json:"upgrades"`
+	// Length of each piece of data, which shorter data is zero-padded to
+	DataLen json.Uint32 `json:"dataLen"`
+	// Encoding of data and of other bytes in the API
+	Encoding string `json:"encoding"`
+}
+
+// GetGenesis returns the chain's genesis, which fixes its consensus
+// parameters such as the max payload size and fees, and its upgrades
+func (s *Service) GetGenesis(_ *http.Request, _ *struct{}, reply *GetGenesisReply) error {
+	reply.Genesis = s.backend.chainGenesis()
+	reply.Upgrades = s.backend.upgradeConfig()
+	reply.DataLen = dataLen
+	reply.Encoding = "cb58"
+	return nil
+}
+
+// GetConfigReply is the reply from GetConfig
+type GetConfigReply struct {
+	// Keys, tokens and secrets are left empty
+	Config Config `json:"config"`
+}
+
+// GetConfig returns this node's current config of the chain, which may have
+// been reloaded since the chain started
+func (s *Service) GetConfig(_ *http.Request, _ *struct{}, reply *GetConfigReply) error {
+	reply.Config = s.backend.nodeConfig().withoutSecrets()
 	return nil
 }
 
 // APIBlock is the API representation of a block
 type APIBlock struct {
 	Timestamp json.Uint64 `json:"timestamp"` // Timestamp of most recent block
-	Data      string      `json:"data"`      // Data in the most recent block. Base 58 repr. of 5 bytes.
+	Data      []string    `json:"data"`      // Data in the most recent block. Base 58 repr. of each piece of data.
 	ID        string      `json:"id"`        // String repr. of ID of the most recent block
 	ParentID  string      `json:"parentID"`  // String repr. of ID of the most recent block's parent
+	Height    json.Uint64 `json:"height"`    // Height of the most recent block
+	// Namespace of each piece of data, in the same order, on chains whose
+	// data has namespaces. Empty if a piece of data has no namespace.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// One of "Processing", "Accepted" or "Rejected". Only the data of
+	// accepted blocks is final.
+	Status string `json:"status"`
 }
 
 // GetBlockArgs are the arguments to GetBlock
@@ -56,6 +212,14 @@ type GetBlockArgs struct {
 	// ID of the block we're getting.
 	// If left blank, gets the latest block
 	ID string
+
+	id ids.ID
+}
+
+func (a *GetBlockArgs) validate(v *argValidator) {
+	if a.ID != "" {
+		a.id = v.id("id", a.ID)
+	}
 }
 
 // GetBlockReply is the reply from GetBlock
@@ -65,32 +229,348 @@ type GetBlockReply struct {
 
 // GetBlock gets the block whose ID is [args.ID]
 // If [args.ID] is empty, get the latest block
-func (s *Service) GetBlock(_ *http.Request, args *GetBlockArgs, reply *GetBlockReply) error {
-	var ID ids.ID
-	var err error
+// The reply includes the block's consensus status. Rejected blocks are only
+// found if the VM doesn't prune rejected blocks.
+func (s *Service) GetBlock(r *http.Request, args *GetBlockArgs, reply *GetBlockReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	ID := args.id
 	if args.ID == "" {
-		ID = s.vm.LastAccepted()
-	} else {
-		ID, err = ids.FromString(args.ID)
+		var err error
+		ID, err = s.backend.lastAcceptedID(ctx)
 		if err != nil {
-			return errors.New("problem parsing ID")
+			return err
 		}
 	}
 
-	blockInterface, err := s.vm.GetBlock(ID)
+	block, err := s.backend.lookupBlock(ctx, ID)
 	if err != nil {
-		return errNoSuchBlock
+		return ErrBlockNotFound
+	}
+	reply.APIBlock = newAPIBlock(block)
+	return nil
+}
+
+// GetBlockByHeightArgs are the arguments to GetBlockByHeight
+type GetBlockByHeightArgs struct {
+	Height json.Uint64 `json:"height"`
+}
+
+// GetBlockByHeight gets the accepted block at [args.Height]
+func (s *Service) GetBlockByHeight(r *http.Request, args *GetBlockByHeightArgs, reply *GetBlockReply) error {
+	ctx := requestContext(r)
+	blkID, err := s.backend.acceptedAtHeight(ctx, uint64(args.Height))
+	if err != nil {
+		return ErrBlockNotFound
+	}
+	block, err := s.backend.lookupBlock(ctx, blkID)
+	if err != nil {
+		return ErrBlockNotFound
+	}
+	reply.APIBlock = newAPIBlock(block)
+	return nil
+}
+
+// newAPIBlock returns the API representation of [block]
+func newAPIBlock(block *Block) APIBlock {
+	blkID := block.ID()
+	parentID := block.Parent()
+	apiBlock := APIBlock{
+		Timestamp: json.Uint64(block.Tmstmp),
+		Data:      make([]string, len(block.Dt)),
+		ID:        encoding.EncodeCB58(blkID[:]),
+		ParentID:  encoding.EncodeCB58(parentID[:]),
+		Height:    json.Uint64(block.Height()),
+		Status:    block.Status().String(),
+	}
+	for i := range block.Dt {
+		apiBlock.Data[i] = encoding.EncodeCB58(block.Dt[i][:])
 	}
+	if len(block.Ns) > 0 {
+		apiBlock.Namespaces = make([]string, len(block.Ns))
+		for i, namespace := range block.Ns {
+			apiBlock.Namespaces[i] = namespaceString(namespace)
+		}
+	}
+	return apiBlock
+}
 
-	block, ok := blockInterface.(*Block)
-	if !ok {
-		return errBadData
+// GetBlockHeaderReply is the reply from GetBlockHeader
+type GetBlockHeaderReply struct {
+	ID        string      `json:"id"`
+	ParentID  string      `json:"parentID"`
+	Height    json.Uint64 `json:"height"`
+	Timestamp json.Uint64 `json:"timestamp"`
+}
+
+// GetBlockHeader gets the header of the block whose ID is [args.ID] without
+// decoding the block's data
+// If [args.ID] is empty, get the header of the latest block
+func (s *Service) GetBlockHeader(r *http.Request, args *GetBlockArgs, reply *GetBlockHeaderReply) error {
+	ctx := requestContext(r)
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	ID := args.id
+	if args.ID == "" {
+		var err error
+		ID, err = s.backend.lastAcceptedID(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
-	reply.APIBlock.ID = block.ID().String()
-	reply.APIBlock.Timestamp = json.Uint64(block.Timestamp)
-	reply.APIBlock.ParentID = block.ParentID().String()
-	reply.Data, err = formatting.Encode(formatting.CB58, block.Data[:])
+	header, err := s.backend.lookupHeader(ctx, ID)
+	if err != nil {
+		return ErrBlockNotFound
+	}
 
-	return err
+	reply.ID = header.ID.String()
+	reply.ParentID = header.ParentID.String()
+	reply.Height = json.Uint64(header.Height)
+	reply.Timestamp = json.Uint64(header.Timestamp)
+	return nil
+}
+
+// GetChainHeadReply is the reply from GetChainHead
+type GetChainHeadReply struct {
+	LastAcceptedID     ids.ID      `json:"lastAcceptedID"`
+	LastAcceptedHeight json.Uint64 `json:"lastAcceptedHeight"`
+	// The block this node builds on and votes for. It's the last accepted
+	// block or one of its processing descendants.
+	PreferredID     ids.ID      `json:"preferredID"`
+	PreferredHeight json.Uint64 `json:"preferredHeight"`
+}
+
+// GetChainHead returns this node's last accepted block and its preferred
+// block, read at the same moment. A preferred block that stays far above
+// the last accepted block means that blocks aren't being finalized.
+func (s *Service) GetChainHead(r *http.Request, _ *struct{}, reply *GetChainHeadReply) error {
+	lastAccepted, preferred, err := s.backend.chainHead(requestContext(r))
+	if err != nil {
+		return err
+	}
+	reply.LastAcceptedID = lastAccepted.ID
+	reply.LastAcceptedHeight = json.Uint64(lastAccepted.Height)
+	reply.PreferredID = preferred.ID
+	reply.PreferredHeight = json.Uint64(preferred.Height)
+	return nil
+}
+
+// ProposeSignerOpArgs are the arguments to ProposeSignerOp
+type ProposeSignerOpArgs struct {
+	// Position of the operation among the chain's signer operations
+	Nonce json.Uint64 `json:"nonce"`
+	// If true, [Signer] is added to the allowed signers. Otherwise it's removed.
+	Add bool `json:"add"`
+	// Address of the signer to add or remove
+	Signer ids.ShortID `json:"signer"`
+	// Base 58 repr. of an admin's signature of the operation
+	Signature string `json:"signature"`
+
+	sig [secp256k1.SignatureLen]byte
+}
+
+func (a *ProposeSignerOpArgs) validate(v *argValidator) {
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// ProposeSignerOpReply is the reply from ProposeSignerOp
+type ProposeSignerOpReply struct{ Success bool }
+
+// ProposeSignerOp is an API method to propose a change to the allowed
+// signers. The operation is included in a block built by this node once it
+// is the next operation and is valid.
+func (s *Service) ProposeSignerOp(_ *http.Request, args *ProposeSignerOpArgs, reply *ProposeSignerOpReply) error {
+	params := s.backend.chainParams()
+	if !params.isPermissioned() {
+		return errNoSignerSet
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	op := SignerOp{
+		Nonce:    uint64(args.Nonce),
+		Add:      args.Add,
+		Signer:   args.Signer,
+		AdminSig: args.sig,
+	}
+
+	admin, err := op.admin(s.backend.chainID())
+	if err != nil {
+		return err
+	}
+	if !params.isAdmin(admin) {
+		return errNotAdmin
+	}
+	if err := s.backend.addSignerOp(op); err != nil {
+		return err
+	}
+	reply.Success = true
+	return nil
+}
+
+// GetBalanceArgs are the arguments to GetBalance
+type GetBalanceArgs struct {
+	Address ids.ShortID `json:"address"`
+}
+
+// GetBalanceReply is the reply from GetBalance
+type GetBalanceReply struct {
+	Balance json.Uint64 `json:"balance"`
+}
+
+// GetBalance returns the balance of [args.Address] after the last accepted
+// block. The balance pays the fees of the blocks the address signs.
+func (s *Service) GetBalance(r *http.Request, args *GetBalanceArgs, reply *GetBalanceReply) error {
+	balance, err := s.backend.balance(requestContext(r), args.Address)
+	if err != nil {
+		return err
+	}
+	reply.Balance = json.Uint64(balance)
+	return nil
+}
+
+// GetBurnedFeesReply is the reply from GetBurnedFees
+type GetBurnedFeesReply struct {
+	// Total fees paid by accepted blocks
+	Burned json.Uint64 `json:"burned"`
+}
+
+// GetBurnedFees returns the total fees burned by accepted blocks
+func (s *Service) GetBurnedFees(r *http.Request, _ *struct{}, reply *GetBurnedFeesReply) error {
+	burned, err := s.backend.burned(requestContext(r))
+	if err != nil {
+		return err
+	}
+	reply.Burned = json.Uint64(burned)
+	return nil
+}
+
+// AnchorCIDArgs are the arguments to AnchorCID
+type AnchorCIDArgs struct {
+	// CID of IPFS content hashed with sha2-256
+	CID string `json:"cid"`
+	// Optional MIME type of the content
+	ContentType string `json:"contentType"`
+
+	anchor anchor
+}
+
+func (a *AnchorCIDArgs) validate(v *argValidator) {
+	var err error
+	a.anchor, err = parseAnchor(a.CID, a.ContentType)
+	if err == errBadContentType {
+		v.add("contentType", err)
+	} else {
+		v.add("cid", err)
+	}
+}
+
+// AnchorCIDReply is the reply from AnchorCID
+type AnchorCIDReply struct {
+	// Base 58 repr. of the data that was proposed, which is the digest of the
+	// content
+	Data string `json:"data"`
+}
+
+// AnchorCID proposes the digest of the IPFS content with CID [args.CID] and
+// records the CID and content type in this node's anchor index. Only the
+// digest is put on the chain.
+func (s *Service) AnchorCID(_ *http.Request, args *AnchorCIDArgs, reply *AnchorCIDReply) error {
+	if !s.backend.anchoringEnabled() {
+		return errAnchoringDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	a := args.anchor
+	data := a.data()
+	if err := s.backend.verifyProposal(data[:], [NamespaceLen]byte{}); err != nil {
+		return err
+	}
+	if err := s.backend.proposeBlock(data); err != nil {
+		return err
+	}
+	if err := s.backend.putAnchor(a); err != nil {
+		return err
+	}
+	reply.Data = encoding.EncodeCB58(data[:])
+	return nil
+}
+
+// APIAnchor is the API representation of anchored IPFS content
+type APIAnchor struct {
+	CID         string `json:"cid"`
+	ContentType string `json:"contentType"`
+	// Base 58 repr. of the content's digest, which is the data on the chain
+	Data string `json:"data"`
+	// ID of the accepted block that contains [Data]. Empty if the data isn't
+	// accepted yet.
+	BlockID string `json:"blockID"`
+}
+
+// ListAnchoredCIDsArgs are the arguments to ListAnchoredCIDs
+type ListAnchoredCIDsArgs struct {
+	// Max number of anchors to return. Zero means 25. At most 100.
+	Limit json.Uint32 `json:"limit"`
+	// If set, the anchors start where the previous page's nextCursor says,
+	// instead of at the first one. Content anchored after the previous page
+	// may move an anchor onto the next page too.
+	Cursor string `json:"cursor"`
+
+	limit int
+	start pageCursor
+}
+
+func (a *ListAnchoredCIDsArgs) validate(v *argValidator) {
+	a.limit = v.limit("limit", uint64(a.Limit), defaultAnchorPageSize, maxAnchorPageSize)
+	a.start = v.cursor("cursor", a.Cursor, pageCursor{list: anchorsCursor, direction: forward})
+}
+
+// ListAnchoredCIDsReply is the reply from ListAnchoredCIDs
+type ListAnchoredCIDsReply struct {
+	Anchors []APIAnchor `json:"anchors"`
+	// Cursor of the next page. Empty if this page is the last.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ListAnchoredCIDs returns the IPFS content anchored through this node's API,
+// in the order of the CIDs' bytes, and the accepted blocks that anchor it
+func (s *Service) ListAnchoredCIDs(r *http.Request, args *ListAnchoredCIDsArgs, reply *ListAnchoredCIDsReply) error {
+	ctx := requestContext(r)
+	if !s.backend.anchoringEnabled() {
+		return errAnchoringDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	anchors, err := s.backend.anchors(ctx, args.start.position, args.limit+1)
+	if err != nil {
+		return err
+	}
+	if len(anchors) > args.limit {
+		reply.NextCursor = args.start.at(args.start.position + uint64(args.limit)).String()
+		anchors = anchors[:args.limit]
+	}
+	reply.Anchors = make([]APIAnchor, len(anchors))
+	for i, a := range anchors {
+		data := a.data()
+		reply.Anchors[i] = APIAnchor{
+			CID:         a.cid.String(),
+			ContentType: a.contentType,
+			Data:        encoding.EncodeCB58(data[:]),
+		}
+		blkID, err := s.backend.dataBlock(ctx, data)
+		switch err {
+		case nil:
+			reply.Anchors[i].BlockID = blkID.String()
+		case database.ErrNotFound:
+		default:
+			return err
+		}
+	}
+	return nil
 }
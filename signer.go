@@ -0,0 +1,182 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+)
+
+const defaultRemoteSignerTimeout = 5 * time.Second
+
+var (
+	errMultipleSigners     = errors.New("only one of a signing key, a remote signer or an fx's signer may be used")
+	errBadRemoteSigner     = errors.New("remote signer needs an http or https URL and an address")
+	errRemoteSignerStatus  = errors.New("remote signer responded with a non-2xx status")
+	errRemoteSignerAddress = errors.New("remote signer's signature isn't from the configured address")
+
+	_ Signer = (*keySigner)(nil)
+	_ Signer = (*remoteSigner)(nil)
+)
+
+// Signer signs the blocks this node builds. The key may be held outside the
+// node, such as in a KMS or HSM.
+type Signer interface {
+	// Address returns the address of the signing key
+	Address() ids.ShortID
+	// SignHash returns the 65 byte recoverable secp256k1 signature of [hash]
+	SignHash(ctx context.Context, hash []byte) ([]byte, error)
+}
+
+// keySigner signs with a key in the node's config
+type keySigner struct {
+	key *secp256k1.PrivateKey
+}
+
+func (k *keySigner) Address() ids.ShortID {
+	return k.key.Address()
+}
+
+func (k *keySigner) SignHash(_ context.Context, hash []byte) ([]byte, error) {
+	return k.key.SignHash(hash)
+}
+
+// RemoteSignerConfig configures a signer that holds its key outside the
+// node. The signer is sent
+//
+//	{"hash": "<hex>"}
+//
+// and must respond with
+//
+//	{"signature": "<hex of the 65 byte recoverable signature>"}
+type RemoteSignerConfig struct {
+	URL string `json:"url"`
+	// Address of the signer's key. Signatures from any other key are refused.
+	Address ids.ShortID `json:"address"`
+	// If set, it's sent in the header "Authorization: Bearer <token>"
+	Token string `json:"token"`
+	// How long to wait for a signature. Zero means 5s.
+	Timeout Duration `json:"timeout"`
+}
+
+// Verify returns nil iff [c] is a valid remote signer config
+func (c *RemoteSignerConfig) Verify() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || c.Address == ids.ShortEmpty || c.Timeout.Duration < 0 {
+		return errBadRemoteSigner
+	}
+	return nil
+}
+
+// remoteSigner signs by calling the signer in its config
+type remoteSigner struct {
+	config RemoteSignerConfig
+	client *http.Client
+}
+
+func newRemoteSigner(config RemoteSignerConfig) *remoteSigner {
+	if config.Timeout.Duration == 0 {
+		config.Timeout.Duration = defaultRemoteSignerTimeout
+	}
+	return &remoteSigner{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout.Duration},
+	}
+}
+
+func (r *remoteSigner) Address() ids.ShortID {
+	return r.config.Address
+}
+
+type remoteSignRequest struct {
+	Hash string `json:"hash"`
+}
+
+type remoteSignResponse struct {
+	Signature string `json:"signature"`
+}
+
+func (r *remoteSigner) SignHash(ctx context.Context, hash []byte) ([]byte, error) {
+	body, err := json.Marshal(remoteSignRequest{Hash: hex.EncodeToString(hash)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.config.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%w: %d", errRemoteSignerStatus, resp.StatusCode)
+	}
+
+	var reply remoteSignResponse
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	sig, err := hex.DecodeString(reply.Signature)
+	if err != nil {
+		return nil, err
+	}
+	// A misconfigured signer would otherwise make this node build blocks
+	// that every validator rejects
+	key, err := secp256k1.RecoverPublicKeyFromHash(hash, sig)
+	if err != nil {
+		return nil, err
+	}
+	if key.Address() != r.config.Address {
+		return nil, errRemoteSignerAddress
+	}
+	return sig, nil
+}
+
+// SignerProvider is implemented by fxs that sign this node's blocks
+type SignerProvider interface {
+	// Signer returns the signer of this node's blocks
+	Signer() Signer
+}
+
+// initializeSigner sets the signer of this node's blocks from the config or
+// from an fx. Must be called after the fxs are initialized.
+func (vm *VM) initializeSigner() error {
+	var signers []Signer
+	if vm.config.Load().SigningKey != nil {
+		signers = append(signers, &keySigner{key: vm.config.Load().SigningKey})
+	}
+	if vm.config.Load().RemoteSigner != nil {
+		signers = append(signers, newRemoteSigner(*vm.config.Load().RemoteSigner))
+	}
+	for _, fx := range vm.fxs {
+		if provider, ok := fx.(SignerProvider); ok {
+			signers = append(signers, provider.Signer())
+		}
+	}
+	switch len(signers) {
+	case 0:
+		return nil
+	case 1:
+		vm.signer = signers[0]
+		return nil
+	default:
+		return errMultipleSigners
+	}
+}
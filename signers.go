@@ -0,0 +1,363 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// signedCodecVersion is the codec version of blocks on chains whose
+	// blocks are signed, which are chains with a permissioned signer set or
+	// fees. It also serializes the fields tagged with [signedTagName].
+	signedCodecVersion = 1
+	signedTagName      = "signed"
+)
+
+// The message of each kind of signed operation has its own tag after the
+// chain ID, so that no signature can be replayed as another kind of
+// operation's. Block signatures cover the block's bytes, which start with
+// the codec version's zero high byte, so they don't collide with these.
+const (
+	signerOpTag        = 'o'
+	transferTag        = 't'
+	aclOpTag           = 'a'
+	claimTransferTag   = 'c'
+	keyRegistrationTag = 'k'
+	feedUpdateTag      = 'f'
+	governanceVoteTag  = 'g'
+	multisigTag        = 'm'
+	submissionTag      = 's'
+)
+
+var (
+	errUnsignedBlock       = errors.New("block must be signed")
+	errUnexpectedSignature = errors.New("block is signed but the chain doesn't sign blocks")
+	errUnexpectedOps       = errors.New("block has signer operations but the chain has no signer set")
+	errNotSigner           = errors.New("block's signer isn't an allowed signer")
+	errNoSigningKey        = errors.New("no signing key or signer is configured")
+	errTooManyOps          = errors.New("block has too many signer operations")
+	errBadOpNonce          = errors.New("signer operation has the wrong nonce")
+	errNotAdmin            = errors.New("signer operation isn't signed by an admin")
+	errAlreadySigner       = errors.New("address is already an allowed signer")
+	errUnknownSigner       = errors.New("address isn't an allowed signer")
+	errLastSigner          = errors.New("the last allowed signer can't be removed")
+	errDuplicateAddress    = errors.New("duplicate address")
+	errAdminsWithoutSigner = errors.New("admins require a signer set")
+)
+
+// SignerOp adds an address to, or removes an address from, the set of
+// allowed block signers. It must be signed by one of the chain's admins.
+// Operations are applied in the order of their nonces, starting at 0, so an
+// operation can't be replayed.
+type SignerOp struct {
+	Nonce  uint64      `serialize:"true"`
+	Add    bool        `serialize:"true"` // If false, [Signer] is removed
+	Signer ids.ShortID `serialize:"true"`
+	// Admin's signature of the operation's hash on this chain
+	AdminSig [secp256k1.SignatureLen]byte `serialize:"true"`
+}
+
+// Hash returns the hash of [op] on the chain [chainID], which is what an
+// admin signs.
+func (op *SignerOp) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+8+1+ids.ShortIDLen)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, signerOpTag)
+	msg = binary.BigEndian.AppendUint64(msg, op.Nonce)
+	if op.Add {
+		msg = append(msg, 1)
+	} else {
+		msg = append(msg, 0)
+	}
+	msg = append(msg, op.Signer[:]...)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [op]'s admin signature to [key]'s signature of [op] on the chain
+// [chainID]
+func (op *SignerOp) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(op.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(op.AdminSig[:], sig)
+	return nil
+}
+
+// admin returns the address that signed [op] on the chain [chainID]
+func (op *SignerOp) admin(chainID ids.ID) (ids.ShortID, error) {
+	key, err := secp256k1.RecoverPublicKeyFromHash(op.Hash(chainID), op.AdminSig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	return key.Address(), nil
+}
+
+// signerSet is the set of allowed block signers after some number of signer
+// operations
+type signerSet struct {
+	signers set.Set[ids.ShortID]
+	// Nonce of the next signer operation
+	nonce uint64
+}
+
+// apply applies [op] to [s] without checking it
+func (s *signerSet) apply(op SignerOp) {
+	if op.Add {
+		s.signers.Add(op.Signer)
+	} else {
+		s.signers.Remove(op.Signer)
+	}
+	s.nonce++
+}
+
+// verify returns nil iff [op] can be applied to [s] on the chain [vm] runs
+func (s *signerSet) verify(vm *VM, op SignerOp) error {
+	if op.Nonce != s.nonce {
+		return errBadOpNonce
+	}
+	admin, err := op.admin(vm.ctx.ChainID)
+	if err != nil {
+		return err
+	}
+	if !vm.genesis.Params.isAdmin(admin) {
+		return errNotAdmin
+	}
+	switch {
+	case op.Add && s.signers.Contains(op.Signer):
+		return errAlreadySigner
+	case !op.Add && !s.signers.Contains(op.Signer):
+		return errUnknownSigner
+	case !op.Add && s.signers.Len() == 1:
+		return errLastSigner
+	default:
+		return nil
+	}
+}
+
+// signersAfter returns the signer set after [blk] is accepted
+func (vm *VM) signersAfter(blk *Block) (*signerSet, error) {
+	// Processing ancestors' operations aren't persisted yet
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := vm.state.getSigners()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(processing) - 1; i >= 0; i-- {
+		for _, op := range processing[i].Ops {
+			s.apply(op)
+		}
+	}
+	return s, nil
+}
+
+// verifySignature returns nil iff [b] is signed if the chain signs blocks,
+// and, on chains with an allowed signer set, [b]'s signer is an allowed
+// signer and its signer operations are valid. [parent] is [b]'s parent.
+func (b *Block) verifySignature(parent *Block) error {
+	params := &b.vm.genesis.Params
+	if !params.signsBlocks() {
+		if b.version != params.unsignedCodecVersion() {
+			return errUnexpectedSignature
+		}
+		return nil
+	}
+	if b.version != params.blockCodecVersion() {
+		return errUnsignedBlock
+	}
+	signer, err := b.signer()
+	if err != nil {
+		return err
+	}
+	if !params.isPermissioned() {
+		if len(b.Ops) > 0 {
+			return errUnexpectedOps
+		}
+		return nil
+	}
+	if len(b.Ops) > maxBatchSize {
+		return errTooManyOps
+	}
+
+	signers, err := b.vm.signersAfter(parent)
+	if err != nil {
+		return err
+	}
+	if !signers.signers.Contains(signer) {
+		return errNotSigner
+	}
+	for _, op := range b.Ops {
+		if err := signers.verify(b.vm, op); err != nil {
+			return err
+		}
+		signers.apply(op)
+	}
+	return nil
+}
+
+// signer returns the address that signed [b]
+func (b *Block) signer() (ids.ShortID, error) {
+	if b.signerKnown {
+		return b.signerAddr, nil
+	}
+	switch b.version {
+	case signedCodecVersion, transferCodecVersion, namespacedSignedCodecVersion, namespacedTransferCodecVersion:
+	default:
+		return ids.ShortID{}, errUnsignedBlock
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(b.vm.signingHash(b.bytes), b.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	b.signerAddr = key.Address()
+	b.signerKnown = true
+	return b.signerAddr, nil
+}
+
+// signingHash returns the hash that the signer of the signed block
+// [blockBytes] signs: the hash of the chain's ID followed by [blockBytes] with
+// the signature zeroed. The signature is serialized last, so it's the last
+// bytes of [blockBytes]. The chain ID is signed so that a block signed for
+// one chain isn't valid on another chain running this VM.
+func (vm *VM) signingHash(blockBytes []byte) []byte {
+	var zeroSig [secp256k1.SignatureLen]byte
+	hasher := sha256.New()
+	_, _ = hasher.Write(vm.ctx.ChainID[:])
+	_, _ = hasher.Write(blockBytes[:len(blockBytes)-secp256k1.SignatureLen])
+	_, _ = hasher.Write(zeroSig[:])
+	return hasher.Sum(nil)
+}
+
+// signBlock makes [b] a signed block that includes [ops], signed by this
+// node's signer
+func (vm *VM) signBlock(ctx context.Context, b *Block, ops []SignerOp) error {
+	b.Ops = ops
+	b.Sig = [secp256k1.SignatureLen]byte{}
+	version := vm.genesis.Params.blockCodecVersion()
+	blockBytes, err := vm.marshal(version, b)
+	if err != nil {
+		return err
+	}
+	sig, err := vm.signer.SignHash(ctx, vm.signingHash(blockBytes))
+	if err != nil {
+		return err
+	}
+	copy(b.Sig[:], sig)
+	// The signature is serialized last, so it's written over the zeroed
+	// signature instead of marshaling the block again
+	copy(blockBytes[len(blockBytes)-secp256k1.SignatureLen:], sig)
+	b.Initialize(blockBytes, b.Status(), vm)
+	b.version = version
+	b.signerAddr = vm.signer.Address()
+	b.signerKnown = true
+	return nil
+}
+
+// verifyCanSign returns the signer set after [parent] if this node may sign
+// a child of [parent]. The signer set is nil if the chain has no allowed
+// signer set.
+func (vm *VM) verifyCanSign(parent *Block) (*signerSet, error) {
+	if vm.signer == nil {
+		return nil, errNoSigningKey
+	}
+	if !vm.genesis.Params.isPermissioned() {
+		return nil, nil
+	}
+	signers, err := vm.signersAfter(parent)
+	if err != nil {
+		return nil, err
+	}
+	if !signers.signers.Contains(vm.signer.Address()) {
+		return nil, errNotSigner
+	}
+	return signers, nil
+}
+
+// pendingSignerOps holds signer operations submitted over the API until they
+// are accepted
+type pendingSignerOps struct {
+	lock sync.Mutex
+	ops  []SignerOp
+}
+
+// add adds [op] to the pending operations
+func (p *pendingSignerOps) add(op SignerOp) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ops = append(p.ops, op)
+}
+
+// next returns the pending operations, in nonce order starting at
+// [signers]'s nonce, that can be applied to [signers]. [signers] is modified.
+func (p *pendingSignerOps) next(vm *VM, signers *signerSet) []SignerOp {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var next []SignerOp
+	for len(next) < maxBatchSize {
+		found := false
+		for _, op := range p.ops {
+			if op.Nonce == signers.nonce && signers.verify(vm, op) == nil {
+				signers.apply(op)
+				next = append(next, op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return next
+		}
+	}
+	return next
+}
+
+// prune drops the pending operations whose nonces were used
+func (p *pendingSignerOps) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	signers, err := vm.state.getSigners()
+	if err != nil {
+		return err
+	}
+	p.ops, err = pruneOps(vm.opJournal, signerOpKind, p.ops, func(op *SignerOp) bool {
+		return op.Nonce >= signers.nonce
+	})
+	return err
+}
+
+// len returns the number of pending operations
+func (p *pendingSignerOps) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.ops)
+}
+
+// verifyAddresses returns errDuplicateAddress if [addrs] has duplicates
+func verifyAddresses(addrs []ids.ShortID) error {
+	seen := set.NewSet[ids.ShortID](len(addrs))
+	for _, addr := range addrs {
+		if seen.Contains(addr) {
+			return errDuplicateAddress
+		}
+		seen.Add(addr)
+	}
+	return nil
+}
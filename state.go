@@ -0,0 +1,1223 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/ava-labs/avalanchego/cache"
+	"github.com/ava-labs/avalanchego/cache/lru"
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/database/prefixdb"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/utils/set"
+
+	"github.com/hitrich/AVM-TEST/light"
+)
+
+var (
+	blockPrefix      = []byte("block")
+	dataPrefix       = []byte("data")
+	heightPrefix     = []byte("height")
+	journalPrefix    = []byte("journal")
+	metadataPrefix   = []byte("metadata")
+	signerPrefix     = []byte("signer")
+	balancePrefix    = []byte("balance")
+	submitterPrefix  = []byte("submitter")
+	kvPrefix         = []byte("kv")
+	kvHistoryPrefix  = []byte("kvHistory")
+	noncePrefix      = []byte("nonce")
+	claimPrefix      = []byte("claim")
+	ownedPrefix      = []byte("owned")
+	writerPrefix     = []byte("writer")
+	aclNoncePrefix   = []byte("aclNonce")
+	namespacePrefix  = []byte("namespace")
+	nsCountPrefix    = []byte("nsCount")
+	revealPrefix     = []byte("reveal")
+	keyPrefix        = []byte("key")
+	keyVersionPrefix = []byte("keyVersion")
+	encryptedPrefix  = []byte("encrypted")
+	oraclePrefix     = []byte("oracle")
+	feedPrefix       = []byte("feed")
+	feedLatestPrefix = []byte("feedLatest")
+	documentPrefix   = []byte("document")
+	lightPrefix      = []byte("light")
+	warpPrefix       = []byte("warp")
+	votePrefix       = []byte("vote")
+	paramPrefix      = []byte("param")
+	retentionPrefix  = []byte("retention")
+	multisigPrefix   = []byte("multisig")
+	accountPrefix    = []byte("account")
+	submissionPrefix = []byte("submission")
+	indexerPrefix    = []byte("indexer")
+	signedDataPrefix = []byte("signedData")
+
+	lastAcceptedKey  = []byte("lastAccepted")
+	dbInitializedKey = []byte("dbInitialized")
+	dbInitializedVal = []byte{1}
+	signerNonceKey   = []byte("signerNonce")
+	signerVal        = []byte{1}
+	burnedKey        = []byte("burned")
+	baseFeeKey       = []byte("baseFee")
+	indexerNextKey   = []byte("indexerNext")
+)
+
+// blkWrapper is the representation of a block persisted in the database.
+// The status is stored alongside the bytes so that a block fetched from
+// the database knows whether it has been decided.
+type blkWrapper struct {
+	Blk    []byte         `serialize:"true"`
+	Status choices.Status `serialize:"true"`
+}
+
+// state persists blocks and chain metadata for the VM.
+// All writes go through [db] and must be committed by the caller. Decided
+// blocks and the height index are cached, so the caches must be flushed if
+// uncommitted writes are aborted.
+type state struct {
+	vm           *VM
+	blockDB      database.Database
+	dataDB       database.Database // data -> ID of the accepted block containing it
+	heightDB     database.Database // height -> ID of the accepted block at that height
+	journalDB    database.Database // Deletions from the journal of proposed data
+	metadataDB   database.Database
+	signerDB     database.Database // address -> signerVal for each allowed signer
+	balanceDB    database.Database // address -> balance
+	submitterDB  database.Database // address -> submitterStats of the signer
+	kvDB         database.Database // key -> kvEntry of the key's value
+	kvHistoryDB  database.Database // kvHistoryKey -> data of the operation
+	nonceDB      database.Database // address -> nonce of the next transfer
+	claimDB      database.Database // data -> claim on the data
+	ownedDB      database.Database // owner + data -> nil for each claim
+	writerDB     database.Database // namespace + address -> signerVal for each writer
+	aclNonceDB   database.Database // namespace -> nonce of the next ACL operation
+	namespaceDB  database.Database // namespaceIndexKey -> data in the namespace
+	nsCountDB    database.Database // namespace -> number of pieces of data in it
+	revealDB     database.Database // commitment -> revealed data
+	keyDB        database.Database // address + version -> public key
+	keyVersionDB database.Database // address -> version of the latest key
+	encryptedDB  database.Database // payload ID -> encryptedEntry
+	oracleDB     database.Database // feed + address -> signerVal for each oracle
+	feedDB       database.Database // feed + timestamp -> feedEntry
+	feedLatestDB database.Database // feed -> timestamp of the latest update
+	documentDB   database.Database // docHistoryKey -> digest of the version
+	lightDB      database.Database // height -> light header of the accepted block
+	warpDB       database.Database // source chain ID + hash -> height of the attestation
+	voteDB       database.Database // param change + address -> signerVal for each vote
+	paramDB      database.Database // param change -> nil for each passed change
+	retentionDB  database.Database // namespace + retention mode -> height the namespace is compacted to
+	multisigDB   database.Database // multisig set + data + namespace -> multisigEntry
+	accountDB    database.Database // address -> submitterAccount
+	submissionDB database.Database // address + nonce -> submissionEntry
+	indexerDB    database.Database // sequence -> indexerEvent
+	signedDataDB database.Database // data -> ID of the accepted block containing it in a signed operation
+
+	blockCache  cache.Cacher[ids.ID, *Block] // ID -> decided block
+	heightCache cache.Cacher[uint64, ids.ID] // height -> ID of the accepted block at that height
+}
+
+// newState returns the state in [db] with caches of the size in [vm]'s
+// config
+func newState(vm *VM, db database.Database) *state {
+	s := &state{
+		vm:           vm,
+		blockDB:      prefixdb.New(blockPrefix, db),
+		dataDB:       prefixdb.New(dataPrefix, db),
+		heightDB:     prefixdb.New(heightPrefix, db),
+		journalDB:    prefixdb.New(journalPrefix, db),
+		metadataDB:   prefixdb.New(metadataPrefix, db),
+		signerDB:     prefixdb.New(signerPrefix, db),
+		balanceDB:    prefixdb.New(balancePrefix, db),
+		submitterDB:  prefixdb.New(submitterPrefix, db),
+		kvDB:         prefixdb.New(kvPrefix, db),
+		kvHistoryDB:  prefixdb.New(kvHistoryPrefix, db),
+		nonceDB:      prefixdb.New(noncePrefix, db),
+		claimDB:      prefixdb.New(claimPrefix, db),
+		ownedDB:      prefixdb.New(ownedPrefix, db),
+		writerDB:     prefixdb.New(writerPrefix, db),
+		aclNonceDB:   prefixdb.New(aclNoncePrefix, db),
+		namespaceDB:  prefixdb.New(namespacePrefix, db),
+		nsCountDB:    prefixdb.New(nsCountPrefix, db),
+		revealDB:     prefixdb.New(revealPrefix, db),
+		keyDB:        prefixdb.New(keyPrefix, db),
+		keyVersionDB: prefixdb.New(keyVersionPrefix, db),
+		encryptedDB:  prefixdb.New(encryptedPrefix, db),
+		oracleDB:     prefixdb.New(oraclePrefix, db),
+		feedDB:       prefixdb.New(feedPrefix, db),
+		feedLatestDB: prefixdb.New(feedLatestPrefix, db),
+		documentDB:   prefixdb.New(documentPrefix, db),
+		lightDB:      prefixdb.New(lightPrefix, db),
+		warpDB:       prefixdb.New(warpPrefix, db),
+		voteDB:       prefixdb.New(votePrefix, db),
+		paramDB:      prefixdb.New(paramPrefix, db),
+		retentionDB:  prefixdb.New(retentionPrefix, db),
+		multisigDB:   prefixdb.New(multisigPrefix, db),
+		accountDB:    prefixdb.New(accountPrefix, db),
+		submissionDB: prefixdb.New(submissionPrefix, db),
+		indexerDB:    prefixdb.New(indexerPrefix, db),
+		signedDataDB: prefixdb.New(signedDataPrefix, db),
+	}
+	s.resizeCaches(vm.config.Load().BlockCacheSize)
+	return s
+}
+
+// resizeCaches replaces the caches with empty caches of [size] values. Zero
+// disables the caches.
+func (s *state) resizeCaches(size int) {
+	if size == 0 {
+		s.blockCache = &cache.Empty[ids.ID, *Block]{}
+		s.heightCache = &cache.Empty[uint64, ids.ID]{}
+		return
+	}
+	s.blockCache = lru.NewCache[ids.ID, *Block](size)
+	s.heightCache = lru.NewCache[uint64, ids.ID](size)
+}
+
+// flushCaches drops every cached value
+func (s *state) flushCaches() {
+	s.blockCache.Flush()
+	s.heightCache.Flush()
+}
+
+// getBlock returns the block with ID [blkID] from the database
+func (s *state) getBlock(blkID ids.ID) (*Block, error) {
+	if blk, ok := s.blockCache.Get(blkID); ok {
+		return blk, nil
+	}
+
+	// The block's bytes are sliced out of the stored block rather than copied
+	// by unmarshaling the wrapper
+	blockBytes, status, err := s.getStoredBlockBytes(blkID)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err := s.vm.parseBlock(blockBytes)
+	if err != nil {
+		return nil, err
+	}
+	blk.status = status
+	s.blockCache.Put(blkID, blk)
+	return blk, nil
+}
+
+// getStatus returns the status of the block with ID [blkID] without decoding
+// the block
+func (s *state) getStatus(blkID ids.ID) (choices.Status, error) {
+	_, status, err := s.getBlockBytes(blkID)
+	return status, err
+}
+
+// getBlockBytes returns the bytes and status of the block with ID [blkID]
+// without decoding the block
+func (s *state) getBlockBytes(blkID ids.ID) ([]byte, choices.Status, error) {
+	if blk, ok := s.blockCache.Get(blkID); ok {
+		return blk.Bytes(), blk.Status(), nil
+	}
+	return s.getStoredBlockBytes(blkID)
+}
+
+// getStoredBlockBytes returns the bytes and status of the block with ID
+// [blkID] from the database, skipping the cache
+func (s *state) getStoredBlockBytes(blkID ids.ID) ([]byte, choices.Status, error) {
+	wrappedBytes, err := s.blockDB.Get(blkID[:])
+	if err != nil {
+		return nil, choices.Unknown, err
+	}
+	return unwrapBlock(wrappedBytes)
+}
+
+// getHeader returns the header of the block with ID [blkID] without decoding
+// the block's data
+func (s *state) getHeader(blkID ids.ID) (blockHeader, error) {
+	blockBytes, _, err := s.getBlockBytes(blkID)
+	if err != nil {
+		return blockHeader{}, err
+	}
+	return parseHeader(blockBytes)
+}
+
+// putBlock writes [blk] and its status to the database
+func (s *state) putBlock(blk *Block) error {
+	wrapper := blkWrapper{
+		Blk:    blk.Bytes(),
+		Status: blk.Status(),
+	}
+	blkID := blk.ID()
+	// The database copies the bytes, so they can be marshaled into a pooled
+	// buffer
+	err := s.vm.withMarshaled(codecVersion, &wrapper, func(wrappedBytes []byte) error {
+		return s.blockDB.Put(blkID[:], wrappedBytes)
+	})
+	if err != nil {
+		return err
+	}
+	s.blockCache.Put(blkID, blk)
+	return nil
+}
+
+// deleteBlock removes the block with ID [blkID] from the database
+func (s *state) deleteBlock(blkID ids.ID) error {
+	s.blockCache.Evict(blkID)
+	return s.blockDB.Delete(blkID[:])
+}
+
+// hasData returns true iff an accepted block contains [data]
+func (s *state) hasData(data [dataLen]byte) (bool, error) {
+	return s.dataDB.Has(data[:])
+}
+
+// getDataBlock returns the ID of the accepted block that contains [data].
+// Returns database.ErrNotFound if no accepted block contains [data].
+func (s *state) getDataBlock(data [dataLen]byte) (ids.ID, error) {
+	return database.GetID(s.dataDB, data[:])
+}
+
+// putData records that the accepted block [blkID] contains [data]
+func (s *state) putData(data [dataLen]byte, blkID ids.ID) error {
+	return database.PutID(s.dataDB, data[:], blkID)
+}
+
+// hasAnyData returns true iff an accepted block contains [data], directly
+// or in a signed operation
+func (s *state) hasAnyData(data [dataLen]byte) (bool, error) {
+	if has, err := s.dataDB.Has(data[:]); err != nil || has {
+		return has, err
+	}
+	return s.signedDataDB.Has(data[:])
+}
+
+// putSignedData records that the accepted block [blkID] contains [data] in
+// a signed operation
+func (s *state) putSignedData(data [dataLen]byte, blkID ids.ID) error {
+	return database.PutID(s.signedDataDB, data[:], blkID)
+}
+
+// getBlockIDAtHeight returns the ID of the accepted block at [height]
+func (s *state) getBlockIDAtHeight(height uint64) (ids.ID, error) {
+	if blkID, ok := s.heightCache.Get(height); ok {
+		return blkID, nil
+	}
+	blkID, err := database.GetID(s.heightDB, database.PackUInt64(height))
+	if err != nil {
+		return ids.Empty, err
+	}
+	s.heightCache.Put(height, blkID)
+	return blkID, nil
+}
+
+// putBlockIDAtHeight records [blkID] as the accepted block at [height]
+func (s *state) putBlockIDAtHeight(height uint64, blkID ids.ID) error {
+	if err := database.PutID(s.heightDB, database.PackUInt64(height), blkID); err != nil {
+		return err
+	}
+	s.heightCache.Put(height, blkID)
+	return nil
+}
+
+// warmCaches loads the [n] most recently accepted blocks, starting at the last
+// accepted block [lastAcceptedID], and their heights into the caches.
+// Returns the number of blocks loaded.
+func (s *state) warmCaches(lastAcceptedID ids.ID, n int) (int, error) {
+	blkID := lastAcceptedID
+	for i := 0; i < n; i++ {
+		blk, err := s.getBlock(blkID)
+		if err != nil {
+			return i, err
+		}
+		if _, err := s.getBlockIDAtHeight(blk.Height()); err != nil {
+			return i, err
+		}
+		if blk.Height() == 0 {
+			return i + 1, nil
+		}
+		blkID = blk.Parent()
+	}
+	return n, nil
+}
+
+// getLastAccepted returns the ID of the last accepted block
+func (s *state) getLastAccepted() (ids.ID, error) {
+	return database.GetID(s.metadataDB, lastAcceptedKey)
+}
+
+// setLastAccepted records [blkID] as the last accepted block
+func (s *state) setLastAccepted(blkID ids.ID) error {
+	return database.PutID(s.metadataDB, lastAcceptedKey, blkID)
+}
+
+// isInitialized returns true iff the genesis block has been persisted
+func (s *state) isInitialized() (bool, error) {
+	return s.metadataDB.Has(dbInitializedKey)
+}
+
+// setInitialized marks the database as holding a genesis block
+func (s *state) setInitialized() error {
+	return s.metadataDB.Put(dbInitializedKey, dbInitializedVal)
+}
+
+// getSigners returns the signer set after the last accepted block
+func (s *state) getSigners() (*signerSet, error) {
+	nonce, err := database.WithDefault(database.GetUInt64, s.metadataDB, signerNonceKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	signers := &signerSet{
+		signers: set.Set[ids.ShortID]{},
+		nonce:   nonce,
+	}
+
+	it := s.signerDB.NewIterator()
+	defer it.Release()
+	for it.Next() {
+		addr, err := ids.ToShortID(it.Key())
+		if err != nil {
+			return nil, err
+		}
+		signers.signers.Add(addr)
+	}
+	return signers, it.Error()
+}
+
+// applySignerOp records that [op] was accepted
+func (s *state) applySignerOp(op SignerOp) error {
+	if op.Add {
+		if err := s.putSigner(op.Signer); err != nil {
+			return err
+		}
+	} else if err := s.signerDB.Delete(op.Signer[:]); err != nil {
+		return err
+	}
+	return database.PutUInt64(s.metadataDB, signerNonceKey, op.Nonce+1)
+}
+
+// putSigner adds [addr] to the allowed signers
+func (s *state) putSigner(addr ids.ShortID) error {
+	return s.signerDB.Put(addr[:], signerVal)
+}
+
+// getWriters returns the addresses that may write to [namespace] after the
+// last accepted block
+func (s *state) getWriters(namespace [NamespaceLen]byte) (*writerSet, error) {
+	nonce, err := s.getACLNonce(namespace)
+	if err != nil {
+		return nil, err
+	}
+	w := &writerSet{
+		writers: set.Set[ids.ShortID]{},
+		nonce:   nonce,
+	}
+
+	it := s.writerDB.NewIteratorWithPrefix(namespace[:])
+	defer it.Release()
+	for it.Next() {
+		addr, err := ids.ToShortID(it.Key()[NamespaceLen:])
+		if err != nil {
+			return nil, err
+		}
+		w.writers.Add(addr)
+	}
+	return w, it.Error()
+}
+
+// getACLNonce returns the nonce of [namespace]'s next ACL operation
+func (s *state) getACLNonce(namespace [NamespaceLen]byte) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.aclNonceDB, namespace[:], 0)
+}
+
+// applyACLOp writes the effect of the ACL operation [op]
+func (s *state) applyACLOp(op ACLOp) error {
+	key := writerKey(op.Namespace, op.Writer)
+	if op.Grant {
+		if err := s.writerDB.Put(key, signerVal); err != nil {
+			return err
+		}
+	} else if err := s.writerDB.Delete(key); err != nil {
+		return err
+	}
+	return database.PutUInt64(s.aclNonceDB, op.Namespace[:], op.Nonce+1)
+}
+
+// putWriter allows [addr] to write to [namespace]
+func (s *state) putWriter(namespace [NamespaceLen]byte, addr ids.ShortID) error {
+	return s.writerDB.Put(writerKey(namespace, addr), signerVal)
+}
+
+func writerKey(namespace [NamespaceLen]byte, addr ids.ShortID) []byte {
+	return append(namespace[:], addr[:]...)
+}
+
+// getBalance returns the balance of [addr] after the last accepted block
+func (s *state) getBalance(addr ids.ShortID) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.balanceDB, addr[:], 0)
+}
+
+// putBalance sets the balance of [addr]
+func (s *state) putBalance(addr ids.ShortID, balance uint64) error {
+	return database.PutUInt64(s.balanceDB, addr[:], balance)
+}
+
+// getNonce returns the nonce of [addr]'s next transfer after the last
+// accepted block
+func (s *state) getNonce(addr ids.ShortID) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.nonceDB, addr[:], 0)
+}
+
+// putNonce sets the nonce of [addr]'s next transfer
+func (s *state) putNonce(addr ids.ShortID, nonce uint64) error {
+	return database.PutUInt64(s.nonceDB, addr[:], nonce)
+}
+
+// getClaim returns the claim on [data] after the last accepted block.
+// Returns database.ErrNotFound if no accepted block minted the claim.
+func (s *state) getClaim(data [dataLen]byte) (claim, error) {
+	claimBytes, err := s.claimDB.Get(data[:])
+	if err != nil {
+		return claim{}, err
+	}
+	return parseClaim(claimBytes)
+}
+
+// hasClaim returns true iff an accepted block minted the claim on [data]
+func (s *state) hasClaim(data [dataLen]byte) (bool, error) {
+	return s.claimDB.Has(data[:])
+}
+
+// putClaim sets the claim on [data] to [c] and indexes it by its owner
+func (s *state) putClaim(data [dataLen]byte, c claim) error {
+	if err := s.claimDB.Put(data[:], c.bytes()); err != nil {
+		return err
+	}
+	return s.ownedDB.Put(ownedKey(c.owner, data), nil)
+}
+
+// deleteOwnedClaim removes the claim on [data] from [owner]'s claims
+func (s *state) deleteOwnedClaim(owner ids.ShortID, data [dataLen]byte) error {
+	return s.ownedDB.Delete(ownedKey(owner, data))
+}
+
+// getOwnedClaims returns the data claimed by [owner], in the order of the
+// data's bytes
+func (s *state) getOwnedClaims(ctx context.Context, owner ids.ShortID) ([][dataLen]byte, error) {
+	it := s.ownedDB.NewIteratorWithPrefix(owner[:])
+	defer it.Release()
+
+	var owned [][dataLen]byte
+	for it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var data [dataLen]byte
+		copy(data[:], it.Key()[ids.ShortIDLen:])
+		owned = append(owned, data)
+	}
+	return owned, it.Error()
+}
+
+func ownedKey(owner ids.ShortID, data [dataLen]byte) []byte {
+	return append(owner[:], data[:]...)
+}
+
+// getReveal returns the data an accepted block revealed for [commitment].
+// Returns database.ErrNotFound if no accepted block revealed it.
+func (s *state) getReveal(commitment [dataLen]byte) (revealed, error) {
+	revealedBytes, err := s.revealDB.Get(commitment[:])
+	if err != nil {
+		return revealed{}, err
+	}
+	return parseRevealed(revealedBytes)
+}
+
+// hasReveal returns true iff an accepted block revealed [commitment]
+func (s *state) hasReveal(commitment [dataLen]byte) (bool, error) {
+	return s.revealDB.Has(commitment[:])
+}
+
+// putReveal records that [commitment] is revealed as [r]
+func (s *state) putReveal(commitment [dataLen]byte, r revealed) error {
+	return s.revealDB.Put(commitment[:], r.bytes())
+}
+
+// getKeyVersion returns the version of [addr]'s latest key after the last
+// accepted block. Zero means [addr] has no key.
+func (s *state) getKeyVersion(addr ids.ShortID) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.keyVersionDB, addr[:], 0)
+}
+
+// getKey returns version [version] of [addr]'s key
+func (s *state) getKey(addr ids.ShortID, version uint64) ([EncryptionKeyLen]byte, error) {
+	var key [EncryptionKeyLen]byte
+	keyBytes, err := s.keyDB.Get(keyKey(addr, version))
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], keyBytes)
+	return key, nil
+}
+
+// putKey makes [key] version [version] of [addr]'s key, which is its latest
+// key
+func (s *state) putKey(addr ids.ShortID, version uint64, key [EncryptionKeyLen]byte) error {
+	if err := s.keyDB.Put(keyKey(addr, version), key[:]); err != nil {
+		return err
+	}
+	return database.PutUInt64(s.keyVersionDB, addr[:], version)
+}
+
+func keyKey(addr ids.ShortID, version uint64) []byte {
+	return binary.BigEndian.AppendUint64(addr[:], version)
+}
+
+// getEncrypted returns the accepted encrypted payload [id].
+// Returns database.ErrNotFound if it isn't accepted.
+func (s *state) getEncrypted(id [dataLen]byte) (encryptedEntry, error) {
+	entryBytes, err := s.encryptedDB.Get(id[:])
+	if err != nil {
+		return encryptedEntry{}, err
+	}
+	return parseEncryptedEntry(entryBytes)
+}
+
+// hasEncrypted returns true iff the encrypted payload [id] is accepted
+func (s *state) hasEncrypted(id [dataLen]byte) (bool, error) {
+	return s.encryptedDB.Has(id[:])
+}
+
+// putEncrypted stores the accepted encrypted payload [id]
+func (s *state) putEncrypted(id [dataLen]byte, e encryptedEntry) error {
+	return s.encryptedDB.Put(id[:], e.bytes())
+}
+
+// isOracle returns true iff [addr] may sign updates of [feed]
+func (s *state) isOracle(feed [FeedIDLen]byte, addr ids.ShortID) (bool, error) {
+	return s.oracleDB.Has(append(feed[:], addr[:]...))
+}
+
+// putOracle allows [addr] to sign updates of [feed]
+func (s *state) putOracle(feed [FeedIDLen]byte, addr ids.ShortID) error {
+	return s.oracleDB.Put(append(feed[:], addr[:]...), signerVal)
+}
+
+// getFeedTimestamp returns the timestamp of [feed]'s latest accepted update.
+// Zero means [feed] has no accepted updates.
+func (s *state) getFeedTimestamp(feed [FeedIDLen]byte) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.feedLatestDB, feed[:], 0)
+}
+
+// getLatestFeedEntry returns [feed]'s latest accepted update.
+// Returns database.ErrNotFound if [feed] has no accepted updates.
+func (s *state) getLatestFeedEntry(feed [FeedIDLen]byte) (feedEntry, error) {
+	timestamp, err := database.GetUInt64(s.feedLatestDB, feed[:])
+	if err != nil {
+		return feedEntry{}, err
+	}
+	entryBytes, err := s.feedDB.Get(feedKey(feed, timestamp))
+	if err != nil {
+		return feedEntry{}, err
+	}
+	return parseFeedEntry(timestamp, entryBytes)
+}
+
+// getFeedEntries returns up to [limit] of [feed]'s accepted updates, oldest
+// first, starting at the timestamp [start]
+func (s *state) getFeedEntries(ctx context.Context, feed [FeedIDLen]byte, start uint64, limit int) ([]feedEntry, error) {
+	it := s.feedDB.NewIteratorWithStartAndPrefix(feedKey(feed, start), feed[:])
+	defer it.Release()
+
+	var entries []feedEntry
+	for len(entries) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry, err := parseFeedEntry(binary.BigEndian.Uint64(it.Key()[FeedIDLen:]), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, it.Error()
+}
+
+// putFeedEntry records [e] as [feed]'s latest update
+func (s *state) putFeedEntry(feed [FeedIDLen]byte, e feedEntry) error {
+	if err := s.feedDB.Put(feedKey(feed, e.timestamp), e.bytes()); err != nil {
+		return err
+	}
+	return database.PutUInt64(s.feedLatestDB, feed[:], e.timestamp)
+}
+
+func feedKey(feed [FeedIDLen]byte, timestamp uint64) []byte {
+	return binary.BigEndian.AppendUint64(feed[:], timestamp)
+}
+
+// getSubmitterStats returns the stats of the accepted blocks signed by [addr]
+func (s *state) getSubmitterStats(addr ids.ShortID) (submitterStats, error) {
+	statsBytes, err := s.submitterDB.Get(addr[:])
+	if err == database.ErrNotFound {
+		return submitterStats{}, nil
+	}
+	if err != nil {
+		return submitterStats{}, err
+	}
+	return parseSubmitterStats(statsBytes)
+}
+
+// putSubmitterStats sets the stats of the accepted blocks signed by [addr]
+func (s *state) putSubmitterStats(addr ids.ShortID, stats submitterStats) error {
+	return s.submitterDB.Put(addr[:], stats.bytes())
+}
+
+// getSubmitters returns the stats of up to [limit] addresses that signed an
+// accepted block, in the order of the addresses, skipping the first [start]
+func (s *state) getSubmitters(ctx context.Context, start uint64, limit int) ([]submitterSummary, error) {
+	it := s.submitterDB.NewIterator()
+	defer it.Release()
+
+	skip(it, start)
+	var summaries []submitterSummary
+	for len(summaries) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		addr, err := ids.ToShortID(it.Key())
+		if err != nil {
+			return nil, err
+		}
+		stats, err := parseSubmitterStats(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, submitterSummary{addr: addr, submitterStats: stats})
+	}
+	return summaries, it.Error()
+}
+
+// getKV returns the value of [key] after the last accepted block. Returns
+// database.ErrNotFound if [key] has no value.
+func (s *state) getKV(key [KVKeyLen]byte) (kvEntry, error) {
+	entryBytes, err := s.kvDB.Get(key[:])
+	if err != nil {
+		return kvEntry{}, err
+	}
+	return parseKVEntry(entryBytes)
+}
+
+// applyKVOp applies [op], the [index]th piece of data of the block at
+// [height], and adds it to the history of its key
+func (s *state) applyKVOp(op kvOp, height uint64, index int) error {
+	if op.delete {
+		if err := s.kvDB.Delete(op.key[:]); err != nil {
+			return err
+		}
+	} else {
+		entry := kvEntry{value: op.value, height: height}
+		if err := s.kvDB.Put(op.key[:], entry.bytes()); err != nil {
+			return err
+		}
+	}
+	data := op.data()
+	return s.kvHistoryDB.Put(kvHistoryKey(op.key, height, index), data[:])
+}
+
+// getKVHistory returns up to [limit] accepted operations on [key], oldest
+// first, starting at the [index]th piece of data of the block at [start]
+func (s *state) getKVHistory(ctx context.Context, key [KVKeyLen]byte, start uint64, index int, limit int) ([]kvHistoryEntry, error) {
+	it := s.kvHistoryDB.NewIteratorWithStartAndPrefix(kvHistoryKey(key, start, index), key[:])
+	defer it.Release()
+
+	var history []kvHistoryEntry
+	for len(history) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var data [dataLen]byte
+		copy(data[:], it.Value())
+		op, err := parseKVOp(data)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, kvHistoryEntry{
+			op:     op,
+			height: binary.BigEndian.Uint64(it.Key()[KVKeyLen:]),
+			index:  int(binary.BigEndian.Uint16(it.Key()[KVKeyLen+8:])),
+		})
+	}
+	return history, it.Error()
+}
+
+// putDocVersion adds [v], the [index]th piece of data of the block at
+// [height], to its document's history
+func (s *state) putDocVersion(v docVersion, height uint64, index int) error {
+	return s.documentDB.Put(docHistoryKey(v.docID, height, index), v.digest[:])
+}
+
+// getDocHistory returns up to [limit] accepted versions of [docID], oldest
+// first, skipping the first [start]
+func (s *state) getDocHistory(ctx context.Context, docID [DocIDLen]byte, start uint64, limit int) ([]docHistoryEntry, error) {
+	it := s.documentDB.NewIteratorWithPrefix(docID[:])
+	defer it.Release()
+
+	skip(it, start)
+	var history []docHistoryEntry
+	for len(history) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry := docHistoryEntry{
+			version: docVersion{docID: docID},
+			height:  binary.BigEndian.Uint64(it.Key()[DocIDLen:]),
+		}
+		copy(entry.version.digest[:], it.Value())
+		history = append(history, entry)
+	}
+	return history, it.Error()
+}
+
+// putWarpAttestation records that the attestation with [key] was accepted in
+// the block at [height]
+func (s *state) putWarpAttestation(key []byte, height uint64) error {
+	return database.PutUInt64(s.warpDB, key, height)
+}
+
+// hasWarpAttestation returns true iff the attestation with [key] was accepted
+func (s *state) hasWarpAttestation(key []byte) (bool, error) {
+	return s.warpDB.Has(key)
+}
+
+// getWarpAttestation returns the height of the block that accepted the
+// attestation with [key]
+func (s *state) getWarpAttestation(key []byte) (uint64, error) {
+	return database.GetUInt64(s.warpDB, key)
+}
+
+// getMultisig returns the accepted multisig proposal with [key].
+// Returns database.ErrNotFound if it isn't accepted.
+func (s *state) getMultisig(key []byte) (multisigEntry, error) {
+	b, err := s.multisigDB.Get(key)
+	if err != nil {
+		return multisigEntry{}, err
+	}
+	return parseMultisigEntry(b)
+}
+
+// hasMultisig returns true iff a multisig proposal with [key] was accepted
+func (s *state) hasMultisig(key []byte) (bool, error) {
+	return s.multisigDB.Has(key)
+}
+
+// putMultisig records that the multisig proposal with [key] was accepted as
+// [e]
+func (s *state) putMultisig(key []byte, e multisigEntry) error {
+	return s.multisigDB.Put(key, e.bytes())
+}
+
+// getSubmitterAccount returns the account of [addr].
+// Returns database.ErrNotFound if [addr] has no accepted submissions.
+func (s *state) getSubmitterAccount(addr ids.ShortID) (submitterAccount, error) {
+	b, err := s.accountDB.Get(addr[:])
+	if err != nil {
+		return submitterAccount{}, err
+	}
+	return parseSubmitterAccount(b)
+}
+
+// putSubmitterAccount sets the account of [addr] to [a]
+func (s *state) putSubmitterAccount(addr ids.ShortID, a submitterAccount) error {
+	return s.accountDB.Put(addr[:], a.bytes())
+}
+
+// getSubmissions returns up to [limit] of [addr]'s accepted submissions from
+// the nonce [start] on
+func (s *state) getSubmissions(ctx context.Context, addr ids.ShortID, start uint64, limit int) ([]submissionEntry, error) {
+	it := s.submissionDB.NewIteratorWithStartAndPrefix(binary.BigEndian.AppendUint64(addr[:], start), addr[:])
+	defer it.Release()
+
+	var entries []submissionEntry
+	for len(entries) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e, err := parseSubmissionEntry(binary.BigEndian.Uint64(it.Key()[ids.ShortIDLen:]), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, it.Error()
+}
+
+// putSubmission records [e] in [addr]'s submission history
+func (s *state) putSubmission(addr ids.ShortID, e submissionEntry) error {
+	return s.submissionDB.Put(binary.BigEndian.AppendUint64(addr[:], e.nonce), e.bytes())
+}
+
+// getIndexerEvents returns up to [limit] events of the indexer feed from the
+// sequence [start] on
+func (s *state) getIndexerEvents(ctx context.Context, start uint64, limit int) ([]indexerEvent, error) {
+	it := s.indexerDB.NewIteratorWithStart(database.PackUInt64(start))
+	defer it.Release()
+
+	var events []indexerEvent
+	for len(events) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e, err := parseIndexerEvent(binary.BigEndian.Uint64(it.Key()), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, it.Error()
+}
+
+// appendIndexerEvent adds [e] to the end of the indexer feed
+func (s *state) appendIndexerEvent(e indexerEvent) error {
+	sequence, err := database.WithDefault(database.GetUInt64, s.metadataDB, indexerNextKey, 0)
+	if err != nil {
+		return err
+	}
+	if err := s.indexerDB.Put(database.PackUInt64(sequence), e.bytes()); err != nil {
+		return err
+	}
+	return database.PutUInt64(s.metadataDB, indexerNextKey, sequence+1)
+}
+
+// getVoters returns the addresses whose votes for [c] were accepted
+func (s *state) getVoters(c ParamChange) (set.Set[ids.ShortID], error) {
+	prefix := c.bytes()
+	it := s.voteDB.NewIteratorWithPrefix(prefix)
+	defer it.Release()
+
+	voters := set.Set[ids.ShortID]{}
+	for it.Next() {
+		addr, err := ids.ToShortID(it.Key()[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		voters.Add(addr)
+	}
+	return voters, it.Error()
+}
+
+// putVote records that [voter]'s vote for [c] was accepted
+func (s *state) putVote(c ParamChange, voter ids.ShortID) error {
+	return s.voteDB.Put(append(c.bytes(), voter[:]...), signerVal)
+}
+
+// hasParamChange returns true iff a change of [slot]'s parameter at its
+// activation height passed
+func (s *state) hasParamChange(slot paramSlot) (bool, error) {
+	it := s.paramDB.NewIteratorWithPrefix(slot.key())
+	defer it.Release()
+
+	return it.Next(), it.Error()
+}
+
+// isPassed returns true iff [c] passed
+func (s *state) isPassed(c ParamChange) (bool, error) {
+	return s.paramDB.Has(c.bytes())
+}
+
+// putParamChange records that [c] passed
+func (s *state) putParamChange(c ParamChange) error {
+	return s.paramDB.Put(c.bytes(), nil)
+}
+
+// getParamChanges returns the changes that passed, in activation order
+func (s *state) getParamChanges() ([]ParamChange, error) {
+	it := s.paramDB.NewIterator()
+	defer it.Release()
+
+	var changes []ParamChange
+	for it.Next() {
+		c, err := parseParamChange(it.Key())
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, it.Error()
+}
+
+// putLightHeader records [h] as the light header at its height
+func (s *state) putLightHeader(h light.Header) error {
+	return s.lightDB.Put(database.PackUInt64(h.Height), h.Bytes())
+}
+
+// getLightHeader returns the light header at [height]
+func (s *state) getLightHeader(height uint64) (light.Header, error) {
+	b, err := s.lightDB.Get(database.PackUInt64(height))
+	if err != nil {
+		return light.Header{}, err
+	}
+	return light.ParseHeader(b)
+}
+
+// getLightHeaders returns up to [limit] consecutive light headers, starting
+// at [start]
+func (s *state) getLightHeaders(ctx context.Context, start uint64, limit int) ([]light.Header, error) {
+	it := s.lightDB.NewIteratorWithStart(database.PackUInt64(start))
+	defer it.Release()
+
+	var headers []light.Header
+	for len(headers) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		h, err := light.ParseHeader(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		if h.Height != start+uint64(len(headers)) {
+			break
+		}
+		headers = append(headers, h)
+	}
+	return headers, it.Error()
+}
+
+// putNamespaceData adds [data], the [index]th piece of data of the block at
+// [height], to the index of [namespace]
+func (s *state) putNamespaceData(namespace [NamespaceLen]byte, height uint64, index int, data [dataLen]byte) error {
+	if err := s.namespaceDB.Put(namespaceIndexKey(namespace, height, index), data[:]); err != nil {
+		return err
+	}
+	count, err := database.WithDefault(database.GetUInt64, s.nsCountDB, namespace[:], 0)
+	if err != nil {
+		return err
+	}
+	return database.PutUInt64(s.nsCountDB, namespace[:], count+1)
+}
+
+// getNamespaceData returns up to [limit] pieces of [namespace]'s accepted
+// data, oldest first, starting at the piece at [index] in the block at
+// [start]
+func (s *state) getNamespaceData(ctx context.Context, namespace [NamespaceLen]byte, start uint64, index int, limit int) ([]namespaceEntry, error) {
+	it := s.namespaceDB.NewIteratorWithStartAndPrefix(namespaceIndexKey(namespace, start, index), namespace[:])
+	defer it.Release()
+
+	var entries []namespaceEntry
+	for len(entries) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry := namespaceEntry{
+			height: binary.BigEndian.Uint64(it.Key()[NamespaceLen:]),
+			index:  int(binary.BigEndian.Uint16(it.Key()[NamespaceLen+8:])),
+		}
+		entry.data, entry.hashOnly = parseNamespaceValue(it.Value())
+		entries = append(entries, entry)
+	}
+	return entries, it.Error()
+}
+
+// namespaceIterator iterates over [namespace]'s index, starting at the block
+// at [start]
+func (s *state) namespaceIterator(namespace [NamespaceLen]byte, start uint64) database.Iterator {
+	return s.namespaceDB.NewIteratorWithStartAndPrefix(namespaceIndexKey(namespace, start, 0), namespace[:])
+}
+
+// getNamespaceValue returns the value of [key] in the namespace index
+func (s *state) getNamespaceValue(key []byte) ([]byte, error) {
+	return s.namespaceDB.Get(key)
+}
+
+// putNamespaceValue sets the value of [key] in the namespace index
+func (s *state) putNamespaceValue(key []byte, value []byte) error {
+	return s.namespaceDB.Put(key, value)
+}
+
+// deleteNamespaceValue removes [key] from the namespace index
+func (s *state) deleteNamespaceValue(key []byte) error {
+	return s.namespaceDB.Delete(key)
+}
+
+// getCompactedHeight returns the height up to which [namespace]'s data is
+// compacted under [mode]
+func (s *state) getCompactedHeight(namespace [NamespaceLen]byte, mode byte) (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.retentionDB, append(namespace[:], mode), 0)
+}
+
+// putCompactedHeight sets the height up to which [namespace]'s data is
+// compacted under [mode]
+func (s *state) putCompactedHeight(namespace [NamespaceLen]byte, mode byte, height uint64) error {
+	return database.PutUInt64(s.retentionDB, append(namespace[:], mode), height)
+}
+
+// getNamespaces returns up to [limit] namespaces with accepted data, in the
+// order of the namespaces' bytes, skipping the first [start]
+func (s *state) getNamespaces(ctx context.Context, start uint64, limit int) ([]namespaceSummary, error) {
+	it := s.nsCountDB.NewIterator()
+	defer it.Release()
+
+	skip(it, start)
+	var summaries []namespaceSummary
+	for len(summaries) < limit && it.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		count, err := database.ParseUInt64(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		summary := namespaceSummary{count: count}
+		copy(summary.namespace[:], it.Key())
+		summaries = append(summaries, summary)
+	}
+	return summaries, it.Error()
+}
+
+// getBurned returns the total fees burned by accepted blocks
+func (s *state) getBurned() (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.metadataDB, burnedKey, 0)
+}
+
+// putBurned sets the total fees burned by accepted blocks
+func (s *state) putBurned(burned uint64) error {
+	return database.PutUInt64(s.metadataDB, burnedKey, burned)
+}
+
+// getBaseFee returns the base fee of the last accepted block of a chain with
+// a dynamic fee. Zero if only the genesis block is accepted.
+func (s *state) getBaseFee() (uint64, error) {
+	return database.WithDefault(database.GetUInt64, s.metadataDB, baseFeeKey, 0)
+}
+
+// putBaseFee sets the base fee of the last accepted block
+func (s *state) putBaseFee(fee uint64) error {
+	return database.PutUInt64(s.metadataDB, baseFeeKey, fee)
+}
+
+// repairHeightIndex indexes every accepted block that is missing from the
+// height index. Databases created before the height index was introduced
+// are indexed by walking back from the last accepted block.
+func (s *state) repairHeightIndex() error {
+	lastAcceptedID, err := s.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	// Only the headers of the blocks are needed
+	header, err := s.getHeader(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		indexedID, err := s.getBlockIDAtHeight(header.Height)
+		switch {
+		case err == nil && indexedID == header.ID:
+			// Everything below an indexed block is indexed
+			return nil
+		case err != nil && err != database.ErrNotFound:
+			return err
+		}
+
+		if err := s.putBlockIDAtHeight(header.Height, header.ID); err != nil {
+			return err
+		}
+		if header.Height == 0 {
+			return nil
+		}
+		if header, err = s.getHeader(header.ParentID); err != nil {
+			return err
+		}
+	}
+}
+
+// repairIndexerFeed starts the indexer feed of databases created before it
+// was introduced, with an accepted event for every accepted block this node
+// has, from the genesis block up
+func (s *state) repairIndexerFeed() error {
+	if has, err := s.metadataDB.Has(indexerNextKey); err != nil || has {
+		return err
+	}
+	lastAcceptedID, err := s.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	header, err := s.getHeader(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	for height := uint64(0); height <= header.Height; height++ {
+		switch _, err := s.getBlockIDAtHeight(height); err {
+		case nil:
+		case database.ErrNotFound:
+			// The node state synced past this height
+			continue
+		default:
+			return err
+		}
+		if err := s.appendIndexerEvent(indexerEvent{height: height}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairLightHeaders adds the light headers that are missing from the header
+// chain. Databases created before light headers were introduced get headers
+// for every accepted block, from the genesis block up.
+func (s *state) repairLightHeaders() error {
+	lastAcceptedID, err := s.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	header, err := s.getHeader(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	switch _, err := s.getLightHeader(header.Height); err {
+	case nil:
+		return nil
+	case database.ErrNotFound:
+	default:
+		return err
+	}
+
+	var (
+		parentID ids.ID
+		height   uint64
+	)
+	for ; height <= header.Height; height++ {
+		h, err := s.getLightHeader(height)
+		if err == database.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		parentID = h.ID()
+	}
+	for ; height <= header.Height; height++ {
+		blkID, err := s.getBlockIDAtHeight(height)
+		if err == database.ErrNotFound {
+			// The node state synced past this height
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		blk, err := s.getBlock(blkID)
+		if err != nil {
+			return err
+		}
+		h := blk.lightHeader(parentID)
+		if err := s.putLightHeader(h); err != nil {
+			return err
+		}
+		parentID = h.ID()
+	}
+	return nil
+}
+
+// skip moves [it] past its next [n] entries, so that the next call to Next
+// moves it to the entry after them, if any
+func skip(it database.Iterator, n uint64) {
+	for ; n > 0 && it.Next(); n-- {
+	}
+}
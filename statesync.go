@@ -0,0 +1,354 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/choices"
+	"github.com/ava-labs/avalanchego/snow/engine/common"
+	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+// errCodeBlockNotFound is the app error code sent to a peer that asks for a
+// block this node hasn't accepted
+const errCodeBlockNotFound = 1
+
+var (
+	errWrongCheckpointHeight = errors.New("checkpoint block isn't at the checkpoint's height")
+	errCheckpointSigned      = errors.New("chains with signed blocks can't sync to a checkpoint")
+	errCheckpointMedianTime  = errors.New("chains with a median time past window can't sync to a checkpoint")
+	errCheckpointDuplicates  = errors.New("chains that reject duplicate data can't sync to a checkpoint")
+	errCheckpointIndexes     = errors.New("chains with key-value, document or namespace state can't sync to a checkpoint")
+
+	_ block.StateSyncableVM = &VM{}
+	_ block.StateSummary    = &summary{}
+)
+
+// summary is a state summary of the chain: the ID of the accepted block at a
+// height. Nodes that accepted the same block at a height have the same
+// summary for that height, so validators can vote on a checkpoint.
+type summary struct {
+	Hght  uint64 `serialize:"true"`
+	BlkID ids.ID `serialize:"true"`
+
+	id    ids.ID
+	bytes []byte
+	vm    *VM
+}
+
+// newSummary returns the summary of the block [blkID] at [height]
+func (vm *VM) newSummary(height uint64, blkID ids.ID) (*summary, error) {
+	s := &summary{
+		Hght:  height,
+		BlkID: blkID,
+	}
+	bytes, err := vm.codec.Marshal(codecVersion, s)
+	if err != nil {
+		return nil, err
+	}
+	s.initialize(bytes, vm)
+	return s, nil
+}
+
+func (s *summary) initialize(bytes []byte, vm *VM) {
+	s.bytes = bytes
+	s.id = hashing.ComputeHash256Array(bytes)
+	s.vm = vm
+}
+
+// ID returns the ID of this summary
+func (s *summary) ID() ids.ID { return s.id }
+
+// Height returns the height of the block this summary is of
+func (s *summary) Height() uint64 { return s.Hght }
+
+// Bytes returns the binary representation of this summary
+func (s *summary) Bytes() []byte { return s.bytes }
+
+// Accept starts fetching the checkpoint block if this is the summary of the
+// configured checkpoint. Any other summary is skipped, in which case the
+// node bootstraps from its last accepted block as usual.
+func (s *summary) Accept(ctx context.Context) (block.StateSyncMode, error) {
+	syncer := s.vm.syncer
+	if syncer == nil || s.Hght != syncer.checkpoint.Height || s.BlkID != syncer.checkpoint.BlockID {
+		s.vm.ctx.Log.Info("skipping state summary that isn't the checkpoint",
+			zap.Stringer("summaryID", s.id),
+			zap.Uint64("height", s.Hght),
+		)
+		return block.StateSyncSkipped, nil
+	}
+	if err := syncer.start(ctx); err != nil {
+		return block.StateSyncSkipped, err
+	}
+	return block.StateSyncStatic, nil
+}
+
+// initializeSyncer creates the checkpoint syncer if the config has a
+// checkpoint above the last accepted block [lastAcceptedID]
+func (vm *VM) initializeSyncer(lastAcceptedID ids.ID) error {
+	checkpoint := vm.config.Load().Checkpoint
+	if checkpoint == nil {
+		return nil
+	}
+	// Blocks before the checkpoint are never fetched, so the chain's rules
+	// must not depend on them
+	rules := allPayloadRules(&vm.genesis.Params, &vm.upgrades)
+	switch params := &vm.genesis.Params; {
+	case params.signsBlocks():
+		// The allowed signers and balances at the checkpoint depend on every
+		// block before it
+		return errCheckpointSigned
+	case params.MedianTimePastWindow > 0:
+		// The median time past of the blocks after the checkpoint depends on
+		// the blocks before it
+		return errCheckpointMedianTime
+	case vm.upgrades.DuplicateRejection != nil:
+		return errCheckpointDuplicates
+	case params.Namespaces || hasPayloadRule(rules, KeyValuePayloadRule) || hasPayloadRule(rules, DocumentPayloadRule):
+		// Namespace quotas and the key-value and document state are built
+		// from every block's data
+		return errCheckpointIndexes
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return err
+	}
+	if lastAccepted.Height() >= checkpoint.Height {
+		return nil
+	}
+	vm.syncer = &checkpointSyncer{
+		vm:         vm,
+		checkpoint: *checkpoint,
+		peers:      set.Set[ids.NodeID]{},
+		asked:      set.Set[ids.NodeID]{},
+	}
+	return nil
+}
+
+// StateSyncEnabled returns true iff this node should state sync to the
+// configured checkpoint
+func (vm *VM) StateSyncEnabled(context.Context) (bool, error) {
+	return vm.syncer != nil, nil
+}
+
+// GetOngoingSyncStateSummary returns the summary of the configured
+// checkpoint so that validators vote on it.
+// Returns database.ErrNotFound if there is no checkpoint to sync to.
+func (vm *VM) GetOngoingSyncStateSummary(context.Context) (block.StateSummary, error) {
+	if vm.syncer == nil {
+		return nil, database.ErrNotFound
+	}
+	return vm.newSummary(vm.syncer.checkpoint.Height, vm.syncer.checkpoint.BlockID)
+}
+
+// GetLastStateSummary returns the summary of the last accepted block
+func (vm *VM) GetLastStateSummary(ctx context.Context) (block.StateSummary, error) {
+	lastAcceptedID, err := vm.LastAccepted(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		return nil, err
+	}
+	return vm.newSummary(lastAccepted.Height(), lastAcceptedID)
+}
+
+// ParseStateSummary parses [summaryBytes] to a summary
+func (vm *VM) ParseStateSummary(_ context.Context, summaryBytes []byte) (block.StateSummary, error) {
+	s := &summary{}
+	if _, err := vm.codec.Unmarshal(summaryBytes, s); err != nil {
+		return nil, err
+	}
+	s.initialize(summaryBytes, vm)
+	return s, nil
+}
+
+// GetStateSummary returns the summary of the accepted block at [height].
+// Returns database.ErrNotFound if no block has been accepted at [height].
+func (vm *VM) GetStateSummary(_ context.Context, height uint64) (block.StateSummary, error) {
+	blkID, err := vm.state.getBlockIDAtHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	return vm.newSummary(height, blkID)
+}
+
+// AppRequest responds to a peer's request, which is the ID of an accepted
+// block, with that block's bytes
+func (vm *VM) AppRequest(ctx context.Context, nodeID ids.NodeID, requestID uint32, _ time.Time, request []byte) error {
+	blkID, err := ids.ToID(request)
+	if err != nil {
+		vm.ctx.Log.Debug("dropping malformed block request",
+			zap.Stringer("nodeID", nodeID),
+			zap.Error(err),
+		)
+		return nil
+	}
+	// Only accepted blocks are served, so processing blocks, which are owned by
+	// the engine's goroutine, aren't looked at
+	blk, err := vm.state.getBlock(blkID)
+	if err != nil || blk.Status() != choices.Accepted {
+		return vm.appSender.SendAppError(ctx, nodeID, requestID, errCodeBlockNotFound, "block not found")
+	}
+	return vm.appSender.SendAppResponse(ctx, nodeID, requestID, blk.Bytes())
+}
+
+// AppResponse handles a peer's response to a request for the checkpoint block
+func (vm *VM) AppResponse(ctx context.Context, nodeID ids.NodeID, requestID uint32, response []byte) error {
+	if vm.syncer == nil {
+		return nil
+	}
+	return vm.syncer.onResponse(ctx, nodeID, requestID, response)
+}
+
+// AppRequestFailed asks another peer for the checkpoint block
+func (vm *VM) AppRequestFailed(ctx context.Context, _ ids.NodeID, requestID uint32, _ *common.AppError) error {
+	if vm.syncer == nil {
+		return nil
+	}
+	return vm.syncer.onFailure(ctx, requestID)
+}
+
+// checkpointSyncer fetches the checkpoint block from connected peers, one
+// peer at a time, and accepts it once it arrives
+type checkpointSyncer struct {
+	vm         *VM
+	checkpoint Checkpoint
+
+	lock sync.Mutex
+	// Connected peers
+	peers set.Set[ids.NodeID]
+	// Peers asked for the checkpoint block since every peer was last asked
+	asked set.Set[ids.NodeID]
+	// True iff the checkpoint summary was accepted and the block hasn't
+	// arrived yet
+	syncing bool
+	// True iff a request for the checkpoint block is outstanding
+	requesting bool
+	requestID  uint32
+}
+
+// start begins fetching the checkpoint block
+func (s *checkpointSyncer) start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.vm.ctx.Log.Info("state syncing to checkpoint",
+		zap.Uint64("height", s.checkpoint.Height),
+		zap.Stringer("blkID", s.checkpoint.BlockID),
+	)
+	s.syncing = true
+	return s.request(ctx)
+}
+
+// connected adds [nodeID] to the peers that may be asked for the
+// checkpoint block
+func (s *checkpointSyncer) connected(ctx context.Context, nodeID ids.NodeID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.peers.Add(nodeID)
+	if !s.syncing || s.requesting {
+		return nil
+	}
+	return s.request(ctx)
+}
+
+// disconnected removes [nodeID] from the peers that may be asked for the
+// checkpoint block
+func (s *checkpointSyncer) disconnected(nodeID ids.NodeID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.peers.Remove(nodeID)
+}
+
+// onResponse accepts the checkpoint block if [response] is its bytes.
+// Otherwise another peer is asked for it.
+func (s *checkpointSyncer) onResponse(ctx context.Context, nodeID ids.NodeID, requestID uint32, response []byte) error {
+	s.vm.ctx.Lock.Lock()
+	defer s.vm.ctx.Lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.requesting || requestID != s.requestID {
+		return nil
+	}
+	s.requesting = false
+
+	if hashing.ComputeHash256Array(response) != s.checkpoint.BlockID {
+		s.vm.ctx.Log.Debug("peer sent the wrong checkpoint block",
+			zap.Stringer("nodeID", nodeID),
+		)
+		return s.request(ctx)
+	}
+	blk, err := s.vm.parseBlock(response)
+	if err != nil {
+		return err
+	}
+	if blk.Height() != s.checkpoint.Height {
+		return errWrongCheckpointHeight
+	}
+
+	// The checkpoint block becomes the last accepted block. Blocks between
+	// the previous last accepted block and the checkpoint are never fetched.
+	if err := blk.Accept(ctx); err != nil {
+		return err
+	}
+	s.vm.preferred = blk.ID()
+	s.syncing = false
+	s.vm.ctx.Log.Info("finished state syncing to checkpoint",
+		zap.Uint64("height", blk.Height()),
+		zap.Stringer("blkID", blk.ID()),
+	)
+	s.vm.builder.markStateSyncDone()
+	return nil
+}
+
+// onFailure asks another peer for the checkpoint block
+func (s *checkpointSyncer) onFailure(ctx context.Context, requestID uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.requesting || requestID != s.requestID {
+		return nil
+	}
+	s.requesting = false
+	return s.request(ctx)
+}
+
+// request asks a peer that hasn't been asked since every peer was last asked
+// for the checkpoint block. If there are no peers, the next peer to connect
+// is asked.
+// Assumes [s.lock] is held.
+func (s *checkpointSyncer) request(ctx context.Context) error {
+	if s.peers.Len() == 0 {
+		s.vm.ctx.Log.Debug("waiting for a peer to fetch the checkpoint block from")
+		return nil
+	}
+
+	candidates := set.Of(s.peers.List()...)
+	candidates.Difference(s.asked)
+	if candidates.Len() == 0 {
+		s.asked.Clear()
+		candidates = set.Of(s.peers.List()...)
+	}
+	nodeID, _ := candidates.Peek()
+
+	s.asked.Add(nodeID)
+	s.requestID++
+	s.requesting = true
+	return s.vm.appSender.SendAppRequest(ctx, set.Of(nodeID), s.requestID, s.checkpoint.BlockID[:])
+}
@@ -0,0 +1,152 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+//go:build e2e
+
+// Package e2e runs chains using the timestamp VM on a local avalanchego
+// network. The tests need an avalanchego binary and a plugin dir with the
+// VM's plugin binary in it, named by the VM's ID:
+//
+//	go build -o $PLUGIN_DIR/tGas3T58KzdjLHhBDMnH2TvrddhqTji5iZAMZ3RXs2NLpSnhH ./cmd/timestampvm
+//	AVALANCHEGO_PATH=... AVALANCHEGO_PLUGIN_DIR=$PLUGIN_DIR go test -tags e2e ./tests/e2e
+package e2e
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/tests/fixture/tmpnet"
+	"github.com/ava-labs/avalanchego/utils/cb58"
+	"github.com/ava-labs/avalanchego/utils/logging"
+
+	timestampvm "github.com/hitrich/AVM-TEST"
+	"github.com/hitrich/AVM-TEST/genesis"
+)
+
+const (
+	numNodes = 3
+	// How long a proposal has to be accepted on every node
+	acceptTimeout = 2 * time.Minute
+)
+
+// newNetwork starts a local network whose nodes all validate a chain using
+// the timestamp VM, and returns the network and the chain's ID. The network
+// is stopped when the test finishes.
+func newNetwork(t *testing.T) (*tmpnet.Network, ids.ID) {
+	avalancheGoPath := os.Getenv("AVALANCHEGO_PATH")
+	pluginDir := os.Getenv("AVALANCHEGO_PLUGIN_DIR")
+	if avalancheGoPath == "" || pluginDir == "" {
+		t.Fatal("AVALANCHEGO_PATH and AVALANCHEGO_PLUGIN_DIR must be set")
+	}
+	genesisBytes, err := genesis.Build(timestampvm.ChainParams{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	network := tmpnet.NewDefaultNetwork("timestampvm-e2e")
+	network.Nodes = tmpnet.NewNodesOrPanic(numNodes)
+	network.DefaultRuntimeConfig = tmpnet.NodeRuntimeConfig{
+		Process: &tmpnet.ProcessRuntimeConfig{
+			AvalancheGoPath: avalancheGoPath,
+			PluginDir:       pluginDir,
+		},
+	}
+	validatorIDs := make([]ids.NodeID, len(network.Nodes))
+	for i, node := range network.Nodes {
+		validatorIDs[i] = node.NodeID
+	}
+	network.Subnets = []*tmpnet.Subnet{{
+		Name: "timestamp",
+		Chains: []*tmpnet.Chain{{
+			VMID:    timestampvm.ID,
+			Genesis: genesisBytes,
+			Config:  `{"buildBatchWindow": "0s"}`,
+		}},
+		ValidatorIDs: validatorIDs,
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	log := logging.NoLog{}
+	if err := tmpnet.BootstrapNewNetwork(ctx, log, network, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := network.Stop(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return network, network.Subnets[0].Chains[0].ChainID
+}
+
+// Assert that data proposed to one node is accepted by every node, and that
+// every node agrees on the accepted chain
+func TestProposeAccept(t *testing.T) {
+	network, chainID := newNetwork(t)
+	clients := make([]*timestampvm.Client, len(network.Nodes))
+	for i, node := range network.Nodes {
+		clients[i] = timestampvm.NewClient(node.URI, chainID.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acceptTimeout)
+	defer cancel()
+	data := []byte("timestampvm e2e")
+	if err := clients[0].ProposeBlock(ctx, data); err != nil {
+		t.Fatal(err)
+	}
+	var padded [32]byte
+	copy(padded[:], data)
+	encoded, err := cb58.Encode(padded[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var acceptedID string
+	for i, client := range clients {
+		blk := waitForData(ctx, t, client, encoded)
+		if blk.Status != "Accepted" {
+			t.Fatalf("node %d: expected the block to be accepted but it's %s", i, blk.Status)
+		}
+		if i == 0 {
+			acceptedID = blk.ID
+		} else if blk.ID != acceptedID {
+			t.Fatalf("node %d accepted block %s but node 0 accepted %s", i, blk.ID, acceptedID)
+		}
+
+		byHeight, err := client.GetBlockByHeight(ctx, uint64(blk.Height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byHeight.ID != blk.ID {
+			t.Fatalf("node %d: expected block %s at height %d but got %s", i, blk.ID, blk.Height, byHeight.ID)
+		}
+	}
+}
+
+// waitForData polls [client] until an accepted block contains [encoded] and
+// returns that block
+func waitForData(ctx context.Context, t *testing.T, client *timestampvm.Client, encoded string) *timestampvm.APIBlock {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var height uint64 = 1
+	for {
+		blk, err := client.GetBlockByHeight(ctx, height)
+		if err == nil {
+			if slices.Contains(blk.Data, encoded) {
+				return blk
+			}
+			height++
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("data wasn't accepted: %v", err)
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/timer/mockable"
+)
+
+// maxMedianTimeWindow is the maximum number of ancestors whose median
+// timestamp a block's timestamp is checked against
+const maxMedianTimeWindow = 64
+
+var errTimestampNotAfterMedian = fmt.Errorf("%w: block's timestamp isn't after the median timestamp of its recent ancestors", ErrInvalidTimestamp)
+
+// verifyTimestamp returns nil iff a block with Unix time [timestamp] may be
+// the child of a block with Unix time [parentTimestamp] on a chain with
+// parameters [p], at local time [now]. It must be that:
+// parentTimestamp <= timestamp <= now + [p.MaxClockSkew]
+// where the first comparison is strict if [p] requires strictly increasing
+// timestamps, and [timestamp] must be at least [p.MinBlockInterval] after
+// [parentTimestamp].
+// [parentTimestamp] must not be negative, which holds for every verified
+// block.
+func (p *ChainParams) verifyTimestamp(parentTimestamp, timestamp int64, now time.Time) error {
+	switch {
+	case p.StrictlyIncreasingTimestamps && timestamp <= parentTimestamp:
+		return errTimestampNotAfter
+	case timestamp < parentTimestamp:
+		return errTimestampTooEarly
+	// [timestamp] >= [parentTimestamp] >= 0, so the difference can't overflow
+	case timestamp-parentTimestamp < p.minBlockIntervalSeconds():
+		return errBlockTooSoon
+	case timestamp > now.Add(p.MaxClockSkew.Duration).Unix():
+		return errTimestampTooLate
+	default:
+		return nil
+	}
+}
+
+// minBlockIntervalSeconds returns the min block interval rounded up to whole
+// seconds, which is the precision of block timestamps
+func (p *ChainParams) minBlockIntervalSeconds() int64 {
+	return int64((p.MinBlockInterval.Duration + time.Second - 1) / time.Second)
+}
+
+// Clock returns the clock this vm reads local time from when it builds and
+// verifies blocks. Setting it lets tests and simulated networks run on
+// virtual time. It may only be set before Initialize or while holding the
+// context's lock.
+func (vm *VM) Clock() *mockable.Clock {
+	return vm.clock
+}
+
+// verifyBlockTimestamp returns nil iff a block with Unix time [timestamp]
+// and parameters [params] may be the child of [parent] at local time. If the
+// chain has a median time past window, [timestamp] must also be after the
+// median time past of [parent].
+func (vm *VM) verifyBlockTimestamp(parent *Block, params *ChainParams, timestamp int64) error {
+	median, ok, err := vm.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if ok && timestamp <= median {
+		return errTimestampNotAfterMedian
+	}
+	return params.verifyTimestamp(parent.Tmstmp, timestamp, vm.clock.Time())
+}
+
+// buildTimestamp returns the timestamp of a block with parameters [params]
+// built on [parent] at local time [now]. The parent's timestamp may be ahead
+// of local time by up to the max clock skew, so the block is never
+// timestamped before its parent. On chains with a median time past window,
+// the timestamp is also kept after the median time past of [parent].
+func (vm *VM) buildTimestamp(parent *Block, params *ChainParams, now time.Time) (time.Time, error) {
+	timestamp := now.Unix()
+	minTimestamp := parent.Tmstmp
+	if params.StrictlyIncreasingTimestamps {
+		minTimestamp++
+	}
+	median, ok, err := vm.medianTimePast(parent)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ok {
+		minTimestamp = max(minTimestamp, median+1)
+	}
+	return time.Unix(max(timestamp, minTimestamp), 0), nil
+}
+
+// medianTimePast returns the median timestamp of [parent] and its most
+// recent ancestors, up to the chain's median time past window of them,
+// excluding the genesis block.
+// Returns false if the chain has no median time past window or [parent] is
+// the genesis block.
+func (vm *VM) medianTimePast(parent *Block) (int64, bool, error) {
+	window := vm.genesis.Params.MedianTimePastWindow
+	timestamps := make([]int64, 0, window)
+	for blk := parent; len(timestamps) < window && blk.Height() > 0; {
+		timestamps = append(timestamps, blk.Tmstmp)
+		if len(timestamps) == window {
+			break
+		}
+		var err error
+		if blk, err = vm.getBlock(blk.Parent()); err != nil {
+			return 0, false, errDatabaseGet
+		}
+	}
+	if len(timestamps) == 0 {
+		return 0, false, nil
+	}
+	return median(timestamps), true, nil
+}
+
+// median returns the median of [timestamps], which must not be empty. If
+// there is an even number of timestamps, the greater of the middle two is
+// returned. [timestamps] is sorted.
+func median(timestamps []int64) int64 {
+	slices.Sort(timestamps)
+	return timestamps[len(timestamps)/2]
+}
@@ -0,0 +1,116 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestVerifyTimestamp(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	tests := []struct {
+		name            string
+		params          ChainParams
+		parentTimestamp int64
+		timestamp       int64
+		expectedErr     error
+	}{
+		{
+			name:            "same as parent",
+			parentTimestamp: 100,
+			timestamp:       100,
+		},
+		{
+			name:            "before parent",
+			parentTimestamp: 100,
+			timestamp:       99,
+			expectedErr:     errTimestampTooEarly,
+		},
+		{
+			name:            "same as parent with strictly increasing timestamps",
+			params:          ChainParams{StrictlyIncreasingTimestamps: true},
+			parentTimestamp: 100,
+			timestamp:       100,
+			expectedErr:     errTimestampNotAfter,
+		},
+		{
+			name:            "after parent with strictly increasing timestamps",
+			params:          ChainParams{StrictlyIncreasingTimestamps: true},
+			parentTimestamp: 100,
+			timestamp:       101,
+		},
+		{
+			name:            "min block interval after parent",
+			params:          ChainParams{MinBlockInterval: Duration{Duration: 10 * time.Second}},
+			parentTimestamp: 100,
+			timestamp:       110,
+		},
+		{
+			name:            "just under min block interval after parent",
+			params:          ChainParams{MinBlockInterval: Duration{Duration: 10 * time.Second}},
+			parentTimestamp: 100,
+			timestamp:       109,
+			expectedErr:     errBlockTooSoon,
+		},
+		{
+			name:            "fractional min block interval rounds up",
+			params:          ChainParams{MinBlockInterval: Duration{Duration: 1500 * time.Millisecond}},
+			parentTimestamp: 100,
+			timestamp:       101,
+			expectedErr:     errBlockTooSoon,
+		},
+		{
+			name:            "max clock skew ahead of local time",
+			params:          ChainParams{MaxClockSkew: Duration{Duration: time.Minute}},
+			parentTimestamp: 100,
+			timestamp:       now.Unix() + 60,
+		},
+		{
+			name:            "past max clock skew ahead of local time",
+			params:          ChainParams{MaxClockSkew: Duration{Duration: time.Minute}},
+			parentTimestamp: 100,
+			timestamp:       now.Unix() + 61,
+			expectedErr:     errTimestampTooLate,
+		},
+		{
+			name:            "max timestamp",
+			params:          ChainParams{MinBlockInterval: Duration{Duration: time.Second}},
+			parentTimestamp: 0,
+			timestamp:       math.MaxInt64,
+			expectedErr:     errTimestampTooLate,
+		},
+		{
+			name:            "min timestamp",
+			parentTimestamp: 0,
+			timestamp:       math.MinInt64,
+			expectedErr:     errTimestampTooEarly,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.params.verifyTimestamp(test.parentTimestamp, test.timestamp, now); err != test.expectedErr {
+				t.Fatalf("expected error %v but got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		timestamps []int64
+		expected   int64
+	}{
+		{timestamps: []int64{5}, expected: 5},
+		{timestamps: []int64{3, 1, 2}, expected: 2},
+		{timestamps: []int64{4, 1, 3, 2}, expected: 3},
+		{timestamps: []int64{7, 7, 1}, expected: 7},
+	}
+	for _, test := range tests {
+		if got := median(test.timestamps); got != test.expected {
+			t.Fatalf("expected median %d but got %d", test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/rpc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/trace"
+	"github.com/ava-labs/avalanchego/utils/logging"
+
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the app name spans are reported under if the tracing config
+// doesn't set one
+const tracerName = "timestampvm"
+
+// newTracer returns the tracer configured by [config]. If [config] is nil,
+// spans aren't recorded.
+func newTracer(config *trace.Config) (trace.Tracer, error) {
+	if config == nil {
+		return trace.Noop, nil
+	}
+	c := *config
+	if c.AppName == "" {
+		c.AppName = tracerName
+	}
+	if c.Version == "" {
+		c.Version = Version
+	}
+	return trace.New(c)
+}
+
+// startBlockSpan starts a span named [name] that has [b]'s ID, parent ID,
+// height and number of pieces of data as attributes
+func (vm *VM) startBlockSpan(ctx context.Context, name string, b *Block) (context.Context, oteltrace.Span) {
+	return vm.tracer.Start(ctx, name, oteltrace.WithAttributes(
+		attribute.Stringer("blkID", b.ID()),
+		attribute.Stringer("parentID", b.Parent()),
+		attribute.Int64("height", int64(b.Height())),
+		attribute.Int("numData", len(b.Dt)),
+	))
+}
+
+// endSpan marks [span] as failed if [err] is non-nil and ends it
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+type callStartKey struct{}
+
+// traceRequests makes [server] record a span, named after the called method,
+// around each API request. The span is in the request's context. Each call is
+// logged to [log] at debug level, with its request ID, duration and outcome;
+// failed calls aren't logged higher since the caller is told why.
+func traceRequests(server *rpc.Server, tracer trace.Tracer, log logging.Logger) {
+	server.RegisterInterceptFunc(func(i *rpc.RequestInfo) *http.Request {
+		ctx, _ := tracer.Start(i.Request.Context(), i.Method, oteltrace.WithAttributes(
+			attribute.String("requestID", requestID(i.Request.Context())),
+		))
+		ctx = context.WithValue(ctx, callStartKey{}, time.Now())
+		return i.Request.WithContext(ctx)
+	})
+	server.RegisterAfterFunc(func(i *rpc.RequestInfo) {
+		ctx := i.Request.Context()
+		endSpan(oteltrace.SpanFromContext(ctx), i.Error)
+
+		fields := []zap.Field{
+			zap.String("requestID", requestID(ctx)),
+			zap.String("method", i.Method),
+		}
+		if start, ok := ctx.Value(callStartKey{}).(time.Time); ok {
+			fields = append(fields, zap.Duration("duration", time.Since(start)))
+		}
+		if i.Error != nil {
+			log.Debug("API call failed", append(fields, zap.Error(i.Error))...)
+			return
+		}
+		log.Debug("API call succeeded", fields...)
+	})
+}
@@ -0,0 +1,434 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/math"
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// transferCodecVersion is the codec version of blocks on chains with
+	// transfers, claims or namespace ACLs. It also serializes the fields
+	// tagged with [signedTagName] and [transferTagName].
+	transferCodecVersion = 2
+	transferTagName      = "transfer"
+)
+
+var (
+	errTransfersDisabled = errors.New("chain doesn't have transfers")
+	errTooManyTransfers  = errors.New("block has too many transfers")
+	errZeroTransfer      = errors.New("transfer amount must be positive")
+	errBadTransferNonce  = errors.New("transfer has the wrong nonce")
+	errTransferBalance   = errors.New("transfer's sender can't pay the amount")
+)
+
+// Transfer moves [Amount] from the balance of the address that signed it to
+// [To]. Each address's transfers are applied in the order of their nonces,
+// starting at 0, so a transfer can't be replayed. Transfers pay no fee.
+type Transfer struct {
+	Nonce  uint64      `serialize:"true"`
+	To     ids.ShortID `serialize:"true"`
+	Amount uint64      `serialize:"true"`
+	// Sender's signature of the transfer's hash on this chain
+	Sig [secp256k1.SignatureLen]byte `serialize:"true"`
+
+	senderAddr  ids.ShortID // address of this transfer's sender, if [senderKnown]
+	senderKnown bool
+}
+
+// Hash returns the hash of [t] on the chain [chainID], which is what the
+// sender signs
+func (t *Transfer) Hash(chainID ids.ID) []byte {
+	msg := make([]byte, 0, ids.IDLen+1+8+ids.ShortIDLen+8)
+	msg = append(msg, chainID[:]...)
+	msg = append(msg, transferTag)
+	msg = binary.BigEndian.AppendUint64(msg, t.Nonce)
+	msg = append(msg, t.To[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, t.Amount)
+	return hashing.ComputeHash256(msg)
+}
+
+// Sign sets [t]'s signature to [key]'s signature of [t] on the chain
+// [chainID]. [key]'s address is the sender.
+func (t *Transfer) Sign(chainID ids.ID, key *secp256k1.PrivateKey) error {
+	sig, err := key.SignHash(t.Hash(chainID))
+	if err != nil {
+		return err
+	}
+	copy(t.Sig[:], sig)
+	t.senderKnown = false
+	return nil
+}
+
+// sender returns the address that signed [t] on the chain [chainID]
+func (t *Transfer) sender(chainID ids.ID) (ids.ShortID, error) {
+	if t.senderKnown {
+		return t.senderAddr, nil
+	}
+	key, err := secp256k1.RecoverPublicKeyFromHash(t.Hash(chainID), t.Sig[:])
+	if err != nil {
+		return ids.ShortID{}, err
+	}
+	t.senderAddr = key.Address()
+	t.senderKnown = true
+	return t.senderAddr, nil
+}
+
+// blockCodecVersion returns the codec version of the signed blocks of a chain
+// with parameters [p]
+func (p *ChainParams) blockCodecVersion() uint16 {
+	transfers := p.Transfers || p.Claims || p.hasACLs() || p.Reveals || p.Encryption || p.hasFeeds() || p.hasWarp() || p.Governance || p.hasMultisigs() || p.Accounts
+	switch {
+	case transfers && p.namespaced():
+		return namespacedTransferCodecVersion
+	case transfers:
+		return transferCodecVersion
+	case p.namespaced():
+		return namespacedSignedCodecVersion
+	default:
+		return signedCodecVersion
+	}
+}
+
+// unsignedCodecVersion returns the codec version of the unsigned blocks of a
+// chain with parameters [p], which are the blocks of chains that don't sign
+// them and the genesis block
+func (p *ChainParams) unsignedCodecVersion() uint16 {
+	if p.namespaced() {
+		return namespacedCodecVersion
+	}
+	return codecVersion
+}
+
+// account is the balance and next transfer nonce of an address
+type account struct {
+	balance uint64
+	nonce   uint64
+}
+
+// apply applies [blk]'s fee and transfers to [a], the account of [addr].
+// The fee is charged before the transfers.
+func (a *account) apply(vm *VM, blk *Block, addr ids.ShortID) error {
+	params, err := blk.activeParams()
+	if err != nil {
+		return err
+	}
+	fee, err := blk.feeOf(params, addr)
+	if err != nil {
+		return err
+	}
+	if a.balance < fee {
+		return errInsufficientBalance
+	}
+	a.balance -= fee
+	for i := range blk.Transfers {
+		t := &blk.Transfers[i]
+		sender, err := t.sender(vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		if sender == addr {
+			switch {
+			case t.Nonce != a.nonce:
+				return errBadTransferNonce
+			case a.balance < t.Amount:
+				return errTransferBalance
+			}
+			a.balance -= t.Amount
+			a.nonce++
+		}
+		if t.To == addr {
+			if a.balance, err = math.Add(a.balance, t.Amount); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// accountAfter returns the account of [addr] after [blk] is accepted
+func (vm *VM) accountAfter(blk *Block, addr ids.ShortID) (account, error) {
+	// Processing ancestors' fees and transfers aren't persisted yet
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return account{}, err
+	}
+
+	balance, err := vm.state.getBalance(addr)
+	if err != nil {
+		return account{}, err
+	}
+	nonce, err := vm.state.getNonce(addr)
+	if err != nil {
+		return account{}, err
+	}
+	a := account{balance: balance, nonce: nonce}
+	for i := len(processing) - 1; i >= 0; i-- {
+		if err := a.apply(vm, processing[i], addr); err != nil {
+			return account{}, err
+		}
+	}
+	return a, nil
+}
+
+// verifyTransfers returns nil iff [b]'s transfers can be applied after
+// [parent] is accepted and [b]'s fee is charged
+func (b *Block) verifyTransfers(parent *Block) error {
+	switch {
+	case len(b.Transfers) == 0:
+		return nil
+	case !b.vm.genesis.Params.Transfers:
+		return errTransfersDisabled
+	case len(b.Transfers) > maxBatchSize:
+		return errTooManyTransfers
+	}
+	addrs := set.NewSet[ids.ShortID](2 * len(b.Transfers))
+	for i := range b.Transfers {
+		t := &b.Transfers[i]
+		if t.Amount == 0 {
+			return errZeroTransfer
+		}
+		sender, err := t.sender(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		addrs.Add(sender, t.To)
+	}
+	// An address's account only depends on the fees and transfers that
+	// involve it, so each account is checked on its own
+	for addr := range addrs {
+		a, err := b.vm.accountAfter(parent, addr)
+		if err != nil {
+			return err
+		}
+		if err := a.apply(b.vm, b, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTransfers moves the amount of each of [b]'s transfers from its sender
+// to its recipient. Must be called after [b]'s fee is charged.
+func (b *Block) applyTransfers() error {
+	for i := range b.Transfers {
+		t := &b.Transfers[i]
+		sender, err := t.sender(b.vm.ctx.ChainID)
+		if err != nil {
+			return err
+		}
+		balance, err := b.vm.state.getBalance(sender)
+		if err != nil {
+			return err
+		}
+		if balance < t.Amount {
+			return errTransferBalance
+		}
+		if err := b.vm.state.putBalance(sender, balance-t.Amount); err != nil {
+			return err
+		}
+		if err := b.vm.state.putNonce(sender, t.Nonce+1); err != nil {
+			return err
+		}
+		if balance, err = b.vm.state.getBalance(t.To); err != nil {
+			return err
+		}
+		if balance, err = math.Add(balance, t.Amount); err != nil {
+			return err
+		}
+		if err := b.vm.state.putBalance(t.To, balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingTransfers holds transfers submitted over the API until they are
+// accepted
+type pendingTransfers struct {
+	lock      sync.Mutex
+	transfers []Transfer
+}
+
+// add adds [t] to the pending transfers
+func (p *pendingTransfers) add(t Transfer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.transfers = append(p.transfers, t)
+}
+
+// next returns the pending transfers that can be applied in a child of
+// [parent] signed by [signer] that pays [fee] for its data
+func (p *pendingTransfers) next(vm *VM, parent *Block, signer ids.ShortID, fee uint64) []Transfer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.transfers) == 0 {
+		return nil
+	}
+	accounts := make(map[ids.ShortID]*account)
+	getAccount := func(addr ids.ShortID) (*account, error) {
+		if a, ok := accounts[addr]; ok {
+			return a, nil
+		}
+		a, err := vm.accountAfter(parent, addr)
+		if err != nil {
+			return nil, err
+		}
+		if addr == signer {
+			if a.balance < fee {
+				return nil, errInsufficientBalance
+			}
+			a.balance -= fee
+		}
+		accounts[addr] = &a
+		return &a, nil
+	}
+
+	var next []Transfer
+	included := make([]bool, len(p.transfers))
+	for found := true; found && len(next) < maxBatchSize; {
+		found = false
+		for i := range p.transfers {
+			t := &p.transfers[i]
+			if included[i] {
+				continue
+			}
+			sender, err := t.sender(vm.ctx.ChainID)
+			if err != nil {
+				continue
+			}
+			from, err := getAccount(sender)
+			if err != nil || t.Nonce != from.nonce || from.balance < t.Amount {
+				continue
+			}
+			to, err := getAccount(t.To)
+			if err != nil {
+				continue
+			}
+			// [from] and [to] are the same account for a transfer to self, so
+			// the amount is taken before it's added
+			from.balance -= t.Amount
+			balance, err := math.Add(to.balance, t.Amount)
+			if err != nil {
+				from.balance += t.Amount
+				continue
+			}
+			to.balance = balance
+			from.nonce++
+			included[i] = true
+			next = append(next, *t)
+			found = true
+			if len(next) == maxBatchSize {
+				break
+			}
+		}
+	}
+	return next
+}
+
+// prune drops the pending transfers that can no longer be accepted because
+// their nonces were used
+func (p *pendingTransfers) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.transfers, err = pruneOps(vm.opJournal, transferKind, p.transfers, func(t *Transfer) bool {
+		sender, err := t.sender(vm.ctx.ChainID)
+		if err != nil {
+			return false
+		}
+		nonce, err := vm.state.getNonce(sender)
+		return err == nil && t.Nonce >= nonce
+	})
+	return err
+}
+
+// len returns the number of pending transfers
+func (p *pendingTransfers) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.transfers)
+}
+
+// TransferArgs are the arguments to Transfer
+type TransferArgs struct {
+	// Position of the transfer among the sender's transfers
+	Nonce  json.Uint64 `json:"nonce"`
+	To     ids.ShortID `json:"to"`
+	Amount json.Uint64 `json:"amount"`
+	// Base 58 repr. of the sender's signature of the transfer
+	Signature string `json:"signature"`
+
+	sig [secp256k1.SignatureLen]byte
+}
+
+func (a *TransferArgs) validate(v *argValidator) {
+	v.check("amount", a.Amount != 0, errZeroTransfer)
+	a.sig = v.signature("signature", a.Signature)
+}
+
+// TransferReply is the reply from Transfer
+type TransferReply struct {
+	// Address that signed the transfer
+	Sender ids.ShortID `json:"sender"`
+}
+
+// Transfer is an API method to propose a signed transfer. The transfer is
+// included in a block built by this node once it is the sender's next
+// transfer and the sender can pay it.
+func (s *Service) Transfer(_ *http.Request, args *TransferArgs, reply *TransferReply) error {
+	if !s.backend.chainParams().Transfers {
+		return errTransfersDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	t := Transfer{
+		Nonce:  uint64(args.Nonce),
+		To:     args.To,
+		Amount: uint64(args.Amount),
+		Sig:    args.sig,
+	}
+	var err error
+	if reply.Sender, err = t.sender(s.backend.chainID()); err != nil {
+		return err
+	}
+	if err := s.backend.addTransfer(t); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetNonceArgs are the arguments to GetNonce
+type GetNonceArgs struct {
+	Address ids.ShortID `json:"address"`
+}
+
+// GetNonceReply is the reply from GetNonce
+type GetNonceReply struct {
+	// Nonce of the address's next transfer
+	Nonce json.Uint64 `json:"nonce"`
+}
+
+// GetNonce returns the nonce of [args.Address]'s next transfer after the last
+// accepted block
+func (s *Service) GetNonce(_ *http.Request, args *GetNonceArgs, reply *GetNonceReply) error {
+	nonce, err := s.backend.nonce(args.Address)
+	reply.Nonce = json.Uint64(nonce)
+	return err
+}
@@ -0,0 +1,33 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// uiEndpoint is the path extension of the chain's explorer page
+const uiEndpoint = "/ui"
+
+// uiPage lists the most recently accepted blocks and decodes their data,
+// calling the JSON-RPC API served at the chain's base path
+//
+//go:embed ui.html
+var uiPage []byte
+
+// explorerUI serves the explorer page
+type explorerUI struct{}
+
+func (explorerUI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The page only calls the API it's served with
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; connect-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	_, _ = w.Write(uiPage)
+}
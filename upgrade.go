@@ -0,0 +1,153 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ava-labs/avalanchego/utils/set"
+)
+
+const (
+	// DuplicateRejectionFeature makes blocks whose data is already in an
+	// ancestor invalid
+	DuplicateRejectionFeature Feature = "duplicateRejection"
+	// PayloadPolicyFeature adds the payload rules and validators of the
+	// payload policy upgrade to the chain's
+	PayloadPolicyFeature Feature = "payloadPolicy"
+)
+
+var (
+	errBadActivation   = errors.New("activation must specify exactly one of height or timestamp")
+	errUnknownFeature  = errors.New("unknown feature")
+	errFeatureHasField = errors.New("feature is activated by its own field of the upgrade config")
+
+	// features are the features that can be activated by an upgrade config.
+	// A new consensus rule is added here and checked with
+	// [UpgradeConfig.IsActive].
+	features = set.Of(
+		DuplicateRejectionFeature,
+		PayloadPolicyFeature,
+	)
+)
+
+// Feature names a consensus rule that was added after the chain was created
+// and is only active from its activation in the chain's upgrade config on
+type Feature string
+
+// Activation is the point at which a consensus rule becomes active.
+// Exactly one of [Height] or [Timestamp] (Unix seconds) must be set.
+type Activation struct {
+	Height    *uint64 `json:"height,omitempty"`
+	Timestamp *int64  `json:"timestamp,omitempty"`
+}
+
+// IsActive returns true iff a block at [height] with time [timestamp] is
+// subject to the rule activated by [a].
+// A nil Activation is never active.
+func (a *Activation) IsActive(height uint64, timestamp time.Time) bool {
+	switch {
+	case a == nil:
+		return false
+	case a.Height != nil:
+		return height >= *a.Height
+	default:
+		return timestamp.Unix() >= *a.Timestamp
+	}
+}
+
+// Verify returns nil iff [a] is nil or well formed
+func (a *Activation) Verify() error {
+	if a == nil {
+		return nil
+	}
+	if (a.Height == nil) == (a.Timestamp == nil) {
+		return errBadActivation
+	}
+	return nil
+}
+
+// UpgradeConfig schedules consensus rules that were added after the chain
+// was created. It is passed to Initialize as JSON in the upgradeBytes.
+// A rule that isn't scheduled is never active.
+type UpgradeConfig struct {
+	// Blocks whose data is already in an ancestor are invalid
+	DuplicateRejection *Activation `json:"duplicateRejection,omitempty"`
+	// Payload rules and validators that are added to the chain's
+	PayloadPolicy *PayloadPolicyUpgrade `json:"payloadPolicy,omitempty"`
+	// Feature --> Its activation, for the features without a field of their
+	// own
+	Features map[Feature]*Activation `json:"features,omitempty"`
+}
+
+// activation returns the activation of [feature], or nil if it isn't
+// scheduled
+func (u *UpgradeConfig) activation(feature Feature) *Activation {
+	switch feature {
+	case DuplicateRejectionFeature:
+		return u.DuplicateRejection
+	case PayloadPolicyFeature:
+		if u.PayloadPolicy == nil {
+			return nil
+		}
+		return &u.PayloadPolicy.Activation
+	default:
+		return u.Features[feature]
+	}
+}
+
+// IsActive returns true iff a block at [height] with time [timestamp] is
+// subject to [feature]
+func (u *UpgradeConfig) IsActive(feature Feature, height uint64, timestamp time.Time) bool {
+	return u.activation(feature).IsActive(height, timestamp)
+}
+
+// ParseUpgradeConfig parses [upgradeBytes].
+// Unknown fields are an error so that a misspelled rule isn't silently
+// left inactive on some nodes.
+func ParseUpgradeConfig(upgradeBytes []byte) (UpgradeConfig, error) {
+	config := UpgradeConfig{}
+	if len(bytes.TrimSpace(upgradeBytes)) == 0 {
+		return config, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(upgradeBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return UpgradeConfig{}, fmt.Errorf("couldn't parse upgrade config: %w", err)
+	}
+	return config, config.Verify()
+}
+
+// Verify returns nil iff every activation in [u] is well formed and is of a
+// known feature
+func (u *UpgradeConfig) Verify() error {
+	if err := u.DuplicateRejection.Verify(); err != nil {
+		return fmt.Errorf("duplicateRejection: %w", err)
+	}
+	if u.PayloadPolicy != nil {
+		if err := u.PayloadPolicy.Activation.Verify(); err != nil {
+			return fmt.Errorf("payloadPolicy: %w", err)
+		}
+		if _, err := payloadValidators(u.PayloadPolicy.Validators); err != nil {
+			return fmt.Errorf("payloadPolicy: %w", err)
+		}
+	}
+	for feature, activation := range u.Features {
+		switch {
+		case !features.Contains(feature):
+			return fmt.Errorf("%w: %q", errUnknownFeature, feature)
+		case feature == DuplicateRejectionFeature || feature == PayloadPolicyFeature:
+			return fmt.Errorf("%w: %s", errFeatureHasField, feature)
+		}
+		if err := activation.Verify(); err != nil {
+			return fmt.Errorf("%s: %w", feature, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpgradeFeatures(t *testing.T) {
+	// testFeature is a feature without a field of its own
+	const testFeature Feature = "testFeature"
+	features.Add(testFeature)
+	defer features.Remove(testFeature)
+
+	tests := []struct {
+		name        string
+		upgrade     string
+		expectedErr error
+		// Height --> Whether [testFeature] is active at that height
+		active map[uint64]bool
+	}{
+		{
+			name:    "not scheduled",
+			upgrade: `{}`,
+			active:  map[uint64]bool{0: false, 100: false},
+		},
+		{
+			name:    "height",
+			upgrade: `{"features": {"testFeature": {"height": 10}}}`,
+			active:  map[uint64]bool{9: false, 10: true, 11: true},
+		},
+		{
+			name:        "unknown feature",
+			upgrade:     `{"features": {"nothing": {"height": 10}}}`,
+			expectedErr: errUnknownFeature,
+		},
+		{
+			name:        "feature with a field",
+			upgrade:     `{"features": {"duplicateRejection": {"height": 10}}}`,
+			expectedErr: errFeatureHasField,
+		},
+		{
+			name:        "height and timestamp",
+			upgrade:     `{"features": {"testFeature": {"height": 10, "timestamp": 10}}}`,
+			expectedErr: errBadActivation,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upgrade, err := ParseUpgradeConfig([]byte(test.upgrade))
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("expected %v but got %v", test.expectedErr, err)
+			}
+			for height, active := range test.active {
+				if upgrade.IsActive(testFeature, height, time.Unix(0, 0)) != active {
+					t.Fatalf("expected the feature's activity at height %d to be %t", height, active)
+				}
+			}
+		})
+	}
+
+	// Features with a field of their own are activated by it
+	upgrade, err := ParseUpgradeConfig([]byte(`{"duplicateRejection": {"timestamp": 100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgrade.IsActive(DuplicateRejectionFeature, 1, time.Unix(99, 0)) {
+		t.Fatal("expected duplicate rejection not to be active before its timestamp")
+	}
+	if !upgrade.IsActive(DuplicateRejectionFeature, 1, time.Unix(100, 0)) {
+		t.Fatal("expected duplicate rejection to be active from its timestamp on")
+	}
+	if upgrade.IsActive(PayloadPolicyFeature, 1, time.Unix(100, 0)) {
+		t.Fatal("expected an unscheduled feature not to be active")
+	}
+}
@@ -0,0 +1,183 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/rpc/v2"
+	"github.com/gorilla/rpc/v2/json2"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+var (
+	errBadID    = errors.New("must be the string repr. of an ID")
+	errBadLimit = errors.New("page size is too large")
+)
+
+// argError is returned for an invalid argument of an API method. Clients
+// get it as a JSON-RPC "invalid params" error whose data names the argument.
+type argError struct {
+	// JSON name of the argument
+	field string
+	err   error
+}
+
+func (e *argError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.field, e.err)
+}
+
+func (e *argError) Unwrap() error {
+	return e.err
+}
+
+// validatedArgs are the arguments of API methods that are checked by
+// [validateArgs] before the method uses them
+type validatedArgs interface {
+	// validate checks the arguments with [v] and stores what [v] parses in
+	// their unexported fields
+	validate(v *argValidator)
+}
+
+// validateArgs checks [args] against the chain served by [b] and returns the
+// first invalid argument's error, as an [argError]
+func validateArgs(b backend, args validatedArgs) error {
+	v := &argValidator{backend: b}
+	args.validate(v)
+	return v.err
+}
+
+// argValidator parses and checks the arguments of an API method, keeping the
+// error of the first invalid one. Once an argument is invalid, the values it
+// returns must not be used.
+type argValidator struct {
+	backend backend
+	err     error
+}
+
+// add records [err], if non-nil, as the error of the argument [field]
+func (v *argValidator) add(field string, err error) {
+	if err != nil && v.err == nil {
+		v.err = &argError{field: field, err: err}
+	}
+}
+
+// check records [err] as the error of the argument [field] unless [ok]
+func (v *argValidator) check(field string, ok bool, err error) {
+	if !ok {
+		v.add(field, err)
+	}
+}
+
+// bytes returns the bytes whose base 58 repr. is [s], which must be at least
+// [minLen] and at most [maxLen] bytes. Otherwise [err] is recorded.
+func (v *argValidator) bytes(field, s string, minLen, maxLen int, err error) []byte {
+	decoded, decodeErr := encoding.DecodeCB58(s)
+	v.check(field, decodeErr == nil && minLen <= len(decoded) && len(decoded) <= maxLen, err)
+	return decoded
+}
+
+// data returns the zero-padded data whose base 58 repr. is [s]
+func (v *argValidator) data(field, s string) [dataLen]byte {
+	var data [dataLen]byte
+	copy(data[:], v.bytes(field, s, 1, dataLen, ErrBadData))
+	return data
+}
+
+// payload returns the data whose base 58 repr. is [s], without padding. It
+// must be at most the chain's and this node's max payload size.
+func (v *argValidator) payload(field, s string) []byte {
+	return v.bytes(field, s, 1, v.backend.maxPayloadSize(), ErrBadData)
+}
+
+// hash returns the 32 byte hash whose base 58 repr. is [s]. [err] is
+// recorded if it's another length.
+func (v *argValidator) hash(field, s string, err error) [dataLen]byte {
+	var hash [dataLen]byte
+	copy(hash[:], v.bytes(field, s, dataLen, dataLen, err))
+	return hash
+}
+
+// namespace returns the zero-padded namespace [s], or no namespace if [s] is
+// empty
+func (v *argValidator) namespace(field, s string) [NamespaceLen]byte {
+	if s == "" {
+		return [NamespaceLen]byte{}
+	}
+	namespace, err := parseNamespace(s)
+	v.add(field, err)
+	return namespace
+}
+
+// signature returns the signature whose base 58 repr. is [s]
+func (v *argValidator) signature(field, s string) [secp256k1.SignatureLen]byte {
+	var sig [secp256k1.SignatureLen]byte
+	copy(sig[:], v.bytes(field, s, secp256k1.SignatureLen, secp256k1.SignatureLen, errBadSig))
+	return sig
+}
+
+// id returns the ID whose string repr. is [s]
+func (v *argValidator) id(field, s string) ids.ID {
+	id, err := ids.FromString(s)
+	v.check(field, err == nil, errBadID)
+	return id
+}
+
+// cursor returns the cursor whose repr. is [s], which must page through the
+// same list in the same direction as [start]. If [s] is empty, the page
+// starts at [start].
+func (v *argValidator) cursor(field, s string, start pageCursor) pageCursor {
+	if s == "" {
+		return start
+	}
+	cursor, err := parseCursor(s)
+	v.check(field, err == nil && cursor.list == start.list && cursor.direction == start.direction, errBadCursor)
+	return cursor
+}
+
+// limit returns the page size [limit], which is [defaultLimit] if zero and
+// must be at most [maxLimit]
+func (v *argValidator) limit(field string, limit uint64, defaultLimit, maxLimit int) int {
+	switch {
+	case limit == 0:
+		return defaultLimit
+	case limit > uint64(maxLimit):
+		v.add(field, fmt.Errorf("%w: must be at most %d", errBadLimit, maxLimit))
+		return maxLimit
+	}
+	return int(limit)
+}
+
+// argsCodec is a JSON-RPC codec that reports invalid arguments with the
+// "invalid params" error code and the name of the argument as the error's
+// data, so that every method reports them the same way
+type argsCodec struct {
+	rpc.Codec
+}
+
+func (c argsCodec) NewRequest(r *http.Request) rpc.CodecRequest {
+	return argsCodecRequest{c.Codec.NewRequest(r)}
+}
+
+type argsCodecRequest struct {
+	rpc.CodecRequest
+}
+
+func (r argsCodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	var argErr *argError
+	if errors.As(err, &argErr) {
+		err = &json2.Error{
+			Code:    json2.E_BAD_PARAMS,
+			Message: err.Error(),
+			Data:    map[string]string{"field": argErr.field},
+		}
+	}
+	r.CodecRequest.WriteError(w, status, err)
+}
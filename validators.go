@@ -0,0 +1,254 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	// RegexValidatorType is the type of a [RegexValidator] in a config
+	RegexValidatorType = "regex"
+	// SizeValidatorType is the type of a [SizeValidator] in a config
+	SizeValidatorType = "size"
+	// DigestValidatorType is the type of a [DigestValidator] in a config
+	DigestValidatorType = "digest"
+)
+
+var (
+	errNoValidators        = errors.New("payload validation has no validators")
+	errUnknownValidator    = errors.New("unknown payload validator type")
+	errBadValidatorSize    = fmt.Errorf("payload validator sizes must be in [0, %d] with the min size at most the max size", dataLen)
+	errUnknownDigest       = errors.New("unknown digest algorithm")
+	errPayloadPattern      = errors.New("data doesn't match the payload pattern")
+	errPayloadSizeOutRange = errors.New("data size is outside the allowed range")
+	errNotDigest           = errors.New("data isn't a digest of the required algorithm")
+
+	// digestSizes are the lengths of the digests of the algorithms a
+	// [DigestValidator] knows
+	digestSizes = map[string]int{
+		"md5":         16,
+		"sha1":        20,
+		"ripemd160":   20,
+		"sha224":      28,
+		"sha256":      32,
+		"sha3-256":    32,
+		"blake2b-256": 32,
+	}
+)
+
+// PayloadValidator enforces a deployment's own rules on each piece of data.
+// Validators added with [VM.AddPayloadValidator] or built from the chain's
+// parameters and upgrades are consensus rules, so every node of a chain must
+// run the same validators, or they'll disagree about which blocks are valid.
+// Validators built from the node's config only apply to the API.
+type PayloadValidator interface {
+	// ValidatePayload is called by Verify for each piece of a block's data,
+	// after the chain's payload rules pass, and by the API for each
+	// proposal, zero-padded to [dataLen] bytes. A non-nil error makes the
+	// data invalid. It may be called concurrently.
+	ValidatePayload(data [dataLen]byte) error
+}
+
+// PayloadValidationConfig configures the payload validators this node's API
+// applies to proposals
+type PayloadValidationConfig struct {
+	Validators []PayloadValidatorConfig `json:"validators"`
+}
+
+// Verify returns nil iff [c] is a valid payload validation config
+func (c *PayloadValidationConfig) Verify() error {
+	if len(c.Validators) == 0 {
+		return errNoValidators
+	}
+	for i := range c.Validators {
+		if _, err := c.Validators[i].validator(); err != nil {
+			return fmt.Errorf("payload validator %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validators returns the validators configured by [c]
+func (c *PayloadValidationConfig) validators() ([]PayloadValidator, error) {
+	return payloadValidators(c.Validators)
+}
+
+// payloadValidators returns the validators configured by [configs]
+func payloadValidators(configs []PayloadValidatorConfig) ([]PayloadValidator, error) {
+	validators := make([]PayloadValidator, len(configs))
+	for i := range configs {
+		v, err := configs[i].validator()
+		if err != nil {
+			return nil, fmt.Errorf("payload validator %d: %w", i, err)
+		}
+		validators[i] = v
+	}
+	return validators, nil
+}
+
+// PayloadValidatorConfig configures one of the validators shipped with the
+// VM
+type PayloadValidatorConfig struct {
+	// One of "regex", "size" or "digest"
+	Type string `json:"type"`
+	// Pattern of a regex validator, in RE2 syntax
+	Pattern string `json:"pattern"`
+	// Bounds of a size validator, in bytes. A zero max size means 32.
+	MinSize int `json:"minSize"`
+	MaxSize int `json:"maxSize"`
+	// Algorithm of a digest validator, such as "sha256"
+	Algorithm string `json:"algorithm"`
+}
+
+// validator returns the validator configured by [c]
+func (c *PayloadValidatorConfig) validator() (PayloadValidator, error) {
+	switch c.Type {
+	case RegexValidatorType:
+		return NewRegexValidator(c.Pattern)
+	case SizeValidatorType:
+		maxSize := c.MaxSize
+		if maxSize == 0 {
+			maxSize = dataLen
+		}
+		return NewSizeValidator(c.MinSize, maxSize)
+	case DigestValidatorType:
+		return NewDigestValidator(c.Algorithm)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownValidator, c.Type)
+	}
+}
+
+// trimPadding returns [data] without the zero bytes that pad it to [dataLen]
+// bytes. Data that ends in zero bytes of its own loses them too.
+func trimPadding(data [dataLen]byte) []byte {
+	return bytes.TrimRight(data[:], "\x00")
+}
+
+// RegexValidator requires data, without its zero padding, to match a
+// pattern. Anchor the pattern with ^ and $ to match all of the data.
+type RegexValidator struct {
+	pattern *regexp.Regexp
+}
+
+// NewRegexValidator returns a validator of data that matches [pattern], in
+// RE2 syntax
+func NewRegexValidator(pattern string) (*RegexValidator, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexValidator{pattern: re}, nil
+}
+
+// ValidatePayload implements [PayloadValidator]
+func (v *RegexValidator) ValidatePayload(data [dataLen]byte) error {
+	if !v.pattern.Match(trimPadding(data)) {
+		return fmt.Errorf("%w %q", errPayloadPattern, v.pattern)
+	}
+	return nil
+}
+
+// SizeValidator requires data, without its zero padding, to be between a min
+// and a max number of bytes
+type SizeValidator struct {
+	minSize, maxSize int
+}
+
+// NewSizeValidator returns a validator of data of [minSize] to [maxSize]
+// bytes
+func NewSizeValidator(minSize, maxSize int) (*SizeValidator, error) {
+	if minSize < 0 || maxSize > dataLen || minSize > maxSize {
+		return nil, errBadValidatorSize
+	}
+	return &SizeValidator{minSize: minSize, maxSize: maxSize}, nil
+}
+
+// ValidatePayload implements [PayloadValidator]
+func (v *SizeValidator) ValidatePayload(data [dataLen]byte) error {
+	if size := len(trimPadding(data)); size < v.minSize || size > v.maxSize {
+		return fmt.Errorf("%w: %d bytes isn't in [%d, %d]", errPayloadSizeOutRange, size, v.minSize, v.maxSize)
+	}
+	return nil
+}
+
+// DigestValidator requires data to be a digest of a hash function. A digest
+// may end in zero bytes, so only the bytes after the digest's length are
+// checked, which must be zero, and the digest must not be all zeros.
+type DigestValidator struct {
+	algorithm string
+	size      int
+}
+
+// NewDigestValidator returns a validator of digests of [algorithm], which is
+// one of "md5", "sha1", "ripemd160", "sha224", "sha256", "sha3-256" or
+// "blake2b-256"
+func NewDigestValidator(algorithm string) (*DigestValidator, error) {
+	size, ok := digestSizes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownDigest, algorithm)
+	}
+	return &DigestValidator{algorithm: algorithm, size: size}, nil
+}
+
+// ValidatePayload implements [PayloadValidator]
+func (v *DigestValidator) ValidatePayload(data [dataLen]byte) error {
+	if size := len(trimPadding(data)); size == 0 || size > v.size {
+		return fmt.Errorf("%w: %s", errNotDigest, v.algorithm)
+	}
+	return nil
+}
+
+// AddPayloadValidator adds [v] to the validators of every piece of data. It
+// must be called before Initialize, such as by a factory that builds the VM
+// for a deployment.
+func (vm *VM) AddPayloadValidator(v PayloadValidator) {
+	vm.validators = append(vm.validators, v)
+}
+
+// initializeValidators builds the payload validators of the chain's
+// parameters, of its payload policy upgrade and of this node's config
+func (vm *VM) initializeValidators() error {
+	validators, err := payloadValidators(vm.genesis.Params.PayloadValidators)
+	if err != nil {
+		return fmt.Errorf("couldn't load the chain's payload validators: %w", err)
+	}
+	vm.validators = append(vm.validators, validators...)
+	if upgrade := vm.upgrades.PayloadPolicy; upgrade != nil {
+		if vm.upgradeValidators, err = payloadValidators(upgrade.Validators); err != nil {
+			return fmt.Errorf("couldn't load the payload policy's validators: %w", err)
+		}
+	}
+	if config := vm.config.Load().PayloadValidation; config != nil {
+		if vm.apiValidators, err = config.validators(); err != nil {
+			return fmt.Errorf("couldn't load payload validators: %w", err)
+		}
+	}
+	return nil
+}
+
+// payloadValidators returns the payload validators that the data of a block
+// at [height] with time [timestamp] must pass
+func (vm *VM) payloadValidators(height uint64, timestamp time.Time) []PayloadValidator {
+	validators := vm.validators
+	if vm.upgrades.IsActive(PayloadPolicyFeature, height, timestamp) {
+		validators = append(validators[:len(validators):len(validators)], vm.upgradeValidators...)
+	}
+	return validators
+}
+
+// validatePayload returns the first error returned by one of [validators]
+// for [data]
+func validatePayload(validators []PayloadValidator, data [dataLen]byte) error {
+	for _, v := range validators {
+		if err := v.ValidatePayload(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
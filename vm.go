@@ -4,29 +4,64 @@
 package timestampvm
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gorilla/rpc/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+
+	avametrics "github.com/ava-labs/avalanchego/api/metrics"
 	"github.com/ava-labs/avalanchego/codec"
-	"github.com/ava-labs/avalanchego/codec/linearcodec"
 	"github.com/ava-labs/avalanchego/database"
+	"github.com/ava-labs/avalanchego/database/prefixdb"
+	"github.com/ava-labs/avalanchego/database/versiondb"
 	"github.com/ava-labs/avalanchego/ids"
 	"github.com/ava-labs/avalanchego/snow"
+	"github.com/ava-labs/avalanchego/snow/choices"
 	"github.com/ava-labs/avalanchego/snow/consensus/snowman"
 	"github.com/ava-labs/avalanchego/snow/engine/common"
 	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
-	"github.com/ava-labs/avalanchego/vms/components/core"
+	"github.com/ava-labs/avalanchego/trace"
+	"github.com/ava-labs/avalanchego/utils/hashing"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/timer/mockable"
+	"github.com/ava-labs/avalanchego/version"
+	"github.com/ava-labs/avalanchego/vms/proposervm/proposer"
 )
 
 const (
 	dataLen      = 32
 	codecVersion = 0
+
+	// maxBatchSize is the maximum number of pieces of data in a block
+	maxBatchSize = 256
+
+	// bootstrapCommitInterval is the number of blocks accepted while
+	// bootstrapping whose writes are committed together
+	bootstrapCommitInterval = 1024
+
+	// Name is the name of this VM's API service
+	Name = "timestamp"
+
+	// Version is the version of this VM
+	Version = "v1.0.0"
 )
 
 var (
-	errNoPendingBlocks = errors.New("there is no block to propose")
-	errBadGenesisBytes = errors.New("genesis data should be bytes (max length 32)")
+	// ErrMempoolFull is returned for data proposed while this node's mempool
+	// is full
+	ErrMempoolFull = errors.New("mempool is full")
+
+	errNoPendingBlocks    = errors.New("there is no block to propose")
+	errNotAllowedProposer = errors.New("this node isn't an allowed proposer")
 
 	_ block.ChainVM = &VM{}
 )
@@ -35,162 +70,1008 @@ var (
 // Each block in this chain contains a Unix timestamp
 // and a piece of data (a string)
 type VM struct {
-	core.SnowmanVM
+	common.AppHandler
+
+	// The context of this vm
+	ctx *snow.Context
+
+	// The decoded genesis of this chain
+	genesis *Genesis
+
+	// The per-chain configuration of this vm. ReloadConfig replaces it as a
+	// whole, so it may be read from any goroutine without the lock, but
+	// must never be changed in place.
+	config atomic.Pointer[Config]
+	// True once Initialize has succeeded, so that goroutines that reload
+	// the config see the initialized vm
+	running atomic.Bool
+
+	// Activation points of consensus rules added after genesis
+	upgrades UpgradeConfig
+
+	// Local time, as read by the timestamp rules and block building
+	clock *mockable.Clock
+
+	// Feature extensions passed at chain creation
+	fxs []Fx
+	// Validators of every piece of data, added before initialization or
+	// built from the chain's parameters
+	validators []PayloadValidator
+	// Validators of the data of blocks after the payload policy upgrade
+	upgradeValidators []PayloadValidator
+	// Validators of proposals to this node's API, built from the config
+	apiValidators []PayloadValidator
+
+	// The database of this vm. Writes are buffered until Commit is called.
+	db *versiondb.Database
+	// The database under [db], set by [WithDatabase] in place of the one
+	// this vm is initialized with
+	baseDB database.Database
+
+	// Persists blocks and chain metadata
+	state *state
+	// CID of IPFS content anchored through this node's API --> Content type.
+	// Writes aren't buffered in [db] because the index isn't chain state.
+	anchorDB database.Database
+	// Data of references to off-chain content proposed through this node's
+	// API --> Reference. Like [anchorDB], writes aren't buffered.
+	referenceDB database.Database
+
+	// Loggers of the API, block building and the mempool, whose levels may
+	// be changed on a running chain
+	logs *subsystemLogs
+
+	// Reported in the node's Prometheus output
+	metrics *metrics
+	// Records spans of block building, verification and decisions, and of
+	// API requests
+	tracer trace.Tracer
+	// Notifies the configured webhooks of accepted blocks. Nil if there are
+	// no webhooks.
+	webhooks *webhooks
+	// Publishes accepted blocks to the configured message bus. Nil if there
+	// is no message bus.
+	publisher *publisher
+	// Answers RFC 3161 time-stamp requests. Nil if there is no time-stamp
+	// authority.
+	tsa *timeStampAuthority
+	// Aggregates submitted hashes into Merkle trees. Nil if aggregation
+	// isn't enabled.
+	aggregator *aggregator
+	// Aggregates the validators' attestations of accepted blocks. Nil if
+	// attestations aren't enabled.
+	attestor *attestor
+	// Compacts expired data in the namespace index. Nil if retention isn't
+	// enabled.
+	compactor *compactor
+	// Records the write API calls to this node. Nil if the audit log isn't
+	// enabled.
+	audit *auditLog
+	// Runs the WASM hook on accepted data. Nil if there is no hook.
+	hooks *hookRunner
+
 	codec codec.Manager
-	// Proposed pieces of data that haven't been put into a block and proposed yet
-	mempool [][dataLen]byte
+	// Codec version --> Codec, which values are marshaled with
+	codecs map[uint16]codec.Codec
+	// Codec version --> Codec set by [WithCodec]
+	codecOverrides map[uint16]codec.Codec
+
+	// ID of the preferred block
+	preferred ids.ID
+
+	// Signs the blocks this node builds. Nil if this node can't sign blocks.
+	signer Signer
+
+	// Write-ahead log of the operations in the pending pools below
+	opJournal *opJournal
+	// Signer operations submitted over the API that haven't been accepted
+	pendingOps pendingSignerOps
+	// Transfers submitted over the API that haven't been accepted
+	pendingTransfers pendingTransfers
+	// Claim transfers submitted over the API that haven't been accepted
+	pendingClaims pendingClaimTransfers
+	// ACL operations submitted over the API that haven't been accepted
+	pendingACLOps pendingACLOps
+	// Reveals submitted over the API that haven't been accepted
+	pendingReveals pendingReveals
+	// Key registrations and encrypted payloads submitted over the API that
+	// haven't been accepted
+	pendingEncryption  pendingEncryption
+	pendingFeeds       pendingFeedUpdates
+	pendingWarp        pendingWarpMessages
+	pendingVotes       pendingVotes
+	pendingMultisigs   pendingMultisigs
+	pendingSubmissions pendingSubmissions
+
+	// Blocks that passed verification and haven't been decided
+	processing *blockTree
+
+	// Holds proposed data until it is built into a block
+	builder *builder
+	// Holds the proposed data that's due. Set by [WithMempool], or else
+	// first in, first out.
+	mempool Mempool
+	// Block ID --> Journal entries of the data in that block.
+	// Each element is a block built by this node that hasn't been decided.
+	inFlight map[ids.ID][]MempoolEntry
+	// Makes Shutdown idempotent
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	// Determines which validator may propose a block in each ProposerVM slot
+	windower proposer.Windower
+	// This node's stake-weighted build backoff for a child of the preferred
+	// block
+	backoff buildBackoff
+
+	// Indicates that this VM has finished bootstrapping for the chain
+	bootstrapped bool
+	// True iff the engine is bootstrapping the chain, during which accepted
+	// blocks are committed in batches
+	bootstrapping bool
+	// Number of blocks accepted while bootstrapping whose writes haven't been
+	// committed
+	uncommitted int
+
+	// Sends requests and responses to peers running this chain
+	appSender common.AppSender
+	// Fetches the checkpoint block. Nil unless there is a checkpoint above the
+	// last accepted block.
+	syncer *checkpointSyncer
 }
 
 // Initialize this vm
 // [ctx] is this vm's context
-// [db] is this vm's database
-// [toEngine] is used to notify the consensus engine that new blocks are
-//   ready to be added to consensus
-// The data in the genesis block is [genesisData]
+// [db] is this vm's database, unless one was set by [WithDatabase]
+// [genesisBytes] is the JSON encoding of this chain's Genesis
+// [upgradeBytes] is the JSON encoding of this chain's UpgradeConfig
+// [configBytes] is the JSON encoding of this chain's Config
+// [fxs] are feature extensions that hook into this vm. Each must implement Fx.
 func (vm *VM) Initialize(
+	_ context.Context,
 	ctx *snow.Context,
 	db database.Database,
-	genesisData []byte,
-	toEngine chan<- common.Message,
-	_ []*common.Fx,
+	genesisBytes []byte,
+	upgradeBytes []byte,
+	configBytes []byte,
+	fxs []*common.Fx,
+	appSender common.AppSender,
 ) error {
-	if err := vm.SnowmanVM.Initialize(ctx, db, vm.ParseBlock, toEngine); err != nil {
-		ctx.Log.Error("error initializing SnowmanVM: %v", err)
+	if vm.baseDB != nil {
+		db = vm.baseDB
+	}
+	if vm.clock == nil {
+		vm.clock = &mockable.Clock{}
+	}
+	if vm.mempool == nil {
+		vm.mempool = &fifoMempool{}
+	}
+
+	genesis, err := ParseGenesis(genesisBytes)
+	if err != nil {
 		return err
 	}
-	c := linearcodec.NewDefault()
-	manager := codec.NewDefaultManager()
-	if err := manager.RegisterCodec(codecVersion, c); err != nil {
+	vm.genesis = genesis
+
+	config, err := ParseConfig(configBytes)
+	if err != nil {
 		return err
 	}
-	vm.codec = manager
+	vm.config.Store(&config)
+	if vm.tracer, err = newTracer(config.Tracing); err != nil {
+		return fmt.Errorf("couldn't create tracer: %w", err)
+	}
 
-	// If database is empty, create it using the provided genesis data
-	if !vm.DBInitialized() {
-		if len(genesisData) > dataLen {
-			return errBadGenesisBytes
+	upgrades, err := ParseUpgradeConfig(upgradeBytes)
+	if err != nil {
+		return err
+	}
+	if upgrades.PayloadPolicy != nil {
+		if err := verifyPayloadRules(allPayloadRules(&genesis.Params, &upgrades), &genesis.Params); err != nil {
+			return fmt.Errorf("payloadPolicy: %w", err)
 		}
+	}
+	vm.upgrades = upgrades
+
+	vm.AppHandler = common.NewNoOpAppHandler(ctx.Log)
+	vm.ctx = ctx
+	vm.logs = newSubsystemLogs(ctx.Log)
+	vm.appSender = appSender
+	if vm.db == nil {
+		vm.db = versiondb.New(db)
+	}
+
+	registerer, err := avametrics.MakeAndRegister(ctx.Metrics, "")
+	if err != nil {
+		return err
+	}
+	vm.metrics, err = newMetrics(registerer)
+	if err != nil {
+		return err
+	}
+
+	if vm.codec == nil {
+		if err := vm.initializeCodecs(); err != nil {
+			return err
+		}
+	}
+	vm.state = newState(vm, vm.db)
+	vm.opJournal = &opJournal{codec: vm.codec, db: prefixdb.New(opJournalPrefix, db)}
+	vm.processing = newBlockTree()
+
+	initialized, err := vm.state.isInitialized()
+	if err != nil {
+		return err
+	}
 
-		// genesisData is a byte slice but each block contains an byte array
-		// Take the first [dataLen] bytes from genesisData and put them in an array
-		var genesisDataArr [dataLen]byte
-		copy(genesisDataArr[:], genesisData)
+	// If database is empty, create it using the provided genesis data
+	if !initialized {
+		genesisData, err := genesis.decodeData()
+		if err != nil {
+			return err
+		}
 
 		// Create the genesis block
 		// Timestamp of genesis block is 0. It has no parent.
-		genesisBlock, err := vm.NewBlock(ids.Empty, 0, genesisDataArr, time.Unix(0, 0))
+		genesisBlock, err := vm.NewBlock(ids.Empty, 0, genesisData, time.Unix(0, 0))
 		if err != nil {
-			vm.Ctx.Log.Error("error while creating genesis block: %v", err)
+			ctx.Log.Error("error while creating genesis block", zap.Error(err))
 			return err
 		}
 
-		if err := vm.SaveBlock(vm.DB, genesisBlock); err != nil {
-			vm.Ctx.Log.Error("error while saving genesis block: %v", err)
-			return err
+		if err := vm.state.setInitialized(); err != nil {
+			return fmt.Errorf("error while setting db to initialized: %w", err)
+		}
+		for _, signer := range genesis.Params.Signers {
+			if err := vm.state.putSigner(signer); err != nil {
+				return err
+			}
+		}
+		for _, acl := range genesis.Params.ACLs {
+			namespace, err := parseNamespace(acl.Namespace)
+			if err != nil {
+				return err
+			}
+			for _, writer := range acl.Writers {
+				if err := vm.state.putWriter(namespace, writer); err != nil {
+					return err
+				}
+			}
+		}
+		for _, feed := range genesis.Params.Feeds {
+			id, err := parseFeedID(feed.ID)
+			if err != nil {
+				return err
+			}
+			for _, oracle := range feed.Oracles {
+				if err := vm.state.putOracle(id, oracle); err != nil {
+					return err
+				}
+			}
+		}
+		for _, allocation := range genesis.Allocations {
+			if err := vm.state.putBalance(allocation.Address, allocation.Balance); err != nil {
+				return err
+			}
 		}
 
 		// Accept the genesis block
-		// Sets [vm.lastAccepted] and [vm.preferred]
-		if err := genesisBlock.Accept(); err != nil {
+		// Sets the last accepted block and flushes VM's database to the
+		// underlying db along with the initialized flag
+		if err := genesisBlock.Accept(context.TODO()); err != nil {
 			return fmt.Errorf("error accepting genesis block: %w", err)
 		}
+	}
 
-		if err := vm.SetDBInitialized(); err != nil {
-			return fmt.Errorf("error while setting db to initialized: %w", err)
-		}
+	if err := vm.state.repairHeightIndex(); err != nil {
+		return fmt.Errorf("couldn't repair height index: %w", err)
+	}
+	if err := vm.state.repairLightHeaders(); err != nil {
+		return fmt.Errorf("couldn't repair light headers: %w", err)
+	}
+	if err := vm.state.repairIndexerFeed(); err != nil {
+		return fmt.Errorf("couldn't repair indexer feed: %w", err)
+	}
+	if err := vm.commit(); err != nil {
+		return err
+	}
 
-		// Flush VM's database to underlying db
-		if err := vm.DB.Commit(); err != nil {
-			vm.Ctx.Log.Error("error while committing db: %v", err)
-			return err
+	lastAccepted, err := vm.state.getLastAccepted()
+	if err != nil {
+		return err
+	}
+	vm.preferred = lastAccepted
+
+	// Load the tip of the chain so that the first API queries and the first
+	// block built after a restart don't wait on the database
+	start := time.Now()
+	numWarmed, err := vm.state.warmCaches(lastAccepted, vm.config.Load().BlockCacheSize)
+	if err != nil {
+		return fmt.Errorf("couldn't warm caches: %w", err)
+	}
+	ctx.Log.Debug("warmed block caches",
+		zap.Int("numBlocks", numWarmed),
+		zap.Duration("duration", time.Since(start)),
+	)
+
+	if err := vm.initializeFxs(fxs); err != nil {
+		return err
+	}
+	if err := vm.initializeValidators(); err != nil {
+		return err
+	}
+	if err := vm.initializeSigner(); err != nil {
+		return err
+	}
+	if err := vm.initializeSyncer(lastAccepted); err != nil {
+		return err
+	}
+
+	// Data that was proposed but not decided before the last shutdown is put
+	// back into the mempool
+	journal, pending, err := newJournal(prefixdb.New(journalPrefix, db))
+	if err != nil {
+		return fmt.Errorf("couldn't load journal: %w", err)
+	}
+	if len(pending) > 0 {
+		vm.logs.mempool.Info("restoring proposed data from journal", zap.Int("numPending", len(pending)))
+	}
+
+	vm.anchorDB = prefixdb.New(anchorPrefix, db)
+	vm.referenceDB = prefixdb.New(referencePrefix, db)
+	vm.windower = proposer.New(ctx.ValidatorState, ctx.SubnetID, ctx.ChainID)
+	vm.inFlight = make(map[ids.ID][]MempoolEntry)
+	vm.builder = newBuilder(vm.config.Load().MempoolSize, vm.config.Load().BuildBatchWindow.Duration, journal, vm.mempool, pending)
+	vm.builder.start()
+
+	// Operations that were submitted but not accepted before the last
+	// shutdown are put back into their pools
+	lastAcceptedBlk, err := vm.getBlock(lastAccepted)
+	if err != nil {
+		return err
+	}
+	if err := vm.restorePendingOps(lastAcceptedBlk); err != nil {
+		return err
+	}
+	if config.Webhooks != nil {
+		vm.webhooks = newWebhooks(*config.Webhooks, ctx.Log)
+	}
+	if config.Publisher != nil {
+		bus, err := dialMessageBus(*config.Publisher)
+		if err != nil {
+			return fmt.Errorf("couldn't connect to message bus: %w", err)
+		}
+		vm.publisher = newPublisher(bus, config.Publisher.QueueSize, ctx.Log)
+	}
+	if config.TSA != nil {
+		vm.tsa, err = newTimeStampAuthority(*config.TSA, vm)
+		if err != nil {
+			return fmt.Errorf("couldn't load time-stamp authority: %w", err)
+		}
+	}
+	if config.Aggregation != nil {
+		vm.aggregator, err = newAggregator(*config.Aggregation, prefixdb.New(aggregatedPrefix, db), prefixdb.New(pendingAggregatedPrefix, db), vm.verifyRoot, vm.proposeBlock, ctx.Log)
+		if err != nil {
+			return fmt.Errorf("couldn't load aggregation journal: %w", err)
 		}
 	}
+	if config.Attestations {
+		vm.attestor = newAttestor(ctx, appSender, prefixdb.New(attestationPrefix, db))
+	}
+	if config.Audit != nil {
+		if vm.audit, err = newAuditLog(*config.Audit, prefixdb.New(auditPrefix, db)); err != nil {
+			return fmt.Errorf("couldn't load audit log: %w", err)
+		}
+	}
+	if config.Retention != nil {
+		if !genesis.Params.Namespaces {
+			return errRetentionWithoutNamespaces
+		}
+		vm.compactor = newCompactor(*config.Retention, vm.compactRetention, ctx.Log)
+	}
+	if config.Hooks != nil {
+		if vm.hooks, err = newHookRunner(vm, *config.Hooks, prefixdb.New(hookPrefix, db), ctx.Log); err != nil {
+			return fmt.Errorf("couldn't load hook: %w", err)
+		}
+	}
+	if err := vm.metrics.registerMempoolSize(vm.builder.len); err != nil {
+		return err
+	}
+	vm.running.Store(true)
 	return nil
 }
 
+// SetState sets this VM state according to given snow.State
+func (vm *VM) SetState(_ context.Context, state snow.State) error {
+	switch state {
+	case snow.StateSyncing:
+		vm.bootstrapped = false
+		return nil
+	case snow.Bootstrapping:
+		vm.bootstrapped = false
+		vm.bootstrapping = true
+		return nil
+	case snow.NormalOp:
+		vm.bootstrapped = true
+		vm.bootstrapping = false
+		return vm.commitBootstrapped()
+	default:
+		return snow.ErrUnknownState
+	}
+}
+
+// Shutdown this vm
+// Calling Shutdown more than once has no further effect.
+func (vm *VM) Shutdown(context.Context) error {
+	vm.shutdownOnce.Do(func() {
+		// The aggregator proposes to the builder, so it's stopped first
+		if vm.aggregator != nil {
+			vm.aggregator.stop()
+		}
+		if vm.compactor != nil {
+			vm.compactor.stop()
+		}
+		if vm.hooks != nil {
+			vm.hooks.stop()
+		}
+		if vm.builder != nil {
+			vm.builder.stop()
+		}
+		if vm.webhooks != nil {
+			vm.webhooks.stop()
+		}
+		if vm.db != nil {
+			vm.shutdownErr = errors.Join(vm.commitBootstrapped(), vm.db.Close())
+		}
+		if vm.publisher != nil {
+			vm.shutdownErr = errors.Join(vm.shutdownErr, vm.publisher.stop())
+		}
+		if vm.tracer != nil {
+			vm.shutdownErr = errors.Join(vm.shutdownErr, vm.tracer.Close())
+		}
+	})
+	return vm.shutdownErr
+}
+
+// Version returns the version of this VM
+func (*VM) Version(context.Context) (string, error) {
+	return Version, nil
+}
+
 // CreateHandlers returns a map where:
-// Keys: The path extension for this VM's API (empty in this case)
+// Keys: The path extension of each version of this VM's API, such as "/v1".
+// The empty extension serves the first version.
 // Values: The handler for the API
-func (vm *VM) CreateHandlers() map[string]*common.HTTPHandler {
-	handler, err := vm.NewHandler("timestamp", &Service{vm})
-	vm.Ctx.Log.AssertNoError(err)
-	return map[string]*common.HTTPHandler{
-		"": handler,
+// Handlers registered by fxs are added to the map, as is the profiler if a
+// profiler token is configured.
+// No handlers are returned if the API is disabled in the config
+func (vm *VM) CreateHandlers(ctx context.Context) (map[string]http.Handler, error) {
+	if !vm.config.Load().APIEnabled {
+		return nil, nil
+	}
+
+	handlers := make(map[string]http.Handler)
+	for _, version := range apiVersions {
+		server, err := newServiceHandler(vm, version, vm.tracer, vm.logs.api)
+		if err != nil {
+			return nil, err
+		}
+		handlers[version.endpoint] = server
+	}
+	handlers[""] = handlers[unversionedAPI.endpoint]
+	if vm.config.Load().ProfilerToken != "" {
+		handlers[profilerEndpoint] = &profiler{token: vm.config.Load().ProfilerToken}
 	}
+	if vm.config.Load().AdminToken != "" {
+		admin, err := newAdminHandler(vm, vm.config.Load().AdminToken)
+		if err != nil {
+			return nil, err
+		}
+		handlers[adminEndpoint] = admin
+	}
+	if vm.config.Load().ExplorerUI {
+		handlers[uiEndpoint] = explorerUI{}
+	}
+	if vm.tsa != nil {
+		handlers[tsaEndpoint] = vm.tsa
+	}
+	return handlers, vm.addFxHandlers(ctx, handlers)
 }
 
-// CreateStaticHandlers returns a map where:
-// Keys: The path extension for this VM's static API
-// Values: The handler for that static API
-// We return nil because this VM has no static API
-func (vm *VM) CreateStaticHandlers() map[string]*common.HTTPHandler { return nil }
+// newServiceHandler returns the JSON-RPC handler of [version] of the API
+// served from [b].
+// Batch requests are supported. Each request is given an ID, each call is
+// traced with [tracer] and logged to [log] with that ID, and write calls are
+// recorded in [b]'s audit log if it has one. Invalid arguments are reported
+// with the "invalid params" error code. Request bodies are limited to the
+// max batch bytes of [b]'s config when the handler is created.
+func newServiceHandler(b backend, version apiVersion, tracer trace.Tracer, log logging.Logger) (http.Handler, error) {
+	server := rpc.NewServer()
+	server.RegisterCodec(argsCodec{json.NewCodec()}, "application/json")
+	server.RegisterCodec(argsCodec{json.NewCodec()}, "application/json;charset=UTF-8")
+	traceRequests(server, tracer, log)
+	var next http.Handler = server
+	if log := b.auditLog(); log != nil {
+		next = &auditHandler{next: server, log: log}
+	}
+	batch := &batchHandler{next: next, maxBytes: int64(b.nodeConfig().MaxBatchBytes)}
+	return &requestIDHandler{next: batch}, server.RegisterService(version.newService(b), Name)
+}
+
+// NewHTTPHandler returns nil because this VM has no gRPC API
+func (*VM) NewHTTPHandler(context.Context) (http.Handler, error) { return nil, nil }
+
+// HealthCheck implements the common.VM interface
+func (*VM) HealthCheck(context.Context) (interface{}, error) { return nil, nil }
 
-// Health implements the common.VM interface
-func (vm *VM) Health() (interface{}, error) { return nil, nil }
+// Connected implements the validators.Connector interface
+// Connected peers are asked for the checkpoint block during state sync.
+func (vm *VM) Connected(ctx context.Context, nodeID ids.NodeID, _ *version.Application) error {
+	if vm.syncer == nil || nodeID == vm.ctx.NodeID {
+		return nil
+	}
+	return vm.syncer.connected(ctx, nodeID)
+}
+
+// Disconnected implements the validators.Connector interface
+func (vm *VM) Disconnected(_ context.Context, nodeID ids.NodeID) error {
+	if vm.syncer != nil {
+		vm.syncer.disconnected(nodeID)
+	}
+	return nil
+}
+
+// WaitForEvent blocks until there is data in the mempool to build a block with
+// and the build batch window of that data has elapsed, or a full batch is
+// waiting. Once the checkpoint block has been fetched during state sync,
+// StateSyncDone is returned instead.
+func (vm *VM) WaitForEvent(ctx context.Context) (common.Message, error) {
+	return vm.builder.waitForEvent(ctx)
+}
 
 // BuildBlock returns a block that this vm wants to add to consensus
-func (vm *VM) BuildBlock() (snowman.Block, error) {
-	if len(vm.mempool) == 0 { // There is no block to be built
-		return nil, errNoPendingBlocks
+// The block contains up to [maxBatchSize] pieces of data from the mempool
+// Nodes whose config doesn't allow them to propose never build blocks.
+// On chains that sign blocks, the block is signed with this node's signer.
+// On chains with an allowed signer set it includes the pending signer
+// operations, on chains with transfers, claims or namespace ACLs it includes
+// the pending transfers, claim transfers or ACL operations, on chains with
+// fees it only holds the data this node can pay for, and on chains with
+// namespace ACLs it only holds the data this node may write.
+// No block is built before the chain's min block interval has passed since
+// the preferred block, or before this node's build backoff has elapsed.
+// Warp messages are only included in blocks built with
+// BuildBlockWithContext, since their signatures are checked at the P-Chain
+// height.
+func (vm *VM) BuildBlock(ctx context.Context) (snowman.Block, error) {
+	return vm.traceBuildBlock(ctx, nil)
+}
+
+// traceBuildBlock builds a block in a trace span. [blockCtx] is nil unless
+// the chain is wrapped by the ProposerVM.
+func (vm *VM) traceBuildBlock(ctx context.Context, blockCtx *block.Context) (snowman.Block, error) {
+	ctx, span := vm.tracer.Start(ctx, "timestampvm.BuildBlock")
+	blk, err := vm.buildBlock(ctx, blockCtx)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
 	}
+	span.SetAttributes(attribute.Stringer("blkID", blk.ID()))
+	span.End()
+	vm.logBlock("built block", blk)
+	return blk, nil
+}
 
-	// Get the value to put in the new block
-	value := vm.mempool[0]
-	vm.mempool = vm.mempool[1:]
+func (vm *VM) buildBlock(ctx context.Context, blockCtx *block.Context) (*Block, error) {
+	if !vm.config.Load().isAllowedProposer(vm.ctx.NodeID) {
+		return nil, errNotAllowedProposer
+	}
+	if timeout := vm.config.Load().BuildTimeout.Duration; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	// Notify consensus engine that there are more pending data for blocks
-	// (if that is the case) when done building this block
-	if len(vm.mempool) > 0 {
-		defer vm.NotifyBlockReady()
+	preferredBlock, err := vm.getBlock(vm.preferred)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get preferred block: %w", err)
+	}
+
+	var ops []SignerOp
+	if vm.genesis.Params.signsBlocks() {
+		signers, err := vm.verifyCanSign(preferredBlock)
+		if err != nil {
+			return nil, err
+		}
+		if signers != nil {
+			ops = vm.pendingOps.next(vm, signers)
+		}
+	}
+
+	// Leave the mempool untouched until the min block interval has passed,
+	// and tell the engine to try again then
+	timestamp := vm.clock.Time()
+	interval := vm.genesis.Params.minBlockIntervalSeconds()
+	if earliest := time.Unix(preferredBlock.Tmstmp+interval, 0); interval > 0 && timestamp.Before(earliest) {
+		vm.builder.retryAt(earliest)
+		return nil, errBlockTooSoon
+	}
+	if err := vm.verifyBuildBackoff(ctx, preferredBlock); err != nil {
+		return nil, err
 	}
 
-	preferredIntf, err := vm.GetBlock(vm.Preferred())
+	params, err := vm.paramsAt(preferredBlock, preferredBlock.Height()+1)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't get preferred block")
+		return nil, err
+	}
+	// The block's base fee and the feed updates it may hold depend on its
+	// timestamp
+	timestamp, err = vm.buildTimestamp(preferredBlock, params, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	baseFee, err := vm.baseFeeAfter(preferredBlock, params, timestamp.Unix())
+	if err != nil {
+		return nil, err
+	}
+	// Leave the mempool untouched if this node can't pay for any data. The
+	// block's data and its multisig proposals, which this node pays for, each
+	// count up to [maxBatchSize].
+	affordable, err := vm.affordableData(preferredBlock, params, baseFee, 2*maxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if affordable == 0 && len(ops) == 0 && !vm.hasPendingOps() {
+		return nil, errInsufficientBalance
 	}
-	preferredHeight := preferredIntf.(*Block).Height()
 
-	// Build the block
-	block, err := vm.NewBlock(vm.Preferred(), preferredHeight+1, value, time.Now())
+	// Leave the mempool untouched if the deadline has already passed
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Get the values to put in the new block. From here on, the data is put
+	// back into the mempool if the block isn't built.
+	entries, err := vm.builder.nextBatch()
 	if err != nil {
 		return nil, err
 	}
+	if len(entries) > affordable {
+		// Put the data this node can't pay for back into the mempool
+		vm.builder.requeue(entries[affordable:])
+		entries = entries[:affordable]
+	}
+	writable, unwritable, err := vm.writableData(preferredBlock, entries)
+	if err != nil {
+		return nil, vm.abandonBuild(entries, err)
+	}
+	entries = writable
+	// Put the data this node may not write back into the mempool
+	if len(unwritable) > 0 {
+		vm.builder.requeue(unwritable)
+	}
+	entries, overQuota := vm.withinNamespaceQuota(entries)
+	if len(overQuota) > 0 {
+		vm.builder.requeue(overQuota)
+	}
+	entries, oversized := withinPayloadSize(params, entries)
+	if len(oversized) > 0 {
+		vm.builder.requeue(oversized)
+	}
+	values := make([][dataLen]byte, len(entries))
+	var namespaces [][NamespaceLen]byte
+	if vm.genesis.Params.namespaced() {
+		namespaces = make([][NamespaceLen]byte, len(entries))
+	}
+	for i, entry := range entries {
+		values[i] = entry.data
+		if namespaces != nil {
+			namespaces[i] = entry.namespace
+		}
+	}
+	var submissions []SignedSubmission
+	if vm.genesis.Params.Accounts {
+		submissions = vm.pendingSubmissions.next(vm, preferredBlock, params, timestamp, values, namespaces, maxBatchSize)
+	}
+	var multisigs []MultisigProposal
+	if vm.genesis.Params.hasMultisigs() {
+		data, dataNamespaces := values, namespaces
+		for i := range submissions {
+			data = append(data, submissions[i].Data)
+			dataNamespaces = append(dataNamespaces, submissions[i].Namespace)
+		}
+		multisigs = vm.pendingMultisigs.next(vm, preferredBlock, params, timestamp, data, dataNamespaces, affordable-len(entries))
+	}
+	var transfers []Transfer
+	if vm.genesis.Params.Transfers {
+		fee, err := params.fee(vm.signer.Address(), baseFee, len(entries)+len(multisigs))
+		if err != nil {
+			return nil, vm.abandonBuild(entries, err)
+		}
+		transfers = vm.pendingTransfers.next(vm, preferredBlock, vm.signer.Address(), fee)
+	}
+	var claimTransfers []ClaimTransfer
+	if vm.genesis.Params.Claims {
+		claimTransfers = vm.pendingClaims.next(vm, preferredBlock)
+	}
+	var aclOps []ACLOp
+	if vm.genesis.Params.hasACLs() {
+		aclOps = vm.pendingACLOps.next(vm, preferredBlock)
+	}
+	var reveals []Reveal
+	if vm.genesis.Params.Reveals {
+		reveals = vm.pendingReveals.next(vm, preferredBlock)
+	}
+	var (
+		keyRegs   []KeyRegistration
+		encrypted []EncryptedPayload
+	)
+	if vm.genesis.Params.Encryption {
+		keyRegs, encrypted = vm.pendingEncryption.next(vm, preferredBlock)
+	}
+	var feedUpdates []FeedUpdate
+	if vm.genesis.Params.hasFeeds() {
+		feedUpdates = vm.pendingFeeds.next(vm, preferredBlock, timestamp.Unix())
+	}
+	var warpMessages [][]byte
+	if vm.genesis.Params.hasWarp() && blockCtx != nil {
+		warpMessages = vm.pendingWarp.next(ctx, vm, preferredBlock, blockCtx.PChainHeight)
+	}
+	var votes []GovernanceVote
+	if vm.genesis.Params.Governance {
+		votes = vm.pendingVotes.next(vm, preferredBlock)
+	}
+
+	// Build the block
+	block, err := vm.newBlock(vm.preferred, preferredBlock.Height()+1, values, namespaces, timestamp)
+	if err != nil {
+		return nil, vm.abandonBuild(entries, err)
+	}
+	if vm.genesis.Params.signsBlocks() {
+		block.Transfers = transfers
+		block.ClaimTransfers = claimTransfers
+		block.ACLOps = aclOps
+		block.Reveals = reveals
+		block.KeyRegs = keyRegs
+		block.Encrypted = encrypted
+		block.FeedUpdates = feedUpdates
+		block.WarpMessages = warpMessages
+		block.Votes = votes
+		block.Multisigs = multisigs
+		block.Submissions = submissions
+		// Leave out the operations whose signers can't pay for them
+		block.Ops = ops
+		if err := vm.dropUnpaid(block, preferredBlock, params); err != nil {
+			return nil, vm.abandonBuild(entries, err)
+		}
+		ops = block.Ops
+	}
+	// [ops] are added when the block is signed
+	if len(ops) == 0 && block.empty() { // There is no block to be built
+		return nil, errNoPendingBlocks
+	}
+	if vm.genesis.Params.signsBlocks() {
+		if err := vm.signBlock(ctx, block, ops); err != nil {
+			return nil, vm.abandonBuild(entries, err)
+		}
+	}
+	// A block finished after the deadline isn't handed to the engine, which
+	// may have given up on it
+	if err := ctx.Err(); err != nil {
+		return nil, vm.abandonBuild(entries, err)
+	}
+	vm.inFlight[block.ID()] = entries
+	vm.metrics.blocksBuilt.Inc()
 	return block, nil
 }
 
-// proposeBlock appends [data] to [p.mempool].
-// Then it notifies the consensus engine
-// that a new block is ready to be added to consensus
-// (namely, a block with data [data])
-func (vm *VM) proposeBlock(data [dataLen]byte) {
-	vm.mempool = append(vm.mempool, data)
-	vm.NotifyBlockReady()
+// hasPendingOps returns true iff this node has signed operations that
+// aren't in a block yet
+func (vm *VM) hasPendingOps() bool {
+	return vm.pendingOps.len() > 0 ||
+		vm.pendingTransfers.len() > 0 ||
+		vm.pendingClaims.len() > 0 ||
+		vm.pendingACLOps.len() > 0 ||
+		vm.pendingReveals.len() > 0 ||
+		vm.pendingEncryption.len() > 0 ||
+		vm.pendingFeeds.len() > 0 ||
+		vm.pendingWarp.len() > 0 ||
+		vm.pendingVotes.len() > 0 ||
+		vm.pendingMultisigs.len() > 0 ||
+		vm.pendingSubmissions.len() > 0
+}
+
+// abandonBuild puts [entries], the data of a block that couldn't be built
+// because of [err], back at the front of the mempool, so that it's in the
+// next block this node builds rather than held in the journal until a
+// restart. It returns [err].
+func (vm *VM) abandonBuild(entries []MempoolEntry, err error) error {
+	vm.metrics.buildFailures.Inc()
+	vm.logs.builder.Warn("couldn't build block",
+		zap.Int("numData", len(entries)),
+		zap.Error(err),
+	)
+	if len(entries) > 0 {
+		vm.builder.requeue(entries)
+	}
+	return err
+}
+
+// commitAccepted commits the writes of a block that was just accepted.
+// While bootstrapping, the writes of [bootstrapCommitInterval] accepted blocks
+// are committed together instead, which is far cheaper than committing each
+// block. Blocks whose writes weren't committed before a crash are fetched
+// again when the node restarts.
+func (vm *VM) commitAccepted() error {
+	if vm.bootstrapping {
+		vm.uncommitted++
+		if vm.uncommitted < bootstrapCommitInterval {
+			return nil
+		}
+	}
+	vm.uncommitted = 0
+	return vm.commit()
+}
+
+// commitBootstrapped commits the writes of the blocks accepted while
+// bootstrapping that haven't been committed yet
+func (vm *VM) commitBootstrapped() error {
+	if vm.uncommitted == 0 {
+		return nil
+	}
+	vm.uncommitted = 0
+	return vm.commit()
+}
+
+// commit commits the writes buffered in vm.db to the underlying database
+func (vm *VM) commit() error {
+	defer observeSince(vm.metrics.commitDuration, time.Now())
+	return vm.db.Commit()
+}
+
+// abort drops every write that hasn't been committed.
+// While bootstrapping, this includes the writes of the blocks accepted since
+// the last commit. The engine treats a failed accept as fatal, and those
+// blocks are fetched again when the node restarts.
+func (vm *VM) abort() {
+	vm.db.Abort()
+	vm.state.flushCaches()
+	vm.uncommitted = 0
+}
+
+// proposeBlock sends [data] to the block builder, which adds it to the
+// mempool and notifies the consensus engine once a block is ready to be
+// added to consensus (namely, a block containing [data])
+// Returns an error if the mempool is full or the vm is shutting down.
+func (vm *VM) proposeBlock(data [dataLen]byte) error {
+	_, _, err := vm.submitProposal(data, [NamespaceLen]byte{}, 0)
+	return err
+}
+
+// submitProposal is [vm.proposeBlock] for data in [namespace] that isn't put
+// into a block before the Unix time [notBefore]. It returns the proposal's ID
+// and a random token that cancels it.
+func (vm *VM) submitProposal(data [dataLen]byte, namespace [NamespaceLen]byte, notBefore int64) (uint64, [cancelTokenLen]byte, error) {
+	var cancelToken [cancelTokenLen]byte
+	if _, err := rand.Read(cancelToken[:]); err != nil {
+		return 0, cancelToken, err
+	}
+	id, err := vm.builder.schedule(data, namespace, notBefore, cancelToken)
+	if err == ErrMempoolFull {
+		vm.logs.mempool.Debug("dropping proposal", zap.Error(err))
+	}
+	return id, cancelToken, err
+}
+
+// GetBlock implements the snowman.ChainVM interface
+func (vm *VM) GetBlock(_ context.Context, blkID ids.ID) (snowman.Block, error) {
+	return vm.getBlock(blkID)
+}
+
+// getBlock returns the block with ID [blkID], looking at processing blocks
+// before the database
+func (vm *VM) getBlock(blkID ids.ID) (*Block, error) {
+	if blk, ok := vm.processing.get(blkID); ok {
+		return blk, nil
+	}
+	return vm.state.getBlock(blkID)
 }
 
 // ParseBlock parses [bytes] to a snowman.Block
 // This function is used by the vm's state to unmarshal blocks saved in state
-func (vm *VM) ParseBlock(bytes []byte) (snowman.Block, error) {
+// and by the consensus layer when it receives the byte representation of a block
+// from another node
+func (vm *VM) ParseBlock(_ context.Context, bytes []byte) (snowman.Block, error) {
+	// If we have already verified this block, return that version so that
+	// the bytes aren't decoded again
+	blkID := hashing.ComputeHash256Array(bytes)
+	if processing, ok := vm.processing.get(blkID); ok {
+		return processing, nil
+	}
+
+	block, err := vm.parseBlock(bytes)
+	if err != nil {
+		return nil, err
+	}
+	// If we have stored this block, its status is known
+	status, err := vm.state.getStatus(blkID)
+	switch {
+	case err == nil:
+		block.status = status
+	case err != database.ErrNotFound:
+		return nil, err
+	}
+	return block, nil
+}
+
+func (vm *VM) parseBlock(bytes []byte) (*Block, error) {
 	block := &Block{}
-	_, err := vm.codec.Unmarshal(bytes, block)
-	block.Initialize(bytes, &vm.SnowmanVM)
-	return block, err
+	version, err := vm.codec.Unmarshal(bytes, block)
+	if err != nil {
+		return nil, err
+	}
+	block.Initialize(bytes, choices.Processing, vm)
+	block.version = version
+	return block, nil
 }
 
 // NewBlock returns a new Block where:
 // - the block's parent is [parentID]
 // - the block's data is [data]
 // - the block's timestamp is [timestamp]
-// The block is persisted in storage
-func (vm *VM) NewBlock(parentID ids.ID, height uint64, data [dataLen]byte, timestamp time.Time) (*Block, error) {
+func (vm *VM) NewBlock(parentID ids.ID, height uint64, data [][dataLen]byte, timestamp time.Time) (*Block, error) {
+	return vm.newBlock(parentID, height, data, nil, timestamp)
+}
+
+// newBlock is [vm.NewBlock] for a block whose data is in [namespaces], in
+// the same order, on chains whose data has namespaces
+func (vm *VM) newBlock(parentID ids.ID, height uint64, data [][dataLen]byte, namespaces [][NamespaceLen]byte, timestamp time.Time) (*Block, error) {
 	block := &Block{
-		Block:     core.NewBlock(parentID, height),
-		Data:      data,
-		Timestamp: timestamp.Unix(),
+		PrntID: parentID,
+		Hght:   height,
+		Tmstmp: timestamp.Unix(),
+		Dt:     data,
+		Ns:     namespaces,
+	}
+	// Blocks made before the VM is initialized have no namespaces
+	version := uint16(codecVersion)
+	if vm.genesis != nil {
+		version = vm.genesis.Params.unsignedCodecVersion()
 	}
-	blockBytes, err := vm.codec.Marshal(codecVersion, block)
+	blockBytes, err := vm.marshal(version, block)
 	if err != nil {
 		return nil, err
 	}
-	block.Initialize(blockBytes, &vm.SnowmanVM)
+	block.Initialize(blockBytes, choices.Processing, vm)
+	block.version = version
 	return block, nil
 }
+
+// SetPreference sets the block with ID [blkID] as the preferred block
+func (vm *VM) SetPreference(_ context.Context, blkID ids.ID) error {
+	vm.preferred = blkID
+	return nil
+}
+
+// LastAccepted returns the ID of the last accepted block
+func (vm *VM) LastAccepted(context.Context) (ids.ID, error) {
+	return vm.state.getLastAccepted()
+}
+
+// GetBlockIDAtHeight returns the ID of the accepted block at [height].
+// Returns database.ErrNotFound if no block has been accepted at [height].
+func (vm *VM) GetBlockIDAtHeight(_ context.Context, height uint64) (ids.ID, error) {
+	return vm.state.getBlockIDAtHeight(height)
+}
+
+// maxPayloadSize returns the maximum number of bytes of data this node
+// accepts in a proposal
+func (vm *VM) maxPayloadSize() int {
+	vm.ctx.Lock.Lock()
+	defer vm.ctx.Lock.Unlock()
+
+	params, err := vm.nextParams()
+	if err != nil {
+		params = &vm.genesis.Params
+	}
+	return min(vm.config.Load().MaxPayloadSize, params.MaxPayloadSize)
+}
@@ -4,31 +4,165 @@
 package timestampvm
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tetratelabs/wazero"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/ava-labs/avalanchego/database"
 	"github.com/ava-labs/avalanchego/database/memdb"
 	"github.com/ava-labs/avalanchego/ids"
 	"github.com/ava-labs/avalanchego/snow"
+	"github.com/ava-labs/avalanchego/snow/choices"
 	"github.com/ava-labs/avalanchego/snow/engine/common"
-	"testing"
+	"github.com/ava-labs/avalanchego/snow/engine/enginetest"
+	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
+	"github.com/ava-labs/avalanchego/snow/snowtest"
+	"github.com/ava-labs/avalanchego/snow/validators"
+	"github.com/ava-labs/avalanchego/snow/validators/validatorstest"
+	"github.com/ava-labs/avalanchego/utils/cb58"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls"
+	"github.com/ava-labs/avalanchego/utils/crypto/bls/signer/localsigner"
+	"github.com/ava-labs/avalanchego/utils/crypto/secp256k1"
+	avajson "github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/logging"
+	"github.com/ava-labs/avalanchego/utils/rpc"
+	"github.com/ava-labs/avalanchego/utils/set"
+	"github.com/ava-labs/avalanchego/utils/timer/mockable"
+	"github.com/ava-labs/avalanchego/utils/wrappers"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp/payload"
+	"github.com/ava-labs/avalanchego/vms/proposervm/proposer"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+	"github.com/hitrich/AVM-TEST/light"
+	"github.com/hitrich/AVM-TEST/proof"
 )
 
 var blockchainID = ids.ID{1, 2, 3}
 
+// Utility function to build genesis bytes with default chain parameters
+// whose only piece of data is [genesisData]
+func testGenesisBytes(t *testing.T, genesisData []byte) []byte {
+	encoded, err := cb58.Encode(genesisData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisBytes, err := BuildGenesisBytes(&Genesis{
+		Params: ChainParams{MaxPayloadSize: dataLen},
+		Data:   []string{encoded},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genesisBytes
+}
+
+// Utility function to create and initialize a vm whose genesis data is
+// [genesisData]
+// Proposals are built into blocks immediately.
+func newTestVM(t *testing.T, genesisData []byte) (*VM, *snow.Context) {
+	return newTestVMWithConfig(t, genesisData, nil, []byte(`{"buildBatchWindow": "0s"}`))
+}
+
+// Utility function to create and initialize a vm with the given genesis,
+// upgrade and config bytes and fxs
+func newTestVMWithConfig(t *testing.T, genesisData, upgradeBytes, configBytes []byte, fxs ...*common.Fx) (*VM, *snow.Context) {
+	return initTestVM(t, snowtest.Context(t, blockchainID), genesisData, upgradeBytes, configBytes, fxs...)
+}
+
+// Utility function to initialize a vm with the given context
+func initTestVM(t *testing.T, ctx *snow.Context, genesisData, upgradeBytes, configBytes []byte, fxs ...*common.Fx) (*VM, *snow.Context) {
+	db := memdb.New()
+	vm := &VM{}
+	if err := vm.Initialize(context.Background(), ctx, db, testGenesisBytes(t, genesisData), upgradeBytes, configBytes, fxs, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return vm, ctx
+}
+
+// Utility function to create and initialize a vm with chain parameters
+// [params] and no genesis data
+// Proposals are built into blocks immediately.
+func newTestVMWithParams(t *testing.T, params ChainParams) *VM {
+	return newTestVMWithGenesis(t, &Genesis{Params: params}, []byte(`{"buildBatchWindow": "0s"}`))
+}
+
+// Utility function to create and initialize a vm with [genesis] and
+// [configBytes]
+func newTestVMWithGenesis(t testing.TB, genesis *Genesis, configBytes []byte) *VM {
+	genesisBytes, err := BuildGenesisBytes(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &VM{}
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), memdb.New(), genesisBytes, nil, configBytes, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return vm
+}
+
+// Utility function to assert that the vm reports pending data to the engine
+func assertPendingTxs(t *testing.T, vm *VM) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err := vm.WaitForEvent(ctx)
+	if err != nil {
+		t.Fatal("should have been pendingTxs message")
+	}
+	if msg != common.PendingTxs {
+		t.Fatal("Wrong message")
+	}
+}
+
 // Utility function to assert that [block] has:
 // * Parent with ID [parentID]
 // * Data [expectedData]
 // * Verify() returns nil iff passesVerify == true
 func assertBlock(block *Block, parentID ids.ID, expectedData [dataLen]byte, passesVerify bool) error {
-	if block.ParentID() != parentID {
-		return fmt.Errorf("expect parent ID to be %s but was %s", parentID, block.ParentID())
+	if block.Parent() != parentID {
+		return fmt.Errorf("expect parent ID to be %s but was %s", parentID, block.Parent())
 	}
-	if block.Data != expectedData {
-		return fmt.Errorf("expected data to be %v but was %v", expectedData, block.Data)
+	if data := block.Data(); len(data) != 1 || data[0] != expectedData {
+		return fmt.Errorf("expected data to be %v but was %v", expectedData, data)
 	}
-	if block.Verify() != nil && passesVerify {
+	if block.Verify(context.Background()) != nil && passesVerify {
 		return fmt.Errorf("expected block to pass verification but it fails")
 	}
-	if block.Verify() == nil && !passesVerify {
+	if block.Verify(context.Background()) == nil && !passesVerify {
 		return fmt.Errorf("expected block to fail verification but it passes")
 	}
 	return nil
@@ -37,30 +171,25 @@ func assertBlock(block *Block, parentID ids.ID, expectedData [dataLen]byte, pass
 // Assert that after initialization, the vm has the state we expect
 func TestGenesis(t *testing.T) {
 	// Initialize the vm
-	db := memdb.New()
-	msgChan := make(chan common.Message, 1)
-	vm := &VM{}
-	ctx := snow.DefaultContextTest()
-	ctx.ChainID = blockchainID
-
-	if err := vm.Initialize(ctx, db, []byte{0, 0, 0, 0, 0}, msgChan, nil); err != nil {
-		t.Fatal(err)
-	}
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
 
 	// Verify that the db is initialized
-	if !vm.DBInitialized() {
+	if initialized, err := vm.state.isInitialized(); err != nil || !initialized {
 		t.Fatal("db should be initialized")
 	}
 
 	// Get lastAccepted
-	lastAccepted := vm.LastAccepted()
+	lastAccepted, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
 	if lastAccepted == ids.Empty {
 		t.Fatal("lastAccepted should not be empty")
 	}
 
 	// Verify that getBlock returns the genesis block, and the genesis block
 	// is the type we expect
-	genesisSnowmanBlock, err := vm.GetBlock(lastAccepted) // genesisBlock as snowman.Block
+	genesisSnowmanBlock, err := vm.GetBlock(context.Background(), lastAccepted) // genesisBlock as snowman.Block
 	if err != nil {
 		t.Fatalf("couldn't get genesisBlock: %s", err)
 	}
@@ -76,52 +205,50 @@ func TestGenesis(t *testing.T) {
 }
 
 func TestHappyPath(t *testing.T) {
-	// Initialize the vm
-	db := memdb.New()
-	msgChan := make(chan common.Message, 1)
-	vm := &VM{}
-	ctx := snow.DefaultContextTest()
-	ctx.ChainID = blockchainID
-	if err := vm.Initialize(ctx, db, []byte{0, 0, 0, 0, 0}, msgChan, nil); err != nil {
+	vm, ctx := newTestVM(t, []byte{0, 0, 0, 0, 0})
+
+	lastAccepted, err := vm.LastAccepted(context.Background())
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	genesisBlock, err := vm.GetBlock(vm.LastAccepted())
+	genesisBlock, err := vm.GetBlock(context.Background(), lastAccepted)
 	if err != nil {
 		t.Fatal("could not get genesis block")
 	}
 	// in an actual execution, the engine would set the preference
-	vm.SetPreference(genesisBlock.ID())
+	if err := vm.SetPreference(context.Background(), genesisBlock.ID()); err != nil {
+		t.Fatal(err)
+	}
 
 	ctx.Lock.Lock()
-	vm.proposeBlock([dataLen]byte{0, 0, 0, 0, 1}) // propose a value
+	if err := vm.proposeBlock([dataLen]byte{0, 0, 0, 0, 1}); err != nil { // propose a value
+		t.Fatal(err)
+	}
 	ctx.Lock.Unlock()
 
-	select { // assert there is a pending tx message to the engine
-	case msg := <-msgChan:
-		if msg != common.PendingTxs {
-			t.Fatal("Wrong message")
-		}
-	default:
-		t.Fatal("should have been pendingTxs message on channel")
-	}
+	assertPendingTxs(t, vm) // assert there is a pending tx message to the engine
 
 	// build the block
 	ctx.Lock.Lock()
-	snowmanBlock2, err := vm.BuildBlock()
+	snowmanBlock2, err := vm.BuildBlock(context.Background())
 	if err != nil {
 		t.Fatalf("problem building block: %s", err)
 	}
-	if err := snowmanBlock2.Verify(); err != nil {
+	if err := snowmanBlock2.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := snowmanBlock2.Accept(context.Background()); err != nil { // accept the block
 		t.Fatal(err)
 	}
-	if err := snowmanBlock2.Accept(); err != nil { // accept the block
+	if err := vm.SetPreference(context.Background(), snowmanBlock2.ID()); err != nil {
 		t.Fatal(err)
 	}
-	vm.SetPreference(snowmanBlock2.ID())
 
 	// Should be the block we just accepted
-	snowmanBlock2, err = vm.GetBlock(vm.LastAccepted())
+	if lastAccepted, err = vm.LastAccepted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	snowmanBlock2, err = vm.GetBlock(context.Background(), lastAccepted)
 	if err != nil {
 		t.Fatal("couldn't get block")
 	}
@@ -134,35 +261,35 @@ func TestHappyPath(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	vm.proposeBlock([dataLen]byte{0, 0, 0, 0, 2}) // propose a block
+	if err := vm.proposeBlock([dataLen]byte{0, 0, 0, 0, 2}); err != nil { // propose a block
+		t.Fatal(err)
+	}
 	ctx.Lock.Unlock()
 
-	select { // verify there is a pending tx message to the engine
-	case msg := <-msgChan:
-		if msg != common.PendingTxs {
-			t.Fatal("Wrong message")
-		}
-	default:
-		t.Fatal("should have been pendingTxs message on channel")
-	}
+	assertPendingTxs(t, vm) // verify there is a pending tx message to the engine
 
 	ctx.Lock.Lock()
 
 	// build the block
-	if block, err := vm.BuildBlock(); err != nil {
+	if block, err := vm.BuildBlock(context.Background()); err != nil {
 		t.Fatalf("problem building block: %s", err)
 	} else {
-		if err := block.Verify(); err != nil {
+		if err := block.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := block.Accept(context.Background()); err != nil { // accept the block
 			t.Fatal(err)
 		}
-		if err := block.Accept(); err != nil { // accept the block
+		if err := vm.SetPreference(context.Background(), block.ID()); err != nil {
 			t.Fatal(err)
 		}
-		vm.SetPreference(block.ID())
 	}
 
 	// The block we just accepted
-	snowmanBlock3, err := vm.GetBlock(vm.LastAccepted())
+	if lastAccepted, err = vm.LastAccepted(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	snowmanBlock3, err := vm.GetBlock(context.Background(), lastAccepted)
 	if err != nil {
 		t.Fatal("couldn't get block")
 	}
@@ -176,12 +303,12 @@ func TestHappyPath(t *testing.T) {
 	}
 
 	// Next, check the blocks we added are there
-	if block2FromState, err := vm.GetBlock(block2.ID()); err != nil {
+	if block2FromState, err := vm.GetBlock(context.Background(), block2.ID()); err != nil {
 		t.Fatal(err)
 	} else if block2FromState.ID() != block2.ID() {
 		t.Fatal("expected IDs to match but they don't")
 	}
-	if block3FromState, err := vm.GetBlock(block3.ID()); err != nil {
+	if block3FromState, err := vm.GetBlock(context.Background(), block3.ID()); err != nil {
 		t.Fatal(err)
 	} else if block3FromState.ID() != block3.ID() {
 		t.Fatal("expected IDs to match but they don't")
@@ -191,18 +318,6077 @@ func TestHappyPath(t *testing.T) {
 }
 
 func TestService(t *testing.T) {
-	// Initialize the vm
-	db := memdb.New()
-	msgChan := make(chan common.Message, 1)
-	vm := &VM{}
-	ctx := snow.DefaultContextTest()
-	ctx.ChainID = blockchainID
-	if err := vm.Initialize(ctx, db, []byte{0, 0, 0, 0, 0}, msgChan, nil); err != nil {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+
+	service := Service{vm}
+	reply := &GetBlockReply{}
+	if err := service.GetBlock(nil, &GetBlockArgs{}, reply); err != nil {
 		t.Fatal(err)
 	}
+	if reply.Status != choices.Accepted.String() {
+		t.Fatalf("expected the last accepted block to be %s but got %s", choices.Accepted, reply.Status)
+	}
 
-	service := Service{vm}
-	if err := service.GetBlock(nil, &GetBlockArgs{}, &GetBlockReply{}); err != nil {
+	// Processing blocks are reported as such
+	blk, err := vm.NewBlock(vm.preferred, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.GetBlock(nil, &GetBlockArgs{ID: blk.ID().String()}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status != choices.Processing.String() {
+		t.Fatalf("expected the verified block to be %s but got %s", choices.Processing, reply.Status)
+	}
+}
+
+// Assert that once duplicate rejection is active, a block repeating an
+// ancestor's data fails verification
+func TestDuplicateRejection(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, []byte(`{"duplicateRejection": {"height": 3}}`), nil)
+	data := [dataLen]byte{0, 0, 0, 0, 1}
+
+	// Before activation, repeating data is allowed
+	for i := 0; i < 2; i++ {
+		if err := vm.proposeBlock(data); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatalf("block at height %d should pass verification: %s", blk.Height(), err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := vm.proposeBlock(data); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != errDuplicateData {
+		t.Fatalf("expected %s but got %v", errDuplicateData, err)
+	}
+}
+
+// Assert that a block whose height isn't one more than its parent's fails
+// verification
+func TestWrongHeight(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, height := range []uint64{0, 2, 100} {
+		blk, err := vm.NewBlock(genesisID, height, [][dataLen]byte{{1}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != errWrongHeight {
+			t.Fatalf("expected %s for a child of genesis at height %d but got %v", errWrongHeight, height, err)
+		}
+	}
+}
+
+// Assert that payload rules added by an upgrade are enforced from their
+// activation and by the API
+func TestPayloadPolicyUpgrade(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, []byte(`{"payloadPolicy": {"height": 2, "rules": ["nonZero"], "validators": [{"type": "regex", "pattern": "^[^x]"}]}}`), nil)
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Before activation, zero data and data the validators refuse is allowed
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{}, {'x'}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
 		t.Fatal(err)
 	}
+
+	blk, err = vm.NewBlock(blk.ID(), 2, [][dataLen]byte{{1}, {}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != errZeroPayload {
+		t.Fatalf("expected %s but got %v", errZeroPayload, err)
+	}
+	refused, err := vm.NewBlock(blk.Parent(), 2, [][dataLen]byte{{'x'}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := refused.Verify(context.Background()); !errors.Is(err, errPayloadPattern) {
+		t.Fatalf("expected %s but got %v", errPayloadPattern, err)
+	}
+
+	service := &Service{vm}
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: "1c7hwa"}, &ProposeBlockReply{}); err != errZeroPayload { // cb58 of 0x00
+		t.Fatalf("expected %s but got %v", errZeroPayload, err)
+	}
+}
+
+// testFx rejects every block whose first data byte is [banned]
+type testFx struct {
+	vm     *VM
+	banned byte
+}
+
+func (fx *testFx) Initialize(vm *VM) error {
+	fx.vm = vm
+	return nil
+}
+
+func (fx *testFx) VerifyBlock(blk *Block) error {
+	for _, data := range blk.Data() {
+		if data[0] == fx.banned {
+			return ErrBadData
+		}
+	}
+	return nil
+}
+
+// testPayloadFx refuses data whose last byte isn't the XOR of its other
+// bytes, standing in for a proof embedded in the data
+type testPayloadFx struct{}
+
+func (testPayloadFx) Initialize(*VM) error {
+	return nil
+}
+
+func (testPayloadFx) VerifyPayload(data [dataLen]byte) error {
+	var checksum byte
+	for _, b := range data[:dataLen-1] {
+		checksum ^= b
+	}
+	if data[dataLen-1] != checksum {
+		return ErrBadData
+	}
+	return nil
+}
+
+// Assert that an fx's payload verifier refuses proposals over the API and
+// makes blocks with invalid data invalid
+func TestFxPayloadVerifier(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s"}`), &common.Fx{ID: ids.ID{'p', 'a', 'y'}, Fx: testPayloadFx{}})
+	service := &Service{vm}
+
+	invalid := [dataLen]byte{1, 2}
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: encoding.EncodeCB58(invalid[:])}, &ProposeBlockReply{}); err != ErrBadData {
+		t.Fatalf("expected %s but got %v", ErrBadData, err)
+	}
+	valid := invalid
+	valid[dataLen-1] = 1 ^ 2
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: encoding.EncodeCB58(valid[:])}, &ProposeBlockReply{}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block built by a node without the fx is invalid
+	built := blk.(*Block)
+	forged, err := vm.NewBlock(built.Parent(), built.Height(), [][dataLen]byte{invalid}, built.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forged.Verify(context.Background()); err != ErrBadData {
+		t.Fatalf("expected %s but got %v", ErrBadData, err)
+	}
+}
+
+// Assert that the chain's payload validators refuse proposals over the API
+// and make blocks with invalid data invalid, and that the validators in the
+// config only refuse proposals
+func TestPayloadValidators(t *testing.T) {
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		PayloadValidators: []PayloadValidatorConfig{
+			{Type: RegexValidatorType, Pattern: "^[a-z]+$"},
+			{Type: SizeValidatorType, MinSize: 2, MaxSize: 8},
+		},
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(`{
+		"buildBatchWindow": "0s",
+		"payloadValidation": {"validators": [{"type": "size", "maxSize": 6}]}
+	}`))
+	service := &Service{vm}
+
+	for _, test := range []struct {
+		data        string
+		expectedErr error
+	}{
+		{data: "Upper", expectedErr: errPayloadPattern},
+		{data: "a", expectedErr: errPayloadSizeOutRange},
+		{data: "muchtoolong", expectedErr: errPayloadSizeOutRange},
+		{data: "toolong", expectedErr: errPayloadSizeOutRange},
+		{data: "valid"},
+	} {
+		err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: encoding.EncodeCB58([]byte(test.data))}, &ProposeBlockReply{})
+		if !errors.Is(err, test.expectedErr) {
+			t.Fatalf("expected %v for %q but got %v", test.expectedErr, test.data, err)
+		}
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A block built by a node without the validators is invalid
+	built := blk.(*Block)
+	forged, err := vm.NewBlock(built.Parent(), built.Height(), [][dataLen]byte{{'a', 'b'}, {'A'}}, built.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := forged.Verify(context.Background()); !errors.Is(err, errPayloadPattern) {
+		t.Fatalf("expected %s but got %v", errPayloadPattern, err)
+	}
+	// The config's validators don't apply to blocks
+	local, err := vm.NewBlock(built.Parent(), built.Height(), [][dataLen]byte{{'t', 'o', 'o', 'l', 'o', 'n', 'g'}}, built.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Added validators run alongside the configured ones
+	short, err := NewSizeValidator(0, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.AddPayloadValidator(short)
+	if err := vm.verifyProposal([]byte("valid"), [NamespaceLen]byte{}); !errors.Is(err, errPayloadSizeOutRange) {
+		t.Fatalf("expected %s but got %v", errPayloadSizeOutRange, err)
+	}
+
+	digest, err := NewDigestValidator("md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := digest.ValidatePayload([dataLen]byte{dataLen - 1: 1}); !errors.Is(err, errNotDigest) {
+		t.Fatalf("expected %s but got %v", errNotDigest, err)
+	}
+	if err := digest.ValidatePayload([dataLen]byte{15: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that fxs passed to Initialize are initialized and their
+// verification hooks are run
+func TestFxVerifyHook(t *testing.T) {
+	fx := &testFx{banned: 0xff}
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, nil, &common.Fx{ID: ids.ID{'t', 'e', 's', 't'}, Fx: fx})
+	if fx.vm != vm {
+		t.Fatal("fx should have been initialized with the vm")
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{0xff}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != ErrBadData {
+		t.Fatalf("expected %s but got %v", ErrBadData, err)
+	}
+
+	if err := (&VM{}).Initialize(context.Background(), snowtest.Context(t, blockchainID), memdb.New(), testGenesisBytes(t, nil), nil, nil, []*common.Fx{{Fx: struct{}{}}}, nil); err == nil {
+		t.Fatal("expected fx that doesn't implement Fx to be rejected")
+	}
+}
+
+// Assert that proposals arriving within the build batch window are put into
+// one block
+func TestBuildBatchWindow(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "50ms"}`))
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPendingTxs(t, vm)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("engine was notified after %s, before the batch window elapsed", elapsed)
+	}
+
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 2 || data[0] != ([dataLen]byte{1}) || data[1] != ([dataLen]byte{2}) {
+		t.Fatalf("expected both proposals in the block but got %v", data)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that the engine isn't told to build again once a block holds all of
+// the mempool's data
+func TestDrainedMempoolNotReady(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s"}`))
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	assertPendingTxs(t, vm)
+	if _, err := vm.BuildBlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if msg, err := vm.WaitForEvent(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the engine to wait but got %v, %v", msg, err)
+	}
+}
+
+// Assert that the builder stops accepting proposals once the vm shuts down
+func TestBuilderShutdown(t *testing.T) {
+	vm := &VM{}
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), memdb.New(), testGenesisBytes(t, nil), nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock([dataLen]byte{2}); err != errShuttingDown {
+		t.Fatalf("expected %s but got %v", errShuttingDown, err)
+	}
+	if _, err := vm.WaitForEvent(context.Background()); err != errShuttingDown {
+		t.Fatalf("expected %s but got %v", errShuttingDown, err)
+	}
+}
+
+// Assert that accepted blocks are indexed by height, including on databases
+// created before the height index existed
+func TestGetBlockIDAtHeight(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.GetBlockIDAtHeight(context.Background(), 1); err != database.ErrNotFound {
+		t.Fatalf("expected processing block not to be indexed but got %v", err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for height, expectedID := range []ids.ID{genesisID, blk.ID()} {
+		blkID, err := vm.GetBlockIDAtHeight(context.Background(), uint64(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blkID != expectedID {
+			t.Fatalf("expected block %s at height %d but got %s", expectedID, height, blkID)
+		}
+	}
+
+	// Drop the index and check that it is rebuilt
+	for height := uint64(0); height <= 1; height++ {
+		if err := vm.state.heightDB.Delete(database.PackUInt64(height)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.state.repairHeightIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if blkID, err := vm.GetBlockIDAtHeight(context.Background(), 0); err != nil || blkID != genesisID {
+		t.Fatalf("expected genesis to be re-indexed but got %s, %v", blkID, err)
+	}
+}
+
+// Assert that, with proposer window building enabled, blocks are only built
+// during this node's slot
+func TestBuildBlockWithContext(t *testing.T) {
+	ctx := snowtest.Context(t, blockchainID)
+	otherNodeID := ids.GenerateTestNodeID()
+	ctx.ValidatorState = &validatorstest.State{
+		GetValidatorSetF: func(context.Context, uint64, ids.ID) (map[ids.NodeID]*validators.GetValidatorOutput, error) {
+			return map[ids.NodeID]*validators.GetValidatorOutput{
+				otherNodeID: {NodeID: otherNodeID, Weight: 1},
+			}, nil
+		},
+	}
+	vm, _ := initTestVM(t, ctx, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "proposerWindowBuilding": true}`))
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlockWithContext(context.Background(), &block.Context{}); err != errNotProposer {
+		t.Fatalf("expected %s but got %v", errNotProposer, err)
+	}
+
+	// The data must still be in the mempool once this node is the proposer
+	ctx.ValidatorState = &validatorstest.State{
+		GetValidatorSetF: func(context.Context, uint64, ids.ID) (map[ids.NodeID]*validators.GetValidatorOutput, error) {
+			return map[ids.NodeID]*validators.GetValidatorOutput{
+				ctx.NodeID: {NodeID: ctx.NodeID, Weight: 1},
+			}, nil
+		},
+	}
+	vm.windower = proposer.New(ctx.ValidatorState, ctx.SubnetID, ctx.ChainID)
+	blk, err := vm.BuildBlockWithContext(context.Background(), &block.Context{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 1 || data[0] != ([dataLen]byte{1}) {
+		t.Fatalf("expected the proposed data in the block but got %v", data)
+	}
+}
+
+// Assert that a node only builds blocks if its config allows it to, and that
+// other nodes still accept its blocks
+func TestAllowedProposers(t *testing.T) {
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "allowedProposers": [%q]}`, ids.GenerateTestNodeID()))
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, configBytes)
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlock(context.Background()); err != errNotAllowedProposer {
+		t.Fatalf("expected %s but got %v", errNotAllowedProposer, err)
+	}
+
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{2}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that a node waits out its stake-weighted build backoff before
+// building a block, and that nodes that aren't validators wait the longest
+func TestBuildBackoff(t *testing.T) {
+	ctx := snowtest.Context(t, blockchainID)
+	otherNodeID := ids.GenerateTestNodeID()
+	ctx.ValidatorState = &validatorstest.State{
+		GetCurrentHeightF: func(context.Context) (uint64, error) {
+			return 0, nil
+		},
+		GetValidatorSetF: func(context.Context, uint64, ids.ID) (map[ids.NodeID]*validators.GetValidatorOutput, error) {
+			return map[ids.NodeID]*validators.GetValidatorOutput{
+				otherNodeID: {NodeID: otherNodeID, Weight: 1},
+			}, nil
+		},
+	}
+	vm, _ := initTestVM(t, ctx, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "buildBackoff": "1m"}`))
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := vm.BuildBlock(context.Background()); err != errBuildBackoff {
+		t.Fatalf("expected %s but got %v", errBuildBackoff, err)
+	}
+	if backoff := vm.backoff.until.Sub(start); backoff < 9*time.Minute {
+		t.Fatalf("expected the max backoff but got %s", backoff)
+	}
+
+	// The backoff isn't redrawn, and the data is still in the mempool once
+	// the backoff elapses
+	vm.backoff.until = time.Now()
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 1 || data[0] != ([dataLen]byte{1}) {
+		t.Fatalf("expected the proposed data in the block but got %v", data)
+	}
+}
+
+// Assert that proposed data that wasn't decided before the vm stopped is put
+// back into the mempool when the vm restarts
+func TestMempoolJournal(t *testing.T) {
+	db := memdb.New()
+	// initVM initializes a vm on [db] without closing [db] on shutdown
+	initVM := func() *VM {
+		vm := &VM{}
+		if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, testGenesisBytes(t, []byte{0, 0, 0, 0, 0}), nil, []byte(`{"buildBatchWindow": "0s"}`), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(vm.builder.stop)
+		return vm
+	}
+
+	vm := initVM()
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	// The block is built but the vm stops before it is decided
+	if _, err := vm.BuildBlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	vm = initVM()
+	assertPendingTxs(t, vm)
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 2 {
+		t.Fatalf("expected both proposals to be restored but got %v", data)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepted data is removed from the journal
+	vm = initVM()
+	if _, err := vm.BuildBlock(context.Background()); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+}
+
+// Assert that operations and aggregated hashes submitted over the API that
+// weren't accepted are put back into their pools when the vm restarts, and
+// are removed from the journal once they are accepted
+func TestOpJournal(t *testing.T) {
+	keys := make([]*secp256k1.PrivateKey, 3)
+	for i := range keys {
+		key, err := secp256k1.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	genesisBytes, err := BuildGenesisBytes(&Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Transfers:      true,
+			Multisigs: []MultisigConfig{{
+				ID:        "board",
+				Signers:   []ids.ShortID{keys[0].Address(), keys[1].Address()},
+				Threshold: 2,
+			}},
+		},
+		Allocations: []Allocation{{Address: keys[0].Address(), Balance: 10}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q, "aggregation": {"interval": "1h"}}`, keys[2].String()))
+	db := memdb.New()
+	// initVM initializes a vm on [db] without closing [db] on shutdown
+	initVM := func() *VM {
+		vm := &VM{}
+		if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, genesisBytes, nil, config, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(vm.builder.stop)
+		t.Cleanup(vm.aggregator.stop)
+		return vm
+	}
+
+	vm := initVM()
+	transfer := Transfer{To: keys[1].Address(), Amount: 4}
+	if err := transfer.Sign(vm.ctx.ChainID, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.addTransfer(transfer); err != nil {
+		t.Fatal(err)
+	}
+	proposal := MultisigProposal{Data: [dataLen]byte{1}}
+	copy(proposal.Set[:], "board")
+	for _, key := range keys[:2] {
+		if err := proposal.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := vm.addMultisigSignature(proposal.Set, proposal.Data, proposal.Namespace, proposal.Sigs[len(proposal.Sigs)-1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := [dataLen]byte{2}
+	if err := vm.submitHash(hash); err != nil {
+		t.Fatal(err)
+	}
+
+	vm = initVM()
+	if vm.pendingTransfers.len() != 1 || vm.pendingMultisigs.len() != 1 {
+		t.Fatalf("expected the transfer and proposal to be restored but got %d and %d", vm.pendingTransfers.len(), vm.pendingMultisigs.len())
+	}
+	if _, _, err := vm.aggregatedPath(hash); err != errHashPending {
+		t.Fatalf("expected %s but got %v", errHashPending, err)
+	}
+	if err := vm.aggregator.flush(); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := blk.(*Block)
+	if len(built.Transfers) != 1 || len(built.Multisigs) != 1 || len(built.Multisigs[0].Sigs) != 2 {
+		t.Fatalf("expected the restored transfer and proposal but got %+v and %+v", built.Transfers, built.Multisigs)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepted operations and aggregated hashes are removed from the journal
+	vm = initVM()
+	if vm.pendingTransfers.len() != 0 || vm.pendingMultisigs.len() != 0 || vm.aggregator.isPending.Len() != 0 {
+		t.Fatal("expected accepted operations and aggregated hashes not to be restored")
+	}
+	for _, journal := range []database.Database{vm.opJournal.db, vm.aggregator.journal} {
+		it := journal.NewIterator()
+		if it.Next() {
+			t.Fatalf("expected the journal to be empty but it has %x", it.Key())
+		}
+		it.Release()
+	}
+}
+
+// lifoMempool is a Mempool that puts the latest proposed data into blocks
+// first
+type lifoMempool struct {
+	entries []MempoolEntry
+}
+
+func (m *lifoMempool) Push(entry MempoolEntry) {
+	m.entries = append(m.entries, entry)
+}
+
+func (m *lifoMempool) Requeue(entries []MempoolEntry) {
+	for i := len(entries) - 1; i >= 0; i-- {
+		m.Push(entries[i])
+	}
+}
+
+func (m *lifoMempool) Pop(n int) []MempoolEntry {
+	var popped []MempoolEntry
+	for ; n > 0 && len(m.entries) > 0; n-- {
+		popped = append(popped, m.entries[len(m.entries)-1])
+		m.entries = m.entries[:len(m.entries)-1]
+	}
+	return popped
+}
+
+func (m *lifoMempool) Get(id uint64) (MempoolEntry, bool) {
+	for _, entry := range m.entries {
+		if entry.ID() == id {
+			return entry, true
+		}
+	}
+	return MempoolEntry{}, false
+}
+
+func (m *lifoMempool) Remove(id uint64) {
+	m.entries = slices.DeleteFunc(m.entries, func(e MempoolEntry) bool {
+		return e.ID() == id
+	})
+}
+
+func (m *lifoMempool) Len() int {
+	return len(m.entries)
+}
+
+// Assert that a vm built by NewVM stores blocks before it's initialized and
+// keeps its dependencies once it is
+func TestNewVM(t *testing.T) {
+	db := memdb.New()
+	clock := &mockable.Clock{}
+	clock.Set(time.Unix(2_000_000_000, 0))
+	vm, err := NewVM(WithDatabase(db), WithClock(clock), WithMempool(&lifoMempool{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := vm.NewBlock(ids.GenerateTestID(), 1, [][dataLen]byte{{1}}, clock.Time())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.state.putBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := vm.parseBlock(blk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID() != blk.ID() {
+		t.Fatalf("expected block %s but got %s", blk.ID(), parsed.ID())
+	}
+
+	ignoredDB := memdb.New()
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), ignoredDB, testGenesisBytes(t, nil), nil, []byte(`{"buildBatchWindow": "0s"}`), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	it := ignoredDB.NewIterator()
+	defer it.Release()
+	if it.Next() {
+		t.Fatal("expected the vm not to write to the database it was initialized with")
+	}
+	if _, err := vm.getBlock(blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][dataLen]byte{{2}, {3}} {
+		if err := vm.proposeBlock(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	built, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := built.(*Block).Data(); len(data) != 2 || data[0] != [dataLen]byte{3} {
+		t.Fatalf("expected the latest data to be built into the block first but got %v", data)
+	}
+	if !built.Timestamp().Equal(clock.Time()) {
+		t.Fatalf("expected the block to be timestamped at %s but got %s", clock.Time(), built.Timestamp())
+	}
+}
+
+// Assert that scheduled data is held until its earliest inclusion time, even
+// across restarts
+func TestScheduledProposal(t *testing.T) {
+	db := memdb.New()
+	// initVM initializes a vm on [db] without closing [db] on shutdown
+	initVM := func() *VM {
+		vm := &VM{}
+		if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, testGenesisBytes(t, []byte{0, 0, 0, 0, 0}), nil, []byte(`{"buildBatchWindow": "0s"}`), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(vm.builder.stop)
+		return vm
+	}
+
+	vm := initVM()
+	service := &Service{vm}
+	later, err := cb58.Encode([]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := avajson.Uint64(time.Now().Add(time.Hour).Unix())
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: later, NotBefore: notBefore}, &ProposeBlockReply{}); err != nil {
+		t.Fatal(err)
+	}
+	size := &GetMempoolSizeReply{}
+	if err := service.GetMempoolSize(nil, nil, size); err != nil {
+		t.Fatal(err)
+	}
+	if size.Size != 0 || size.Scheduled != 1 {
+		t.Fatalf("expected the data to be scheduled but got %+v", size)
+	}
+	if _, err := vm.BuildBlock(context.Background()); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+
+	// The schedule is restored from the journal
+	vm = initVM()
+	service = &Service{vm}
+	if vm.builder.scheduledLen() != 1 {
+		t.Fatalf("expected the scheduled data to be restored but %d pieces are scheduled", vm.builder.scheduledLen())
+	}
+	soon, err := cb58.Encode([]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore = avajson.Uint64(time.Now().Add(time.Second).Unix())
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: soon, NotBefore: notBefore}, &ProposeBlockReply{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if msg, err := vm.WaitForEvent(ctx); err != nil || msg != common.PendingTxs {
+		t.Fatalf("expected the data to be due but got %v, %v", msg, err)
+	}
+	if now := time.Now().Unix(); now < int64(notBefore) {
+		t.Fatalf("data was offered at %d, before %d", now, notBefore)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 1 || data[0] != ([dataLen]byte{2}) {
+		t.Fatalf("expected only the due data in the block but got %v", data)
+	}
+}
+
+// Assert that pending proposals can only be cancelled with their cancel token
+// or the admin token, and are removed from the journal when they are
+func TestCancelProposal(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "adminToken": "secret"}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	scheduled, scheduledToken, err := client.SubmitProposal(ctx, []byte{1}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, dueToken, err := client.SubmitProposal(ctx, []byte{2}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled == due || scheduledToken == dueToken {
+		t.Fatalf("expected proposals to have distinct IDs and cancel tokens but got %d, %s and %d, %s", scheduled, scheduledToken, due, dueToken)
+	}
+
+	// Another proposal's token, no token and the wrong admin token don't
+	// cancel a proposal
+	for _, test := range []struct {
+		cancelToken string
+		options     []rpc.Option
+	}{
+		{cancelToken: dueToken},
+		{},
+		{options: []rpc.Option{rpc.WithHeader("Authorization", "Bearer wrong")}},
+	} {
+		if err := client.CancelProposal(ctx, scheduled, test.cancelToken, test.options...); err == nil || !strings.Contains(err.Error(), errBadCancelToken.Error()) {
+			t.Fatalf("expected %s but got %v", errBadCancelToken, err)
+		}
+	}
+	if err := client.CancelProposal(ctx, scheduled, "1c7hwa"); err == nil || !strings.Contains(err.Error(), errBadCancelToken.Error()) {
+		t.Fatalf("expected a malformed cancel token to be refused but got %v", err)
+	}
+	if err := client.CancelProposal(ctx, scheduled, scheduledToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CancelProposal(ctx, due, "", rpc.WithHeader("Authorization", "Bearer secret")); err != nil {
+		t.Fatal(err)
+	}
+	if vm.builder.len() != 0 || vm.builder.scheduledLen() != 0 {
+		t.Fatalf("expected no pending proposals but %d are due and %d are scheduled", vm.builder.len(), vm.builder.scheduledLen())
+	}
+	if err := client.CancelProposal(ctx, due, dueToken); err == nil || !strings.Contains(err.Error(), errUnknownProposal.Error()) {
+		t.Fatalf("expected %s but got %v", errUnknownProposal, err)
+	}
+	if _, pending, err := newJournal(vm.builder.journal.db); err != nil || len(pending) != 0 {
+		t.Fatalf("expected cancelled proposals to be removed from the journal but got %v (%v)", pending, err)
+	}
+
+	// Proposals put into a block are no longer pending
+	built, builtToken, err := client.SubmitProposal(ctx, []byte{3}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CancelProposal(ctx, built, builtToken); err == nil || !strings.Contains(err.Error(), errUnknownProposal.Error()) {
+		t.Fatalf("expected %s but got %v", errUnknownProposal, err)
+	}
+}
+
+// Assert that with a mempool that isn't a CancellableMempool, only scheduled
+// proposals can be cancelled
+func TestCancelProposalPlainMempool(t *testing.T) {
+	vm := &VM{mempool: struct{ Mempool }{&fifoMempool{}}}
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), memdb.New(), testGenesisBytes(t, nil), nil, []byte(`{"buildBatchWindow": "0s"}`), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	scheduled, scheduledToken, err := vm.submitProposal([dataLen]byte{1}, [NamespaceLen]byte{}, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	due, dueToken, err := vm.submitProposal([dataLen]byte{2}, [NamespaceLen]byte{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.cancelProposal(scheduled, scheduledToken, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.cancelProposal(due, dueToken, false); err != errNotCancellable {
+		t.Fatalf("expected %s but got %v", errNotCancellable, err)
+	}
+}
+
+// Assert that a vm configured with a checkpoint fetches the checkpoint block
+// from a peer and starts from it
+func TestCheckpointSync(t *testing.T) {
+	source, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	for i := byte(1); i <= 2; i++ {
+		if err := source.proposeBlock([dataLen]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := source.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := source.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpointID, err := source.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "checkpoint": {"height": 2, "blockID": %q}}`, checkpointID))
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, configBytes)
+	if err := vm.SetState(context.Background(), snow.StateSyncing); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := vm.StateSyncEnabled(context.Background()); err != nil || !enabled {
+		t.Fatalf("expected state sync to be enabled but got %v, %v", enabled, err)
+	}
+
+	// The source votes for the checkpoint summary
+	localSummary, err := vm.GetOngoingSyncStateSummary(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceSummary, err := source.GetStateSummary(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localSummary.ID() != sourceSummary.ID() {
+		t.Fatal("expected the source to have the checkpoint summary")
+	}
+
+	// Wire the two vms together
+	peerID := ids.GenerateTestNodeID()
+	var request []byte
+	vm.appSender = &enginetest.Sender{
+		SendAppRequestF: func(_ context.Context, nodeIDs set.Set[ids.NodeID], _ uint32, bytes []byte) error {
+			if !nodeIDs.Contains(peerID) {
+				t.Fatalf("expected request to be sent to %s", peerID)
+			}
+			request = bytes
+			return nil
+		},
+	}
+	var response []byte
+	source.appSender = &enginetest.Sender{
+		SendAppResponseF: func(_ context.Context, _ ids.NodeID, _ uint32, bytes []byte) error {
+			response = bytes
+			return nil
+		},
+	}
+
+	if err := vm.Connected(context.Background(), peerID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if mode, err := localSummary.Accept(context.Background()); err != nil || mode != block.StateSyncStatic {
+		t.Fatalf("expected static state sync but got %s, %v", mode, err)
+	}
+	if err := source.AppRequest(context.Background(), peerID, 1, time.Now(), request); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.AppResponse(context.Background(), peerID, 1, response); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if msg, err := vm.WaitForEvent(ctx); err != nil || msg != common.StateSyncDone {
+		t.Fatalf("expected state sync done but got %s, %v", msg, err)
+	}
+	if lastAccepted, err := vm.LastAccepted(context.Background()); err != nil || lastAccepted != checkpointID {
+		t.Fatalf("expected checkpoint to be last accepted but got %s, %v", lastAccepted, err)
+	}
+	if blkID, err := vm.GetBlockIDAtHeight(context.Background(), 2); err != nil || blkID != checkpointID {
+		t.Fatalf("expected checkpoint at height 2 but got %s, %v", blkID, err)
+	}
+	// The block before the checkpoint is never fetched
+	if _, err := vm.GetBlockIDAtHeight(context.Background(), 1); err != database.ErrNotFound {
+		t.Fatalf("expected no block at height 1 but got %v", err)
+	}
+
+	// Summaries other than the checkpoint are skipped
+	sourceSummary, err = source.GetStateSummary(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSummary, err := vm.ParseStateSummary(context.Background(), sourceSummary.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode, err := otherSummary.Accept(context.Background()); err != nil || mode != block.StateSyncSkipped {
+		t.Fatalf("expected summary to be skipped but got %s, %v", mode, err)
+	}
+
+	// Chains whose rules depend on the blocks before the checkpoint can't
+	// sync to it
+	for _, test := range []struct {
+		params       ChainParams
+		upgradeBytes []byte
+		expectedErr  error
+	}{
+		{
+			params:      ChainParams{MaxPayloadSize: dataLen, MedianTimePastWindow: 3},
+			expectedErr: errCheckpointMedianTime,
+		},
+		{
+			params:       ChainParams{MaxPayloadSize: dataLen},
+			upgradeBytes: []byte(`{"duplicateRejection": {"height": 100}}`),
+			expectedErr:  errCheckpointDuplicates,
+		},
+		{
+			params:       ChainParams{MaxPayloadSize: dataLen},
+			upgradeBytes: []byte(`{"payloadPolicy": {"height": 100, "rules": ["keyValue"]}}`),
+			expectedErr:  errCheckpointIndexes,
+		},
+	} {
+		genesisBytes, err := BuildGenesisBytes(&Genesis{Params: test.params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = (&VM{}).Initialize(context.Background(), snowtest.Context(t, blockchainID), memdb.New(), genesisBytes, test.upgradeBytes, configBytes, nil, nil)
+		if !errors.Is(err, test.expectedErr) {
+			t.Fatalf("expected %v but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+// Assert that verified blocks are only persisted once they are accepted, and
+// that rejected blocks are discarded when rejected blocks are pruned
+func TestVerifyDoesNotPersist(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "pruningMode": "rejected"}`))
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := make([]*Block, 2)
+	for i := range blocks {
+		blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{byte(i + 1)}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if has, err := vm.state.blockDB.Has(blk.id[:]); err != nil || has {
+			t.Fatalf("expected verified block not to be persisted but got %v, %v", has, err)
+		}
+		if _, err := vm.GetBlock(context.Background(), blk.ID()); err != nil {
+			t.Fatalf("expected verified block to be fetchable but got %v", err)
+		}
+		blocks[i] = blk
+	}
+
+	accepted, rejected := blocks[0], blocks[1]
+	if err := accepted.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rejected.Reject(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := vm.state.getBlock(accepted.ID()); err != nil || stored.Status() != choices.Accepted {
+		t.Fatalf("expected accepted block to be persisted but got %v", err)
+	}
+	if _, err := vm.GetBlock(context.Background(), rejected.ID()); err != database.ErrNotFound {
+		t.Fatalf("expected rejected block to be discarded but got %v", err)
+	}
+}
+
+var errTestWrite = errors.New("test write failure")
+
+// failingDB is a database whose batches fail to write while [fail] is set
+type failingDB struct {
+	database.Database
+	fail bool
+}
+
+func (db *failingDB) NewBatch() database.Batch {
+	return &failingBatch{Batch: db.Database.NewBatch(), db: db}
+}
+
+type failingBatch struct {
+	database.Batch
+	db *failingDB
+}
+
+func (b *failingBatch) Write() error {
+	if b.db.fail {
+		return errTestWrite
+	}
+	return b.Batch.Write()
+}
+
+// Assert that a block whose acceptance fails to be written leaves no trace
+func TestAcceptAtomic(t *testing.T) {
+	db := &failingDB{Database: memdb.New()}
+	vm := &VM{}
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, testGenesisBytes(t, []byte{0, 0, 0, 0, 0}), nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	db.fail = true
+	if err := blk.Accept(context.Background()); err != errTestWrite {
+		t.Fatalf("expected %s but got %v", errTestWrite, err)
+	}
+	db.fail = false
+	if blk.Status() != choices.Processing {
+		t.Fatalf("expected block to still be processing but was %s", blk.Status())
+	}
+	if lastAccepted, err := vm.LastAccepted(context.Background()); err != nil || lastAccepted != genesisID {
+		t.Fatalf("expected genesis to still be last accepted but got %s, %v", lastAccepted, err)
+	}
+	if _, err := vm.GetBlockIDAtHeight(context.Background(), 1); err != database.ErrNotFound {
+		t.Fatalf("expected height 1 not to be indexed but got %v", err)
+	}
+	if has, err := vm.state.hasData([dataLen]byte{1}); err != nil || has {
+		t.Fatalf("expected data not to be indexed but got %v, %v", has, err)
+	}
+
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lastAccepted, err := vm.LastAccepted(context.Background()); err != nil || lastAccepted != blk.ID() {
+		t.Fatalf("expected block to be last accepted but got %s, %v", lastAccepted, err)
+	}
+}
+
+// Assert that the data of a rejected block built by this node is put back
+// into the mempool, unless it was accepted in another block
+func TestRejectRequeues(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][dataLen]byte{{1}, {2}} {
+		if err := vm.proposeBlock(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	built, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A conflicting block built by another node that contains some of the
+	// same data is accepted instead
+	other, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{2}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Reject(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), other.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	assertPendingTxs(t, vm)
+	rebuilt, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := rebuilt.(*Block).Data(); len(data) != 1 || data[0] != ([dataLen]byte{1}) {
+		t.Fatalf("expected only the unaccepted data to be re-queued but got %v", data)
+	}
+	if rebuilt.Parent() != other.ID() {
+		t.Fatal("expected the re-queued data to be built on the accepted block")
+	}
+}
+
+// Assert that the max clock skew is set by the genesis and that blocks
+// built on a parent ahead of local time are still valid
+func TestMaxClockSkew(t *testing.T) {
+	vm := newTestVMWithParams(t, ChainParams{
+		MaxPayloadSize: dataLen,
+		MaxClockSkew:   Duration{Duration: time.Minute},
+	})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tooLate, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now().Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tooLate.Verify(context.Background()); err != errTimestampTooLate {
+		t.Fatalf("expected %s but got %v", errTimestampTooLate, err)
+	}
+	if !errors.Is(errTimestampTooLate, ErrInvalidTimestamp) {
+		t.Fatalf("expected %s to be an %s", errTimestampTooLate, ErrInvalidTimestamp)
+	}
+
+	ahead, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now().Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ahead.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ahead.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), ahead.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	child, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Timestamp().Before(ahead.Timestamp()) {
+		t.Fatal("expected the child not to be timestamped before its parent")
+	}
+	if err := child.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that blocks are built and verified against the vm's clock rather
+// than the wall clock
+func TestClock(t *testing.T) {
+	vm := newTestVMWithParams(t, ChainParams{
+		MaxPayloadSize: dataLen,
+		MaxClockSkew:   Duration{Duration: time.Minute},
+	})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(2_000_000_000, 0)
+	vm.Clock().Set(now)
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != errTimestampTooLate {
+		t.Fatalf("expected %s but got %v", errTimestampTooLate, err)
+	}
+	vm.Clock().Set(now.Add(time.Minute))
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	vm.Clock().Set(now.Add(3 * time.Minute))
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	child, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !child.Timestamp().Equal(now.Add(3 * time.Minute)) {
+		t.Fatalf("expected the block to be timestamped at %s but got %s", now.Add(3*time.Minute), child.Timestamp())
+	}
+}
+
+// Assert that a chain with strictly increasing timestamps rejects a block
+// timestamped at its parent's time and never builds one
+func TestStrictlyIncreasingTimestamps(t *testing.T) {
+	vm := newTestVMWithParams(t, ChainParams{
+		MaxPayloadSize:               dataLen,
+		StrictlyIncreasingTimestamps: true,
+	})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), parent.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	sameTime, err := vm.NewBlock(parent.ID(), 2, [][dataLen]byte{{2}}, parent.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sameTime.Verify(context.Background()); err != errTimestampNotAfter {
+		t.Fatalf("expected %s but got %v", errTimestampNotAfter, err)
+	}
+	earlier, err := vm.NewBlock(parent.ID(), 2, [][dataLen]byte{{2}}, parent.Timestamp().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := earlier.Verify(context.Background()); err != errTimestampNotAfter {
+		t.Fatalf("expected %s but got %v", errTimestampNotAfter, err)
+	}
+
+	// Blocks built within the same second are still valid
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	built, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that blocks closer together than the min block interval are invalid
+// and that the vm waits for the interval before building a block
+func TestMinBlockInterval(t *testing.T) {
+	vm := newTestVMWithParams(t, ChainParams{
+		MaxPayloadSize:   dataLen,
+		MinBlockInterval: Duration{Duration: time.Second},
+	})
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	parent, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), parent.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	tooSoon, err := vm.NewBlock(parent.ID(), 2, [][dataLen]byte{{2}}, parent.Timestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tooSoon.Verify(context.Background()); err != errBlockTooSoon {
+		t.Fatalf("expected %s but got %v", errBlockTooSoon, err)
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	assertPendingTxs(t, vm)
+	if time.Now().Before(parent.Timestamp().Add(time.Second)) {
+		if _, err := vm.BuildBlock(context.Background()); err != errBlockTooSoon {
+			t.Fatalf("expected %s but got %v", errBlockTooSoon, err)
+		}
+		// The engine is told to try again once the interval has passed
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if msg, err := vm.WaitForEvent(ctx); err != nil || msg != common.PendingTxs {
+			t.Fatalf("expected pending txs but got %s, %v", msg, err)
+		}
+	}
+	child, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Assert that on a chain with an allowed signer set only blocks signed by an
+// allowed signer are valid, and that admins can rotate the signers
+func TestAllowedSigners(t *testing.T) {
+	signer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSigner, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisBytes, err := BuildGenesisBytes(&Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{signer.Address()},
+			Admins:         []ids.ShortID{admin.Address()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &VM{}
+	ctx := snowtest.Context(t, blockchainID)
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, signer.String()))
+	if err := vm.Initialize(context.Background(), ctx, memdb.New(), genesisBytes, nil, configBytes, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unsigned.Verify(context.Background()); err != errUnsignedBlock {
+		t.Fatalf("expected %s but got %v", errUnsignedBlock, err)
+	}
+
+	// signedBy returns a child of the preferred block signed by [key]
+	signedBy := func(key *secp256k1.PrivateKey, ops []SignerOp) *Block {
+		parent, err := vm.getBlock(vm.preferred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.NewBlock(parent.ID(), parent.Height()+1, [][dataLen]byte{{byte(parent.Height() + 1)}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer := vm.signer
+		vm.signer = &keySigner{key: key}
+		defer func() { vm.signer = signer }()
+		if err := vm.signBlock(context.Background(), blk, ops); err != nil {
+			t.Fatal(err)
+		}
+		// Signed blocks round trip through their bytes
+		parsed, err := vm.parseBlock(blk.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	if err := signedBy(newSigner, nil).Verify(context.Background()); err != errNotSigner {
+		t.Fatalf("expected %s but got %v", errNotSigner, err)
+	}
+
+	// Only admins may propose signer operations
+	service := &Service{vm}
+	op := SignerOp{Add: true, Signer: newSigner.Address()}
+	if err := op.Sign(ctx.ChainID, newSigner); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := cb58.Encode(op.AdminSig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &ProposeSignerOpArgs{Add: true, Signer: newSigner.Address(), Signature: encoded}
+	if err := service.ProposeSignerOp(nil, args, &ProposeSignerOpReply{}); err != errNotAdmin {
+		t.Fatalf("expected %s but got %v", errNotAdmin, err)
+	}
+	if err := op.Sign(ctx.ChainID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if args.Signature, err = cb58.Encode(op.AdminSig[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ProposeSignerOp(nil, args, &ProposeSignerOpReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation is built into a block of its own
+	assertPendingTxs(t, vm)
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := blk.(*Block).Ops; len(ops) != 1 || ops[0] != op {
+		t.Fatalf("expected the signer operation in the block but got %v", ops)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new signer may sign blocks and the operation can't be replayed
+	if err := signedBy(newSigner, nil).Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := signedBy(signer, []SignerOp{op}).Verify(context.Background()); err != errBadOpNonce {
+		t.Fatalf("expected %s but got %v", errBadOpNonce, err)
+	}
+}
+
+// Assert that on a chain with fees a block's signer pays the fee for each
+// piece of data from its balance, and that the fees are burned
+func TestFees(t *testing.T) {
+	payer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params:      ChainParams{MaxPayloadSize: dataLen, Fee: 2},
+		Allocations: []Allocation{{Address: payer.Address(), Balance: 5}},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, payer.String())))
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unsigned.Verify(context.Background()); err != errUnsignedBlock {
+		t.Fatalf("expected %s but got %v", errUnsignedBlock, err)
+	}
+
+	// A signer without a balance can't pay for its block
+	other, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := vm.signer
+	vm.signer = &keySigner{key: other}
+	if err := vm.signBlock(context.Background(), unsigned, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm.signer = signer
+	if err := unsigned.Verify(context.Background()); err != errInsufficientBalance {
+		t.Fatalf("expected %s but got %v", errInsufficientBalance, err)
+	}
+
+	// The payer can only pay for two of the three pieces of data
+	for i := byte(1); i <= 3; i++ {
+		if err := vm.proposeBlock([dataLen]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 2 {
+		t.Fatalf("expected 2 pieces of data but got %d", len(data))
+	}
+	// The signature is written into the block's bytes without marshaling the
+	// block again
+	if blockBytes, err := vm.codec.Marshal(signedCodecVersion, blk); err != nil || !bytes.Equal(blockBytes, blk.Bytes()) {
+		t.Fatalf("expected the block's bytes to be its encoding but got %v", err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	service := &Service{vm}
+	balanceReply := &GetBalanceReply{}
+	if err := service.GetBalance(nil, &GetBalanceArgs{Address: payer.Address()}, balanceReply); err != nil {
+		t.Fatal(err)
+	}
+	if balanceReply.Balance != 1 {
+		t.Fatalf("expected a balance of 1 but got %d", balanceReply.Balance)
+	}
+	burnedReply := &GetBurnedFeesReply{}
+	if err := service.GetBurnedFees(nil, nil, burnedReply); err != nil {
+		t.Fatal(err)
+	}
+	if burnedReply.Burned != 4 {
+		t.Fatalf("expected 4 to be burned but got %d", burnedReply.Burned)
+	}
+
+	if _, err := vm.BuildBlock(context.Background()); err != errInsufficientBalance {
+		t.Fatalf("expected %s but got %v", errInsufficientBalance, err)
+	}
+}
+
+// Assert that a fee exempt signer builds blocks without a balance and that
+// its blocks burn no fees
+func TestFeeExempt(t *testing.T) {
+	exempt, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params: ChainParams{MaxPayloadSize: dataLen, Fee: 2, FeeExempt: []ids.ShortID{exempt.Address()}},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, exempt.String())))
+
+	for i := byte(1); i <= 3; i++ {
+		if err := vm.proposeBlock([dataLen]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 3 {
+		t.Fatalf("expected 3 pieces of data but got %d", len(data))
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	burnedReply := &GetBurnedFeesReply{}
+	if err := (&Service{vm}).GetBurnedFees(nil, nil, burnedReply); err != nil {
+		t.Fatal(err)
+	}
+	if burnedReply.Burned != 0 {
+		t.Fatalf("expected nothing to be burned but got %d", burnedReply.Burned)
+	}
+}
+
+// Assert that a signed operation is paid for by its signer, and that the
+// operations of a signer that can't pay are left out of built blocks
+func TestOperationFees(t *testing.T) {
+	keys := make([]*secp256k1.PrivateKey, 3)
+	for i := range keys {
+		key, err := secp256k1.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	node, submitter, poor := keys[0], keys[1], keys[2]
+	genesis := &Genesis{
+		Params: ChainParams{MaxPayloadSize: dataLen, Fee: 2, Accounts: true},
+		Allocations: []Allocation{
+			{Address: node.Address(), Balance: 10},
+			{Address: submitter.Address(), Balance: 2},
+		},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, node.String())))
+	ctx := context.Background()
+	for i, key := range []*secp256k1.PrivateKey{submitter, poor} {
+		s := SignedSubmission{Data: [dataLen]byte{byte(i + 1)}}
+		if err := s.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.addSubmission(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.proposeBlock([dataLen]byte{9}); err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := blk.(*Block)
+	if len(built.Dt) != 1 || len(built.Submissions) != 1 || built.Submissions[0].Data != [dataLen]byte{1} {
+		t.Fatalf("expected the data and the paid for submission but got %+v", built)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[ids.ShortID]uint64{node.Address(): 8, submitter.Address(): 0} {
+		balance, err := vm.state.getBalance(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance != expected {
+			t.Fatalf("expected a balance of %d but got %d", expected, balance)
+		}
+	}
+	burned, err := vm.state.getBurned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if burned != 4 {
+		t.Fatalf("expected 4 to be burned but got %d", burned)
+	}
+
+	// The submission that can't be paid for stays pending
+	if _, err := vm.BuildBlock(ctx); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+	if vm.pendingSubmissions.len() != 1 {
+		t.Fatalf("expected 1 pending submission but got %d", vm.pendingSubmissions.len())
+	}
+}
+
+// Assert that the base fee of a chain with a dynamic fee rises after a block
+// over the target, holds after one at the target and decays while idle
+func TestDynamicFee(t *testing.T) {
+	payer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&ChainParams{MaxPayloadSize: dataLen, DynamicFee: &DynamicFeeConfig{TargetData: 1}}).Verify(); err != errDynamicFeeWithoutFee {
+		t.Fatalf("expected %s but got %v", errDynamicFeeWithoutFee, err)
+	}
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Fee:            10,
+			DynamicFee:     &DynamicFeeConfig{TargetData: 1, ChangeDenominator: 2},
+		},
+		Allocations: []Allocation{{Address: payer.Address(), Balance: 1000}},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, payer.String())))
+	service := &Service{vm}
+
+	expectFee := func(expected uint64) {
+		t.Helper()
+		reply := &GetCurrentFeeReply{}
+		if err := service.GetCurrentFee(nil, nil, reply); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(reply.Fee) != expected || reply.MinFee != 10 || !reply.Dynamic {
+			t.Fatalf("expected a dynamic fee of %d but got %+v", expected, reply)
+		}
+	}
+	buildAccept := func(numData int) {
+		t.Helper()
+		for i := 0; i < numData; i++ {
+			if err := vm.proposeBlock([dataLen]byte{byte(vm.builder.len() + 1), byte(numData)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		blk, err := vm.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectFee(10)
+	// Two pieces of data over the target raise the base fee by the whole
+	// change, half of 10
+	buildAccept(3)
+	expectFee(20)
+	buildAccept(1)
+	expectFee(20)
+	burned, err := vm.burned(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if burned != 3*10+20 {
+		t.Fatalf("expected %d to be burned but got %d", 3*10+20, burned)
+	}
+
+	decaying := &DynamicFeeConfig{TargetData: 1, DecayInterval: Duration{10 * time.Second}}
+	if fee := decaying.next(100, 10, 1, 25); fee != 77 {
+		t.Fatalf("expected two decay steps to leave 77 but got %d", fee)
+	}
+	if fee := decaying.next(100, 10, 0, 0); fee != 88 {
+		t.Fatalf("expected an empty block to lower the fee to 88 but got %d", fee)
+	}
+	if fee := decaying.next(100, 10, 1, 1<<40); fee != 10 {
+		t.Fatalf("expected a long idle time to decay to the min fee but got %d", fee)
+	}
+}
+
+// Assert that transfers are built in nonce order, move balances when
+// accepted, and can't be replayed or overdraw their sender
+func TestTransfers(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := ids.GenerateTestShortID()
+	genesis := &Genesis{
+		Params:      ChainParams{MaxPayloadSize: dataLen, Transfers: true},
+		Allocations: []Allocation{{Address: sender.Address(), Balance: 10}},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+
+	// The sender's second transfer is proposed first
+	second := Transfer{Nonce: 1, To: recipient, Amount: 3}
+	if err := second.Sign(vm.ctx.ChainID, sender); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.addTransfer(second); err != nil {
+		t.Fatal(err)
+	}
+	first := Transfer{Nonce: 0, To: recipient, Amount: 4}
+	if err := first.Sign(vm.ctx.ChainID, sender); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := cb58.Encode(first.Sig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferReply := &TransferReply{}
+	if err := service.Transfer(nil, &TransferArgs{Nonce: 0, To: recipient, Amount: 4, Signature: sig}, transferReply); err != nil {
+		t.Fatal(err)
+	}
+	if transferReply.Sender != sender.Address() {
+		t.Fatalf("expected sender %s but got %s", sender.Address(), transferReply.Sender)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	built := blk.(*Block)
+	if len(built.Transfers) != 2 || built.Transfers[0].Nonce != 0 || built.Transfers[1].Nonce != 1 {
+		t.Fatalf("expected the transfers in nonce order but got %+v", built.Transfers)
+	}
+	parsed, err := vm.ParseBlock(context.Background(), blk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.(*Block).Transfers) != 2 {
+		t.Fatal("parsed block lost its transfers")
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if vm.pendingTransfers.len() != 0 {
+		t.Fatalf("expected no pending transfers but got %d", vm.pendingTransfers.len())
+	}
+
+	for addr, expected := range map[ids.ShortID]uint64{sender.Address(): 3, recipient: 7} {
+		reply := &GetBalanceReply{}
+		if err := service.GetBalance(nil, &GetBalanceArgs{Address: addr}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if uint64(reply.Balance) != expected {
+			t.Fatalf("expected balance %d but got %d", expected, reply.Balance)
+		}
+	}
+	nonceReply := &GetNonceReply{}
+	if err := service.GetNonce(nil, &GetNonceArgs{Address: sender.Address()}, nonceReply); err != nil {
+		t.Fatal(err)
+	}
+	if nonceReply.Nonce != 2 {
+		t.Fatalf("expected nonce 2 but got %d", nonceReply.Nonce)
+	}
+
+	for _, test := range []struct {
+		transfer Transfer
+		err      error
+	}{
+		{Transfer{Nonce: 0, To: recipient, Amount: 4}, errBadTransferNonce},
+		{Transfer{Nonce: 2, To: recipient, Amount: 4}, errTransferBalance},
+		{Transfer{Nonce: 2, To: recipient}, errZeroTransfer},
+	} {
+		if err := test.transfer.Sign(vm.ctx.ChainID, sender); err != nil {
+			t.Fatal(err)
+		}
+		child, err := vm.NewBlock(blk.ID(), 2, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.Transfers = []Transfer{test.transfer}
+		if err := vm.signBlock(context.Background(), child, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+}
+
+// Assert that the signer of the first block with a piece of data owns its
+// claim, and that only the owner can transfer it and only once per nonce
+func TestClaims(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buyer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Claims: true}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+
+	data := [dataLen]byte{1}
+	encoded, err := cb58.Encode(data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock(data); err != nil {
+		t.Fatal(err)
+	}
+	minted, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := minted.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := minted.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	claimReply := &GetClaimReply{}
+	if err := service.GetClaim(nil, &GetClaimArgs{Data: encoded}, claimReply); err != nil {
+		t.Fatal(err)
+	}
+	if claimReply.Owner != builder.Address() || claimReply.Nonce != 0 || claimReply.Height != 1 {
+		t.Fatalf("unexpected claim %+v", claimReply)
+	}
+
+	transfer := ClaimTransfer{Data: data, To: buyer.Address()}
+	if err := transfer.Sign(vm.ctx.ChainID, builder); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := cb58.Encode(transfer.Sig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferReply := &TransferClaimReply{}
+	if err := service.TransferClaim(nil, &TransferClaimArgs{Data: encoded, To: buyer.Address(), Signature: sig}, transferReply); err != nil {
+		t.Fatal(err)
+	}
+	if transferReply.Sender != builder.Address() {
+		t.Fatalf("expected sender %s but got %s", builder.Address(), transferReply.Sender)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blk.(*Block).ClaimTransfers) != 1 {
+		t.Fatalf("expected 1 claim transfer but got %d", len(blk.(*Block).ClaimTransfers))
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for owner, expected := range map[ids.ShortID]int{builder.Address(): 0, buyer.Address(): 1} {
+		claimsReply := &GetClaimsReply{}
+		if err := service.GetClaims(nil, &GetClaimsArgs{Owner: owner}, claimsReply); err != nil {
+			t.Fatal(err)
+		}
+		if len(claimsReply.Data) != expected {
+			t.Fatalf("expected %d claims but got %d", expected, len(claimsReply.Data))
+		}
+	}
+
+	for _, test := range []struct {
+		transfer ClaimTransfer
+		key      *secp256k1.PrivateKey
+		err      error
+	}{
+		{ClaimTransfer{Data: data, Nonce: 1, To: builder.Address()}, builder, errNotClaimOwner},
+		{ClaimTransfer{Data: data, Nonce: 0, To: builder.Address()}, buyer, errBadClaimNonce},
+		{ClaimTransfer{Data: [dataLen]byte{2}, To: builder.Address()}, builder, errNoSuchClaim},
+	} {
+		if err := test.transfer.Sign(vm.ctx.ChainID, test.key); err != nil {
+			t.Fatal(err)
+		}
+		child, err := vm.NewBlock(blk.ID(), blk.Height()+1, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.ClaimTransfers = []ClaimTransfer{test.transfer}
+		if err := vm.signBlock(context.Background(), child, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+}
+
+// Assert that a reveal is only put in a block once its commitment is
+// accepted, and that each commitment is revealed once
+func TestCommitReveal(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Reveals: true}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+
+	bid := []byte("sealed bid: 100")
+	salt := [SaltLen]byte{7}
+	commitment := Commitment(bid, salt)
+	encodedBid, err := cb58.Encode(bid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedSalt, err := cb58.Encode(salt[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	revealReply := &RevealReply{}
+	if err := service.Reveal(nil, &RevealArgs{Data: encodedBid, Salt: encodedSalt}, revealReply); err != nil {
+		t.Fatal(err)
+	}
+	encodedCommitment, err := cb58.Encode(commitment[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revealReply.Commitment != encodedCommitment {
+		t.Fatalf("expected commitment %s but got %s", encodedCommitment, revealReply.Commitment)
+	}
+	// The reveal waits for its commitment
+	if _, err := vm.BuildBlock(context.Background()); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+
+	if err := vm.proposeBlock(commitment); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(committed.(*Block).Reveals) != 0 {
+		t.Fatal("expected the reveal to wait for its commitment to be accepted")
+	}
+	if err := committed.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := committed.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), committed.ID()); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blk.(*Block).Reveals) != 1 {
+		t.Fatalf("expected 1 reveal but got %d", len(blk.(*Block).Reveals))
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	getReply := &GetRevealReply{}
+	if err := service.GetReveal(nil, &GetRevealArgs{Commitment: encodedCommitment}, getReply); err != nil {
+		t.Fatal(err)
+	}
+	if getReply.Data != encodedBid || getReply.Height != 2 {
+		t.Fatalf("unexpected reveal %+v", getReply)
+	}
+	if vm.pendingReveals.len() != 0 {
+		t.Fatalf("expected no pending reveals but got %d", vm.pendingReveals.len())
+	}
+
+	for _, test := range []struct {
+		reveal Reveal
+		err    error
+	}{
+		{Reveal{Data: bid, Salt: salt}, errAlreadyRevealed},
+		{Reveal{Data: bid, Salt: [SaltLen]byte{8}}, errNoCommitment},
+		{Reveal{Data: make([]byte, MaxRevealSize+1)}, errRevealTooLarge},
+	} {
+		child, err := vm.NewBlock(blk.ID(), 3, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.Reveals = []Reveal{test.reveal}
+		if err := vm.signBlock(context.Background(), child, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+}
+
+// Assert that payloads can only be encrypted to registered keys, and that
+// key registrations must be the next version of the owner's key
+func TestEncryptedPayloads(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Encryption: true}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+
+	ciphertext, err := cb58.Encode([]byte("ciphertext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposeArgs := &ProposeEncryptedArgs{Recipient: recipient.Address(), Ciphertext: ciphertext}
+	proposeReply := &ProposeEncryptedReply{}
+	if err := service.ProposeEncrypted(nil, proposeArgs, proposeReply); err != errNoEncryptionKey {
+		t.Fatalf("expected %s but got %v", errNoEncryptionKey, err)
+	}
+
+	reg := KeyRegistration{Key: [EncryptionKeyLen]byte{1}, Version: 1}
+	if err := reg.Sign(vm.ctx.ChainID, recipient); err != nil {
+		t.Fatal(err)
+	}
+	key, err := cb58.Encode(reg.Key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := cb58.Encode(reg.Sig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerReply := &RegisterKeyReply{}
+	if err := service.RegisterKey(nil, &RegisterKeyArgs{Key: key, Version: 1, Signature: sig}, registerReply); err != nil {
+		t.Fatal(err)
+	}
+	if registerReply.Owner != recipient.Address() {
+		t.Fatalf("expected owner %s but got %s", recipient.Address(), registerReply.Owner)
+	}
+	registered, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered.(*Block).KeyRegs) != 1 {
+		t.Fatalf("expected 1 key registration but got %d", len(registered.(*Block).KeyRegs))
+	}
+	if err := registered.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := registered.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), registered.ID()); err != nil {
+		t.Fatal(err)
+	}
+	keyReply := &GetKeyReply{}
+	if err := service.GetKey(nil, &GetKeyArgs{Address: recipient.Address()}, keyReply); err != nil {
+		t.Fatal(err)
+	}
+	if keyReply.Key != key || keyReply.Version != 1 {
+		t.Fatalf("unexpected key %+v", keyReply)
+	}
+
+	if err := service.ProposeEncrypted(nil, proposeArgs, proposeReply); err != nil {
+		t.Fatal(err)
+	}
+	if proposeReply.KeyVersion != 1 {
+		t.Fatalf("expected key version 1 but got %d", proposeReply.KeyVersion)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	encryptedReply := &GetEncryptedReply{}
+	if err := service.GetEncrypted(nil, &GetEncryptedArgs{ID: proposeReply.ID}, encryptedReply); err != nil {
+		t.Fatal(err)
+	}
+	if encryptedReply.Recipient != recipient.Address() || encryptedReply.KeyVersion != 1 || encryptedReply.Ciphertext != ciphertext || encryptedReply.Height != 2 {
+		t.Fatalf("unexpected encrypted payload %+v", encryptedReply)
+	}
+
+	payload := EncryptedPayload{Recipient: recipient.Address(), KeyVersion: 1, Ciphertext: []byte("ciphertext")}
+	for _, test := range []struct {
+		keyRegs   []KeyRegistration
+		encrypted []EncryptedPayload
+		err       error
+	}{
+		{keyRegs: []KeyRegistration{reg}, err: errBadKeyVersion},
+		{encrypted: []EncryptedPayload{payload}, err: errDuplicateEncrypted},
+		{encrypted: []EncryptedPayload{{Recipient: recipient.Address(), KeyVersion: 2, Ciphertext: []byte{1}}}, err: errNoEncryptionKey},
+		{encrypted: []EncryptedPayload{{Recipient: recipient.Address(), KeyVersion: 1}}, err: errBadCiphertextSize},
+	} {
+		child, err := vm.NewBlock(blk.ID(), 3, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.KeyRegs = test.keyRegs
+		child.Encrypted = test.encrypted
+		if err := vm.signBlock(context.Background(), child, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+}
+
+// Assert that only writers of a namespace with an ACL can sign blocks with
+// its data, and that the namespace's admins can grant write permission
+func TestACL(t *testing.T) {
+	admin, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := ids.GenerateTestShortID()
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		ACLs: []NamespaceACL{{
+			Namespace: "acme",
+			Admins:    []ids.ShortID{admin.Address()},
+			Writers:   []ids.ShortID{writer},
+		}},
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acme := [NamespaceLen]byte{'a', 'c', 'm', 'e'}
+	restricted := [dataLen]byte{1}
+	if err := vm.verifyProposal(restricted[:], acme); err != errNoWritePermission {
+		t.Fatalf("expected %s but got %v", errNoWritePermission, err)
+	}
+	// Data in a namespace without an ACL, or without a namespace, may be
+	// written by any block signer
+	if err := vm.verifyProposal(restricted[:], [NamespaceLen]byte{'o', 'p', 'e', 'n'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.verifyProposal(restricted[:], [NamespaceLen]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.verifyProposal(restricted[:], [NamespaceLen]byte{0, 'a'}); err != errBadDataNamespace {
+		t.Fatalf("expected %s but got %v", errBadDataNamespace, err)
+	}
+	unpermitted, err := vm.newBlock(genesisID, 1, [][dataLen]byte{restricted}, [][NamespaceLen]byte{acme}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.signBlock(context.Background(), unpermitted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpermitted.Verify(context.Background()); err != errNoWritePermission {
+		t.Fatalf("expected %s but got %v", errNoWritePermission, err)
+	}
+
+	grant := ACLOp{Namespace: acme, Grant: true, Writer: builder.Address()}
+	if err := grant.Sign(vm.ctx.ChainID, admin); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := cb58.Encode(grant.AdminSig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	opReply := &ProposeACLOpReply{}
+	if err := service.ProposeACLOp(nil, &ProposeACLOpArgs{
+		Namespace: "acme",
+		Grant:     true,
+		Writer:    builder.Address(),
+		Signature: sig,
+	}, opReply); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blk.(*Block).ACLOps) != 1 {
+		t.Fatalf("expected 1 ACL operation but got %d", len(blk.(*Block).ACLOps))
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	permissionsReply := &GetPermissionsReply{}
+	if err := service.GetPermissions(nil, &GetPermissionsArgs{Namespace: "acme"}, permissionsReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(permissionsReply.Writers) != 2 || permissionsReply.Nonce != 1 {
+		t.Fatalf("unexpected permissions %+v", permissionsReply)
+	}
+
+	// The builder may now write to the namespace
+	if err := vm.verifyProposal(restricted[:], acme); err != nil {
+		t.Fatal(err)
+	}
+	permitted, err := vm.newBlock(blk.ID(), 2, [][dataLen]byte{restricted}, [][NamespaceLen]byte{acme}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.signBlock(context.Background(), permitted, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := permitted.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := ACLOp{Nonce: 1, Namespace: acme, Writer: writer}
+	for _, test := range []struct {
+		op  ACLOp
+		key *secp256k1.PrivateKey
+		err error
+	}{
+		{grant, admin, errBadACLOpNonce},
+		{revoke, builder, errNotNamespaceAdmin},
+		{ACLOp{Nonce: 1, Namespace: acme, Writer: ids.GenerateTestShortID()}, admin, errUnknownWriter},
+	} {
+		if err := test.op.Sign(vm.ctx.ChainID, test.key); err != nil {
+			t.Fatal(err)
+		}
+		child, err := vm.NewBlock(blk.ID(), 2, nil, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		child.ACLOps = []ACLOp{test.op}
+		if err := vm.signBlock(context.Background(), child, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := child.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+}
+
+// Assert that blocks respect the namespace quota and that accepted data is
+// indexed by namespace
+func TestNamespaces(t *testing.T) {
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Namespaces: true, MaxNamespaceData: 2}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(`{"buildBatchWindow": "0s"}`))
+	service := &Service{vm}
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := [NamespaceLen]byte{'a'}, [NamespaceLen]byte{'b'}
+	for _, namespace := range [][NamespaceLen]byte{{}, {0, 'a'}} {
+		if err := vm.verifyProposal([]byte{1}, namespace); err != errBadDataNamespace {
+			t.Fatalf("expected %s but got %v", errBadDataNamespace, err)
+		}
+	}
+	for _, test := range []struct {
+		namespaces [][NamespaceLen]byte
+		err        error
+	}{
+		{nil, errNamespaceCount},
+		{[][NamespaceLen]byte{a, a, {}}, errBadDataNamespace},
+		{[][NamespaceLen]byte{a, a, a}, errNamespaceQuota},
+	} {
+		blk, err := vm.newBlock(genesisID, 1, [][dataLen]byte{{1}, {2}, {3}}, test.namespaces, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != test.err {
+			t.Fatalf("expected %s but got %v", test.err, err)
+		}
+	}
+
+	// The namespace is kept apart from the data, so the data keeps all of
+	// its bytes
+	digest := [dataLen]byte(bytes.Repeat([]byte{0xff}, dataLen))
+	for i, d := range [][dataLen]byte{digest, {2}, {3}, {1}} {
+		namespace := a
+		if i == 3 {
+			namespace = b
+		}
+		if _, _, err := vm.submitProposal(d, namespace, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third piece of data in "a" is over the quota, so it's put in a
+	// second block
+	for _, expected := range []int{3, 1} {
+		blk, err := vm.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := blk.(*Block).Data(); len(data) != expected {
+			t.Fatalf("expected %d pieces of data but got %d", expected, len(data))
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dataReply := &GetNamespaceDataReply{}
+	if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "a"}, dataReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(dataReply.Data) != 3 || dataReply.Data[0].Data != encoding.EncodeCB58(digest[:]) || dataReply.Data[2].Height != 2 {
+		t.Fatalf("unexpected namespace data %+v", dataReply.Data)
+	}
+	if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "a", StartHeight: 2}, dataReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(dataReply.Data) != 1 {
+		t.Fatalf("expected 1 piece of data but got %d", len(dataReply.Data))
+	}
+	namespacesReply := &ListNamespacesReply{}
+	if err := service.ListNamespaces(nil, &ListNamespacesArgs{}, namespacesReply); err != nil {
+		t.Fatal(err)
+	}
+	expected := []NamespaceSummary{{Namespace: "a", Count: 3}, {Namespace: "b", Count: 1}}
+	if !slices.Equal(namespacesReply.Namespaces, expected) || namespacesReply.NextCursor != "" {
+		t.Fatalf("expected namespaces %+v but got %+v", expected, namespacesReply)
+	}
+	var (
+		namespaces []NamespaceSummary
+		cursor     string
+	)
+	for {
+		reply := &ListNamespacesReply{}
+		if err := service.ListNamespaces(nil, &ListNamespacesArgs{Limit: 1, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		namespaces = append(namespaces, reply.Namespaces...)
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(namespaces, expected) {
+		t.Fatalf("expected the pages to have namespaces %+v but got %+v", expected, namespaces)
+	}
+}
+
+// Assert that list methods page through their results with cursors
+func TestPageCursors(t *testing.T) {
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Namespaces: true}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(`{"buildBatchWindow": "0s"}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	for _, d := range [][dataLen]byte{{1}, {2}, {3}} {
+		if _, _, err := vm.submitProposal(d, [NamespaceLen]byte{'a'}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pieces of data are in the same block, so the cursor splits it
+	var (
+		data   []APINamespaceData
+		cursor string
+	)
+	for {
+		reply := &GetNamespaceDataReply{}
+		if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "a", Limit: 2, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, reply.Data...)
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(data) != 3 || data[0].Data == data[2].Data {
+		t.Fatalf("expected the 3 pieces of data but got %+v", data)
+	}
+
+	var heights []uint64
+	for {
+		reply := &ListBlocksReply{}
+		if err := service.ListBlocks(nil, &ListBlocksArgs{PageSize: 1, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range reply.Blocks {
+			heights = append(heights, uint64(b.Height))
+		}
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(heights, []uint64{1, 0}) {
+		t.Fatalf("expected the blocks newest first but got heights %v", heights)
+	}
+
+	// A cursor only pages through the list it was returned for
+	reply := &GetNamespaceDataReply{}
+	if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "a", Limit: 1}, reply); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{reply.NextCursor, "not a cursor"} {
+		err := service.ListBlocks(nil, &ListBlocksArgs{Cursor: bad}, &ListBlocksReply{})
+		if !errors.Is(err, errBadCursor) {
+			t.Fatalf("expected %s but got %v", errBadCursor, err)
+		}
+	}
+}
+
+// Assert that proofs of accepted data verify offline and can't be altered
+func TestProof(t *testing.T) {
+	key, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, key.String())))
+	service := &Service{vm}
+
+	for i := byte(1); i <= 2; i++ {
+		if err := vm.proposeBlock([dataLen]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := cb58.Encode([]byte{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &GetProofReply{}
+	if err := service.GetProof(nil, &GetProofArgs{Data: missing}, reply); err != errDataNotAccepted {
+		t.Fatalf("expected %s but got %v", errDataNotAccepted, err)
+	}
+	encoded, err := cb58.Encode([]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.GetProof(nil, &GetProofArgs{Data: encoded}, reply); err != nil {
+		t.Fatal(err)
+	}
+	// The proof survives a round trip through JSON
+	proofBytes, err := json.Marshal(reply.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p proof.Proof
+	if err := json.Unmarshal(proofBytes, &p); err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := p.Verify([]byte{2}, key.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp.BlockID != blk.ID() || timestamp.Height != 1 || !timestamp.Time.Equal(blk.Timestamp()) {
+		t.Fatalf("unexpected timestamp %+v", timestamp)
+	}
+
+	if _, err := p.Verify([]byte{1}, key.Address()); err == nil {
+		t.Fatal("proof verified other data")
+	}
+	if _, err := p.Verify([]byte{2}, ids.GenerateTestShortID()); err == nil {
+		t.Fatal("proof verified with an untrusted signer")
+	}
+	p.Block[len(p.Block)-1]++
+	if _, err := p.Verify([]byte{2}, key.Address()); err == nil {
+		t.Fatal("proof of an altered block verified")
+	}
+}
+
+// Assert that blocks and signer operations signed for another chain aren't
+// valid on this chain
+func TestSignatureReplay(t *testing.T) {
+	signer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{signer.Address()},
+			Admins:         []ids.ShortID{admin.Address()},
+		},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, signer.String())))
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign a block as if this vm ran another chain
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainID := vm.ctx.ChainID
+	vm.ctx.ChainID = ids.GenerateTestID()
+	if err := vm.signBlock(context.Background(), blk, nil); err != nil {
+		t.Fatal(err)
+	}
+	vm.ctx.ChainID = chainID
+	replayed, err := vm.parseBlock(blk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayed.Verify(context.Background()); err != errNotSigner {
+		t.Fatalf("expected %s but got %v", errNotSigner, err)
+	}
+
+	op := SignerOp{Add: true, Signer: ids.GenerateTestShortID()}
+	if err := op.Sign(ids.GenerateTestID(), admin); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := cb58.Encode(op.AdminSig[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := &Service{vm}
+	args := &ProposeSignerOpArgs{Add: true, Signer: op.Signer, Signature: encoded}
+	if err := service.ProposeSignerOp(nil, args, &ProposeSignerOpReply{}); err != errNotAdmin {
+		t.Fatalf("expected %s but got %v", errNotAdmin, err)
+	}
+}
+
+// Assert that on a chain with a median time past window, block timestamps are
+// checked against the median timestamp of recent ancestors as well as local
+// time
+func TestMedianTimePast(t *testing.T) {
+	vm := newTestVMWithParams(t, ChainParams{
+		MaxPayloadSize:       dataLen,
+		MaxClockSkew:         Duration{Duration: time.Minute},
+		MedianTimePastWindow: 3,
+	})
+	vm.Clock().Set(time.Unix(1030, 0))
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Children of the genesis block are only checked against local time
+	parent, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Unix(1000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(context.Background(), parent.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		timestamp   int64
+		expectedErr error
+	}{
+		{timestamp: 1000, expectedErr: errTimestampNotAfterMedian},
+		{timestamp: 1091, expectedErr: errTimestampTooLate},
+		{timestamp: 1090},
+		{timestamp: 1001},
+	} {
+		blk, err := vm.NewBlock(parent.ID(), 2, [][dataLen]byte{{2}}, time.Unix(test.timestamp, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != test.expectedErr {
+			t.Fatalf("timestamp %d: expected %v but got %v", test.timestamp, test.expectedErr, err)
+		}
+	}
+
+	// Built blocks are timestamped at local time, or after the median if
+	// local time is behind it
+	vm.Clock().Set(time.Unix(990, 0))
+	if err := vm.proposeBlock([dataLen]byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timestamp := blk.Timestamp().Unix(); timestamp != 1001 {
+		t.Fatalf("expected timestamp 1001 but got %d", timestamp)
+	}
+}
+
+// Assert that accepting a block drops the processing blocks that conflict
+// with it, and that they can still be rejected afterwards
+func TestAcceptDropsConflicts(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newVerifiedBlock := func(parentID ids.ID, height uint64, data byte) *Block {
+		blk, err := vm.NewBlock(parentID, height, [][dataLen]byte{{data}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return blk
+	}
+	accepted := newVerifiedBlock(genesisID, 1, 1)
+	conflict := newVerifiedBlock(genesisID, 1, 2)
+	conflictChild := newVerifiedBlock(conflict.ID(), 2, 3)
+	if err := vm.SetPreference(context.Background(), conflictChild.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if n := vm.processing.len(); n != 3 {
+		t.Fatalf("expected 3 processing blocks but got %d", n)
+	}
+
+	if err := accepted.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := vm.processing.len(); n != 0 {
+		t.Fatalf("expected no processing blocks but got %d", n)
+	}
+	if vm.preferred != accepted.ID() {
+		t.Fatalf("expected the accepted block to be preferred but got %s", vm.preferred)
+	}
+	if _, err := vm.getBlock(conflictChild.ID()); err == nil {
+		t.Fatal("expected the conflicting block to be dropped")
+	}
+
+	for _, blk := range []*Block{conflictChild, conflict} {
+		if err := blk.Reject(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Assert that while bootstrapping, accepted blocks are committed in batches,
+// and the rest are committed once bootstrapping finishes
+func TestBootstrapBatchedCommits(t *testing.T) {
+	db := memdb.New()
+	vm := &VM{}
+	if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, testGenesisBytes(t, []byte{0, 0, 0, 0, 0}), nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := vm.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	if err := vm.SetState(context.Background(), snow.Bootstrapping); err != nil {
+		t.Fatal(err)
+	}
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The vm sees the accepted block but the database doesn't have it yet
+	if lastAccepted, err := vm.LastAccepted(context.Background()); err != nil || lastAccepted != blk.ID() {
+		t.Fatalf("expected last accepted block %s but got %s, %v", blk.ID(), lastAccepted, err)
+	}
+	committed := newState(vm, db)
+	if lastAccepted, err := committed.getLastAccepted(); err != nil || lastAccepted != genesisID {
+		t.Fatalf("expected committed last accepted block %s but got %s, %v", genesisID, lastAccepted, err)
+	}
+
+	if err := vm.SetState(context.Background(), snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+	if lastAccepted, err := committed.getLastAccepted(); err != nil || lastAccepted != blk.ID() {
+		t.Fatalf("expected committed last accepted block %s but got %s, %v", blk.ID(), lastAccepted, err)
+	}
+}
+
+// Assert that the most recently accepted blocks are cached when the vm
+// restarts, and that aborted writes don't leave blocks in the cache
+func TestWarmCaches(t *testing.T) {
+	db := memdb.New()
+	// initVM initializes a vm on [db] without closing [db] on shutdown
+	initVM := func() *VM {
+		vm := &VM{}
+		if err := vm.Initialize(context.Background(), snowtest.Context(t, blockchainID), db, testGenesisBytes(t, []byte{0, 0, 0, 0, 0}), nil, []byte(`{"blockCacheSize": 2}`), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(vm.builder.stop)
+		return vm
+	}
+
+	vm := initVM()
+	var blkIDs []ids.ID
+	for i := byte(1); i <= 3; i++ {
+		blk, err := vm.NewBlock(vm.preferred, uint64(i), [][dataLen]byte{{i}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		vm.preferred = blk.ID()
+		blkIDs = append(blkIDs, blk.ID())
+	}
+
+	vm = initVM()
+	for _, blkID := range blkIDs[1:] {
+		if _, ok := vm.state.blockCache.Get(blkID); !ok {
+			t.Fatalf("expected block %s to be cached", blkID)
+		}
+	}
+	if _, ok := vm.state.blockCache.Get(blkIDs[0]); ok {
+		t.Fatalf("expected block %s to not be cached", blkIDs[0])
+	}
+	if blkID, ok := vm.state.heightCache.Get(3); !ok || blkID != blkIDs[2] {
+		t.Fatalf("expected height 3 to be cached as %s", blkIDs[2])
+	}
+
+	blk, err := vm.NewBlock(vm.preferred, 4, [][dataLen]byte{{4}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.state.putBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+	vm.abort()
+	if _, err := vm.state.getBlock(blk.ID()); err != database.ErrNotFound {
+		t.Fatalf("expected %s but got %v", database.ErrNotFound, err)
+	}
+}
+
+// Assert that GetAncestors returns a block and its ancestors, newest first,
+// within the given limits
+func TestGetAncestors(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	genesisID, err := vm.LastAccepted(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentID := genesisID
+	var blks [][]byte
+	for i := uint64(1); i <= 3; i++ {
+		blk, err := vm.NewBlock(parentID, i, [][dataLen]byte{{byte(i)}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		parentID = blk.ID()
+		blks = append([][]byte{blk.Bytes()}, blks...)
+	}
+
+	ancestors, err := vm.GetAncestors(context.Background(), parentID, 2, math.MaxInt, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 || !bytes.Equal(ancestors[0], blks[0]) || !bytes.Equal(ancestors[1], blks[1]) {
+		t.Fatal("expected the last accepted block and its parent")
+	}
+
+	// The first block is always returned, but its parent doesn't fit
+	ancestors, err = vm.GetAncestors(context.Background(), parentID, 10, len(blks[0])+wrappers.IntLen, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 1 {
+		t.Fatalf("expected 1 block but got %d", len(ancestors))
+	}
+
+	// Every block down to the genesis block
+	ancestors, err = vm.GetAncestors(context.Background(), parentID, 10, math.MaxInt, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 4 {
+		t.Fatalf("expected 4 blocks but got %d", len(ancestors))
+	}
+	parsed, err := vm.BatchedParseBlock(context.Background(), ancestors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed[3].ID() != genesisID || parsed[3].(*Block).Status() != choices.Accepted {
+		t.Fatal("expected the last block to be the accepted genesis block")
+	}
+
+	if ancestors, err := vm.GetAncestors(context.Background(), ids.GenerateTestID(), 10, math.MaxInt, time.Minute); err != nil || len(ancestors) != 0 {
+		t.Fatalf("expected no blocks for an unknown block but got %d, %v", len(ancestors), err)
+	}
+}
+
+// Assert that the config's ancestors limits lower the engine's
+func TestGetAncestorsConfigLimits(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"maxAncestorsBlocks": 2}`))
+	ctx := context.Background()
+	parentID, err := vm.LastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	for i := uint64(1); i <= 3; i++ {
+		blk, err := vm.NewBlock(parentID, i, [][dataLen]byte{{byte(i)}}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		parentID = blk.ID()
+		size = len(blk.Bytes()) + wrappers.IntLen
+	}
+
+	ancestors, err := vm.GetAncestors(ctx, parentID, 10, math.MaxInt, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 2 {
+		t.Fatalf("expected 2 blocks but got %d", len(ancestors))
+	}
+
+	config := *vm.config.Load()
+	config.MaxAncestorsBlocks = 0
+	config.MaxAncestorsBytes = size
+	vm.config.Store(&config)
+	ancestors, err = vm.GetAncestors(ctx, parentID, 10, math.MaxInt, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 1 {
+		t.Fatalf("expected only the requested block but got %d blocks", len(ancestors))
+	}
+}
+
+// Assert that values marshaled into pooled buffers match the codec manager's
+// encoding and aren't overwritten when the buffer is reused
+func TestPooledMarshal(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	blk := &Block{Hght: 1, Dt: [][dataLen]byte{{1}}}
+	expected, err := vm.codec.Marshal(codecVersion, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaled, err := vm.marshal(codecVersion, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.marshal(codecVersion, &Block{Hght: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshaled, expected) {
+		t.Fatalf("expected %x but got %x", expected, marshaled)
+	}
+	if _, err := vm.marshal(namespacedTransferCodecVersion+1, blk); err != errUnknownCodecVersion {
+		t.Fatalf("expected %s but got %v", errUnknownCodecVersion, err)
+	}
+}
+
+// Assert that headers decoded from block bytes match the decoded blocks
+func TestParseHeader(t *testing.T) {
+	signer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params:      ChainParams{MaxPayloadSize: dataLen, Fee: 1},
+		Allocations: []Allocation{{Address: signer.Address(), Balance: 1}},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"signingKey": %q}`, signer.String())))
+	ctx := context.Background()
+	genesisID, err := vm.LastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.signBlock(context.Background(), built, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	processing, _, err := vm.getHeader(built.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processing != built.header() {
+		t.Fatalf("expected header %+v but got %+v", built.header(), processing)
+	}
+	if err := built.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := vm.state.getHeader(built.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != built.header() {
+		t.Fatalf("expected header %+v but got %+v", built.header(), header)
+	}
+	blockBytes, status, err := vm.state.getBlockBytes(built.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blockBytes, built.Bytes()) {
+		t.Fatal("stored block has the wrong bytes")
+	}
+	if status != choices.Accepted {
+		t.Fatalf("expected status %s but got %s", choices.Accepted, status)
+	}
+
+	if _, err := parseHeader(built.Bytes()[:headerLen-1]); err != errBadHeader {
+		t.Fatalf("expected %s but got %v", errBadHeader, err)
+	}
+	badVersion := bytes.Clone(built.Bytes())
+	badVersion[1] = namespacedTransferCodecVersion + 1
+	if _, err := parseHeader(badVersion); err != errBadHeader {
+		t.Fatalf("expected %s but got %v", errBadHeader, err)
+	}
+}
+
+// Assert that the profiler is only served with a profiler token, and only to
+// requests that carry it
+func TestProfiler(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handlers[profilerEndpoint]; ok {
+		t.Fatal("expected no profiler without a profiler token")
+	}
+
+	vm, _ = newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"profilerToken": "secret"}`))
+	handlers, err = vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := handlers[profilerEndpoint]
+	for _, test := range []struct {
+		authorization  string
+		profile        string
+		expectedStatus int
+	}{
+		{profile: "heap", expectedStatus: http.StatusUnauthorized},
+		{authorization: "Bearer wrong", profile: "heap", expectedStatus: http.StatusUnauthorized},
+		{authorization: "Bearer secret", profile: "heap", expectedStatus: http.StatusOK},
+		{authorization: "Bearer secret", profile: "nothing", expectedStatus: http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, profilerEndpoint+"?profile="+test.profile, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.expectedStatus {
+			t.Fatalf("%q %s: expected status %d but got %d", test.authorization, test.profile, test.expectedStatus, recorder.Code)
+		}
+	}
+}
+
+// Assert that each version of the API is served at its own path, and that
+// the unversioned path serves the first version
+func TestAPIVersions(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handlers[""] != handlers[unversionedAPI.endpoint] {
+		t.Fatal("expected the unversioned path to serve the first version")
+	}
+	for _, version := range apiVersions {
+		handler, ok := handlers[version.endpoint]
+		if !ok {
+			t.Fatalf("expected %s to be served", version.endpoint)
+		}
+		server := httptest.NewServer(handler)
+		blk, err := NewClient(server.URL, "").GetLastAccepted(context.Background())
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blk.Height != 0 {
+			t.Fatalf("%s: expected the genesis block but got height %d", version.endpoint, blk.Height)
+		}
+	}
+}
+
+// Assert that the explorer page is only served when enabled, and only to GET
+// requests
+func TestExplorerUI(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := handlers[uiEndpoint]; ok {
+		t.Fatal("expected no explorer page unless it's enabled")
+	}
+
+	vm, _ = newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"explorerUI": true}`))
+	handlers, err = vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handlers[uiEndpoint].ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, uiEndpoint, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("expected an HTML page but got %q", contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), Name+".") {
+		t.Fatal("expected the page to call the API")
+	}
+
+	recorder = httptest.NewRecorder()
+	handlers[uiEndpoint].ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, uiEndpoint, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d but got %d", http.StatusMethodNotAllowed, recorder.Code)
+	}
+}
+
+// Assert that the reloadable config fields change on a running chain, over
+// the admin API or from the config file, and that the others don't
+func TestReloadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	config := fmt.Sprintf(`{"buildBatchWindow": "0s", "mempoolSize": 1, "adminToken": "secret", "configFile": %q}`, configFile)
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(config))
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock([dataLen]byte{2}); err != ErrMempoolFull {
+		t.Fatalf("expected %s but got %v", ErrMempoolFull, err)
+	}
+
+	config = fmt.Sprintf(`{"buildBatchWindow": "0s", "mempoolSize": 2, "adminToken": "secret", "configFile": %q}`, configFile)
+	changed, err := vm.ReloadConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(changed, []string{"mempoolSize"}) {
+		t.Fatalf("expected the mempool size to change but got %v", changed)
+	}
+	if err := vm.proposeBlock([dataLen]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vm.ReloadConfig([]byte(`{"mempoolSize": 2, "pruningMode": "rejected"}`)); !errors.Is(err, errNotReloadable) {
+		t.Fatalf("expected %s but got %v", errNotReloadable, err)
+	}
+
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[adminEndpoint])
+	t.Cleanup(server.Close)
+	requester := rpc.NewEndpointRequester(server.URL)
+	ctx := context.Background()
+
+	reply := &ReloadConfigReply{}
+	if err := requester.SendRequest(ctx, AdminName+".reloadConfig", &ReloadConfigArgs{}, reply); err == nil {
+		t.Fatal("expected a request without the admin token to be refused")
+	}
+
+	config = fmt.Sprintf(`{"buildBatchWindow": "0s", "mempoolSize": 2, "blockCacheSize": 8, "adminToken": "secret", "configFile": %q}`, configFile)
+	if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := requester.SendRequest(ctx, AdminName+".reloadConfig", &ReloadConfigArgs{}, reply, rpc.WithHeader("Authorization", "Bearer secret")); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reply.Changed, []string{"blockCacheSize"}) {
+		t.Fatalf("expected the block cache size to change but got %v", reply.Changed)
+	}
+	if vm.config.Load().BlockCacheSize != 8 {
+		t.Fatalf("expected a block cache size of 8 but got %d", vm.config.Load().BlockCacheSize)
+	}
+}
+
+// Assert that the config can be reloaded while API calls and the engine read
+// it without the lock. Run with -race.
+func TestReloadConfigWhileServing(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s"}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			config := fmt.Sprintf(`{"buildBatchWindow": "0s", "mempoolSize": %d, "buildBackoff": "%dms"}`, 10+i%2, i%2)
+			if _, err := vm.ReloadConfig([]byte(config)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 50; i++ {
+		if _, err := client.GetConfig(ctx); err != nil {
+			t.Fatal(err)
+		}
+		_ = vm.referencesEnabled()
+		_ = vm.anchoringEnabled()
+		_ = vm.maxPayloadSize()
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if size := vm.nodeConfig().MempoolSize; size != 11 {
+		t.Fatalf("expected the last reloaded mempool size 11 but got %d", size)
+	}
+}
+
+// logBuffer is a log writer that holds what's logged
+type logBuffer struct {
+	bytes.Buffer
+}
+
+func (*logBuffer) Close() error { return nil }
+
+// Assert that the admin API changes the level of the chain's logs and of each
+// subsystem's logs
+func TestLogLevels(t *testing.T) {
+	ctx := snowtest.Context(t, blockchainID)
+	logs := &logBuffer{}
+	ctx.Log = logging.NewLogger("", logging.NewWrappedCore(logging.Info, logs, logging.Plain.ConsoleEncoder()))
+	vm, _ := initTestVM(t, ctx, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"adminToken": "secret"}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// call calls the admin API method [method] with [params] and returns the
+	// JSON-RPC reply
+	call := func(method, params string) map[string]json.RawMessage {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "admin.%s", "params": %s}`, method, params)
+		req := httptest.NewRequest(http.MethodPost, adminEndpoint, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		handlers[adminEndpoint].ServeHTTP(recorder, req)
+		var reply map[string]json.RawMessage
+		if err := json.Unmarshal(recorder.Body.Bytes(), &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	// logged returns true iff [msg] was logged since the last call
+	logged := func(msg string) bool {
+		defer logs.Reset()
+		return strings.Contains(logs.String(), msg)
+	}
+
+	vm.logs.builder.Debug("before")
+	if logged("before") {
+		t.Fatal("expected the builder to log at the chain's level")
+	}
+	if reply := call("setLogLevel", `{"subsystem": "builder", "level": "debug"}`); reply["error"] != nil {
+		t.Fatal(string(reply["error"]))
+	}
+	vm.logs.builder.Debug("builder debug")
+	if !logged("builder debug") {
+		t.Fatal("expected the builder to log at its own level")
+	}
+	vm.logs.mempool.Debug("mempool debug")
+	if logged("mempool debug") {
+		t.Fatal("expected the mempool to log at the chain's level")
+	}
+
+	reply := call("getLogLevels", `{}`)
+	var levels GetLogLevelsReply
+	if err := json.Unmarshal(reply["result"], &levels); err != nil {
+		t.Fatal(err)
+	}
+	if levels.Chain != "info" || len(levels.Subsystems) != 1 || levels.Subsystems["builder"] != "debug" {
+		t.Fatalf("unexpected log levels %+v", levels)
+	}
+
+	if reply := call("setLogLevel", `{"level": "debug"}`); reply["error"] != nil {
+		t.Fatal(string(reply["error"]))
+	}
+	vm.logs.mempool.Debug("chain debug")
+	if !logged("chain debug") {
+		t.Fatal("expected the mempool to follow the chain's level")
+	}
+	if reply := call("setLogLevel", `{"subsystem": "builder", "level": "warn"}`); reply["error"] != nil {
+		t.Fatal(string(reply["error"]))
+	}
+	vm.logs.builder.Info("builder info")
+	if logged("builder info") {
+		t.Fatal("expected the builder to log at its own level")
+	}
+
+	if reply := call("setLogLevel", `{"subsystem": "nothing", "level": "debug"}`); reply["error"] == nil {
+		t.Fatal("expected an unknown subsystem to be refused")
+	}
+}
+
+// Assert that each API call is logged with its request's ID, which is
+// returned to the client
+func TestRequestLog(t *testing.T) {
+	ctx := snowtest.Context(t, blockchainID)
+	logs := &logBuffer{}
+	ctx.Log = logging.NewLogger("", logging.NewWrappedCore(logging.Debug, logs, logging.Plain.ConsoleEncoder()))
+	vm, _ := initTestVM(t, ctx, []byte{0, 0, 0, 0, 0}, nil, nil)
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// call sends [body] to the API with the request ID [id], if set, and
+	// returns the request ID of the response
+	call := func(body, id string) string {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		recorder := httptest.NewRecorder()
+		handlers[""].ServeHTTP(recorder, req)
+		return recorder.Header().Get(RequestIDHeader)
+	}
+
+	id := call(`{"jsonrpc": "2.0", "id": 1, "method": "timestamp.getBlock", "params": {}}`, "")
+	if id == "" {
+		t.Fatal("expected the response to have a request ID")
+	}
+	if msg := logs.String(); !strings.Contains(msg, "API call succeeded") || !strings.Contains(msg, id) || !strings.Contains(msg, "duration") {
+		t.Fatalf("expected the call to be logged with its request ID and duration but got %q", msg)
+	}
+	logs.Reset()
+
+	// Failed calls are logged with the client's ID
+	badID := `{"jsonrpc": "2.0", "id": 1, "method": "timestamp.getBlock", "params": {"id": "nothing"}}`
+	if id := call(badID, "client-1"); id != "client-1" {
+		t.Fatalf("expected the client's request ID but got %q", id)
+	}
+	if msg := logs.String(); !strings.Contains(msg, "API call failed") || !strings.Contains(msg, "client-1") {
+		t.Fatalf("expected the failed call to be logged with its request ID but got %q", msg)
+	}
+	logs.Reset()
+
+	// IDs that could forge log lines are replaced
+	if id := call(badID, "bad\nid"); id == "bad\nid" || id == "" {
+		t.Fatalf("expected an invalid request ID to be replaced but got %q", id)
+	}
+
+	// The calls of a batch share its ID
+	logs.Reset()
+	id = call(`[{"jsonrpc": "2.0", "id": 1, "method": "timestamp.getBlock", "params": {}}, `+badID+`]`, "")
+	if msg := logs.String(); strings.Count(msg, id) != 2 {
+		t.Fatalf("expected both calls to be logged with the batch's ID but got %q", msg)
+	}
+}
+
+// Assert that invalid arguments are reported the same way by every method,
+// naming the invalid argument
+func TestArgValidation(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "dataReferences": true, "ipfsAnchoring": true}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method        string
+		params        string
+		expectedField string
+	}{
+		{method: "proposeBlock", params: `{"data": "nothing"}`, expectedField: "data"},
+		{method: "proposeBlock", params: `{"data": "", "notBefore": "18446744073709551615"}`, expectedField: "notBefore"},
+		{method: "getBlock", params: `{"id": "nothing"}`, expectedField: "id"},
+		{method: "listBlocks", params: `{"pageSize": "1000"}`, expectedField: "pageSize"},
+		{method: "getProof", params: `{"data": ""}`, expectedField: "data"},
+		{method: "proposeReference", params: `{"locator": "nowhere", "contentHash": ""}`, expectedField: "locator"},
+		{method: "proposeReference", params: `{"locator": "s3://bucket/key", "contentHash": "nothing"}`, expectedField: "contentHash"},
+		{method: "getValue", params: `{"key": ""}`, expectedField: "key"},
+		{method: "getHistory", params: `{"key": ""}`, expectedField: "key"},
+		{method: "getDocumentHistory", params: `{"docID": ""}`, expectedField: "docID"},
+		{method: "getDocumentHistory", params: `{"docID": "contract", "cursor": "nothing"}`, expectedField: "cursor"},
+		{method: "listSubmitters", params: `{"limit": "1000"}`, expectedField: "limit"},
+		{method: "anchorCID", params: `{"cid": "nothing"}`, expectedField: "cid"},
+		{method: "anchorCID", params: `{"cid": "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", "contentType": "not a type"}`, expectedField: "contentType"},
+	} {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "timestamp.%s", "params": %s}`, test.method, test.params)
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		recorder := httptest.NewRecorder()
+		handlers[""].ServeHTTP(recorder, req)
+
+		var reply struct {
+			Error *struct {
+				Code int `json:"code"`
+				Data struct {
+					Field string `json:"field"`
+				} `json:"data"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Error == nil {
+			t.Fatalf("%s: expected an error", test.method)
+		}
+		if reply.Error.Code != -32602 || reply.Error.Data.Field != test.expectedField {
+			t.Fatalf("%s: expected an invalid params error for %q but got %+v", test.method, test.expectedField, *reply.Error)
+		}
+	}
+
+	// Called directly, methods return the cause of the invalid argument
+	service := &Service{vm}
+	err = service.ProposeSignerOp(nil, &ProposeSignerOpArgs{Signature: "nothing"}, &ProposeSignerOpReply{})
+	if err != errNoSignerSet {
+		t.Fatalf("expected %s but got %v", errNoSignerSet, err)
+	}
+	err = service.GetHeaders(nil, &GetHeadersArgs{Limit: maxHeaderPageSize + 1}, &GetHeadersReply{})
+	if !errors.Is(err, errBadLimit) {
+		t.Fatalf("expected %s but got %v", errBadLimit, err)
+	}
+}
+
+// Assert that clients can read the chain's genesis and the node's config,
+// without its secrets
+func TestGetGenesisAndConfig(t *testing.T) {
+	vm := newTestVMWithGenesis(t, &Genesis{Params: ChainParams{MaxPayloadSize: 20}}, []byte(`{"mempoolSize": 7, "profilerToken": "secret", "adminToken": "secret"}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	genesis, err := client.GetGenesis(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.Genesis.Params.MaxPayloadSize != 20 || genesis.DataLen != dataLen || genesis.Encoding != "cb58" {
+		t.Fatalf("unexpected genesis %+v", genesis)
+	}
+
+	config, err := client.GetConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MempoolSize != 7 {
+		t.Fatalf("expected a mempool size of 7 but got %d", config.MempoolSize)
+	}
+	if config.ProfilerToken != "" || config.AdminToken != "" {
+		t.Fatal("expected the config's tokens to be left out")
+	}
+	if vm.config.Load().ProfilerToken != "secret" {
+		t.Fatal("expected the node's config to keep its tokens")
+	}
+}
+
+// Assert that the chain head reports a preferred block that isn't accepted
+// yet
+func TestGetChainHead(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	genesisID, err := vm.LastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.NewBlock(genesisID, 1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	head, err := client.GetChainHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := GetChainHeadReply{LastAcceptedID: genesisID, PreferredID: blk.ID(), PreferredHeight: 1}
+	if *head != expected {
+		t.Fatalf("expected %+v but got %+v", expected, head)
+	}
+
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	head, err = client.GetChainHead(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.LastAcceptedID != blk.ID() || head.LastAcceptedHeight != 1 || head.PreferredID != blk.ID() {
+		t.Fatalf("expected the accepted block to be preferred but got %+v", head)
+	}
+}
+
+// Assert that the client proposes data and gets blocks over the API
+func TestClient(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s"}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	if err := client.ProposeBlock(ctx, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ProposeBlock(ctx, make([]byte, dataLen+1)); err == nil {
+		t.Fatal("expected too much data to be refused")
+	}
+	if size, err := client.GetMempoolSize(ctx); err != nil || size != 1 {
+		t.Fatalf("expected a mempool size of 1 but got %d (%v)", size, err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lastAccepted, err := client.GetLastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastAccepted.ID != blk.ID().String() || lastAccepted.Height != 1 || len(lastAccepted.Data) != 1 {
+		t.Fatalf("unexpected last accepted block %+v", lastAccepted)
+	}
+	byHeight, err := client.GetBlockByHeight(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byHeight.ID != lastAccepted.ID {
+		t.Fatalf("expected block %s at height 1 but got %s", lastAccepted.ID, byHeight.ID)
+	}
+	parent, err := client.GetBlock(ctx, blk.Parent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.Height != 0 {
+		t.Fatalf("expected the genesis block but got height %d", parent.Height)
+	}
+	if _, err := client.GetBlockByHeight(ctx, 2); err == nil {
+		t.Fatal("expected no block at height 2")
+	}
+}
+
+// Assert that built, accepted and rejected blocks are counted
+func TestMetrics(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	ctx := context.Background()
+
+	// The genesis block was accepted when the chain was initialized
+	if accepted := testutil.ToFloat64(vm.metrics.blocksAccepted); accepted != 1 {
+		t.Fatalf("expected 1 accepted block but got %v", accepted)
+	}
+	build := func(data byte) *Block {
+		if err := vm.proposeBlock([dataLen]byte{data}); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+	accepted := build(1)
+	if err := accepted.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, accepted.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := build(2).Reject(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{"built", vm.metrics.blocksBuilt, 2},
+		{"accepted", vm.metrics.blocksAccepted, 2},
+		{"rejected", vm.metrics.blocksRejected, 1},
+	} {
+		if actual := testutil.ToFloat64(test.counter); actual != test.expected {
+			t.Fatalf("expected %v blocks %s but got %v", test.expected, test.name, actual)
+		}
+	}
+}
+
+// tracer records spans in memory
+type tracer struct {
+	oteltrace.Tracer
+}
+
+func (tracer) Close() error { return nil }
+
+// Assert that proposals, and the building, verification and acceptance of
+// blocks, are traced
+func TestTracing(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	recorder := tracetest.NewSpanRecorder()
+	vm.tracer = tracer{sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")}
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	ctx := context.Background()
+
+	if err := NewClient(server.URL, "timestamp").ProposeBlock(ctx, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"timestamp.ProposeBlock", "timestampvm.BuildBlock", "timestampvm.Verify", "timestampvm.Accept"}
+	spans := recorder.Ended()
+	if len(spans) != len(expected) {
+		t.Fatalf("expected %d spans but got %d", len(expected), len(spans))
+	}
+	for i, span := range spans {
+		if span.Name() != expected[i] {
+			t.Fatalf("expected span %q but got %q", expected[i], span.Name())
+		}
+	}
+}
+
+// Assert that accepted blocks are POSTed to webhooks with a valid signature,
+// and that payloads that can't be sent are dead-lettered
+func TestWebhooks(t *testing.T) {
+	received := make(chan BlockEvent, 1)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get(WebhookSignatureHeader)), []byte(SignWebhookPayload("secret", body))) {
+			t.Error("webhook payload has a bad signature")
+		}
+		var payload BlockEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+		received <- payload
+	}))
+	t.Cleanup(good.Close)
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(bad.Close)
+
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters")
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "webhooks": {"urls": [%q, %q], "secret": "secret", "maxAttempts": 2, "retryDelay": "1ms", "deadLetterPath": %q}}`, good.URL, bad.URL, deadLetterPath))
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, configBytes)
+	ctx := context.Background()
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-received:
+		if payload.Block.ID != blk.ID().String() || payload.ChainID != vm.ctx.ChainID {
+			t.Fatalf("unexpected webhook payload %+v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called")
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		deadLetters, err := os.ReadFile(deadLetterPath)
+		if err == nil && bytes.Contains(deadLetters, []byte(bad.URL)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("payload wasn't dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// recordingBus records the events published to it
+type recordingBus chan []byte
+
+func (m recordingBus) send(_ context.Context, _ ids.ID, event []byte) error {
+	m <- event
+	return nil
+}
+
+func (recordingBus) close() error { return nil }
+
+// Assert that blocks accepted after bootstrapping are published to the
+// message bus
+func TestPublisher(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	bus := make(recordingBus, 1)
+	vm.publisher = newPublisher(bus, 0, vm.ctx.Log)
+	ctx := context.Background()
+
+	accept := func(data byte) *Block {
+		if err := vm.proposeBlock([dataLen]byte{data}); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+
+	// Blocks accepted while bootstrapping aren't published
+	if err := vm.SetState(ctx, snow.Bootstrapping); err != nil {
+		t.Fatal(err)
+	}
+	accept(1)
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+	blk := accept(2)
+
+	select {
+	case eventBytes := <-bus:
+		var event BlockEvent
+		if err := json.Unmarshal(eventBytes, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Block.ID != blk.ID().String() {
+			t.Fatalf("expected the event of block %s but got %s", blk.ID(), event.Block.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("block event wasn't published")
+	}
+}
+
+// Assert that anchored IPFS content is listed with the block that accepted
+// its digest, and that anchoring is disabled by default
+func TestIPFSAnchoring(t *testing.T) {
+	const (
+		cid      = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+		otherCID = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	)
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "ipfsAnchoring": true}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	if err := service.AnchorCID(nil, &AnchorCIDArgs{CID: cid, ContentType: "text/plain"}, &AnchorCIDReply{}); err != nil {
+		t.Fatal(err)
+	}
+	reply := &ListAnchoredCIDsReply{}
+	if err := service.ListAnchoredCIDs(nil, &ListAnchoredCIDsArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Anchors) != 1 || reply.Anchors[0].CID != cid || reply.Anchors[0].BlockID != "" {
+		t.Fatalf("expected the unaccepted anchor but got %+v", reply.Anchors)
+	}
+
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ListAnchoredCIDs(nil, &ListAnchoredCIDsArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Anchors) != 1 || reply.Anchors[0].BlockID != blk.ID().String() || reply.Anchors[0].ContentType != "text/plain" {
+		t.Fatalf("expected the anchor accepted in block %s but got %+v", blk.ID(), reply.Anchors)
+	}
+
+	if err := service.AnchorCID(nil, &AnchorCIDArgs{CID: otherCID}, &AnchorCIDReply{}); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		cids   []string
+		cursor string
+	)
+	for {
+		reply := &ListAnchoredCIDsReply{}
+		if err := service.ListAnchoredCIDs(nil, &ListAnchoredCIDsArgs{Limit: 1, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range reply.Anchors {
+			cids = append(cids, a.CID)
+		}
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(cids) != 2 || cids[0] == cids[1] || !slices.Contains(cids, cid) || !slices.Contains(cids, otherCID) {
+		t.Fatalf("expected the pages to have both anchors but got %v", cids)
+	}
+
+	disabled, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	if err := (&Service{disabled}).AnchorCID(nil, &AnchorCIDArgs{CID: cid}, &AnchorCIDReply{}); err != errAnchoringDisabled {
+		t.Fatalf("expected %s but got %v", errAnchoringDisabled, err)
+	}
+}
+
+// Assert that a data reference is only verified if the content at its
+// locator matches it, and that references need a well-formed content hash
+func TestDataReferences(t *testing.T) {
+	const content = "off-chain content"
+	served := []byte(content)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(served)
+	}))
+	defer server.Close()
+
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "dataReferences": true}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	hash := sha256.Sum256([]byte(content))
+	args := &ProposeReferenceArgs{
+		Locator:     server.URL + "/content",
+		ContentHash: "sha256:" + hex.EncodeToString(hash[:]),
+		Size:        17, // len(content)
+	}
+	proposeReply := &ProposeReferenceReply{}
+	if err := service.ProposeReference(nil, args, proposeReply); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := &GetReferenceReply{}
+	if err := service.GetReference(nil, &GetReferenceArgs{Data: proposeReply.Data, Verify: true}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Locator != args.Locator || reply.ContentHash != args.ContentHash || reply.BlockID != blk.ID().String() || !reply.Verified {
+		t.Fatalf("unexpected reference %+v", reply)
+	}
+	served = []byte("off-chain CONTENT")
+	if err := service.GetReference(nil, &GetReferenceArgs{Data: proposeReply.Data, Verify: true}, &GetReferenceReply{}); err != errReferenceMismatch {
+		t.Fatalf("expected %s but got %v", errReferenceMismatch, err)
+	}
+	served = []byte(content[1:])
+	if err := service.GetReference(nil, &GetReferenceArgs{Data: proposeReply.Data, Verify: true}, &GetReferenceReply{}); err != errReferenceSize {
+		t.Fatalf("expected %s but got %v", errReferenceSize, err)
+	}
+
+	for _, contentHash := range []string{
+		hex.EncodeToString(hash[:]),
+		"sha256:" + hex.EncodeToString(hash[1:]),
+		"sha256:" + strings.ToUpper(hex.EncodeToString(hash[:])),
+	} {
+		args := &ProposeReferenceArgs{Locator: "s3://bucket/key", ContentHash: contentHash, Size: 1}
+		if err := service.ProposeReference(nil, args, &ProposeReferenceReply{}); !errors.Is(err, errBadContentHash) {
+			t.Fatalf("expected %s but got %v", errBadContentHash, err)
+		}
+	}
+}
+
+// Assert that blocks can be signed by a remote signer, and that signatures
+// from a key other than the configured one are refused
+func TestRemoteSigner(t *testing.T) {
+	key, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingKey := key
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req remoteSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hash, err := hex.DecodeString(req.Hash)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, err := signingKey.SignHash(hash)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(remoteSignResponse{Signature: hex.EncodeToString(sig)})
+	}))
+	t.Cleanup(server.Close)
+
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{key.Address()},
+		},
+	}
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "remoteSigner": {"url": %q, "address": %q, "token": "token"}}`, server.URL, key.Address()))
+	vm := newTestVMWithGenesis(t, genesis, configBytes)
+	service := &Service{vm}
+	ctx := context.Background()
+
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: "SkB7qHwfMsyF2PgrjhMvtFxJKhuR5ZfVoW9VATWRV4P9jV7J"}, &ProposeBlockReply{}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if signer := blk.(*Block).signerAddr; signer != key.Address() {
+		t.Fatalf("expected the block to be signed by %s but got %s", key.Address(), signer)
+	}
+
+	// A signer that signs with the wrong key doesn't sign blocks
+	if signingKey, err = secp256k1.NewPrivateKey(); err != nil {
+		t.Fatal(err)
+	}
+	parent, err := vm.getBlock(vm.preferred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := vm.NewBlock(parent.ID(), parent.Height()+1, [][dataLen]byte{{1}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.signBlock(ctx, unsigned, nil); !errors.Is(err, errRemoteSignerAddress) {
+		t.Fatalf("expected %s but got %v", errRemoteSignerAddress, err)
+	}
+}
+
+// Assert that a block that isn't built before the build timeout, because the
+// remote signer doesn't answer, is abandoned and its data is put back into
+// the mempool for the next block
+func TestBuildTimeout(t *testing.T) {
+	key, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hang atomic.Bool
+	hang.Store(true)
+	// Closed before the server is, so that hanging requests return
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hang.Load() {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		var req remoteSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hash, err := hex.DecodeString(req.Hash)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, err := key.SignHash(hash)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(remoteSignResponse{Signature: hex.EncodeToString(sig)})
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{key.Address()},
+		},
+	}
+	configBytes := []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "buildTimeout": "50ms", "remoteSigner": {"url": %q, "address": %q}}`, server.URL, key.Address()))
+	vm := newTestVMWithGenesis(t, genesis, configBytes)
+	ctx := context.Background()
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %s but got %v", context.DeadlineExceeded, err)
+	}
+	if failures := testutil.ToFloat64(vm.metrics.buildFailures); failures != 1 {
+		t.Fatalf("expected 1 build failure but got %f", failures)
+	}
+
+	hang.Store(false)
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := blk.(*Block).Data(); len(data) != 1 || data[0] != ([dataLen]byte{1}) {
+		t.Fatalf("expected the data of the abandoned block to be built into the next block but got %v", data)
+	}
+}
+
+// Assert that an admin's key can be generated, saved and loaded by a client,
+// which signs signer operations without sending the key to the node
+func TestClientSigning(t *testing.T) {
+	admin, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "admin.key")
+	if err := SaveKey(path, admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKey(path, admin); err == nil {
+		t.Fatal("expected an existing key file not to be overwritten")
+	}
+	loaded, err := LoadKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Address() != admin.Address() {
+		t.Fatalf("expected key %s but loaded %s", admin.Address(), loaded.Address())
+	}
+
+	signer, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{signer.Address()},
+			Admins:         []ids.ShortID{admin.Address()},
+		},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, signer.String())))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	op := SignerOp{Add: true, Signer: ids.GenerateTestShortID()}
+	if err := op.Sign(vm.ctx.ChainID, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ProposeSignerOp(ctx, op); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ops := blk.(*Block).Ops; len(ops) != 1 || ops[0] != op {
+		t.Fatalf("expected the signer operation in the block but got %v", ops)
+	}
+}
+
+// Assert that a JSON-RPC batch request is answered with the response to each
+// call that isn't a notification, in order
+func TestBatchRequests(t *testing.T) {
+	vm, _ := newTestVM(t, []byte{0, 0, 0, 0, 0})
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+
+	post := func(body string) (int, []byte) {
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, respBody
+	}
+
+	_, body := post(`[
+		{"jsonrpc": "2.0", "method": "timestamp.getBlockByHeight", "params": {"height": "0"}, "id": 1},
+		{"jsonrpc": "2.0", "method": "timestamp.getMempoolSize", "params": {}},
+		{"jsonrpc": "2.0", "method": "timestamp.noSuchMethod", "params": {}, "id": "b"},
+		{"jsonrpc": "2.0", "method": "timestamp.getBlock", "params": {}, "id": 3}
+	]`)
+	var responses []struct {
+		ID     json.RawMessage  `json:"id"`
+		Result *GetBlockReply   `json:"result"`
+		Error  *json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &responses); err != nil {
+		t.Fatalf("couldn't parse %s: %s", body, err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses but got %s", body)
+	}
+	if string(responses[0].ID) != "1" || responses[0].Result == nil || responses[0].Result.Height != 0 {
+		t.Fatalf("expected the genesis block but got %s", body)
+	}
+	if string(responses[1].ID) != `"b"` || responses[1].Error == nil {
+		t.Fatalf("expected an error for the unknown method but got %s", body)
+	}
+	if string(responses[2].ID) != "3" || responses[2].Result == nil || responses[2].Result.ID != responses[0].Result.ID {
+		t.Fatalf("expected the last accepted block but got %s", body)
+	}
+
+	if status, body := post(`[{"jsonrpc": "2.0", "method": "timestamp.getMempoolSize", "params": {}}]`); status != http.StatusNoContent || len(body) != 0 {
+		t.Fatalf("expected no response to notifications but got %d %s", status, body)
+	}
+	if _, body := post(`[]`); !bytes.Contains(body, []byte(`"code":-32600`)) {
+		t.Fatalf("expected an invalid request error but got %s", body)
+	}
+	// Requests that aren't batches are served as before
+	if _, body := post(`{"jsonrpc": "2.0", "method": "timestamp.getMempoolSize", "params": {}, "id": 1}`); !bytes.Contains(body, []byte(`"size"`)) {
+		t.Fatalf("expected the mempool size but got %s", body)
+	}
+	// Requests larger than the max batch bytes aren't read
+	large := "[" + strings.Repeat(`{"jsonrpc": "2.0", "method": "timestamp.getMempoolSize", "params": {}},`, defaultMaxBatchBytes/64) + "]"
+	if status, _ := post(large); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status %d for a request over the max batch bytes but got %d", http.StatusRequestEntityTooLarge, status)
+	}
+}
+
+// Assert that the explorer APIs page through, search and count accepted
+// blocks, and total the blocks of each submitter
+func TestExplorer(t *testing.T) {
+	signer, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{
+		Params: ChainParams{
+			MaxPayloadSize: dataLen,
+			Signers:        []ids.ShortID{signer.Address()},
+		},
+	}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, signer.String())))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	var last *Block
+	for i := byte(1); i <= 3; i++ {
+		if err := vm.proposeBlock([dataLen]byte{i}); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		last = blk.(*Block)
+	}
+
+	page := &ListBlocksReply{}
+	if err := service.ListBlocks(nil, &ListBlocksArgs{Page: 1, PageSize: 3}, page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 4 || len(page.Blocks) != 1 || page.Blocks[0].Height != 0 {
+		t.Fatalf("expected only the genesis block on the second page but got %+v", page)
+	}
+	if err := service.ListBlocks(nil, &ListBlocksArgs{PageSize: 3}, page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Blocks) != 3 || page.Blocks[0].ID != last.ID().String() || page.Blocks[2].Height != 1 {
+		t.Fatalf("expected the newest 3 blocks but got %+v", page.Blocks)
+	}
+
+	for _, query := range []string{last.ID().String(), "3", page.Blocks[0].Data[0]} {
+		reply := &SearchReply{}
+		if err := service.Search(nil, &SearchArgs{Query: query}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Block.ID != last.ID().String() {
+			t.Fatalf("expected %q to find block %s but got %+v", query, last.ID(), reply)
+		}
+	}
+	if err := service.Search(nil, &SearchArgs{Query: "4"}, &SearchReply{}); err != errNoSearchResult {
+		t.Fatalf("expected %s but got %v", errNoSearchResult, err)
+	}
+
+	// The genesis block's timestamp is the Unix epoch
+	for start, expected := range map[string]uint64{
+		"1970-01-01": 1,
+		last.Timestamp().UTC().Format(time.DateOnly): 3,
+	} {
+		reply := &GetDailyBlockCountsReply{}
+		if err := service.GetDailyBlockCounts(nil, &GetDailyBlockCountsArgs{Start: start, Days: 1}, reply); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Counts) != 1 || uint64(reply.Counts[0].Count) != expected {
+			t.Fatalf("expected %d blocks on %s but got %+v", expected, start, reply.Counts)
+		}
+	}
+
+	submitters := &ListSubmittersReply{}
+	if err := service.ListSubmitters(nil, &ListSubmittersArgs{}, submitters); err != nil {
+		t.Fatal(err)
+	}
+	if len(submitters.Submitters) != 1 || submitters.Submitters[0] != (SubmitterSummary{Address: signer.Address(), Blocks: 3, Data: 3}) {
+		t.Fatalf("expected the signer to have signed 3 blocks but got %+v", submitters.Submitters)
+	}
+
+	// Stats of other signers, so that the submitters span pages
+	for i := 0; i < 2; i++ {
+		if err := vm.state.putSubmitterStats(ids.GenerateTestShortID(), submitterStats{blocks: 1, data: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		addrs  []ids.ShortID
+		cursor string
+	)
+	for {
+		reply := &ListSubmittersReply{}
+		if err := service.ListSubmitters(nil, &ListSubmittersArgs{Limit: 2, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range reply.Submitters {
+			addrs = append(addrs, s.Address)
+		}
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(addrs) != 3 || !slices.IsSortedFunc(addrs, ids.ShortID.Compare) || !slices.Contains(addrs, signer.Address()) {
+		t.Fatalf("expected the pages to have the 3 submitters in order but got %v", addrs)
+	}
+
+	// The queries of a request whose client disconnected stop
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(cancelled)
+	if err := service.ListBlocks(req, &ListBlocksArgs{PageSize: 3}, &ListBlocksReply{}); err != context.Canceled {
+		t.Fatalf("expected %s but got %v", context.Canceled, err)
+	}
+	if err := service.ListSubmitters(req, &ListSubmittersArgs{}, &ListSubmittersReply{}); err != context.Canceled {
+		t.Fatalf("expected %s but got %v", context.Canceled, err)
+	}
+}
+
+// Assert that on a chain with the key-value payload rule, accepted puts and
+// deletes are materialized in the key-value state along with their history
+func TestKeyValue(t *testing.T) {
+	put, err := EncodePut("greeting", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedPut, err := cb58.Encode(put[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := newTestVMWithGenesis(t, &Genesis{
+		Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{KeyValuePayloadRule}},
+		Data:   []string{encodedPut},
+	}, []byte(`{"buildBatchWindow": "0s"}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	value := &GetValueReply{}
+	if err := service.GetValue(nil, &GetValueArgs{Key: "greeting"}, value); err != nil {
+		t.Fatal(err)
+	}
+	if decoded, err := cb58.Decode(value.Value); err != nil || !bytes.HasPrefix(decoded, []byte("hello")) || value.Height != 0 {
+		t.Fatalf("expected the genesis value but got %+v", value)
+	}
+
+	if err := vm.verifyProposal([]byte{1}, [NamespaceLen]byte{}); err != errBadKVOp {
+		t.Fatalf("expected %s but got %v", errBadKVOp, err)
+	}
+	del, err := EncodeDelete("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := EncodePut("other", []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range [][dataLen]byte{del, other} {
+		if err := vm.proposeBlock(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.GetValue(nil, &GetValueArgs{Key: "greeting"}, value); err != errNoSuchKey {
+		t.Fatalf("expected %s but got %v", errNoSuchKey, err)
+	}
+	if err := service.GetValue(nil, &GetValueArgs{Key: "other"}, value); err != nil || value.Height != 1 {
+		t.Fatalf("expected the value put at height 1 but got %+v (%v)", value, err)
+	}
+	history := &GetHistoryReply{}
+	if err := service.GetHistory(nil, &GetHistoryArgs{Key: "greeting"}, history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.History) != 2 || history.History[0].Op != "put" || history.History[1].Op != "delete" || history.History[1].Height != 1 {
+		t.Fatalf("expected a put and then a delete but got %+v", history.History)
+	}
+
+	var (
+		ops    []APIKVOp
+		cursor string
+	)
+	for {
+		reply := &GetHistoryReply{}
+		if err := service.GetHistory(nil, &GetHistoryArgs{Key: "greeting", Limit: 1, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, reply.History...)
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(ops, history.History) {
+		t.Fatalf("expected the pages to have the operations %+v but got %+v", history.History, ops)
+	}
+}
+
+// Assert that versions of a document proposed in different blocks form the
+// document's history
+func TestDocumentHistory(t *testing.T) {
+	first, err := EncodeDocumentVersion("contract", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedFirst, err := cb58.Encode(first[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := newTestVMWithGenesis(t, &Genesis{
+		Params: ChainParams{MaxPayloadSize: dataLen, PayloadRules: []PayloadRule{DocumentPayloadRule}},
+		Data:   []string{encodedFirst},
+	}, []byte(`{"buildBatchWindow": "0s"}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	if err := vm.verifyProposal([]byte{0, 1}, [NamespaceLen]byte{}); err != errBadDocVersion {
+		t.Fatalf("expected %s but got %v", errBadDocVersion, err)
+	}
+	if err := service.GetDocumentHistory(nil, &GetDocumentHistoryArgs{DocID: "other"}, &GetDocumentHistoryReply{}); err != errNoSuchDocument {
+		t.Fatalf("expected %s but got %v", errNoSuchDocument, err)
+	}
+
+	second, err := EncodeDocumentVersion("contract", []byte("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := EncodeDocumentVersion("other", []byte("v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range [][dataLen]byte{second, other} {
+		if err := vm.proposeBlock(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	history := &GetDocumentHistoryReply{}
+	if err := service.GetDocumentHistory(nil, &GetDocumentHistoryArgs{DocID: "contract"}, history); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		versions []APIDocumentVersion
+		cursor   string
+	)
+	for {
+		reply := &GetDocumentHistoryReply{}
+		if err := service.GetDocumentHistory(nil, &GetDocumentHistoryArgs{DocID: "contract", Limit: 1, Cursor: cursor}, reply); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, reply.Versions...)
+		if cursor = reply.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if !slices.Equal(versions, history.Versions) {
+		t.Fatalf("expected the pages to have the versions %+v but got %+v", history.Versions, versions)
+	}
+	if len(history.Versions) != 2 || history.Versions[0].Data != encodedFirst || history.Versions[0].Height != 0 || history.Versions[1].Version != 2 || history.Versions[1].Height != 1 {
+		t.Fatalf("expected the genesis version and then the second version but got %+v", history.Versions)
+	}
+	digest := sha256.Sum256([]byte("v2"))
+	if decoded, err := cb58.Decode(history.Versions[1].Digest); err != nil || !bytes.Equal(decoded, digest[:DocDigestLen]) {
+		t.Fatalf("unexpected digest %s", history.Versions[1].Digest)
+	}
+}
+
+// Assert that oracle feed updates are accepted in the order of their
+// timestamps only if they're signed by one of the feed's oracles, and that
+// the latest value and history of each feed are served
+func TestOracleFeeds(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oracle, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		Feeds:          []FeedConfig{{ID: "AVAX/USD", Oracles: []ids.ShortID{oracle.Address()}}},
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+	feed, err := parseFeedID("AVAX/USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit := func(key *secp256k1.PrivateKey, u FeedUpdate) error {
+		if err := u.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := cb58.Encode(u.Sig[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := &SubmitFeedUpdateArgs{
+			Feed:      "AVAX/USD",
+			Value:     u.Value,
+			Timestamp: avajson.Uint64(u.Timestamp),
+			Signature: sig,
+		}
+		return service.SubmitFeedUpdate(nil, args, &SubmitFeedUpdateReply{})
+	}
+	acceptNext := func() *Block {
+		blk, err := vm.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+
+	if err := service.GetFeedValue(nil, &GetFeedValueArgs{Feed: "AVAX/USD"}, &APIFeedUpdate{}); err != errNoFeedUpdate {
+		t.Fatalf("expected %s but got %v", errNoFeedUpdate, err)
+	}
+	if err := submit(other, FeedUpdate{Feed: feed, Value: 1, Timestamp: 1000}); err != errNotOracle {
+		t.Fatalf("expected %s but got %v", errNotOracle, err)
+	}
+
+	// The later update is submitted first but is accepted second
+	if err := submit(oracle, FeedUpdate{Feed: feed, Value: 12, Timestamp: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := submit(oracle, FeedUpdate{Feed: feed, Value: -11, Timestamp: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	blk := acceptNext()
+	if len(blk.FeedUpdates) != 2 || blk.FeedUpdates[0].Timestamp != 1000 || blk.FeedUpdates[1].Timestamp != 2000 {
+		t.Fatalf("expected both updates oldest first but got %+v", blk.FeedUpdates)
+	}
+	if vm.pendingFeeds.len() != 0 {
+		t.Fatalf("expected no pending feed updates but got %d", vm.pendingFeeds.len())
+	}
+
+	latest := &APIFeedUpdate{}
+	if err := service.GetFeedValue(nil, &GetFeedValueArgs{Feed: "AVAX/USD"}, latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Value != 12 || latest.Timestamp != 2000 || latest.Oracle != oracle.Address() || latest.Height != 1 {
+		t.Fatalf("unexpected latest update %+v", latest)
+	}
+
+	// A replayed update is never built into a block
+	if err := submit(oracle, FeedUpdate{Feed: feed, Value: 12, Timestamp: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.pendingFeeds.prune(vm); err != nil {
+		t.Fatal(err)
+	}
+	if vm.pendingFeeds.len() != 0 {
+		t.Fatal("expected the replayed update to be pruned")
+	}
+	stale := FeedUpdate{Feed: feed, Value: 13, Timestamp: 1500}
+	if err := stale.Sign(vm.ctx.ChainID, oracle); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.verifyFeedUpdate(&stale, 2000, blk.Tmstmp); err != errStaleFeedUpdate {
+		t.Fatalf("expected %s but got %v", errStaleFeedUpdate, err)
+	}
+	future := FeedUpdate{Feed: feed, Value: 13, Timestamp: uint64(blk.Tmstmp) + 1}
+	if err := future.Sign(vm.ctx.ChainID, oracle); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.verifyFeedUpdate(&future, 2000, blk.Tmstmp); err != errFutureFeedUpdate {
+		t.Fatalf("expected %s but got %v", errFutureFeedUpdate, err)
+	}
+
+	if err := submit(oracle, FeedUpdate{Feed: feed, Value: 14, Timestamp: 3000}); err != nil {
+		t.Fatal(err)
+	}
+	acceptNext()
+	history := &GetFeedHistoryReply{}
+	if err := service.GetFeedHistory(nil, &GetFeedHistoryArgs{Feed: "AVAX/USD", StartTime: 1500}, history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Updates) != 2 || history.Updates[0].Value != 12 || history.Updates[1].Value != 14 || history.Updates[1].Height != 2 {
+		t.Fatalf("unexpected history %+v", history.Updates)
+	}
+}
+
+// Assert that submitted hashes are aggregated into a Merkle tree whose root
+// is proposed, and that each hash's inclusion proof verifies against the
+// block with the root
+func TestHashAggregation(t *testing.T) {
+	// The interval is long so that the test flushes the aggregator itself
+	vm := newTestVMWithGenesis(t, &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}, []byte(`{"buildBatchWindow": "0s", "aggregation": {"interval": "1h"}}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	hashes := make([][dataLen]byte, 5)
+	for i := range hashes {
+		hashes[i] = sha256.Sum256([]byte{byte(i)})
+		encoded, err := cb58.Encode(hashes[i][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := service.SubmitHash(nil, &SubmitHashArgs{Hash: encoded}, &SubmitHashReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encodedFirst, err := cb58.Encode(hashes[0][:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := &GetInclusionProofReply{}
+	if err := service.GetInclusionProof(nil, &GetInclusionProofArgs{Hash: encodedFirst}, reply); err != errHashPending {
+		t.Fatalf("expected %s but got %v", errHashPending, err)
+	}
+
+	if err := vm.aggregator.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if vm.builder.len() != 1 {
+		t.Fatalf("expected only the root to be proposed but the mempool has %d pieces of data", vm.builder.len())
+	}
+	if err := service.GetInclusionProof(nil, &GetInclusionProofArgs{Hash: encodedFirst}, reply); err != errDataNotAccepted {
+		t.Fatalf("expected %s but got %v", errDataNotAccepted, err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hash := range hashes {
+		encoded, err := cb58.Encode(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &GetInclusionProofReply{}
+		if err := service.GetInclusionProof(nil, &GetInclusionProofArgs{Hash: encoded}, reply); err != nil {
+			t.Fatal(err)
+		}
+		timestamp, err := reply.Proof.Verify(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if timestamp.BlockID != blk.ID() {
+			t.Fatalf("expected block %s but got %s", blk.ID(), timestamp.BlockID)
+		}
+	}
+
+	// A path doesn't verify for another hash
+	if err := service.GetInclusionProof(nil, &GetInclusionProofArgs{Hash: encodedFirst}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reply.Proof.Verify(hashes[1][:]); err == nil {
+		t.Fatal("expected the proof of one hash not to verify for another")
+	}
+}
+
+// Assert that the light headers of accepted blocks form a chain that a client
+// can follow from a checkpoint, and that data can be checked against them
+func TestLightHeaders(t *testing.T) {
+	key, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, key.String())))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	for i := byte(1); i <= 3; i++ {
+		for j := byte(0); j < i; j++ {
+			if err := vm.proposeBlock([dataLen]byte{i, j}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reply := &GetHeadersReply{}
+	if err := service.GetHeaders(nil, &GetHeadersArgs{}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Headers) != 4 {
+		t.Fatalf("expected 4 headers but got %d", len(reply.Headers))
+	}
+	genesisHeader := reply.Headers[0]
+	if err := light.VerifyChain(genesisHeader, reply.Headers[1:]); err != nil {
+		t.Fatal(err)
+	}
+	last := reply.Headers[3]
+	if err := last.VerifyCheckpoint(vm.ctx.ChainID, reply.Checkpoint, key.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if err := last.VerifyCheckpoint(vm.ctx.ChainID, reply.Checkpoint, ids.GenerateTestShortID()); err == nil {
+		t.Fatal("expected a checkpoint from an untrusted signer not to verify")
+	}
+
+	// A header can't be swapped out of the chain
+	tampered := slices.Clone(reply.Headers[1:])
+	tampered[1].PayloadRoot = ids.Empty
+	if err := light.VerifyChain(genesisHeader, tampered); err == nil {
+		t.Fatal("expected a tampered header chain not to verify")
+	}
+
+	page := &GetHeadersReply{}
+	if err := service.GetHeaders(nil, &GetHeadersArgs{StartHeight: 2, Limit: 1}, page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Headers) != 1 || page.Headers[0] != reply.Headers[2] {
+		t.Fatalf("expected the header at height 2 but got %+v", page.Headers)
+	}
+	if err := service.GetHeaders(nil, &GetHeadersArgs{StartHeight: 4}, page); err != errNoLightHeaders {
+		t.Fatalf("expected %s but got %v", errNoLightHeaders, err)
+	}
+
+	data := [dataLen]byte{3, 1}
+	encoded, err := cb58.Encode(data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := &GetPayloadPathReply{}
+	if err := service.GetPayloadPath(nil, &GetPayloadPathArgs{Data: encoded}, path); err != nil {
+		t.Fatal(err)
+	}
+	if path.Header != last {
+		t.Fatalf("expected the header at height 3 but got %+v", path.Header)
+	}
+	if err := last.VerifyData(data, &path.Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := last.VerifyData([dataLen]byte{3, 2}, &path.Path); err == nil {
+		t.Fatal("expected the path of one piece of data not to verify for another")
+	}
+}
+
+// Assert that a Warp message from an approved chain is only accepted if it's
+// signed by the quorum of the chain's validators at the P-Chain height its
+// block is verified at, and that a chain can attest a hash only once
+func TestWarpRelay(t *testing.T) {
+	builder, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceChainID := ids.GenerateTestID()
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		Warp:           &WarpConfig{SourceChains: []ids.ID{sourceChainID}},
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, builder.String())))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	// The source chain's validators each have an equal weight
+	signers := make([]*localsigner.LocalSigner, 3)
+	sourceValidators := validators.WarpSet{TotalWeight: uint64(len(signers))}
+	for i := range signers {
+		if signers[i], err = localsigner.New(); err != nil {
+			t.Fatal(err)
+		}
+		pk := signers[i].PublicKey()
+		sourceValidators.Validators = append(sourceValidators.Validators, &validators.Warp{
+			PublicKey:      pk,
+			PublicKeyBytes: bls.PublicKeyToUncompressedBytes(pk),
+			Weight:         1,
+		})
+	}
+	slices.SortFunc(sourceValidators.Validators, (*validators.Warp).Compare)
+	sourceSubnetID := ids.GenerateTestID()
+	vm.ctx.ValidatorState = &validatorstest.State{
+		GetCurrentHeightF: func(context.Context) (uint64, error) {
+			return 1, nil
+		},
+		GetSubnetIDF: func(_ context.Context, chainID ids.ID) (ids.ID, error) {
+			if chainID != sourceChainID {
+				return ids.Empty, database.ErrNotFound
+			}
+			return sourceSubnetID, nil
+		},
+		GetWarpValidatorSetF: func(context.Context, uint64, ids.ID) (validators.WarpSet, error) {
+			return sourceValidators, nil
+		},
+	}
+
+	hash := ids.GenerateTestID()
+	hashPayload, err := payload.NewHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := warp.NewUnsignedMessage(vm.ctx.NetworkID, sourceChainID, hashPayload.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sign returns the message signed by the validators at [indices]
+	sign := func(indices ...int) string {
+		var sigs []*bls.Signature
+		for _, i := range indices {
+			for _, s := range signers {
+				if bytes.Equal(bls.PublicKeyToUncompressedBytes(s.PublicKey()), sourceValidators.Validators[i].PublicKeyBytes) {
+					sig, err := s.Sign(unsigned.Bytes())
+					if err != nil {
+						t.Fatal(err)
+					}
+					sigs = append(sigs, sig)
+				}
+			}
+		}
+		aggSig, err := bls.AggregateSignatures(sigs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := warp.NewMessage(unsigned, &warp.BitSetSignature{
+			Signers:   set.NewBits(indices...).Bytes(),
+			Signature: [bls.SignatureLen]byte(bls.SignatureToBytes(aggSig)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := cb58.Encode(msg.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	// Two of three validators don't reach the 67% quorum
+	reply := &SubmitWarpMessageReply{}
+	if err := service.SubmitWarpMessage(nil, &SubmitWarpMessageArgs{Message: sign(0, 1)}, reply); !errors.Is(err, errBadWarpSignature) {
+		t.Fatalf("expected %s but got %v", errBadWarpSignature, err)
+	}
+	if err := service.SubmitWarpMessage(nil, &SubmitWarpMessageArgs{Message: sign(0, 1, 2)}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.SourceChainID != sourceChainID {
+		t.Fatalf("expected source chain %s but got %s", sourceChainID, reply.SourceChainID)
+	}
+
+	// Without the P-Chain height the message can't be included
+	if _, err := vm.BuildBlock(ctx); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+	built, err := vm.BuildBlockWithContext(ctx, &block.Context{PChainHeight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk := built.(*Block)
+	if len(blk.WarpMessages) != 1 {
+		t.Fatalf("expected the Warp message in the block but got %d", len(blk.WarpMessages))
+	}
+	if should, err := blk.ShouldVerifyWithContext(ctx); err != nil || !should {
+		t.Fatalf("expected the block to be verified with the P-Chain height but got %t, %v", should, err)
+	}
+	if err := blk.Verify(ctx); err != errWarpWithoutContext {
+		t.Fatalf("expected %s but got %v", errWarpWithoutContext, err)
+	}
+	if err := blk.VerifyWithContext(ctx, &block.Context{PChainHeight: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	encodedHash, err := cb58.Encode(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestation := &GetWarpAttestationReply{}
+	if err := service.GetWarpAttestation(nil, &GetWarpAttestationArgs{SourceChainID: sourceChainID, Hash: encodedHash}, attestation); err != nil {
+		t.Fatal(err)
+	}
+	if attestation.Height != 1 {
+		t.Fatalf("expected the attestation at height 1 but got %d", attestation.Height)
+	}
+	if err := service.GetWarpAttestation(nil, &GetWarpAttestationArgs{SourceChainID: ids.GenerateTestID(), Hash: encodedHash}, attestation); err != errNoSuchAttestation {
+		t.Fatalf("expected %s but got %v", errNoSuchAttestation, err)
+	}
+
+	// The hash can't be attested again
+	if err := service.SubmitWarpMessage(nil, &SubmitWarpMessageArgs{Message: sign(0, 1, 2)}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlockWithContext(ctx, &block.Context{PChainHeight: 1}); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+}
+
+// Assert that a parameter change passes once more than half of the allowed
+// signers voted for it, and applies from its activation height on
+func TestGovernance(t *testing.T) {
+	keys := make([]*secp256k1.PrivateKey, 4)
+	for i := range keys {
+		key, err := secp256k1.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		Signers:        []ids.ShortID{keys[0].Address(), keys[1].Address(), keys[2].Address()},
+		Governance:     true,
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, keys[0].String())))
+	service := &Service{vm}
+	vote := func(key *secp256k1.PrivateKey, c ParamChange) error {
+		v := GovernanceVote{Param: c.Param, Value: c.Value, ActivationHeight: c.ActivationHeight}
+		if err := v.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := cb58.Encode(v.Sig[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := &SubmitGovernanceVoteArgs{APIParamChange: newAPIParamChange(c), Signature: sig}
+		return service.SubmitGovernanceVote(nil, args, &SubmitGovernanceVoteReply{})
+	}
+	acceptNext := func() *Block {
+		blk, err := vm.BuildBlock(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(context.Background(), blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+
+	change := ParamChange{Param: MaxPayloadSizeParam, Value: 4, ActivationHeight: 4}
+	if err := vote(keys[3], change); err != errNotVoter {
+		t.Fatalf("expected %s but got %v", errNotVoter, err)
+	}
+	if err := vote(keys[0], ParamChange{Param: MaxPayloadSizeParam, Value: 4, ActivationHeight: 1}); err != errActivationNotFuture {
+		t.Fatalf("expected %s but got %v", errActivationNotFuture, err)
+	}
+	if err := vote(keys[0], ParamChange{Param: MaxPayloadSizeParam, Value: dataLen + 1, ActivationHeight: 4}); err != errBadParamValue {
+		t.Fatalf("expected %s but got %v", errBadParamValue, err)
+	}
+
+	// One vote of three doesn't pass the change
+	if err := vote(keys[0], change); err != nil {
+		t.Fatal(err)
+	}
+	if blk := acceptNext(); len(blk.Votes) != 1 {
+		t.Fatalf("expected the vote in the block but got %+v", blk.Votes)
+	}
+	votes := &GetProposalVotesReply{}
+	args := newAPIParamChange(change)
+	if err := service.GetProposalVotes(nil, &args, votes); err != nil {
+		t.Fatal(err)
+	}
+	if len(votes.Voters) != 1 || votes.Voters[0] != keys[0].Address() || votes.Passed {
+		t.Fatalf("unexpected votes %+v", votes)
+	}
+	if err := vote(keys[0], change); err != errDuplicateVote {
+		t.Fatalf("expected %s but got %v", errDuplicateVote, err)
+	}
+
+	// The second vote passes it, and no other value can pass at its height
+	if err := vote(keys[1], change); err != nil {
+		t.Fatal(err)
+	}
+	acceptNext()
+	if err := service.GetProposalVotes(nil, &args, votes); err != nil {
+		t.Fatal(err)
+	}
+	if len(votes.Voters) != 2 || !votes.Passed {
+		t.Fatalf("unexpected votes %+v", votes)
+	}
+	if err := vote(keys[2], ParamChange{Param: MaxPayloadSizeParam, Value: 8, ActivationHeight: 4}); err != errParamChangePassed {
+		t.Fatalf("expected %s but got %v", errParamChangePassed, err)
+	}
+	reply := &GetGovernanceReply{}
+	if err := service.GetGovernance(nil, nil, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.MaxPayloadSize != dataLen || len(reply.Scheduled) != 1 || reply.Scheduled[0] != args {
+		t.Fatalf("expected the change to be scheduled but got %+v", reply)
+	}
+
+	// The block before the activation height may still hold larger data
+	large, err := cb58.Encode([]byte{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: large}, &ProposeBlockReply{}); err != nil {
+		t.Fatal(err)
+	}
+	acceptNext()
+	if err := service.GetGovernance(nil, nil, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.MaxPayloadSize != 4 || len(reply.Scheduled) != 0 {
+		t.Fatalf("expected the change to be active but got %+v", reply)
+	}
+	if err := service.ProposeBlock(nil, &ProposeBlockArgs{Data: large}, &ProposeBlockReply{}); !errors.Is(err, ErrBadData) {
+		t.Fatalf("expected %s but got %v", ErrBadData, err)
+	}
+
+	parent, err := vm.getBlock(vm.preferred)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.NewBlock(parent.ID(), parent.Height()+1, [][dataLen]byte{{1, 2, 3, 4, 5}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.signBlock(context.Background(), blk, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(context.Background()); err != errPayloadTooLarge {
+		t.Fatalf("expected %s but got %v", errPayloadTooLarge, err)
+	}
+}
+
+// Assert that a node attests the blocks it accepts and aggregates the
+// attestations gossiped by the other validators into a Warp message that
+// reaches the quorum of their stake
+func TestBlockAttestations(t *testing.T) {
+	vm := newTestVMWithGenesis(t, &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}, []byte(`{"buildBatchWindow": "0s", "attestations": true}`))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	peer, err := localsigner.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerID := ids.GenerateTestNodeID()
+	vdrs := validators.WarpSet{TotalWeight: 2}
+	for _, vdr := range []struct {
+		pk     *bls.PublicKey
+		nodeID ids.NodeID
+	}{{vm.ctx.PublicKey, vm.ctx.NodeID}, {peer.PublicKey(), peerID}} {
+		vdrs.Validators = append(vdrs.Validators, &validators.Warp{
+			PublicKey:      vdr.pk,
+			PublicKeyBytes: bls.PublicKeyToUncompressedBytes(vdr.pk),
+			Weight:         1,
+			NodeIDs:        []ids.NodeID{vdr.nodeID},
+		})
+	}
+	slices.SortFunc(vdrs.Validators, (*validators.Warp).Compare)
+	vm.ctx.ValidatorState = &validatorstest.State{
+		GetCurrentHeightF: func(context.Context) (uint64, error) {
+			return 3, nil
+		},
+		GetWarpValidatorSetF: func(_ context.Context, height uint64, subnetID ids.ID) (validators.WarpSet, error) {
+			if height != 3 || subnetID != vm.ctx.SubnetID {
+				return validators.WarpSet{}, database.ErrNotFound
+			}
+			return vdrs, nil
+		},
+	}
+	var gossiped []byte
+	vm.appSender = &enginetest.Sender{
+		SendAppGossipF: func(_ context.Context, config common.SendConfig, msg []byte) error {
+			if !config.NodeIDs.Equals(set.Of(peerID)) {
+				t.Fatalf("expected gossip to %s but got %s", peerID, config.NodeIDs)
+			}
+			gossiped = msg
+			return nil
+		},
+	}
+	vm.attestor.sender = vm.appSender
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	reply := &GetBlockAttestationReply{}
+	if err := service.GetBlockAttestation(nil, &GetBlockAttestationArgs{BlockID: blk.ID()}, reply); err != errAttestedNotAccepted {
+		t.Fatalf("expected %s but got %v", errAttestedNotAccepted, err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if len(gossiped) != attestationGossipLen || ids.ID(gossiped[:ids.IDLen]) != blk.ID() {
+		t.Fatal("expected the node to gossip its attestation of the accepted block")
+	}
+
+	// This node's attestation alone doesn't reach a 67% quorum
+	if err := service.GetBlockAttestation(nil, &GetBlockAttestationArgs{BlockID: blk.ID()}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.SignedWeight != 1 || reply.TotalWeight != 2 || reply.PChainHeight != 3 {
+		t.Fatalf("expected 1 of 2 weight at P-Chain height 3 but got %d of %d at %d", reply.SignedWeight, reply.TotalWeight, reply.PChainHeight)
+	}
+	verify := func(msg string, blkID ids.ID) error {
+		b, err := cb58.Decode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof.VerifyAttestation(b, vm.ctx.NetworkID, vm.ctx.ChainID, blkID, vdrs, 67, 100)
+	}
+	if err := verify(reply.Message, blk.ID()); err == nil {
+		t.Fatal("expected half of the stake not to reach the quorum")
+	}
+
+	unsigned, err := vm.attestor.unsignedMessage(blk.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A signature gossiped by a node that isn't its validator is dropped
+	sig, err := peer.Sign(unsigned.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blkID := blk.ID()
+	msg := append(blkID[:], bls.SignatureToBytes(sig)...)
+	if err := vm.AppGossip(ctx, ids.GenerateTestNodeID(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.AppGossip(ctx, peerID, msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.GetBlockAttestation(nil, &GetBlockAttestationArgs{BlockID: blk.ID()}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.SignedWeight != 2 {
+		t.Fatalf("expected all of the weight to attest the block but got %d", reply.SignedWeight)
+	}
+	if err := verify(reply.Message, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(reply.Message, ids.GenerateTestID()); err == nil {
+		t.Fatal("expected the attestation not to be of another block")
+	}
+}
+
+// Assert that the compactor removes or hashes the data of each namespace once
+// its block is older than the namespace's retention policy
+func TestRetention(t *testing.T) {
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		Namespaces:     true,
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(`{
+		"buildBatchWindow": "0s",
+		"retention": {"namespaces": [
+			{"namespace": "a", "mode": "days", "days": 1},
+			{"namespace": "b", "mode": "hashOnly", "days": 2}
+		]}
+	}`))
+	service := &Service{vm}
+	ctx := context.Background()
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+
+	data := [][dataLen]byte{{1}, {2}, {3}}
+	namespaces := [][NamespaceLen]byte{{'a'}, {'b'}, {'c'}}
+	for i, d := range data {
+		if _, _, err := vm.submitProposal(d, namespaces[i], 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+	accepted := blk.(*Block)
+	if len(accepted.Dt) != len(data) {
+		t.Fatalf("expected %d pieces of data but got %d", len(data), len(accepted.Dt))
+	}
+
+	assertStatuses := func(expected map[string]string) {
+		reply := &GetBlockRetentionReply{}
+		if err := service.GetBlockRetention(nil, &GetBlockRetentionArgs{BlockID: blk.ID()}, reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reply.Data {
+			if r.Status != expected[r.Namespace] {
+				t.Fatalf("expected namespace %q to be %s but was %s", r.Namespace, expected[r.Namespace], r.Status)
+			}
+			if r.Namespace == "c" && r.Expiry != 0 {
+				t.Fatal("expected namespace \"c\" to keep its data forever")
+			}
+		}
+	}
+	blkTime := time.Unix(accepted.Tmstmp, 0)
+	if err := vm.compactRetention(blkTime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(map[string]string{"a": RetainedStatus, "b": RetainedStatus, "c": RetainedStatus})
+
+	if err := vm.compactRetention(blkTime.Add(36 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(map[string]string{"a": DeletedStatus, "b": RetainedStatus, "c": RetainedStatus})
+
+	if err := vm.compactRetention(blkTime.Add(72 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	assertStatuses(map[string]string{"a": DeletedStatus, "b": HashOnlyStatus, "c": RetainedStatus})
+
+	// Only the hash of the hash-only namespace's data is served
+	reply := &GetNamespaceDataReply{}
+	if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "b"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data[1][:])
+	if len(reply.Data) != 1 || reply.Data[0].Data != "" || reply.Data[0].Hash != encoding.EncodeCB58(hash[:]) {
+		t.Fatalf("expected only the hash of the data but got %+v", reply.Data)
+	}
+	if err := service.GetNamespaceData(nil, &GetNamespaceDataArgs{Namespace: "a"}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Data) != 0 {
+		t.Fatalf("expected the expired data to be deleted but got %+v", reply.Data)
+	}
+}
+
+// Assert that the indexer feed has the acceptance of each block and the
+// compaction of its data, in order, and resumes from its cursors
+func TestIndexerFeed(t *testing.T) {
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen, Namespaces: true}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(`{
+		"buildBatchWindow": "0s",
+		"retention": {"namespaces": [{"namespace": "a", "mode": "days", "days": 1}]}
+	}`))
+	service := &Service{vm}
+	ctx := context.Background()
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+	accept := func(d [dataLen]byte, namespace [NamespaceLen]byte) *Block {
+		if _, _, err := vm.submitProposal(d, namespace, 0); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+	// feed returns the events after [cursor], a page of 2 events at a time
+	feed := func(cursor string) ([]IndexerEvent, string) {
+		var events []IndexerEvent
+		for {
+			reply := &GetIndexerFeedReply{}
+			if err := service.GetIndexerFeed(nil, &GetIndexerFeedArgs{Cursor: cursor, Limit: 2}, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.NextCursor == "" {
+				t.Fatal("expected a cursor at the end of the feed")
+			}
+			events = append(events, reply.Events...)
+			cursor = reply.NextCursor
+			if len(reply.Events) == 0 {
+				return events, cursor
+			}
+		}
+	}
+
+	blk := accept([dataLen]byte{1}, [NamespaceLen]byte{'a'})
+	if err := vm.compactRetention(time.Unix(blk.Tmstmp, 0).Add(36 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	events, cursor := feed("")
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events but got %+v", events)
+	}
+	for i, expected := range []struct {
+		kind   string
+		height uint64
+	}{{AcceptedEvent, 0}, {AcceptedEvent, 1}, {TombstoneEvent, 1}} {
+		if e := events[i]; uint64(e.Sequence) != uint64(i) || e.Kind != expected.kind || uint64(e.Height) != expected.height {
+			t.Fatalf("expected event %d to be %s at height %d but got %+v", i, expected.kind, expected.height, e)
+		}
+	}
+	if events[1].Block == nil || events[1].Block.ID != blk.ID().String() {
+		t.Fatalf("expected the accepted block but got %+v", events[1].Block)
+	}
+	if tombstone := events[2].Tombstone; tombstone == nil || *tombstone != (APITombstone{Index: 0, Status: DeletedStatus}) {
+		t.Fatalf("expected the data to be deleted but got %+v", tombstone)
+	}
+
+	// The cursor at the end of the feed returns the blocks accepted since
+	next := accept([dataLen]byte{2}, [NamespaceLen]byte{'b'})
+	events, _ = feed(cursor)
+	if len(events) != 1 || events[0].Block == nil || events[0].Block.ID != next.ID().String() {
+		t.Fatalf("expected only the next block but got %+v", events)
+	}
+
+	// Databases from before the feed get an event for each accepted block
+	for sequence := uint64(0); sequence < 4; sequence++ {
+		if err := vm.state.indexerDB.Delete(database.PackUInt64(sequence)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := vm.state.metadataDB.Delete(indexerNextKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.state.repairIndexerFeed(); err != nil {
+		t.Fatal(err)
+	}
+	events, _ = feed("")
+	if len(events) != 3 || events[2].Kind != AcceptedEvent || uint64(events[2].Height) != 2 {
+		t.Fatalf("expected an accepted event for each block but got %+v", events)
+	}
+}
+
+// Assert that write API calls, including refused ones, are recorded in the
+// audit log with their caller and the hash of their params
+func TestAuditLog(t *testing.T) {
+	vm, _ := newTestVMWithConfig(t, []byte{0, 0, 0, 0, 0}, nil, []byte(`{"buildBatchWindow": "0s", "audit": {"callerHeader": "X-Caller"}}`))
+	handlers, err := vm.CreateHandlers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handlers[""])
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, "timestamp")
+	ctx := context.Background()
+
+	if err := client.ProposeBlock(ctx, []byte{1, 2}, rpc.WithHeader("X-Caller", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetMempoolSize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ProposeBlock(ctx, make([]byte, dataLen+1)); err == nil {
+		t.Fatal("expected too much data to be refused")
+	}
+
+	records, err := client.GetAuditLog(ctx, 0, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected the 2 write calls to be recorded but got %d", len(records))
+	}
+	if records[0].Method != "proposeBlock" || records[0].Caller != "alice" || records[0].Error != "" {
+		t.Fatalf("unexpected record of the first call %+v", records[0])
+	}
+	if records[1].Index != 1 || records[1].Caller == "alice" || records[1].Error == "" {
+		t.Fatalf("unexpected record of the refused call %+v", records[1])
+	}
+	if records[0].PayloadHash == records[1].PayloadHash {
+		t.Fatal("expected calls with different params to have different payload hashes")
+	}
+
+	records, err = client.GetAuditLog(ctx, 0, 0, "", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Index != 0 {
+		t.Fatalf("expected only alice's call but got %+v", records)
+	}
+}
+
+// testHookModule is a WASM hook that indexes each piece of data by its first
+// 4 bytes, emits the data as an event and returns the data's second byte, so
+// data whose second byte isn't zero fails
+var testHookModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: (i32), (i32, i32, i32, i32), (i32, i32), (i64, i64, i32) -> i32
+	0x01, 0x18, 0x04, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x00, 0x60, 0x02, 0x7f, 0x7f, 0x00, 0x60, 0x03, 0x7e, 0x7e, 0x7f, 0x01, 0x7f,
+	// Imports: env.payload, env.put_index, env.emit
+	0x02, 0x2a, 0x03,
+	0x03, 0x65, 0x6e, 0x76, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x00, 0x00,
+	0x03, 0x65, 0x6e, 0x76, 0x09, 0x70, 0x75, 0x74, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x00, 0x01,
+	0x03, 0x65, 0x6e, 0x76, 0x04, 0x65, 0x6d, 0x69, 0x74, 0x00, 0x02,
+	// Functions, memory and exports: memory, on_payload
+	0x03, 0x02, 0x01, 0x03,
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x17, 0x02, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x0a, 0x6f, 0x6e, 0x5f, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x00, 0x03,
+	// on_payload: payload(0); put_index(0, 4, 0, 32); emit(0, 32); return mem[1]
+	0x0a, 0x1d, 0x01, 0x1b, 0x00,
+	0x41, 0x00, 0x10, 0x00,
+	0x41, 0x00, 0x41, 0x04, 0x41, 0x00, 0x41, 0x20, 0x10, 0x01,
+	0x41, 0x00, 0x41, 0x20, 0x10, 0x02,
+	0x41, 0x00, 0x2d, 0x00, 0x01, 0x0b,
+}
+
+func TestWASMHooks(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "hook.wasm")
+	if err := os.WriteFile(module, testHookModule, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{
+		"buildBatchWindow": "0s",
+		"hooks": {"module": %q}
+	}`, module)))
+	service := &Service{vm}
+	ctx := context.Background()
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+
+	succeeds := [dataLen]byte{1, 0, 2, 3, 4}
+	fails := [dataLen]byte{5, 1}
+	for _, d := range [][dataLen]byte{succeeds, fails} {
+		if err := vm.proposeBlock(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := &GetHookResultsReply{}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := service.GetHookResults(nil, &GetHookResultsArgs{BlockID: blk.ID()}, reply)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errHookPending) || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	accepted := blk.(*Block)
+	if len(reply.Results) != len(accepted.Dt) {
+		t.Fatalf("expected %d results but got %d", len(accepted.Dt), len(reply.Results))
+	}
+	for i, d := range accepted.Dt {
+		result := reply.Results[i]
+		switch d {
+		case succeeds:
+			if !result.Success || result.GasUsed == 0 {
+				t.Fatalf("expected run to succeed but got %+v", result)
+			}
+			if len(result.Events) != 1 || result.Events[0] != encoding.EncodeCB58(d[:]) {
+				t.Fatalf("expected the data as the event but got %v", result.Events)
+			}
+		case fails:
+			if result.Success || result.Error != errHookExit.Error() || len(result.Events) != 0 {
+				t.Fatalf("expected run to fail without events but got %+v", result)
+			}
+		}
+	}
+
+	indexReply := &GetHookIndexReply{}
+	if err := service.GetHookIndex(nil, &GetHookIndexArgs{Key: encoding.EncodeCB58(succeeds[:4])}, indexReply); err != nil {
+		t.Fatal(err)
+	}
+	if indexReply.Value != encoding.EncodeCB58(succeeds[:]) {
+		t.Fatal("expected the index entry of the successful run")
+	}
+	// The failed run's index entry was discarded
+	err = service.GetHookIndex(nil, &GetHookIndexArgs{Key: encoding.EncodeCB58(fails[:4])}, indexReply)
+	if !errors.Is(err, errNoHookIndexEntry) {
+		t.Fatalf("expected %v but got %v", errNoHookIndexEntry, err)
+	}
+
+	limited := &hookRunner{runtime: vm.hooks.runtime, gasLimit: 50, timeout: time.Minute}
+	if limited.module, err = compileHook(ctx, limited.runtime, testHookModule, limited.gasLimit); err != nil {
+		t.Fatal(err)
+	}
+	result := limited.runHook(0, 0, 0, succeeds)
+	if !errors.Is(result.err, errHookOutOfGas) || result.gasUsed != 50 || len(result.events) != 0 {
+		t.Fatalf("expected run to run out of gas without events but got %+v", result)
+	}
+}
+
+// testLoopHookModule is a WASM hook that loops forever without calling
+// functions
+var testLoopHookModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: (i64, i64, i32) -> i32
+	0x01, 0x08, 0x01, 0x60, 0x03, 0x7e, 0x7e, 0x7f, 0x01, 0x7f,
+	// Functions and exports: on_payload
+	0x03, 0x02, 0x01, 0x00,
+	0x07, 0x0e, 0x01, 0x0a, 0x6f, 0x6e, 0x5f, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x00, 0x00,
+	// on_payload: loop br 0 end; return 0
+	0x0a, 0x0b, 0x01, 0x09, 0x00,
+	0x03, 0x40, 0x0c, 0x00, 0x0b,
+	0x41, 0x00, 0x0b,
+}
+
+// testFillHookModule is a WASM hook that fills its memory page
+var testFillHookModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: (i64, i64, i32) -> i32
+	0x01, 0x08, 0x01, 0x60, 0x03, 0x7e, 0x7e, 0x7f, 0x01, 0x7f,
+	// Functions, a memory of 1 page and exports: on_payload
+	0x03, 0x02, 0x01, 0x00,
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x0e, 0x01, 0x0a, 0x6f, 0x6e, 0x5f, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x00, 0x00,
+	// on_payload: memory.fill 0 0 65536; return 0
+	0x0a, 0x11, 0x01, 0x0f, 0x00,
+	0x41, 0x00, 0x41, 0x00, 0x41, 0x80, 0x80, 0x04, 0xfc, 0x0b, 0x00,
+	0x41, 0x00, 0x0b,
+}
+
+// testGlobalHookModule is a WASM hook that reads a global it doesn't have
+var testGlobalHookModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: (i64, i64, i32) -> i32
+	0x01, 0x08, 0x01, 0x60, 0x03, 0x7e, 0x7e, 0x7f, 0x01, 0x7f,
+	// Functions and exports: on_payload
+	0x03, 0x02, 0x01, 0x00,
+	0x07, 0x0e, 0x01, 0x0a, 0x6f, 0x6e, 0x5f, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x00, 0x00,
+	// on_payload: global.get 0; drop; return 0
+	0x0a, 0x09, 0x01, 0x07, 0x00,
+	0x23, 0x00, 0x1a,
+	0x41, 0x00, 0x0b,
+}
+
+// Assert that a hook's instructions are metered, so a loop runs out of gas
+// after the same instructions however long they take, that bulk instructions
+// are charged their length, that a module can't refer to the gas global, and
+// that a run that runs out of time halts the hooks instead of recording a
+// result
+func TestWASMHookMetering(t *testing.T) {
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().WithCloseOnContextDone(true))
+	t.Cleanup(func() { _ = runtime.Close(ctx) })
+	limited := &hookRunner{runtime: runtime, gasLimit: 10_000, timeout: time.Minute}
+	var err error
+	if limited.module, err = compileHook(ctx, runtime, testLoopHookModule, limited.gasLimit); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		result := limited.runHook(0, 0, 0, [dataLen]byte{})
+		if !errors.Is(result.err, errHookOutOfGas) || result.gasUsed != limited.gasLimit {
+			t.Fatalf("expected the loop to run out of gas but got %+v", result)
+		}
+	}
+	if _, err := meterHookModule(testLoopHookModule[:len(testLoopHookModule)-1], 1); err != errBadHookModule {
+		t.Fatalf("expected %s but got %v", errBadHookModule, err)
+	}
+	if _, err := compileHook(ctx, runtime, testGlobalHookModule, 1); err == nil {
+		t.Fatal("expected a module that reads the gas global to be refused")
+	}
+
+	for _, test := range []struct {
+		gasLimit    uint64
+		expectedErr error
+	}{
+		{gasLimit: 10_000, expectedErr: errHookOutOfGas},
+		{gasLimit: 100_000},
+	} {
+		runner := &hookRunner{runtime: runtime, gasLimit: test.gasLimit, timeout: time.Minute}
+		if runner.module, err = compileHook(ctx, runtime, testFillHookModule, runner.gasLimit); err != nil {
+			t.Fatal(err)
+		}
+		if result := runner.runHook(0, 0, 0, [dataLen]byte{}); !errors.Is(result.err, test.expectedErr) {
+			t.Fatalf("gas limit %d: expected %v but got %+v", test.gasLimit, test.expectedErr, result)
+		}
+	}
+
+	module := filepath.Join(t.TempDir(), "loop.wasm")
+	if err := os.WriteFile(module, testLoopHookModule, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{MaxPayloadSize: dataLen}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{
+		"buildBatchWindow": "0s",
+		"hooks": {"module": %q, "gasLimit": %d, "timeout": "1ms"}
+	}`, module, uint64(math.MaxInt64))))
+	service := &Service{vm}
+	if err := vm.SetState(ctx, snow.NormalOp); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.proposeBlock([dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := blk.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := service.GetHookResults(nil, &GetHookResultsArgs{BlockID: blk.ID()}, &GetHookResultsReply{})
+		if errors.Is(err, errHooksHalted) {
+			break
+		}
+		if !errors.Is(err, errHookPending) || time.Now().After(deadline) {
+			t.Fatalf("expected %s but got %v", errHooksHalted, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultisigProposals(t *testing.T) {
+	keys := make([]*secp256k1.PrivateKey, 4)
+	for i := range keys {
+		key, err := secp256k1.NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: 4,
+		Multisigs: []MultisigConfig{{
+			ID:        "board",
+			Signers:   []ids.ShortID{keys[0].Address(), keys[1].Address(), keys[2].Address()},
+			Threshold: 2,
+		}},
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, keys[3].String())))
+	service := &Service{vm}
+	ctx := context.Background()
+
+	data := [dataLen]byte{1, 2, 3}
+	encodedData, err := cb58.Encode(data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key *secp256k1.PrivateKey) (*SubmitMultisigSignatureReply, error) {
+		p := MultisigProposal{Data: data}
+		copy(p.Set[:], "board")
+		if err := p.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := cb58.Encode(p.Sigs[0][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &SubmitMultisigSignatureReply{}
+		args := &SubmitMultisigSignatureArgs{Set: "board", Data: encodedData, Signature: sig}
+		return reply, service.SubmitMultisigSignature(nil, args, reply)
+	}
+
+	reply, err := sign(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Signer != keys[0].Address() || reply.Signatures != 1 || reply.Threshold != 2 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if _, err := sign(keys[0]); err != errDuplicateMultisigSig {
+		t.Fatalf("expected %s but got %v", errDuplicateMultisigSig, err)
+	}
+	if _, err := sign(keys[3]); err != errNotMultisigSigner {
+		t.Fatalf("expected %s but got %v", errNotMultisigSigner, err)
+	}
+	// One signature of two isn't enough to propose the data
+	if _, err := vm.BuildBlock(ctx); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+	status := &GetMultisigReply{}
+	if err := service.GetMultisig(nil, &GetMultisigArgs{Set: "board", Data: encodedData}, status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != PendingMultisig || len(status.Signers) != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// A block with too few signatures fails verification
+	lastAcceptedID, err := vm.LastAccepted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastAccepted, err := vm.getBlock(lastAcceptedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := MultisigProposal{Set: [MultisigIDLen]byte{'b', 'o', 'a', 'r', 'd'}, Data: data}
+	if err := partial.Sign(vm.ctx.ChainID, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	blk := &Block{Multisigs: []MultisigProposal{partial}, vm: vm}
+	if err := blk.verifyMultisigs(lastAccepted); err != errMultisigBelowThreshold {
+		t.Fatalf("expected %s but got %v", errMultisigBelowThreshold, err)
+	}
+
+	if _, err := sign(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	built, err := vm.BuildBlock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Verify(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := built.Accept(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if multisigs := built.(*Block).Multisigs; len(multisigs) != 1 || len(multisigs[0].Sigs) != 2 {
+		t.Fatalf("expected the proposal with both signatures in the block but got %+v", multisigs)
+	}
+	if err := service.GetMultisig(nil, &GetMultisigArgs{Set: "board", Data: encodedData}, status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != AcceptedMultisig || uint64(status.Height) != built.Height() || len(status.Signers) != 2 || status.Signers[1] != keys[2].Address() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if _, err := sign(keys[1]); err != errMultisigAccepted {
+		t.Fatalf("expected %s but got %v", errMultisigAccepted, err)
+	}
+
+	// The proposal's data must fit in the chain's max payload size
+	oversized := MultisigProposal{Set: partial.Set, Data: [dataLen]byte{dataLen - 1: 1}}
+	if err := oversized.Sign(vm.ctx.ChainID, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := vm.addMultisigSignature(oversized.Set, oversized.Data, oversized.Namespace, oversized.Sigs[0]); err != errPayloadTooLarge {
+		t.Fatalf("expected %s but got %v", errPayloadTooLarge, err)
+	}
+}
+
+func TestSignedSubmissions(t *testing.T) {
+	nodeKey, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := secp256k1.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := &Genesis{Params: ChainParams{
+		MaxPayloadSize: dataLen,
+		PayloadRules:   []PayloadRule{NonZeroPayloadRule},
+		Accounts:       true,
+	}}
+	vm := newTestVMWithGenesis(t, genesis, []byte(fmt.Sprintf(`{"buildBatchWindow": "0s", "signingKey": %q}`, nodeKey.String())))
+	service := &Service{vm}
+	ctx := context.Background()
+	sign := func(nonce uint64, data [dataLen]byte) SignedSubmission {
+		s := SignedSubmission{Nonce: nonce, Data: data}
+		if err := s.Sign(vm.ctx.ChainID, key); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	submit := func(nonce uint64, data [dataLen]byte) error {
+		s := sign(nonce, data)
+		sig, err := cb58.Encode(s.Sig[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := &SubmitSignedArgs{Nonce: avajson.Uint64(nonce), Data: encoding.EncodeCB58(data[:]), Signature: sig}
+		reply := &SubmitSignedReply{}
+		if err := service.SubmitSigned(nil, args, reply); err != nil {
+			return err
+		}
+		if reply.Submitter != key.Address() {
+			t.Fatalf("expected submitter %s but got %s", key.Address(), reply.Submitter)
+		}
+		return nil
+	}
+	acceptNext := func() *Block {
+		blk, err := vm.BuildBlock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Verify(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := blk.Accept(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := vm.SetPreference(ctx, blk.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return blk.(*Block)
+	}
+
+	if err := service.GetAccount(nil, &GetAccountArgs{Address: key.Address()}, &GetAccountReply{}); err != errNoSuchAccount {
+		t.Fatalf("expected %s but got %v", errNoSuchAccount, err)
+	}
+	// The second submission waits for the first, which is submitted after it
+	second := [dataLen]byte{2}
+	if err := submit(1, second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.BuildBlock(ctx); err != errNoPendingBlocks {
+		t.Fatalf("expected %s but got %v", errNoPendingBlocks, err)
+	}
+	if err := submit(0, [dataLen]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	blk := acceptNext()
+	if len(blk.Submissions) != 2 || blk.Submissions[0].Nonce != 0 || blk.Submissions[1].Nonce != 1 {
+		t.Fatalf("expected both submissions in nonce order but got %+v", blk.Submissions)
+	}
+
+	account := &GetAccountReply{}
+	if err := service.GetAccount(nil, &GetAccountArgs{Address: key.Address()}, account); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := cb58.Encode(key.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Nonce != 2 || account.PublicKey != publicKey {
+		t.Fatalf("unexpected account %+v", account)
+	}
+	// A used nonce can't be replayed
+	if err := submit(0, [dataLen]byte{3}); err != errUsedSubmissionNonce {
+		t.Fatalf("expected %s but got %v", errUsedSubmissionNonce, err)
+	}
+	replayed := &Block{Submissions: []SignedSubmission{blk.Submissions[0]}, vm: vm}
+	if err := replayed.verifySubmissions(blk); err != errBadSubmissionNonce {
+		t.Fatalf("expected %s but got %v", errBadSubmissionNonce, err)
+	}
+
+	history := &GetAccountHistoryReply{}
+	if err := service.GetAccountHistory(nil, &GetAccountHistoryArgs{Address: key.Address(), StartNonce: 1}, history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Submissions) != 1 || history.Submissions[0].Data != encoding.EncodeCB58(second[:]) || uint64(history.Submissions[0].Height) != blk.Height() {
+		t.Fatalf("unexpected history %+v", history.Submissions)
+	}
+
+	// Submitted data follows the chain's payload rules
+	if err := submit(2, [dataLen]byte{}); err != errZeroPayload {
+		t.Fatalf("expected %s but got %v", errZeroPayload, err)
+	}
+	zero, err := vm.NewBlock(blk.ID(), blk.Height()+1, nil, time.Unix(blk.Tmstmp+1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero.Submissions = []SignedSubmission{sign(2, [dataLen]byte{})}
+	if err := vm.signBlock(ctx, zero, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := zero.Verify(ctx); err != errZeroPayload {
+		t.Fatalf("expected %s but got %v", errZeroPayload, err)
+	}
 }
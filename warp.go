@@ -0,0 +1,402 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/ava-labs/avalanchego/ids"
+	"github.com/ava-labs/avalanchego/snow/engine/snowman/block"
+	"github.com/ava-labs/avalanchego/utils/json"
+	"github.com/ava-labs/avalanchego/utils/set"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp"
+	"github.com/ava-labs/avalanchego/vms/platformvm/warp/payload"
+
+	"github.com/hitrich/AVM-TEST/encoding"
+)
+
+const (
+	defaultWarpQuorum = 67
+	warpQuorumDen     = 100
+
+	// Verifying a Warp message's aggregate signature is far more expensive
+	// than verifying a signed operation, so few fit in a block
+	maxWarpMessages    = 16
+	maxWarpMessageSize = 4 * 1024
+
+	warpAttestationKeyLen = 2 * ids.IDLen
+)
+
+var (
+	errWarpDisabled         = errors.New("chain doesn't accept Warp messages")
+	errNoWarpSources        = errors.New("warp config must approve at least one source chain")
+	errDuplicateWarpSource  = errors.New("warp source chain is approved more than once")
+	errBadWarpQuorum        = fmt.Errorf("warp quorum must be at most %d percent", warpQuorumDen)
+	errWarpWithoutContext   = errors.New("block with Warp messages must be verified with the P-Chain height")
+	errTooManyWarpMessages  = fmt.Errorf("block has more than %d Warp messages", maxWarpMessages)
+	errWarpMessageTooLarge  = fmt.Errorf("warp message is larger than %d bytes", maxWarpMessageSize)
+	errBadWarpMessage       = errors.New("couldn't parse Warp message")
+	errBadWarpPayload       = errors.New("warp message's payload must be a hash")
+	errWrongWarpNetwork     = errors.New("warp message is from another network")
+	errUnapprovedWarpSource = errors.New("warp message's source chain isn't approved")
+	errBadWarpSignature     = errors.New("warp message's signature doesn't reach the quorum of its source chain's validators")
+	errDuplicateAttestation = errors.New("hash is already attested by the source chain")
+	errNoSuchAttestation    = errors.New("hash isn't attested by the source chain")
+
+	_ block.WithVerifyContext = &Block{}
+)
+
+// WarpConfig approves the chains whose validators may notarize hashes on this
+// chain by signing Warp messages
+type WarpConfig struct {
+	// Chains whose Warp messages are accepted
+	SourceChains []ids.ID `json:"sourceChains"`
+	// Percentage of a source chain's stake that must sign a message. Zero
+	// means 67.
+	Quorum uint64 `json:"quorum"`
+}
+
+// Verify returns nil iff [c] is a valid Warp config
+func (c *WarpConfig) Verify() error {
+	if len(c.SourceChains) == 0 {
+		return errNoWarpSources
+	}
+	sources := set.NewSet[ids.ID](len(c.SourceChains))
+	for _, chainID := range c.SourceChains {
+		if sources.Contains(chainID) {
+			return fmt.Errorf("%w: %s", errDuplicateWarpSource, chainID)
+		}
+		sources.Add(chainID)
+	}
+	if c.Quorum > warpQuorumDen {
+		return errBadWarpQuorum
+	}
+	return nil
+}
+
+// hasWarp returns true iff the chain accepts Warp messages
+func (p *ChainParams) hasWarp() bool {
+	return p.Warp != nil
+}
+
+// warpQuorum returns the percentage of a source chain's stake that must sign
+// a Warp message
+func (p *ChainParams) warpQuorum() uint64 {
+	if p.Warp.Quorum == 0 {
+		return defaultWarpQuorum
+	}
+	return p.Warp.Quorum
+}
+
+// isWarpSource returns true iff Warp messages from [chainID] are accepted
+func (p *ChainParams) isWarpSource(chainID ids.ID) bool {
+	for _, source := range p.Warp.SourceChains {
+		if source == chainID {
+			return true
+		}
+	}
+	return false
+}
+
+// warpAttestation is a hash notarized by a source chain's validators, which
+// is what a Warp message relays
+type warpAttestation struct {
+	msg  *warp.Message
+	hash ids.ID
+}
+
+// parseWarpMessage returns the attestation that the Warp message [b]
+// relays. Its signature isn't checked.
+func parseWarpMessage(b []byte) (warpAttestation, error) {
+	if len(b) > maxWarpMessageSize {
+		return warpAttestation{}, errWarpMessageTooLarge
+	}
+	msg, err := warp.ParseMessage(b)
+	if err != nil {
+		return warpAttestation{}, fmt.Errorf("%w: %w", errBadWarpMessage, err)
+	}
+	hash, err := payload.ParseHash(msg.Payload)
+	if err != nil {
+		return warpAttestation{}, errBadWarpPayload
+	}
+	return warpAttestation{msg: msg, hash: hash.Hash}, nil
+}
+
+// key returns the key of [a] in the attestation index. A source chain can
+// attest a hash only once.
+func (a warpAttestation) key() []byte {
+	return warpAttestationKey(a.msg.SourceChainID, a.hash)
+}
+
+func warpAttestationKey(sourceChainID, hash ids.ID) []byte {
+	b := make([]byte, 0, warpAttestationKeyLen)
+	b = append(b, sourceChainID[:]...)
+	return append(b, hash[:]...)
+}
+
+// verifyWarpAttestation returns nil iff [a]'s message is from this network
+// and an approved source chain, and is signed by the quorum of the source
+// chain's validators at [pChainHeight]
+func (vm *VM) verifyWarpAttestation(ctx context.Context, a warpAttestation, pChainHeight uint64) error {
+	params := &vm.genesis.Params
+	switch {
+	case a.msg.NetworkID != vm.ctx.NetworkID:
+		return errWrongWarpNetwork
+	case !params.isWarpSource(a.msg.SourceChainID):
+		return errUnapprovedWarpSource
+	}
+	subnetID, err := vm.ctx.ValidatorState.GetSubnetID(ctx, a.msg.SourceChainID)
+	if err != nil {
+		return err
+	}
+	validators, err := vm.ctx.ValidatorState.GetWarpValidatorSet(ctx, pChainHeight, subnetID)
+	if err != nil {
+		return err
+	}
+	if err := a.msg.Signature.Verify(&a.msg.UnsignedMessage, vm.ctx.NetworkID, validators, params.warpQuorum(), warpQuorumDen); err != nil {
+		return fmt.Errorf("%w: %w", errBadWarpSignature, err)
+	}
+	return nil
+}
+
+// isAttested returns true iff [a]'s hash is attested by its source chain
+// once [blk] is accepted
+func (vm *VM) isAttested(blk *Block, a warpAttestation) (bool, error) {
+	processing, err := vm.processingAncestors(blk)
+	if err != nil {
+		return false, err
+	}
+	key := string(a.key())
+	for _, ancestor := range processing {
+		for _, b := range ancestor.WarpMessages {
+			// The messages of verified blocks parse
+			if prev, err := parseWarpMessage(b); err == nil && string(prev.key()) == key {
+				return true, nil
+			}
+		}
+	}
+	return vm.state.hasWarpAttestation(a.key())
+}
+
+// ShouldVerifyWithContext returns true iff [b] has Warp messages, whose
+// signatures are checked against the validator sets at the P-Chain height
+func (b *Block) ShouldVerifyWithContext(context.Context) (bool, error) {
+	return len(b.WarpMessages) > 0, nil
+}
+
+// VerifyWithContext is called instead of Verify when [b] has Warp messages
+// and the chain is wrapped by the ProposerVM
+func (b *Block) VerifyWithContext(ctx context.Context, blockCtx *block.Context) error {
+	b.pChainHeight = blockCtx.PChainHeight
+	b.hasPChainHeight = true
+	return b.Verify(ctx)
+}
+
+// verifyWarpMessages returns nil iff each of [b]'s Warp messages attests a
+// hash that its source chain hasn't attested yet and is signed by the quorum
+// of its source chain's validators at the P-Chain height [b] is verified at
+func (b *Block) verifyWarpMessages(ctx context.Context, parent *Block) error {
+	switch {
+	case len(b.WarpMessages) == 0:
+		return nil
+	case !b.vm.genesis.Params.hasWarp():
+		return errWarpDisabled
+	case !b.hasPChainHeight:
+		return errWarpWithoutContext
+	case len(b.WarpMessages) > maxWarpMessages:
+		return errTooManyWarpMessages
+	}
+	keys := set.NewSet[string](len(b.WarpMessages))
+	for _, msg := range b.WarpMessages {
+		a, err := parseWarpMessage(msg)
+		if err != nil {
+			return err
+		}
+		key := string(a.key())
+		if keys.Contains(key) {
+			return errDuplicateAttestation
+		}
+		keys.Add(key)
+		attested, err := b.vm.isAttested(parent, a)
+		if err != nil {
+			return err
+		}
+		if attested {
+			return errDuplicateAttestation
+		}
+		if err := b.vm.verifyWarpAttestation(ctx, a, b.pChainHeight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyWarpMessages records the hashes attested by [b]'s Warp messages
+func (b *Block) applyWarpMessages() error {
+	for _, msg := range b.WarpMessages {
+		a, err := parseWarpMessage(msg)
+		if err != nil {
+			return err
+		}
+		if err := b.vm.state.putWarpAttestation(a.key(), b.Height()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingWarpMessages holds Warp messages submitted over the API until they
+// are accepted
+type pendingWarpMessages struct {
+	lock sync.Mutex
+	msgs [][]byte
+}
+
+// add adds the Warp message [msg] to the pending messages
+func (p *pendingWarpMessages) add(msg []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.msgs = append(p.msgs, msg)
+}
+
+// next returns the pending Warp messages that can be accepted in a child of
+// [parent] verified at [pChainHeight]
+func (p *pendingWarpMessages) next(ctx context.Context, vm *VM, parent *Block, pChainHeight uint64) [][]byte {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var (
+		next [][]byte
+		keys = set.Set[string]{}
+	)
+	for _, msg := range p.msgs {
+		a, err := parseWarpMessage(msg)
+		if err != nil || keys.Contains(string(a.key())) {
+			continue
+		}
+		if attested, err := vm.isAttested(parent, a); err != nil || attested {
+			continue
+		}
+		if vm.verifyWarpAttestation(ctx, a, pChainHeight) != nil {
+			continue
+		}
+		keys.Add(string(a.key()))
+		next = append(next, msg)
+		if len(next) == maxWarpMessages {
+			break
+		}
+	}
+	return next
+}
+
+// prune drops the pending Warp messages whose hashes are already attested,
+// which can never be accepted
+func (p *pendingWarpMessages) prune(vm *VM) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	p.msgs, err = pruneOps(vm.opJournal, warpMessageKind, p.msgs, func(msg *[]byte) bool {
+		a, err := parseWarpMessage(*msg)
+		if err != nil {
+			return false
+		}
+		attested, err := vm.state.hasWarpAttestation(a.key())
+		return err != nil || !attested
+	})
+	return err
+}
+
+// len returns the number of pending Warp messages
+func (p *pendingWarpMessages) len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.msgs)
+}
+
+// SubmitWarpMessageArgs are the arguments to SubmitWarpMessage
+type SubmitWarpMessageArgs struct {
+	// Base 58 repr. of the signed Warp message
+	Message string `json:"message"`
+
+	msg         []byte
+	attestation warpAttestation
+}
+
+func (a *SubmitWarpMessageArgs) validate(v *argValidator) {
+	a.msg = v.bytes("message", a.Message, 0, math.MaxInt, errBadWarpMessage)
+	var err error
+	a.attestation, err = parseWarpMessage(a.msg)
+	v.add("message", err)
+}
+
+// SubmitWarpMessageReply is the reply from SubmitWarpMessage
+type SubmitWarpMessageReply struct {
+	SourceChainID ids.ID `json:"sourceChainID"`
+	// Base 58 repr. of the attested hash
+	Hash string `json:"hash"`
+}
+
+// SubmitWarpMessage is an API method to relay a Warp message, whose payload
+// is a hash, from an approved source chain. The message is included in a
+// block built by this node once its signature is checked against the source
+// chain's validators at the block's P-Chain height.
+func (s *Service) SubmitWarpMessage(r *http.Request, args *SubmitWarpMessageArgs, reply *SubmitWarpMessageReply) error {
+	if !s.backend.chainParams().hasWarp() {
+		return errWarpDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	a := args.attestation
+	if err := s.backend.addWarpMessage(requestContext(r), args.msg, a); err != nil {
+		return err
+	}
+	reply.SourceChainID = a.msg.SourceChainID
+	reply.Hash = encoding.EncodeCB58(a.hash[:])
+	return nil
+}
+
+// GetWarpAttestationArgs are the arguments to GetWarpAttestation
+type GetWarpAttestationArgs struct {
+	SourceChainID ids.ID `json:"sourceChainID"`
+	// Base 58 repr. of the hash
+	Hash string `json:"hash"`
+
+	hash [dataLen]byte
+}
+
+func (a *GetWarpAttestationArgs) validate(v *argValidator) {
+	a.hash = v.hash("hash", a.Hash, errBadAggregatedHashBytes)
+}
+
+// GetWarpAttestationReply is the reply from GetWarpAttestation
+type GetWarpAttestationReply struct {
+	// Height of the accepted block whose Warp message attests the hash
+	Height json.Uint64 `json:"height"`
+}
+
+// GetWarpAttestation returns where [args.SourceChainID]'s attestation of
+// [args.Hash] was accepted
+func (s *Service) GetWarpAttestation(_ *http.Request, args *GetWarpAttestationArgs, reply *GetWarpAttestationReply) error {
+	if !s.backend.chainParams().hasWarp() {
+		return errWarpDisabled
+	}
+	if err := validateArgs(s.backend, args); err != nil {
+		return err
+	}
+	height, err := s.backend.warpAttestation(args.SourceChainID, ids.ID(args.hash))
+	if err != nil {
+		return err
+	}
+	reply.Height = json.Uint64(height)
+	return nil
+}
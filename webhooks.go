@@ -0,0 +1,268 @@
+// (c) 2019-2020, Ava Labs, Inc. All rights reserved.
+// See the file LICENSE for licensing terms.
+
+package timestampvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ava-labs/avalanchego/utils/logging"
+)
+
+const (
+	// WebhookSignatureHeader is the header of a webhook request that holds
+	// "sha256=" followed by the hex encoding of the HMAC-SHA256 of the
+	// request's body, keyed with the webhook secret
+	WebhookSignatureHeader = "X-Timestampvm-Signature"
+
+	defaultWebhookMaxAttempts = 5
+	defaultWebhookRetryDelay  = time.Second
+	defaultWebhookQueueSize   = 1024
+	webhookTimeout            = 10 * time.Second
+)
+
+var (
+	errNoWebhookURLs    = errors.New("webhooks need at least one URL")
+	errBadWebhookURL    = errors.New("webhook URL must be an http or https URL")
+	errNoWebhookSecret  = errors.New("webhooks need a secret to sign payloads with")
+	errBadWebhookConfig = errors.New("webhook max attempts, retry delay and queue size must not be negative")
+	errWebhookQueueFull = errors.New("webhook queue is full")
+	errWebhookStatus    = errors.New("webhook responded with a non-2xx status")
+)
+
+// WebhookConfig configures the URLs that are POSTed a [BlockEvent] for each
+// block accepted after the node has bootstrapped
+type WebhookConfig struct {
+	URLs []string `json:"urls"`
+	// Key of the HMAC in each request's [WebhookSignatureHeader]
+	Secret string `json:"secret"`
+	// Number of times a payload is sent to a URL before it's dead-lettered.
+	// Zero means 5.
+	MaxAttempts int `json:"maxAttempts"`
+	// Delay before the first retry, which doubles after each attempt. Zero
+	// means 1s.
+	RetryDelay Duration `json:"retryDelay"`
+	// Number of payloads waiting to be sent to a URL, beyond which payloads
+	// are dead-lettered. Zero means 1024.
+	QueueSize int `json:"queueSize"`
+	// If set, payloads that couldn't be sent are appended to this file as
+	// JSON lines, as well as being logged
+	DeadLetterPath string `json:"deadLetterPath"`
+}
+
+// Verify returns nil iff [c] is a valid webhook config
+func (c *WebhookConfig) Verify() error {
+	switch {
+	case len(c.URLs) == 0:
+		return errNoWebhookURLs
+	case c.Secret == "":
+		return errNoWebhookSecret
+	case c.MaxAttempts < 0 || c.RetryDelay.Duration < 0 || c.QueueSize < 0:
+		return errBadWebhookConfig
+	}
+	for _, rawURL := range c.URLs {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %q", errBadWebhookURL, rawURL)
+		}
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the value of the [WebhookSignatureHeader] of a
+// request with body [body], signed with [secret]. Receivers compare it to the
+// header with hmac.Equal.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter is a payload that couldn't be sent to a webhook
+type deadLetter struct {
+	URL     string          `json:"url"`
+	Payload json.RawMessage `json:"payload"`
+	Error   string          `json:"error"`
+	Time    time.Time       `json:"time"`
+}
+
+// webhooks sends the payloads of accepted blocks to the configured URLs.
+// Each URL has its own queue, so a slow URL doesn't hold back the others and
+// each URL receives the payloads in the order the blocks were accepted.
+type webhooks struct {
+	config WebhookConfig
+	log    logging.Logger
+	client *http.Client
+
+	queues []chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	deadLetterLock sync.Mutex
+}
+
+// newWebhooks starts sending payloads to the URLs in [config]
+func newWebhooks(config WebhookConfig, log logging.Logger) *webhooks {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if config.RetryDelay.Duration == 0 {
+		config.RetryDelay.Duration = defaultWebhookRetryDelay
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultWebhookQueueSize
+	}
+	w := &webhooks{
+		config: config,
+		log:    log,
+		client: &http.Client{Timeout: webhookTimeout},
+		queues: make([]chan []byte, len(config.URLs)),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for i, u := range config.URLs {
+		queue := make(chan []byte, config.QueueSize)
+		w.queues[i] = queue
+		w.wg.Add(1)
+		go w.run(u, queue)
+	}
+	return w
+}
+
+// notify queues [body], the encoded [BlockEvent] of a block that was just
+// accepted, for every URL. It never blocks; if a URL's queue is full, the
+// payload is dead-lettered for that URL.
+func (w *webhooks) notify(body []byte) {
+	for i, queue := range w.queues {
+		select {
+		case queue <- body:
+		default:
+			w.deadLetter(w.config.URLs[i], body, errWebhookQueueFull)
+		}
+	}
+}
+
+// stop stops sending payloads. Payloads that weren't sent are dead-lettered.
+func (w *webhooks) stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// run sends the payloads in [queue] to [u] until stop is called
+func (w *webhooks) run(u string, queue chan []byte) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.ctx.Done():
+			for {
+				select {
+				case body := <-queue:
+					w.deadLetter(u, body, w.ctx.Err())
+				default:
+					return
+				}
+			}
+		case body := <-queue:
+			if err := w.send(u, body); err != nil {
+				w.deadLetter(u, body, err)
+			}
+		}
+	}
+}
+
+// send POSTs [body] to [u], retrying with exponential backoff until it
+// succeeds, [w.config.MaxAttempts] attempts fail or stop is called
+func (w *webhooks) send(u string, body []byte) error {
+	signature := SignWebhookPayload(w.config.Secret, body)
+	delay := w.config.RetryDelay.Duration
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = w.post(u, body, signature); err == nil {
+			return nil
+		}
+		if attempt == w.config.MaxAttempts {
+			return err
+		}
+		w.log.Debug("retrying webhook",
+			zap.String("url", u),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-w.ctx.Done():
+			return err
+		}
+	}
+}
+
+// post makes one attempt to POST [body] to [u]
+func (w *webhooks) post(u string, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: %d", errWebhookStatus, resp.StatusCode)
+	}
+	return nil
+}
+
+// deadLetter records that [body] couldn't be sent to [u] because of [err]
+func (w *webhooks) deadLetter(u string, body []byte, err error) {
+	w.log.Warn("couldn't send webhook",
+		zap.String("url", u),
+		zap.ByteString("payload", body),
+		zap.Error(err),
+	)
+	if w.config.DeadLetterPath == "" {
+		return
+	}
+
+	line, marshalErr := json.Marshal(deadLetter{
+		URL:     u,
+		Payload: body,
+		Error:   err.Error(),
+		Time:    time.Now(),
+	})
+	if marshalErr != nil {
+		return
+	}
+	w.deadLetterLock.Lock()
+	defer w.deadLetterLock.Unlock()
+
+	f, fileErr := os.OpenFile(w.config.DeadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if fileErr == nil {
+		_, fileErr = f.Write(append(line, '\n'))
+		fileErr = errors.Join(fileErr, f.Close())
+	}
+	if fileErr != nil {
+		w.log.Error("couldn't write webhook dead letter",
+			zap.String("path", w.config.DeadLetterPath),
+			zap.Error(fileErr),
+		)
+	}
+}